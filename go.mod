@@ -7,18 +7,21 @@ toolchain go1.24.12
 require (
 	github.com/blang/semver v3.5.1+incompatible
 	github.com/google/uuid v1.6.0
+	github.com/joho/godotenv v1.5.1
 	github.com/miekg/dns v1.1.72
 	github.com/minio/selfupdate v0.6.0
+	github.com/pkg/sftp v1.13.10
 	github.com/prometheus-community/pro-bing v0.7.0
+	golang.org/x/crypto v0.47.0
+	golang.org/x/image v0.25.0
+	golang.org/x/net v0.49.0
+	golang.org/x/sys v0.40.0
 )
 
 require (
 	aead.dev/minisign v0.2.0 // indirect
-	github.com/joho/godotenv v1.5.1 // indirect
-	golang.org/x/crypto v0.47.0 // indirect
+	github.com/kr/fs v0.1.0 // indirect
 	golang.org/x/mod v0.31.0 // indirect
-	golang.org/x/net v0.49.0 // indirect
 	golang.org/x/sync v0.19.0 // indirect
-	golang.org/x/sys v0.40.0 // indirect
 	golang.org/x/tools v0.40.0 // indirect
 )
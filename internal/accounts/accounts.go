@@ -0,0 +1,450 @@
+// Package accounts stores the device's user accounts and their API
+// credentials. It is a single JSON file; the number of users on one box is
+// small enough that anything fancier would be overkill.
+package accounts
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/errs"
+	"github.com/strct-org/strct-agent/internal/fsx"
+)
+
+const (
+	OpOpen   errs.Op = "accounts.Open"
+	OpCreate errs.Op = "accounts.Create"
+	OpUpdate errs.Op = "accounts.Update"
+	OpSave   errs.Op = "accounts.save"
+	OpHTTP   errs.Op = "accounts.HandleAccounts"
+)
+
+// Account is one user of the device. Its storage is the set of top-level
+// folders it owns; QuotaBytes caps their combined size (0 means unlimited).
+type Account struct {
+	Name       string    `json:"name"`
+	AccessKey  string    `json:"accessKey"`
+	SecretKey  string    `json:"secretKey"`
+	Admin      bool      `json:"admin"`
+	QuotaBytes int64     `json:"quotaBytes"`
+	Folders    []string  `json:"folders"`
+	CreatedAt  time.Time `json:"createdAt"`
+}
+
+// Public is the view returned by the API; the secret is only ever shown once,
+// in the response to Create.
+type Public struct {
+	Name       string    `json:"name"`
+	AccessKey  string    `json:"accessKey"`
+	Admin      bool      `json:"admin"`
+	QuotaBytes int64     `json:"quotaBytes"`
+	Folders    []string  `json:"folders"`
+	CreatedAt  time.Time `json:"createdAt"`
+}
+
+type Store struct {
+	Path string
+
+	mu       sync.RWMutex
+	accounts map[string]*Account // by name
+}
+
+var validName = regexp.MustCompile(`^[a-z0-9][a-z0-9_.-]{0,31}$`)
+
+func Open(path string) (*Store, error) {
+	s := &Store{Path: path, accounts: make(map[string]*Account)}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return s, nil
+		}
+		return nil, errs.E(OpOpen, errs.KindIO, err)
+	}
+
+	var list []*Account
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, errs.E(OpOpen, errs.KindIO, err, "corrupt accounts file")
+	}
+	for _, a := range list {
+		s.accounts[a.Name] = a
+	}
+	return s, nil
+}
+
+func (s *Store) Create(name string, admin bool) (Account, error) {
+	return s.create(name, admin, false)
+}
+
+// CreateFirstAdmin creates the admin account a new device is set up with,
+// and refuses once there is one. The check and the insert happen under the
+// same lock, so two setup requests racing each other cannot both get in.
+func (s *Store) CreateFirstAdmin(name string) (Account, error) {
+	return s.create(name, true, true)
+}
+
+func (s *Store) create(name string, admin, first bool) (Account, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if !validName.MatchString(name) {
+		return Account{}, errs.E(OpCreate, errs.KindInvalid, "name must be 1-32 lowercase letters, digits, '.', '_' or '-'")
+	}
+
+	access, err := randomKey(15)
+	if err != nil {
+		return Account{}, errs.E(OpCreate, errs.KindSystem, err)
+	}
+	secret, err := randomKey(30)
+	if err != nil {
+		return Account{}, errs.E(OpCreate, errs.KindSystem, err)
+	}
+
+	a := &Account{
+		Name:      name,
+		AccessKey: strings.ToUpper(access),
+		SecretKey: secret,
+		Admin:     admin,
+		CreatedAt: time.Now().UTC(),
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if first && s.admins() > 0 {
+		return Account{}, errs.E(OpCreate, errs.KindUnauthorized, "sign in with an admin account's access key and secret")
+	}
+	if _, exists := s.accounts[name]; exists {
+		return Account{}, errs.E(OpCreate, errs.KindInvalid, fmt.Sprintf("account %q already exists", name))
+	}
+	s.accounts[name] = a
+	if err := s.save(); err != nil {
+		delete(s.accounts, name)
+		return Account{}, err
+	}
+	return *a, nil
+}
+
+func (s *Store) Delete(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	a, ok := s.accounts[name]
+	if !ok {
+		return errs.E(OpHTTP, errs.KindNotFound, "account not found")
+	}
+	// Without an admin the next account could be created by anyone
+	if a.Admin && s.admins() == 1 {
+		return errs.E(OpHTTP, errs.KindInvalid, "cannot delete the last admin account")
+	}
+	delete(s.accounts, name)
+	if err := s.save(); err != nil {
+		s.accounts[name] = a
+		return err
+	}
+	return nil
+}
+
+// Update changes an account's quota and, if folders is non-nil, the set of
+// top-level folders it owns. A folder has at most one owner; assigning it
+// here takes it away from whoever had it.
+func (s *Store) Update(name string, quota int64, folders []string) (Account, error) {
+	if quota < 0 {
+		return Account{}, errs.E(OpUpdate, errs.KindInvalid, "quotaBytes cannot be negative")
+	}
+	for _, f := range folders {
+		if !validFolder(f) {
+			return Account{}, errs.E(OpUpdate, errs.KindInvalid, fmt.Sprintf("%q is not a top-level folder name", f))
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	a, ok := s.accounts[name]
+	if !ok {
+		return Account{}, errs.E(OpUpdate, errs.KindNotFound, "account not found")
+	}
+	before := make(map[string]Account, len(s.accounts))
+	for n, acct := range s.accounts {
+		c := *acct
+		c.Folders = slices.Clone(acct.Folders)
+		before[n] = c
+	}
+
+	a.QuotaBytes = quota
+	if folders != nil {
+		for _, f := range folders {
+			s.release(f)
+		}
+		a.Folders = append([]string(nil), folders...)
+		sort.Strings(a.Folders)
+	}
+
+	if err := s.save(); err != nil {
+		for n, acct := range before {
+			*s.accounts[n] = acct
+		}
+		return Account{}, err
+	}
+	return *a, nil
+}
+
+// Claim records name as the owner of a top-level folder unless someone
+// already owns it. Used when an account creates a bucket.
+func (s *Store) Claim(name, folder string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	a, ok := s.accounts[name]
+	if !ok || !validFolder(folder) {
+		return nil
+	}
+	for _, other := range s.accounts {
+		if slices.Contains(other.Folders, folder) {
+			return nil
+		}
+	}
+	a.Folders = append(a.Folders, folder)
+	sort.Strings(a.Folders)
+	return s.save()
+}
+
+// Owner returns the account owning a top-level folder, if any.
+func (s *Store) Owner(folder string) (Account, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, a := range s.accounts {
+		if slices.Contains(a.Folders, folder) {
+			return *a, true
+		}
+	}
+	return Account{}, false
+}
+
+// release must be called with mu held.
+func (s *Store) release(folder string) {
+	for _, a := range s.accounts {
+		a.Folders = slices.DeleteFunc(a.Folders, func(f string) bool { return f == folder })
+	}
+}
+
+func validFolder(f string) bool {
+	return f != "" && f != "." && f != ".." && !strings.ContainsAny(f, `/\`)
+}
+
+func (s *Store) Get(name string) (Account, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	a, ok := s.accounts[name]
+	if !ok {
+		return Account{}, false
+	}
+	return *a, true
+}
+
+func (s *Store) ByAccessKey(key string) (Account, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, a := range s.accounts {
+		if a.AccessKey == key {
+			return *a, true
+		}
+	}
+	return Account{}, false
+}
+
+func (s *Store) List() []Account {
+	s.mu.RLock()
+	list := make([]Account, 0, len(s.accounts))
+	for _, a := range s.accounts {
+		list = append(list, *a)
+	}
+	s.mu.RUnlock()
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// admins must be called with mu held.
+func (s *Store) admins() int {
+	n := 0
+	for _, a := range s.accounts {
+		if a.Admin {
+			n++
+		}
+	}
+	return n
+}
+
+// Authenticate returns the account whose access key and secret r carries
+// as HTTP Basic credentials.
+func (s *Store) Authenticate(r *http.Request) (Account, bool) {
+	access, secret, ok := r.BasicAuth()
+	if !ok {
+		return Account{}, false
+	}
+	a, ok := s.ByAccessKey(access)
+	if !ok || subtle.ConstantTimeCompare([]byte(a.SecretKey), []byte(secret)) != 1 {
+		return Account{}, false
+	}
+	return a, true
+}
+
+// authorize lets admins manage accounts. Until there is one, the only
+// thing allowed is creating the first admin, which is how a new device
+// is set up.
+func (s *Store) authorize(r *http.Request) error {
+	if a, ok := s.Authenticate(r); ok {
+		if a.Admin {
+			return nil
+		}
+		return errs.E(OpHTTP, errs.KindForbidden, "only an admin can manage accounts")
+	}
+	s.mu.RLock()
+	setup := s.admins() == 0
+	s.mu.RUnlock()
+	if setup && r.Method == http.MethodPost {
+		return nil
+	}
+	return errs.E(OpHTTP, errs.KindUnauthorized, "sign in with an admin account's access key and secret")
+}
+
+// save must be called with mu held.
+func (s *Store) save() error {
+	list := make([]*Account, 0, len(s.accounts))
+	for _, a := range s.accounts {
+		list = append(list, a)
+	}
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return errs.E(OpSave, errs.KindIO, err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.Path), 0700); err != nil {
+		return errs.E(OpSave, errs.KindIO, err)
+	}
+	// Secrets live in here: owner read/write only
+	if err := fsx.WriteFile(s.Path, data, 0600); err != nil {
+		return errs.E(OpSave, errs.KindIO, err)
+	}
+	return nil
+}
+
+func randomKey(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func (a Account) Public() Public {
+	return Public{
+		Name:       a.Name,
+		AccessKey:  a.AccessKey,
+		Admin:      a.Admin,
+		QuotaBytes: a.QuotaBytes,
+		Folders:    a.Folders,
+		CreatedAt:  a.CreatedAt,
+	}
+}
+
+// HandleAccounts lists (GET), creates (POST), updates quota and folders
+// (PATCH) and deletes (DELETE ?name=) accounts. Callers sign in with an
+// admin account's access key and secret as Basic credentials.
+func (s *Store) HandleAccounts(w http.ResponseWriter, r *http.Request) {
+	if err := s.authorize(r); err != nil {
+		w.Header().Set("WWW-Authenticate", `Basic realm="strct"`)
+		errs.HTTPResponse(w, err)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		list := s.List()
+		out := make([]Public, 0, len(list))
+		for _, a := range list {
+			out = append(out, a.Public())
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string][]Public{"accounts": out})
+
+	case http.MethodPost:
+		var req struct {
+			Name  string `json:"name"`
+			Admin bool   `json:"admin"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			errs.HTTPResponse(w, errs.E(OpHTTP, errs.KindInvalid, "Invalid JSON"))
+			return
+		}
+		var a Account
+		var err error
+		switch _, signedIn := s.Authenticate(r); {
+		case signedIn:
+			a, err = s.Create(req.Name, req.Admin)
+		case req.Admin:
+			a, err = s.CreateFirstAdmin(req.Name)
+		default:
+			err = errs.E(OpHTTP, errs.KindInvalid, "the first account must be an admin")
+		}
+		if err != nil {
+			errs.HTTPResponse(w, err)
+			return
+		}
+		log.Printf("[ACCOUNTS] Created account %s (admin: %v)", a.Name, a.Admin)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(a)
+
+	case http.MethodPatch:
+		var req struct {
+			Name       string   `json:"name"`
+			QuotaBytes *int64   `json:"quotaBytes"`
+			Folders    []string `json:"folders"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			errs.HTTPResponse(w, errs.E(OpHTTP, errs.KindInvalid, "Invalid JSON"))
+			return
+		}
+		current, ok := s.Get(req.Name)
+		if !ok {
+			errs.HTTPResponse(w, errs.E(OpHTTP, errs.KindNotFound, "account not found"))
+			return
+		}
+		quota := current.QuotaBytes
+		if req.QuotaBytes != nil {
+			quota = *req.QuotaBytes
+		}
+		a, err := s.Update(req.Name, quota, req.Folders)
+		if err != nil {
+			errs.HTTPResponse(w, err)
+			return
+		}
+		log.Printf("[ACCOUNTS] Updated account %s (quota: %d bytes, folders: %v)", a.Name, a.QuotaBytes, a.Folders)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(a.Public())
+
+	case http.MethodDelete:
+		if err := s.Delete(r.URL.Query().Get("name")); err != nil {
+			errs.HTTPResponse(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"status": "deleted"})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,102 @@
+package accounts
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestHandleAccountsNeedsAdmin(t *testing.T) {
+	s, err := Open(filepath.Join(t.TempDir(), "accounts.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	call := func(method, target, body string, as *Account) int {
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		if as != nil {
+			r.SetBasicAuth(as.AccessKey, as.SecretKey)
+		}
+		w := httptest.NewRecorder()
+		s.HandleAccounts(w, r)
+		return w.Code
+	}
+
+	// A new device only lets the first admin be created
+	if code := call(http.MethodPost, "/api/accounts", `{"name":"alice"}`, nil); code != http.StatusBadRequest {
+		t.Errorf("first account without admin: %d", code)
+	}
+	if code := call(http.MethodGet, "/api/accounts", "", nil); code != http.StatusUnauthorized {
+		t.Errorf("list before setup: %d", code)
+	}
+	if code := call(http.MethodPost, "/api/accounts", `{"name":"owner","admin":true}`, nil); code != http.StatusCreated {
+		t.Fatalf("first admin: %d", code)
+	}
+	admin, _ := s.Get("owner")
+	if _, err := s.CreateFirstAdmin("late"); err == nil {
+		t.Error("a second first admin was created")
+	}
+	user, err := s.Create("bob", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrong := admin
+	wrong.SecretKey = "guess"
+
+	tests := []struct {
+		name   string
+		method string
+		target string
+		body   string
+		as     *Account
+		want   int
+	}{
+		{"second admin without credentials", "POST", "/api/accounts", `{"name":"mallory","admin":true}`, nil, http.StatusUnauthorized},
+		{"wrong secret", "GET", "/api/accounts", "", &wrong, http.StatusUnauthorized},
+		{"list as a user", "GET", "/api/accounts", "", &user, http.StatusForbidden},
+		{"raise own quota", "PATCH", "/api/accounts", `{"name":"bob","quotaBytes":0}`, &user, http.StatusForbidden},
+		{"delete as a user", "DELETE", "/api/accounts?name=owner", "", &user, http.StatusForbidden},
+		{"list as admin", "GET", "/api/accounts", "", &admin, http.StatusOK},
+		{"update as admin", "PATCH", "/api/accounts", `{"name":"bob","quotaBytes":1024}`, &admin, http.StatusOK},
+		{"delete the last admin", "DELETE", "/api/accounts?name=owner", "", &admin, http.StatusBadRequest},
+		{"delete as admin", "DELETE", "/api/accounts?name=bob", "", &admin, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if code := call(tt.method, tt.target, tt.body, tt.as); code != tt.want {
+				t.Errorf("status %d, want %d", code, tt.want)
+			}
+		})
+	}
+}
+
+func TestCreateFirstAdminRace(t *testing.T) {
+	s, err := Open(filepath.Join(t.TempDir(), "accounts.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	created := 0
+	for i := range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r := httptest.NewRequest(http.MethodPost, "/api/accounts", strings.NewReader(fmt.Sprintf(`{"name":"admin%d","admin":true}`, i)))
+			w := httptest.NewRecorder()
+			s.HandleAccounts(w, r)
+			if w.Code == http.StatusCreated {
+				mu.Lock()
+				created++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if created != 1 || len(s.List()) != 1 {
+		t.Errorf("%d setup requests succeeded, %d accounts", created, len(s.List()))
+	}
+}
@@ -1,21 +1,30 @@
 package agent
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"path/filepath"
 	"sync"
 	"time"
 
 	_ "net/http/pprof"
 
+	"github.com/strct-org/strct-agent/internal/accounts"
 	"github.com/strct-org/strct-agent/internal/api"
 	"github.com/strct-org/strct-agent/internal/config"
 	"github.com/strct-org/strct-agent/internal/errs"
+	"github.com/strct-org/strct-agent/internal/features/backup"
 	"github.com/strct-org/strct-agent/internal/features/cloud"
+	"github.com/strct-org/strct-agent/internal/features/importer"
 	monitor "github.com/strct-org/strct-agent/internal/features/network_monitor"
+	"github.com/strct-org/strct-agent/internal/features/peer"
+	"github.com/strct-org/strct-agent/internal/features/s3"
+	"github.com/strct-org/strct-agent/internal/features/storage"
 	"github.com/strct-org/strct-agent/internal/network/dns"
 	"github.com/strct-org/strct-agent/internal/network/tunnel"
+	"github.com/strct-org/strct-agent/internal/platform/disk"
 	"github.com/strct-org/strct-agent/internal/platform/wifi"
 	"github.com/strct-org/strct-agent/internal/setup"
 )
@@ -23,14 +32,20 @@ import (
 const (
 	OpAgentInit    errs.Op = "agent.Initialize"
 	OpSetupCloud   errs.Op = "agent.setupCloud"
+	OpSetupAccts   errs.Op = "agent.setupAccounts"
+	OpUnlockDisk   errs.Op = "agent.unlockStorage"
 	OpCheckConn    errs.Op = "agent.ensureConnectivity"
 	OpStartHotspot errs.Op = "agent.runSetupWizard"
 )
 
+// apiPort is where the API listens, and the unlock page before it.
+const apiPort = 8080
+
 type Agent struct {
-	Wifi    wifi.Provider
-	Runners []Runner
-	Config  *config.Config
+	Wifi     wifi.Provider
+	Runners  []Runner
+	Config   *config.Config
+	Accounts *accounts.Store
 }
 
 type HTTPFeature interface {
@@ -76,31 +91,126 @@ func (a *Agent) Initialize() error {
 		return errs.E(OpAgentInit, err)
 	}
 
+	accts, err := accounts.Open(filepath.Join(a.Config.StateDir, "accounts.json"))
+	if err != nil {
+		return errs.E(OpSetupAccts, errs.KindIO, err)
+	}
+	a.Accounts = accts
+
+	keys := disk.NewKeyStore(filepath.Join(a.Config.StateDir, "disk"))
+	a.unlockStorage(keys)
+
 	cloud, err := a.setupCloud()
 	if err != nil {
 		return errs.E(OpAgentInit, err)
 	}
+	storageSvc := storage.New(cloud.Disk, keys)
+	storageSvc.Switcher = cloud
+	storageSvc.Ejector = cloud
+	storageSvc.Checker = disk.NewChecker(keys.Dir)
+	if a.Config.IsDev {
+		// Nothing is really mounted, so the drive "is" the data folder
+		storageSvc.Open = func(device string, progress func(string)) disk.Manager {
+			return &disk.MockDisk{VirtualPath: device, Progress: progress}
+		}
+		storageSvc.OpenMirror = func(devices []string, progress func(string)) disk.Manager {
+			return &disk.MockDisk{VirtualPath: devices[0], Progress: progress}
+		}
+		storageSvc.MountPoint = cloud.DataDir
+	}
+	backups, err := backup.NewManager(cloud.DataDir, filepath.Join(a.Config.StateDir, "backup", "jobs.json"), cloud)
+	if err != nil {
+		return errs.E(OpAgentInit, errs.KindIO, err, "failed to load backup jobs")
+	}
+	// Peers reach this device through the tunnel's subdomain
+	peers, err := peer.NewManager(peer.Config{
+		DeviceID: a.Config.DeviceID,
+		URL:      "https://" + a.Config.DeviceID + "." + a.Config.Domain,
+		DataDir:  cloud.DataDir,
+		StateDir: a.Config.StateDir,
+	}, cloud.GetRoutes(), cloud)
+	if err != nil {
+		return errs.E(OpAgentInit, errs.KindIO, err, "failed to load peers")
+	}
+	imports, err := importer.NewManager(cloud.DataDir, a.Config.StateDir, cloud)
+	if err != nil {
+		return errs.E(OpAgentInit, errs.KindIO, err, "failed to load import rules")
+	}
+	hotplug := disk.NewHotplug()
+	imports.Events = hotplug.Subscribe()
+	imports.Tick = 30 * time.Second
+	cloud.Pool.Events = hotplug.Subscribe()
 	monitor := a.setupMonitor()
-
-	apiSvc := a.assembleAPIServer(cloud, monitor)
+	health, err := storage.NewHealthMonitor(filepath.Join(a.Config.StateDir, "disk", "health.json"))
+	if err != nil {
+		return errs.E(OpAgentInit, errs.KindIO, err, "failed to load drive health")
+	}
+	health.Events = hotplug.Subscribe()
+	health.Report = func(r storage.HealthReport) { monitor.Report("drive_health", r) }
+	monitor.Checks = append(monitor.Checks, health, storageSvc)
+
+	apiSvc := a.assembleAPIServer(cloud, backups, peers, imports, storageSvc, health, monitor)
+	s3Svc := s3.New(s3.Config{
+		DataDir:  cloud.DataDir,
+		StateDir: a.Config.StateDir,
+		Port:     a.Config.S3Port,
+	}, a.Accounts, cloud)
 	tunnelSvc := tunnel.New(a.Config)
 	dnsSvc := dns.NewAdBlocker(":63")
 	profilerSvc := &ProfilerService{
 		Port: a.Config.PprofPort,
 	}
 	a.Runners = []Runner{
+		hotplug,
+		cloud.Pool,
+		storageSvc,
+		health,
+		cloud.Walker, // starts Index, Usage, Media and Journal first
+		cloud.Thumbs,
+		cloud.Analysis,
+		backups,
+		peers,
+		imports,
 		monitor,
 		tunnelSvc,
 		dnsSvc,
 		apiSvc,
+		s3Svc,
 		profilerSvc,
 	}
 
 	return nil
 }
 
+// unlockStorage opens encrypted data drives before the cloud mounts one.
+// A drive that also needs the user's passphrase holds boot until it is
+// given on the local network.
+func (a *Agent) unlockStorage(keys *disk.KeyStore) {
+	for _, d := range disk.NewDataDrive(keys.Dir).Candidates() {
+		path := d.DevicePath
+		if !d.IsEncrypted() || d.IsUnlocked() {
+			continue
+		}
+		err := keys.Unlock(d, "")
+		if errors.Is(err, disk.ErrPassphraseRequired) {
+			err = storage.New(d, keys).WaitForUnlock(fmt.Sprintf(":%d", apiPort))
+		}
+		if err != nil {
+			log.Printf("[STORAGE] Could not unlock %s: %v", path, errs.E(OpUnlockDisk, errs.KindSystem, err))
+			continue
+		}
+		log.Printf("[STORAGE] Unlocked %s", path)
+	}
+}
+
 func (a *Agent) setupCloud() (*cloud.Cloud, error) {
-	c := cloud.New(a.Config.DataDir, 8080, a.Config.IsDev)
+	c := cloud.New(a.Config.DataDir, a.Config.StateDir, apiPort, a.Config.IsDev)
+	c.Accounts = a.Accounts
+	if a.Config.IsDev {
+		// The mock drive is the data folder itself; there is nothing to unmount
+		c.Bind = func(src, dst string) error { return nil }
+		c.Unmount = func(dir string) error { return nil }
+	}
 	if err := c.InitFileSystem(); err != nil {
 		return nil, errs.E(OpSetupCloud, errs.KindIO, err, "failed to initialize cloud storage")
 	}
@@ -120,12 +230,28 @@ func (a *Agent) setupMonitor() *monitor.NetworkMonitor {
 	})
 }
 
-func (a *Agent) assembleAPIServer(cloud *cloud.Cloud, monitorFeat *monitor.NetworkMonitor) *APIService {
+func (a *Agent) assembleAPIServer(cloud *cloud.Cloud, backups *backup.Manager, peers *peer.Manager, imports *importer.Manager, storageSvc *storage.Manager, health *storage.HealthMonitor, monitorFeat *monitor.NetworkMonitor) *APIService {
 	routes := cloud.GetRoutes()
+	for path, h := range backups.GetRoutes() {
+		routes[path] = h
+	}
+	for path, h := range peers.GetRoutes() {
+		routes[path] = h
+	}
+	for path, h := range imports.GetRoutes() {
+		routes[path] = h
+	}
+	for path, h := range storageSvc.GetRoutes() {
+		routes[path] = h
+	}
+	for path, h := range health.GetRoutes() {
+		routes[path] = h
+	}
 
 	routes["/api/network/stats"] = monitorFeat.HandleStats
 	routes["/api/network/speedtest"] = monitorFeat.HandleSpeedtest
 	routes["/api/health"] = monitorFeat.HandleHealth
+	routes["/api/accounts"] = a.Accounts.HandleAccounts
 
 	return &APIService{
 		Config: api.Config{
@@ -69,7 +69,9 @@ func corsMiddleware(next http.Handler) http.Handler {
 			w.Header().Set("Access-Control-Allow-Credentials", "true")
 		}
 
-		if r.Method == "OPTIONS" {
+		// Only answer CORS preflights here; a plain OPTIONS is how WebDAV
+		// clients discover the server and has to reach the handler.
+		if r.Method == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") != "" {
 			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
 			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Requested-With, Range")
 			w.Header().Set("Access-Control-Max-Age", "3600")
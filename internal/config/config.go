@@ -16,9 +16,11 @@ type Config struct {
 	VPSIP      string
 	AuthToken  string
 	DataDir    string
+	StateDir   string
 	BackendURL string
 	VPSPort    int
 	PprofPort  int
+	S3Port     int
 	IsDev      bool
 }
 
@@ -38,12 +40,15 @@ func Load() *Config {
 		AuthToken: getEnv("AUTH_TOKEN", "default-secret"),
 		Domain:    getEnv("DOMAIN", "localhost"),
 		PprofPort: getEnvAsInt("PPROF_PORT", 6060),
+		S3Port:    getEnvAsInt("S3_PORT", 9000),
 	}
 
 	if cfg.IsArm64() {
 		cfg.DataDir = "/mnt/data"
+		cfg.StateDir = "/var/lib/strct"
 	} else {
 		cfg.DataDir = "./data"
+		cfg.StateDir = "./state"
 	}
 
 	cfg.DeviceID = getOrGenerateDeviceID(cfg.IsDev)
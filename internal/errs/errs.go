@@ -17,6 +17,9 @@ const (
  KindUnauthorized // Auth token missing/invalid
  KindNotFound // File or Route not found
  KindSystem // OS level failures (exec, mounting)
+ KindQuota // Storage quota or free space exhausted
+ KindForbidden // Caller may not touch this resource
+ KindBusy // Too much work queued right now; try again shortly
 )
 
 type Op string
@@ -91,6 +94,12 @@ func HTTPResponse(w http.ResponseWriter, err error) {
    code = http.StatusUnauthorized
   case KindNotFound:
    code = http.StatusNotFound
+  case KindForbidden:
+   code = http.StatusForbidden
+  case KindQuota:
+   code = http.StatusInsufficientStorage
+  case KindBusy:
+   code = http.StatusServiceUnavailable
   case KindIO, KindSystem:
    code = http.StatusInternalServerError
   }
@@ -0,0 +1,438 @@
+// Package exif reads the handful of metadata fields the agent cares about:
+// EXIF and XMP from JPEG files and the movie header of MP4/MOV containers.
+// It is deliberately tiny: no maker notes, no thumbnails, no writing.
+package exif
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"strings"
+	"time"
+)
+
+var ErrNoExif = errors.New("exif: no exif data")
+
+const (
+	tagImageWidth    = 0x0100
+	tagImageLength   = 0x0101
+	tagMake          = 0x010F
+	tagModel         = 0x0110
+	tagOrientation   = 0x0112
+	tagDateTime      = 0x0132
+	tagExifIFD       = 0x8769
+	tagGPSIFD        = 0x8825
+	tagDateOriginal  = 0x9003
+	tagOffsetOrig    = 0x9011
+	tagPixelX        = 0xA002
+	tagPixelY        = 0xA003
+	tagGPSLatRef     = 0x0001
+	tagGPSLat        = 0x0002
+	tagGPSLonRef     = 0x0003
+	tagGPSLon        = 0x0004
+	tagGPSAltRef     = 0x0005
+	tagGPSAlt        = 0x0006
+	exifTimeLayout   = "2006:01:02 15:04:05"
+	xmpSegmentPrefix = "http://ns.adobe.com/xap/1.0/\x00"
+)
+
+// Data holds the decoded tags. Zero values mean "not present".
+type Data struct {
+	Orientation int
+	Make        string
+	Model       string
+	// Taken is the capture time. Cameras rarely record a zone; without one
+	// the wall clock time is returned as UTC.
+	Taken    time.Time
+	Width    int
+	Height   int
+	GPS      *GPS
+	Duration time.Duration // videos only
+}
+
+// GPS is a position in decimal degrees; Alt is meters above sea level.
+type GPS struct {
+	Lat float64 `json:"lat"`
+	Lon float64 `json:"lon"`
+	Alt float64 `json:"alt,omitempty"`
+}
+
+// Fill copies every field o has and d lacks.
+func (d *Data) Fill(o *Data) {
+	if o == nil {
+		return
+	}
+	if d.Orientation == 0 {
+		d.Orientation = o.Orientation
+	}
+	if d.Make == "" {
+		d.Make = o.Make
+	}
+	if d.Model == "" {
+		d.Model = o.Model
+	}
+	if d.Taken.IsZero() {
+		d.Taken = o.Taken
+	}
+	if d.Width == 0 || d.Height == 0 {
+		d.Width, d.Height = o.Width, o.Height
+	}
+	if d.GPS == nil {
+		d.GPS = o.GPS
+	}
+	if d.Duration == 0 {
+		d.Duration = o.Duration
+	}
+}
+
+// maxSegment bounds how much we are willing to buffer for a single APP1
+// segment; the JPEG format caps it at 64KiB anyway.
+const maxSegment = 1 << 16
+
+// Decode scans the JPEG markers in r for the Exif and XMP APP1 segments and
+// the frame header. It stops at the start of the image data, so only the
+// header is read. EXIF wins over XMP where both carry a field.
+func Decode(r io.Reader) (*Data, error) {
+	br := bufio.NewReader(r)
+
+	var soi [2]byte
+	if _, err := io.ReadFull(br, soi[:]); err != nil {
+		return nil, err
+	}
+	if soi[0] != 0xFF || soi[1] != 0xD8 {
+		return nil, errors.New("exif: not a jpeg")
+	}
+
+	var exifData, xmpData *Data
+	var frame Data
+	for {
+		marker, err := nextMarker(br)
+		if err != nil {
+			return nil, err
+		}
+
+		// Start of scan / end of image: metadata would have come before this
+		if marker == 0xDA || marker == 0xD9 {
+			break
+		}
+		// Standalone markers carry no length
+		if marker == 0x01 || (marker >= 0xD0 && marker <= 0xD7) {
+			continue
+		}
+
+		var l [2]byte
+		if _, err := io.ReadFull(br, l[:]); err != nil {
+			return nil, err
+		}
+		size := int(binary.BigEndian.Uint16(l[:])) - 2
+		if size < 0 {
+			return nil, errors.New("exif: bad segment length")
+		}
+
+		wanted := marker == 0xE1 || isFrameMarker(marker)
+		if !wanted || (marker == 0xE1 && exifData != nil && xmpData != nil) {
+			if _, err := br.Discard(size); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		seg := make([]byte, min(size, maxSegment))
+		if _, err := io.ReadFull(br, seg); err != nil {
+			return nil, err
+		}
+
+		switch {
+		case isFrameMarker(marker):
+			// precision(1) height(2) width(2)
+			if len(seg) >= 5 {
+				frame.Height = int(binary.BigEndian.Uint16(seg[1:]))
+				frame.Width = int(binary.BigEndian.Uint16(seg[3:]))
+			}
+		case bytes.HasPrefix(seg, []byte("Exif\x00\x00")) && exifData == nil:
+			if exifData, err = parseTIFF(seg[6:]); err != nil {
+				return nil, err
+			}
+		case bytes.HasPrefix(seg, []byte(xmpSegmentPrefix)) && xmpData == nil:
+			xmpData = parseXMP(seg[len(xmpSegmentPrefix):])
+		}
+	}
+
+	if exifData == nil && xmpData == nil && frame.Width == 0 {
+		return nil, ErrNoExif
+	}
+	d := &Data{}
+	d.Fill(exifData)
+	d.Fill(xmpData)
+	d.Fill(&frame)
+	return d, nil
+}
+
+// isFrameMarker reports whether m is a SOFn marker (not DHT, JPG or DAC,
+// which share the range).
+func isFrameMarker(m byte) bool {
+	return m >= 0xC0 && m <= 0xCF && m != 0xC4 && m != 0xC8 && m != 0xCC
+}
+
+func nextMarker(br *bufio.Reader) (byte, error) {
+	b, err := br.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	if b != 0xFF {
+		return 0, errors.New("exif: corrupt marker")
+	}
+	// Markers may be padded with any number of 0xFF bytes
+	for b == 0xFF {
+		if b, err = br.ReadByte(); err != nil {
+			return 0, err
+		}
+	}
+	return b, nil
+}
+
+type tiff struct {
+	buf   []byte
+	order binary.ByteOrder
+}
+
+type entry struct {
+	tag   uint16
+	typ   uint16
+	count uint32
+	raw   []byte // the 4 byte value/offset field
+}
+
+// Sizes of the TIFF field types we read, indexed by type.
+var typeSize = map[uint16]int{1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 7: 1, 9: 4, 10: 8}
+
+func parseTIFF(buf []byte) (*Data, error) {
+	if len(buf) < 8 {
+		return nil, ErrNoExif
+	}
+
+	t := &tiff{buf: buf}
+	switch string(buf[:2]) {
+	case "II":
+		t.order = binary.LittleEndian
+	case "MM":
+		t.order = binary.BigEndian
+	default:
+		return nil, errors.New("exif: bad byte order")
+	}
+	if t.order.Uint16(buf[2:]) != 42 {
+		return nil, errors.New("exif: bad tiff magic")
+	}
+
+	entries, err := t.ifd(t.order.Uint32(buf[4:]))
+	if err != nil {
+		return nil, err
+	}
+
+	d := &Data{}
+	var dateTime, original, offset string
+	var exifOff, gpsOff uint32
+	for _, e := range entries {
+		switch e.tag {
+		case tagOrientation:
+			d.Orientation = int(t.short(e))
+		case tagMake:
+			d.Make = t.ascii(e)
+		case tagModel:
+			d.Model = t.ascii(e)
+		case tagDateTime:
+			dateTime = t.ascii(e)
+		case tagImageWidth:
+			d.Width = int(t.uint(e))
+		case tagImageLength:
+			d.Height = int(t.uint(e))
+		case tagExifIFD:
+			exifOff = t.uint(e)
+		case tagGPSIFD:
+			gpsOff = t.uint(e)
+		}
+	}
+
+	// Sub-IFDs are optional; a broken one should not cost us IFD0
+	if exifOff != 0 {
+		if sub, err := t.ifd(exifOff); err == nil {
+			for _, e := range sub {
+				switch e.tag {
+				case tagDateOriginal:
+					original = t.ascii(e)
+				case tagOffsetOrig:
+					offset = t.ascii(e)
+				case tagPixelX:
+					d.Width = int(t.uint(e))
+				case tagPixelY:
+					d.Height = int(t.uint(e))
+				}
+			}
+		}
+	}
+	if gpsOff != 0 {
+		if sub, err := t.ifd(gpsOff); err == nil {
+			d.GPS = t.gps(sub)
+		}
+	}
+
+	if original == "" {
+		original = dateTime
+	}
+	d.Taken = parseExifTime(original, offset)
+	return d, nil
+}
+
+func (t *tiff) ifd(off uint32) ([]entry, error) {
+	if int(off)+2 > len(t.buf) {
+		return nil, errors.New("exif: ifd out of range")
+	}
+	n := int(t.order.Uint16(t.buf[off:]))
+	p := int(off) + 2
+	if p+n*12 > len(t.buf) {
+		return nil, errors.New("exif: ifd truncated")
+	}
+
+	list := make([]entry, 0, n)
+	for i := 0; i < n; i++ {
+		b := t.buf[p+i*12:]
+		list = append(list, entry{
+			tag:   t.order.Uint16(b),
+			typ:   t.order.Uint16(b[2:]),
+			count: t.order.Uint32(b[4:]),
+			raw:   b[8:12],
+		})
+	}
+	return list, nil
+}
+
+// data returns the bytes of an entry's value, which live inline when they
+// fit in four bytes and at an offset otherwise. Nil means out of range.
+func (t *tiff) data(e entry) []byte {
+	size := typeSize[e.typ] * int(e.count)
+	if size <= 0 {
+		return nil
+	}
+	if size <= 4 {
+		return e.raw[:size]
+	}
+	off := int(t.order.Uint32(e.raw))
+	if off < 0 || off+size > len(t.buf) {
+		return nil
+	}
+	return t.buf[off : off+size]
+}
+
+func (t *tiff) short(e entry) uint16 {
+	return t.order.Uint16(e.raw)
+}
+
+// uint reads a SHORT or LONG value.
+func (t *tiff) uint(e entry) uint32 {
+	if e.typ == 3 {
+		return uint32(t.short(e))
+	}
+	return t.order.Uint32(e.raw)
+}
+
+func (t *tiff) ascii(e entry) string {
+	if e.typ != 2 {
+		return ""
+	}
+	b := t.data(e)
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return strings.TrimSpace(string(b))
+}
+
+func (t *tiff) rationals(e entry) []float64 {
+	if e.typ != 5 {
+		return nil
+	}
+	b := t.data(e)
+	out := make([]float64, 0, len(b)/8)
+	for i := 0; i+8 <= len(b); i += 8 {
+		num, den := t.order.Uint32(b[i:]), t.order.Uint32(b[i+4:])
+		if den == 0 {
+			return nil
+		}
+		out = append(out, float64(num)/float64(den))
+	}
+	return out
+}
+
+func (t *tiff) gps(entries []entry) *GPS {
+	var lat, lon []float64
+	var latRef, lonRef string
+	var alt float64
+	below := false
+	for _, e := range entries {
+		switch e.tag {
+		case tagGPSLatRef:
+			latRef = t.ascii(e)
+		case tagGPSLat:
+			lat = t.rationals(e)
+		case tagGPSLonRef:
+			lonRef = t.ascii(e)
+		case tagGPSLon:
+			lon = t.rationals(e)
+		case tagGPSAltRef:
+			below = e.raw[0] == 1
+		case tagGPSAlt:
+			if v := t.rationals(e); len(v) == 1 {
+				alt = v[0]
+			}
+		}
+	}
+	if len(lat) != 3 || len(lon) != 3 {
+		return nil
+	}
+
+	g := &GPS{Lat: dms(lat), Lon: dms(lon), Alt: alt}
+	if latRef == "S" {
+		g.Lat = -g.Lat
+	}
+	if lonRef == "W" {
+		g.Lon = -g.Lon
+	}
+	if below {
+		g.Alt = -g.Alt
+	}
+	if !validPosition(g.Lat, g.Lon) {
+		return nil
+	}
+	return g
+}
+
+func dms(v []float64) float64 {
+	return v[0] + v[1]/60 + v[2]/3600
+}
+
+// validPosition rejects out-of-range values and the 0,0 that some phones
+// write when they had no fix.
+func validPosition(lat, lon float64) bool {
+	if math.IsNaN(lat) || math.IsNaN(lon) || math.Abs(lat) > 90 || math.Abs(lon) > 180 {
+		return false
+	}
+	return lat != 0 || lon != 0
+}
+
+func parseExifTime(value, offset string) time.Time {
+	if value == "" || strings.HasPrefix(value, "0000") {
+		return time.Time{}
+	}
+	if offset != "" {
+		if t, err := time.Parse(exifTimeLayout+"-07:00", value+offset); err == nil {
+			return t
+		}
+	}
+	t, err := time.Parse(exifTimeLayout, value)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
@@ -0,0 +1,316 @@
+package exif
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+// buildJPEG wraps a single-entry IFD0 holding the orientation tag in a
+// minimal JPEG header (SOI, APP1, SOS).
+func buildJPEG(order binary.ByteOrder, orientation uint16) []byte {
+	var tiff bytes.Buffer
+	if order == binary.LittleEndian {
+		tiff.WriteString("II")
+	} else {
+		tiff.WriteString("MM")
+	}
+	binary.Write(&tiff, order, uint16(42))
+	binary.Write(&tiff, order, uint32(8))
+	binary.Write(&tiff, order, uint16(1))
+	binary.Write(&tiff, order, uint16(tagOrientation))
+	binary.Write(&tiff, order, uint16(3)) // SHORT
+	binary.Write(&tiff, order, uint32(1))
+	binary.Write(&tiff, order, orientation)
+	binary.Write(&tiff, order, uint16(0))
+	binary.Write(&tiff, order, uint32(0))
+
+	app1 := append([]byte("Exif\x00\x00"), tiff.Bytes()...)
+
+	var b bytes.Buffer
+	b.Write([]byte{0xFF, 0xD8})
+	// An unrelated APP0 segment first, like most cameras write
+	b.Write([]byte{0xFF, 0xE0, 0x00, 0x04, 0x00, 0x00})
+	b.Write([]byte{0xFF, 0xE1})
+	binary.Write(&b, binary.BigEndian, uint16(len(app1)+2))
+	b.Write(app1)
+	b.Write([]byte{0xFF, 0xDA})
+	return b.Bytes()
+}
+
+func TestDecode(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		input   []byte
+		want    int
+		wantErr bool
+	}{
+		{"Little Endian Rotate 90", buildJPEG(binary.LittleEndian, 6), 6, false},
+		{"Big Endian Rotate 180", buildJPEG(binary.BigEndian, 3), 3, false},
+		{"No Exif Segment", []byte{0xFF, 0xD8, 0xFF, 0xE0, 0x00, 0x02, 0xFF, 0xDA}, 0, true},
+		{"Not A JPEG", []byte("\x89PNG\r\n"), 0, true},
+		{"Truncated", []byte{0xFF, 0xD8, 0xFF, 0xE1, 0x00}, 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, err := Decode(bytes.NewReader(tt.input))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("Decode() expected error, got %+v", d)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Decode() error: %v", err)
+			}
+			if d.Orientation != tt.want {
+				t.Errorf("Orientation = %d, want %d", d.Orientation, tt.want)
+			}
+		})
+	}
+}
+
+type testTag struct {
+	id  uint16
+	typ uint16
+	val []byte // encoded in the TIFF's byte order; count is derived from typ
+}
+
+func asciiTag(id uint16, s string) testTag {
+	return testTag{id, 2, append([]byte(s), 0)}
+}
+
+func rationalTag(order binary.ByteOrder, id uint16, vals ...[2]uint32) testTag {
+	var b bytes.Buffer
+	for _, v := range vals {
+		binary.Write(&b, order, v[0])
+		binary.Write(&b, order, v[1])
+	}
+	return testTag{id, 5, b.Bytes()}
+}
+
+func longTag(order binary.ByteOrder, id uint16, v uint32) testTag {
+	b := make([]byte, 4)
+	order.PutUint32(b, v)
+	return testTag{id, 4, b}
+}
+
+// buildTIFF lays out IFD0, the Exif IFD and the GPS IFD back to back,
+// followed by every value too large to sit inline.
+func buildTIFF(order binary.ByteOrder, ifd0, exifIFD, gpsIFD []testTag) []byte {
+	ifdSize := func(tags []testTag) int { return 2 + 12*len(tags) + 4 }
+
+	// Pointer tags first so their sizes count when laying out
+	ifd0 = append([]testTag{}, ifd0...)
+	if len(exifIFD) > 0 {
+		ifd0 = append(ifd0, longTag(order, tagExifIFD, 0))
+	}
+	if len(gpsIFD) > 0 {
+		ifd0 = append(ifd0, longTag(order, tagGPSIFD, 0))
+	}
+	exifOff := 8 + ifdSize(ifd0)
+	gpsOff := exifOff
+	if len(exifIFD) > 0 {
+		gpsOff += ifdSize(exifIFD)
+	}
+	dataOff := gpsOff
+	if len(gpsIFD) > 0 {
+		dataOff += ifdSize(gpsIFD)
+	}
+	for i, tag := range ifd0 {
+		switch tag.id {
+		case tagExifIFD:
+			ifd0[i] = longTag(order, tagExifIFD, uint32(exifOff))
+		case tagGPSIFD:
+			ifd0[i] = longTag(order, tagGPSIFD, uint32(gpsOff))
+		}
+	}
+
+	var head, data bytes.Buffer
+	if order == binary.LittleEndian {
+		head.WriteString("II")
+	} else {
+		head.WriteString("MM")
+	}
+	binary.Write(&head, order, uint16(42))
+	binary.Write(&head, order, uint32(8))
+
+	for _, tags := range [][]testTag{ifd0, exifIFD, gpsIFD} {
+		if len(tags) == 0 {
+			continue
+		}
+		binary.Write(&head, order, uint16(len(tags)))
+		for _, tag := range tags {
+			binary.Write(&head, order, tag.id)
+			binary.Write(&head, order, tag.typ)
+			binary.Write(&head, order, uint32(len(tag.val)/typeSize[tag.typ]))
+			if len(tag.val) <= 4 {
+				head.Write(append(tag.val, make([]byte, 4-len(tag.val))...))
+				continue
+			}
+			binary.Write(&head, order, uint32(dataOff+data.Len()))
+			data.Write(tag.val)
+		}
+		binary.Write(&head, order, uint32(0))
+	}
+	return append(head.Bytes(), data.Bytes()...)
+}
+
+// wrapJPEG puts APP1 payloads and a frame header in front of SOS.
+func wrapJPEG(width, height uint16, app1 ...[]byte) []byte {
+	var b bytes.Buffer
+	b.Write([]byte{0xFF, 0xD8})
+	for _, seg := range app1 {
+		b.Write([]byte{0xFF, 0xE1})
+		binary.Write(&b, binary.BigEndian, uint16(len(seg)+2))
+		b.Write(seg)
+	}
+	if width > 0 {
+		b.Write([]byte{0xFF, 0xC0, 0x00, 0x0B, 0x08})
+		binary.Write(&b, binary.BigEndian, height)
+		binary.Write(&b, binary.BigEndian, width)
+		b.Write([]byte{0x01, 0x01, 0x11, 0x00})
+	}
+	b.Write([]byte{0xFF, 0xDA})
+	return b.Bytes()
+}
+
+func TestDecodeTags(t *testing.T) {
+	t.Parallel()
+
+	be := binary.BigEndian
+	le := binary.LittleEndian
+	exifSeg := func(order binary.ByteOrder, ifd0, sub, gps []testTag) []byte {
+		return append([]byte("Exif\x00\x00"), buildTIFF(order, ifd0, sub, gps)...)
+	}
+	xmpSeg := func(body string) []byte {
+		return append([]byte(xmpSegmentPrefix), body...)
+	}
+
+	tests := []struct {
+		name string
+		jpeg []byte
+		want Data
+	}{
+		{
+			name: "camera, capture time with offset and GPS",
+			jpeg: wrapJPEG(0, 0, exifSeg(le,
+				[]testTag{asciiTag(tagMake, "Canon"), asciiTag(tagModel, "EOS R6"), asciiTag(tagDateTime, "2024:01:01 00:00:00")},
+				[]testTag{asciiTag(tagDateOriginal, "2023:07:14 18:30:05"), asciiTag(tagOffsetOrig, "+02:00"), longTag(le, tagPixelX, 6000), longTag(le, tagPixelY, 4000)},
+				[]testTag{
+					asciiTag(tagGPSLatRef, "N"), rationalTag(le, tagGPSLat, [2]uint32{48, 1}, [2]uint32{51, 1}, [2]uint32{3000, 100}),
+					asciiTag(tagGPSLonRef, "W"), rationalTag(le, tagGPSLon, [2]uint32{2, 1}, [2]uint32{17, 1}, [2]uint32{0, 1}),
+				})),
+			want: Data{
+				Make: "Canon", Model: "EOS R6", Width: 6000, Height: 4000,
+				Taken: time.Date(2023, 7, 14, 18, 30, 5, 0, time.FixedZone("", 2*3600)),
+				GPS:   &GPS{Lat: 48 + 51.0/60 + 30.0/3600, Lon: -(2 + 17.0/60)},
+			},
+		},
+		{
+			name: "falls back to DateTime and the frame size",
+			jpeg: wrapJPEG(640, 480, exifSeg(be, []testTag{asciiTag(tagDateTime, "2020:02:29 12:00:00")}, nil, nil)),
+			want: Data{Taken: time.Date(2020, 2, 29, 12, 0, 0, 0, time.UTC), Width: 640, Height: 480},
+		},
+		{
+			name: "zero GPS fix is dropped",
+			jpeg: wrapJPEG(0, 0, exifSeg(be, []testTag{asciiTag(tagMake, "Phone")}, nil, []testTag{
+				asciiTag(tagGPSLatRef, "N"), rationalTag(be, tagGPSLat, [2]uint32{0, 1}, [2]uint32{0, 1}, [2]uint32{0, 1}),
+				asciiTag(tagGPSLonRef, "E"), rationalTag(be, tagGPSLon, [2]uint32{0, 1}, [2]uint32{0, 1}, [2]uint32{0, 1}),
+			})),
+			want: Data{Make: "Phone"},
+		},
+		{
+			name: "XMP fills what EXIF lacks",
+			jpeg: wrapJPEG(0, 0,
+				exifSeg(be, []testTag{asciiTag(tagMake, "Nikon")}, nil, nil),
+				xmpSeg(`<rdf:Description tiff:Make="Ignored" tiff:Model="Z 6" exif:DateTimeOriginal="2019-05-04T10:11:12Z" exif:GPSLatitude="33,52.5S" exif:GPSLongitude="151,12.6E"/>`)),
+			want: Data{
+				Make: "Nikon", Model: "Z 6",
+				Taken: time.Date(2019, 5, 4, 10, 11, 12, 0, time.UTC),
+				GPS:   &GPS{Lat: -(33 + 52.5/60), Lon: 151 + 12.6/60},
+			},
+		},
+		{
+			name: "frame header only",
+			jpeg: wrapJPEG(1920, 1080),
+			want: Data{Width: 1920, Height: 1080},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Decode(bytes.NewReader(tt.jpeg))
+			if err != nil {
+				t.Fatalf("Decode() error: %v", err)
+			}
+			assertData(t, got, &tt.want)
+		})
+	}
+}
+
+func TestDecodeXMP(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		sidecar string
+		want    Data
+		wantErr bool
+	}{
+		{
+			name:    "element form",
+			sidecar: `<x:xmpmeta><rdf:RDF><rdf:Description><photoshop:DateCreated>2021-12-24T20:00:00+01:00</photoshop:DateCreated><tiff:Orientation>6</tiff:Orientation></rdf:Description></rdf:RDF></x:xmpmeta>`,
+			want:    Data{Taken: time.Date(2021, 12, 24, 20, 0, 0, 0, time.FixedZone("", 3600)), Orientation: 6},
+		},
+		{
+			name:    "degrees minutes seconds",
+			sidecar: `<rdf:Description exif:GPSLatitude="51,30,0N" exif:GPSLongitude="0,7,30W"/>`,
+			want:    Data{GPS: &GPS{Lat: 51.5, Lon: -0.125}},
+		},
+		{
+			name:    "nothing useful",
+			sidecar: `<rdf:Description dc:title="holiday"/>`,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := DecodeXMP(strings.NewReader(tt.sidecar))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("DecodeXMP() expected error, got %+v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("DecodeXMP() error: %v", err)
+			}
+			assertData(t, got, &tt.want)
+		})
+	}
+}
+
+func assertData(t *testing.T, got, want *Data) {
+	t.Helper()
+	if got.Make != want.Make || got.Model != want.Model || got.Orientation != want.Orientation ||
+		got.Width != want.Width || got.Height != want.Height || got.Duration != want.Duration {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	if !got.Taken.Equal(want.Taken) {
+		t.Errorf("Taken = %v, want %v", got.Taken, want.Taken)
+	}
+	switch {
+	case (got.GPS == nil) != (want.GPS == nil):
+		t.Errorf("GPS = %+v, want %+v", got.GPS, want.GPS)
+	case got.GPS != nil && (math.Abs(got.GPS.Lat-want.GPS.Lat) > 1e-6 || math.Abs(got.GPS.Lon-want.GPS.Lon) > 1e-6 || math.Abs(got.GPS.Alt-want.GPS.Alt) > 1e-3):
+		t.Errorf("GPS = %+v, want %+v", *got.GPS, *want.GPS)
+	}
+}
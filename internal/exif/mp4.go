@@ -0,0 +1,336 @@
+package exif
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxBox bounds how much of a single leaf box is loaded into memory. The
+// boxes we read are a few hundred bytes; sample tables, which can be
+// megabytes, are only ever skipped over.
+const maxBox = 1 << 20
+
+// mp4Epoch is where QuickTime and ISO-BMFF timestamps count from.
+var mp4Epoch = time.Date(1904, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// DecodeMP4 reads the movie header of an MP4, M4V or QuickTime file: capture
+// time, duration, frame size and rotation of the first video track, and the
+// recording location where the camera stored one. Only box headers and the
+// few small boxes we need are read, so it is cheap even for huge files.
+func DecodeMP4(r io.ReaderAt, size int64) (*Data, error) {
+	m := &mp4{r: r, d: &Data{}}
+
+	found := false
+	err := m.boxes(0, size, func(typ string, start, end int64) error {
+		if typ == "moov" {
+			found = true
+			return m.moov(start, end)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, errors.New("exif: no movie header")
+	}
+	return m.d, nil
+}
+
+type mp4 struct {
+	r io.ReaderAt
+	d *Data
+
+	creation time.Time // from the Apple keys, which carry a zone
+}
+
+// boxes calls fn with the payload range of every box between start and end.
+func (m *mp4) boxes(start, end int64, fn func(typ string, start, end int64) error) error {
+	var hdr [16]byte
+	for off := start; off+8 <= end; {
+		if _, err := m.r.ReadAt(hdr[:8], off); err != nil {
+			return err
+		}
+		size := int64(binary.BigEndian.Uint32(hdr[:4]))
+		typ := string(hdr[4:8])
+		payload := off + 8
+
+		switch size {
+		case 0: // extends to the end of the enclosing box
+			size = end - off
+		case 1: // 64-bit size follows the type
+			if _, err := m.r.ReadAt(hdr[8:16], off+8); err != nil {
+				return err
+			}
+			size = int64(binary.BigEndian.Uint64(hdr[8:16]))
+			payload += 8
+		}
+		if size < payload-off || off+size > end {
+			return errors.New("exif: bad box size")
+		}
+		if err := fn(typ, payload, off+size); err != nil {
+			return err
+		}
+		off += size
+	}
+	return nil
+}
+
+func (m *mp4) read(start, end int64) ([]byte, error) {
+	if end-start > maxBox {
+		return nil, errors.New("exif: box too large")
+	}
+	buf := make([]byte, end-start)
+	if _, err := m.r.ReadAt(buf, start); err != nil && err != io.EOF {
+		return nil, err
+	}
+	return buf, nil
+}
+
+func (m *mp4) moov(start, end int64) error {
+	err := m.boxes(start, end, func(typ string, start, end int64) error {
+		switch typ {
+		case "mvhd":
+			buf, err := m.read(start, end)
+			if err != nil {
+				return err
+			}
+			m.mvhd(buf)
+		case "trak":
+			return m.boxes(start, end, func(typ string, start, end int64) error {
+				if typ != "tkhd" || m.d.Width != 0 {
+					return nil
+				}
+				buf, err := m.read(start, end)
+				if err != nil {
+					return err
+				}
+				m.tkhd(buf)
+				return nil
+			})
+		case "udta":
+			return m.udta(start, end)
+		case "meta":
+			return m.meta(start, end)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if !m.creation.IsZero() {
+		m.d.Taken = m.creation
+	}
+	return nil
+}
+
+func (m *mp4) mvhd(b []byte) {
+	var created uint64
+	var scale uint32
+	var duration uint64
+	switch {
+	case len(b) >= 32 && b[0] == 1:
+		created = binary.BigEndian.Uint64(b[4:])
+		scale = binary.BigEndian.Uint32(b[20:])
+		duration = binary.BigEndian.Uint64(b[24:])
+	case len(b) >= 20 && b[0] == 0:
+		created = uint64(binary.BigEndian.Uint32(b[4:]))
+		scale = binary.BigEndian.Uint32(b[12:])
+		duration = uint64(binary.BigEndian.Uint32(b[16:]))
+	default:
+		return
+	}
+	// Zero means unset; encoders that count from 1970 by mistake land before it
+	if created > 0 {
+		if t := mp4Epoch.Add(time.Duration(created) * time.Second); t.Year() > 1970 {
+			m.d.Taken = t
+		}
+	}
+	if scale > 0 {
+		m.d.Duration = time.Duration(float64(duration) / float64(scale) * float64(time.Second))
+	}
+}
+
+// tkhd reads the frame size and display matrix of a track. Audio tracks
+// have a zero size and are skipped by the caller's Width check.
+func (m *mp4) tkhd(b []byte) {
+	matrix := 40 // version 0
+	if len(b) > 0 && b[0] == 1 {
+		matrix = 52
+	}
+	if len(b) < matrix+36+8 {
+		return
+	}
+	w := int(binary.BigEndian.Uint32(b[matrix+36:]) >> 16)
+	h := int(binary.BigEndian.Uint32(b[matrix+40:]) >> 16)
+	if w == 0 || h == 0 {
+		return
+	}
+	m.d.Width, m.d.Height = w, h
+
+	// Rotation lives in the first two matrix entries (16.16 fixed point)
+	a := int32(binary.BigEndian.Uint32(b[matrix:]))
+	rb := int32(binary.BigEndian.Uint32(b[matrix+4:]))
+	switch {
+	case a == 0 && rb > 0:
+		m.d.Orientation = 6
+	case a < 0 && rb == 0:
+		m.d.Orientation = 3
+	case a == 0 && rb < 0:
+		m.d.Orientation = 8
+	default:
+		m.d.Orientation = 1
+	}
+}
+
+// udta holds QuickTime user data: ©xyz, ©mak and ©mod are a 16-bit length,
+// a 16-bit language code and the string.
+func (m *mp4) udta(start, end int64) error {
+	return m.boxes(start, end, func(typ string, start, end int64) error {
+		switch typ {
+		case "\xa9xyz", "\xa9mak", "\xa9mod":
+		default:
+			return nil
+		}
+		b, err := m.read(start, end)
+		if err != nil || len(b) < 4 {
+			return err
+		}
+		n := int(binary.BigEndian.Uint16(b))
+		val := string(b[4:min(4+n, len(b))])
+		switch typ {
+		case "\xa9xyz":
+			m.d.GPS = parseISO6709(val)
+		case "\xa9mak":
+			m.d.Make = strings.TrimSpace(val)
+		case "\xa9mod":
+			m.d.Model = strings.TrimSpace(val)
+		}
+		return nil
+	})
+}
+
+// meta reads Apple's mdta metadata: a keys box naming each item and an ilst
+// box holding the values, matched by 1-based index.
+func (m *mp4) meta(start, end int64) error {
+	// ISO meta is a full box with 4 bytes of version/flags; QuickTime's is not
+	var peek [8]byte
+	if _, err := m.r.ReadAt(peek[:], start); err != nil {
+		return nil
+	}
+	if string(peek[4:8]) != "hdlr" && string(peek[4:8]) != "keys" {
+		start += 4
+	}
+
+	var keys []string
+	values := map[int]string{}
+	err := m.boxes(start, end, func(typ string, start, end int64) error {
+		switch typ {
+		case "keys":
+			b, err := m.read(start, end)
+			if err != nil {
+				return err
+			}
+			keys = parseKeys(b)
+		case "ilst":
+			return m.boxes(start, end, func(typ string, start, end int64) error {
+				idx := int(binary.BigEndian.Uint32([]byte(typ)))
+				return m.boxes(start, end, func(typ string, start, end int64) error {
+					if typ != "data" {
+						return nil
+					}
+					b, err := m.read(start, end)
+					if err != nil || len(b) < 8 {
+						return err
+					}
+					values[idx] = string(b[8:])
+					return nil
+				})
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for i, key := range keys {
+		val, ok := values[i+1]
+		if !ok {
+			continue
+		}
+		switch key {
+		case "com.apple.quicktime.location.ISO6709":
+			if g := parseISO6709(val); g != nil {
+				m.d.GPS = g
+			}
+		case "com.apple.quicktime.make":
+			m.d.Make = val
+		case "com.apple.quicktime.model":
+			m.d.Model = val
+		case "com.apple.quicktime.creationdate":
+			if t, err := time.Parse("2006-01-02T15:04:05-0700", val); err == nil {
+				m.creation = t
+			} else if t, err := time.Parse(time.RFC3339, val); err == nil {
+				m.creation = t
+			}
+		}
+	}
+	return nil
+}
+
+func parseKeys(b []byte) []string {
+	if len(b) < 8 {
+		return nil
+	}
+	n := int(binary.BigEndian.Uint32(b[4:]))
+	keys := make([]string, 0, min(n, 64))
+	off := 8
+	for i := 0; i < n && off+8 <= len(b); i++ {
+		size := int(binary.BigEndian.Uint32(b[off:]))
+		if size < 8 || off+size > len(b) {
+			break
+		}
+		keys = append(keys, string(b[off+8:off+size]))
+		off += size
+	}
+	return keys
+}
+
+// parseISO6709 reads "+37.7749-122.4194+010.000/" style positions.
+func parseISO6709(s string) *GPS {
+	s = strings.TrimSuffix(strings.TrimSpace(s), "/")
+	var parts []string
+	for i := 0; i < len(s); {
+		j := i + 1
+		for j < len(s) && s[j] != '+' && s[j] != '-' {
+			j++
+		}
+		parts = append(parts, s[i:j])
+		i = j
+	}
+	if len(parts) < 2 {
+		return nil
+	}
+
+	var vals []float64
+	for _, p := range parts {
+		f, err := strconv.ParseFloat(p, 64)
+		if err != nil {
+			return nil
+		}
+		vals = append(vals, f)
+	}
+	if !validPosition(vals[0], vals[1]) {
+		return nil
+	}
+	g := &GPS{Lat: vals[0], Lon: vals[1]}
+	if len(vals) > 2 {
+		g.Alt = vals[2]
+	}
+	return g
+}
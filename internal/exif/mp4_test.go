@@ -0,0 +1,131 @@
+package exif
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+func box(typ string, payload ...[]byte) []byte {
+	body := bytes.Join(payload, nil)
+	b := make([]byte, 8, 8+len(body))
+	binary.BigEndian.PutUint32(b, uint32(8+len(body)))
+	copy(b[4:], typ)
+	return append(b, body...)
+}
+
+func u32(v uint32) []byte {
+	return binary.BigEndian.AppendUint32(nil, v)
+}
+
+// mvhd0 is a version 0 movie header.
+func mvhd0(created time.Time, scale, duration uint32) []byte {
+	secs := uint32(created.Sub(mp4Epoch) / time.Second)
+	return box("mvhd", u32(0), u32(secs), u32(secs), u32(scale), u32(duration), make([]byte, 80))
+}
+
+// tkhd0 is a version 0 track header with the first two matrix entries set.
+func tkhd0(width, height uint16, a, b int32) []byte {
+	head := make([]byte, 40)
+	matrix := make([]byte, 36)
+	binary.BigEndian.PutUint32(matrix, uint32(a))
+	binary.BigEndian.PutUint32(matrix[4:], uint32(b))
+	return box("tkhd", head, matrix, u32(uint32(width)<<16), u32(uint32(height)<<16))
+}
+
+func qtString(typ, s string) []byte {
+	b := binary.BigEndian.AppendUint16(nil, uint16(len(s)))
+	b = append(b, 0x15, 0xC7) // language
+	return box(typ, append(b, s...))
+}
+
+func appleMeta(kv ...string) []byte {
+	var keys, items [][]byte
+	for i := 0; i < len(kv); i += 2 {
+		keys = append(keys, box("mdta", []byte(kv[i])))
+		item := make([]byte, 4)
+		binary.BigEndian.PutUint32(item, uint32(i/2+1))
+		items = append(items, box(string(item), box("data", u32(1), u32(0), []byte(kv[i+1]))))
+	}
+	return box("meta",
+		box("hdlr", make([]byte, 24)),
+		box("keys", append(u32(0), append(u32(uint32(len(keys))), bytes.Join(keys, nil)...)...)),
+		box("ilst", items...),
+	)
+}
+
+func TestDecodeMP4(t *testing.T) {
+	t.Parallel()
+
+	recorded := time.Date(2022, 8, 1, 9, 30, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		file    []byte
+		want    Data
+		wantErr bool
+	}{
+		{
+			name: "mvhd, rotated video track and ©xyz",
+			file: bytes.Join([][]byte{
+				box("ftyp", []byte("isom")),
+				box("mdat", make([]byte, 64)),
+				box("moov",
+					mvhd0(recorded, 600, 6000),
+					box("trak", tkhd0(0, 0, 0x10000, 0)), // audio first
+					box("trak", tkhd0(1920, 1080, 0, 0x10000)),
+					box("udta", qtString("\xa9xyz", "+52.3676+004.9041/"), qtString("\xa9mak", "GoPro")),
+				),
+			}, nil),
+			want: Data{
+				Taken: recorded, Duration: 10 * time.Second, Width: 1920, Height: 1080,
+				Orientation: 6, Make: "GoPro", GPS: &GPS{Lat: 52.3676, Lon: 4.9041},
+			},
+		},
+		{
+			name: "Apple keys win over mvhd",
+			file: bytes.Join([][]byte{
+				box("ftyp", []byte("qt  ")),
+				box("moov",
+					mvhd0(recorded, 1000, 500),
+					appleMeta(
+						"com.apple.quicktime.make", "Apple",
+						"com.apple.quicktime.model", "iPhone 15",
+						"com.apple.quicktime.creationdate", "2022-08-01T11:30:00+0200",
+						"com.apple.quicktime.location.ISO6709", "-33.8688+151.2093+012.000/",
+					),
+				),
+			}, nil),
+			want: Data{
+				Taken: recorded, Duration: 500 * time.Millisecond, Make: "Apple", Model: "iPhone 15",
+				GPS: &GPS{Lat: -33.8688, Lon: 151.2093, Alt: 12},
+			},
+		},
+		{
+			name:    "no movie header",
+			file:    box("ftyp", []byte("isom")),
+			wantErr: true,
+		},
+		{
+			name:    "box overruns the file",
+			file:    append(u32(1000), []byte("moov")...),
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := DecodeMP4(bytes.NewReader(tt.file), int64(len(tt.file)))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("DecodeMP4() expected error, got %+v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("DecodeMP4() error: %v", err)
+			}
+			assertData(t, got, &tt.want)
+		})
+	}
+}
@@ -0,0 +1,119 @@
+package exif
+
+import (
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxXMP bounds how much of a sidecar file is read.
+const maxXMP = 1 << 20
+
+// DecodeXMP reads an XMP packet, either embedded or a .xmp sidecar as
+// written by Lightroom, darktable and most phone backup tools.
+func DecodeXMP(r io.Reader) (*Data, error) {
+	buf, err := io.ReadAll(io.LimitReader(r, maxXMP))
+	if err != nil {
+		return nil, err
+	}
+	d := parseXMP(buf)
+	if *d == (Data{}) {
+		return nil, ErrNoExif
+	}
+	return d, nil
+}
+
+// parseXMP picks values out of the RDF without a full XML parse. Properties
+// may be written as attributes (exif:Foo="bar") or elements
+// (<exif:Foo>bar</exif:Foo>); both are accepted.
+func parseXMP(buf []byte) *Data {
+	doc := string(buf)
+	d := &Data{}
+
+	d.Make = xmpValue(doc, "tiff:Make")
+	d.Model = xmpValue(doc, "tiff:Model")
+	d.Orientation, _ = strconv.Atoi(xmpValue(doc, "tiff:Orientation"))
+	d.Width, _ = strconv.Atoi(xmpValue(doc, "exif:PixelXDimension"))
+	d.Height, _ = strconv.Atoi(xmpValue(doc, "exif:PixelYDimension"))
+
+	for _, name := range []string{"exif:DateTimeOriginal", "photoshop:DateCreated", "xmp:CreateDate"} {
+		if t := parseXMPTime(xmpValue(doc, name)); !t.IsZero() {
+			d.Taken = t
+			break
+		}
+	}
+
+	lat, okLat := parseXMPCoord(xmpValue(doc, "exif:GPSLatitude"))
+	lon, okLon := parseXMPCoord(xmpValue(doc, "exif:GPSLongitude"))
+	if okLat && okLon && validPosition(lat, lon) {
+		d.GPS = &GPS{Lat: lat, Lon: lon}
+	}
+	return d
+}
+
+func xmpValue(doc, name string) string {
+	if i := strings.Index(doc, name+`="`); i >= 0 {
+		rest := doc[i+len(name)+2:]
+		if j := strings.IndexByte(rest, '"'); j >= 0 {
+			return strings.TrimSpace(rest[:j])
+		}
+	}
+	if i := strings.Index(doc, "<"+name+">"); i >= 0 {
+		rest := doc[i+len(name)+2:]
+		if j := strings.Index(rest, "</"+name+">"); j >= 0 {
+			return strings.TrimSpace(rest[:j])
+		}
+	}
+	return ""
+}
+
+var xmpTimeLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04Z07:00",
+	"2006-01-02T15:04",
+	time.DateOnly,
+}
+
+func parseXMPTime(v string) time.Time {
+	if v == "" {
+		return time.Time{}
+	}
+	for _, layout := range xmpTimeLayouts {
+		if t, err := time.Parse(layout, v); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// parseXMPCoord reads the XMP GPSCoordinate form "DDD,MM,SSk" or "DDD,MM.mmk"
+// where k is N, S, E or W.
+func parseXMPCoord(v string) (float64, bool) {
+	if len(v) < 2 {
+		return 0, false
+	}
+	ref := v[len(v)-1]
+	parts := strings.Split(v[:len(v)-1], ",")
+	if len(parts) < 2 || len(parts) > 3 {
+		return 0, false
+	}
+
+	var vals [3]float64
+	for i, p := range parts {
+		f, err := strconv.ParseFloat(strings.TrimSpace(p), 64)
+		if err != nil {
+			return 0, false
+		}
+		vals[i] = f
+	}
+	deg := dms(vals[:])
+	switch ref {
+	case 'S', 'W':
+		return -deg, true
+	case 'N', 'E':
+		return deg, true
+	}
+	return 0, false
+}
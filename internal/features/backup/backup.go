@@ -0,0 +1,836 @@
+// Package backup snapshots the cloud's DataDir to a second disk, an SFTP
+// server or an S3-compatible bucket, so losing the data drive does not mean
+// losing the data. Backups are encrypted on the device, deduplicated across
+// files and runs, pruned by a retention policy and can be restored file by
+// file or as whole trees.
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/errs"
+	"github.com/strct-org/strct-agent/internal/fsx"
+)
+
+const (
+	OpBackupRun     errs.Op = "backup.Manager.Run"
+	OpBackupRestore errs.Op = "backup.Manager.Restore"
+	OpBackupSave    errs.Op = "backup.Manager.save"
+	OpBackupAPI     errs.Op = "backup.handle"
+)
+
+const (
+	// restoreRoot is where restores land in DataDir unless told otherwise.
+	restoreRoot = "Restored"
+
+	minInterval   = 15 * time.Minute
+	retryInterval = 30 * time.Minute
+	secretMask    = "********"
+)
+
+// Hooks lets restores keep the cloud's index, usage and thumbnails current,
+// and tells backups when there is no storage to read.
+type Hooks interface {
+	NotifyChanged(fullPath string)
+	// Offline reports whether fullPath is on storage that is not mounted,
+	// like the data drive while it is ejected.
+	Offline(fullPath string) bool
+}
+
+// Schedule is either a fixed interval or a time of day; empty means the job
+// only runs when asked to.
+type Schedule struct {
+	Every string `json:"every,omitempty"` // Go duration, e.g. "6h"
+	Daily string `json:"daily,omitempty"` // "HH:MM", local time
+}
+
+func (s Schedule) validate() error {
+	if s.Every != "" && s.Daily != "" {
+		return errs.E(OpBackupAPI, errs.KindInvalid, "set either every or daily, not both")
+	}
+	if s.Every != "" {
+		d, err := time.ParseDuration(s.Every)
+		if err != nil || d < minInterval {
+			return errs.E(OpBackupAPI, errs.KindInvalid, fmt.Sprintf("every must be a duration of at least %s", minInterval))
+		}
+	}
+	if s.Daily != "" {
+		if _, err := time.Parse("15:04", s.Daily); err != nil {
+			return errs.E(OpBackupAPI, errs.KindInvalid, "daily must be HH:MM")
+		}
+	}
+	return nil
+}
+
+// next is the first scheduled time after last, or zero for a manual job.
+func (s Schedule) next(last time.Time) time.Time {
+	switch {
+	case s.Every != "":
+		d, _ := time.ParseDuration(s.Every)
+		return last.Add(d)
+	case s.Daily != "":
+		hm, _ := time.Parse("15:04", s.Daily)
+		l := last.Local()
+		t := time.Date(l.Year(), l.Month(), l.Day(), hm.Hour(), hm.Minute(), 0, 0, time.Local)
+		if !t.After(last) {
+			t = t.AddDate(0, 0, 1)
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+// Job is one configured backup. The passphrase is kept so scheduled runs
+// can happen unattended; the state file is therefore only readable by the
+// agent, and the API never returns secrets.
+type Job struct {
+	ID         string       `json:"id"`
+	Name       string       `json:"name"`
+	Target     TargetConfig `json:"target"`
+	Passphrase string       `json:"passphrase,omitempty"`
+	Schedule   Schedule     `json:"schedule"`
+	Retention  Retention    `json:"retention"`
+	// Exclude holds path.Match patterns checked against each path relative
+	// to DataDir and against its name alone.
+	Exclude []string  `json:"exclude,omitempty"`
+	Paused  bool      `json:"paused,omitempty"`
+	Created time.Time `json:"created"`
+}
+
+// Status is what the last and current runs of a job did.
+type Status struct {
+	Running  bool      `json:"running"`
+	Phase    string    `json:"phase,omitempty"` // backup, prune or restore
+	Progress *Progress `json:"progress,omitempty"`
+
+	LastRun      *time.Time `json:"lastRun,omitempty"`
+	LastSuccess  *time.Time `json:"lastSuccess,omitempty"`
+	LastError    string     `json:"lastError,omitempty"`
+	LastSnapshot *Snapshot  `json:"lastSnapshot,omitempty"`
+	Snapshots    int        `json:"snapshots"`
+	NextRun      *time.Time `json:"nextRun,omitempty"`
+
+	LastRestore      *RestoreResult `json:"lastRestore,omitempty"`
+	LastRestoreError string         `json:"lastRestoreError,omitempty"`
+}
+
+// JobResponse is a job as the API shows it.
+type JobResponse struct {
+	Job
+	Status Status `json:"status"`
+}
+
+// RestoreRequest picks what to restore and where. Dest is relative to
+// DataDir.
+type RestoreRequest struct {
+	Job       string `json:"job"`
+	Snapshot  string `json:"snapshot"`
+	Path      string `json:"path"`
+	Dest      string `json:"dest"`
+	Overwrite bool   `json:"overwrite"`
+}
+
+// Manager owns the backup jobs, runs them on schedule and serves the
+// /api/backup endpoints. Only one run or restore per job happens at a time,
+// since they share the job's repository.
+type Manager struct {
+	DataDir string        `json:"-"`
+	Path    string        `json:"-"`
+	Hooks   Hooks         `json:"-"`
+	Tick    time.Duration `json:"-"`
+
+	mu      sync.Mutex
+	Jobs    map[string]*Job    `json:"jobs"`
+	Status  map[string]*Status `json:"status"`
+	cancels map[string]context.CancelFunc
+	wg      sync.WaitGroup
+}
+
+// NewManager loads the jobs saved at path.
+func NewManager(dataDir, path string, hooks Hooks) (*Manager, error) {
+	m := &Manager{
+		DataDir: dataDir,
+		Path:    path,
+		Hooks:   hooks,
+		Tick:    time.Minute,
+		Jobs:    make(map[string]*Job),
+		Status:  make(map[string]*Status),
+		cancels: make(map[string]context.CancelFunc),
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, m); err != nil {
+			return nil, fmt.Errorf("parse %s: %w", path, err)
+		}
+	}
+	for id, st := range m.Status {
+		// A run cut short by a restart is not running any more
+		st.Running, st.Phase, st.Progress = false, "", nil
+		if m.Jobs[id] == nil {
+			delete(m.Status, id)
+		}
+	}
+	for id := range m.Jobs {
+		if m.Status[id] == nil {
+			m.Status[id] = &Status{}
+		}
+	}
+	return m, nil
+}
+
+// Start runs due jobs every Tick.
+func (m *Manager) Start() error {
+	go func() {
+		t := time.NewTicker(m.Tick)
+		defer t.Stop()
+		for {
+			m.runDue(time.Now())
+			<-t.C
+		}
+	}()
+	return nil
+}
+
+func (m *Manager) runDue(now time.Time) {
+	// An empty folder backed up in place of the drive would push real
+	// snapshots out of the retention policy
+	if m.offline() {
+		return
+	}
+	m.mu.Lock()
+	var due []string
+	for id, job := range m.Jobs {
+		if job.Paused || m.cancels[id] != nil {
+			continue
+		}
+		if next := m.nextRun(job, m.Status[id]); !next.IsZero() && !next.After(now) {
+			due = append(due, id)
+		}
+	}
+	m.mu.Unlock()
+
+	for _, id := range due {
+		m.runAsync(id)
+	}
+}
+
+// nextRun is the schedule's next time, brought forward to retry a failed
+// run sooner than the schedule would. A job that never ran is due straight
+// away on an interval, or at the first time of day after it was created.
+func (m *Manager) nextRun(job *Job, st *Status) time.Time {
+	if st.LastRun == nil {
+		if job.Schedule.Every != "" {
+			return job.Created
+		}
+		return job.Schedule.next(job.Created)
+	}
+	next := job.Schedule.next(*st.LastRun)
+	if next.IsZero() {
+		return next
+	}
+	if st.LastError != "" {
+		if retry := st.LastRun.Add(retryInterval); retry.Before(next) {
+			next = retry
+		}
+	}
+	return next
+}
+
+func (m *Manager) runAsync(id string) {
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		if _, err := m.Run(context.Background(), id); err != nil {
+			log.Printf("[BACKUP] %v", err)
+		}
+	}()
+}
+
+func (m *Manager) offline() bool {
+	return m.Hooks != nil && m.Hooks.Offline(m.DataDir)
+}
+
+// begin marks the job busy and returns a context that DELETE /run cancels.
+func (m *Manager) begin(ctx context.Context, op errs.Op, id, phase string) (Job, context.Context, error) {
+	if m.offline() {
+		return Job{}, nil, errs.E(op, errs.KindNotFound, "storage is offline: the data drive was ejected")
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	job, ok := m.Jobs[id]
+	if !ok {
+		return Job{}, nil, errs.E(op, errs.KindNotFound, "unknown backup job")
+	}
+	if m.cancels[id] != nil {
+		return Job{}, nil, errs.E(op, errs.KindInvalid, "this job is already running")
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	m.cancels[id] = cancel
+	st := m.Status[id]
+	st.Running, st.Phase, st.Progress = true, phase, &Progress{}
+	return *job, ctx, nil
+}
+
+func (m *Manager) end(id string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if cancel := m.cancels[id]; cancel != nil {
+		cancel()
+	}
+	delete(m.cancels, id)
+	if st := m.Status[id]; st != nil {
+		st.Running, st.Phase, st.Progress = false, "", nil
+	}
+	if err := m.save(); err != nil {
+		log.Printf("[BACKUP] %v", err)
+	}
+}
+
+func (m *Manager) setPhase(id, phase string) {
+	m.mu.Lock()
+	if st := m.Status[id]; st != nil {
+		st.Phase = phase
+	}
+	m.mu.Unlock()
+}
+
+func (m *Manager) progress(id string) func(Progress) {
+	return func(p Progress) {
+		m.mu.Lock()
+		if st := m.Status[id]; st != nil {
+			st.Progress = &p
+		}
+		m.mu.Unlock()
+	}
+}
+
+// open connects to the job's target and unlocks its repository. A host key
+// pinned on first contact is saved with the job.
+func (m *Manager) open(ctx context.Context, op errs.Op, job *Job) (Target, *Repository, error) {
+	pinned := job.Target.HostKey
+	t, err := openTarget(ctx, &job.Target, m.DataDir)
+	if err != nil {
+		return nil, nil, errs.E(op, errs.KindNetwork, err, "could not reach the backup target")
+	}
+	if job.Target.HostKey != pinned {
+		m.mu.Lock()
+		if j := m.Jobs[job.ID]; j != nil && j.Target.HostKey == pinned {
+			j.Target.HostKey = job.Target.HostKey
+			log.Printf("[BACKUP] Pinned host key %s for %s", job.Target.HostKey, job.Target.Addr)
+		}
+		m.mu.Unlock()
+	}
+
+	repo, err := openRepository(ctx, t, job.Passphrase)
+	if err != nil {
+		t.Close()
+		if errors.Is(err, ErrWrongPassphrase) {
+			return nil, nil, errs.E(op, errs.KindUnauthorized, err)
+		}
+		return nil, nil, errs.E(op, errs.KindIO, err, "could not open the backup repository")
+	}
+	return t, repo, nil
+}
+
+// Run backs the job up now and applies its retention policy.
+func (m *Manager) Run(ctx context.Context, id string) (*Snapshot, error) {
+	job, ctx, err := m.begin(ctx, OpBackupRun, id, "backup")
+	if err != nil {
+		return nil, err
+	}
+	defer m.end(id)
+
+	started := time.Now().UTC()
+	snap, count, err := m.run(ctx, &job)
+
+	m.mu.Lock()
+	if st := m.Status[id]; st != nil {
+		st.LastRun = &started
+		if err != nil {
+			st.LastError = err.Error()
+		} else {
+			done := time.Now().UTC()
+			st.LastSuccess = &done
+			st.LastError = ""
+			st.LastSnapshot = snap
+			st.Snapshots = count
+		}
+	}
+	m.mu.Unlock()
+
+	if err != nil {
+		return nil, errs.E(OpBackupRun, fmt.Errorf("job %s: %w", job.Name, err))
+	}
+	log.Printf("[BACKUP] %s: snapshot %s, %d files, %d bytes new", job.Name, snap.ID, snap.Files, snap.Added)
+	return snap, nil
+}
+
+func (m *Manager) run(ctx context.Context, job *Job) (*Snapshot, int, error) {
+	t, repo, err := m.open(ctx, OpBackupRun, job)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer t.Close()
+
+	list, err := repo.Snapshots(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	opts := BackupOptions{
+		Exclude:  m.excluder(job),
+		Progress: m.progress(job.ID),
+	}
+	if len(list) > 0 {
+		opts.Parent = list[0]
+	}
+	snap, err := repo.Backup(ctx, m.DataDir, opts)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	m.setPhase(job.ID, "prune")
+	policy := job.Retention
+	if policy.empty() {
+		policy = DefaultRetention
+	}
+	removed, err := repo.Forget(ctx, policy, time.Now())
+	if err != nil {
+		// The new snapshot is safe; pruning is retried next run
+		log.Printf("[BACKUP] %s: prune failed: %v", job.Name, err)
+	}
+	return snap, len(list) + 1 - len(removed), nil
+}
+
+// excluder skips the job's patterns, the agent's own temporary files and,
+// for a folder target inside DataDir, the target itself.
+func (m *Manager) excluder(job *Job) func(string, bool) bool {
+	var inside string
+	if job.Target.Kind == KindLocal || job.Target.Kind == KindUSB {
+		if rel, err := filepath.Rel(m.DataDir, job.Target.Path); err == nil && !strings.HasPrefix(rel, "..") {
+			inside = filepath.ToSlash(rel)
+		}
+	}
+	return func(rel string, dir bool) bool {
+		name := path.Base(rel)
+		if fsx.IsTempName(name) {
+			return true
+		}
+		if inside != "" && (rel == inside || inside == ".") {
+			return true
+		}
+		for _, pat := range job.Exclude {
+			if ok, _ := path.Match(pat, rel); ok {
+				return true
+			}
+			if ok, _ := path.Match(pat, name); ok {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// Restore writes part or all of a snapshot into DataDir.
+func (m *Manager) Restore(ctx context.Context, req RestoreRequest) (RestoreResult, error) {
+	job, ctx, err := m.begin(ctx, OpBackupRestore, req.Job, "restore")
+	if err != nil {
+		return RestoreResult{}, err
+	}
+	defer m.end(req.Job)
+
+	res, err := m.restore(ctx, &job, req)
+
+	m.mu.Lock()
+	if st := m.Status[req.Job]; st != nil {
+		st.LastRestore = &res
+		st.LastRestoreError = ""
+		if err != nil {
+			st.LastRestoreError = err.Error()
+		}
+	}
+	m.mu.Unlock()
+	return res, err
+}
+
+func (m *Manager) restore(ctx context.Context, job *Job, req RestoreRequest) (RestoreResult, error) {
+	t, repo, err := m.open(ctx, OpBackupRestore, job)
+	if err != nil {
+		return RestoreResult{}, err
+	}
+	defer t.Close()
+
+	id := req.Snapshot
+	if id == "" {
+		id = "latest"
+	}
+	snap, err := repo.Snapshot(ctx, id)
+	if errors.Is(err, errNotExist) {
+		return RestoreResult{}, errs.E(OpBackupRestore, errs.KindNotFound, "unknown snapshot")
+	}
+	if err != nil {
+		return RestoreResult{}, errs.E(OpBackupRestore, errs.KindIO, err)
+	}
+
+	dest := req.Dest
+	if dest == "" {
+		dest = path.Join(restoreRoot, snap.Time.Local().Format("2006-01-02 15.04.05"))
+	}
+	full := filepath.Join(m.DataDir, filepath.FromSlash(path.Clean("/"+dest)))
+
+	res, err := repo.Restore(ctx, snap, full, RestoreOptions{
+		Path:      req.Path,
+		Overwrite: req.Overwrite,
+		Progress:  m.progress(job.ID),
+		Restored: func(p string) {
+			if m.Hooks != nil {
+				m.Hooks.NotifyChanged(p)
+			}
+		},
+	})
+	if errors.Is(err, errNotExist) {
+		return res, errs.E(OpBackupRestore, errs.KindNotFound, err)
+	}
+	if err != nil {
+		return res, errs.E(OpBackupRestore, errs.KindIO, err)
+	}
+	log.Printf("[BACKUP] %s: restored %d files from %s to %s", job.Name, res.Files, snap.ID, dest)
+	return res, nil
+}
+
+// save must be called with mu held. The file holds secrets, so it is
+// private to the agent.
+func (m *Manager) save() error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return errs.E(OpBackupSave, errs.KindIO, err)
+	}
+	if err := os.MkdirAll(filepath.Dir(m.Path), 0755); err != nil {
+		return errs.E(OpBackupSave, errs.KindIO, err)
+	}
+	if err := fsx.WriteFile(m.Path, data, 0600); err != nil {
+		return errs.E(OpBackupSave, errs.KindIO, err)
+	}
+	return nil
+}
+
+func (m *Manager) GetRoutes() map[string]http.HandlerFunc {
+	return map[string]http.HandlerFunc{
+		"/api/backup/jobs":      m.handleJobs,
+		"/api/backup/run":       m.handleRun,
+		"/api/backup/snapshots": m.handleSnapshots,
+		"/api/backup/restore":   m.handleRestore,
+	}
+}
+
+func (m *Manager) handleJobs(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		m.listJobs(w, r)
+	case http.MethodPost:
+		m.saveJob(w, r)
+	case http.MethodDelete:
+		m.deleteJob(w, r)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (m *Manager) listJobs(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	list := make([]JobResponse, 0, len(m.Jobs))
+	for id, job := range m.Jobs {
+		list = append(list, m.response(job, m.Status[id]))
+	}
+	m.mu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Created.Before(list[j].Created) })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]JobResponse{"jobs": list})
+}
+
+// response must be called with mu held.
+func (m *Manager) response(job *Job, st *Status) JobResponse {
+	resp := JobResponse{Job: *job, Status: *st}
+	resp.Target = job.Target.redacted()
+	if resp.Passphrase != "" {
+		resp.Passphrase = secretMask
+	}
+	resp.Exclude = append([]string(nil), job.Exclude...)
+	if st.Progress != nil {
+		p := *st.Progress
+		resp.Status.Progress = &p
+	}
+	if !job.Paused {
+		if next := m.nextRun(job, st); !next.IsZero() {
+			resp.Status.NextRun = &next
+		}
+	}
+	return resp
+}
+
+// saveJob creates a job, or updates one when the body carries a known id.
+// Secrets sent back masked keep their stored values.
+func (m *Manager) saveJob(w http.ResponseWriter, r *http.Request) {
+	var job Job
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&job); err != nil {
+		errs.HTTPResponse(w, errs.E(OpBackupAPI, errs.KindInvalid, "Invalid JSON"))
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	old := m.Jobs[job.ID]
+	if job.ID != "" && old == nil {
+		errs.HTTPResponse(w, errs.E(OpBackupAPI, errs.KindNotFound, "unknown backup job"))
+		return
+	}
+	if old != nil {
+		if m.cancels[job.ID] != nil {
+			errs.HTTPResponse(w, errs.E(OpBackupAPI, errs.KindInvalid, "wait for the running job to finish"))
+			return
+		}
+		keepSecret(&job.Target.Password, old.Target.Password)
+		keepSecret(&job.Target.KeyPEM, old.Target.KeyPEM)
+		keepSecret(&job.Target.SecretKey, old.Target.SecretKey)
+		if job.Passphrase == "" || job.Passphrase == secretMask {
+			job.Passphrase = old.Passphrase
+		} else if job.Passphrase != old.Passphrase {
+			// The repository's keys are sealed with the old one
+			errs.HTTPResponse(w, errs.E(OpBackupAPI, errs.KindInvalid, "the passphrase of an existing job cannot be changed"))
+			return
+		}
+		if job.Target.Kind == old.Target.Kind && job.Target.Addr == old.Target.Addr && job.Target.HostKey == "" {
+			job.Target.HostKey = old.Target.HostKey
+		}
+		job.Created = old.Created
+	}
+
+	job.Name = strings.TrimSpace(job.Name)
+	if job.Name == "" {
+		errs.HTTPResponse(w, errs.E(OpBackupAPI, errs.KindInvalid, "name is required"))
+		return
+	}
+	if len(job.Passphrase) < 8 {
+		errs.HTTPResponse(w, errs.E(OpBackupAPI, errs.KindInvalid, "passphrase must be at least 8 characters"))
+		return
+	}
+	if err := job.Target.validate(); err != nil {
+		errs.HTTPResponse(w, err)
+		return
+	}
+	if err := job.Schedule.validate(); err != nil {
+		errs.HTTPResponse(w, err)
+		return
+	}
+	if job.Retention.Last < 0 || job.Retention.Daily < 0 || job.Retention.Weekly < 0 || job.Retention.Monthly < 0 {
+		errs.HTTPResponse(w, errs.E(OpBackupAPI, errs.KindInvalid, "retention counts must not be negative"))
+		return
+	}
+	for _, pat := range job.Exclude {
+		if _, err := path.Match(pat, ""); err != nil {
+			errs.HTTPResponse(w, errs.E(OpBackupAPI, errs.KindInvalid, fmt.Sprintf("bad exclude pattern %q", pat)))
+			return
+		}
+	}
+
+	status := http.StatusOK
+	if old == nil {
+		job.ID = randomHex(8)
+		job.Created = time.Now().UTC()
+		m.Status[job.ID] = &Status{}
+		status = http.StatusCreated
+	}
+	m.Jobs[job.ID] = &job
+	if err := m.save(); err != nil {
+		errs.HTTPResponse(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(m.response(&job, m.Status[job.ID]))
+}
+
+func keepSecret(v *string, old string) {
+	if *v == secretMask {
+		*v = old
+	}
+}
+
+// deleteJob forgets the job. The repository on the target is left alone.
+func (m *Manager) deleteJob(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.Jobs[id] == nil {
+		errs.HTTPResponse(w, errs.E(OpBackupAPI, errs.KindNotFound, "unknown backup job"))
+		return
+	}
+	if cancel := m.cancels[id]; cancel != nil {
+		cancel()
+	}
+	delete(m.Jobs, id)
+	delete(m.Status, id)
+	if err := m.save(); err != nil {
+		errs.HTTPResponse(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleRun starts a backup now (POST) or cancels the running operation
+// (DELETE).
+func (m *Manager) handleRun(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+	switch r.Method {
+	case http.MethodPost:
+		m.mu.Lock()
+		_, ok := m.Jobs[id]
+		busy := m.cancels[id] != nil
+		m.mu.Unlock()
+		if !ok {
+			errs.HTTPResponse(w, errs.E(OpBackupAPI, errs.KindNotFound, "unknown backup job"))
+			return
+		}
+		if busy {
+			errs.HTTPResponse(w, errs.E(OpBackupAPI, errs.KindInvalid, "this job is already running"))
+			return
+		}
+		m.runAsync(id)
+		w.WriteHeader(http.StatusAccepted)
+	case http.MethodDelete:
+		m.mu.Lock()
+		cancel := m.cancels[id]
+		m.mu.Unlock()
+		if cancel == nil {
+			errs.HTTPResponse(w, errs.E(OpBackupAPI, errs.KindNotFound, "nothing is running for this job"))
+			return
+		}
+		cancel()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleSnapshots lists a job's snapshots, or with snapshot= the entries of
+// one folder inside a snapshot (path=, empty for the top).
+func (m *Manager) handleSnapshots(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	m.mu.Lock()
+	j, ok := m.Jobs[q.Get("id")]
+	var job Job
+	if ok {
+		job = *j
+	}
+	m.mu.Unlock()
+	if !ok {
+		errs.HTTPResponse(w, errs.E(OpBackupAPI, errs.KindNotFound, "unknown backup job"))
+		return
+	}
+
+	t, repo, err := m.open(r.Context(), OpBackupAPI, &job)
+	if err != nil {
+		errs.HTTPResponse(w, err)
+		return
+	}
+	defer t.Close()
+
+	w.Header().Set("Content-Type", "application/json")
+	if q.Get("snapshot") == "" {
+		list, err := repo.Snapshots(r.Context())
+		if err != nil {
+			errs.HTTPResponse(w, errs.E(OpBackupAPI, errs.KindIO, err))
+			return
+		}
+		for _, s := range list {
+			s.Tree = nil
+		}
+		json.NewEncoder(w).Encode(map[string][]*Snapshot{"snapshots": list})
+		return
+	}
+
+	snap, err := repo.Snapshot(r.Context(), q.Get("snapshot"))
+	if errors.Is(err, errNotExist) {
+		errs.HTTPResponse(w, errs.E(OpBackupAPI, errs.KindNotFound, "unknown snapshot"))
+		return
+	}
+	if err != nil {
+		errs.HTTPResponse(w, errs.E(OpBackupAPI, errs.KindIO, err))
+		return
+	}
+	nodes, err := repo.Tree(r.Context(), snap)
+	if err != nil {
+		errs.HTTPResponse(w, errs.E(OpBackupAPI, errs.KindIO, err))
+		return
+	}
+	dir := strings.Trim(path.Clean("/"+q.Get("path")), "/")
+	entries := []Node{}
+	for _, n := range nodes {
+		parent := path.Dir(n.Path)
+		if parent == "." {
+			parent = ""
+		}
+		if parent == dir {
+			n.Chunks = nil
+			entries = append(entries, n)
+		}
+	}
+	json.NewEncoder(w).Encode(map[string]any{"snapshot": snap.ID, "path": dir, "entries": entries})
+}
+
+// handleRestore starts a restore in the background; progress and the
+// result show up in the job's status.
+func (m *Manager) handleRestore(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req RestoreRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil {
+		errs.HTTPResponse(w, errs.E(OpBackupAPI, errs.KindInvalid, "Invalid JSON"))
+		return
+	}
+	m.mu.Lock()
+	_, ok := m.Jobs[req.Job]
+	busy := m.cancels[req.Job] != nil
+	m.mu.Unlock()
+	if !ok {
+		errs.HTTPResponse(w, errs.E(OpBackupAPI, errs.KindNotFound, "unknown backup job"))
+		return
+	}
+	if busy {
+		errs.HTTPResponse(w, errs.E(OpBackupAPI, errs.KindInvalid, "wait for the running job to finish"))
+		return
+	}
+
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		if _, err := m.Restore(context.Background(), req); err != nil {
+			log.Printf("[BACKUP] Restore failed: %v", err)
+		}
+	}()
+	w.WriteHeader(http.StatusAccepted)
+}
@@ -0,0 +1,219 @@
+package backup
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type recordHooks struct {
+	mu      sync.Mutex
+	changed []string
+	offline bool
+}
+
+func (h *recordHooks) NotifyChanged(p string) {
+	h.mu.Lock()
+	h.changed = append(h.changed, p)
+	h.mu.Unlock()
+}
+
+func (h *recordHooks) Offline(string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.offline
+}
+
+func doJSON(t *testing.T, m *Manager, method, target, body string, out any) int {
+	t.Helper()
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	w := httptest.NewRecorder()
+	path := target
+	if i := strings.IndexByte(path, '?'); i >= 0 {
+		path = path[:i]
+	}
+	m.GetRoutes()[path](w, req)
+	if out != nil && w.Code < 300 {
+		if err := json.Unmarshal(w.Body.Bytes(), out); err != nil {
+			t.Fatalf("%s %s: %v: %s", method, target, err, w.Body)
+		}
+	}
+	return w.Code
+}
+
+func TestManagerAPI(t *testing.T) {
+	dataDir, stateDir, usb := t.TempDir(), t.TempDir(), t.TempDir()
+	writeTree(t, dataDir, map[string]string{
+		"Documents/taxes.pdf": "numbers",
+		"Photos/cat.jpg":      strings.Repeat("meow", 2000),
+		"cache/tmp.bin":       "skip me",
+	})
+	hooks := &recordHooks{}
+	statePath := filepath.Join(stateDir, "backup", "jobs.json")
+	m, err := NewManager(dataDir, statePath, hooks)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jobBody := `{"name":"Desk drive","target":{"kind":"local","path":"` + usb + `"},` +
+		`"passphrase":"correct horse","schedule":{"daily":"03:00"},"retention":{"daily":7},"exclude":["cache"]}`
+
+	invalid := []struct {
+		name string
+		body string
+		want int
+	}{
+		{"bad json", `{`, http.StatusBadRequest},
+		{"no name", strings.Replace(jobBody, "Desk drive", " ", 1), http.StatusBadRequest},
+		{"short passphrase", strings.Replace(jobBody, "correct horse", "short", 1), http.StatusBadRequest},
+		{"relative path", strings.Replace(jobBody, usb, "usb", 1), http.StatusBadRequest},
+		{"unknown kind", strings.Replace(jobBody, `"local"`, `"floppy"`, 1), http.StatusBadRequest},
+		{"sftp without auth", `{"name":"x","passphrase":"12345678","target":{"kind":"sftp","addr":"h:22","user":"u"}}`, http.StatusBadRequest},
+		{"too frequent", strings.Replace(jobBody, `"daily":"03:00"`, `"every":"1m"`, 1), http.StatusBadRequest},
+		{"bad time", strings.Replace(jobBody, "03:00", "25:00", 1), http.StatusBadRequest},
+		{"bad pattern", strings.Replace(jobBody, `"cache"`, `"["`, 1), http.StatusBadRequest},
+		{"unknown id", `{"id":"nope","name":"x"}`, http.StatusNotFound},
+	}
+	for _, tt := range invalid {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := doJSON(t, m, "POST", "/api/backup/jobs", tt.body, nil); got != tt.want {
+				t.Errorf("status %d, want %d", got, tt.want)
+			}
+		})
+	}
+
+	var job JobResponse
+	if code := doJSON(t, m, "POST", "/api/backup/jobs", jobBody, &job); code != http.StatusCreated {
+		t.Fatalf("create: %d", code)
+	}
+	if job.Passphrase != secretMask || job.Status.NextRun == nil || job.Status.NextRun.Hour() != 3 {
+		t.Errorf("created job = %+v", job)
+	}
+	if fi, err := os.Stat(statePath); err != nil || fi.Mode().Perm() != 0600 {
+		t.Fatalf("state file: %v %v", fi, err)
+	}
+
+	// Run now, then check status and the snapshot list
+	if code := doJSON(t, m, "POST", "/api/backup/run?id="+job.ID, "", nil); code != http.StatusAccepted {
+		t.Fatalf("run: %d", code)
+	}
+	m.wg.Wait()
+
+	var jobs struct{ Jobs []JobResponse }
+	doJSON(t, m, "GET", "/api/backup/jobs", "", &jobs)
+	st := jobs.Jobs[0].Status
+	if st.Running || st.LastError != "" || st.LastSuccess == nil || st.Snapshots != 1 || st.LastSnapshot.Files != 2 {
+		t.Fatalf("status after run = %+v", st)
+	}
+
+	// Nothing is backed up while the data drive is ejected, and the empty
+	// folder does not count as a run
+	hooks.offline = true
+	m.runDue(time.Now().AddDate(0, 0, 2))
+	m.wg.Wait()
+	if _, err := m.Run(t.Context(), job.ID); err == nil {
+		t.Error("backed up with storage offline")
+	}
+	if got := m.Status[job.ID]; got.Snapshots != 1 || !got.LastRun.Equal(*st.LastRun) {
+		t.Errorf("status after an offline run = %+v", got)
+	}
+	hooks.offline = false
+
+	var snaps struct{ Snapshots []*Snapshot }
+	if code := doJSON(t, m, "GET", "/api/backup/snapshots?id="+job.ID, "", &snaps); code != http.StatusOK || len(snaps.Snapshots) != 1 {
+		t.Fatalf("snapshots: %d %+v", code, snaps)
+	}
+	var browse struct{ Entries []Node }
+	doJSON(t, m, "GET", "/api/backup/snapshots?id="+job.ID+"&snapshot=latest&path=Photos", "", &browse)
+	if len(browse.Entries) != 1 || browse.Entries[0].Path != "Photos/cat.jpg" || browse.Entries[0].Chunks != nil {
+		t.Errorf("browse Photos = %+v", browse.Entries)
+	}
+	if code := doJSON(t, m, "GET", "/api/backup/snapshots?id="+job.ID+"&snapshot=nope", "", nil); code != http.StatusNotFound {
+		t.Errorf("unknown snapshot: %d", code)
+	}
+
+	// Restore a folder to the default place and a file to a chosen one
+	if code := doJSON(t, m, "POST", "/api/backup/restore", `{"job":"`+job.ID+`","path":"Documents"}`, nil); code != http.StatusAccepted {
+		t.Fatalf("restore: %d", code)
+	}
+	m.wg.Wait()
+	restored, _ := filepath.Glob(filepath.Join(dataDir, restoreRoot, "*", "Documents", "taxes.pdf"))
+	if len(restored) != 1 {
+		t.Fatalf("restored to %v", restored)
+	}
+	if code := doJSON(t, m, "POST", "/api/backup/restore", `{"job":"`+job.ID+`","path":"Photos/cat.jpg","dest":"../../etc"}`, nil); code != http.StatusAccepted {
+		t.Fatalf("restore: %d", code)
+	}
+	m.wg.Wait()
+	if data, err := os.ReadFile(filepath.Join(dataDir, "etc", "cat.jpg")); err != nil || len(data) != 8000 {
+		t.Errorf("restore with dest escaped DataDir or failed: %v", err)
+	}
+	hooks.mu.Lock()
+	if len(hooks.changed) < 3 {
+		t.Errorf("hooks saw %v", hooks.changed)
+	}
+	hooks.mu.Unlock()
+	doJSON(t, m, "GET", "/api/backup/jobs", "", &jobs)
+	if r := jobs.Jobs[0].Status.LastRestore; r == nil || r.Files != 1 {
+		t.Errorf("last restore = %+v", r)
+	}
+
+	// Updating with masked secrets keeps them; changing the passphrase is refused
+	update := strings.Replace(jobBody, `{"name"`, `{"id":"`+job.ID+`","name"`, 1)
+	if code := doJSON(t, m, "POST", "/api/backup/jobs", strings.Replace(update, "correct horse", secretMask, 1), nil); code != http.StatusOK {
+		t.Errorf("update: %d", code)
+	}
+	if m.Jobs[job.ID].Passphrase != "correct horse" {
+		t.Error("masked passphrase overwrote the real one")
+	}
+	if code := doJSON(t, m, "POST", "/api/backup/jobs", strings.Replace(update, "correct horse", "another horse", 1), nil); code != http.StatusBadRequest {
+		t.Errorf("passphrase change: %d", code)
+	}
+
+	// Everything survives a restart
+	m2, err := NewManager(dataDir, statePath, hooks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m2.Jobs[job.ID] == nil || m2.Status[job.ID].Snapshots != 1 {
+		t.Fatal("job or status lost on reload")
+	}
+
+	if code := doJSON(t, m, "DELETE", "/api/backup/run?id="+job.ID, "", nil); code != http.StatusNotFound {
+		t.Errorf("cancel while idle: %d", code)
+	}
+	if code := doJSON(t, m, "DELETE", "/api/backup/jobs?id="+job.ID, "", nil); code != http.StatusNoContent {
+		t.Errorf("delete: %d", code)
+	}
+	if code := doJSON(t, m, "POST", "/api/backup/run?id="+job.ID, "", nil); code != http.StatusNotFound {
+		t.Errorf("run deleted job: %d", code)
+	}
+}
+
+func TestManagerWrongPassphrase(t *testing.T) {
+	dataDir, usb := t.TempDir(), t.TempDir()
+	writeTree(t, dataDir, map[string]string{"a.txt": "a"})
+	m, err := NewManager(dataDir, filepath.Join(t.TempDir(), "jobs.json"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo, err := openRepository(t.Context(), &dirTarget{root: usb}, "someone else's")
+	if err != nil || repo == nil {
+		t.Fatal(err)
+	}
+	m.Jobs["j"] = &Job{ID: "j", Name: "j", Target: TargetConfig{Kind: KindLocal, Path: usb}, Passphrase: "not the same"}
+	m.Status["j"] = &Status{}
+
+	if _, err := m.Run(t.Context(), "j"); err == nil {
+		t.Fatal("backed up into a repository with another passphrase")
+	}
+	if st := m.Status["j"]; st.LastError == "" || st.LastRun == nil || st.LastSuccess != nil || st.Running {
+		t.Errorf("status = %+v", st)
+	}
+}
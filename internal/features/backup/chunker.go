@@ -0,0 +1,88 @@
+package backup
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"math/bits"
+)
+
+const (
+	MinChunk = 256 << 10
+	AvgChunk = 1 << 20
+	MaxChunk = 4 << 20
+)
+
+// chunker splits a stream at content-defined boundaries (a gear hash, as in
+// FastCDC), so inserting a few bytes into a file only changes the chunk
+// around the insertion and every other chunk still deduplicates. The gear
+// table is derived from the repository key, so chunk boundaries say
+// nothing about the content to whoever holds the target.
+type chunker struct {
+	gear     [256]uint64
+	min, max int
+	mask     uint64
+}
+
+func newChunker(key []byte, min, avg, max int) *chunker {
+	c := &chunker{min: min, max: max}
+	// Cut where the top log2(avg) bits of the hash are zero
+	c.mask = ^uint64(0) << (64 - bits.Len(uint(avg-1)))
+	for i := range c.gear {
+		var buf [40]byte
+		copy(buf[:32], key)
+		binary.BigEndian.PutUint64(buf[32:], uint64(i))
+		sum := sha256.Sum256(buf[:])
+		c.gear[i] = binary.BigEndian.Uint64(sum[:8])
+	}
+	return c
+}
+
+// split calls fn with each chunk of r. The slice is only valid during the
+// call.
+func (c *chunker) split(r io.Reader, fn func([]byte) error) error {
+	buf := make([]byte, 2*c.max)
+	start, end := 0, 0
+	eof := false
+
+	for {
+		// Keep at least max bytes available unless the input is done
+		if !eof && end-start < c.max {
+			copy(buf, buf[start:end])
+			end -= start
+			start = 0
+			n, err := io.ReadFull(r, buf[end:])
+			end += n
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				eof = true
+			} else if err != nil {
+				return err
+			}
+		}
+		if start == end {
+			return nil
+		}
+
+		n := c.cut(buf[start:end])
+		if err := fn(buf[start : start+n]); err != nil {
+			return err
+		}
+		start += n
+	}
+}
+
+// cut returns the length of the next chunk at the front of p.
+func (c *chunker) cut(p []byte) int {
+	if len(p) <= c.min {
+		return len(p)
+	}
+	limit := min(len(p), c.max)
+	var h uint64
+	for i := c.min; i < limit; i++ {
+		h = h<<1 + c.gear[p[i]]
+		if h&c.mask == 0 {
+			return i + 1
+		}
+	}
+	return limit
+}
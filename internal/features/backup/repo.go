@@ -0,0 +1,678 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	repoVersion    = 1
+	configKey      = "config"
+	dataPrefix     = "data/"
+	snapshotPrefix = "snapshots/"
+)
+
+var (
+	ErrWrongPassphrase = errors.New("backup: wrong passphrase for this repository")
+	errCorrupt         = errors.New("backup: object failed authentication")
+)
+
+// scryptN and chunkSizes are stored in each repository when it is created,
+// so changing them only affects new ones.
+var (
+	scryptN    = 1 << 15
+	chunkSizes = [3]int{MinChunk, AvgChunk, MaxChunk}
+)
+
+// repoConfig is the only object stored in the clear. The keys that encrypt
+// and name everything else are sealed with a key derived from the
+// passphrase, so the passphrase can change without re-encrypting data.
+type repoConfig struct {
+	Version  int       `json:"version"`
+	ID       string    `json:"id"`
+	Created  time.Time `json:"created"`
+	Salt     []byte    `json:"salt"`
+	N        int       `json:"n"`
+	R        int       `json:"r"`
+	P        int       `json:"p"`
+	Keys     []byte    `json:"keys"`
+	ChunkMin int       `json:"chunkMin"`
+	ChunkAvg int       `json:"chunkAvg"`
+	ChunkMax int       `json:"chunkMax"`
+}
+
+// Repository is an encrypted, deduplicated store of snapshots on a Target.
+// File content is split into content-defined chunks; each chunk is named by
+// a keyed hash of its plaintext and stored once however many files and
+// snapshots use it. Chunk names, contents and snapshot metadata are all
+// encrypted and authenticated (XChaCha20-Poly1305), so the target only
+// learns object sizes and counts.
+type Repository struct {
+	target  Target
+	cfg     repoConfig
+	aead    cipher.AEAD
+	idKey   []byte
+	chunker *chunker
+	known   map[string]bool // chunk ids present on the target
+}
+
+// Snapshot is the header of one backup run. The file list itself is stored
+// in chunks like file content and loaded with Tree.
+type Snapshot struct {
+	ID     string    `json:"id"`
+	Time   time.Time `json:"time"`
+	Parent string    `json:"parent,omitempty"`
+	Files  int       `json:"files"`
+	Dirs   int       `json:"dirs"`
+	Size   int64     `json:"size"`  // bytes of file content in the snapshot
+	Added  int64     `json:"added"` // bytes of new chunks this run uploaded
+	Tree   []string  `json:"tree,omitempty"`
+}
+
+// Node is one entry of a snapshot's tree. Path is relative to the backed
+// up folder, with forward slashes.
+type Node struct {
+	Path    string      `json:"path"`
+	Dir     bool        `json:"dir,omitempty"`
+	Link    string      `json:"link,omitempty"`
+	Mode    fs.FileMode `json:"mode"`
+	Size    int64       `json:"size,omitempty"`
+	ModTime time.Time   `json:"mtime"`
+	Chunks  []string    `json:"chunks,omitempty"`
+}
+
+// Progress is reported as a backup or restore goes.
+type Progress struct {
+	Files   int    `json:"files"`
+	Bytes   int64  `json:"bytes"`
+	Added   int64  `json:"added"`
+	Current string `json:"current,omitempty"`
+}
+
+// openRepository unlocks the repository on t, creating one if the target
+// is empty.
+func openRepository(ctx context.Context, t Target, passphrase string) (*Repository, error) {
+	if passphrase == "" {
+		return nil, errors.New("backup: a passphrase is required")
+	}
+	data, err := t.Get(ctx, configKey)
+	if errors.Is(err, errNotExist) {
+		return initRepository(ctx, t, passphrase)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var cfg repoConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("backup: unreadable repository config: %w", err)
+	}
+	if cfg.Version != repoVersion {
+		return nil, fmt.Errorf("backup: unsupported repository version %d", cfg.Version)
+	}
+	if cfg.ChunkMin <= 0 || cfg.ChunkMin > cfg.ChunkAvg || cfg.ChunkAvg > cfg.ChunkMax || cfg.ChunkMax > MaxChunk {
+		return nil, errors.New("backup: repository config has invalid chunk sizes")
+	}
+
+	kek, err := scrypt.Key([]byte(passphrase), cfg.Salt, cfg.N, cfg.R, cfg.P, chacha20poly1305.KeySize)
+	if err != nil {
+		return nil, err
+	}
+	wrap, _ := chacha20poly1305.NewX(kek)
+	keys, err := openSealed(wrap, configKey, cfg.Keys)
+	if err != nil || len(keys) != 64 {
+		return nil, ErrWrongPassphrase
+	}
+	r := &Repository{target: t, cfg: cfg}
+	r.unlock(keys)
+	return r, r.loadKnown(ctx)
+}
+
+func initRepository(ctx context.Context, t Target, passphrase string) (*Repository, error) {
+	cfg := repoConfig{
+		Version:  repoVersion,
+		ID:       randomHex(8),
+		Created:  time.Now().UTC(),
+		Salt:     randomBytes(16),
+		N:        scryptN,
+		R:        8,
+		P:        1,
+		ChunkMin: chunkSizes[0],
+		ChunkAvg: chunkSizes[1],
+		ChunkMax: chunkSizes[2],
+	}
+	kek, err := scrypt.Key([]byte(passphrase), cfg.Salt, cfg.N, cfg.R, cfg.P, chacha20poly1305.KeySize)
+	if err != nil {
+		return nil, err
+	}
+	wrap, _ := chacha20poly1305.NewX(kek)
+	keys := randomBytes(64)
+	cfg.Keys = seal(wrap, configKey, keys)
+
+	data, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := t.Put(ctx, configKey, data); err != nil {
+		return nil, err
+	}
+	r := &Repository{target: t, cfg: cfg, known: make(map[string]bool)}
+	r.unlock(keys)
+	return r, nil
+}
+
+func (r *Repository) unlock(keys []byte) {
+	r.aead, _ = chacha20poly1305.NewX(keys[:32])
+	r.idKey = keys[32:]
+	r.chunker = newChunker(r.idKey, r.cfg.ChunkMin, r.cfg.ChunkAvg, r.cfg.ChunkMax)
+}
+
+func (r *Repository) loadKnown(ctx context.Context) error {
+	keys, err := r.target.List(ctx, dataPrefix)
+	if err != nil {
+		return err
+	}
+	r.known = make(map[string]bool, len(keys))
+	for _, k := range keys {
+		r.known[path.Base(k)] = true
+	}
+	return nil
+}
+
+// seal encrypts plain, binding it to the object key so a blob cannot be
+// passed off as another one.
+func seal(aead cipher.AEAD, key string, plain []byte) []byte {
+	nonce := randomBytes(aead.NonceSize())
+	return aead.Seal(nonce, nonce, plain, []byte(key))
+}
+
+func openSealed(aead cipher.AEAD, key string, blob []byte) ([]byte, error) {
+	if len(blob) < aead.NonceSize()+aead.Overhead() {
+		return nil, errCorrupt
+	}
+	n := aead.NonceSize()
+	plain, err := aead.Open(nil, blob[:n], blob[n:], []byte(key))
+	if err != nil {
+		return nil, errCorrupt
+	}
+	return plain, nil
+}
+
+func (r *Repository) chunkID(p []byte) string {
+	m := hmac.New(sha256.New, r.idKey)
+	m.Write(p)
+	return hex.EncodeToString(m.Sum(nil))
+}
+
+func chunkKey(id string) string {
+	return dataPrefix + id[:2] + "/" + id
+}
+
+// putChunks stores the chunks of rd that the target does not have yet and
+// returns their ids in order, plus the bytes newly uploaded.
+func (r *Repository) putChunks(ctx context.Context, rd io.Reader) ([]string, int64, error) {
+	var ids []string
+	var added int64
+	err := r.chunker.split(rd, func(p []byte) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		id := r.chunkID(p)
+		ids = append(ids, id)
+		if r.known[id] {
+			return nil
+		}
+		key := chunkKey(id)
+		if err := r.target.Put(ctx, key, seal(r.aead, key, p)); err != nil {
+			return err
+		}
+		r.known[id] = true
+		added += int64(len(p))
+		return nil
+	})
+	return ids, added, err
+}
+
+// getChunk fetches, decrypts and verifies one chunk.
+func (r *Repository) getChunk(ctx context.Context, id string) ([]byte, error) {
+	if len(id) != 64 {
+		return nil, errCorrupt
+	}
+	key := chunkKey(id)
+	blob, err := r.target.Get(ctx, key)
+	if err != nil {
+		return nil, fmt.Errorf("chunk %s: %w", id[:12], err)
+	}
+	p, err := openSealed(r.aead, key, blob)
+	if err != nil || !hmac.Equal([]byte(r.chunkID(p)), []byte(id)) {
+		return nil, fmt.Errorf("chunk %s: %w", id[:12], errCorrupt)
+	}
+	return p, nil
+}
+
+// BackupOptions controls one Backup run.
+type BackupOptions struct {
+	Parent   *Snapshot                       // unchanged files are taken from here without reading them
+	Exclude  func(rel string, dir bool) bool // rel has forward slashes
+	Progress func(Progress)
+}
+
+// Backup snapshots the folder root. Files whose size and mtime match the
+// parent snapshot reuse its chunks; everything else is read and chunked,
+// and only chunks the repository lacks are uploaded.
+func (r *Repository) Backup(ctx context.Context, root string, opts BackupOptions) (*Snapshot, error) {
+	parent := make(map[string]Node)
+	if opts.Parent != nil {
+		nodes, err := r.Tree(ctx, opts.Parent)
+		if err != nil {
+			return nil, err
+		}
+		for _, n := range nodes {
+			parent[n.Path] = n
+		}
+	}
+
+	snap := &Snapshot{ID: newSnapshotID(time.Now()), Time: time.Now().UTC()}
+	if opts.Parent != nil {
+		snap.Parent = opts.Parent.ID
+	}
+	var nodes []Node
+	var prog Progress
+
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// Unreadable folders are skipped rather than failing the whole run
+			if d != nil && d.IsDir() && p != root {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if cerr := ctx.Err(); cerr != nil {
+			return cerr
+		}
+		if p == root {
+			return nil
+		}
+		rel, _ := filepath.Rel(root, p)
+		rel = filepath.ToSlash(rel)
+		if opts.Exclude != nil && opts.Exclude(rel, d.IsDir()) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		n := Node{Path: rel, Mode: info.Mode().Perm(), ModTime: info.ModTime().UTC()}
+
+		switch {
+		case d.IsDir():
+			n.Dir = true
+			snap.Dirs++
+		case d.Type()&fs.ModeSymlink != 0:
+			n.Link, _ = os.Readlink(p)
+		case d.Type().IsRegular():
+			n.Size = info.Size()
+			if old, ok := parent[rel]; ok && old.Size == n.Size && old.ModTime.Equal(n.ModTime) && r.haveAll(old.Chunks) {
+				n.Chunks = old.Chunks
+			} else {
+				f, err := os.Open(p)
+				if err != nil {
+					return nil
+				}
+				ids, added, err := r.putChunks(ctx, f)
+				f.Close()
+				if err != nil {
+					return fmt.Errorf("%s: %w", rel, err)
+				}
+				n.Chunks = ids
+				prog.Added += added
+			}
+			snap.Files++
+			snap.Size += n.Size
+			prog.Files++
+			prog.Bytes += n.Size
+			prog.Current = rel
+			if opts.Progress != nil {
+				opts.Progress(prog)
+			}
+		default:
+			// Sockets, devices and pipes have no content worth keeping
+			return nil
+		}
+		nodes = append(nodes, n)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	tree, err := json.Marshal(nodes)
+	if err != nil {
+		return nil, err
+	}
+	ids, added, err := r.putChunks(ctx, bytes.NewReader(tree))
+	if err != nil {
+		return nil, err
+	}
+	snap.Tree = ids
+	snap.Added = prog.Added + added
+
+	header, err := json.Marshal(snap)
+	if err != nil {
+		return nil, err
+	}
+	key := snapshotPrefix + snap.ID
+	if err := r.target.Put(ctx, key, seal(r.aead, key, header)); err != nil {
+		return nil, err
+	}
+	return snap, nil
+}
+
+func (r *Repository) haveAll(ids []string) bool {
+	for _, id := range ids {
+		if !r.known[id] {
+			return false
+		}
+	}
+	return true
+}
+
+// Snapshots lists the repository's snapshots, newest first.
+func (r *Repository) Snapshots(ctx context.Context) ([]*Snapshot, error) {
+	keys, err := r.target.List(ctx, snapshotPrefix)
+	if err != nil {
+		return nil, err
+	}
+	var list []*Snapshot
+	for _, key := range keys {
+		blob, err := r.target.Get(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		data, err := openSealed(r.aead, key, blob)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", key, err)
+		}
+		var s Snapshot
+		if err := json.Unmarshal(data, &s); err != nil {
+			return nil, fmt.Errorf("%s: %w", key, err)
+		}
+		list = append(list, &s)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Time.After(list[j].Time) })
+	return list, nil
+}
+
+// Snapshot finds one snapshot by id; "latest" is the newest.
+func (r *Repository) Snapshot(ctx context.Context, id string) (*Snapshot, error) {
+	list, err := r.Snapshots(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range list {
+		if s.ID == id || (id == "latest" && s == list[0]) {
+			return s, nil
+		}
+	}
+	return nil, errNotExist
+}
+
+// Tree loads the file list of a snapshot.
+func (r *Repository) Tree(ctx context.Context, s *Snapshot) ([]Node, error) {
+	var buf bytes.Buffer
+	for _, id := range s.Tree {
+		p, err := r.getChunk(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(p)
+	}
+	var nodes []Node
+	if err := json.Unmarshal(buf.Bytes(), &nodes); err != nil {
+		return nil, fmt.Errorf("snapshot %s: %w", s.ID, err)
+	}
+	return nodes, nil
+}
+
+// RestoreOptions controls one Restore.
+type RestoreOptions struct {
+	// Path picks a file or folder inside the snapshot; empty restores
+	// everything.
+	Path string
+	// Overwrite replaces existing files; otherwise they are left alone and
+	// counted as skipped.
+	Overwrite bool
+	Progress  func(Progress)
+	// Restored is called with the full path of everything written.
+	Restored func(full string)
+}
+
+type RestoreResult struct {
+	Files   int   `json:"files"`
+	Bytes   int64 `json:"bytes"`
+	Skipped int   `json:"skipped"`
+}
+
+// Restore writes the selected part of a snapshot below dest. The selected
+// file or folder keeps its own name: restoring "Photos/2023" into dest
+// produces dest/2023/... Every chunk is verified before it is written, and
+// files appear atomically once complete.
+func (r *Repository) Restore(ctx context.Context, s *Snapshot, dest string, opts RestoreOptions) (RestoreResult, error) {
+	var res RestoreResult
+	nodes, err := r.Tree(ctx, s)
+	if err != nil {
+		return res, err
+	}
+	sel := strings.Trim(path.Clean("/"+opts.Path), "/")
+	base := path.Dir(sel)
+	if sel == "" {
+		base = "."
+	}
+
+	found := sel == ""
+	var prog Progress
+	for _, n := range nodes {
+		if sel != "" && n.Path != sel && !strings.HasPrefix(n.Path, sel+"/") {
+			continue
+		}
+		found = true
+		if err := ctx.Err(); err != nil {
+			return res, err
+		}
+		rel := n.Path
+		if base != "." {
+			rel = strings.TrimPrefix(n.Path, base+"/")
+		}
+		full := filepath.Join(dest, filepath.FromSlash(rel))
+
+		switch {
+		case n.Dir:
+			if err := os.MkdirAll(full, 0755); err != nil {
+				return res, err
+			}
+			if opts.Restored != nil {
+				opts.Restored(full)
+			}
+		case n.Link != "":
+			os.MkdirAll(filepath.Dir(full), 0755)
+			if _, err := os.Lstat(full); err == nil {
+				if !opts.Overwrite {
+					res.Skipped++
+					continue
+				}
+				os.Remove(full)
+			}
+			if err := os.Symlink(n.Link, full); err != nil {
+				return res, err
+			}
+			if opts.Restored != nil {
+				opts.Restored(full)
+			}
+		default:
+			if _, err := os.Lstat(full); err == nil && !opts.Overwrite {
+				res.Skipped++
+				continue
+			}
+			if err := r.restoreFile(ctx, n, full); err != nil {
+				return res, fmt.Errorf("%s: %w", n.Path, err)
+			}
+			if opts.Restored != nil {
+				opts.Restored(full)
+			}
+			res.Files++
+			res.Bytes += n.Size
+			prog.Files, prog.Bytes, prog.Current = res.Files, res.Bytes, n.Path
+			if opts.Progress != nil {
+				opts.Progress(prog)
+			}
+		}
+	}
+	if !found {
+		return res, fmt.Errorf("%s is not in snapshot %s: %w", sel, s.ID, errNotExist)
+	}
+	return res, nil
+}
+
+func (r *Repository) restoreFile(ctx context.Context, n Node, full string) error {
+	if err := os.MkdirAll(filepath.Dir(full), 0755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(full), ".strct-upload-restore-*")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	fail := func(err error) error {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	var written int64
+	for _, id := range n.Chunks {
+		p, err := r.getChunk(ctx, id)
+		if err != nil {
+			return fail(err)
+		}
+		if _, err := f.Write(p); err != nil {
+			return fail(err)
+		}
+		written += int64(len(p))
+	}
+	if written != n.Size {
+		return fail(fmt.Errorf("restored %d bytes, expected %d", written, n.Size))
+	}
+	if err := f.Sync(); err != nil {
+		return fail(err)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	os.Chmod(tmp, n.Mode.Perm())
+	if err := os.Rename(tmp, full); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	os.Chtimes(full, n.ModTime, n.ModTime)
+	return nil
+}
+
+// Forget deletes the snapshots the policy does not keep, then every chunk
+// no remaining snapshot uses. It returns the ids it removed.
+func (r *Repository) Forget(ctx context.Context, policy Retention, now time.Time) ([]string, error) {
+	list, err := r.Snapshots(ctx)
+	if err != nil {
+		return nil, err
+	}
+	keep := policy.Keep(list, now)
+
+	var removed []string
+	var kept []*Snapshot
+	for _, s := range list {
+		if keep[s.ID] {
+			kept = append(kept, s)
+			continue
+		}
+		if err := r.target.Delete(ctx, snapshotPrefix+s.ID); err != nil {
+			return removed, err
+		}
+		removed = append(removed, s.ID)
+	}
+	if len(removed) == 0 {
+		return nil, nil
+	}
+	return removed, r.prune(ctx, kept)
+}
+
+// prune deletes chunks that none of the given snapshots reference.
+func (r *Repository) prune(ctx context.Context, snaps []*Snapshot) error {
+	used := make(map[string]bool)
+	for _, s := range snaps {
+		for _, id := range s.Tree {
+			used[id] = true
+		}
+		nodes, err := r.Tree(ctx, s)
+		if err != nil {
+			// Never delete data while unsure what is in use
+			return err
+		}
+		for _, n := range nodes {
+			for _, id := range n.Chunks {
+				used[id] = true
+			}
+		}
+	}
+	keys, err := r.target.List(ctx, dataPrefix)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		id := path.Base(key)
+		if used[id] {
+			continue
+		}
+		if err := r.target.Delete(ctx, key); err != nil {
+			return err
+		}
+		delete(r.known, id)
+	}
+	return nil
+}
+
+// newSnapshotID sorts by time and stays unique within a second.
+func newSnapshotID(t time.Time) string {
+	return t.UTC().Format("20060102T150405Z") + "-" + randomHex(4)
+}
+
+func randomBytes(n int) []byte {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func randomHex(n int) string {
+	return hex.EncodeToString(randomBytes(n))
+}
@@ -0,0 +1,281 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func init() {
+	// Keep the KDF and chunks small so tests stay fast
+	scryptN = 1 << 10
+	chunkSizes = [3]int{1 << 10, 4 << 10, 16 << 10}
+}
+
+func writeTree(t *testing.T, root string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		p := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func readTree(t *testing.T, root string) map[string]string {
+	t.Helper()
+	out := map[string]string{}
+	filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, _ := filepath.Rel(root, p)
+		data, _ := os.ReadFile(p)
+		out[filepath.ToSlash(rel)] = string(data)
+		return nil
+	})
+	return out
+}
+
+func assertSameTree(t *testing.T, want, got string) {
+	t.Helper()
+	a, b := readTree(t, want), readTree(t, got)
+	if len(a) != len(b) {
+		t.Errorf("restored %d files, want %d", len(b), len(a))
+	}
+	for name, content := range a {
+		if b[name] != content {
+			t.Errorf("%s: restored %d bytes, want %d", name, len(b[name]), len(content))
+		}
+	}
+}
+
+func randomString(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return string(b)
+}
+
+func TestRepository(t *testing.T) {
+	ctx := context.Background()
+	targetDir, src := t.TempDir(), t.TempDir()
+	tgt := &dirTarget{root: targetDir}
+
+	big := randomString(200 << 10)
+	secret := "TOP-SECRET-PLAINTEXT-MARKER " + strings.Repeat("x", 3000)
+	writeTree(t, src, map[string]string{
+		"docs/secret.txt":  secret,
+		"docs/empty.txt":   "",
+		"photos/big.raw":   big,
+		"photos/copy.raw":  big,
+		"music/song.flac":  randomString(50 << 10),
+		".strct-upload-xy": "partial upload",
+	})
+	os.MkdirAll(filepath.Join(src, "empty-folder"), 0755)
+	old := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+	os.Chtimes(filepath.Join(src, "docs", "secret.txt"), old, old)
+	os.Chmod(filepath.Join(src, "docs", "secret.txt"), 0600)
+
+	repo, err := openRepository(ctx, tgt, "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	skipTemp := func(rel string, dir bool) bool { return strings.HasPrefix(filepath.Base(rel), ".strct-upload-") }
+
+	first, err := repo.Backup(ctx, src, BackupOptions{Exclude: skipTemp})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Files != 5 || first.Dirs != 4 {
+		t.Errorf("first snapshot has %d files and %d dirs, want 5 and 4", first.Files, first.Dirs)
+	}
+	// The duplicate photo is stored once
+	if total := int64(len(big)*2 + len(secret) + 50<<10); first.Size != total || first.Added >= total-int64(len(big))/2 {
+		t.Errorf("size %d added %d, want size %d and the copy deduplicated", first.Size, first.Added, total)
+	}
+
+	// Nothing on the target reveals content or names
+	filepath.WalkDir(targetDir, func(p string, d fs.DirEntry, err error) error {
+		if d.IsDir() {
+			return nil
+		}
+		data, _ := os.ReadFile(p)
+		for _, leak := range []string{"TOP-SECRET", "secret.txt", "photos", big[:64]} {
+			if bytes.Contains(data, []byte(leak)) || strings.Contains(p, leak) {
+				t.Errorf("%s leaks %q", p, leak[:min(len(leak), 16)])
+			}
+		}
+		return nil
+	})
+
+	// An unchanged tree uploads only its new file list
+	second, err := repo.Backup(ctx, src, BackupOptions{Parent: first, Exclude: skipTemp})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.Added > 4<<10 || second.Parent != first.ID {
+		t.Errorf("unchanged incremental added %d bytes (parent %q)", second.Added, second.Parent)
+	}
+
+	// Editing the middle of a big file only uploads the chunks around the edit
+	edited := big[:100<<10] + "EDIT" + big[100<<10:]
+	writeTree(t, src, map[string]string{"photos/big.raw": edited})
+	third, err := repo.Backup(ctx, src, BackupOptions{Parent: second, Exclude: skipTemp})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if third.Added > 48<<10 {
+		t.Errorf("a 4-byte insert uploaded %d bytes", third.Added)
+	}
+
+	// A fresh open with the passphrase sees everything; a wrong one is refused
+	if _, err := openRepository(ctx, tgt, "wrong horse"); !errors.Is(err, ErrWrongPassphrase) {
+		t.Fatalf("wrong passphrase: %v", err)
+	}
+	repo, err = openRepository(ctx, tgt, "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	list, err := repo.Snapshots(ctx)
+	if err != nil || len(list) != 3 || list[0].ID != third.ID {
+		t.Fatalf("snapshots = %d, %v", len(list), err)
+	}
+
+	t.Run("restore tree", func(t *testing.T) {
+		dst := t.TempDir()
+		res, err := repo.Restore(ctx, first, dst, RestoreOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Files != 5 {
+			t.Errorf("restored %d files", res.Files)
+		}
+		got := readTree(t, dst)
+		if got["photos/big.raw"] != big || got["docs/secret.txt"] != secret || got["docs/empty.txt"] != "" {
+			t.Error("restored content differs from the first snapshot")
+		}
+		if _, ok := got[".strct-upload-xy"]; ok {
+			t.Error("excluded file was restored")
+		}
+		if fi, err := os.Stat(filepath.Join(dst, "empty-folder")); err != nil || !fi.IsDir() {
+			t.Error("empty folder not restored")
+		}
+		fi, _ := os.Stat(filepath.Join(dst, "docs", "secret.txt"))
+		if !fi.ModTime().Equal(old) || fi.Mode().Perm() != 0600 {
+			t.Errorf("secret.txt restored with %v %v", fi.ModTime(), fi.Mode())
+		}
+	})
+
+	t.Run("restore one file", func(t *testing.T) {
+		dst := t.TempDir()
+		var notified []string
+		if _, err := repo.Restore(ctx, third, dst, RestoreOptions{Path: "photos/big.raw", Restored: func(p string) { notified = append(notified, p) }}); err != nil {
+			t.Fatal(err)
+		}
+		got := readTree(t, dst)
+		if len(got) != 1 || got["big.raw"] != edited {
+			t.Errorf("restored %v", len(got))
+		}
+		if len(notified) != 1 || notified[0] != filepath.Join(dst, "big.raw") {
+			t.Errorf("notified %v", notified)
+		}
+	})
+
+	t.Run("restore folder without overwriting", func(t *testing.T) {
+		dst := t.TempDir()
+		writeTree(t, dst, map[string]string{"docs/secret.txt": "mine"})
+		res, err := repo.Restore(ctx, first, dst, RestoreOptions{Path: "/docs/"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Files != 1 || res.Skipped != 1 {
+			t.Errorf("files %d skipped %d", res.Files, res.Skipped)
+		}
+		if got := readTree(t, dst); got["docs/secret.txt"] != "mine" || len(got) != 2 {
+			t.Errorf("restore clobbered or missed files: %v", len(got))
+		}
+	})
+
+	t.Run("missing path", func(t *testing.T) {
+		if _, err := repo.Restore(ctx, first, t.TempDir(), RestoreOptions{Path: "nope"}); !errors.Is(err, errNotExist) {
+			t.Errorf("got %v", err)
+		}
+	})
+
+	t.Run("tampered chunk", func(t *testing.T) {
+		nodes, _ := repo.Tree(ctx, first)
+		var id string
+		for _, n := range nodes {
+			if n.Path == "music/song.flac" {
+				id = n.Chunks[0]
+			}
+		}
+		key := chunkKey(id)
+		blob, _ := tgt.Get(ctx, key)
+		blob[len(blob)-1] ^= 1
+		tgt.Put(ctx, key, blob)
+		if _, err := repo.Restore(ctx, first, t.TempDir(), RestoreOptions{Path: "music"}); !errors.Is(err, errCorrupt) {
+			t.Errorf("tampered chunk restored: %v", err)
+		}
+	})
+
+	t.Run("forget and prune", func(t *testing.T) {
+		before, _ := tgt.List(ctx, dataPrefix)
+		removed, err := repo.Forget(ctx, Retention{Last: 1}, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(removed) != 2 {
+			t.Fatalf("removed %v", removed)
+		}
+		after, _ := tgt.List(ctx, dataPrefix)
+		if len(after) >= len(before) {
+			t.Errorf("prune kept %d of %d chunks", len(after), len(before))
+		}
+		// What is left still restores completely
+		dst := t.TempDir()
+		if _, err := repo.Restore(ctx, third, dst, RestoreOptions{Path: "photos"}); err != nil {
+			t.Fatal(err)
+		}
+		if got := readTree(t, dst); got["photos/big.raw"] != edited || got["photos/copy.raw"] != big {
+			t.Error("pruned data the kept snapshot needs")
+		}
+	})
+}
+
+func TestChunkerResyncs(t *testing.T) {
+	c := newChunker([]byte("key"), 1<<10, 4<<10, 16<<10)
+	data := []byte(randomString(256 << 10))
+	cuts := func(p []byte) map[string]bool {
+		out := map[string]bool{}
+		c.split(bytes.NewReader(p), func(b []byte) error {
+			if len(b) > 16<<10 {
+				t.Fatalf("chunk of %d bytes", len(b))
+			}
+			out[string(b)] = true
+			return nil
+		})
+		return out
+	}
+	a := cuts(data)
+	b := cuts(append(append([]byte("prefix"), data[:128<<10]...), data[128<<10:]...))
+	shared := 0
+	for k := range a {
+		if b[k] {
+			shared++
+		}
+	}
+	if shared < len(a)-3 {
+		t.Errorf("only %d of %d chunks survive an insert", shared, len(a))
+	}
+}
@@ -0,0 +1,73 @@
+package backup
+
+import (
+	"fmt"
+	"time"
+)
+
+// Retention says which snapshots survive a prune. Each rule keeps the
+// newest snapshot of that many distinct periods that have one, so a device
+// that was off for a week does not lose its older dailies to the gap. A
+// snapshot kept by any rule is kept; a policy with every field zero keeps
+// everything.
+type Retention struct {
+	Last    int `json:"last,omitempty"`
+	Daily   int `json:"daily,omitempty"`
+	Weekly  int `json:"weekly,omitempty"`
+	Monthly int `json:"monthly,omitempty"`
+}
+
+// DefaultRetention is used for jobs that do not set one.
+var DefaultRetention = Retention{Last: 3, Daily: 7, Weekly: 4, Monthly: 12}
+
+func (p Retention) empty() bool {
+	return p.Last <= 0 && p.Daily <= 0 && p.Weekly <= 0 && p.Monthly <= 0
+}
+
+// Keep returns the ids of the snapshots to keep. list must be newest
+// first. Snapshots dated after now are always kept: a clock that jumped
+// backwards should not make the newest backups look expendable.
+func (p Retention) Keep(list []*Snapshot, now time.Time) map[string]bool {
+	keep := make(map[string]bool)
+	if p.empty() {
+		for _, s := range list {
+			keep[s.ID] = true
+		}
+		return keep
+	}
+
+	rules := []struct {
+		n      int
+		bucket func(*Snapshot) string
+	}{
+		{p.Last, func(s *Snapshot) string { return s.ID }},
+		{p.Daily, func(s *Snapshot) string { return s.Time.Local().Format("2006-01-02") }},
+		{p.Weekly, func(s *Snapshot) string {
+			y, w := s.Time.Local().ISOWeek()
+			return fmt.Sprintf("%d-%02d", y, w)
+		}},
+		{p.Monthly, func(s *Snapshot) string { return s.Time.Local().Format("2006-01") }},
+	}
+	for _, rule := range rules {
+		last := ""
+		left := rule.n
+		for _, s := range list {
+			if left <= 0 {
+				break
+			}
+			b := rule.bucket(s)
+			if b == last {
+				continue
+			}
+			last = b
+			keep[s.ID] = true
+			left--
+		}
+	}
+	for _, s := range list {
+		if s.Time.After(now) {
+			keep[s.ID] = true
+		}
+	}
+	return keep
+}
@@ -0,0 +1,71 @@
+package backup
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestRetentionKeep(t *testing.T) {
+	now := time.Date(2026, 3, 31, 23, 0, 0, 0, time.Local)
+	// Two snapshots a day, at 03:00 and 15:00, for 90 days
+	var list []*Snapshot
+	for d := 0; d < 90; d++ {
+		for _, h := range []int{15, 3} {
+			ts := time.Date(2026, 3, 31-d, h, 0, 0, 0, time.Local)
+			list = append(list, &Snapshot{ID: ts.Format("01-02T15"), Time: ts})
+		}
+	}
+
+	tests := []struct {
+		name   string
+		policy Retention
+		list   []*Snapshot
+		want   []string
+	}{
+		{"empty policy keeps all", Retention{}, list[:4], []string{"03-30T03", "03-30T15", "03-31T03", "03-31T15"}},
+		{"last", Retention{Last: 3}, list, []string{"03-30T15", "03-31T03", "03-31T15"}},
+		{"daily keeps newest of each day", Retention{Daily: 3}, list, []string{"03-29T15", "03-30T15", "03-31T15"}},
+		{"weekly", Retention{Weekly: 3}, list, []string{"03-22T15", "03-29T15", "03-31T15"}},
+		{"monthly", Retention{Monthly: 2}, list, []string{"02-28T15", "03-31T15"}},
+		{"rules combine", Retention{Last: 1, Daily: 2, Monthly: 3}, list, []string{"01-31T15", "02-28T15", "03-30T15", "03-31T15"}},
+		{"gaps are skipped, not counted", Retention{Daily: 3}, []*Snapshot{list[0], list[20], list[60]}, []string{"03-01T15", "03-21T15", "03-31T15"}},
+		{"future snapshots survive", Retention{Last: 1}, []*Snapshot{{ID: "future", Time: now.Add(time.Hour)}, list[0], list[1]}, []string{"future"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for id := range tt.policy.Keep(tt.list, now) {
+				got = append(got, id)
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("kept %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestScheduleNext(t *testing.T) {
+	at := func(d, h, m int) time.Time { return time.Date(2026, 5, d, h, m, 0, 0, time.Local) }
+	tests := []struct {
+		s    Schedule
+		last time.Time
+		want time.Time
+	}{
+		{Schedule{Every: "6h"}, at(1, 10, 0), at(1, 16, 0)},
+		{Schedule{Daily: "03:30"}, at(1, 10, 0), at(2, 3, 30)},
+		{Schedule{Daily: "03:30"}, at(1, 2, 0), at(1, 3, 30)},
+		{Schedule{Daily: "03:30"}, at(1, 3, 30), at(2, 3, 30)},
+		{Schedule{}, at(1, 3, 30), time.Time{}},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%+v", tt.s), func(t *testing.T) {
+			if got := tt.s.next(tt.last); !got.Equal(tt.want) {
+				t.Errorf("next(%v) = %v, want %v", tt.last, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,184 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/features/s3"
+)
+
+const (
+	s3EmptySHA256  = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	maxS3ErrorBody = 64 << 10
+)
+
+// s3Target talks to any S3-compatible endpoint (AWS, MinIO, Backblaze B2,
+// or another strct device's gateway) with path-style URLs and Signature
+// Version 4, which is all the repository needs.
+type s3Target struct {
+	endpoint string
+	region   string
+	bucket   string
+	prefix   string
+	access   string
+	secret   string
+	client   *http.Client
+	now      func() time.Time
+}
+
+func newS3Target(c *TargetConfig) *s3Target {
+	region := c.Region
+	if region == "" {
+		region = "us-east-1"
+	}
+	prefix := strings.Trim(c.Prefix, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	return &s3Target{
+		endpoint: strings.TrimSuffix(c.Endpoint, "/"),
+		region:   region,
+		bucket:   c.Bucket,
+		prefix:   prefix,
+		access:   c.AccessKey,
+		secret:   c.SecretKey,
+		client:   &http.Client{Timeout: 5 * time.Minute},
+		now:      time.Now,
+	}
+}
+
+type s3Error struct {
+	Status  int
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+func (e *s3Error) Error() string {
+	return fmt.Sprintf("s3: %d %s: %s", e.Status, e.Code, e.Message)
+}
+
+func (s *s3Target) Put(ctx context.Context, key string, data []byte) error {
+	resp, err := s.do(ctx, http.MethodPut, s.prefix+key, nil, data)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *s3Target) Get(ctx context.Context, key string) ([]byte, error) {
+	resp, err := s.do(ctx, http.MethodGet, s.prefix+key, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return readAll(resp.Body, MaxChunk+1<<20)
+}
+
+func (s *s3Target) Delete(ctx context.Context, key string) error {
+	resp, err := s.do(ctx, http.MethodDelete, s.prefix+key, nil, nil)
+	if err != nil && err != errNotExist {
+		return err
+	}
+	if resp != nil {
+		resp.Body.Close()
+	}
+	return nil
+}
+
+type s3ListResult struct {
+	Contents []struct {
+		Key string `xml:"Key"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+func (s *s3Target) List(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	token := ""
+	for {
+		q := url.Values{"list-type": {"2"}, "prefix": {s.prefix + prefix}}
+		if token != "" {
+			q.Set("continuation-token", token)
+		}
+		resp, err := s.do(ctx, http.MethodGet, "", q, nil)
+		if err != nil {
+			if err == errNotExist {
+				return nil, fmt.Errorf("s3: bucket %s does not exist", s.bucket)
+			}
+			return nil, err
+		}
+		var res s3ListResult
+		err = xml.NewDecoder(resp.Body).Decode(&res)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range res.Contents {
+			keys = append(keys, strings.TrimPrefix(c.Key, s.prefix))
+		}
+		if !res.IsTruncated || res.NextContinuationToken == "" {
+			return keys, nil
+		}
+		token = res.NextContinuationToken
+	}
+}
+
+func (s *s3Target) Close() error { return nil }
+
+// do sends one signed request. A 404 comes back as errNotExist, other
+// failures as *s3Error.
+func (s *s3Target) do(ctx context.Context, method, key string, q url.Values, body []byte) (*http.Response, error) {
+	u, err := url.Parse(s.endpoint + "/" + s.bucket + "/" + key)
+	if err != nil {
+		return nil, err
+	}
+	if key == "" {
+		u.Path = "/" + s.bucket
+	}
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = int64(len(body))
+	s.sign(req, body)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound && method != http.MethodPut {
+		return nil, errNotExist
+	}
+	apiErr := &s3Error{Status: resp.StatusCode}
+	if data, _ := io.ReadAll(io.LimitReader(resp.Body, maxS3ErrorBody)); len(data) > 0 {
+		xml.Unmarshal(data, apiErr)
+	}
+	return nil, apiErr
+}
+
+// sign signs req with the gateway's Signature Version 4 signer.
+func (s *s3Target) sign(req *http.Request, body []byte) {
+	payload := s3EmptySHA256
+	if len(body) > 0 {
+		sum := sha256.Sum256(body)
+		payload = hex.EncodeToString(sum[:])
+	}
+	s3.Sign(req, s.access, s.secret, s.region, payload, s.now())
+}
@@ -0,0 +1,235 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/strct-org/strct-agent/internal/errs"
+)
+
+const OpTarget errs.Op = "backup.target"
+
+// errNotExist is what every target returns for a missing object, whatever
+// the transport calls it.
+var errNotExist = fs.ErrNotExist
+
+// Target is where a repository lives. Objects are small-ish blobs (a chunk
+// is at most MaxChunk bytes) addressed by slash-separated keys; Put must
+// not leave a partial object behind if it fails.
+type Target interface {
+	Put(ctx context.Context, key string, data []byte) error
+	Get(ctx context.Context, key string) ([]byte, error)
+	// List returns every key that starts with prefix, in no particular order.
+	List(ctx context.Context, prefix string) ([]string, error)
+	Delete(ctx context.Context, key string) error
+	Close() error
+}
+
+const (
+	KindUSB   = "usb"
+	KindLocal = "local"
+	KindSFTP  = "sftp"
+	KindS3    = "s3"
+)
+
+// TargetConfig says how to reach a target. Only the fields of its Kind are
+// used.
+type TargetConfig struct {
+	Kind string `json:"kind"`
+
+	// usb, local
+	Path string `json:"path,omitempty"`
+
+	// sftp
+	Addr     string `json:"addr,omitempty"` // host:port
+	User     string `json:"user,omitempty"`
+	Password string `json:"password,omitempty"`
+	KeyPEM   string `json:"privateKey,omitempty"`
+	// HostKey pins the server's key as an SSH SHA256 fingerprint. Left
+	// empty, the first key seen is pinned.
+	HostKey string `json:"hostKey,omitempty"`
+
+	// s3
+	Endpoint  string `json:"endpoint,omitempty"` // e.g. https://s3.eu-west-1.amazonaws.com
+	Region    string `json:"region,omitempty"`
+	Bucket    string `json:"bucket,omitempty"`
+	AccessKey string `json:"accessKey,omitempty"`
+	SecretKey string `json:"secretKey,omitempty"`
+
+	// sftp, s3: folder or key prefix inside the server/bucket
+	Prefix string `json:"prefix,omitempty"`
+}
+
+func (c TargetConfig) validate() error {
+	switch c.Kind {
+	case KindUSB, KindLocal:
+		if !filepath.IsAbs(c.Path) {
+			return errs.E(OpTarget, errs.KindInvalid, "path must be absolute")
+		}
+	case KindSFTP:
+		if c.Addr == "" || c.User == "" || (c.Password == "" && c.KeyPEM == "") {
+			return errs.E(OpTarget, errs.KindInvalid, "sftp needs addr, user and a password or private key")
+		}
+	case KindS3:
+		if c.Endpoint == "" || c.Bucket == "" || c.AccessKey == "" || c.SecretKey == "" {
+			return errs.E(OpTarget, errs.KindInvalid, "s3 needs endpoint, bucket, accessKey and secretKey")
+		}
+	default:
+		return errs.E(OpTarget, errs.KindInvalid, fmt.Sprintf("unknown target kind %q", c.Kind))
+	}
+	return nil
+}
+
+// redacted is the config with its secrets blanked, for the API.
+func (c TargetConfig) redacted() TargetConfig {
+	if c.Password != "" {
+		c.Password = "********"
+	}
+	if c.KeyPEM != "" {
+		c.KeyPEM = "********"
+	}
+	if c.SecretKey != "" {
+		c.SecretKey = "********"
+	}
+	return c
+}
+
+// openTarget connects to the target. dataDir is the folder being backed
+// up: a usb target on the same filesystem would not survive the drive
+// dying, which is the whole point, so that is refused.
+func openTarget(ctx context.Context, c *TargetConfig, dataDir string) (Target, error) {
+	switch c.Kind {
+	case KindUSB:
+		if err := checkSeparateDevice(c.Path, dataDir); err != nil {
+			return nil, err
+		}
+		return &dirTarget{root: c.Path}, nil
+	case KindLocal:
+		return &dirTarget{root: c.Path}, nil
+	case KindSFTP:
+		return dialSFTP(ctx, c)
+	case KindS3:
+		return newS3Target(c), nil
+	}
+	return nil, c.validate()
+}
+
+func checkSeparateDevice(target, dataDir string) error {
+	a, err := os.Stat(target)
+	if err != nil {
+		return errs.E(OpTarget, errs.KindNotFound, err, "Backup disk is not mounted")
+	}
+	b, err := os.Stat(dataDir)
+	if err != nil {
+		return errs.E(OpTarget, errs.KindIO, err)
+	}
+	sa, ok1 := a.Sys().(*syscall.Stat_t)
+	sb, ok2 := b.Sys().(*syscall.Stat_t)
+	if ok1 && ok2 && sa.Dev == sb.Dev {
+		return errs.E(OpTarget, errs.KindInvalid, "Backup disk is not mounted: the path is on the data drive")
+	}
+	return nil
+}
+
+// dirTarget stores objects as files below root: an attached disk or any
+// mounted filesystem.
+type dirTarget struct {
+	root string
+}
+
+func (d *dirTarget) path(key string) string {
+	return filepath.Join(d.root, filepath.FromSlash(path.Clean("/"+key)))
+}
+
+func (d *dirTarget) Put(ctx context.Context, key string, data []byte) error {
+	p := d.path(key)
+	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(p), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Rename(f.Name(), p); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return nil
+}
+
+func (d *dirTarget) Get(ctx context.Context, key string) ([]byte, error) {
+	data, err := os.ReadFile(d.path(key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, errNotExist
+	}
+	return data, err
+}
+
+func (d *dirTarget) List(ctx context.Context, prefix string) ([]string, error) {
+	// Only walk the folder the prefix points into
+	start := d.root
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		start = d.path(prefix[:i])
+	}
+	var keys []string
+	err := filepath.WalkDir(start, func(p string, e fs.DirEntry, err error) error {
+		if err != nil {
+			if p == start && errors.Is(err, fs.ErrNotExist) {
+				return filepath.SkipAll
+			}
+			return err
+		}
+		if e.IsDir() || strings.HasPrefix(e.Name(), ".tmp-") {
+			return nil
+		}
+		rel, _ := filepath.Rel(d.root, p)
+		if key := filepath.ToSlash(rel); strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	sort.Strings(keys)
+	return keys, err
+}
+
+func (d *dirTarget) Delete(ctx context.Context, key string) error {
+	err := os.Remove(d.path(key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func (d *dirTarget) Close() error { return nil }
+
+// readAll is io.ReadAll with a ceiling, for bodies from remote targets.
+func readAll(r io.Reader, limit int64) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, limit+1))
+	if err == nil && int64(len(data)) > limit {
+		return nil, fmt.Errorf("object larger than %d bytes", limit)
+	}
+	return data, err
+}
@@ -0,0 +1,251 @@
+package backup
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/strct-org/strct-agent/internal/accounts"
+	"github.com/strct-org/strct-agent/internal/features/s3"
+)
+
+type nopS3Hooks struct{}
+
+func (nopS3Hooks) Enter() bool                    { return true }
+func (nopS3Hooks) Leave()                         {}
+func (nopS3Hooks) Offline(string) bool            { return false }
+func (nopS3Hooks) NotifyChanged(string)           {}
+func (nopS3Hooks) NotifyWritten(string, string)   {}
+func (nopS3Hooks) NotifyRemoved(string)           {}
+func (nopS3Hooks) CheckQuota(string, int64) error { return nil }
+func (nopS3Hooks) Room(string) (int64, error)     { return -1, nil }
+
+// newS3StandIn starts the agent's own S3 gateway as the remote and returns
+// a config for a bucket on it.
+func newS3StandIn(t *testing.T) TargetConfig {
+	t.Helper()
+	dataDir, stateDir := t.TempDir(), t.TempDir()
+	accts, err := accounts.Open(filepath.Join(stateDir, "accounts.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	acct, err := accts.Create("backup", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(s3.New(s3.Config{DataDir: dataDir, StateDir: stateDir}, accts, nopS3Hooks{}))
+	t.Cleanup(srv.Close)
+
+	c := TargetConfig{Kind: KindS3, Endpoint: srv.URL, Bucket: "offsite", AccessKey: acct.AccessKey, SecretKey: acct.SecretKey, Prefix: "strct"}
+	st := newS3Target(&c)
+	resp, err := st.do(context.Background(), "PUT", "", nil, nil)
+	if err != nil {
+		t.Fatalf("create bucket: %v", err)
+	}
+	resp.Body.Close()
+	return c
+}
+
+// newSFTPStandIn starts an SSH server on localhost whose sftp subsystem,
+// the server half of the client library, serves a temporary folder.
+func newSFTPStandIn(t *testing.T) TargetConfig {
+	t.Helper()
+	root := t.TempDir()
+	_, priv, _ := ed25519.GenerateKey(rand.Reader)
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+			if c.User() == "backup" && string(pass) == "hunter22" {
+				return nil, nil
+			}
+			return nil, errors.New("denied")
+		},
+	}
+	cfg.AddHostKey(signer)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			nc, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveSSH(nc, cfg, root)
+		}
+	}()
+	return TargetConfig{Kind: KindSFTP, Addr: ln.Addr().String(), User: "backup", Password: "hunter22", Prefix: "backups/strct"}
+}
+
+func serveSSH(nc net.Conn, cfg *ssh.ServerConfig, root string) {
+	_, chans, reqs, err := ssh.NewServerConn(nc, cfg)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	for nch := range chans {
+		if nch.ChannelType() != "session" {
+			nch.Reject(ssh.UnknownChannelType, "")
+			continue
+		}
+		ch, in, err := nch.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			for req := range in {
+				ok := req.Type == "subsystem" && len(req.Payload) > 4 && string(req.Payload[4:]) == "sftp"
+				req.Reply(ok, nil)
+				if ok {
+					go func() {
+						defer ch.Close()
+						srv, err := sftp.NewServer(ch, sftp.WithServerWorkingDirectory(root))
+						if err != nil {
+							return
+						}
+						srv.Serve()
+					}()
+				}
+			}
+		}()
+	}
+}
+
+// TestTargets runs every kind of target through the same object
+// operations and a full backup and restore.
+func TestTargets(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name   string
+		config func(t *testing.T) TargetConfig
+	}{
+		{"local", func(t *testing.T) TargetConfig { return TargetConfig{Kind: KindLocal, Path: t.TempDir()} }},
+		{"s3", newS3StandIn},
+		{"sftp", newSFTPStandIn},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := tt.config(t)
+			if err := c.validate(); err != nil {
+				t.Fatal(err)
+			}
+			tgt, err := openTarget(ctx, &c, t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer tgt.Close()
+
+			big := make([]byte, 100<<10+17)
+			rand.Read(big)
+			objects := map[string][]byte{
+				"config":            []byte(`{"version":1}`),
+				"data/ab/abcdef":    big,
+				"data/ab/ab0000":    {},
+				"data/cd/cd1234":    []byte("chunk"),
+				"snapshots/2026-01": []byte("snap"),
+			}
+			for k, v := range objects {
+				if err := tgt.Put(ctx, k, v); err != nil {
+					t.Fatalf("put %s: %v", k, err)
+				}
+			}
+			// Overwriting replaces the object
+			if err := tgt.Put(ctx, "config", []byte(`{"version":2}`)); err != nil {
+				t.Fatal(err)
+			}
+			objects["config"] = []byte(`{"version":2}`)
+
+			for k, v := range objects {
+				got, err := tgt.Get(ctx, k)
+				if err != nil || string(got) != string(v) {
+					t.Errorf("get %s = %d bytes, %v; want %d bytes", k, len(got), err, len(v))
+				}
+			}
+			if _, err := tgt.Get(ctx, "data/zz/missing"); !errors.Is(err, errNotExist) {
+				t.Errorf("get missing: %v, want not exist", err)
+			}
+
+			keys, err := tgt.List(ctx, "data/")
+			if err != nil {
+				t.Fatal(err)
+			}
+			sort.Strings(keys)
+			want := []string{"data/ab/ab0000", "data/ab/abcdef", "data/cd/cd1234"}
+			if !reflect.DeepEqual(keys, want) {
+				t.Errorf("list data/ = %v, want %v", keys, want)
+			}
+
+			if err := tgt.Delete(ctx, "data/cd/cd1234"); err != nil {
+				t.Fatal(err)
+			}
+			if err := tgt.Delete(ctx, "data/cd/cd1234"); err != nil {
+				t.Errorf("deleting twice: %v", err)
+			}
+			keys, _ = tgt.List(ctx, "data/cd/")
+			if len(keys) != 0 {
+				t.Errorf("after delete: %v", keys)
+			}
+			if keys, _ := tgt.List(ctx, "nothing/"); len(keys) != 0 {
+				t.Errorf("list of empty prefix = %v", keys)
+			}
+			if c.Kind == KindSFTP && c.HostKey == "" {
+				t.Error("sftp host key was not pinned on first use")
+			}
+
+			// A full round trip through the repository
+			for _, k := range []string{"config", "data/ab/ab0000", "data/ab/abcdef", "snapshots/2026-01"} {
+				tgt.Delete(ctx, k)
+			}
+			src := t.TempDir()
+			writeTree(t, src, map[string]string{"a.txt": "alpha", "sub/b.bin": strings.Repeat("b", 5000)})
+			repo, err := openRepository(ctx, tgt, "correct horse")
+			if err != nil {
+				t.Fatal(err)
+			}
+			snap, err := repo.Backup(ctx, src, BackupOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			dst := t.TempDir()
+			if _, err := repo.Restore(ctx, snap, dst, RestoreOptions{}); err != nil {
+				t.Fatal(err)
+			}
+			assertSameTree(t, src, dst)
+		})
+	}
+
+	t.Run("sftp wrong host key", func(t *testing.T) {
+		c := newSFTPStandIn(t)
+		c.HostKey = "SHA256:not-the-key"
+		if _, err := openTarget(ctx, &c, t.TempDir()); err == nil {
+			t.Fatal("connected despite a host key mismatch")
+		}
+	})
+	t.Run("usb on the data drive", func(t *testing.T) {
+		dir := t.TempDir()
+		c := TargetConfig{Kind: KindUSB, Path: filepath.Join(dir, "usb")}
+		os.Mkdir(c.Path, 0755)
+		if _, err := openTarget(ctx, &c, dir); err == nil {
+			t.Fatal("accepted a usb target on the same filesystem as the data")
+		}
+	})
+}
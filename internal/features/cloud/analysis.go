@@ -0,0 +1,338 @@
+package cloud
+
+import (
+	"encoding/json"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/errs"
+)
+
+const OpAnalysis errs.Op = "cloud.handleAnalysis"
+
+const (
+	maxTreeDepth    = 4
+	maxTreeChildren = 100 // per folder; the rest is summed into Other
+	maxDuplicateSet = 100
+)
+
+// TypeUsage is how much of the storage one category of file takes.
+type TypeUsage struct {
+	Category string `json:"category"`
+	Bytes    int64  `json:"bytes"`
+	Files    int    `json:"files"`
+}
+
+// SizedPath is a file or folder in the largest lists.
+type SizedPath struct {
+	Path     string `json:"path"`
+	Bytes    int64  `json:"bytes"`
+	Category string `json:"category,omitempty"` // files only
+}
+
+// DuplicateSet is files with the same content.
+type DuplicateSet struct {
+	SHA256 string   `json:"sha256"`
+	Size   int64    `json:"size"`   // of each copy
+	Wasted int64    `json:"wasted"` // by all copies but one
+	Paths  []string `json:"paths"`
+}
+
+// Analysis is where the space went, as the usage page shows it.
+type Analysis struct {
+	Updated        time.Time      `json:"updated"`
+	Used           int64          `json:"used"`
+	Files          int            `json:"files"`
+	Types          []TypeUsage    `json:"types"`
+	LargestFiles   []SizedPath    `json:"largestFiles"`
+	LargestFolders []SizedPath    `json:"largestFolders"`
+	Duplicates     []DuplicateSet `json:"duplicates"` // most wasteful first
+	Wasted         int64          `json:"wasted"`     // by every duplicate, not only those listed
+	// Unhashed is how many files are still waiting to be hashed; their
+	// duplicates show up once they are.
+	Unhashed int `json:"unhashed"`
+}
+
+// TreeNode is a folder or file in the size tree a treemap is drawn from.
+type TreeNode struct {
+	Name     string     `json:"name"`
+	Path     string     `json:"path"`
+	Dir      bool       `json:"dir"`
+	Bytes    int64      `json:"bytes"`
+	Files    int        `json:"files,omitempty"`    // below a folder
+	Category string     `json:"category,omitempty"` // files only
+	Children []TreeNode `json:"children,omitempty"`
+	Other    int64      `json:"other,omitempty"` // bytes in children left out of the list
+}
+
+// Analyzer works out where the space went from what Usage and the sync
+// Journal already keep up to date as files change, so it never walks the
+// drive itself. The result is cached and only worked out again every Tick
+// once either has moved on.
+type Analyzer struct {
+	Usage   *Usage
+	Journal *Journal
+	Tick    time.Duration
+	Top     int // entries in the largest lists
+
+	mu       sync.Mutex
+	report   *Analysis
+	children map[string][]TreeNode // folder -> entries, largest first
+	usageGen int64
+	seq      int64
+}
+
+func NewAnalyzer(usage *Usage, journal *Journal) *Analyzer {
+	return &Analyzer{Usage: usage, Journal: journal, Tick: time.Minute, Top: 20}
+}
+
+func (a *Analyzer) Start() error {
+	go func() {
+		ticker := time.NewTicker(a.Tick)
+		defer ticker.Stop()
+		for range ticker.C {
+			a.Refresh()
+		}
+	}()
+	return nil
+}
+
+// Refresh works the analysis out again if anything changed since the last
+// time, and reports whether it did.
+func (a *Analyzer) Refresh() bool {
+	gen, seq := a.Usage.Version(), a.Journal.Version()
+	a.mu.Lock()
+	fresh := a.report != nil && gen == a.usageGen && seq == a.seq
+	a.mu.Unlock()
+	if fresh {
+		return false
+	}
+
+	files := a.Usage.Files()
+	report := &Analysis{Updated: time.Now().UTC(), Unhashed: a.Journal.Pending()}
+
+	types := make(map[string]*TypeUsage)
+	largest := make([]SizedPath, 0, len(files))
+	dirBytes := map[string]int64{}
+	dirFiles := map[string]int{}
+	children := map[string][]TreeNode{}
+	for rel, size := range files {
+		report.Used += size
+		report.Files++
+		category := Category(rel)
+		t := types[category]
+		if t == nil {
+			t = &TypeUsage{Category: category}
+			types[category] = t
+		}
+		t.Bytes += size
+		t.Files++
+		largest = append(largest, SizedPath{Path: rel, Bytes: size, Category: category})
+
+		parent := parentDir(rel)
+		children[parent] = append(children[parent], TreeNode{Name: path.Base(rel), Path: rel, Bytes: size, Category: category})
+		for dir := rel; dir != ""; {
+			dir = parentDir(dir)
+			dirBytes[dir] += size
+			dirFiles[dir]++
+		}
+	}
+
+	folders := make([]SizedPath, 0, len(dirBytes))
+	for dir, size := range dirBytes {
+		if dir == "" {
+			continue
+		}
+		folders = append(folders, SizedPath{Path: dir, Bytes: size})
+		parent := parentDir(dir)
+		children[parent] = append(children[parent], TreeNode{Name: path.Base(dir), Path: dir, Dir: true, Bytes: size, Files: dirFiles[dir]})
+	}
+	for _, list := range children {
+		sort.Slice(list, func(i, j int) bool { return bySize(list[i].Bytes, list[j].Bytes, list[i].Path, list[j].Path) })
+	}
+
+	for _, t := range types {
+		report.Types = append(report.Types, *t)
+	}
+	sort.Slice(report.Types, func(i, j int) bool {
+		return bySize(report.Types[i].Bytes, report.Types[j].Bytes, report.Types[i].Category, report.Types[j].Category)
+	})
+	report.LargestFiles = topSized(largest, a.Top)
+	report.LargestFolders = topSized(folders, a.Top)
+	report.Duplicates, report.Wasted = duplicates(a.Journal.Live(), a.Usage.inode)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.report, a.children = report, children
+	a.usageGen, a.seq = gen, seq
+	return true
+}
+
+// Report is the latest analysis, worked out now if there is none yet.
+func (a *Analyzer) Report() Analysis {
+	a.mu.Lock()
+	report := a.report
+	a.mu.Unlock()
+	if report == nil {
+		a.Refresh()
+		a.mu.Lock()
+		report = a.report
+		a.mu.Unlock()
+	}
+	return *report
+}
+
+// Tree returns the folder at rel with depth levels below it.
+func (a *Analyzer) Tree(rel string, depth int) (TreeNode, bool) {
+	a.Report()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	root := TreeNode{Name: path.Base(rel), Path: rel, Dir: true}
+	if rel == "" {
+		root.Name = ""
+		root.Bytes, root.Files = a.report.Used, a.report.Files
+	} else {
+		found := false
+		for _, n := range a.children[parentDir(rel)] {
+			if n.Path == rel && n.Dir {
+				root, found = n, true
+				break
+			}
+		}
+		if !found {
+			return TreeNode{}, false
+		}
+	}
+	a.fill(&root, depth)
+	return root, true
+}
+
+// fill must be called with mu held.
+func (a *Analyzer) fill(n *TreeNode, depth int) {
+	if depth <= 0 || !n.Dir {
+		return
+	}
+	list := a.children[n.Path]
+	if len(list) > maxTreeChildren {
+		for _, c := range list[maxTreeChildren:] {
+			n.Other += c.Bytes
+		}
+		list = list[:maxTreeChildren]
+	}
+	n.Children = make([]TreeNode, len(list))
+	copy(n.Children, list)
+	for i := range n.Children {
+		a.fill(&n.Children[i], depth-1)
+	}
+}
+
+// duplicates groups files by content, most wasteful set first. Names of one
+// hard-linked file, as inode reports them, take no extra space and only
+// count as one copy.
+func duplicates(entries []SyncEntry, inode func(rel string) (fileID, bool)) ([]DuplicateSet, int64) {
+	bySum := make(map[string]*DuplicateSet)
+	copies := make(map[string]int)
+	seen := make(map[fileID]bool)
+	for _, e := range entries {
+		if e.Size == 0 || e.SHA256 == "" {
+			continue
+		}
+		set := bySum[e.SHA256]
+		if set == nil {
+			set = &DuplicateSet{SHA256: e.SHA256, Size: e.Size}
+			bySum[e.SHA256] = set
+		}
+		set.Paths = append(set.Paths, e.Path)
+		if id, ok := inode(e.Path); ok {
+			if seen[id] {
+				continue
+			}
+			seen[id] = true
+		}
+		copies[e.SHA256]++
+	}
+
+	sets := []DuplicateSet{}
+	var wasted int64
+	for _, set := range bySum {
+		if copies[set.SHA256] < 2 {
+			continue
+		}
+		sort.Strings(set.Paths)
+		set.Wasted = set.Size * int64(copies[set.SHA256]-1)
+		wasted += set.Wasted
+		sets = append(sets, *set)
+	}
+	sort.Slice(sets, func(i, j int) bool { return bySize(sets[i].Wasted, sets[j].Wasted, sets[i].Paths[0], sets[j].Paths[0]) })
+	if len(sets) > maxDuplicateSet {
+		sets = sets[:maxDuplicateSet]
+	}
+	return sets, wasted
+}
+
+func topSized(list []SizedPath, n int) []SizedPath {
+	sort.Slice(list, func(i, j int) bool { return bySize(list[i].Bytes, list[j].Bytes, list[i].Path, list[j].Path) })
+	if len(list) > n {
+		list = list[:n]
+	}
+	return list
+}
+
+// bySize orders largest first, then by name so the order is stable.
+func bySize(a, b int64, nameA, nameB string) bool {
+	if a != b {
+		return a > b
+	}
+	return nameA < nameB
+}
+
+func parentDir(rel string) string {
+	if dir := path.Dir(rel); dir != "." {
+		return dir
+	}
+	return ""
+}
+
+// handleAnalysis serves the breakdown of used space: by type, the largest
+// files and folders and the duplicates.
+func (s *Cloud) handleAnalysis(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.Analysis.Report())
+}
+
+// handleUsageTree serves the size tree below ?path= for a treemap, ?depth=
+// levels deep (1 by default).
+func (s *Cloud) handleUsageTree(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	depth := 1
+	if v := q.Get("depth"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxTreeDepth {
+			errs.HTTPResponse(w, errs.E(OpAnalysis, errs.KindInvalid, "depth must be between 1 and "+strconv.Itoa(maxTreeDepth)))
+			return
+		}
+		depth = n
+	}
+	rel := strings.Trim(path.Clean("/"+q.Get("path")), "/")
+	node, ok := s.Analysis.Tree(rel, depth)
+	if !ok {
+		errs.HTTPResponse(w, errs.E(OpAnalysis, errs.KindNotFound, "no such folder, or it is empty"))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(node)
+}
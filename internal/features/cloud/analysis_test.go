@@ -0,0 +1,134 @@
+package cloud
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestAnalysis(t *testing.T) {
+	c := newTestCloud(t)
+	c.Journal.Throttle = 0
+	c.Analysis = NewAnalyzer(c.Usage, c.Journal)
+	c.Analysis.Top = 3
+	write := func(rel, content string) {
+		p := filepath.Join(c.DataDir, filepath.FromSlash(rel))
+		os.MkdirAll(filepath.Dir(p), 0755)
+		os.WriteFile(p, []byte(content), 0644)
+		c.NotifyChanged(p)
+	}
+	photo := strings.Repeat("p", 3000)
+	write("Photos/a.jpg", photo)
+	write("Photos/copy.jpg", photo)
+	write("Videos/clip.mp4", strings.Repeat("v", 10000))
+	write("Documents/report.pdf", strings.Repeat("d", 500))
+	write("Documents/old/notes.txt", strings.Repeat("n", 200))
+	write("archive.zip", strings.Repeat("z", 100))
+
+	// Nothing is hashed yet, so no duplicates are known
+	if r := c.Analysis.Report(); r.Used != 16800 || r.Files != 6 || len(r.Duplicates) != 0 || r.Unhashed != 6 {
+		t.Fatalf("before hashing: %+v", r)
+	}
+	c.Journal.Process(context.Background())
+	if !c.Analysis.Refresh() {
+		t.Fatal("hashes came in but the analysis was not redone")
+	}
+	if c.Analysis.Refresh() {
+		t.Error("redone with nothing changed")
+	}
+
+	r := c.Analysis.Report()
+	types := map[string]int64{}
+	for _, ty := range r.Types {
+		types[ty.Category] = ty.Bytes
+	}
+	want := map[string]int64{CategoryVideo: 10000, CategoryImage: 6000, CategoryDocument: 700, CategoryArchive: 100}
+	for category, bytes := range want {
+		if types[category] != bytes {
+			t.Errorf("%s: %d bytes, want %d", category, types[category], bytes)
+		}
+	}
+	if r.Types[0].Category != CategoryVideo {
+		t.Errorf("types not largest first: %+v", r.Types)
+	}
+	paths := func(list []SizedPath) string {
+		var out []string
+		for _, p := range list {
+			out = append(out, p.Path)
+		}
+		return strings.Join(out, ",")
+	}
+	if got := paths(r.LargestFiles); got != "Videos/clip.mp4,Photos/a.jpg,Photos/copy.jpg" {
+		t.Errorf("largest files %s", got)
+	}
+	if got := paths(r.LargestFolders); got != "Videos,Photos,Documents" {
+		t.Errorf("largest folders %s", got)
+	}
+	if len(r.Duplicates) != 1 || r.Wasted != 3000 || strings.Join(r.Duplicates[0].Paths, ",") != "Photos/a.jpg,Photos/copy.jpg" {
+		t.Errorf("duplicates %+v, wasted %d", r.Duplicates, r.Wasted)
+	}
+
+	routes := c.GetRoutes()
+	tree := func(query string) (*httptest.ResponseRecorder, TreeNode) {
+		w := httptest.NewRecorder()
+		routes["/api/usage/tree"](w, httptest.NewRequest("GET", "/api/usage/tree"+query, nil))
+		var n TreeNode
+		json.Unmarshal(w.Body.Bytes(), &n)
+		return w, n
+	}
+	w, root := tree("?depth=2")
+	if w.Code != http.StatusOK || root.Bytes != 16800 || len(root.Children) != 4 || root.Children[0].Path != "Videos" {
+		t.Fatalf("tree: %d %+v", w.Code, root)
+	}
+	docs := root.Children[2]
+	if docs.Path != "Documents" || docs.Files != 2 || len(docs.Children) != 2 || docs.Children[0].Name != "report.pdf" || docs.Children[1].Children != nil {
+		t.Errorf("documents %+v", docs)
+	}
+	if w, n := tree("?path=/Documents/old"); w.Code != http.StatusOK || n.Bytes != 200 || len(n.Children) != 1 || n.Children[0].Category != CategoryDocument {
+		t.Errorf("subfolder: %d %+v", w.Code, n)
+	}
+	for _, q := range []string{"?path=nope", "?path=archive.zip"} {
+		if w, _ := tree(q); w.Code != http.StatusNotFound {
+			t.Errorf("%s: %d", q, w.Code)
+		}
+	}
+	if w, _ := tree("?depth=9"); w.Code != http.StatusBadRequest {
+		t.Errorf("deep tree: %d", w.Code)
+	}
+
+	// Deleting the copy is picked up without a walk of the drive
+	p := filepath.Join(c.DataDir, "Photos", "copy.jpg")
+	os.Remove(p)
+	c.NotifyRemoved(p)
+	if !c.Analysis.Refresh() {
+		t.Fatal("not redone after a delete")
+	}
+	w = httptest.NewRecorder()
+	routes["/api/usage/analysis"](w, httptest.NewRequest("GET", "/api/usage/analysis", nil))
+	r = Analysis{}
+	json.Unmarshal(w.Body.Bytes(), &r)
+	if w.Code != http.StatusOK || len(r.Duplicates) != 0 || r.Wasted != 0 || r.Used != 13800 {
+		t.Errorf("after the delete: %d %+v", w.Code, r)
+	}
+	// A second name for the same file takes no space and is no duplicate
+	if runtime.GOOS != "linux" {
+		return
+	}
+	if err := os.Link(filepath.Join(c.DataDir, "Photos", "a.jpg"), filepath.Join(c.DataDir, "Photos", "b.jpg")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Walker.Scan(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	c.Journal.Process(context.Background())
+	c.Analysis.Refresh()
+	if r := c.Analysis.Report(); len(r.Duplicates) != 0 || r.Wasted != 0 || r.Used != 13800 || c.Usage.Folder("Photos") != 3000 {
+		t.Errorf("after a hard link: %+v, Photos %d", r, c.Usage.Folder("Photos"))
+	}
+}
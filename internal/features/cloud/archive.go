@@ -0,0 +1,618 @@
+package cloud
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/errs"
+	"github.com/strct-org/strct-agent/internal/fsx"
+)
+
+const (
+	OpArchive errs.Op = "cloud.handleArchive"
+	OpExtract errs.Op = "cloud.handleExtract"
+)
+
+// Limits for archive extraction. Declared sizes are checked up front where
+// the format has them and actual bytes are counted while writing, so an
+// archive that lies about its contents is caught either way. The upload
+// itself is held to maxExtractBytes too.
+var (
+	maxExtractEntries       = 20000
+	maxExtractBytes   int64 = 32 << 30
+)
+
+const extractJobTTL = time.Hour
+
+var errArchiveLimit = errors.New("archive exceeds extraction limits")
+
+// ExtractJob reports the progress of one archive extraction.
+type ExtractJob struct {
+	ID         string     `json:"id"`
+	Target     string     `json:"target"`
+	Format     string     `json:"format"`
+	Status     string     `json:"status"` // running, done, failed
+	Entries    int        `json:"entries"`
+	Skipped    int        `json:"skipped"`
+	Bytes      int64      `json:"bytes"`
+	Progress   float64    `json:"progress"`
+	Error      string     `json:"error,omitempty"`
+	StartedAt  time.Time  `json:"startedAt"`
+	FinishedAt *time.Time `json:"finishedAt,omitempty"`
+}
+
+type extractJobs struct {
+	mu   sync.Mutex
+	jobs map[string]*ExtractJob
+}
+
+// handleArchive streams one or more files/folders as a zip or tar.gz. The
+// archive is written straight to the response; nothing is staged on disk.
+func (s *Cloud) handleArchive(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	q := r.URL.Query()
+	format := q.Get("format")
+	if format == "" {
+		format = "zip"
+	}
+	if format != "zip" && format != "tar.gz" {
+		errs.HTTPResponse(w, errs.E(OpArchive, errs.KindInvalid, "format must be zip or tar.gz"))
+		return
+	}
+
+	selection := q["path"]
+	if len(selection) == 0 {
+		selection = []string{"/"}
+	}
+	roots := make([]string, 0, len(selection))
+	for _, p := range selection {
+		full, err := secureJoin(s.DataDir, p)
+		if err != nil {
+			http.Error(w, "Access Denied", http.StatusForbidden)
+			return
+		}
+		if _, err := os.Stat(full); err != nil {
+			errs.HTTPResponse(w, errs.E(OpArchive, errs.KindNotFound, fmt.Sprintf("%s not found", p)))
+			return
+		}
+		roots = append(roots, full)
+	}
+
+	name := "strct"
+	if len(roots) == 1 && roots[0] != s.DataDir {
+		name = filepath.Base(roots[0])
+	} else if len(roots) > 1 {
+		name = "download"
+	}
+
+	var err error
+	if format == "zip" {
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name+".zip"))
+		err = s.writeZip(r.Context(), w, roots)
+	} else {
+		w.Header().Set("Content-Type", "application/gzip")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name+".tar.gz"))
+		err = s.writeTarGz(r.Context(), w, roots)
+	}
+	if err != nil {
+		// Headers are long gone; all we can do is cut the stream short
+		log.Printf("[ARCHIVE] %s download aborted: %v", format, err)
+	}
+}
+
+// walkSelection visits every folder and regular file below each root, naming
+// them relative to the root's parent so a selected folder keeps its name
+// inside the archive. Symlinks and other special files are left out.
+func (s *Cloud) walkSelection(ctx context.Context, roots []string, fn func(name, p string, info fs.FileInfo) error) error {
+	for _, root := range roots {
+		base := filepath.Dir(root)
+		if root == s.DataDir {
+			base = root
+		}
+		err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return nil
+			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if p == s.DataDir || fsx.IsTempName(d.Name()) {
+				return nil
+			}
+			if !d.IsDir() && !d.Type().IsRegular() {
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil {
+				return nil
+			}
+			rel, err := filepath.Rel(base, p)
+			if err != nil {
+				return nil
+			}
+			return fn(filepath.ToSlash(rel), p, info)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Cloud) writeZip(ctx context.Context, w io.Writer, roots []string) error {
+	zw := zip.NewWriter(w)
+	err := s.walkSelection(ctx, roots, func(name, p string, info fs.FileInfo) error {
+		hdr, err := zip.FileInfoHeader(info)
+		if err != nil {
+			return err
+		}
+		hdr.Name = name
+		if info.IsDir() {
+			hdr.Name += "/"
+			_, err := zw.CreateHeader(hdr)
+			return err
+		}
+
+		// Photos, videos and archives do not compress; storing them saves the Pi's CPU
+		switch Category(name) {
+		case CategoryImage, CategoryVideo, CategoryAudio, CategoryArchive:
+			hdr.Method = zip.Store
+		default:
+			hdr.Method = zip.Deflate
+		}
+
+		dst, err := zw.CreateHeader(hdr)
+		if err != nil {
+			return err
+		}
+		return copyFile(dst, p)
+	})
+	if err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+func (s *Cloud) writeTarGz(ctx context.Context, w io.Writer, roots []string) error {
+	gz, _ := gzip.NewWriterLevel(w, gzip.BestSpeed)
+	tw := tar.NewWriter(gz)
+	err := s.walkSelection(ctx, roots, func(name, p string, info fs.FileInfo) error {
+		hdr, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = name
+		if info.IsDir() {
+			hdr.Name += "/"
+		}
+		hdr.Uid, hdr.Gid, hdr.Uname, hdr.Gname = 0, 0, "", ""
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		return copyFile(tw, p)
+	})
+	if err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+func copyFile(dst io.Writer, p string) error {
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(dst, f)
+	return err
+}
+
+// handleExtract takes an uploaded zip/tar/tar.gz (POST, multipart "file")
+// and unpacks it into ?path= in the background; GET ?id= reports progress.
+func (s *Cloud) handleExtract(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		job, ok := s.extractJob(r.URL.Query().Get("id"))
+		if !ok {
+			errs.HTTPResponse(w, errs.E(OpExtract, errs.KindNotFound, "extraction job not found"))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(job)
+
+	case http.MethodPost:
+		s.startExtract(w, r)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Cloud) startExtract(w http.ResponseWriter, r *http.Request) {
+	targetDir, err := secureJoin(s.DataDir, r.URL.Query().Get("path"))
+	if err != nil {
+		http.Error(w, "Access Denied", http.StatusForbidden)
+		return
+	}
+	if info, err := os.Stat(targetDir); err != nil || !info.IsDir() {
+		errs.HTTPResponse(w, errs.E(OpExtract, errs.KindNotFound, "target folder not found"))
+		return
+	}
+	overwrite := r.URL.Query().Get("overwrite") == "true"
+
+	reader, err := r.MultipartReader()
+	if err != nil {
+		errs.HTTPResponse(w, errs.E(OpExtract, errs.KindInvalid, "expected a multipart upload"))
+		return
+	}
+	var part io.Reader
+	for {
+		p, err := reader.NextPart()
+		if err != nil {
+			errs.HTTPResponse(w, errs.E(OpExtract, errs.KindInvalid, "missing 'file' field"))
+			return
+		}
+		if p.FormName() == "file" {
+			part = p
+			break
+		}
+	}
+
+	// zip needs random access, so the upload is spooled next to the target
+	// under a temp name the listings and archives already ignore
+	spool, err := os.CreateTemp(targetDir, fsx.TempPrefix+"*")
+	if err != nil {
+		errs.HTTPResponse(w, errs.E(OpExtract, errs.KindIO, err))
+		return
+	}
+	fail := func(err error) {
+		spool.Close()
+		os.Remove(spool.Name())
+		errs.HTTPResponse(w, err)
+	}
+	if r.ContentLength > 0 {
+		if err := s.CheckQuota(spool.Name(), r.ContentLength); err != nil {
+			fail(err)
+			return
+		}
+	}
+	body, err := s.LimitUpload(spool.Name(), io.LimitReader(part, maxExtractBytes+1))
+	if err != nil {
+		fail(err)
+		return
+	}
+	n, err := io.Copy(spool, body)
+	switch {
+	case isQuota(err):
+		fail(err)
+		return
+	case err != nil:
+		fail(errs.E(OpExtract, errs.KindInvalid, "upload interrupted", err))
+		return
+	case n > maxExtractBytes:
+		fail(errs.E(OpExtract, errs.KindInvalid, fmt.Sprintf("archives over %d bytes cannot be extracted", maxExtractBytes)))
+		return
+	}
+
+	format, err := sniffArchive(spool)
+	if err != nil {
+		fail(errs.E(OpExtract, errs.KindInvalid, "not a zip, tar or tar.gz archive"))
+		return
+	}
+
+	id := make([]byte, 8)
+	rand.Read(id)
+	rel, _ := filepath.Rel(s.DataDir, targetDir)
+	job := &ExtractJob{
+		ID:        hex.EncodeToString(id),
+		Target:    filepath.ToSlash(rel),
+		Format:    format,
+		Status:    "running",
+		StartedAt: time.Now().UTC(),
+	}
+	s.addExtractJob(job)
+
+	go func() {
+		x := &extractor{cloud: s, job: job, target: targetDir, overwrite: overwrite}
+		err := x.run(spool, format)
+		// Gone before the target is counted again, so usage leaves it out
+		spool.Close()
+		os.Remove(spool.Name())
+
+		s.NotifyChanged(targetDir)
+		s.extracts.mu.Lock()
+		now := time.Now().UTC()
+		job.FinishedAt = &now
+		if err != nil {
+			job.Status = "failed"
+			job.Error = err.Error()
+		} else {
+			job.Status = "done"
+			job.Progress = 1
+		}
+		s.extracts.mu.Unlock()
+		log.Printf("[ARCHIVE] Extracted %d entries (%d bytes, %d skipped) into /%s: %v",
+			job.Entries, job.Bytes, job.Skipped, job.Target, err)
+	}()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(s.snapshotJob(job))
+}
+
+func (s *Cloud) addExtractJob(job *ExtractJob) {
+	s.extracts.mu.Lock()
+	defer s.extracts.mu.Unlock()
+	if s.extracts.jobs == nil {
+		s.extracts.jobs = make(map[string]*ExtractJob)
+	}
+	for id, j := range s.extracts.jobs {
+		if j.FinishedAt != nil && time.Since(*j.FinishedAt) > extractJobTTL {
+			delete(s.extracts.jobs, id)
+		}
+	}
+	s.extracts.jobs[job.ID] = job
+}
+
+func (s *Cloud) extractJob(id string) (ExtractJob, bool) {
+	s.extracts.mu.Lock()
+	defer s.extracts.mu.Unlock()
+	job, ok := s.extracts.jobs[id]
+	if !ok {
+		return ExtractJob{}, false
+	}
+	return *job, true
+}
+
+func (s *Cloud) snapshotJob(job *ExtractJob) ExtractJob {
+	s.extracts.mu.Lock()
+	defer s.extracts.mu.Unlock()
+	return *job
+}
+
+func sniffArchive(f *os.File) (string, error) {
+	head := make([]byte, 512)
+	n, _ := f.ReadAt(head, 0)
+	head = head[:n]
+	switch {
+	case bytes.HasPrefix(head, []byte("PK\x03\x04")), bytes.HasPrefix(head, []byte("PK\x05\x06")):
+		return "zip", nil
+	case bytes.HasPrefix(head, []byte{0x1f, 0x8b}):
+		return "tar.gz", nil
+	case n >= 262 && string(head[257:262]) == "ustar":
+		return "tar", nil
+	}
+	return "", errors.New("unknown archive format")
+}
+
+type extractor struct {
+	cloud     *Cloud
+	job       *ExtractJob
+	target    string
+	overwrite bool
+	total     int64 // declared uncompressed size, zip only
+}
+
+func (x *extractor) run(f *os.File, format string) error {
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	if format == "zip" {
+		zr, err := zip.NewReader(f, info.Size())
+		if err != nil {
+			return err
+		}
+		if len(zr.File) > maxExtractEntries {
+			return fmt.Errorf("%w: %d entries (max %d)", errArchiveLimit, len(zr.File), maxExtractEntries)
+		}
+		for _, zf := range zr.File {
+			x.total += int64(zf.UncompressedSize64)
+		}
+		if x.total > maxExtractBytes {
+			return fmt.Errorf("%w: %d bytes uncompressed", errArchiveLimit, x.total)
+		}
+		for _, zf := range zr.File {
+			if err := x.extractZipEntry(zf); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// For tar the only known total is the compressed size, so progress
+	// follows how far into the upload we have read
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	counted := &countingReader{r: f, total: info.Size(), progress: &x.job.Progress, mu: &x.cloud.extracts.mu}
+	var r io.Reader = bufio.NewReader(counted)
+	if format == "tar.gz" {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := x.extractEntry(hdr.Name, hdr.Typeflag == tar.TypeDir, hdr.Typeflag == tar.TypeReg,
+			hdr.Size, hdr.ModTime, tr); err != nil {
+			return err
+		}
+	}
+}
+
+func (x *extractor) extractZipEntry(zf *zip.File) error {
+	mode := zf.Mode()
+	isDir := mode.IsDir() || strings.HasSuffix(zf.Name, "/")
+	if isDir || !mode.IsRegular() {
+		return x.extractEntry(zf.Name, isDir, false, 0, zf.Modified, nil)
+	}
+	rc, err := zf.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	return x.extractEntry(zf.Name, false, true, int64(zf.UncompressedSize64), zf.Modified, rc)
+}
+
+// extractEntry writes a single entry below the target. Names are resolved
+// lexically and refused if they would land outside it (zip-slip); links and
+// device files are skipped rather than recreated.
+func (x *extractor) extractEntry(name string, isDir, isFile bool, size int64, mtime time.Time, r io.Reader) error {
+	x.cloud.extracts.mu.Lock()
+	x.job.Entries++
+	entries, written := x.job.Entries, x.job.Bytes
+	x.cloud.extracts.mu.Unlock()
+
+	if entries > maxExtractEntries {
+		return fmt.Errorf("%w: more than %d entries", errArchiveLimit, maxExtractEntries)
+	}
+	if written+size > maxExtractBytes {
+		return fmt.Errorf("%w: more than %d bytes uncompressed", errArchiveLimit, maxExtractBytes)
+	}
+
+	dst, ok := x.resolve(name)
+	if !ok || (!isDir && !isFile) {
+		x.skip()
+		return nil
+	}
+
+	if isDir {
+		if err := os.MkdirAll(dst, 0755); err != nil {
+			return err
+		}
+		return nil
+	}
+
+	if info, err := os.Lstat(dst); err == nil && (info.IsDir() || !x.overwrite) {
+		x.skip()
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	if err := x.cloud.CheckQuota(dst, size); err != nil {
+		return err
+	}
+
+	af, err := createAtomic(dst)
+	if err != nil {
+		return err
+	}
+
+	// Never trust the header: stop one byte past what it promised
+	n, err := io.Copy(af, io.LimitReader(r, size+1))
+	if err == nil && n != size {
+		err = fmt.Errorf("%w: %s does not match its declared size", errArchiveLimit, name)
+	}
+	if err != nil {
+		af.Abort()
+		return err
+	}
+	if err := af.Commit(""); err != nil {
+		return err
+	}
+	if !mtime.IsZero() {
+		os.Chtimes(dst, mtime, mtime)
+	}
+	x.cloud.digests.put(dst, af.Sum())
+	// Counted at once, so the quota check of the next entry includes it
+	x.cloud.Usage.Update(dst)
+
+	x.cloud.extracts.mu.Lock()
+	x.job.Bytes += n
+	if x.total > 0 {
+		x.job.Progress = float64(x.job.Bytes) / float64(x.total)
+	}
+	x.cloud.extracts.mu.Unlock()
+	return nil
+}
+
+func (x *extractor) resolve(name string) (string, bool) {
+	name = strings.ReplaceAll(name, "\\", "/")
+	if name == "" || strings.HasPrefix(name, "/") || (len(name) > 1 && name[1] == ':') {
+		return "", false
+	}
+	for _, seg := range strings.Split(name, "/") {
+		if seg == ".." || fsx.IsTempName(seg) {
+			return "", false
+		}
+	}
+	clean := path.Clean(name)
+	if clean == "." {
+		return "", false
+	}
+	dst := filepath.Join(x.target, filepath.FromSlash(clean))
+	if !strings.HasPrefix(dst, x.target+string(filepath.Separator)) {
+		return "", false
+	}
+	return dst, true
+}
+
+func (x *extractor) skip() {
+	x.cloud.extracts.mu.Lock()
+	x.job.Skipped++
+	x.cloud.extracts.mu.Unlock()
+}
+
+// countingReader publishes how much of the compressed input has been read.
+type countingReader struct {
+	r        io.Reader
+	read     int64
+	total    int64
+	progress *float64
+	mu       *sync.Mutex
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.read += int64(n)
+	if c.total > 0 {
+		c.mu.Lock()
+		*c.progress = float64(c.read) / float64(c.total)
+		c.mu.Unlock()
+	}
+	return n, err
+}
@@ -0,0 +1,292 @@
+package cloud
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"encoding/json"
+	"hash/crc32"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/accounts"
+	"github.com/strct-org/strct-agent/internal/fsx"
+)
+
+func uploadArchive(t *testing.T, c *Cloud, target string, data []byte) ExtractJob {
+	t.Helper()
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fw, _ := mw.CreateFormFile("file", "upload")
+	fw.Write(data)
+	mw.Close()
+
+	r := httptest.NewRequest(http.MethodPost, "/api/files/extract?path="+target, &body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	w := httptest.NewRecorder()
+	c.handleExtract(w, r)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("extract status = %d: %s", w.Code, w.Body.String())
+	}
+	var job ExtractJob
+	json.NewDecoder(w.Body).Decode(&job)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for job.Status == "running" && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		job, _ = c.extractJob(job.ID)
+	}
+	return job
+}
+
+func buildZip(t *testing.T, files map[string]string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, content := range files {
+		f, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write([]byte(content))
+	}
+	zw.Close()
+	return buf.Bytes()
+}
+
+func TestArchiveRoundTrip(t *testing.T) {
+	for _, format := range []string{"zip", "tar.gz"} {
+		t.Run(format, func(t *testing.T) {
+			c := newTestCloud(t)
+			src := filepath.Join(c.DataDir, "project")
+			os.MkdirAll(filepath.Join(src, "src", "empty"), 0755)
+			os.WriteFile(filepath.Join(src, "README.md"), []byte("# hi"), 0644)
+			os.WriteFile(filepath.Join(src, "src", "main.go"), []byte("package main"), 0644)
+			os.WriteFile(filepath.Join(src, fsx.TempPrefix+"partial"), []byte("nope"), 0644)
+			os.Mkdir(filepath.Join(c.DataDir, "restore"), 0755)
+
+			r := httptest.NewRequest(http.MethodGet, "/api/files/archive?format="+format+"&path=/project", nil)
+			w := httptest.NewRecorder()
+			c.handleArchive(w, r)
+			if w.Code != http.StatusOK {
+				t.Fatalf("archive status = %d: %s", w.Code, w.Body.String())
+			}
+
+			job := uploadArchive(t, c, "/restore", w.Body.Bytes())
+			if job.Status != "done" {
+				t.Fatalf("job = %+v", job)
+			}
+
+			want := map[string]string{
+				"project/README.md":   "# hi",
+				"project/src/main.go": "package main",
+			}
+			for rel, content := range want {
+				got, err := os.ReadFile(filepath.Join(c.DataDir, "restore", filepath.FromSlash(rel)))
+				if err != nil || string(got) != content {
+					t.Errorf("%s = %q, %v; want %q", rel, got, err, content)
+				}
+			}
+			if info, err := os.Stat(filepath.Join(c.DataDir, "restore", "project", "src", "empty")); err != nil || !info.IsDir() {
+				t.Errorf("empty folder not restored: %v", err)
+			}
+			if _, err := os.Stat(filepath.Join(c.DataDir, "restore", "project", fsx.TempPrefix+"partial")); err == nil {
+				t.Errorf("temp file was archived")
+			}
+		})
+	}
+}
+
+func TestExtractRejectsUnsafeEntries(t *testing.T) {
+	tests := []struct {
+		name        string
+		files       map[string]string
+		wantStatus  string
+		wantSkipped int
+		wantFile    string
+		absentFile  string
+	}{
+		{
+			name:        "zip slip",
+			files:       map[string]string{"../evil.txt": "x", "ok.txt": "fine"},
+			wantStatus:  "done",
+			wantSkipped: 1,
+			wantFile:    "target/ok.txt",
+			absentFile:  "evil.txt",
+		},
+		{
+			name:        "absolute and drive paths",
+			files:       map[string]string{"/etc/passwd": "x", `C:\boot.ini`: "x", `dir\win.txt`: "ok"},
+			wantStatus:  "done",
+			wantSkipped: 2,
+			wantFile:    "target/dir/win.txt",
+		},
+		{
+			name:        "hidden temp names",
+			files:       map[string]string{fsx.TempPrefix + "x": "x"},
+			wantStatus:  "done",
+			wantSkipped: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestCloud(t)
+			os.Mkdir(filepath.Join(c.DataDir, "target"), 0755)
+
+			job := uploadArchive(t, c, "/target", buildZip(t, tt.files))
+			if job.Status != tt.wantStatus || job.Skipped != tt.wantSkipped {
+				t.Fatalf("job = %+v, want status %s skipped %d", job, tt.wantStatus, tt.wantSkipped)
+			}
+			if tt.wantFile != "" {
+				if _, err := os.Stat(filepath.Join(c.DataDir, filepath.FromSlash(tt.wantFile))); err != nil {
+					t.Errorf("%s missing: %v", tt.wantFile, err)
+				}
+			}
+			if tt.absentFile != "" {
+				if _, err := os.Stat(filepath.Join(filepath.Dir(c.DataDir), tt.absentFile)); err == nil {
+					t.Errorf("%s escaped the target", tt.absentFile)
+				}
+				if _, err := os.Stat(filepath.Join(c.DataDir, tt.absentFile)); err == nil {
+					t.Errorf("%s escaped the target", tt.absentFile)
+				}
+			}
+		})
+	}
+}
+
+func buildTarGz(t *testing.T, files map[string]string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for name, content := range files {
+		tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(content))})
+		tw.Write([]byte(content))
+	}
+	tw.Close()
+	gz.Close()
+	return buf.Bytes()
+}
+
+// lyingZip holds one stored entry "a" of size bytes whose header says it
+// has declared.
+func lyingZip(size, declared int) []byte {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	content := bytes.Repeat([]byte("z"), size)
+	f, _ := zw.CreateRaw(&zip.FileHeader{
+		Name: "a", Method: zip.Store, CRC32: crc32.ChecksumIEEE(content),
+		CompressedSize64: uint64(size), UncompressedSize64: uint64(declared),
+	})
+	f.Write(content)
+	zw.Close()
+	return buf.Bytes()
+}
+
+func TestExtractLimits(t *testing.T) {
+	defer func(entries int, size int64) { maxExtractEntries, maxExtractBytes = entries, size }(maxExtractEntries, maxExtractBytes)
+	maxExtractEntries, maxExtractBytes = 3, 1000
+
+	four := map[string]string{"a": "1", "b": "2", "c": "3", "d": "4"}
+	large := map[string]string{"a": strings.Repeat("x", 600), "b": strings.Repeat("y", 600)}
+	tests := []struct {
+		name string
+		data func(t *testing.T) []byte
+	}{
+		{"zip entry count", func(t *testing.T) []byte { return buildZip(t, four) }},
+		{"tar entry count", func(t *testing.T) []byte { return buildTarGz(t, four) }},
+		{"zip total size", func(t *testing.T) []byte { return buildZip(t, large) }},
+		{"tar total size", func(t *testing.T) []byte { return buildTarGz(t, large) }},
+		{"zip larger than declared", func(t *testing.T) []byte { return lyingZip(100, 2) }},
+		{"zip smaller than declared", func(t *testing.T) []byte { return lyingZip(2, 100) }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestCloud(t)
+			os.Mkdir(filepath.Join(c.DataDir, "target"), 0755)
+			job := uploadArchive(t, c, "/target", tt.data(t))
+			if job.Status != "failed" || job.Error == "" || job.Bytes > maxExtractBytes {
+				t.Errorf("job = %+v", job)
+			}
+			written, _ := os.ReadDir(filepath.Join(c.DataDir, "target"))
+			if len(written) > maxExtractEntries {
+				t.Errorf("extracted %d entries", len(written))
+			}
+			if _, err := os.Stat(filepath.Join(c.DataDir, "target", "a")); err == nil && strings.Contains(tt.name, "declared") {
+				t.Error("kept an entry whose size does not match its header")
+			}
+		})
+	}
+
+	t.Run("upload too large", func(t *testing.T) {
+		c := newTestCloud(t)
+		os.Mkdir(filepath.Join(c.DataDir, "target"), 0755)
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		fw, _ := mw.CreateFormFile("file", "upload")
+		fw.Write(bytes.Repeat([]byte{0}, int(maxExtractBytes)+1))
+		mw.Close()
+		r := httptest.NewRequest(http.MethodPost, "/api/files/extract?path=/target", &body)
+		r.Header.Set("Content-Type", mw.FormDataContentType())
+		w := httptest.NewRecorder()
+		c.handleExtract(w, r)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("status %d: %s", w.Code, w.Body)
+		}
+		if leftovers, _ := filepath.Glob(filepath.Join(c.DataDir, "target", fsx.TempPrefix+"*")); len(leftovers) != 0 {
+			t.Errorf("spool left behind: %v", leftovers)
+		}
+	})
+}
+
+func TestExtractQuota(t *testing.T) {
+	c := newTestCloud(t)
+	store, err := accounts.Open(filepath.Join(c.StateDir, "accounts.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Accounts = store
+	store.Create("alice", false)
+	store.Update("alice", 1000, []string{"alice"})
+	os.MkdirAll(filepath.Join(c.DataDir, "alice", "target"), 0755)
+
+	// Each entry fits on its own; together they do not
+	files := map[string]string{}
+	for _, name := range []string{"a", "b", "c"} {
+		files[name] = strings.Repeat(name, 400)
+	}
+	job := uploadArchive(t, c, "/alice/target", buildZip(t, files))
+	if job.Status != "failed" || job.Bytes > 1000 {
+		t.Errorf("job = %+v", job)
+	}
+	if used := c.Usage.Folder("alice"); used > 1000 {
+		t.Errorf("alice uses %d bytes of 1000", used)
+	}
+
+	// The spooled upload is held to the quota as well
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fw, _ := mw.CreateFormFile("file", "upload")
+	noise := make([]byte, 1500)
+	rand.Read(noise)
+	fw.Write(buildZip(t, map[string]string{"big": string(noise)}))
+	mw.Close()
+	r := httptest.NewRequest(http.MethodPost, "/api/files/extract?path=/alice/target", &body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	r.ContentLength = -1
+	w := httptest.NewRecorder()
+	c.handleExtract(w, r)
+	if w.Code != http.StatusInsufficientStorage {
+		t.Errorf("spool past the quota: %d %s", w.Code, w.Body)
+	}
+}
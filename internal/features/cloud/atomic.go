@@ -0,0 +1,405 @@
+package cloud
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/strct-org/strct-agent/internal/errs"
+	"github.com/strct-org/strct-agent/internal/fsx"
+)
+
+const OpCommit errs.Op = "cloud.commit"
+
+var errDigestMismatch = errors.New("content does not match the expected SHA-256")
+
+// atomicFile stages a write in a temp file next to its destination and
+// hashes it on the way through. Commit fsyncs the data, renames it over the
+// destination and fsyncs the folder, so after a power cut the destination
+// holds either the old content or the new, never a mix.
+type atomicFile struct {
+	f    *os.File
+	dst  string
+	hash hash.Hash
+	n    int64
+	done bool
+}
+
+func createAtomic(dst string) (*atomicFile, error) {
+	f, err := os.CreateTemp(filepath.Dir(dst), fsx.TempPrefix+"*")
+	if err != nil {
+		return nil, err
+	}
+	return &atomicFile{f: f, dst: dst, hash: sha256.New()}, nil
+}
+
+// Write deliberately is the only way in: there is no ReadFrom, so io.Copy
+// cannot bypass the hash with a sendfile/splice fast path.
+func (a *atomicFile) Write(p []byte) (int, error) {
+	n, err := a.f.Write(p)
+	a.hash.Write(p[:n])
+	a.n += int64(n)
+	return n, err
+}
+
+// Sum is the hex SHA-256 of everything written so far.
+func (a *atomicFile) Sum() string {
+	return hex.EncodeToString(a.hash.Sum(nil))
+}
+
+// Commit moves the staged file into place if its digest matches expected
+// (empty means no expectation). On any failure the temp file is removed and
+// the destination is left untouched.
+func (a *atomicFile) Commit(expected string) error {
+	if a.done {
+		return os.ErrClosed
+	}
+	a.done = true
+	tmp := a.f.Name()
+
+	if expected != "" && !strings.EqualFold(expected, a.Sum()) {
+		a.f.Close()
+		os.Remove(tmp)
+		return errs.E(OpCommit, errs.KindInvalid, errDigestMismatch,
+			fmt.Sprintf("Checksum mismatch: expected %s, got %s", strings.ToLower(expected), a.Sum()))
+	}
+
+	if err := a.f.Sync(); err != nil {
+		a.f.Close()
+		os.Remove(tmp)
+		return errs.E(OpCommit, errs.KindIO, err)
+	}
+	if err := a.f.Close(); err != nil {
+		os.Remove(tmp)
+		return errs.E(OpCommit, errs.KindIO, err)
+	}
+	// CreateTemp makes the file 0600; give it the mode a plain create would have
+	os.Chmod(tmp, 0644)
+	if err := os.Rename(tmp, a.dst); err != nil {
+		os.Remove(tmp)
+		return errs.E(OpCommit, errs.KindIO, err)
+	}
+	if err := fsx.SyncDir(filepath.Dir(a.dst)); err != nil {
+		log.Printf("[CLOUD] fsync %s: %v", filepath.Dir(a.dst), err)
+	}
+	return nil
+}
+
+// Abort discards the staged content.
+func (a *atomicFile) Abort() {
+	if a.done {
+		return
+	}
+	a.done = true
+	a.f.Close()
+	os.Remove(a.f.Name())
+}
+
+// Keep moves what was written so far to dst instead of discarding it, for
+// an interrupted transfer that a retry can pick up from.
+func (a *atomicFile) Keep(dst string) error {
+	if a.done {
+		return os.ErrClosed
+	}
+	a.done = true
+	tmp := a.f.Name()
+	a.f.Close()
+	if err := os.Rename(tmp, dst); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// syncDir makes a rename durable. Not every platform lets you fsync a
+// directory; those errors are reported but the file itself is already safe.
+// expectedDigest extracts a client-supplied SHA-256 from the ?sha256= query
+// parameter or, when the request body is the file itself, an RFC 9530
+// Content-Digest header (sha-256=:base64:).
+func expectedDigest(r *http.Request, bodyIsFile bool) (string, error) {
+	if v := r.URL.Query().Get("sha256"); v != "" {
+		return parseHexDigest(v)
+	}
+	if !bodyIsFile {
+		return "", nil
+	}
+	for _, item := range strings.Split(r.Header.Get("Content-Digest"), ",") {
+		alg, val, ok := strings.Cut(strings.TrimSpace(item), "=")
+		if !ok || !strings.EqualFold(alg, "sha-256") {
+			continue
+		}
+		raw, err := base64.StdEncoding.DecodeString(strings.Trim(val, ":"))
+		if err != nil || len(raw) != sha256.Size {
+			return "", errs.E(OpCommit, errs.KindInvalid, "Malformed Content-Digest header")
+		}
+		return hex.EncodeToString(raw), nil
+	}
+	return "", nil
+}
+
+func parseHexDigest(v string) (string, error) {
+	v = strings.ToLower(strings.TrimSpace(v))
+	if raw, err := hex.DecodeString(v); err != nil || len(raw) != sha256.Size {
+		return "", errs.E(OpCommit, errs.KindInvalid, "sha256 must be 64 hex characters")
+	}
+	return v, nil
+}
+
+// setDigestHeader reports the stored content's digest back to the client.
+func setDigestHeader(w http.ResponseWriter, sum string) {
+	raw, err := hex.DecodeString(sum)
+	if err != nil {
+		return
+	}
+	w.Header().Set("Repr-Digest", "sha-256=:"+base64.StdEncoding.EncodeToString(raw)+":")
+}
+
+// digestStore remembers the SHA-256 of files written through the agent. A
+// record is only trusted while the file's size and mtime still match, so a
+// file changed behind our back simply has no known digest.
+//
+// A second set of records maps each digest back to the paths that held it,
+// so content can be found again by hash. Those are only hints: find checks
+// every path against its forward record before returning it.
+type digestStore struct {
+	dir string
+
+	mu sync.Mutex // serialises updates to the by-hash records
+}
+
+// maxDigestPaths caps how many paths are remembered per digest.
+const maxDigestPaths = 16
+
+// digestFile is a record's name inside the folder that mirrors its file.
+// A file has no children, so it never meets a real name there.
+const digestFile = "digest.json"
+
+type digestRecord struct {
+	SHA256  string `json:"sha256"`
+	Size    int64  `json:"size"`
+	ModTime int64  `json:"mtime"`
+}
+
+// path files the record of full under a mirror of the data tree, so the
+// records of everything in a folder sit in one subtree that can be moved
+// or dropped along with the folder.
+func (d *digestStore) path(full string) string {
+	return filepath.Join(d.tree(full), digestFile)
+}
+
+func (d *digestStore) tree(full string) string {
+	full = filepath.Clean(full)
+	return filepath.Join(d.dir, "files", full[len(filepath.VolumeName(full)):])
+}
+
+// legacyPath is where records used to be kept, under a hash of the path.
+// They are still read and moved or dropped with their own file; nothing
+// finds the ones under a folder that goes, so those are simply never used.
+func (d *digestStore) legacyPath(full string) string {
+	sum := sha256.Sum256([]byte(full))
+	key := hex.EncodeToString(sum[:])
+	return filepath.Join(d.dir, key[:2], key+".json")
+}
+
+func (d *digestStore) put(full, sum string) {
+	info, err := os.Stat(full)
+	if err != nil {
+		return
+	}
+	data, _ := json.Marshal(digestRecord{SHA256: sum, Size: info.Size(), ModTime: info.ModTime().UnixNano()})
+	p := d.path(full)
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		log.Printf("[CLOUD] Digest dir: %v", err)
+		return
+	}
+	if err := os.WriteFile(p, data, 0644); err != nil {
+		log.Printf("[CLOUD] Digest write: %v", err)
+		return
+	}
+	os.Remove(d.legacyPath(full))
+	d.hint(sum, "", full)
+}
+
+func (d *digestStore) hashPath(sum string) string {
+	return filepath.Join(d.dir, "by-sha", sum[:2], sum+".json")
+}
+
+// hint updates the paths remembered for sum: drop is forgotten and add is
+// put first. Either may be "".
+func (d *digestStore) hint(sum, drop, add string) {
+	if len(sum) != sha256.Size*2 {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var paths []string
+	if data, err := os.ReadFile(d.hashPath(sum)); err == nil {
+		json.Unmarshal(data, &paths)
+	}
+	// Newest first; the oldest hints fall off the end
+	var next []string
+	if add != "" {
+		next = append(next, add)
+	}
+	for _, p := range paths {
+		if p != drop && p != add {
+			next = append(next, p)
+		}
+	}
+	if len(next) > maxDigestPaths {
+		next = next[:maxDigestPaths]
+	}
+	switch {
+	case slices.Equal(next, paths):
+		return
+	case len(next) == 0:
+		os.Remove(d.hashPath(sum))
+		return
+	}
+	data, _ := json.Marshal(next)
+	if err := writeFileAtomic(d.hashPath(sum), data); err != nil {
+		log.Printf("[CLOUD] Digest index write: %v", err)
+	}
+}
+
+// find returns the paths that currently hold content with the given digest.
+func (d *digestStore) find(sum string) []string {
+	if len(sum) != sha256.Size*2 {
+		return nil
+	}
+	data, err := os.ReadFile(d.hashPath(sum))
+	if err != nil {
+		return nil
+	}
+	var hints, found []string
+	json.Unmarshal(data, &hints)
+	for _, p := range hints {
+		info, err := os.Stat(p)
+		if err == nil && info.Mode().IsRegular() && d.get(p, info) == sum {
+			found = append(found, p)
+		}
+	}
+	return found
+}
+
+func (d *digestStore) get(full string, info fs.FileInfo) string {
+	data, err := os.ReadFile(d.path(full))
+	if err != nil {
+		if data, err = os.ReadFile(d.legacyPath(full)); err != nil {
+			return ""
+		}
+	}
+	var rec digestRecord
+	if json.Unmarshal(data, &rec) != nil || rec.Size != info.Size() || rec.ModTime != info.ModTime().UnixNano() {
+		return ""
+	}
+	return rec.SHA256
+}
+
+// records returns the records of full and of everything under it, by path.
+// A record still in the legacy place is moved into the tree first.
+func (d *digestStore) records(full string) map[string]digestRecord {
+	if data, err := os.ReadFile(d.legacyPath(full)); err == nil {
+		if os.MkdirAll(d.tree(full), 0755) == nil && os.WriteFile(d.path(full), data, 0644) == nil {
+			os.Remove(d.legacyPath(full))
+		}
+	}
+
+	root := d.tree(full)
+	found := make(map[string]digestRecord)
+	filepath.WalkDir(root, func(p string, e fs.DirEntry, err error) error {
+		if err != nil || e.IsDir() || e.Name() != digestFile {
+			return nil
+		}
+		data, err := os.ReadFile(p)
+		var rec digestRecord
+		if err != nil || json.Unmarshal(data, &rec) != nil {
+			return nil
+		}
+		rel, err := filepath.Rel(root, filepath.Dir(p))
+		if err == nil {
+			found[filepath.Join(full, rel)] = rec
+		}
+		return nil
+	})
+	return found
+}
+
+// move carries the records of a renamed file, or of everything in a renamed
+// folder, along with it.
+func (d *digestStore) move(oldFull, newFull string) {
+	recs := d.records(oldFull)
+	if len(recs) == 0 {
+		return
+	}
+	os.RemoveAll(d.tree(newFull))
+	if err := os.MkdirAll(filepath.Dir(d.tree(newFull)), 0755); err != nil {
+		log.Printf("[CLOUD] Digest dir: %v", err)
+		return
+	}
+	if err := os.Rename(d.tree(oldFull), d.tree(newFull)); err != nil {
+		log.Printf("[CLOUD] Digest move: %v", err)
+		return
+	}
+	for p, rec := range recs {
+		if rel, err := filepath.Rel(oldFull, p); err == nil {
+			d.hint(rec.SHA256, p, filepath.Join(newFull, rel))
+		}
+	}
+}
+
+// remove forgets full and, for a folder, everything that was under it.
+func (d *digestStore) remove(full string) {
+	for p, rec := range d.records(full) {
+		d.hint(rec.SHA256, p, "")
+	}
+	os.RemoveAll(d.tree(full))
+}
+
+// writeFile streams r into fullPath atomically, verifies it against expected
+// and records the digest. It is what every cloud upload path goes through.
+func (s *Cloud) writeFile(fullPath string, r io.Reader, expected string) (int64, string, error) {
+	af, err := createAtomic(fullPath)
+	if err != nil {
+		return 0, "", errs.E(OpCommit, errs.KindIO, err)
+	}
+	if _, err := io.Copy(af, r); err != nil {
+		af.Abort()
+		if isQuota(err) {
+			return 0, "", err
+		}
+		return 0, "", errs.E(OpCommit, errs.KindInvalid, err, "Upload interrupted")
+	}
+	if err := af.Commit(expected); err != nil {
+		return 0, "", err
+	}
+	s.digests.put(fullPath, af.Sum())
+	s.NotifyChanged(fullPath)
+	return af.n, af.Sum(), nil
+}
+
+// HasContent reports whether DataDir already holds a file with this SHA-256.
+func (s *Cloud) HasContent(sum string) bool {
+	return len(s.digests.find(sum)) > 0
+}
+
+// NotifyWritten is NotifyChanged for a file whose digest the writer already
+// computed, so it is never hashed again.
+func (s *Cloud) NotifyWritten(fullPath, sum string) {
+	s.digests.put(fullPath, sum)
+	s.NotifyChanged(fullPath)
+}
@@ -0,0 +1,239 @@
+package cloud
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/strct-org/strct-agent/internal/fsx"
+)
+
+func TestVerifiedWrites(t *testing.T) {
+	content := "checksummed content"
+	sum := sha256.Sum256([]byte(content))
+	good := hex.EncodeToString(sum[:])
+	bad := strings.Repeat("0", 64)
+
+	multipartBody := func(fields [][2]string) (*bytes.Buffer, string) {
+		var buf bytes.Buffer
+		mw := multipart.NewWriter(&buf)
+		for _, f := range fields {
+			if f[0] == "file" {
+				fw, _ := mw.CreateFormFile("file", "doc.txt")
+				fw.Write([]byte(f[1]))
+			} else {
+				mw.WriteField(f[0], f[1])
+			}
+		}
+		mw.Close()
+		return &buf, mw.FormDataContentType()
+	}
+
+	tests := []struct {
+		name     string
+		request  func() *http.Request
+		dav      bool
+		wantCode int
+		wantFile bool
+	}{
+		{
+			name: "upload without digest",
+			request: func() *http.Request {
+				body, ct := multipartBody([][2]string{{"file", content}})
+				r := httptest.NewRequest(http.MethodPost, "/strct_agent/fs/upload?path=/", body)
+				r.Header.Set("Content-Type", ct)
+				return r
+			},
+			wantCode: http.StatusOK, wantFile: true,
+		},
+		{
+			name: "upload with matching query digest",
+			request: func() *http.Request {
+				body, ct := multipartBody([][2]string{{"file", content}})
+				r := httptest.NewRequest(http.MethodPost, "/strct_agent/fs/upload?path=/&sha256="+good, body)
+				r.Header.Set("Content-Type", ct)
+				return r
+			},
+			wantCode: http.StatusOK, wantFile: true,
+		},
+		{
+			name: "upload with digest field after the file",
+			request: func() *http.Request {
+				body, ct := multipartBody([][2]string{{"file", content}, {"sha256", bad}})
+				r := httptest.NewRequest(http.MethodPost, "/strct_agent/fs/upload?path=/", body)
+				r.Header.Set("Content-Type", ct)
+				return r
+			},
+			wantCode: http.StatusBadRequest, wantFile: false,
+		},
+		{
+			name: "malformed digest",
+			request: func() *http.Request {
+				body, ct := multipartBody([][2]string{{"file", content}})
+				r := httptest.NewRequest(http.MethodPost, "/strct_agent/fs/upload?path=/&sha256=abc", body)
+				r.Header.Set("Content-Type", ct)
+				return r
+			},
+			wantCode: http.StatusBadRequest, wantFile: false,
+		},
+		{
+			name: "dav put with matching content-digest",
+			dav:  true,
+			request: func() *http.Request {
+				r := httptest.NewRequest(http.MethodPut, "/dav/doc.txt", strings.NewReader(content))
+				r.Header.Set("Content-Digest", "sha-256=:"+base64.StdEncoding.EncodeToString(sum[:])+":")
+				return r
+			},
+			wantCode: http.StatusCreated, wantFile: true,
+		},
+		{
+			name: "dav put with wrong content-digest",
+			dav:  true,
+			request: func() *http.Request {
+				r := httptest.NewRequest(http.MethodPut, "/dav/doc.txt", strings.NewReader(content))
+				r.Header.Set("Content-Digest", "sha-256=:"+base64.StdEncoding.EncodeToString(make([]byte, 32))+":")
+				return r
+			},
+			wantCode: http.StatusBadRequest, wantFile: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestCloud(t)
+			w := httptest.NewRecorder()
+			if tt.dav {
+				c.handleDAV(w, tt.request())
+			} else {
+				c.handleUpload(w, tt.request())
+			}
+
+			if w.Code != tt.wantCode {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantCode, w.Body.String())
+			}
+
+			dst := filepath.Join(c.DataDir, "doc.txt")
+			_, err := os.Stat(dst)
+			if (err == nil) != tt.wantFile {
+				t.Fatalf("file exists = %v, want %v", err == nil, tt.wantFile)
+			}
+			if leftovers, _ := filepath.Glob(filepath.Join(c.DataDir, fsx.TempPrefix+"*")); len(leftovers) != 0 {
+				t.Errorf("temp files left behind: %v", leftovers)
+			}
+			if !tt.wantFile {
+				return
+			}
+
+			if got := w.Header().Get("Repr-Digest"); got != "sha-256=:"+base64.StdEncoding.EncodeToString(sum[:])+":" {
+				t.Errorf("Repr-Digest = %q", got)
+			}
+			if !tt.dav {
+				var resp struct{ SHA256 string }
+				json.NewDecoder(w.Body).Decode(&resp)
+				if resp.SHA256 != good {
+					t.Errorf("response sha256 = %q, want %q", resp.SHA256, good)
+				}
+			}
+			info, _ := os.Stat(dst)
+			if got := c.digests.get(dst, info); got != good {
+				t.Errorf("stored digest = %q, want %q", got, good)
+			}
+		})
+	}
+}
+
+func TestDigestStoreFolders(t *testing.T) {
+	dir := t.TempDir()
+	data := filepath.Join(dir, "data")
+	d := &digestStore{dir: filepath.Join(dir, "digests")}
+
+	write := func(rel, content string) (string, string) {
+		t.Helper()
+		full := filepath.Join(data, rel)
+		os.MkdirAll(filepath.Dir(full), 0755)
+		if err := os.WriteFile(full, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		sum := sha256.Sum256([]byte(content))
+		return full, hex.EncodeToString(sum[:])
+	}
+	known := func(full string) string {
+		info, err := os.Stat(full)
+		if err != nil {
+			return ""
+		}
+		return d.get(full, info)
+	}
+
+	x, sumX := write("album/x.jpg", "x")
+	y, sumY := write("album/sub/y.jpg", "y")
+	z, sumZ := write("albums.txt", "z")
+	for full, sum := range map[string]string{x: sumX, y: sumY, z: sumZ} {
+		d.put(full, sum)
+	}
+	// A record from before they were filed by path
+	old, sumOld := write("album/old.jpg", "old")
+	rec, _ := json.Marshal(digestRecord{SHA256: sumOld, Size: 3, ModTime: mtime(t, old)})
+	os.MkdirAll(filepath.Dir(d.legacyPath(old)), 0755)
+	os.WriteFile(d.legacyPath(old), rec, 0644)
+	if known(old) != sumOld {
+		t.Fatal("legacy record not read")
+	}
+
+	// Renaming the folder carries every record under it along
+	album, moved := filepath.Join(data, "album"), filepath.Join(data, "photos")
+	if err := os.Rename(album, moved); err != nil {
+		t.Fatal(err)
+	}
+	d.move(album, moved)
+	newX, newY, newOld := filepath.Join(moved, "x.jpg"), filepath.Join(moved, "sub", "y.jpg"), filepath.Join(moved, "old.jpg")
+	if known(newX) != sumX || known(newY) != sumY || known(z) != sumZ {
+		t.Errorf("records after the move: %q %q %q", known(newX), known(newY), known(z))
+	}
+	// The legacy record was not filed under the folder; only its own path finds it
+	if known(newOld) != "" {
+		t.Errorf("legacy record of a folder's child followed it")
+	}
+	if got := d.find(sumY); len(got) != 1 || got[0] != newY {
+		t.Errorf("find after the move = %v", got)
+	}
+	var hints []string
+	raw, _ := os.ReadFile(d.hashPath(sumX))
+	json.Unmarshal(raw, &hints)
+	if len(hints) != 1 || hints[0] != newX {
+		t.Errorf("hints after the move = %v", hints)
+	}
+
+	// Removing it forgets them, and only them
+	os.RemoveAll(moved)
+	d.remove(moved)
+	for _, sum := range []string{sumX, sumY} {
+		if _, err := os.Stat(d.hashPath(sum)); !os.IsNotExist(err) {
+			t.Errorf("hints for %s kept: %v", sum, err)
+		}
+	}
+	if _, err := os.Stat(d.tree(moved)); !os.IsNotExist(err) {
+		t.Errorf("records kept: %v", err)
+	}
+	if known(z) != sumZ || len(d.find(sumZ)) != 1 {
+		t.Error("record next to the folder was dropped")
+	}
+}
+
+func mtime(t *testing.T, p string) int64 {
+	t.Helper()
+	info, err := os.Stat(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info.ModTime().UnixNano()
+}
@@ -0,0 +1,757 @@
+package cloud
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/errs"
+	"github.com/strct-org/strct-agent/internal/fsx"
+)
+
+const (
+	OpBackup     errs.Op = "cloud.handleBackup"
+	OpBackupSave errs.Op = "cloud.BackupStore.save"
+)
+
+const (
+	// backupRoot is the top-level folder every device backs up into.
+	backupRoot = "Backups"
+
+	maxBackupBatch   = 10000
+	backupSessionTTL = 14 * 24 * time.Hour
+)
+
+// Item states. Only "missing" items need to be uploaded.
+const (
+	BackupPresent  = "present"  // already in this device's backup
+	BackupLinked   = "linked"   // found elsewhere in DataDir and hard-linked in
+	BackupMissing  = "missing"  // waiting for the client to upload or prove it
+	BackupUploaded = "uploaded" // received and verified
+)
+
+var errBackupOffset = errors.New("upload offset does not match what was received")
+
+// BackupItem is one file the device asked about. Path is where the content
+// lives (or will live) relative to DataDir.
+//
+// Challenge is set when the content already exists elsewhere in DataDir:
+// instead of uploading, the client may send the HMAC-SHA256 of the file
+// keyed with the challenge string to have it linked in.
+type BackupItem struct {
+	SHA256    string     `json:"sha256"`
+	Size      int64      `json:"size"`
+	Name      string     `json:"name"`
+	TakenAt   *time.Time `json:"takenAt,omitempty"`
+	Path      string     `json:"path"`
+	State     string     `json:"state"`
+	Received  int64      `json:"received,omitempty"`
+	Challenge string     `json:"challenge,omitempty"`
+}
+
+type BackupSession struct {
+	ID        string        `json:"id"`
+	Device    string        `json:"device"`
+	CreatedAt time.Time     `json:"createdAt"`
+	UpdatedAt time.Time     `json:"updatedAt"`
+	Complete  bool          `json:"complete"`
+	Items     []*BackupItem `json:"items"`
+}
+
+// BackupDevice is the per-phone status record.
+type BackupDevice struct {
+	ID           string     `json:"id"`
+	Name         string     `json:"name,omitempty"`
+	LastSeen     time.Time  `json:"lastSeen"`
+	LastSession  string     `json:"lastSession,omitempty"`
+	LastComplete *time.Time `json:"lastComplete,omitempty"`
+	Uploaded     int        `json:"uploaded"`
+	Linked       int        `json:"linked"`
+	UploadedSize int64      `json:"uploadedBytes"`
+
+	// Filled in when reported, not stored
+	Pending     int   `json:"pending"`
+	StoredBytes int64 `json:"storedBytes"`
+}
+
+// BackupStore persists devices and open sessions so an interrupted backup
+// can carry on after the app or the agent restarts.
+type BackupStore struct {
+	Path string `json:"-"`
+
+	mu       sync.Mutex
+	busy     map[string]bool           // session/sha of uploads in progress
+	Devices  map[string]*BackupDevice  `json:"devices"`
+	Sessions map[string]*BackupSession `json:"sessions"`
+}
+
+func NewBackupStore(path string) (*BackupStore, error) {
+	st := &BackupStore{
+		Path:     path,
+		busy:     make(map[string]bool),
+		Devices:  make(map[string]*BackupDevice),
+		Sessions: make(map[string]*BackupSession),
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, st); err != nil {
+			return nil, fmt.Errorf("parse %s: %w", path, err)
+		}
+	}
+	return st, nil
+}
+
+// save must be called with mu held.
+func (st *BackupStore) save() error {
+	data, err := json.Marshal(st)
+	if err != nil {
+		return errs.E(OpBackupSave, errs.KindIO, err)
+	}
+	if err := writeFileAtomic(st.Path, data); err != nil {
+		return errs.E(OpBackupSave, errs.KindIO, err)
+	}
+	return nil
+}
+
+func (sess *BackupSession) item(sum string) *BackupItem {
+	for _, it := range sess.Items {
+		if it.SHA256 == sum {
+			return it
+		}
+	}
+	return nil
+}
+
+func (s *Cloud) handleBackupSessions(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		s.getBackupSession(w, r)
+	case http.MethodPost:
+		s.createBackupSession(w, r)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// createBackupSession takes the hashes and sizes of everything the phone
+// wants backed up and answers which of them actually need uploading.
+func (s *Cloud) createBackupSession(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Device string `json:"device"`
+		Name   string `json:"name"`
+		Items  []struct {
+			SHA256  string     `json:"sha256"`
+			Size    int64      `json:"size"`
+			Name    string     `json:"name"`
+			TakenAt *time.Time `json:"takenAt"`
+		} `json:"items"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		errs.HTTPResponse(w, errs.E(OpBackup, errs.KindInvalid, "Invalid JSON"))
+		return
+	}
+	if !validDeviceID(req.Device) {
+		errs.HTTPResponse(w, errs.E(OpBackup, errs.KindInvalid, "device must be 1-64 letters, digits, '.', '_' or '-'"))
+		return
+	}
+	if len(req.Items) == 0 || len(req.Items) > maxBackupBatch {
+		errs.HTTPResponse(w, errs.E(OpBackup, errs.KindInvalid, fmt.Sprintf("send between 1 and %d items", maxBackupBatch)))
+		return
+	}
+
+	id, err := newBackupID()
+	if err != nil {
+		errs.HTTPResponse(w, errs.E(OpBackup, errs.KindSystem, err))
+		return
+	}
+	now := time.Now().UTC()
+	sess := &BackupSession{ID: id, Device: req.Device, CreatedAt: now, UpdatedAt: now}
+	deviceDir := path.Join(backupRoot, req.Device)
+	reserved := make(map[string]bool)
+
+	for _, in := range req.Items {
+		sum, err := parseHexDigest(in.SHA256)
+		if err != nil {
+			errs.HTTPResponse(w, err)
+			return
+		}
+		if in.Size < 0 {
+			errs.HTTPResponse(w, errs.E(OpBackup, errs.KindInvalid, "size must not be negative"))
+			return
+		}
+		// The same photo twice in one batch is uploaded once
+		if sess.item(sum) != nil {
+			continue
+		}
+
+		it := &BackupItem{SHA256: sum, Size: in.Size, Name: backupName(in.Name, sum), TakenAt: in.TakenAt, State: BackupMissing}
+		sess.Items = append(sess.Items, it)
+
+		existing := s.digests.find(sum)
+		if rel, ok := s.backupHas(existing, deviceDir); ok {
+			it.State, it.Path = BackupPresent, rel
+			continue
+		}
+
+		when := now
+		if in.TakenAt != nil {
+			when = *in.TakenAt
+		}
+		dir := path.Join(deviceDir, when.Format("2006"), when.Format("01"))
+		it.Path = s.freeBackupPath(dir, it.Name, reserved)
+		reserved[it.Path] = true
+
+		// Knowing a digest is not proof of having the file, so content held
+		// elsewhere is only linked in once the client shows it has it
+		if len(existing) > 0 {
+			if it.Challenge, err = newBackupID(); err != nil {
+				errs.HTTPResponse(w, errs.E(OpBackup, errs.KindSystem, err))
+				return
+			}
+		}
+	}
+
+	st := s.Backups
+	st.mu.Lock()
+	st.prune(now, s.DataDir)
+	dev := st.Devices[req.Device]
+	if dev == nil {
+		dev = &BackupDevice{ID: req.Device}
+		st.Devices[req.Device] = dev
+	}
+	if req.Name != "" {
+		dev.Name = req.Name
+	}
+	dev.LastSeen = now
+	dev.LastSession = id
+	st.Sessions[id] = sess
+	s.finishIfDone(sess, dev, now)
+	err = st.save()
+	resp := backupSessionResponse(sess)
+	st.mu.Unlock()
+
+	if err != nil {
+		errs.HTTPResponse(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(resp)
+}
+
+type BackupSessionResponse struct {
+	BackupSession
+	Missing []string `json:"missing"` // digests the client still has to upload
+}
+
+// backupSessionResponse snapshots sess; must be called with mu held.
+func backupSessionResponse(sess *BackupSession) BackupSessionResponse {
+	resp := BackupSessionResponse{BackupSession: *sess, Missing: []string{}}
+	resp.Items = make([]*BackupItem, len(sess.Items))
+	for i, it := range sess.Items {
+		cp := *it
+		resp.Items[i] = &cp
+		if it.State == BackupMissing {
+			resp.Missing = append(resp.Missing, it.SHA256)
+		}
+	}
+	return resp
+}
+
+func (s *Cloud) getBackupSession(w http.ResponseWriter, r *http.Request) {
+	st := s.Backups
+	st.mu.Lock()
+	sess, ok := st.Sessions[r.URL.Query().Get("id")]
+	var resp BackupSessionResponse
+	if ok {
+		resp = backupSessionResponse(sess)
+	}
+	st.mu.Unlock()
+
+	if !ok {
+		errs.HTTPResponse(w, errs.E(OpBackup, errs.KindNotFound, "unknown or expired session"))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// handleBackupUpload receives the content of one missing item. Uploads are
+// resumable: HEAD reports how many bytes have arrived in Upload-Offset, and
+// a PUT carrying that Upload-Offset appends the rest.
+func (s *Cloud) handleBackupUpload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	sum := strings.ToLower(q.Get("sha256"))
+
+	st := s.Backups
+	st.mu.Lock()
+	sess, ok := st.Sessions[q.Get("session")]
+	var it BackupItem
+	if ok && sess.item(sum) != nil {
+		it = *sess.item(sum)
+	}
+	st.mu.Unlock()
+	if !ok || it.SHA256 == "" {
+		errs.HTTPResponse(w, errs.E(OpBackup, errs.KindNotFound, "unknown session or file"))
+		return
+	}
+
+	destFull := filepath.Join(s.DataDir, filepath.FromSlash(it.Path))
+	partial := partialPath(destFull, it.SHA256)
+
+	received := it.Size
+	if it.State == BackupMissing {
+		received = 0
+		if info, err := os.Stat(partial); err == nil {
+			received = info.Size()
+		}
+	}
+	w.Header().Set("Upload-Offset", strconv.FormatInt(received, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(it.Size, 10))
+	if r.Method == http.MethodHead || it.State != BackupMissing {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(it)
+		return
+	}
+
+	key := sess.ID + "/" + it.SHA256
+	st.mu.Lock()
+	if st.busy[key] || sess.item(sum).State != BackupMissing {
+		st.mu.Unlock()
+		errs.HTTPResponse(w, errs.E(OpBackup, errs.KindInvalid, "this file is already being uploaded"))
+		return
+	}
+	st.busy[key] = true
+	st.mu.Unlock()
+	defer func() {
+		st.mu.Lock()
+		delete(st.busy, key)
+		st.mu.Unlock()
+	}()
+
+	offset := int64(0)
+	if raw := r.Header.Get("Upload-Offset"); raw != "" {
+		var err error
+		if offset, err = strconv.ParseInt(raw, 10, 64); err != nil || offset < 0 {
+			errs.HTTPResponse(w, errs.E(OpBackup, errs.KindInvalid, "invalid Upload-Offset"))
+			return
+		}
+	}
+	if offset != received {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]any{"error": errBackupOffset.Error(), "offset": received})
+		return
+	}
+	if err := s.CheckQuota(destFull, it.Size-received); err != nil {
+		errs.HTTPResponse(w, err)
+		return
+	}
+
+	n, err := appendPartial(partial, r.Body, it.Size-received)
+	received += n
+	if err != nil {
+		errs.HTTPResponse(w, err)
+		return
+	}
+
+	if received == it.Size {
+		if err := s.finishBackupUpload(partial, &it); err != nil {
+			st.mu.Lock()
+			if live := sess.item(it.SHA256); live != nil {
+				live.Received = 0
+			}
+			st.mu.Unlock()
+			errs.HTTPResponse(w, err)
+			return
+		}
+	}
+
+	now := time.Now().UTC()
+	st.mu.Lock()
+	live := sess.item(it.SHA256)
+	live.Received, live.State, live.Path = received, it.State, it.Path
+	sess.UpdatedAt = now
+	if dev := st.Devices[sess.Device]; dev != nil {
+		dev.LastSeen = now
+		if it.State == BackupUploaded {
+			dev.Uploaded++
+			dev.UploadedSize += it.Size
+		}
+		s.finishIfDone(sess, dev, now)
+	}
+	if err := st.save(); err != nil {
+		log.Printf("[BACKUP] %v", err)
+	}
+	st.mu.Unlock()
+
+	setDigestHeader(w, it.SHA256)
+	w.Header().Set("Upload-Offset", strconv.FormatInt(received, 10))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(it)
+}
+
+// handleBackupLink links content that already exists elsewhere in DataDir
+// into the backup in place of an upload. The body carries the proof, the
+// hex HMAC-SHA256 of the file keyed with the item's challenge. Each
+// challenge is good for one attempt; after that the file has to be
+// uploaded. An item that could not be linked comes back still missing.
+func (s *Cloud) handleBackupLink(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	sum := strings.ToLower(q.Get("sha256"))
+
+	var req struct {
+		Proof string `json:"proof"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		errs.HTTPResponse(w, errs.E(OpBackup, errs.KindInvalid, "Invalid JSON"))
+		return
+	}
+	proof, err := hex.DecodeString(req.Proof)
+	if err != nil || len(proof) != sha256.Size {
+		errs.HTTPResponse(w, errs.E(OpBackup, errs.KindInvalid, "proof must be 64 hex characters"))
+		return
+	}
+
+	st := s.Backups
+	st.mu.Lock()
+	sess, ok := st.Sessions[q.Get("session")]
+	var it BackupItem
+	if ok && sess.item(sum) != nil {
+		it = *sess.item(sum)
+	}
+	if !ok || it.SHA256 == "" {
+		st.mu.Unlock()
+		errs.HTTPResponse(w, errs.E(OpBackup, errs.KindNotFound, "unknown session or file"))
+		return
+	}
+	key := sess.ID + "/" + it.SHA256
+	if st.busy[key] || it.State != BackupMissing || it.Challenge == "" {
+		st.mu.Unlock()
+		errs.HTTPResponse(w, errs.E(OpBackup, errs.KindInvalid, "this file has to be uploaded"))
+		return
+	}
+	st.busy[key] = true
+	sess.item(sum).Challenge = ""
+	st.mu.Unlock()
+	defer func() {
+		st.mu.Lock()
+		delete(st.busy, key)
+		st.mu.Unlock()
+	}()
+
+	linked, err := s.linkProven(&it, it.Challenge, proof)
+	if linked {
+		destFull := filepath.Join(s.DataDir, filepath.FromSlash(it.Path))
+		os.Remove(partialPath(destFull, it.SHA256))
+		it.State = BackupLinked
+	}
+
+	now := time.Now().UTC()
+	st.mu.Lock()
+	live := sess.item(it.SHA256)
+	live.State, live.Path = it.State, it.Path
+	sess.UpdatedAt = now
+	if dev := st.Devices[sess.Device]; dev != nil {
+		dev.LastSeen = now
+		if linked {
+			dev.Linked++
+		}
+		s.finishIfDone(sess, dev, now)
+	}
+	if err := st.save(); err != nil {
+		log.Printf("[BACKUP] %v", err)
+	}
+	resp := *live
+	st.mu.Unlock()
+
+	if err != nil {
+		errs.HTTPResponse(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// linkProven checks proof against the content held elsewhere and links it
+// in if it matches. Each file is hashed as it is read, so one changed since
+// its digest was recorded is passed over.
+func (s *Cloud) linkProven(it *BackupItem, challenge string, proof []byte) (bool, error) {
+	for _, src := range s.digests.find(it.SHA256) {
+		f, err := os.Open(src)
+		if err != nil {
+			continue
+		}
+		h, mac := sha256.New(), hmac.New(sha256.New, []byte(challenge))
+		_, err = io.Copy(io.MultiWriter(h, mac), f)
+		f.Close()
+		if err != nil || hex.EncodeToString(h.Sum(nil)) != it.SHA256 {
+			continue
+		}
+		if !hmac.Equal(mac.Sum(nil), proof) {
+			return false, errs.E(OpBackup, errs.KindForbidden, "proof does not match the content")
+		}
+		// Something else may have taken the name since the session began
+		dir, name := path.Split(it.Path)
+		it.Path = s.freeBackupPath(path.Clean(dir), name, nil)
+		return s.linkBackup(src, it), nil
+	}
+	return false, nil
+}
+
+// partialPath is where an unfinished upload waits, next to its destination
+// so the final rename never crosses filesystems. The temp prefix keeps it
+// out of listings and archives.
+func partialPath(destFull, sum string) string {
+	return filepath.Join(filepath.Dir(destFull), fsx.TempPrefix+sum+".part")
+}
+
+// appendPartial adds at most want bytes from body to the partial file. A
+// dropped connection keeps what arrived so the client can resume from there.
+func appendPartial(partial string, body io.Reader, want int64) (int64, error) {
+	if err := os.MkdirAll(filepath.Dir(partial), 0755); err != nil {
+		return 0, errs.E(OpBackup, errs.KindIO, err)
+	}
+	f, err := os.OpenFile(partial, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return 0, errs.E(OpBackup, errs.KindIO, err)
+	}
+	defer f.Close()
+
+	n, copyErr := io.Copy(f, io.LimitReader(body, want))
+	if err := f.Sync(); err != nil {
+		return n, errs.E(OpBackup, errs.KindIO, err)
+	}
+	if copyErr != nil {
+		return n, errs.E(OpBackup, errs.KindInvalid, copyErr, "Upload interrupted")
+	}
+	if n == want {
+		// Anything past the declared size means the client and we disagree
+		var probe [1]byte
+		if m, _ := body.Read(probe[:]); m > 0 {
+			os.Remove(partial)
+			return 0, errs.E(OpBackup, errs.KindInvalid, "more data than the declared size")
+		}
+	}
+	return n, nil
+}
+
+// finishBackupUpload verifies a complete partial file against its digest
+// and moves it into place.
+func (s *Cloud) finishBackupUpload(partial string, it *BackupItem) error {
+	f, err := os.Open(partial)
+	if err != nil {
+		return errs.E(OpBackup, errs.KindIO, err)
+	}
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	f.Close()
+	if err != nil {
+		return errs.E(OpBackup, errs.KindIO, err)
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); got != it.SHA256 {
+		os.Remove(partial)
+		return errs.E(OpCommit, errs.KindInvalid, errDigestMismatch,
+			fmt.Sprintf("Checksum mismatch: expected %s, got %s", it.SHA256, got))
+	}
+
+	// Something else may have taken the name while the upload was running
+	dir, name := path.Split(it.Path)
+	it.Path = s.freeBackupPath(path.Clean(dir), name, nil)
+	destFull := filepath.Join(s.DataDir, filepath.FromSlash(it.Path))
+
+	os.Chmod(partial, 0644)
+	if err := os.Rename(partial, destFull); err != nil {
+		return errs.E(OpBackup, errs.KindIO, err)
+	}
+	if err := fsx.SyncDir(filepath.Dir(destFull)); err != nil {
+		log.Printf("[BACKUP] fsync %s: %v", filepath.Dir(destFull), err)
+	}
+	s.digests.put(destFull, it.SHA256)
+	s.NotifyChanged(destFull)
+	it.State = BackupUploaded
+	return nil
+}
+
+// finishIfDone marks the session complete once nothing is missing. Must be
+// called with mu held.
+func (s *Cloud) finishIfDone(sess *BackupSession, dev *BackupDevice, now time.Time) {
+	if sess.Complete {
+		return
+	}
+	for _, it := range sess.Items {
+		if it.State == BackupMissing {
+			return
+		}
+	}
+	sess.Complete = true
+	dev.LastComplete = &now
+}
+
+// prune forgets sessions nobody touched for backupSessionTTL and their
+// partial uploads. Must be called with mu held.
+func (st *BackupStore) prune(now time.Time, dataDir string) {
+	for id, sess := range st.Sessions {
+		if now.Sub(sess.UpdatedAt) < backupSessionTTL {
+			continue
+		}
+		for _, it := range sess.Items {
+			if it.State == BackupMissing {
+				os.Remove(partialPath(filepath.Join(dataDir, filepath.FromSlash(it.Path)), it.SHA256))
+			}
+		}
+		delete(st.Sessions, id)
+		log.Printf("[BACKUP] Session %s for %s expired", id, sess.Device)
+	}
+}
+
+func (s *Cloud) handleBackupDevices(w http.ResponseWriter, r *http.Request) {
+	want := r.URL.Query().Get("device")
+
+	st := s.Backups
+	st.mu.Lock()
+	list := make([]BackupDevice, 0, len(st.Devices))
+	for _, dev := range st.Devices {
+		if want != "" && dev.ID != want {
+			continue
+		}
+		d := *dev
+		for _, sess := range st.Sessions {
+			if sess.Device != dev.ID {
+				continue
+			}
+			for _, it := range sess.Items {
+				if it.State == BackupMissing {
+					d.Pending++
+				}
+			}
+		}
+		list = append(list, d)
+	}
+	st.mu.Unlock()
+
+	for i := range list {
+		list[i].StoredBytes = s.Usage.Folder(path.Join(backupRoot, list[i].ID))
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].LastSeen.After(list[j].LastSeen) })
+
+	if want != "" && len(list) == 0 {
+		errs.HTTPResponse(w, errs.E(OpBackup, errs.KindNotFound, "unknown device"))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]BackupDevice{"devices": list})
+}
+
+// backupHas reports whether one of the paths holding the content is already
+// inside the device's backup.
+func (s *Cloud) backupHas(fullPaths []string, deviceDir string) (string, bool) {
+	for _, full := range fullPaths {
+		rel, err := filepath.Rel(s.DataDir, full)
+		if err != nil {
+			continue
+		}
+		rel = filepath.ToSlash(rel)
+		if strings.HasPrefix(rel, deviceDir+"/") {
+			return rel, true
+		}
+	}
+	return "", false
+}
+
+// linkBackup hard-links content that already exists elsewhere into the
+// backup, so it costs no space. Filesystems without hard links (exFAT) or a
+// source on another drive simply fall back to an upload.
+func (s *Cloud) linkBackup(src string, it *BackupItem) bool {
+	dst := filepath.Join(s.DataDir, filepath.FromSlash(it.Path))
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return false
+	}
+	if err := os.Link(src, dst); err != nil {
+		log.Printf("[BACKUP] Could not link %s: %v", it.Path, err)
+		return false
+	}
+	// The source has a second name now; recount it first so the bytes are
+	// charged to it and the link counts as nothing
+	s.Usage.Update(src)
+	s.digests.put(dst, it.SHA256)
+	s.NotifyChanged(dst)
+	return true
+}
+
+// freeBackupPath picks name inside dir, adding " (n)" before the extension
+// if the name is taken on disk or by another item in the same batch.
+func (s *Cloud) freeBackupPath(dir, name string, reserved map[string]bool) string {
+	ext := path.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for i := 0; ; i++ {
+		candidate := path.Join(dir, name)
+		if i > 0 {
+			candidate = path.Join(dir, fmt.Sprintf("%s (%d)%s", base, i, ext))
+		}
+		if reserved[candidate] {
+			continue
+		}
+		if _, err := os.Lstat(filepath.Join(s.DataDir, filepath.FromSlash(candidate))); os.IsNotExist(err) {
+			return candidate
+		}
+	}
+}
+
+// backupName keeps the phone's file name where it is safe to use.
+func backupName(name, sum string) string {
+	name = path.Base(strings.ReplaceAll(name, `\`, "/"))
+	if name == "." || name == "/" || name == ".." || fsx.IsTempName(name) || strings.HasPrefix(name, ".") {
+		return sum[:16]
+	}
+	return name
+}
+
+func validDeviceID(id string) bool {
+	if id == "" || len(id) > 64 || strings.HasPrefix(id, ".") {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '.', c == '_', c == '-':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func newBackupID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
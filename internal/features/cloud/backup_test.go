@@ -0,0 +1,217 @@
+package cloud
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/strct-org/strct-agent/internal/fsx"
+)
+
+func sha256hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func createBackupSession(t *testing.T, c *Cloud, body string) (int, BackupSessionResponse) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	c.handleBackupSessions(w, httptest.NewRequest(http.MethodPost, "/api/backup/sessions", strings.NewReader(body)))
+	var resp BackupSessionResponse
+	json.NewDecoder(w.Body).Decode(&resp)
+	return w.Code, resp
+}
+
+func putBackup(c *Cloud, session, sum string, offset int, data string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPut, "/api/backup/upload?session="+session+"&sha256="+sum, strings.NewReader(data))
+	r.Header.Set("Upload-Offset", strconv.Itoa(offset))
+	w := httptest.NewRecorder()
+	c.handleBackupUpload(w, r)
+	return w
+}
+
+func linkBackup(c *Cloud, session, sum, proof string) (*httptest.ResponseRecorder, BackupItem) {
+	r := httptest.NewRequest(http.MethodPost, "/api/backup/link?session="+session+"&sha256="+sum, strings.NewReader(`{"proof":"`+proof+`"}`))
+	w := httptest.NewRecorder()
+	c.handleBackupLink(w, r)
+	var it BackupItem
+	json.Unmarshal(w.Body.Bytes(), &it)
+	return w, it
+}
+
+// backupProof is what a client sends to show it holds content.
+func backupProof(challenge, content string) string {
+	mac := hmac.New(sha256.New, []byte(challenge))
+	mac.Write([]byte(content))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestPhoneBackup(t *testing.T) {
+	c := newTestCloud(t)
+
+	beach, fresh := "beach photo bytes", "new photo from this morning"
+	beachFull := filepath.Join(c.DataDir, "Photos", "beach.jpg")
+	os.MkdirAll(filepath.Dir(beachFull), 0755)
+	if _, _, err := c.writeFile(beachFull, strings.NewReader(beach), ""); err != nil {
+		t.Fatal(err)
+	}
+
+	batch := `{"device":"pixel-7","name":"Ana's phone","items":[
+		{"sha256":"` + sha256hex(beach) + `","size":17,"name":"IMG_0001.jpg","takenAt":"2023-08-02T10:00:00Z"},
+		{"sha256":"` + sha256hex(fresh) + `","size":27,"name":"IMG_0002.jpg","takenAt":"2024-03-05T07:30:00Z"},
+		{"sha256":"` + sha256hex(fresh) + `","size":27,"name":"IMG_0002 copy.jpg"}]}`
+
+	code, sess := createBackupSession(t, c, batch)
+	if code != http.StatusCreated {
+		t.Fatalf("create status = %d", code)
+	}
+	if len(sess.Items) != 2 || len(sess.Missing) != 2 {
+		t.Fatalf("session = %+v", sess)
+	}
+	held := sess.Items[0]
+	if held.State != BackupMissing || held.Challenge == "" || sess.Items[1].Challenge != "" {
+		t.Fatalf("items = %+v, %+v", held, sess.Items[1])
+	}
+
+	// Content held elsewhere is linked in once the client proves it has it
+	used := c.Usage.Total()
+	w, linked := linkBackup(c, sess.ID, held.SHA256, backupProof(held.Challenge, beach))
+	if w.Code != http.StatusOK || linked.State != BackupLinked || linked.Path != "Backups/pixel-7/2023/08/IMG_0001.jpg" {
+		t.Fatalf("link: %d %+v", w.Code, linked)
+	}
+	a, _ := os.Stat(beachFull)
+	b, _ := os.Stat(filepath.Join(c.DataDir, filepath.FromSlash(linked.Path)))
+	if b == nil || !os.SameFile(a, b) {
+		t.Errorf("duplicate content was not hard-linked")
+	}
+	if got := c.Usage.Total(); got != used {
+		t.Errorf("usage %d after the link, want %d", got, used)
+	}
+
+	t.Run("knowing the digest is not enough", func(t *testing.T) {
+		_, other := createBackupSession(t, c, `{"device":"ipad","items":[{"sha256":"`+sha256hex(beach)+`","size":17,"name":"beach.jpg"}]}`)
+		it := other.Items[0]
+		if w, _ := linkBackup(c, other.ID, it.SHA256, backupProof(it.Challenge, "a guess")); w.Code != http.StatusForbidden {
+			t.Errorf("wrong proof: %d", w.Code)
+		}
+		if w, _ := linkBackup(c, other.ID, it.SHA256, backupProof(it.Challenge, beach)); w.Code != http.StatusBadRequest {
+			t.Errorf("second attempt: %d, want 400", w.Code)
+		}
+		if _, err := os.Stat(filepath.Join(c.DataDir, filepath.FromSlash(it.Path))); !os.IsNotExist(err) {
+			t.Errorf("linked without proof: %v", err)
+		}
+	})
+
+	sum := sha256hex(fresh)
+	steps := []struct {
+		name       string
+		offset     int
+		data       string
+		wantCode   int
+		wantOffset string
+	}{
+		{"first half, then the connection drops", 0, fresh[:10], http.StatusOK, "10"},
+		{"stale offset is refused", 0, fresh, http.StatusConflict, "10"},
+		{"resume from the reported offset", 10, fresh[10:], http.StatusOK, "27"},
+		{"repeat after completion is harmless", 0, fresh, http.StatusOK, "27"},
+	}
+	for _, tt := range steps {
+		t.Run(tt.name, func(t *testing.T) {
+			w := putBackup(c, sess.ID, sum, tt.offset, tt.data)
+			if w.Code != tt.wantCode {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantCode, w.Body.String())
+			}
+			if got := w.Header().Get("Upload-Offset"); got != tt.wantOffset {
+				t.Errorf("Upload-Offset = %s, want %s", got, tt.wantOffset)
+			}
+		})
+	}
+
+	got, err := os.ReadFile(filepath.Join(c.DataDir, "Backups", "pixel-7", "2024", "03", "IMG_0002.jpg"))
+	if err != nil || string(got) != fresh {
+		t.Fatalf("uploaded file = %q, %v", got, err)
+	}
+	if leftovers, _ := filepath.Glob(filepath.Join(c.DataDir, "Backups", "pixel-7", "*", "*", fsx.TempPrefix+"*")); len(leftovers) != 0 {
+		t.Errorf("partial files left behind: %v", leftovers)
+	}
+
+	t.Run("second run finds everything present", func(t *testing.T) {
+		_, again := createBackupSession(t, c, batch)
+		if len(again.Missing) != 0 || !again.Complete {
+			t.Fatalf("session = %+v", again)
+		}
+		for _, it := range again.Items {
+			if it.State != BackupPresent {
+				t.Errorf("%s state = %s, want present", it.Name, it.State)
+			}
+		}
+	})
+
+	t.Run("device status", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		c.handleBackupDevices(w, httptest.NewRequest(http.MethodGet, "/api/backup/devices?device=pixel-7", nil))
+		var resp struct{ Devices []BackupDevice }
+		json.NewDecoder(w.Body).Decode(&resp)
+		if len(resp.Devices) != 1 {
+			t.Fatalf("devices = %+v", resp.Devices)
+		}
+		dev := resp.Devices[0]
+		if dev.Name != "Ana's phone" || dev.Uploaded != 1 || dev.Linked != 1 || dev.Pending != 0 || dev.LastComplete == nil {
+			t.Errorf("device = %+v", dev)
+		}
+	})
+
+	t.Run("checksum mismatch discards the upload", func(t *testing.T) {
+		_, bad := createBackupSession(t, c, `{"device":"pixel-7","items":[{"sha256":"`+sha256hex("expected")+`","size":8,"name":"x.jpg"}]}`)
+		w := putBackup(c, bad.ID, sha256hex("expected"), 0, "tampered")
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("status = %d, want 400", w.Code)
+		}
+		r := httptest.NewRequest(http.MethodHead, "/api/backup/upload?session="+bad.ID+"&sha256="+sha256hex("expected"), nil)
+		w = httptest.NewRecorder()
+		c.handleBackupUpload(w, r)
+		if got := w.Header().Get("Upload-Offset"); got != "0" {
+			t.Errorf("offset after mismatch = %s, want 0", got)
+		}
+	})
+
+	t.Run("invalid requests", func(t *testing.T) {
+		for _, body := range []string{
+			`{"device":"../etc","items":[{"sha256":"` + sum + `","size":1}]}`,
+			`{"device":"pixel-7","items":[]}`,
+			`{"device":"pixel-7","items":[{"sha256":"nothex","size":1}]}`,
+		} {
+			if code, _ := createBackupSession(t, c, body); code != http.StatusBadRequest {
+				t.Errorf("%s: status = %d, want 400", body, code)
+			}
+		}
+		w := putBackup(c, "nope", sum, 0, "x")
+		if w.Code != http.StatusNotFound {
+			t.Errorf("unknown session: status = %d, want 404", w.Code)
+		}
+	})
+
+	t.Run("sessions survive a restart", func(t *testing.T) {
+		reloaded, err := NewBackupStore(c.Backups.Path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := reloaded.Sessions[sess.ID]; !ok {
+			t.Errorf("session %s lost", sess.ID)
+		}
+		var buf bytes.Buffer
+		json.NewEncoder(&buf).Encode(reloaded.Devices["pixel-7"])
+		if !strings.Contains(buf.String(), `"uploaded":1`) {
+			t.Errorf("device record = %s", buf.String())
+		}
+	})
+}
@@ -0,0 +1,13 @@
+package cloud
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// dropCache evicts f's pages from the page cache, so the next read of it
+// comes from the disk. f must have been synced.
+func dropCache(f *os.File) error {
+	return unix.Fadvise(int(f.Fd()), 0, 0, unix.FADV_DONTNEED)
+}
@@ -1,7 +1,9 @@
 package cloud
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -9,9 +11,13 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/strct-org/strct-agent/internal/humanize"
+	"golang.org/x/net/webdav"
+
+	"github.com/strct-org/strct-agent/internal/accounts"
+	"github.com/strct-org/strct-agent/internal/errs"
 	"github.com/strct-org/strct-agent/internal/netx"
 	"github.com/strct-org/strct-agent/internal/platform/disk"
 )
@@ -19,67 +25,137 @@ import (
 type Cloud struct {
 	StartTime time.Time
 	DataDir   string
+	StateDir  string
 	Port      int
 	IsDev     bool
+	Index     *Index
+	Usage     *Usage
+	Analysis  *Analyzer // where the space went, for the usage page
+	Thumbs    *Thumbnailer
+	Media     *Media
+	Journal   *Journal
+	Walker    *Walker // the reconcile scan behind Index, Usage, Media and Journal
+	Shares    *ShareStore
+	Backups   *BackupStore
+	DAV       *webdav.Handler
+	Accounts  *accounts.Store
+	Disk      disk.Manager // the mounted data drive; nil on the SD card
+	Pool      *Pool        // extra drives, each a top-level folder
+
+	// How the data drive is bound over DataDir and unmounted on eject
+	Bind    func(src, dst string) error
+	Unmount func(dir string) error
+	// Mounted reports whether a filesystem is mounted at dir, to catch a
+	// data drive that is gone without an eject; nil skips the check.
+	Mounted func(dir string) bool
+
+	digests    *digestStore
+	extracts   extractJobs
+	gate       gate           // closed while the data drive is ejected
+	driveMount string         // where a drive switched to at runtime is mounted
+	scans      sync.WaitGroup // rescans running
+	migration  migration      // files on the SD card waiting to move to a drive
 }
 
 type StatusResponse struct {
-	Uptime   int64  `json:"uptime"`
-	IP       string `json:"ip"`
-	Used     uint64 `json:"used"`
-	Total    uint64 `json:"total"`
-	IsOnline bool   `json:"isOnline"`
+	Uptime   int64          `json:"uptime"`
+	IP       string         `json:"ip"`
+	Used     uint64         `json:"used"`
+	Total    uint64         `json:"total"`
+	IsOnline bool           `json:"isOnline"`
+	Volumes  []VolumeStatus `json:"volumes,omitempty"` // extra drives, with their own free space
+	Ejected  bool           `json:"ejected,omitempty"` // the data drive is unmounted; the rest of the API is offline
 }
 
 type FilesResponse struct {
-	Files []FileItem `json:"files"`
+	Files      []FileItem `json:"files"`
+	Total      int        `json:"total"`                // entries in the folder, not on this page
+	NextCursor string     `json:"nextCursor,omitempty"` // pass back as ?cursor= for the next page
 }
 
 type FileItem struct {
-	Name       string `json:"name"`
-	Size       string `json:"size"`
-	Type       string `json:"type"`
-	ModifiedAt string `json:"modifiedAt"`
+	Name        string `json:"name"`
+	Size        string `json:"size"` // humanized, kept for older clients
+	Bytes       int64  `json:"bytes"`
+	Type        string `json:"type"`
+	MIME        string `json:"mime,omitempty"`
+	ModifiedAt  string `json:"modifiedAt"`
+	Permissions string `json:"permissions"` // octal, e.g. "0644"
+	IsSymlink   bool   `json:"isSymlink"`
+	IsHidden    bool   `json:"isHidden"`
+	Children    *int   `json:"children,omitempty"` // folders only
+	SHA256      string `json:"sha256,omitempty"`   // known for files written through the agent
 }
 
-func New(dataDir string, port int, isDev bool) *Cloud {
+func New(dataDir, stateDir string, port int, isDev bool) *Cloud {
 	return &Cloud{
-		DataDir: dataDir,
-		Port:    port,
-		IsDev:   isDev,
+		DataDir:  dataDir,
+		StateDir: stateDir,
+		Port:     port,
+		IsDev:    isDev,
+		Bind:     disk.BindMount,
+		Unmount:  disk.Unmount,
 	}
 }
 
 func (s *Cloud) InitFileSystem() error {
-	candidates := []string{"/dev/nvme0n1", "/dev/sda"}
+	dataDrive := s.dataDrive()
+	candidates := dataDrive.Candidates()
 
-	const ssdMountPoint = "/mnt/strct_data"
+	ssdMountPoint := disk.DataMountPoint
 
 	ssdSelected := false
+	var holdBack *disk.RealDisk
+
+	// A mirror comes up even with one of its drives missing
+	if a := dataDrive.Array(); a != nil {
+		if err := a.EnsureMounted(ssdMountPoint); err == nil {
+			log.Printf("[STORAGE] Mirror %s mounted at %s", a.Device, ssdMountPoint)
+			s.DataDir = ssdMountPoint
+			s.Disk = a
+			ssdSelected = true
+		} else {
+			log.Printf("[STORAGE] Could not start the mirror %s: %v", a.ArrayUUID, err)
+		}
+	}
 
-	for _, devicePath := range candidates {
-		if _, err := os.Stat(devicePath); err == nil {
-
-			d := &disk.RealDisk{DevicePath: devicePath}
-
-			err := d.EnsureMounted(ssdMountPoint)
-
-			if err == nil {
-				// SUCCESS: SSD is formatted and mounted
-				log.Printf("------------------------------------------------")
-				log.Printf("[STORAGE] PRIORITY SELECT: SSD SELECTED")
-				log.Printf("[STORAGE] Device: %s", devicePath)
-				log.Printf("[STORAGE] Mount:  %s", ssdMountPoint)
-				log.Printf("------------------------------------------------")
-
-				// Update the Cloud struct to use this new path
-				s.DataDir = ssdMountPoint
-				ssdSelected = true
-				break
-			} else {
-				// Device exists but failed to mount (likely unformatted)
-				log.Printf("[STORAGE] Detected %s but could not mount (Unformatted?): %v", devicePath, err)
+	for _, d := range candidates {
+		devicePath := d.DevicePath
+		err := d.EnsureMounted(ssdMountPoint)
+
+		if err == nil && d.UUID == "" && holdsFiles(s.DataDir) {
+			// A drive added after storage started out on the SD card: the
+			// files there are moved over on request, not left behind
+			log.Printf("[STORAGE] Detected %s, mounted at %s; the files are still on the SD card", devicePath, ssdMountPoint)
+			holdBack = d
+			break
+		} else if err == nil {
+			// SUCCESS: SSD is formatted and mounted
+			log.Printf("------------------------------------------------")
+			log.Printf("[STORAGE] PRIORITY SELECT: SSD SELECTED")
+			log.Printf("[STORAGE] Device: %s", devicePath)
+			log.Printf("[STORAGE] Mount:  %s", ssdMountPoint)
+			log.Printf("------------------------------------------------")
+
+			// From now on the drive is only mounted by its UUID
+			if d.UUID == "" {
+				if uuid := d.PartitionUUID(); uuid != "" {
+					if err := dataDrive.Remember(uuid); err != nil {
+						log.Printf("[STORAGE] Could not remember the data drive: %v", err)
+					}
+				}
 			}
+
+			// Update the Cloud struct to use this new path
+			s.DataDir = ssdMountPoint
+			s.Disk = d
+			ssdSelected = true
+			break
+		} else if errors.Is(err, disk.ErrLocked) {
+			log.Printf("[STORAGE] Detected %s but it is encrypted and still locked", devicePath)
+		} else {
+			// Device exists but failed to mount (likely unformatted)
+			log.Printf("[STORAGE] Detected %s but could not mount (Unformatted?): %v", devicePath, err)
 		}
 	}
 
@@ -87,7 +163,11 @@ func (s *Cloud) InitFileSystem() error {
 	if !ssdSelected {
 		log.Printf("------------------------------------------------")
 		log.Printf("[STORAGE] PRIORITY SELECT: SD CARD / INTERNAL")
-		log.Printf("[STORAGE] Reason: No formatted SSD found or mounted.")
+		if holdBack != nil {
+			log.Printf("[STORAGE] Reason: Files not yet moved to the SSD.")
+		} else {
+			log.Printf("[STORAGE] Reason: No formatted SSD found or mounted.")
+		}
 		log.Printf("[STORAGE] Path:   %s", s.DataDir)
 		log.Printf("------------------------------------------------")
 	}
@@ -99,33 +179,161 @@ func (s *Cloud) InitFileSystem() error {
 		absPath = filepath.Clean(s.DataDir)
 	}
 	s.DataDir = absPath
+	if holdBack != nil {
+		s.offerMigration(holdBack, ssdMountPoint)
+	}
 
 	if err := os.MkdirAll(s.DataDir, 0755); err != nil {
 		log.Printf("[CLOUD] Error creating data directory: %v", err)
 		return err
 	}
 
+	s.Index = NewIndex(s.DataDir, filepath.Join(s.StateDir, "search_index.json"))
+	s.Usage = NewUsage(s.DataDir, filepath.Join(s.StateDir, "usage.json"))
+	s.digests = &digestStore{dir: filepath.Join(s.StateDir, "digests")}
+	s.Thumbs = NewThumbnailer(filepath.Join(s.StateDir, "thumbnails"), 2)
+	s.Media = NewMedia(s.DataDir, filepath.Join(s.StateDir, "media_index.json"))
+	s.Journal = NewJournal(s.DataDir, filepath.Join(s.StateDir, "sync"), s.digests)
+	s.Walker = NewWalker(s.DataDir, s.Index, s.Usage, s.Media, s.Journal)
+	s.Walker.Offline, s.Journal.Offline, s.Media.Offline = s.Offline, s.Offline, s.Offline
+	s.Mounted = disk.IsMountPoint
+	s.Analysis = NewAnalyzer(s.Usage, s.Journal)
+
+	shares, err := NewShareStore(filepath.Join(s.StateDir, "shares.json"))
+	if err != nil {
+		log.Printf("[CLOUD] Error loading share links: %v", err)
+		return err
+	}
+	s.Shares = shares
+
+	backups, err := NewBackupStore(filepath.Join(s.StateDir, "backups.json"))
+	if err != nil {
+		log.Printf("[CLOUD] Error loading phone backups: %v", err)
+		return err
+	}
+	s.Backups = backups
+	s.DAV = s.newDAVHandler()
+
+	pool, err := NewPool(s.DataDir, filepath.Join(s.StateDir, "pool.json"))
+	if err != nil {
+		log.Printf("[CLOUD] Error loading the storage pool: %v", err)
+		return err
+	}
+	pool.OnChange = s.rescan
+	s.Pool = pool
+
 	s.StartTime = time.Now()
 	return nil
 }
 
+// dataDrive remembers which drive storage lives on, next to its key.
+func (s *Cloud) dataDrive() *disk.DataDrive {
+	return disk.NewDataDrive(filepath.Join(s.StateDir, "disk"))
+}
+
+// UseDrive moves storage onto a freshly formatted drive mounted at
+// mountPoint. Everything already holds DataDir, so the drive is bound over
+// it rather than DataDir changing; the next boot mounts it there directly.
+// If the SD card holds files, storage stays there instead and moving them
+// onto the drive is offered.
+func (s *Cloud) UseDrive(d disk.Manager, mountPoint string) error {
+	if s.Disk != nil {
+		return fmt.Errorf("storage already lives on a data drive")
+	}
+	if filepath.Clean(mountPoint) != s.DataDir && holdsFiles(s.DataDir) {
+		s.offerMigration(d, mountPoint)
+		return nil
+	}
+	if err := s.adopt(d, mountPoint); err != nil {
+		return err
+	}
+	log.Printf("[STORAGE] Switched storage to the drive at %s", mountPoint)
+	return nil
+}
+
+// adopt binds the drive mounted at mountPoint over DataDir and remembers
+// it as the data drive.
+func (s *Cloud) adopt(d disk.Manager, mountPoint string) error {
+	if filepath.Clean(mountPoint) != s.DataDir {
+		if err := s.Bind(mountPoint, s.DataDir); err != nil {
+			return err
+		}
+	}
+	s.Disk = d
+	s.driveMount = filepath.Clean(mountPoint)
+	var err error
+	if a, ok := d.(*disk.Array); ok {
+		err = s.dataDrive().RememberArray(a)
+	} else if uuid := d.PartitionUUID(); uuid != "" {
+		err = s.dataDrive().Remember(uuid)
+	}
+	if err != nil {
+		log.Printf("[STORAGE] Could not remember the data drive: %v", err)
+	}
+
+	// The indexes still describe the SD card
+	s.rescan()
+	return nil
+}
+
+// rescan brings the indexes up to date after storage changed underneath
+// them.
+func (s *Cloud) rescan() {
+	s.scans.Add(1)
+	go func() {
+		defer s.scans.Done()
+		s.Walker.runScan(context.Background())
+	}()
+}
+
+// GetRoutes serves everything but the status and the migration only while
+// the data drive is mounted.
 func (s *Cloud) GetRoutes() map[string]http.HandlerFunc {
-	return map[string]http.HandlerFunc{
-		"/api/status":            s.handleStatus,
+	routes := map[string]http.HandlerFunc{
+		"/api/usage":             s.handleUsage,
+		"/api/usage/analysis":    s.handleAnalysis,
+		"/api/usage/tree":        s.handleUsageTree,
+		"/api/volumes":           s.handleVolumes,
+		"/api/volumes/default":   s.handleDefaultVolume,
 		"/api/files":             s.handleFiles,
+		"/api/files/search":      s.handleSearch,
+		"/api/files/thumbnail":   s.handleThumbnail,
+		"/api/files/archive":     s.handleArchive,
+		"/api/files/extract":     s.handleExtract,
+		"/api/media/timeline":    s.handleTimeline,
+		"/api/media/albums":      s.handleAlbums,
+		"/api/backup/sessions":   s.handleBackupSessions,
+		"/api/backup/upload":     s.handleBackupUpload,
+		"/api/backup/link":       s.handleBackupLink,
+		"/api/backup/devices":    s.handleBackupDevices,
+		"/api/sync/changes":      s.handleSyncChanges,
+		"/api/sync/signature":    s.handleSyncSignature,
+		"/api/sync/download":     s.handleSyncDownload,
+		"/api/sync/upload":       s.handleSyncUpload,
+		"/api/sync/delete":       s.handleSyncDelete,
 		"/api/mkdir":             s.handleMkdir,
 		"/api/delete":            s.handleDelete,
 		"/strct_agent/fs/upload": s.handleUpload,
+		"/api/shares":            s.handleShares,
+		"/api/shares/log":        s.handleShareLog,
+		"/s/":                    s.handlePublicShare,
+		davPrefix:                s.handleDAV,
+		davPrefix + "/":          s.handleDAV,
 	}
+	for path, h := range routes {
+		routes[path] = s.online(h)
+	}
+	routes["/api/status"] = s.handleStatus
+	routes["/api/migration"] = s.handleMigration
+	routes["/api/migration/cleanup"] = s.handleMigrationCleanup
+	return routes
 }
 
 func (s *Cloud) handleStatus(w http.ResponseWriter, r *http.Request) {
 	realFree, _ := disk.GetFreeDiskSpace(s.DataDir)
 
-	userUsed, err := disk.GetDirSize(s.DataDir)
-	if err != nil {
-		log.Printf("Error calculating dir size: %v", err)
-	}
+	// Kept up to date incrementally; walking the drive here took seconds
+	userUsed := uint64(s.Usage.Total())
 
 	virtualTotal := userUsed + realFree
 
@@ -138,50 +346,14 @@ func (s *Cloud) handleStatus(w http.ResponseWriter, r *http.Request) {
 		Total:    virtualTotal,
 		IP:       localIP,
 		Uptime:   uptime,
+		Volumes:  s.Pool.Status(),
+		Ejected:  s.Ejected(),
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(resp)
 }
 
-func (s *Cloud) handleFiles(w http.ResponseWriter, r *http.Request) {
-	reqPath := r.URL.Query().Get("path")
-	fullPath, err := secureJoin(s.DataDir, reqPath)
-	if err != nil {
-		http.Error(w, "Access Denied", http.StatusForbidden)
-		return
-	}
-
-	entries, err := os.ReadDir(fullPath)
-	if err != nil {
-		json.NewEncoder(w).Encode(FilesResponse{Files: []FileItem{}})
-		return
-	}
-
-	var fileList []FileItem
-	for _, e := range entries {
-		info, err := e.Info()
-		if err != nil {
-			continue
-		}
-
-		fileType := "file"
-		if e.IsDir() {
-			fileType = "folder"
-		}
-
-		fileList = append(fileList, FileItem{
-			Name:       e.Name(),
-			Size:       humanize.Bytes(info.Size()),
-			Type:       fileType,
-			ModifiedAt: info.ModTime().Format(time.RFC3339),
-		})
-	}
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(FilesResponse{Files: fileList})
-}
-
 func (s *Cloud) handleMkdir(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -210,6 +382,10 @@ func (s *Cloud) handleMkdir(w http.ResponseWriter, r *http.Request) {
 	}
 
 	newFolderPath := filepath.Join(parentDir, req.Name)
+	if err := s.CheckQuota(newFolderPath, 0); err != nil {
+		errs.HTTPResponse(w, err)
+		return
+	}
 
 	if err := os.Mkdir(newFolderPath, 0755); err != nil {
 		if os.IsExist(err) {
@@ -221,6 +397,8 @@ func (s *Cloud) handleMkdir(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	s.NotifyChanged(newFolderPath)
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]string{"status": "created"})
 }
@@ -249,11 +427,15 @@ func (s *Cloud) handleDelete(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Could not delete item", http.StatusInternalServerError)
 		return
 	}
+	s.NotifyRemoved(fullPath)
 
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("Deleted"))
 }
 
+// handleUpload stores the multipart "file" field in ?path=. The expected
+// SHA-256 may be given as ?sha256= or as a "sha256" form field (before or
+// after the file); the content is only committed if it matches.
 func (s *Cloud) handleUpload(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -261,31 +443,140 @@ func (s *Cloud) handleUpload(w http.ResponseWriter, r *http.Request) {
 	}
 
 	targetDir := r.URL.Query().Get("path")
+	if targetDir == "" || targetDir == "/" {
+		targetDir = s.Pool.UploadFolder()
+	}
 	saveDir, err := secureJoin(s.DataDir, targetDir)
 	if err != nil {
 		http.Error(w, "Access Denied", http.StatusForbidden)
 		return
 	}
+	expected, err := expectedDigest(r, false)
+	if err != nil {
+		errs.HTTPResponse(w, err)
+		return
+	}
 
-	r.ParseMultipartForm(32 << 20)
-
-	file, header, err := r.FormFile("file")
+	reader, err := r.MultipartReader()
 	if err != nil {
 		http.Error(w, "Invalid file", 400)
 		return
 	}
-	defer file.Close()
 
-	dstPath := filepath.Join(saveDir, header.Filename)
-	dst, err := os.Create(dstPath)
+	var staged *atomicFile
+	defer func() {
+		if staged != nil {
+			staged.Abort()
+		}
+	}()
+
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			errs.HTTPResponse(w, errs.E(OpCommit, errs.KindInvalid, err, "Upload interrupted"))
+			return
+		}
+
+		switch part.FormName() {
+		case "sha256":
+			raw, _ := io.ReadAll(io.LimitReader(part, 128))
+			if expected, err = parseHexDigest(string(raw)); err != nil {
+				errs.HTTPResponse(w, err)
+				return
+			}
+		case "file":
+			name := filepath.Base(part.FileName())
+			if staged != nil || name == "." || name == string(filepath.Separator) {
+				http.Error(w, "Invalid file", 400)
+				return
+			}
+			dstPath := filepath.Join(saveDir, name)
+			if err := s.CheckQuota(dstPath, r.ContentLength); err != nil {
+				errs.HTTPResponse(w, err)
+				return
+			}
+			body, err := s.LimitUpload(dstPath, part)
+			if err != nil {
+				errs.HTTPResponse(w, err)
+				return
+			}
+			if staged, err = createAtomic(dstPath); err != nil {
+				http.Error(w, "Disk error", 500)
+				return
+			}
+			if _, err := io.Copy(staged, body); err != nil {
+				if !isQuota(err) {
+					err = errs.E(OpCommit, errs.KindInvalid, err, "Upload interrupted")
+				}
+				errs.HTTPResponse(w, err)
+				return
+			}
+		}
+	}
+
+	if staged == nil {
+		http.Error(w, "Invalid file", 400)
+		return
+	}
+	af := staged
+	staged = nil
+	if err := af.Commit(expected); err != nil {
+		errs.HTTPResponse(w, err)
+		return
+	}
+	s.digests.put(af.dst, af.Sum())
+	s.NotifyChanged(af.dst)
+
+	rel, _ := filepath.Rel(s.DataDir, af.dst)
+	setDigestHeader(w, af.Sum())
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"status": "uploaded",
+		"path":   "/" + filepath.ToSlash(rel),
+		"size":   af.n,
+		"sha256": af.Sum(),
+	})
+}
+
+func (s *Cloud) handleSearch(w http.ResponseWriter, r *http.Request) {
+	q, err := parseSearchQuery(r.URL.Query())
 	if err != nil {
-		http.Error(w, "Disk error", 500)
+		errs.HTTPResponse(w, err)
 		return
 	}
-	defer dst.Close()
 
-	io.Copy(dst, file)
-	w.Write([]byte("Uploaded"))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.Index.Search(q))
+}
+
+// NotifyChanged tells the derived views (search index, thumbnails, sync
+// journal) that a
+// file or folder was written. Everything that mutates DataDir goes through here.
+func (s *Cloud) NotifyChanged(fullPath string) {
+	// Nothing changed on a drive that is not there
+	if s.Offline(fullPath) {
+		return
+	}
+	s.Index.Update(fullPath)
+	s.Usage.Update(fullPath)
+	s.Thumbs.Invalidate(fullPath)
+	s.Media.Update(fullPath)
+	s.Journal.Update(fullPath)
+}
+
+func (s *Cloud) NotifyRemoved(fullPath string) {
+	if s.Offline(fullPath) {
+		return
+	}
+	s.digests.remove(fullPath)
+	s.Index.Remove(fullPath)
+	s.Usage.Remove(fullPath)
+	s.Thumbs.Invalidate(fullPath)
+	s.Media.Remove(fullPath)
+	s.Journal.Remove(fullPath)
 }
 
 func secureJoin(root, userPath string) (string, error) {
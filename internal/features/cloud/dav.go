@@ -0,0 +1,315 @@
+package cloud
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+
+	"golang.org/x/net/webdav"
+
+	"github.com/strct-org/strct-agent/internal/errs"
+	"github.com/strct-org/strct-agent/internal/fsx"
+)
+
+const (
+	OpDAV     errs.Op = "cloud.handleDAV"
+	davPrefix         = "/dav"
+)
+
+// davFS is a webdav.FileSystem rooted at DataDir. It resolves every name
+// through secureJoin, so WebDAV clients are sandboxed exactly like the JSON
+// API, and keeps the search index and thumbnail cache in step with writes.
+type davFS struct {
+	cloud *Cloud
+}
+
+type putStateKey struct{}
+
+// putState carries per-request context into the file. x/net/webdav always
+// Closes the file, even when the copy failed half way, so the file needs to
+// know whether the body was read to the end; it also needs the expected
+// digest and somewhere to report the computed one.
+type putState struct {
+	complete atomic.Bool
+	expected string
+	w        http.ResponseWriter
+	err      error // commit refused, e.g. checksum mismatch
+}
+
+// putBody reads the request body through body, which stops it at the
+// quota; going past it is reported instead of the webdav package's error.
+type putBody struct {
+	io.ReadCloser
+	body  io.Reader
+	state *putState
+}
+
+func (b *putBody) Read(p []byte) (int, error) {
+	n, err := b.body.Read(p)
+	switch {
+	case err == io.EOF:
+		b.state.complete.Store(true)
+	case isQuota(err):
+		b.state.err = err
+	}
+	return n, err
+}
+
+// putResponse replaces the webdav package's generic failure response with
+// our own error when the commit was refused for a reason the client should see.
+type putResponse struct {
+	http.ResponseWriter
+	state    *putState
+	replaced bool
+}
+
+func (p *putResponse) WriteHeader(code int) {
+	if code >= 400 && p.state.err != nil {
+		p.replaced = true
+		errs.HTTPResponse(p.ResponseWriter, p.state.err)
+		return
+	}
+	p.ResponseWriter.WriteHeader(code)
+}
+
+func (p *putResponse) Write(b []byte) (int, error) {
+	if p.replaced {
+		return len(b), nil
+	}
+	return p.ResponseWriter.Write(b)
+}
+
+func (s *Cloud) newDAVHandler() *webdav.Handler {
+	return &webdav.Handler{
+		Prefix:     davPrefix,
+		FileSystem: &davFS{cloud: s},
+		LockSystem: webdav.NewMemLS(),
+		Logger: func(r *http.Request, err error) {
+			if err != nil {
+				log.Printf("[DAV] %s %s: %v", r.Method, r.URL.Path, err)
+			}
+		},
+	}
+}
+
+func (s *Cloud) handleDAV(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPut {
+		// The webdav package ignores Content-Range and would replace the
+		// whole file with the fragment; RFC 9110 says to refuse it instead
+		if r.Header.Get("Content-Range") != "" {
+			errs.HTTPResponse(w, errs.E(OpDAV, errs.KindInvalid, "Partial PUT with Content-Range is not supported"))
+			return
+		}
+		if r.ContentLength > 0 {
+			if full, err := secureJoin(s.DataDir, strings.TrimPrefix(r.URL.Path, davPrefix)); err == nil {
+				if err := s.CheckQuota(full, r.ContentLength); err != nil {
+					errs.HTTPResponse(w, err)
+					return
+				}
+			}
+		}
+		expected, err := expectedDigest(r, true)
+		if err != nil {
+			errs.HTTPResponse(w, err)
+			return
+		}
+		st := &putState{expected: expected, w: w}
+		body := io.Reader(r.Body)
+		if full, err := secureJoin(s.DataDir, strings.TrimPrefix(r.URL.Path, davPrefix)); err == nil {
+			if body, err = s.LimitUpload(full, r.Body); err != nil {
+				errs.HTTPResponse(w, err)
+				return
+			}
+		}
+		r.Body = &putBody{ReadCloser: r.Body, body: body, state: st}
+		r = r.WithContext(context.WithValue(r.Context(), putStateKey{}, st))
+		w = &putResponse{ResponseWriter: w, state: st}
+	}
+	s.DAV.ServeHTTP(w, r)
+}
+
+// resolve maps a WebDAV name to its path. Files still being written do not
+// exist as far as clients are concerned.
+func (fs *davFS) resolve(name string) (string, error) {
+	full, err := secureJoin(fs.cloud.DataDir, name)
+	if err != nil {
+		return "", os.ErrPermission
+	}
+	if fsx.IsTempName(filepath.Base(full)) {
+		return "", os.ErrNotExist
+	}
+	return full, nil
+}
+
+func (fs *davFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	full, err := fs.resolve(name)
+	if err != nil {
+		return err
+	}
+	if err := os.Mkdir(full, perm); err != nil {
+		return err
+	}
+	fs.cloud.NotifyChanged(full)
+	return nil
+}
+
+func (fs *davFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	full, err := fs.resolve(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		f, err := os.Open(full)
+		if err != nil {
+			return nil, err
+		}
+		return davDir{f}, nil
+	}
+
+	// Only whole-file replacement (PUT, COPY) is ever requested by the
+	// handler; stage it next to the target and rename on Close.
+	if flag&os.O_TRUNC == 0 {
+		f, err := os.OpenFile(full, flag, perm)
+		if err != nil {
+			return nil, err
+		}
+		return f, nil
+	}
+
+	if info, err := os.Stat(full); err == nil && info.IsDir() {
+		return nil, os.ErrInvalid
+	}
+	if _, err := os.Stat(filepath.Dir(full)); err != nil {
+		return nil, err
+	}
+
+	af, err := createAtomic(full)
+	if err != nil {
+		return nil, err
+	}
+	st, _ := ctx.Value(putStateKey{}).(*putState)
+	return &davFile{File: af.f, af: af, fs: fs, put: st}, nil
+}
+
+func (fs *davFS) RemoveAll(ctx context.Context, name string) error {
+	full, err := fs.resolve(name)
+	if err != nil {
+		return err
+	}
+	if full == fs.cloud.DataDir {
+		return os.ErrInvalid
+	}
+	if err := os.RemoveAll(full); err != nil {
+		return err
+	}
+	fs.cloud.NotifyRemoved(full)
+	return nil
+}
+
+func (fs *davFS) Rename(ctx context.Context, oldName, newName string) error {
+	oldFull, err := fs.resolve(oldName)
+	if err != nil {
+		return err
+	}
+	newFull, err := fs.resolve(newName)
+	if err != nil {
+		return err
+	}
+	if oldFull == fs.cloud.DataDir || newFull == fs.cloud.DataDir {
+		return os.ErrInvalid
+	}
+	if err := os.Rename(oldFull, newFull); err != nil {
+		return err
+	}
+	fs.cloud.digests.move(oldFull, newFull)
+	fs.cloud.NotifyRemoved(oldFull)
+	fs.cloud.NotifyChanged(newFull)
+	return nil
+}
+
+func (fs *davFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	full, err := fs.resolve(name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Stat(full)
+}
+
+// davDir hides files still being written from folder listings.
+type davDir struct {
+	*os.File
+}
+
+func (d davDir) Readdir(count int) ([]os.FileInfo, error) {
+	for {
+		list, err := d.File.Readdir(count)
+		kept := list[:0]
+		for _, info := range list {
+			if !fsx.IsTempName(info.Name()) {
+				kept = append(kept, info)
+			}
+		}
+		// A batch of nothing but temp files is not the end of the folder
+		if len(kept) > 0 || err != nil || count <= 0 {
+			return kept, err
+		}
+	}
+}
+
+// davFile is a staged write. The content only replaces the target once the
+// whole body has arrived (and matched the client's digest, if it sent one);
+// an aborted upload leaves the old file untouched.
+type davFile struct {
+	*os.File
+	af  *atomicFile
+	fs  *davFS
+	put *putState
+}
+
+var errIncompleteUpload = errors.New("upload incomplete, discarded")
+
+// Write and ReadFrom go through the atomicFile so every byte is hashed.
+func (f *davFile) Write(p []byte) (int, error) {
+	return f.af.Write(p)
+}
+
+func (f *davFile) ReadFrom(r io.Reader) (int64, error) {
+	return io.Copy(f.af, r)
+}
+
+func (f *davFile) Close() error {
+	if f.put != nil && !f.put.complete.Load() {
+		f.af.Abort()
+		// The webdav package answers any Close error with 405
+		if f.put.err == nil {
+			f.put.err = errs.E(OpDAV, errs.KindInvalid, errIncompleteUpload, "Upload interrupted")
+		}
+		return errIncompleteUpload
+	}
+
+	expected := ""
+	if f.put != nil {
+		expected = f.put.expected
+	}
+	if err := f.af.Commit(expected); err != nil {
+		if f.put != nil {
+			f.put.err = err
+		}
+		return err
+	}
+
+	sum := f.af.Sum()
+	f.fs.cloud.digests.put(f.af.dst, sum)
+	if f.put != nil {
+		setDigestHeader(f.put.w, sum)
+	}
+	f.fs.cloud.NotifyChanged(f.af.dst)
+	return nil
+}
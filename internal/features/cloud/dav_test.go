@@ -0,0 +1,200 @@
+package cloud
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/strct-org/strct-agent/internal/fsx"
+)
+
+func newTestCloud(t *testing.T) *Cloud {
+	t.Helper()
+
+	dir := t.TempDir()
+	c := &Cloud{
+		DataDir:  filepath.Join(dir, "data"),
+		StateDir: filepath.Join(dir, "state"),
+	}
+	if err := os.MkdirAll(c.DataDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	c.Index = NewIndex(c.DataDir, filepath.Join(c.StateDir, "index.json"))
+	c.Usage = NewUsage(c.DataDir, filepath.Join(c.StateDir, "usage.json"))
+	c.digests = &digestStore{dir: filepath.Join(c.StateDir, "digests")}
+	c.Thumbs = NewThumbnailer(filepath.Join(c.StateDir, "thumbnails"), 1)
+	c.Media = NewMedia(c.DataDir, filepath.Join(c.StateDir, "media_index.json"))
+	c.Journal = NewJournal(c.DataDir, filepath.Join(c.StateDir, "sync"), c.digests)
+	c.Walker = NewWalker(c.DataDir, c.Index, c.Usage, c.Media, c.Journal)
+	c.Walker.Offline, c.Journal.Offline, c.Media.Offline = c.Offline, c.Offline, c.Offline
+	backups, err := NewBackupStore(filepath.Join(c.StateDir, "backups.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Backups = backups
+	c.DAV = c.newDAVHandler()
+	return c
+}
+
+// failingReader hands out some bytes and then breaks, like a client that
+// drops off mid-upload.
+type failingReader struct{ n int }
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if r.n <= 0 {
+		return 0, errors.New("connection reset")
+	}
+	n := min(len(p), r.n)
+	for i := range p[:n] {
+		p[i] = 'x'
+	}
+	r.n -= n
+	return n, nil
+}
+
+func TestDAV(t *testing.T) {
+	c := newTestCloud(t)
+	if err := os.WriteFile(filepath.Join(c.DataDir, "keep.txt"), []byte("original"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(c.DataDir, fsx.TempPrefix+"stale"), []byte("half"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		method   string
+		path     string
+		body     io.Reader
+		headers  map[string]string
+		wantCode int
+		absent   string // must not appear in the response
+		check    func(t *testing.T)
+	}{
+		{
+			name: "Options Advertises Locking", method: "OPTIONS", path: "/dav/",
+			wantCode: http.StatusOK,
+		},
+		{
+			name: "Put Creates File", method: "PUT", path: "/dav/hello.txt", body: strings.NewReader("hi there"),
+			wantCode: http.StatusCreated,
+			check: func(t *testing.T) {
+				got, err := os.ReadFile(filepath.Join(c.DataDir, "hello.txt"))
+				if err != nil || string(got) != "hi there" {
+					t.Errorf("hello.txt = %q, %v", got, err)
+				}
+				if c.Index.Len() != 1 {
+					t.Errorf("index has %d entries, want 1", c.Index.Len())
+				}
+			},
+		},
+		{
+			name: "Interrupted Put Keeps Old Content", method: "PUT", path: "/dav/keep.txt", body: &failingReader{n: 4096},
+			wantCode: http.StatusBadRequest,
+			check: func(t *testing.T) {
+				got, _ := os.ReadFile(filepath.Join(c.DataDir, "keep.txt"))
+				if string(got) != "original" {
+					t.Errorf("keep.txt = %q, want original content", got)
+				}
+				// Only the stale one planted above
+				leftovers, _ := filepath.Glob(filepath.Join(c.DataDir, ".strct-upload-*"))
+				if len(leftovers) != 1 {
+					t.Errorf("temp files left behind: %v", leftovers)
+				}
+			},
+		},
+		{
+			name: "Partial Put Refused", method: "PUT", path: "/dav/keep.txt", body: strings.NewReader("XY"),
+			headers:  map[string]string{"Content-Range": "bytes 0-1/8"},
+			wantCode: http.StatusBadRequest,
+			check: func(t *testing.T) {
+				got, _ := os.ReadFile(filepath.Join(c.DataDir, "keep.txt"))
+				if string(got) != "original" {
+					t.Errorf("keep.txt = %q, want original content", got)
+				}
+			},
+		},
+		{
+			name: "Propfind Hides Temp Files", method: "PROPFIND", path: "/dav/",
+			headers:  map[string]string{"Depth": "1"},
+			wantCode: http.StatusMultiStatus, absent: fsx.TempPrefix,
+		},
+		{
+			name: "Temp File Not Found", method: "GET", path: "/dav/" + fsx.TempPrefix + "stale",
+			wantCode: http.StatusNotFound,
+		},
+		{
+			name: "Mkcol", method: "MKCOL", path: "/dav/docs",
+			wantCode: http.StatusCreated,
+		},
+		{
+			name: "Move Into Folder", method: "MOVE", path: "/dav/hello.txt",
+			headers:  map[string]string{"Destination": "http://device/dav/docs/hello.txt"},
+			wantCode: http.StatusCreated,
+			check: func(t *testing.T) {
+				if _, err := os.Stat(filepath.Join(c.DataDir, "docs", "hello.txt")); err != nil {
+					t.Errorf("moved file missing: %v", err)
+				}
+			},
+		},
+		{
+			name: "Propfind Lists Folder", method: "PROPFIND", path: "/dav/docs/",
+			headers:  map[string]string{"Depth": "1"},
+			wantCode: http.StatusMultiStatus,
+		},
+		{
+			name: "Lock File", method: "LOCK", path: "/dav/keep.txt",
+			body:     strings.NewReader(`<?xml version="1.0"?><D:lockinfo xmlns:D="DAV:"><D:lockscope><D:exclusive/></D:lockscope><D:locktype><D:write/></D:locktype></D:lockinfo>`),
+			wantCode: http.StatusOK,
+		},
+		{
+			name: "Put On Locked File Without Token", method: "PUT", path: "/dav/keep.txt", body: strings.NewReader("overwrite"),
+			wantCode: http.StatusLocked,
+		},
+		{
+			name: "Traversal Stays In Root", method: "PUT", path: "/dav/../../escape.txt", body: strings.NewReader("x"),
+			wantCode: http.StatusCreated,
+			check: func(t *testing.T) {
+				if _, err := os.Stat(filepath.Join(c.DataDir, "escape.txt")); err != nil {
+					t.Errorf("file should have landed inside DataDir: %v", err)
+				}
+			},
+		},
+		{
+			name: "Cannot Delete Root", method: "DELETE", path: "/dav/",
+			wantCode: http.StatusMethodNotAllowed,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "http://device"+davPrefix, tt.body)
+			// Bypass httptest's path cleaning so traversal attempts reach the handler
+			req.URL.Path = tt.path
+			for k, v := range tt.headers {
+				req.Header.Set(k, v)
+			}
+			rec := httptest.NewRecorder()
+
+			c.handleDAV(rec, req)
+
+			if rec.Code != tt.wantCode {
+				t.Fatalf("%s %s = %d, want %d (%s)", tt.method, tt.path, rec.Code, tt.wantCode, rec.Body.String())
+			}
+			if tt.absent != "" && strings.Contains(rec.Body.String(), tt.absent) {
+				t.Errorf("response mentions %q: %s", tt.absent, rec.Body.String())
+			}
+			if tt.name == "Options Advertises Locking" && !strings.Contains(rec.Header().Get("DAV"), "2") {
+				t.Errorf("DAV header = %q, want class 2", rec.Header().Get("DAV"))
+			}
+			if tt.check != nil {
+				tt.check(t)
+			}
+		})
+	}
+}
@@ -0,0 +1,203 @@
+package cloud
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"path/filepath"
+	"sync"
+
+	"github.com/strct-org/strct-agent/internal/errs"
+)
+
+const (
+	OpEject   errs.Op = "cloud.Eject"
+	OpRemount errs.Op = "cloud.Remount"
+	OpOffline errs.Op = "cloud.online"
+)
+
+// gate counts the requests using the data drive and turns new ones away
+// while it is ejected.
+type gate struct {
+	mu      sync.Mutex
+	offline bool
+	active  int
+	idle    chan struct{} // closed when the last request leaves a closing gate
+}
+
+func (g *gate) enter() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.offline {
+		return false
+	}
+	g.active++
+	return true
+}
+
+func (g *gate) leave() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.active--
+	if g.active == 0 && g.idle != nil {
+		close(g.idle)
+		g.idle = nil
+	}
+}
+
+// close turns new requests away and waits for those running to finish.
+// It stays closed even if they do not finish in time.
+func (g *gate) close(ctx context.Context) error {
+	g.mu.Lock()
+	g.offline = true
+	if g.active == 0 {
+		g.mu.Unlock()
+		return nil
+	}
+	if g.idle == nil {
+		g.idle = make(chan struct{})
+	}
+	idle := g.idle
+	g.mu.Unlock()
+
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		return fmt.Errorf("%d requests are still using the drive", g.active)
+	}
+}
+
+func (g *gate) open() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.offline = false
+}
+
+func (g *gate) isOffline() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.offline
+}
+
+func errOffline() error {
+	return errs.E(OpOffline, errs.KindNotFound, "Volume is offline: the data drive was ejected")
+}
+
+// online serves h while the data drive is mounted, and counts it as using
+// the drive so an eject waits for it.
+func (s *Cloud) online(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !s.gate.enter() {
+			errs.HTTPResponse(w, errOffline())
+			return
+		}
+		defer s.gate.leave()
+		h(w, r)
+	}
+}
+
+// Enter counts a request that reaches the drive without going through the
+// cloud API, such as one to the S3 gateway, the way online does. It reports
+// false while the drive is ejected; a true must be matched by Leave.
+func (s *Cloud) Enter() bool {
+	return s.gate.enter()
+}
+
+// Leave ends a request Enter let in.
+func (s *Cloud) Leave() {
+	s.gate.leave()
+}
+
+// Ejected reports whether the data drive has been ejected.
+func (s *Cloud) Ejected() bool {
+	return s.gate.isOffline()
+}
+
+// Offline reports whether fullPath is on storage that is not mounted right
+// now: the data drive while it is ejected or gone, or a pool volume that is
+// offline. What is left there is an empty folder, which must never be taken
+// for the files having been deleted.
+func (s *Cloud) Offline(fullPath string) bool {
+	if s.gate.isOffline() {
+		return true
+	}
+	if s.Disk != nil && s.Mounted != nil && !s.Mounted(s.DataDir) {
+		return true
+	}
+	volume, online := s.Pool.On(fullPath)
+	return volume != "" && !online
+}
+
+// Eject takes storage off the data drive so it can be unplugged: new
+// requests are turned away, those running are given until ctx is done to
+// finish, and the drive is flushed and unmounted. If it cannot be, storage
+// stays where it was.
+func (s *Cloud) Eject(ctx context.Context) error {
+	if s.Disk == nil {
+		return errs.E(OpEject, errs.KindInvalid, "storage is on the SD card; there is no drive to eject")
+	}
+	if s.gate.isOffline() {
+		return errs.E(OpEject, errs.KindInvalid, "the data drive is already ejected")
+	}
+	if err := s.gate.close(ctx); err != nil {
+		s.gate.open()
+		return errs.E(OpEject, errs.KindInvalid, err, "the drive is busy; try again once transfers finish")
+	}
+	s.Pool.Suspend()
+
+	// A drive switched to at runtime is bound over DataDir
+	dirs := []string{s.mountPoint()}
+	if dirs[0] != s.DataDir {
+		dirs = []string{s.DataDir, dirs[0]}
+	}
+	for i, dir := range dirs {
+		if err := s.Unmount(dir); err != nil {
+			if i > 0 {
+				s.Bind(dirs[1], s.DataDir)
+			}
+			s.Pool.Resume()
+			s.gate.open()
+			return errs.E(OpEject, errs.KindSystem, err, "could not unmount the drive")
+		}
+	}
+	log.Printf("[STORAGE] Data drive ejected from %s", s.DataDir)
+	return nil
+}
+
+// Remount puts storage back on the data drive after an eject. An
+// encrypted drive must be unlocked first.
+func (s *Cloud) Remount() error {
+	if !s.gate.isOffline() {
+		return errs.E(OpRemount, errs.KindInvalid, "the data drive is not ejected")
+	}
+	mountPoint := s.mountPoint()
+	if err := s.Disk.EnsureMounted(mountPoint); err != nil {
+		return errs.E(OpRemount, errs.KindSystem, err, "could not mount the drive")
+	}
+	if mountPoint != s.DataDir {
+		if err := s.Bind(mountPoint, s.DataDir); err != nil {
+			s.Unmount(mountPoint)
+			return errs.E(OpRemount, errs.KindSystem, err, "could not mount the drive")
+		}
+	}
+	s.gate.open()
+	s.Pool.Resume()
+	log.Printf("[STORAGE] Data drive mounted again at %s", s.DataDir)
+
+	// It may have been changed on another machine
+	s.rescan()
+	return nil
+}
+
+// mountPoint is where the data drive is mounted: DataDir itself, unless
+// it was switched to at runtime and bound there.
+func (s *Cloud) mountPoint() string {
+	if s.driveMount != "" {
+		return s.driveMount
+	}
+	return filepath.Clean(s.DataDir)
+}
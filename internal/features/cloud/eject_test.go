@@ -0,0 +1,235 @@
+package cloud
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/platform/disk"
+)
+
+// mountedDisk is a MockDisk that mounts at once and remembers where.
+type mountedDisk struct {
+	disk.MockDisk
+	mounted []string
+}
+
+func (d *mountedDisk) EnsureMounted(mountPoint string) error {
+	d.mounted = append(d.mounted, mountPoint)
+	return nil
+}
+
+func TestEject(t *testing.T) {
+	c := newTestCloud(t)
+	f := &fakeDrives{attached: map[string]disk.Partition{}, bound: map[string]string{}}
+	c.Pool = newTestPool(t, c, f)
+	f.plug("a1", disk.Partition{Device: "/dev/sdb1", FSType: "ext4"})
+	if _, err := c.Pool.Add("a1", "Archive"); err != nil {
+		t.Fatal(err)
+	}
+	var unmounted []string
+	failUnmount := ""
+	c.Bind = f.bind
+	c.Unmount = func(dir string) error {
+		if dir == failUnmount {
+			return errors.New("umount: target is busy")
+		}
+		unmounted = append(unmounted, dir)
+		return nil
+	}
+	routes := c.GetRoutes()
+	get := func(route string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		routes[route](w, httptest.NewRequest("GET", route, nil))
+		return w
+	}
+
+	if err := c.Eject(context.Background()); err == nil {
+		t.Error("ejected the SD card")
+	}
+	d := &mountedDisk{}
+	c.Disk = d
+
+	// An upload is still running and does not finish in time
+	release := make(chan struct{})
+	started := make(chan struct{})
+	upload := c.online(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	})
+	go upload(httptest.NewRecorder(), httptest.NewRequest("POST", "/strct_agent/fs/upload", nil))
+	<-started
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	err := c.Eject(ctx)
+	cancel()
+	if err == nil || c.Ejected() || len(unmounted) != 0 {
+		t.Fatalf("ejected under a running upload: %v, unmounted %q", err, unmounted)
+	}
+	if w := get("/api/files"); w.Code != http.StatusOK {
+		t.Errorf("after a failed eject: %d", w.Code)
+	}
+
+	// This time it finishes while the eject waits
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		close(release)
+	}()
+	if err := c.Eject(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(unmounted) != 1 || unmounted[0] != c.DataDir || len(f.bound) != 0 {
+		t.Errorf("unmounted %q, still bound %v", unmounted, f.bound)
+	}
+	if w := get("/api/files"); w.Code != http.StatusNotFound || !strings.Contains(w.Body.String(), "offline") {
+		t.Errorf("files while ejected: %d %s", w.Code, w.Body)
+	}
+	if err := c.CheckQuota(filepath.Join(c.DataDir, "a.txt"), 1); err == nil {
+		t.Error("quota allowed a write while ejected")
+	}
+	if w := get("/api/status"); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"ejected":true`) {
+		t.Errorf("status while ejected: %d %s", w.Code, w.Body)
+	}
+	// A drive plugged in meanwhile is not bound onto the SD card
+	c.Pool.Check()
+	if len(f.bound) != 0 {
+		t.Errorf("pool bound %v while ejected", f.bound)
+	}
+	if err := c.Eject(context.Background()); err == nil {
+		t.Error("ejected twice")
+	}
+
+	if err := c.Remount(); err != nil {
+		t.Fatal(err)
+	}
+	if len(d.mounted) != 1 || d.mounted[0] != c.DataDir || c.Ejected() || f.bound[filepath.Join(c.DataDir, "Archive")] == "" {
+		t.Errorf("remounted at %q, ejected %v, bound %v", d.mounted, c.Ejected(), f.bound)
+	}
+	if w := get("/api/files"); w.Code != http.StatusOK {
+		t.Errorf("files after remount: %d", w.Code)
+	}
+	if err := c.Remount(); err == nil {
+		t.Error("remounted a mounted drive")
+	}
+
+	// A drive switched to at runtime is bound over DataDir; when it will
+	// not come off, the bind is put back
+	c.driveMount = filepath.Join(c.StateDir, "drive")
+	unmounted, failUnmount = nil, c.driveMount
+	if err := c.Eject(context.Background()); err == nil || c.Ejected() {
+		t.Fatalf("eject of a busy drive: %v", err)
+	}
+	if len(unmounted) != 1 || unmounted[0] != c.DataDir || f.bound[c.DataDir] != c.driveMount {
+		t.Errorf("unmounted %q, bound %v", unmounted, f.bound)
+	}
+	c.scans.Wait()
+}
+
+// TestOfflineKeepsIndexes checks that an ejected drive or an offline pool
+// volume, which leave an empty folder behind, is never taken for every
+// file on it having been deleted.
+func TestOfflineKeepsIndexes(t *testing.T) {
+	c := newTestCloud(t)
+	c.Journal.Throttle, c.Media.Throttle = 0, 0
+	f := &fakeDrives{attached: map[string]disk.Partition{}, bound: map[string]string{}}
+	c.Pool = newTestPool(t, c, f)
+	f.plug("a1", disk.Partition{Device: "/dev/sdb1", FSType: "ext4"})
+	if _, err := c.Pool.Add("a1", "Archive"); err != nil {
+		t.Fatal(err)
+	}
+	c.Disk = &mountedDisk{}
+	c.Bind = f.bind
+
+	// Unmounting hides the drive's files, as it would for real
+	stash := filepath.Join(c.StateDir, "unmounted")
+	hide := func(dir string) {
+		os.MkdirAll(stash, 0755)
+		entries, _ := os.ReadDir(dir)
+		for _, e := range entries {
+			os.Rename(filepath.Join(dir, e.Name()), filepath.Join(stash, e.Name()))
+		}
+	}
+	show := func(dir string) {
+		entries, _ := os.ReadDir(stash)
+		for _, e := range entries {
+			os.Rename(filepath.Join(stash, e.Name()), filepath.Join(dir, e.Name()))
+		}
+	}
+	c.Unmount = func(dir string) error {
+		hide(dir)
+		return nil
+	}
+
+	for _, rel := range []string{"Photos/a.jpg", "notes.txt", "Archive/old.jpg"} {
+		p := filepath.Join(c.DataDir, filepath.FromSlash(rel))
+		os.MkdirAll(filepath.Dir(p), 0755)
+		os.WriteFile(p, []byte(rel), 0644)
+		c.NotifyChanged(p)
+	}
+	c.Walker.Scan(context.Background())
+	c.Journal.Process(context.Background())
+	c.Media.Process(context.Background())
+	seq, files, used, media := c.Journal.Version(), c.Index.Len(), c.Usage.Total(), len(c.Media.items)
+	unchanged := func(when string) {
+		t.Helper()
+		if got := c.Journal.Version(); got != seq {
+			t.Errorf("%s: journal moved from %d to %d: %+v", when, seq, got, c.Journal.Changes(seq, 10).Changes)
+		}
+		if c.Index.Len() != files || c.Usage.Total() != used || len(c.Media.items) != media {
+			t.Errorf("%s: index %d, usage %d, media %d", when, c.Index.Len(), c.Usage.Total(), len(c.Media.items))
+		}
+	}
+
+	if err := c.Eject(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Walker.Scan(context.Background()); err == nil {
+		t.Error("scanned an ejected drive")
+	}
+	c.NotifyChanged(filepath.Join(c.DataDir, "notes.txt"))
+	c.NotifyRemoved(filepath.Join(c.DataDir, "Photos"))
+	c.Journal.mu.Lock()
+	c.Journal.pending["notes.txt"] = true
+	c.Journal.mu.Unlock()
+	c.Journal.Process(context.Background())
+	if c.Journal.Pending() != 1 {
+		t.Error("hashed while ejected")
+	}
+	c.Journal.hash("notes.txt")
+	if _, _, err := c.Journal.current("Photos/a.jpg"); err == nil {
+		t.Error("looked up a file on an ejected drive")
+	}
+	unchanged("ejected")
+
+	show(c.DataDir)
+	if err := c.Remount(); err != nil {
+		t.Fatal(err)
+	}
+	c.scans.Wait()
+	unchanged("remounted")
+
+	// A pool volume that drops off leaves its empty folder behind
+	archive := filepath.Join(c.DataDir, "Archive")
+	hide(archive)
+	f.unplug("a1")
+	c.Pool.Check()
+	if !c.Offline(filepath.Join(archive, "old.jpg")) || c.Offline(filepath.Join(c.DataDir, "notes.txt")) {
+		t.Fatal("offline volume not told apart")
+	}
+	if _, err := c.Walker.Scan(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	unchanged("volume offline")
+
+	// A drive that is gone without an eject is caught by the mount check
+	c.Mounted = func(string) bool { return false }
+	if _, err := c.Walker.Scan(context.Background()); err == nil {
+		t.Error("scanned a drive that is not mounted")
+	}
+	unchanged("not mounted")
+}
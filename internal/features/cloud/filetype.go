@@ -0,0 +1,86 @@
+package cloud
+
+import (
+	"mime"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	CategoryImage    = "image"
+	CategoryVideo    = "video"
+	CategoryAudio    = "audio"
+	CategoryDocument = "document"
+	CategoryArchive  = "archive"
+	CategoryOther    = "other"
+)
+
+// extra covers extensions that mime.TypeByExtension does not know on a bare Pi image
+// (no /etc/mime.types installed).
+var extraMIME = map[string]string{
+	".heic": "image/heic",
+	".heif": "image/heif",
+	".webp": "image/webp",
+	".mkv":  "video/x-matroska",
+	".mov":  "video/quicktime",
+	".mp4":  "video/mp4",
+	".m4v":  "video/x-m4v",
+	".avi":  "video/x-msvideo",
+	".mp3":  "audio/mpeg",
+	".flac": "audio/flac",
+	".m4a":  "audio/mp4",
+	".md":   "text/markdown",
+	".7z":   "application/x-7z-compressed",
+	".rar":  "application/vnd.rar",
+	".gz":   "application/gzip",
+	".tgz":  "application/gzip",
+}
+
+var documentExt = map[string]bool{
+	".pdf": true, ".doc": true, ".docx": true, ".xls": true, ".xlsx": true,
+	".ppt": true, ".pptx": true, ".odt": true, ".ods": true, ".odp": true,
+	".txt": true, ".md": true, ".rtf": true, ".csv": true, ".pages": true,
+	".numbers": true, ".key": true, ".epub": true,
+}
+
+var archiveExt = map[string]bool{
+	".zip": true, ".tar": true, ".gz": true, ".tgz": true, ".bz2": true,
+	".xz": true, ".7z": true, ".rar": true, ".zst": true,
+}
+
+// MIMEType guesses the content type of a file from its name.
+func MIMEType(name string) string {
+	ext := strings.ToLower(filepath.Ext(name))
+	if t, ok := extraMIME[ext]; ok {
+		return t
+	}
+	if t := mime.TypeByExtension(ext); t != "" {
+		// Drop parameters like "; charset=utf-8"
+		if i := strings.IndexByte(t, ';'); i >= 0 {
+			t = strings.TrimSpace(t[:i])
+		}
+		return t
+	}
+	return "application/octet-stream"
+}
+
+// Category buckets a file into the coarse groups the UI filters by.
+func Category(name string) string {
+	ext := strings.ToLower(filepath.Ext(name))
+	switch {
+	case documentExt[ext]:
+		return CategoryDocument
+	case archiveExt[ext]:
+		return CategoryArchive
+	}
+
+	switch t := MIMEType(name); {
+	case strings.HasPrefix(t, "image/"):
+		return CategoryImage
+	case strings.HasPrefix(t, "video/"):
+		return CategoryVideo
+	case strings.HasPrefix(t, "audio/"):
+		return CategoryAudio
+	}
+	return CategoryOther
+}
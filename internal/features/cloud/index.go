@@ -0,0 +1,449 @@
+package cloud
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/errs"
+	"github.com/strct-org/strct-agent/internal/fsx"
+)
+
+const (
+	OpIndexSave   errs.Op = "cloud.Index.save"
+	OpIndexSearch errs.Op = "cloud.handleSearch"
+)
+
+const (
+	defaultSearchLimit = 50
+	maxSearchLimit     = 500
+)
+
+// IndexEntry is one file or folder in the search index. Path is relative to
+// DataDir and always uses forward slashes so it can be handed to the API as-is.
+type IndexEntry struct {
+	Path    string    `json:"path"`
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modifiedAt"`
+	MIME    string    `json:"mime"`
+	Ext     string    `json:"ext"`
+	IsDir   bool      `json:"isDir"`
+}
+
+// Index keeps a persistent, in-memory view of every entry below Root.
+// Handlers keep it current through Update/Remove; the Walker's reconcile
+// scan catches anything changed behind our back (SSH, Samba, etc).
+type Index struct {
+	Root      string
+	StatePath string
+
+	mu      sync.RWMutex
+	entries map[string]IndexEntry
+	dirty   bool
+}
+
+type SearchQuery struct {
+	Text     string
+	Prefix   bool
+	Types    []string
+	Ext      string
+	After    time.Time
+	Before   time.Time
+	MinSize  int64
+	MaxSize  int64
+	DirsOnly bool
+	Sort     string
+	Desc     bool
+	Offset   int
+	Limit    int
+}
+
+type SearchResponse struct {
+	Results []IndexEntry `json:"results"`
+	Total   int          `json:"total"`
+	Offset  int          `json:"offset"`
+	Limit   int          `json:"limit"`
+}
+
+func NewIndex(root, statePath string) *Index {
+	return &Index{
+		Root:      root,
+		StatePath: statePath,
+		entries:   make(map[string]IndexEntry),
+	}
+}
+
+// Start loads the saved index and flushes it to disk every minute. The
+// Walker keeps it in step with the drive.
+func (idx *Index) Start() error {
+	if err := idx.load(); err != nil {
+		log.Printf("[INDEX] Could not load saved index, rebuilding: %v", err)
+	}
+
+	go func() {
+		flush := time.NewTicker(time.Minute)
+		defer flush.Stop()
+		for range flush.C {
+			if err := idx.save(); err != nil {
+				log.Printf("[INDEX] %v", err)
+			}
+		}
+	}()
+
+	return nil
+}
+
+func (idx *Index) visit(rel, full string, info fs.FileInfo) {
+	// Partial uploads are not files yet
+	if fsx.IsTempName(info.Name()) {
+		return
+	}
+	idx.put(rel, info)
+}
+
+func (idx *Index) reconcile(seen *walked) {
+	idx.mu.Lock()
+	for rel := range idx.entries {
+		if !seen.has(rel) {
+			delete(idx.entries, rel)
+			idx.dirty = true
+		}
+	}
+	idx.mu.Unlock()
+
+	if err := idx.save(); err != nil {
+		log.Printf("[INDEX] %v", err)
+	}
+}
+
+// Update re-indexes a single path (and its children if it is a folder)
+// after the API changed it.
+func (idx *Index) Update(fullPath string) {
+	info, err := os.Stat(fullPath)
+	if err != nil {
+		idx.Remove(fullPath)
+		return
+	}
+
+	idx.put(idx.rel(fullPath), info)
+	if !info.IsDir() {
+		return
+	}
+
+	filepath.WalkDir(fullPath, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || p == fullPath || fsx.IsTempName(d.Name()) {
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			idx.put(idx.rel(p), info)
+		}
+		return nil
+	})
+}
+
+// Remove drops a path and everything below it from the index.
+func (idx *Index) Remove(fullPath string) {
+	rel := idx.rel(fullPath)
+	prefix := rel + "/"
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	for p := range idx.entries {
+		if p == rel || strings.HasPrefix(p, prefix) {
+			delete(idx.entries, p)
+			idx.dirty = true
+		}
+	}
+}
+
+func (idx *Index) Len() int {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	return len(idx.entries)
+}
+
+func (idx *Index) Search(q SearchQuery) SearchResponse {
+	text := strings.ToLower(q.Text)
+	types := make(map[string]bool, len(q.Types))
+	for _, t := range q.Types {
+		types[t] = true
+	}
+
+	idx.mu.RLock()
+	var matches []IndexEntry
+	for _, e := range idx.entries {
+		if q.matches(e, text, types) {
+			matches = append(matches, e)
+		}
+	}
+	idx.mu.RUnlock()
+
+	sortEntries(matches, q.Sort, q.Desc)
+
+	resp := SearchResponse{Total: len(matches), Offset: q.Offset, Limit: q.Limit, Results: []IndexEntry{}}
+	if q.Offset >= len(matches) {
+		return resp
+	}
+	end := min(q.Offset+q.Limit, len(matches))
+	resp.Results = matches[q.Offset:end]
+	return resp
+}
+
+func (q SearchQuery) matches(e IndexEntry, text string, types map[string]bool) bool {
+	if text != "" {
+		name := strings.ToLower(e.Name)
+		if q.Prefix && !strings.HasPrefix(name, text) {
+			return false
+		}
+		if !q.Prefix && !strings.Contains(name, text) {
+			return false
+		}
+	}
+	if q.DirsOnly && !e.IsDir {
+		return false
+	}
+	if len(types) > 0 && (e.IsDir || !types[Category(e.Name)]) {
+		return false
+	}
+	if q.Ext != "" && e.Ext != q.Ext {
+		return false
+	}
+	if !q.After.IsZero() && e.ModTime.Before(q.After) {
+		return false
+	}
+	if !q.Before.IsZero() && !e.ModTime.Before(q.Before) {
+		return false
+	}
+	if q.MinSize > 0 && e.Size < q.MinSize {
+		return false
+	}
+	if q.MaxSize > 0 && e.Size > q.MaxSize {
+		return false
+	}
+	return true
+}
+
+func sortEntries(list []IndexEntry, by string, desc bool) {
+	less := func(a, b IndexEntry) bool {
+		switch by {
+		case "size":
+			if a.Size != b.Size {
+				return a.Size < b.Size
+			}
+		case "mtime":
+			if !a.ModTime.Equal(b.ModTime) {
+				return a.ModTime.Before(b.ModTime)
+			}
+		case "type":
+			if a.MIME != b.MIME {
+				return a.MIME < b.MIME
+			}
+		}
+		if a.Name != b.Name {
+			return strings.ToLower(a.Name) < strings.ToLower(b.Name)
+		}
+		return a.Path < b.Path
+	}
+
+	sort.SliceStable(list, func(i, j int) bool {
+		if desc {
+			return less(list[j], list[i])
+		}
+		return less(list[i], list[j])
+	})
+}
+
+func (idx *Index) put(rel string, info fs.FileInfo) {
+	e := IndexEntry{
+		Path:    rel,
+		Name:    info.Name(),
+		ModTime: info.ModTime().UTC(),
+		IsDir:   info.IsDir(),
+	}
+	if !e.IsDir {
+		e.Size = info.Size()
+		e.Ext = strings.ToLower(path.Ext(e.Name))
+		e.MIME = MIMEType(e.Name)
+	}
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	if old, ok := idx.entries[rel]; ok && old == e {
+		return
+	}
+	idx.entries[rel] = e
+	idx.dirty = true
+}
+
+func (idx *Index) rel(fullPath string) string {
+	rel, err := filepath.Rel(idx.Root, fullPath)
+	if err != nil {
+		return filepath.ToSlash(fullPath)
+	}
+	return filepath.ToSlash(rel)
+}
+
+func (idx *Index) load() error {
+	data, err := os.ReadFile(idx.StatePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	var list []IndexEntry
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	for _, e := range list {
+		idx.entries[e.Path] = e
+	}
+	return nil
+}
+
+func (idx *Index) save() error {
+	idx.mu.Lock()
+	if !idx.dirty {
+		idx.mu.Unlock()
+		return nil
+	}
+	list := make([]IndexEntry, 0, len(idx.entries))
+	for _, e := range idx.entries {
+		list = append(list, e)
+	}
+	idx.dirty = false
+	idx.mu.Unlock()
+
+	data, err := json.Marshal(list)
+	if err != nil {
+		return errs.E(OpIndexSave, errs.KindIO, err)
+	}
+	if err := writeFileAtomic(idx.StatePath, data); err != nil {
+		return errs.E(OpIndexSave, errs.KindIO, err)
+	}
+	return nil
+}
+
+// writeFileAtomic writes small state files via temp file + rename, syncing
+// both the file and its folder, so a power cut never leaves a half-written
+// JSON document behind.
+func writeFileAtomic(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return fsx.WriteFile(path, data, 0644)
+}
+
+func parseSearchQuery(v url.Values) (SearchQuery, error) {
+	q := SearchQuery{
+		Text:     strings.TrimSpace(v.Get("q")),
+		Prefix:   v.Get("match") == "prefix",
+		Ext:      strings.ToLower(v.Get("ext")),
+		DirsOnly: v.Get("folders") == "true",
+		Sort:     v.Get("sort"),
+		Desc:     v.Get("order") == "desc",
+		Limit:    defaultSearchLimit,
+	}
+
+	if q.Ext != "" && !strings.HasPrefix(q.Ext, ".") {
+		q.Ext = "." + q.Ext
+	}
+
+	switch q.Sort {
+	case "", "name", "size", "mtime", "type":
+	default:
+		return q, errs.E(OpIndexSearch, errs.KindInvalid, fmt.Sprintf("unknown sort %q", q.Sort))
+	}
+
+	for _, t := range strings.Split(v.Get("type"), ",") {
+		if t = strings.TrimSpace(t); t == "" {
+			continue
+		}
+		cat, ok := typeFilters[t]
+		if !ok {
+			return q, errs.E(OpIndexSearch, errs.KindInvalid, fmt.Sprintf("unknown type %q", t))
+		}
+		q.Types = append(q.Types, cat)
+	}
+
+	var err error
+	if q.After, err = parseDateParam(v.Get("after")); err != nil {
+		return q, errs.E(OpIndexSearch, errs.KindInvalid, "invalid 'after' date", err)
+	}
+	if q.Before, err = parseDateParam(v.Get("before")); err != nil {
+		return q, errs.E(OpIndexSearch, errs.KindInvalid, "invalid 'before' date", err)
+	}
+
+	ints := []struct {
+		name string
+		dst  *int64
+	}{
+		{"minSize", &q.MinSize},
+		{"maxSize", &q.MaxSize},
+	}
+	for _, p := range ints {
+		raw := v.Get(p.name)
+		if raw == "" {
+			continue
+		}
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil || n < 0 {
+			return q, errs.E(OpIndexSearch, errs.KindInvalid, fmt.Sprintf("invalid %s", p.name))
+		}
+		*p.dst = n
+	}
+
+	if raw := v.Get("offset"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 0 {
+			return q, errs.E(OpIndexSearch, errs.KindInvalid, "invalid offset")
+		}
+		q.Offset = n
+	}
+	if raw := v.Get("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n <= 0 {
+			return q, errs.E(OpIndexSearch, errs.KindInvalid, "invalid limit")
+		}
+		q.Limit = min(n, maxSearchLimit)
+	}
+
+	return q, nil
+}
+
+var typeFilters = map[string]string{
+	"image": CategoryImage, "images": CategoryImage,
+	"video": CategoryVideo, "videos": CategoryVideo,
+	"audio": CategoryAudio, "music": CategoryAudio,
+	"document": CategoryDocument, "documents": CategoryDocument,
+	"archive": CategoryArchive, "archives": CategoryArchive,
+	"other": CategoryOther,
+}
+
+// parseDateParam accepts either a full RFC3339 timestamp or a plain date.
+func parseDateParam(raw string) (time.Time, error) {
+	if raw == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, raw); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.DateOnly, raw)
+}
@@ -0,0 +1,96 @@
+package cloud
+
+import (
+	"net/url"
+	"testing"
+	"time"
+)
+
+func testIndex() *Index {
+	idx := NewIndex("/data", "")
+	day := func(d int) time.Time { return time.Date(2024, 1, d, 0, 0, 0, 0, time.UTC) }
+
+	for _, e := range []IndexEntry{
+		{Path: "Photos", Name: "Photos", IsDir: true, ModTime: day(1)},
+		{Path: "Photos/IMG_0001.jpg", Name: "IMG_0001.jpg", Size: 3000, Ext: ".jpg", ModTime: day(2)},
+		{Path: "Photos/IMG_0002.HEIC", Name: "IMG_0002.HEIC", Size: 5000, Ext: ".heic", ModTime: day(3)},
+		{Path: "Videos/holiday.mp4", Name: "holiday.mp4", Size: 90000, Ext: ".mp4", ModTime: day(4)},
+		{Path: "Docs/tax-2023.pdf", Name: "tax-2023.pdf", Size: 1200, Ext: ".pdf", ModTime: day(5)},
+		{Path: "Docs/notes.txt", Name: "notes.txt", Size: 10, Ext: ".txt", ModTime: day(6)},
+	} {
+		idx.entries[e.Path] = e
+	}
+	return idx
+}
+
+func TestIndexSearch(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name  string
+		query string
+		want  []string
+	}{
+		{"Substring Case Insensitive", "q=img", []string{"Photos/IMG_0001.jpg", "Photos/IMG_0002.HEIC"}},
+		{"Prefix Match", "q=ta&match=prefix", []string{"Docs/tax-2023.pdf"}},
+		{"Prefix Excludes Infix", "q=day&match=prefix", []string{}},
+		{"Images Filter", "type=images", []string{"Photos/IMG_0001.jpg", "Photos/IMG_0002.HEIC"}},
+		{"Multiple Types", "type=video,documents&sort=size", []string{"Docs/notes.txt", "Docs/tax-2023.pdf", "Videos/holiday.mp4"}},
+		{"Extension", "ext=pdf", []string{"Docs/tax-2023.pdf"}},
+		{"Date Range", "after=2024-01-03&before=2024-01-05", []string{"Videos/holiday.mp4", "Photos/IMG_0002.HEIC"}},
+		{"Size Range", "minSize=1000&maxSize=5000", []string{"Photos/IMG_0001.jpg", "Photos/IMG_0002.HEIC", "Docs/tax-2023.pdf"}},
+		{"Folders Only", "folders=true", []string{"Photos"}},
+		{"Sort By Size Desc", "type=images&sort=size&order=desc", []string{"Photos/IMG_0002.HEIC", "Photos/IMG_0001.jpg"}},
+		{"Sort By Mtime", "sort=mtime&limit=2", []string{"Photos", "Photos/IMG_0001.jpg"}},
+		{"Pagination", "sort=mtime&offset=4&limit=10", []string{"Docs/tax-2023.pdf", "Docs/notes.txt"}},
+		{"Offset Past End", "offset=100", []string{}},
+	}
+
+	idx := testIndex()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v, err := url.ParseQuery(tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			q, err := parseSearchQuery(v)
+			if err != nil {
+				t.Fatalf("parseSearchQuery(%q) error: %v", tt.query, err)
+			}
+
+			got := idx.Search(q).Results
+			if len(got) != len(tt.want) {
+				t.Fatalf("Search(%q) returned %d results, want %d: %+v", tt.query, len(got), len(tt.want), got)
+			}
+			for i := range got {
+				if got[i].Path != tt.want[i] {
+					t.Errorf("result[%d] = %s, want %s", i, got[i].Path, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestParseSearchQueryErrors(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name  string
+		query string
+	}{
+		{"Unknown Type", "type=spreadsheets"},
+		{"Unknown Sort", "sort=owner"},
+		{"Bad Date", "after=yesterday"},
+		{"Negative Size", "minSize=-1"},
+		{"Zero Limit", "limit=0"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v, _ := url.ParseQuery(tt.query)
+			if _, err := parseSearchQuery(v); err == nil {
+				t.Errorf("parseSearchQuery(%q) expected error, got nil", tt.query)
+			}
+		})
+	}
+}
@@ -0,0 +1,16 @@
+package cloud
+
+import (
+	"io/fs"
+	"syscall"
+)
+
+// hardLink returns the identity of a file that has more than one name, so
+// its bytes can be counted once.
+func hardLink(info fs.FileInfo) (fileID, bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || st.Nlink < 2 {
+		return fileID{}, false
+	}
+	return fileID{dev: uint64(st.Dev), ino: st.Ino}, true
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package cloud
+
+import "io/fs"
+
+// hardLink always reports no link; the agent only hard-links on Linux.
+func hardLink(fs.FileInfo) (fileID, bool) {
+	return fileID{}, false
+}
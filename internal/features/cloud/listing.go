@@ -0,0 +1,302 @@
+package cloud
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/errs"
+	"github.com/strct-org/strct-agent/internal/fsx"
+	"github.com/strct-org/strct-agent/internal/humanize"
+)
+
+const OpListFiles errs.Op = "cloud.handleFiles"
+
+const (
+	defaultListLimit = 500
+	maxListLimit     = 5000
+)
+
+// listQuery is the parsed form of /api/files?path=&sort=&order=&limit=&cursor=.
+type listQuery struct {
+	Path  string
+	Sort  string
+	Desc  bool
+	Limit int
+	After *listKey
+}
+
+// listKey is everything an entry is ordered by. The cursor handed to the
+// client is the key of the last entry on the page, so the next page starts
+// right after it even if files were added or removed in between.
+type listKey struct {
+	Dir     bool   `json:"d,omitempty"`
+	Name    string `json:"n"`
+	Size    int64  `json:"z,omitempty"`
+	ModTime int64  `json:"t,omitempty"`
+	MIME    string `json:"m,omitempty"`
+}
+
+type listCursor struct {
+	Sort string  `json:"s,omitempty"`
+	Desc bool    `json:"o,omitempty"`
+	Key  listKey `json:"k"`
+}
+
+type listEntry struct {
+	key     listKey
+	info    fs.FileInfo
+	symlink bool
+}
+
+func (s *Cloud) handleFiles(w http.ResponseWriter, r *http.Request) {
+	q, err := parseListQuery(r.URL.Query())
+	if err != nil {
+		errs.HTTPResponse(w, err)
+		return
+	}
+	fullPath, err := secureJoin(s.DataDir, q.Path)
+	if err != nil {
+		errs.HTTPResponse(w, errs.E(OpListFiles, errs.KindForbidden, err, "Access Denied"))
+		return
+	}
+
+	resp, err := s.listFolder(fullPath, q)
+	if err != nil {
+		errs.HTTPResponse(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// listFolder returns one page of fullPath. The whole folder is read and
+// sorted on every call; only the entries on the page pay for digests and
+// child counts.
+func (s *Cloud) listFolder(fullPath string, q listQuery) (FilesResponse, error) {
+	info, err := os.Stat(fullPath)
+	if err != nil {
+		return FilesResponse{}, listError(err)
+	}
+	if !info.IsDir() {
+		return FilesResponse{}, errs.E(OpListFiles, errs.KindInvalid, "Not a folder")
+	}
+
+	dirEntries, err := os.ReadDir(fullPath)
+	if err != nil {
+		return FilesResponse{}, listError(err)
+	}
+
+	entries := make([]listEntry, 0, len(dirEntries))
+	for _, e := range dirEntries {
+		if fsx.IsTempName(e.Name()) {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			// Removed between ReadDir and Lstat
+			continue
+		}
+		le := listEntry{info: info, symlink: info.Mode()&fs.ModeSymlink != 0}
+		if le.symlink {
+			// Describe what the link points at; a dangling link stays a file
+			if target, err := os.Stat(filepath.Join(fullPath, e.Name())); err == nil {
+				le.info = target
+			}
+		}
+		isDir := le.info.IsDir()
+		le.key = listKey{Dir: isDir, Name: e.Name(), ModTime: le.info.ModTime().UnixNano()}
+		if isDir {
+			// Recursive size from the usage tracker, not the inode's 4 KiB
+			le.key.Size = s.Usage.Folder(s.Usage.rel(filepath.Join(fullPath, e.Name())))
+		} else {
+			le.key.Size = le.info.Size()
+			le.key.MIME = MIMEType(e.Name())
+		}
+		entries = append(entries, le)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return compareListKeys(entries[i].key, entries[j].key, q.Sort, q.Desc) < 0
+	})
+
+	start := 0
+	if q.After != nil {
+		start = sort.Search(len(entries), func(i int) bool {
+			return compareListKeys(entries[i].key, *q.After, q.Sort, q.Desc) > 0
+		})
+	}
+	end := min(start+q.Limit, len(entries))
+
+	resp := FilesResponse{Files: make([]FileItem, 0, end-start), Total: len(entries)}
+	for _, e := range entries[start:end] {
+		resp.Files = append(resp.Files, s.fileItem(fullPath, e))
+	}
+	if end < len(entries) {
+		resp.NextCursor = encodeListCursor(listCursor{Sort: q.Sort, Desc: q.Desc, Key: entries[end-1].key})
+	}
+	return resp, nil
+}
+
+func (s *Cloud) fileItem(dir string, e listEntry) FileItem {
+	full := filepath.Join(dir, e.key.Name)
+	item := FileItem{
+		Name:        e.key.Name,
+		Size:        humanize.Bytes(e.key.Size),
+		Bytes:       e.key.Size,
+		Type:        "file",
+		MIME:        e.key.MIME,
+		ModifiedAt:  e.info.ModTime().Format(time.RFC3339),
+		Permissions: fmt.Sprintf("%04o", e.info.Mode().Perm()),
+		IsSymlink:   e.symlink,
+		IsHidden:    strings.HasPrefix(e.key.Name, "."),
+	}
+	if e.key.Dir {
+		item.Type = "folder"
+		if n, err := countChildren(full); err == nil {
+			item.Children = &n
+		}
+		return item
+	}
+	if !e.symlink {
+		item.SHA256 = s.digests.get(full, e.info)
+	}
+	return item
+}
+
+// countChildren counts a folder's entries without stat-ing any of them.
+func countChildren(dir string) (int, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	names, err := f.Readdirnames(-1)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, name := range names {
+		if !fsx.IsTempName(name) {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// compareListKeys orders folders before files, then by the requested field
+// and finally by name so that every entry has a unique position.
+func compareListKeys(a, b listKey, by string, desc bool) int {
+	if a.Dir != b.Dir {
+		if a.Dir {
+			return -1
+		}
+		return 1
+	}
+
+	c := 0
+	switch by {
+	case "size":
+		c = cmpInt(a.Size, b.Size)
+	case "mtime":
+		c = cmpInt(a.ModTime, b.ModTime)
+	case "type":
+		c = strings.Compare(a.MIME, b.MIME)
+	}
+	if c == 0 {
+		c = strings.Compare(strings.ToLower(a.Name), strings.ToLower(b.Name))
+	}
+	if c == 0 {
+		c = strings.Compare(a.Name, b.Name)
+	}
+	if desc {
+		return -c
+	}
+	return c
+}
+
+func cmpInt(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// listError maps a filesystem error to the response the client should see.
+func listError(err error) error {
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return errs.E(OpListFiles, errs.KindNotFound, err, "Folder not found")
+	case errors.Is(err, fs.ErrPermission):
+		return errs.E(OpListFiles, errs.KindForbidden, err, "Permission denied")
+	default:
+		return errs.E(OpListFiles, errs.KindIO, err, "Could not read folder")
+	}
+}
+
+func parseListQuery(v url.Values) (listQuery, error) {
+	q := listQuery{
+		Path:  v.Get("path"),
+		Sort:  v.Get("sort"),
+		Desc:  v.Get("order") == "desc",
+		Limit: defaultListLimit,
+	}
+
+	switch q.Sort {
+	case "name":
+		q.Sort = ""
+	case "", "size", "mtime", "type":
+	default:
+		return q, errs.E(OpListFiles, errs.KindInvalid, fmt.Sprintf("unknown sort %q", q.Sort))
+	}
+
+	if raw := v.Get("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n <= 0 {
+			return q, errs.E(OpListFiles, errs.KindInvalid, "invalid limit")
+		}
+		q.Limit = min(n, maxListLimit)
+	}
+
+	if raw := v.Get("cursor"); raw != "" {
+		c, err := decodeListCursor(raw)
+		if err != nil {
+			return q, errs.E(OpListFiles, errs.KindInvalid, err, "invalid cursor")
+		}
+		if c.Sort != q.Sort || c.Desc != q.Desc {
+			return q, errs.E(OpListFiles, errs.KindInvalid, "cursor was issued for a different sort order")
+		}
+		q.After = &c.Key
+	}
+
+	return q, nil
+}
+
+func encodeListCursor(c listCursor) string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeListCursor(raw string) (listCursor, error) {
+	var c listCursor
+	data, err := base64.RawURLEncoding.DecodeString(raw)
+	if err != nil {
+		return c, err
+	}
+	err = json.Unmarshal(data, &c)
+	return c, err
+}
@@ -0,0 +1,165 @@
+package cloud
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/fsx"
+)
+
+func listFiles(t *testing.T, c *Cloud, query string) (int, FilesResponse) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	c.handleFiles(w, httptest.NewRequest(http.MethodGet, "/api/files?"+query, nil))
+	var resp FilesResponse
+	if w.Code == http.StatusOK {
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return w.Code, resp
+}
+
+func TestListFiles(t *testing.T) {
+	c := newTestCloud(t)
+	now := time.Now()
+	files := []struct {
+		name string
+		size int
+		age  time.Duration
+	}{
+		{"b.txt", 30, 3 * time.Hour},
+		{"A.jpg", 10, 1 * time.Hour},
+		{"c.mp4", 20, 2 * time.Hour},
+		{".hidden", 5, 4 * time.Hour},
+	}
+	for _, f := range files {
+		p := filepath.Join(c.DataDir, f.name)
+		os.WriteFile(p, make([]byte, f.size), 0644)
+		os.Chtimes(p, now.Add(-f.age), now.Add(-f.age))
+		c.NotifyChanged(p)
+	}
+	os.MkdirAll(filepath.Join(c.DataDir, "zdir", "sub"), 0755)
+	os.WriteFile(filepath.Join(c.DataDir, "zdir", "x.bin"), make([]byte, 7), 0600)
+	c.NotifyChanged(filepath.Join(c.DataDir, "zdir", "x.bin"))
+	os.WriteFile(filepath.Join(c.DataDir, fsx.TempPrefix+"partial"), nil, 0644)
+	os.Symlink("b.txt", filepath.Join(c.DataDir, "link.txt"))
+	os.WriteFile(filepath.Join(c.DataDir, "plain.txt"), nil, 0644)
+
+	tests := []struct {
+		name     string
+		query    string
+		wantCode int
+		want     []string
+	}{
+		{"default name order, folders first", "path=/", http.StatusOK,
+			[]string{"zdir", ".hidden", "A.jpg", "b.txt", "c.mp4", "link.txt", "plain.txt"}},
+		{"size descending", "path=/&sort=size&order=desc", http.StatusOK,
+			[]string{"zdir", "link.txt", "b.txt", "c.mp4", "A.jpg", ".hidden", "plain.txt"}},
+		{"type", "path=/&sort=type", http.StatusOK,
+			[]string{"zdir", ".hidden", "A.jpg", "b.txt", "link.txt", "plain.txt", "c.mp4"}},
+		{"unknown sort", "path=/&sort=color", http.StatusBadRequest, nil},
+		{"bad limit", "path=/&limit=-1", http.StatusBadRequest, nil},
+		{"bad cursor", "path=/&cursor=!!!", http.StatusBadRequest, nil},
+		{"missing folder", "path=/nope", http.StatusNotFound, nil},
+		{"file instead of folder", "path=/b.txt", http.StatusBadRequest, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, resp := listFiles(t, c, tt.query)
+			if code != tt.wantCode {
+				t.Fatalf("status = %d, want %d", code, tt.wantCode)
+			}
+			if tt.want == nil {
+				return
+			}
+			var got []string
+			for _, f := range resp.Files {
+				got = append(got, f.Name)
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("order = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("metadata", func(t *testing.T) {
+		_, resp := listFiles(t, c, "path=/")
+		byName := map[string]FileItem{}
+		for _, f := range resp.Files {
+			byName[f.Name] = f
+		}
+		if f := byName["A.jpg"]; f.Bytes != 10 || f.MIME != "image/jpeg" || f.Permissions != "0644" || f.IsHidden {
+			t.Errorf("A.jpg = %+v", f)
+		}
+		if f := byName["zdir"]; f.Type != "folder" || f.Children == nil || *f.Children != 2 || f.Bytes != 7 {
+			t.Errorf("zdir = %+v", f)
+		}
+		if !byName[".hidden"].IsHidden || !byName["link.txt"].IsSymlink {
+			t.Errorf("flags not set: %+v %+v", byName[".hidden"], byName["link.txt"])
+		}
+		if resp.Total != 7 {
+			t.Errorf("total = %d, want 7", resp.Total)
+		}
+	})
+
+	t.Run("unreadable folder", func(t *testing.T) {
+		if os.Geteuid() == 0 {
+			t.Skip("permissions are not enforced for root")
+		}
+		locked := filepath.Join(c.DataDir, "zdir", "sub")
+		os.Chmod(locked, 0)
+		defer os.Chmod(locked, 0755)
+		if code, _ := listFiles(t, c, "path=/zdir/sub"); code != http.StatusForbidden {
+			t.Errorf("status = %d, want 403", code)
+		}
+	})
+}
+
+func TestListFilesPagination(t *testing.T) {
+	c := newTestCloud(t)
+	for i := range 25 {
+		os.WriteFile(filepath.Join(c.DataDir, fmt.Sprintf("f%02d.txt", i)), nil, 0644)
+	}
+
+	var seen []string
+	cursor := ""
+	for pages := 0; ; pages++ {
+		if pages > 10 {
+			t.Fatal("pagination did not terminate")
+		}
+		code, resp := listFiles(t, c, "path=/&sort=name&order=desc&limit=10&cursor="+url.QueryEscape(cursor))
+		if code != http.StatusOK {
+			t.Fatalf("status = %d", code)
+		}
+		for _, f := range resp.Files {
+			seen = append(seen, f.Name)
+		}
+		if pages == 0 {
+			// A file appearing between pages must not shift what comes next
+			os.WriteFile(filepath.Join(c.DataDir, "f99.txt"), nil, 0644)
+		}
+		if resp.NextCursor == "" {
+			break
+		}
+		cursor = resp.NextCursor
+	}
+
+	if len(seen) != 25 || seen[0] != "f24.txt" || seen[24] != "f00.txt" {
+		t.Fatalf("seen %d entries: %v", len(seen), seen)
+	}
+
+	code, _ := listFiles(t, c, "path=/&sort=size&limit=10&cursor="+url.QueryEscape(cursor))
+	if code != http.StatusBadRequest {
+		t.Errorf("cursor reused with another sort: status = %d, want 400", code)
+	}
+}
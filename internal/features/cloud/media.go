@@ -0,0 +1,754 @@
+package cloud
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"image"
+	"io/fs"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/errs"
+	"github.com/strct-org/strct-agent/internal/exif"
+	"github.com/strct-org/strct-agent/internal/fsx"
+)
+
+const (
+	OpMediaSave  errs.Op = "cloud.Media.save"
+	OpMediaQuery errs.Op = "cloud.handleMedia"
+)
+
+const (
+	defaultMediaLimit = 100
+	maxMediaLimit     = 1000
+)
+
+// MediaItem is what the library knows about one photo or video. Path is
+// relative to DataDir with forward slashes, like IndexEntry.Path.
+type MediaItem struct {
+	Path     string    `json:"path"`
+	Name     string    `json:"name"`
+	Kind     string    `json:"kind"` // CategoryImage or CategoryVideo
+	MIME     string    `json:"mime"`
+	Size     int64     `json:"size"`
+	ModTime  time.Time `json:"modifiedAt"`
+	TakenAt  time.Time `json:"takenAt"`
+	Dated    bool      `json:"dated"` // TakenAt came from metadata, not the file's mtime
+	Make     string    `json:"make,omitempty"`
+	Model    string    `json:"model,omitempty"`
+	Width    int       `json:"width,omitempty"`
+	Height   int       `json:"height,omitempty"`
+	Rotation int       `json:"orientation,omitempty"` // EXIF orientation 1-8
+	Duration float64   `json:"duration,omitempty"`    // seconds, videos only
+	GPS      *exif.GPS `json:"gps,omitempty"`
+}
+
+// Camera is "Make Model" without the make repeated, which most vendors do.
+func (m MediaItem) Camera() string {
+	if m.Make == "" || strings.HasPrefix(strings.ToLower(m.Model), strings.ToLower(m.Make)) {
+		return m.Model
+	}
+	return strings.TrimSpace(m.Make + " " + m.Model)
+}
+
+// Media indexes capture metadata for every photo and video below Root.
+// The Walker's scans only compare size and mtime against what is already
+// indexed; files that are new or changed are queued and read one at a time,
+// with a pause after each, so indexing a large library never competes with
+// uploads. The index and the queue are saved as it goes and pick up where
+// they left off on restart.
+type Media struct {
+	Root      string
+	StatePath string
+
+	// Process pauses for Throttle after every file and saves after every
+	// BatchSize of them.
+	BatchSize int
+	Throttle  time.Duration
+
+	// Offline reports whether fullPath is on storage that is not mounted
+	// right now; indexing waits for it to come back.
+	Offline func(fullPath string) bool
+
+	mu      sync.RWMutex
+	items   map[string]MediaItem
+	pending map[string]bool
+	dirty   bool
+	wake    chan struct{}
+}
+
+func NewMedia(root, statePath string) *Media {
+	return &Media{
+		Root:      root,
+		StatePath: statePath,
+		BatchSize: 200,
+		Throttle:  100 * time.Millisecond,
+		items:     make(map[string]MediaItem),
+		pending:   make(map[string]bool),
+		wake:      make(chan struct{}, 1),
+	}
+}
+
+// Start loads the saved library and indexes queued files as they come in.
+// The Walker keeps it in step with the drive.
+func (m *Media) Start() error {
+	if err := m.load(); err != nil {
+		log.Printf("[MEDIA] Could not load saved library, rebuilding: %v", err)
+	}
+
+	go func() {
+		ctx := context.Background()
+		flush := time.NewTicker(time.Minute)
+		defer flush.Stop()
+		for {
+			m.Process(ctx)
+			select {
+			case <-m.wake:
+			case <-flush.C:
+				if err := m.save(); err != nil {
+					log.Printf("[MEDIA] %v", err)
+				}
+			}
+		}
+	}()
+
+	return nil
+}
+
+// visit queues media that is new or changed since it was indexed. Nothing
+// is opened here.
+func (m *Media) visit(rel, full string, info fs.FileInfo) {
+	if info.Mode().IsRegular() && isMedia(info.Name()) {
+		m.queueIfChanged(rel, info)
+	}
+}
+
+// reconcile forgets media that is gone.
+func (m *Media) reconcile(seen *walked) {
+	m.mu.Lock()
+	for rel := range m.items {
+		if !seen.has(rel) {
+			delete(m.items, rel)
+			m.dirty = true
+		}
+	}
+	for rel := range m.pending {
+		if !seen.has(rel) {
+			delete(m.pending, rel)
+			m.dirty = true
+		}
+	}
+	n := len(m.pending)
+	m.mu.Unlock()
+
+	if n > 0 {
+		log.Printf("[MEDIA] %d files to index", n)
+	}
+	m.signal()
+}
+
+// Update queues a path (and any media below it if it is a folder).
+func (m *Media) Update(fullPath string) {
+	info, err := os.Stat(fullPath)
+	if err != nil {
+		m.Remove(fullPath)
+		return
+	}
+
+	if !info.IsDir() {
+		if isMedia(info.Name()) {
+			m.queueIfChanged(m.rel(fullPath), info)
+			m.signal()
+		}
+		return
+	}
+
+	filepath.WalkDir(fullPath, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() || !isMedia(d.Name()) {
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			m.queueIfChanged(m.rel(p), info)
+		}
+		return nil
+	})
+	m.signal()
+}
+
+// Remove drops a path and everything below it.
+func (m *Media) Remove(fullPath string) {
+	rel := m.rel(fullPath)
+	prefix := rel + "/"
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for p := range m.items {
+		if p == rel || strings.HasPrefix(p, prefix) {
+			delete(m.items, p)
+			m.dirty = true
+		}
+	}
+	for p := range m.pending {
+		if p == rel || strings.HasPrefix(p, prefix) {
+			delete(m.pending, p)
+			m.dirty = true
+		}
+	}
+}
+
+// Pending is the number of files waiting to be indexed.
+func (m *Media) Pending() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return len(m.pending)
+}
+
+// Process indexes queued files until the queue is empty or ctx is done.
+func (m *Media) Process(ctx context.Context) {
+	indexed := 0
+	for ctx.Err() == nil && !m.offline(m.Root) {
+		rel, ok := m.next()
+		if !ok {
+			break
+		}
+
+		item, err := m.extract(rel)
+		m.mu.Lock()
+		// Removed while we were reading it
+		if m.pending[rel] && err == nil {
+			m.items[rel] = item
+		}
+		delete(m.pending, rel)
+		m.dirty = true
+		m.mu.Unlock()
+		if err != nil {
+			log.Printf("[MEDIA] %s: %v", rel, err)
+		}
+
+		// Save progress regularly so a restart does not start over
+		if indexed++; m.BatchSize > 0 && indexed%m.BatchSize == 0 {
+			if err := m.save(); err != nil {
+				log.Printf("[MEDIA] %v", err)
+			}
+		}
+		if m.Throttle > 0 {
+			select {
+			case <-ctx.Done():
+			case <-time.After(m.Throttle):
+			}
+		}
+	}
+	if indexed > 0 {
+		if err := m.save(); err != nil {
+			log.Printf("[MEDIA] %v", err)
+		}
+	}
+}
+
+func (m *Media) next() (string, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for rel := range m.pending {
+		return rel, true
+	}
+	return "", false
+}
+
+func (m *Media) queueIfChanged(rel string, info fs.FileInfo) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if old, ok := m.items[rel]; ok && old.Size == info.Size() && old.ModTime.Equal(info.ModTime()) {
+		return
+	}
+	if !m.pending[rel] {
+		m.pending[rel] = true
+		m.dirty = true
+	}
+}
+
+func (m *Media) signal() {
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+}
+
+// extract reads the metadata of one file. Files without any still get an
+// item, dated by their mtime, so they show up in the timeline.
+func (m *Media) extract(rel string) (MediaItem, error) {
+	full := filepath.Join(m.Root, filepath.FromSlash(rel))
+	f, err := os.Open(full)
+	if err != nil {
+		return MediaItem{}, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return MediaItem{}, err
+	}
+
+	name := path.Base(rel)
+	item := MediaItem{
+		Path:    rel,
+		Name:    name,
+		Kind:    Category(name),
+		MIME:    MIMEType(name),
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+	}
+
+	meta := &exif.Data{}
+	switch item.MIME {
+	case "image/jpeg":
+		if d, err := exif.Decode(f); err == nil {
+			meta.Fill(d)
+		}
+	case "video/mp4", "video/quicktime", "video/x-m4v":
+		if d, err := exif.DecodeMP4(f, info.Size()); err == nil {
+			meta.Fill(d)
+		}
+	default:
+		if item.Kind == CategoryImage {
+			if cfg, _, err := image.DecodeConfig(f); err == nil {
+				meta.Width, meta.Height = cfg.Width, cfg.Height
+			}
+		}
+	}
+	// Sidecars fill in what the file itself lacks (RAW and HEIC mostly)
+	for _, sidecar := range []string{full + ".xmp", strings.TrimSuffix(full, filepath.Ext(full)) + ".xmp"} {
+		if sf, err := os.Open(sidecar); err == nil {
+			if d, err := exif.DecodeXMP(sf); err == nil {
+				meta.Fill(d)
+			}
+			sf.Close()
+			break
+		}
+	}
+
+	item.Make, item.Model = meta.Make, meta.Model
+	item.Width, item.Height, item.Rotation = meta.Width, meta.Height, meta.Orientation
+	item.Duration = meta.Duration.Seconds()
+	item.GPS = meta.GPS
+	item.TakenAt, item.Dated = meta.Taken, !meta.Taken.IsZero()
+	if !item.Dated {
+		item.TakenAt = info.ModTime()
+	}
+	return item, nil
+}
+
+func isMedia(name string) bool {
+	if fsx.IsTempName(name) {
+		return false
+	}
+	c := Category(name)
+	return c == CategoryImage || c == CategoryVideo
+}
+
+// MediaQuery filters the library. Zero values match everything.
+type MediaQuery struct {
+	From     time.Time
+	To       time.Time
+	Kind     string
+	Camera   string
+	Folder   string // relative, matches the folder and everything below it
+	Near     *exif.GPS
+	RadiusKm float64
+	BBox     *[4]float64 // minLat, minLon, maxLat, maxLon
+	Located  bool        // only items with a GPS position
+	Oldest   bool        // oldest first instead of newest first
+	Group    string      // day, month or year
+	Offset   int
+	Limit    int
+}
+
+func (q MediaQuery) matches(it MediaItem) bool {
+	if !q.From.IsZero() && it.TakenAt.Before(q.From) {
+		return false
+	}
+	if !q.To.IsZero() && !it.TakenAt.Before(q.To) {
+		return false
+	}
+	if q.Kind != "" && it.Kind != q.Kind {
+		return false
+	}
+	if q.Camera != "" && !strings.EqualFold(it.Camera(), q.Camera) {
+		return false
+	}
+	if q.Folder != "" && !strings.HasPrefix(it.Path, q.Folder+"/") {
+		return false
+	}
+	if (q.Located || q.Near != nil || q.BBox != nil) && it.GPS == nil {
+		return false
+	}
+	if q.Near != nil && distanceKm(*q.Near, *it.GPS) > q.RadiusKm {
+		return false
+	}
+	if b := q.BBox; b != nil {
+		if it.GPS.Lat < b[0] || it.GPS.Lat > b[2] {
+			return false
+		}
+		// A box crossing the antimeridian has minLon > maxLon
+		if b[1] <= b[3] && (it.GPS.Lon < b[1] || it.GPS.Lon > b[3]) {
+			return false
+		}
+		if b[1] > b[3] && it.GPS.Lon < b[1] && it.GPS.Lon > b[3] {
+			return false
+		}
+	}
+	return true
+}
+
+// groupKey buckets a capture time for the timeline scrubber. Capture times
+// are kept in the zone the camera recorded, so a photo taken at 23:30 on
+// holiday stays on that day.
+func (q MediaQuery) groupKey(t time.Time) string {
+	switch q.Group {
+	case "year":
+		return t.Format("2006")
+	case "month":
+		return t.Format("2006-01")
+	}
+	return t.Format(time.DateOnly)
+}
+
+type TimelineGroup struct {
+	Key   string `json:"key"`
+	Count int    `json:"count"`
+}
+
+type TimelineResponse struct {
+	Items   []MediaItem     `json:"items"`
+	Groups  []TimelineGroup `json:"groups"` // every group in the filtered set, not just this page
+	Total   int             `json:"total"`
+	Offset  int             `json:"offset"`
+	Limit   int             `json:"limit"`
+	Pending int             `json:"pending"` // files still waiting to be indexed
+}
+
+type Album struct {
+	Key   string    `json:"key"`
+	Title string    `json:"title"`
+	Count int       `json:"count"`
+	Cover string    `json:"cover"` // path of the newest item
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+type AlbumsResponse struct {
+	By      string  `json:"by"`
+	Albums  []Album `json:"albums"`
+	Pending int     `json:"pending"`
+}
+
+// filter returns the matching items, newest first unless q asks otherwise.
+func (m *Media) filter(q MediaQuery) []MediaItem {
+	m.mu.RLock()
+	list := make([]MediaItem, 0, len(m.items))
+	for _, it := range m.items {
+		if q.matches(it) {
+			list = append(list, it)
+		}
+	}
+	m.mu.RUnlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		a, b := list[i], list[j]
+		if !a.TakenAt.Equal(b.TakenAt) {
+			return a.TakenAt.After(b.TakenAt) != q.Oldest
+		}
+		return a.Path < b.Path
+	})
+	return list
+}
+
+// Timeline returns one page of matching items in capture order, plus a
+// count per day (or month/year) over the whole result.
+func (m *Media) Timeline(q MediaQuery) TimelineResponse {
+	list := m.filter(q)
+
+	resp := TimelineResponse{Total: len(list), Offset: q.Offset, Limit: q.Limit, Items: []MediaItem{}, Groups: []TimelineGroup{}, Pending: m.Pending()}
+	for _, it := range list {
+		key := q.groupKey(it.TakenAt)
+		if n := len(resp.Groups); n > 0 && resp.Groups[n-1].Key == key {
+			resp.Groups[n-1].Count++
+			continue
+		}
+		resp.Groups = append(resp.Groups, TimelineGroup{Key: key, Count: 1})
+	}
+
+	if q.Offset < len(list) {
+		resp.Items = list[q.Offset:min(q.Offset+q.Limit, len(list))]
+	}
+	return resp
+}
+
+// Albums groups matching items by folder, month, year or camera. Albums are
+// ordered by their newest item.
+func (m *Media) Albums(by string, q MediaQuery) AlbumsResponse {
+	resp := AlbumsResponse{By: by, Albums: []Album{}, Pending: m.Pending()}
+	byKey := make(map[string]int)
+
+	q.Oldest = false
+	for _, it := range m.filter(q) {
+		var key, title string
+		switch by {
+		case "month":
+			key, title = it.TakenAt.Format("2006-01"), it.TakenAt.Format("January 2006")
+		case "year":
+			key = it.TakenAt.Format("2006")
+			title = key
+		case "camera":
+			key = it.Camera()
+			title = key
+			if key == "" {
+				title = "Unknown camera"
+			}
+		default:
+			key = path.Dir(it.Path)
+			if key == "." {
+				key = ""
+			}
+			title = path.Base(key)
+			if key == "" {
+				title = "Home"
+			}
+		}
+
+		i, ok := byKey[key]
+		if !ok {
+			// Items arrive newest first, so the first one is the cover
+			i = len(resp.Albums)
+			byKey[key] = i
+			resp.Albums = append(resp.Albums, Album{Key: key, Title: title, Cover: it.Path, End: it.TakenAt})
+		}
+		resp.Albums[i].Count++
+		resp.Albums[i].Start = it.TakenAt
+	}
+	return resp
+}
+
+// distanceKm is the great-circle distance between two positions.
+func distanceKm(a, b exif.GPS) float64 {
+	const earthRadiusKm = 6371
+	toRad := func(d float64) float64 { return d * math.Pi / 180 }
+
+	dLat := toRad(b.Lat - a.Lat)
+	dLon := toRad(b.Lon - a.Lon)
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(toRad(a.Lat))*math.Cos(toRad(b.Lat))*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadiusKm * math.Asin(math.Sqrt(min(h, 1)))
+}
+
+func (m *Media) offline(fullPath string) bool {
+	return m.Offline != nil && m.Offline(fullPath)
+}
+
+func (m *Media) rel(fullPath string) string {
+	rel, err := filepath.Rel(m.Root, fullPath)
+	if err != nil || rel == "." {
+		return ""
+	}
+	return filepath.ToSlash(rel)
+}
+
+// mediaState is what is saved of the library: the indexed items and the
+// files still waiting to be read.
+type mediaState struct {
+	Items   []MediaItem `json:"items"`
+	Pending []string    `json:"pending,omitempty"`
+}
+
+func (m *Media) load() error {
+	data, err := os.ReadFile(m.StatePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	var state mediaState
+	if len(data) > 0 && data[0] == '[' {
+		// Saved before the queue was
+		err = json.Unmarshal(data, &state.Items)
+	} else {
+		err = json.Unmarshal(data, &state)
+	}
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.items = make(map[string]MediaItem, len(state.Items))
+	for _, it := range state.Items {
+		m.items[it.Path] = it
+	}
+	for _, rel := range state.Pending {
+		m.pending[rel] = true
+	}
+	m.dirty = false
+	return nil
+}
+
+func (m *Media) save() error {
+	m.mu.Lock()
+	if !m.dirty {
+		m.mu.Unlock()
+		return nil
+	}
+	state := mediaState{Items: make([]MediaItem, 0, len(m.items))}
+	for _, it := range m.items {
+		state.Items = append(state.Items, it)
+	}
+	for rel := range m.pending {
+		state.Pending = append(state.Pending, rel)
+	}
+	m.dirty = false
+	m.mu.Unlock()
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return errs.E(OpMediaSave, errs.KindIO, err)
+	}
+	if err := writeFileAtomic(m.StatePath, data); err != nil {
+		return errs.E(OpMediaSave, errs.KindIO, err)
+	}
+	return nil
+}
+
+func (s *Cloud) handleTimeline(w http.ResponseWriter, r *http.Request) {
+	q, err := parseMediaQuery(r.URL.Query())
+	if err != nil {
+		errs.HTTPResponse(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.Media.Timeline(q))
+}
+
+func (s *Cloud) handleAlbums(w http.ResponseWriter, r *http.Request) {
+	q, err := parseMediaQuery(r.URL.Query())
+	if err != nil {
+		errs.HTTPResponse(w, err)
+		return
+	}
+	by := r.URL.Query().Get("by")
+	switch by {
+	case "":
+		by = "folder"
+	case "folder", "month", "year", "camera":
+	default:
+		errs.HTTPResponse(w, errs.E(OpMediaQuery, errs.KindInvalid, fmt.Sprintf("unknown grouping %q", by)))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.Media.Albums(by, q))
+}
+
+func parseMediaQuery(v url.Values) (MediaQuery, error) {
+	q := MediaQuery{
+		Camera:  strings.TrimSpace(v.Get("camera")),
+		Oldest:  v.Get("order") == "asc",
+		Group:   v.Get("group"),
+		Located: v.Get("located") == "true",
+		Limit:   defaultMediaLimit,
+	}
+	q.Folder = strings.Trim(path.Clean("/"+v.Get("folder")), "/")
+
+	switch t := v.Get("type"); t {
+	case "":
+	case "image", "images", "photo", "photos":
+		q.Kind = CategoryImage
+	case "video", "videos":
+		q.Kind = CategoryVideo
+	default:
+		return q, errs.E(OpMediaQuery, errs.KindInvalid, fmt.Sprintf("unknown type %q", t))
+	}
+	switch q.Group {
+	case "", "day", "month", "year":
+	default:
+		return q, errs.E(OpMediaQuery, errs.KindInvalid, fmt.Sprintf("unknown group %q", q.Group))
+	}
+
+	var err error
+	if q.From, err = parseDateParam(v.Get("from")); err != nil {
+		return q, errs.E(OpMediaQuery, errs.KindInvalid, "invalid 'from' date", err)
+	}
+	if q.To, err = parseDateParam(v.Get("to")); err != nil {
+		return q, errs.E(OpMediaQuery, errs.KindInvalid, "invalid 'to' date", err)
+	}
+	// A bare date for 'to' means up to the end of that day
+	if raw := v.Get("to"); raw != "" && len(raw) == len(time.DateOnly) {
+		q.To = q.To.AddDate(0, 0, 1)
+	}
+
+	if raw := v.Get("near"); raw != "" {
+		vals, err := parseFloats(raw, 2)
+		if err != nil {
+			return q, errs.E(OpMediaQuery, errs.KindInvalid, "near must be lat,lon", err)
+		}
+		q.Near = &exif.GPS{Lat: vals[0], Lon: vals[1]}
+		q.RadiusKm = 10
+		if raw := v.Get("radius"); raw != "" {
+			if q.RadiusKm, err = strconv.ParseFloat(raw, 64); err != nil || !(q.RadiusKm > 0) || math.IsInf(q.RadiusKm, 0) {
+				return q, errs.E(OpMediaQuery, errs.KindInvalid, "invalid radius")
+			}
+		}
+	}
+	if raw := v.Get("bbox"); raw != "" {
+		vals, err := parseFloats(raw, 4)
+		if err != nil {
+			return q, errs.E(OpMediaQuery, errs.KindInvalid, "bbox must be minLat,minLon,maxLat,maxLon", err)
+		}
+		q.BBox = &[4]float64{vals[0], vals[1], vals[2], vals[3]}
+	}
+
+	if raw := v.Get("offset"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 0 {
+			return q, errs.E(OpMediaQuery, errs.KindInvalid, "invalid offset")
+		}
+		q.Offset = n
+	}
+	if raw := v.Get("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n <= 0 {
+			return q, errs.E(OpMediaQuery, errs.KindInvalid, "invalid limit")
+		}
+		q.Limit = min(n, maxMediaLimit)
+	}
+
+	return q, nil
+}
+
+func parseFloats(raw string, n int) ([]float64, error) {
+	parts := strings.Split(raw, ",")
+	if len(parts) != n {
+		return nil, fmt.Errorf("want %d numbers, got %d", n, len(parts))
+	}
+	out := make([]float64, n)
+	for i, p := range parts {
+		f, err := strconv.ParseFloat(strings.TrimSpace(p), 64)
+		if err != nil {
+			return nil, err
+		}
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			return nil, fmt.Errorf("%q is not a number", p)
+		}
+		out[i] = f
+	}
+	return out, nil
+}
@@ -0,0 +1,165 @@
+package cloud
+
+import (
+	"context"
+	"encoding/json"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMediaLibrary(t *testing.T) {
+	c := newTestCloud(t)
+	c.Media.Throttle = 0
+
+	write := func(rel string, data []byte, mtime time.Time) {
+		p := filepath.Join(c.DataDir, filepath.FromSlash(rel))
+		os.MkdirAll(filepath.Dir(p), 0755)
+		os.WriteFile(p, data, 0644)
+		os.Chtimes(p, mtime, mtime)
+	}
+	sidecar := func(taken, lat, lon string) []byte {
+		return []byte(`<rdf:Description tiff:Make="Apple" tiff:Model="iPhone 15" exif:DateTimeOriginal="` + taken +
+			`" exif:GPSLatitude="` + lat + `" exif:GPSLongitude="` + lon + `"/>`)
+	}
+	var pngData strings.Builder
+	png.Encode(&pngData, image.NewGray(image.Rect(0, 0, 4, 3)))
+
+	old := time.Date(2022, 1, 1, 12, 0, 0, 0, time.UTC)
+	write("Trip/a.jpg", []byte{0xFF, 0xD8, 0xFF, 0xDA}, time.Now())
+	write("Trip/a.xmp", sidecar("2023-07-14T10:00:00Z", "52,22.056N", "4,53.916E"), time.Now()) // Amsterdam
+	write("Trip/b.jpg", []byte{0xFF, 0xD8, 0xFF, 0xDA}, time.Now())
+	write("Trip/b.jpg.xmp", sidecar("2023-07-15T18:00:00Z", "48,51.396N", "2,21.132E"), time.Now()) // Paris
+	write("Home/c.png", []byte(pngData.String()), old)
+	write("notes.txt", []byte("not media"), time.Now())
+
+	if _, err := c.Walker.Scan(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n := c.Media.Pending(); n != 3 {
+		t.Fatalf("pending = %d, want 3", n)
+	}
+	c.Media.Process(context.Background())
+
+	timeline := func(query string) (int, TimelineResponse) {
+		w := httptest.NewRecorder()
+		c.handleTimeline(w, httptest.NewRequest(http.MethodGet, "/api/media/timeline?"+query, nil))
+		var resp TimelineResponse
+		json.NewDecoder(w.Body).Decode(&resp)
+		return w.Code, resp
+	}
+
+	tests := []struct {
+		name     string
+		query    string
+		wantCode int
+		want     []string
+	}{
+		{"newest first", "", http.StatusOK, []string{"Trip/b.jpg", "Trip/a.jpg", "Home/c.png"}},
+		{"oldest first", "order=asc", http.StatusOK, []string{"Home/c.png", "Trip/a.jpg", "Trip/b.jpg"}},
+		{"date range includes the whole 'to' day", "from=2023-07-01&to=2023-07-14", http.StatusOK, []string{"Trip/a.jpg"}},
+		{"near Paris", "near=48.8566,2.3522&radius=25", http.StatusOK, []string{"Trip/b.jpg"}},
+		{"bounding box over the Netherlands", "bbox=50.7,3.3,53.6,7.2", http.StatusOK, []string{"Trip/a.jpg"}},
+		{"only located", "located=true", http.StatusOK, []string{"Trip/b.jpg", "Trip/a.jpg"}},
+		{"camera", "camera=apple%20iphone%2015", http.StatusOK, []string{"Trip/b.jpg", "Trip/a.jpg"}},
+		{"folder", "folder=/Home", http.StatusOK, []string{"Home/c.png"}},
+		{"videos", "type=video", http.StatusOK, nil},
+		{"paged", "limit=1&offset=1", http.StatusOK, []string{"Trip/a.jpg"}},
+		{"bad near", "near=48.8", http.StatusBadRequest, nil},
+		{"near NaN", "near=NaN,2.35", http.StatusBadRequest, nil},
+		{"bbox to infinity", "bbox=50.7,3.3,Inf,7.2", http.StatusBadRequest, nil},
+		{"infinite radius", "near=48.8566,2.3522&radius=+Inf", http.StatusBadRequest, nil},
+		{"bad type", "type=pdf", http.StatusBadRequest, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, resp := timeline(tt.query)
+			if code != tt.wantCode {
+				t.Fatalf("status = %d, want %d", code, tt.wantCode)
+			}
+			if code != http.StatusOK {
+				return
+			}
+			var got []string
+			for _, it := range resp.Items {
+				got = append(got, it.Path)
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("items = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("metadata", func(t *testing.T) {
+		_, resp := timeline("")
+		if len(resp.Groups) != 3 || resp.Groups[0].Key != "2023-07-15" {
+			t.Errorf("groups = %+v", resp.Groups)
+		}
+		b, c := resp.Items[0], resp.Items[2]
+		if !b.Dated || b.Camera() != "Apple iPhone 15" || b.GPS == nil {
+			t.Errorf("b.jpg = %+v", b)
+		}
+		if c.Dated || !c.TakenAt.Equal(old) || c.Width != 4 || c.Height != 3 {
+			t.Errorf("c.png = %+v", c)
+		}
+	})
+
+	t.Run("albums", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		c.handleAlbums(w, httptest.NewRequest(http.MethodGet, "/api/media/albums?by=folder", nil))
+		var resp AlbumsResponse
+		json.NewDecoder(w.Body).Decode(&resp)
+		if len(resp.Albums) != 2 {
+			t.Fatalf("albums = %+v", resp.Albums)
+		}
+		trip := resp.Albums[0]
+		if trip.Key != "Trip" || trip.Count != 2 || trip.Cover != "Trip/b.jpg" || !trip.Start.Before(trip.End) {
+			t.Errorf("Trip album = %+v", trip)
+		}
+	})
+
+	t.Run("resumes after restart", func(t *testing.T) {
+		if err := c.Media.save(); err != nil {
+			t.Fatal(err)
+		}
+		restarted := NewMedia(c.DataDir, c.Media.StatePath)
+		if err := restarted.load(); err != nil {
+			t.Fatal(err)
+		}
+		os.Chtimes(filepath.Join(c.DataDir, "Home", "c.png"), time.Now(), time.Now())
+		if _, err := NewWalker(c.DataDir, restarted).Scan(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if n := restarted.Pending(); n != 1 {
+			t.Errorf("pending after restart = %d, want only the touched file", n)
+		}
+
+		// The queue is saved too, so it is not lost until the next walk
+		if err := restarted.save(); err != nil {
+			t.Fatal(err)
+		}
+		again := NewMedia(c.DataDir, c.Media.StatePath)
+		if err := again.load(); err != nil {
+			t.Fatal(err)
+		}
+		if n := again.Pending(); n != 1 {
+			t.Errorf("queue after restart = %d, want 1", n)
+		}
+	})
+
+	t.Run("removed", func(t *testing.T) {
+		p := filepath.Join(c.DataDir, "Trip")
+		os.RemoveAll(p)
+		c.NotifyRemoved(p)
+		if _, resp := timeline(""); resp.Total != 1 {
+			t.Errorf("total after delete = %d, want 1", resp.Total)
+		}
+	})
+}
@@ -0,0 +1,557 @@
+package cloud
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/errs"
+	"github.com/strct-org/strct-agent/internal/fsx"
+	"github.com/strct-org/strct-agent/internal/humanize"
+	"github.com/strct-org/strct-agent/internal/platform/disk"
+)
+
+const (
+	OpMigrate        errs.Op = "cloud.Migrate"
+	OpMigrateCleanup errs.Op = "cloud.CleanupMigration"
+	OpMigrationSave  errs.Op = "cloud.Migration.save"
+)
+
+// Migration stages.
+const (
+	MigrationOffered   = "offered"   // a drive is mounted; the files are still on the SD card
+	MigrationCopying   = "copying"   // copying and verifying, while storage stays on the SD card
+	MigrationSwitching = "switching" // requests are held while the last changes are copied
+	MigrationDone      = "done"
+	MigrationFailed    = "failed" // storage is still on the SD card; starting again resumes
+)
+
+// MigrationSwitchTimeout is how long the switch waits for transfers to
+// finish, and then how long it may take to bring over what changed since
+// the copy, before giving up and leaving storage on the SD card.
+var MigrationSwitchTimeout = 30 * time.Second
+
+// Migration moves the files on the SD card onto a drive that was added
+// later. Until it is done, storage stays on the SD card and the drive is
+// only mounted.
+type Migration struct {
+	Status      string     `json:"status"`
+	Source      string     `json:"source"` // the data folder on the SD card
+	Target      string     `json:"target"` // where the drive is mounted
+	Files       int        `json:"files"`
+	Copied      int        `json:"copied"` // files copied and verified, or already there
+	Bytes       int64      `json:"bytes"`
+	BytesCopied int64      `json:"bytesCopied"`
+	Progress    float64    `json:"progress"`
+	Free        uint64     `json:"free,omitempty"` // on the drive, when offered
+	Error       string     `json:"error,omitempty"`
+	StartedAt   *time.Time `json:"startedAt,omitempty"`
+	FinishedAt  *time.Time `json:"finishedAt,omitempty"`
+	// Leftover is the SD card's copy, moved aside by the switch and kept
+	// until it is cleaned up.
+	Leftover string `json:"leftover,omitempty"`
+}
+
+type migration struct {
+	mu     sync.Mutex
+	job    *Migration
+	loaded bool
+	drive  disk.Manager
+	cancel context.CancelFunc
+}
+
+func (s *Cloud) migrationPath() string { return filepath.Join(s.StateDir, "migration.json") }
+
+// currentMigration returns the migration, reading what the last one left behind the
+// first time. Must be called with mu held.
+func (s *Cloud) currentMigration() *Migration {
+	m := &s.migration
+	if !m.loaded {
+		m.loaded = true
+		if data, err := os.ReadFile(s.migrationPath()); err == nil {
+			var job Migration
+			if json.Unmarshal(data, &job) == nil {
+				// A copy that was running when the agent stopped is offered
+				// again at boot if the files are still on the SD card
+				if job.Status == MigrationDone && job.Leftover != "" {
+					m.job = &job
+				}
+			}
+		}
+	}
+	return m.job
+}
+
+// saveMigration must be called with mu held.
+func (s *Cloud) saveMigration() error {
+	data, err := json.Marshal(s.migration.job)
+	if err != nil {
+		return errs.E(OpMigrationSave, errs.KindIO, err)
+	}
+	if err := os.MkdirAll(s.StateDir, 0755); err != nil {
+		return errs.E(OpMigrationSave, errs.KindIO, err)
+	}
+	if err := fsx.WriteFile(s.migrationPath(), data, 0600); err != nil {
+		return errs.E(OpMigrationSave, errs.KindIO, err)
+	}
+	return nil
+}
+
+// holdsFiles reports whether there is a file anywhere under dir, leaving
+// out unfinished uploads.
+func holdsFiles(dir string) bool {
+	found := errors.New("found")
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || p == dir || fsx.IsTempName(d.Name()) {
+			return nil
+		}
+		if !d.IsDir() {
+			return found
+		}
+		return nil
+	})
+	return err == found
+}
+
+// offerMigration leaves storage on the SD card and offers to move it onto
+// d, which is mounted at mountPoint.
+func (s *Cloud) offerMigration(d disk.Manager, mountPoint string) {
+	s.migration.mu.Lock()
+	defer s.migration.mu.Unlock()
+	if job := s.currentMigration(); job != nil && (job.Status == MigrationCopying || job.Status == MigrationSwitching) {
+		return
+	}
+	free, _ := disk.GetFreeDiskSpace(mountPoint)
+	s.migration.job = &Migration{
+		Status: MigrationOffered,
+		Source: filepath.Clean(s.DataDir),
+		Target: filepath.Clean(mountPoint),
+		Free:   free,
+	}
+	s.migration.drive = d
+	log.Printf("[STORAGE] The SD card holds files; storage stays there until they are moved to the drive at %s", mountPoint)
+}
+
+// Migration returns the migration offered, running or last finished.
+func (s *Cloud) Migration() (Migration, bool) {
+	s.migration.mu.Lock()
+	defer s.migration.mu.Unlock()
+	job := s.currentMigration()
+	if job == nil {
+		return Migration{}, false
+	}
+	return *job, true
+}
+
+// StartMigration copies the files on the SD card onto the drive, checking
+// each against its SHA-256 as it lands, then switches storage over.
+func (s *Cloud) StartMigration() (Migration, error) {
+	s.migration.mu.Lock()
+	defer s.migration.mu.Unlock()
+	job := s.currentMigration()
+	switch {
+	case job != nil && job.Status == MigrationDone:
+		return Migration{}, errs.E(OpMigrate, errs.KindInvalid, "the files were moved to the drive already")
+	case job == nil || s.migration.drive == nil:
+		return Migration{}, errs.E(OpMigrate, errs.KindNotFound, "there is nothing to move off the SD card")
+	case job.Status != MigrationOffered && job.Status != MigrationFailed:
+		return Migration{}, errs.E(OpMigrate, errs.KindInvalid, "the files are "+job.Status)
+	}
+
+	files, size := s.measure(job.Source)
+	_, already := s.measure(job.Target)
+	free, err := disk.GetFreeDiskSpace(job.Target)
+	if err != nil {
+		return Migration{}, errs.E(OpMigrate, errs.KindSystem, err, "the drive is not mounted")
+	}
+	// What a failed attempt already copied is skipped rather than copied again
+	if need := size - already; need > 0 && uint64(need) > free {
+		return Migration{}, errs.E(OpMigrate, errs.KindQuota,
+			fmt.Sprintf("The drive has %s free; the SD card holds %s", humanize.Bytes(int64(free)), humanize.Bytes(size)))
+	}
+
+	now := time.Now().UTC()
+	*job = Migration{
+		Status:    MigrationCopying,
+		Source:    job.Source,
+		Target:    job.Target,
+		Files:     files,
+		Bytes:     size,
+		StartedAt: &now,
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	s.migration.cancel = cancel
+	go func() {
+		defer cancel()
+		s.migrate(ctx, job)
+	}()
+	log.Printf("[STORAGE] Moving %d files (%s) from %s to %s", files, humanize.Bytes(size), job.Source, job.Target)
+	return *job, nil
+}
+
+// CancelMigration stops a copy; storage stays on the SD card.
+func (s *Cloud) CancelMigration() error {
+	s.migration.mu.Lock()
+	defer s.migration.mu.Unlock()
+	job := s.currentMigration()
+	if job == nil || job.Status != MigrationCopying {
+		return errs.E(OpMigrate, errs.KindInvalid, "no copy is running")
+	}
+	s.migration.cancel()
+	return nil
+}
+
+func (s *Cloud) migrate(ctx context.Context, job *Migration) {
+	err := s.copyTree(ctx, job, job.Source, job.Target)
+	if err == nil {
+		err = s.switchTo(ctx, job)
+	}
+
+	s.migration.mu.Lock()
+	defer s.migration.mu.Unlock()
+	now := time.Now().UTC()
+	job.FinishedAt = &now
+	if err != nil {
+		job.Status = MigrationFailed
+		job.Error = err.Error()
+		log.Printf("[STORAGE] Moving the files off the SD card failed: %v", err)
+		return
+	}
+	job.Status = MigrationDone
+	job.Progress = 1
+	s.migration.drive = nil
+	if err := s.saveMigration(); err != nil {
+		log.Printf("[STORAGE] Could not record the migration: %v", err)
+	}
+	log.Printf("[STORAGE] Files moved to the drive; the SD card's copy is kept at %s", job.Leftover)
+}
+
+// switchTo holds requests while the files changed or deleted during the
+// copy are brought over, then puts the drive in place of the SD card's
+// folder. The folder is moved aside rather than removed, so nothing is lost
+// if the switch fails half way.
+func (s *Cloud) switchTo(ctx context.Context, job *Migration) error {
+	// Most of what changed during the copy is caught up before requests are
+	// held, so the pass behind the gate is short
+	if err := s.prune(ctx, job.Source, job.Target); err != nil {
+		return err
+	}
+	if err := s.copyTree(ctx, nil, job.Source, job.Target); err != nil {
+		return err
+	}
+
+	wait, cancel := context.WithTimeout(ctx, MigrationSwitchTimeout)
+	defer cancel()
+	if err := s.gate.close(wait); err != nil {
+		s.gate.open()
+		return fmt.Errorf("the SD card is busy; try again once transfers finish: %w", err)
+	}
+	defer s.gate.open()
+	s.migration.mu.Lock()
+	job.Status = MigrationSwitching
+	d := s.migration.drive
+	s.migration.mu.Unlock()
+
+	held, cancel := context.WithTimeout(ctx, MigrationSwitchTimeout)
+	defer cancel()
+	err := s.prune(held, job.Source, job.Target)
+	if err == nil {
+		err = s.copyTree(held, nil, job.Source, job.Target)
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("too much changed during the copy to switch in %s; try again: %w", MigrationSwitchTimeout, err)
+	}
+	if err != nil {
+		return err
+	}
+	s.Pool.Suspend()
+	defer s.Pool.Resume()
+
+	leftover := fmt.Sprintf("%s.sd-copy-%s", job.Source, time.Now().Format("20060102-150405"))
+	if err := os.Rename(job.Source, leftover); err != nil {
+		return err
+	}
+	if err := os.Mkdir(job.Source, 0755); err != nil {
+		os.Rename(leftover, job.Source)
+		return err
+	}
+	if err := s.adopt(d, job.Target); err != nil {
+		os.Remove(job.Source)
+		os.Rename(leftover, job.Source)
+		return err
+	}
+	s.migration.mu.Lock()
+	job.Leftover = leftover
+	s.migration.mu.Unlock()
+	return nil
+}
+
+// CleanupMigration deletes the SD card's copy of the files once they live
+// on the drive.
+func (s *Cloud) CleanupMigration() error {
+	s.migration.mu.Lock()
+	defer s.migration.mu.Unlock()
+	job := s.currentMigration()
+	if job == nil || job.Status != MigrationDone || job.Leftover == "" {
+		return errs.E(OpMigrateCleanup, errs.KindNotFound, "there is no copy left on the SD card")
+	}
+	if err := os.RemoveAll(job.Leftover); err != nil {
+		return errs.E(OpMigrateCleanup, errs.KindIO, err)
+	}
+	log.Printf("[STORAGE] Removed the SD card's copy at %s", job.Leftover)
+	job.Leftover = ""
+	return s.saveMigration()
+}
+
+// skipped reports whether p is left out of the migration: the pool's drives
+// are bound into the data folder but are not on the SD card.
+func (s *Cloud) skipped(p string, d fs.DirEntry) bool {
+	if fsx.IsTempName(d.Name()) {
+		return true
+	}
+	name, _ := s.Pool.On(p)
+	return name != "" && d.IsDir()
+}
+
+// measure counts the files and bytes under dir that a migration copies.
+func (s *Cloud) measure(dir string) (files int, size int64) {
+	filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || p == dir {
+			return nil
+		}
+		if s.skipped(p, d) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.Type().IsRegular() {
+			if info, err := d.Info(); err == nil {
+				files++
+				size += info.Size()
+			}
+		}
+		return nil
+	})
+	return files, size
+}
+
+// copyTree copies src into dst. A file already there with the same size and
+// modification time is taken as copied, so a second pass only brings over
+// what changed since the first. Files deleted from src in between are left
+// on dst until prune removes them. Progress is counted on job, if given.
+func (s *Cloud) copyTree(ctx context.Context, job *Migration, src, dst string) error {
+	return filepath.WalkDir(src, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if p != src && s.skipped(p, d) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		rel, _ := filepath.Rel(src, p)
+		target := filepath.Join(dst, rel)
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		switch {
+		case d.IsDir():
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+			return os.Chmod(target, info.Mode().Perm())
+		case d.Type()&fs.ModeSymlink != 0:
+			link, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			if existing, err := os.Readlink(target); err == nil && existing == link {
+				return nil
+			}
+			os.Remove(target)
+			return os.Symlink(link, target)
+		case !d.Type().IsRegular():
+			return nil
+		}
+
+		if have, err := os.Lstat(target); err != nil || have.Size() != info.Size() || !have.ModTime().Equal(info.ModTime()) {
+			if err := copyVerified(p, target, info); err != nil {
+				return fmt.Errorf("%s: %w", rel, err)
+			}
+		}
+		if job == nil {
+			return nil
+		}
+		s.migration.mu.Lock()
+		defer s.migration.mu.Unlock()
+		if job.Status == MigrationCopying {
+			job.Copied++
+			job.BytesCopied += info.Size()
+			if job.Bytes > 0 {
+				job.Progress = float64(job.BytesCopied) / float64(job.Bytes)
+			}
+		}
+		return nil
+	})
+}
+
+// prune removes what is on dst but no longer in src, or is there as a
+// different kind of file, so the drive ends up holding what the SD card
+// holds. The filesystem's lost+found is left alone.
+func (s *Cloud) prune(ctx context.Context, src, dst string) error {
+	return filepath.WalkDir(dst, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if p == dst || fsx.IsTempName(d.Name()) {
+			return nil
+		}
+		rel, _ := filepath.Rel(dst, p)
+		if rel == "lost+found" {
+			return filepath.SkipDir
+		}
+		orig, err := os.Lstat(filepath.Join(src, rel))
+		if err == nil && orig.Mode().Type() == d.Type() && !s.skipped(filepath.Join(src, rel), fs.FileInfoToDirEntry(orig)) {
+			return nil
+		}
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		if err := os.RemoveAll(p); err != nil {
+			return fmt.Errorf("%s: %w", rel, err)
+		}
+		if d.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+}
+
+// copyVerified copies a file through a temp file, reads what landed back
+// from the drive rather than from the page cache, and compares its SHA-256
+// with what was read from the SD card before putting it in place.
+func copyVerified(src, dst string, info fs.FileInfo) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := createAtomic(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Abort()
+		return err
+	}
+	if err := out.f.Sync(); err != nil {
+		out.Abort()
+		return err
+	}
+	// Once synced, the pages can be dropped so the hash below reads the
+	// drive and not the copy still in memory
+	if err := dropCache(out.f); err != nil {
+		out.Abort()
+		return err
+	}
+	written, err := hashFile(out.f.Name())
+	if err != nil {
+		out.Abort()
+		return err
+	}
+	if written != out.Sum() {
+		out.Abort()
+		return errDigestMismatch
+	}
+	if err := out.Commit(""); err != nil {
+		return err
+	}
+	os.Chmod(dst, info.Mode().Perm())
+	return os.Chtimes(dst, info.ModTime(), info.ModTime())
+}
+
+func hashFile(p string) (string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// handleMigration shows the migration (GET), starts it (POST) or stops a
+// copy (DELETE).
+func (s *Cloud) handleMigration(w http.ResponseWriter, r *http.Request) {
+	var (
+		job Migration
+		err error
+	)
+	code := http.StatusOK
+	switch r.Method {
+	case http.MethodGet:
+		var ok bool
+		if job, ok = s.Migration(); !ok {
+			err = errs.E(OpMigrate, errs.KindNotFound, "there is nothing to move off the SD card")
+		}
+	case http.MethodPost:
+		job, err = s.StartMigration()
+		code = http.StatusAccepted
+	case http.MethodDelete:
+		if err := s.CancelMigration(); err != nil {
+			errs.HTTPResponse(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		errs.HTTPResponse(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(job)
+}
+
+// handleMigrationCleanup deletes the SD card's copy after a migration.
+func (s *Cloud) handleMigrationCleanup(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := s.CleanupMigration(); err != nil {
+		errs.HTTPResponse(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
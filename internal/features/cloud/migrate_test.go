@@ -0,0 +1,171 @@
+package cloud
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/fsx"
+	"github.com/strct-org/strct-agent/internal/platform/disk"
+)
+
+func TestMigration(t *testing.T) {
+	c := newTestCloud(t)
+	f := &fakeDrives{attached: map[string]disk.Partition{}, bound: map[string]string{}}
+	c.Pool = newTestPool(t, c, f)
+	c.Bind = f.bind
+	f.plug("a1", disk.Partition{Device: "/dev/sdb1", FSType: "ext4"})
+	if _, err := c.Pool.Add("a1", "Archive"); err != nil {
+		t.Fatal(err)
+	}
+	routes := c.GetRoutes()
+	call := func(method, route string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		routes[route](w, httptest.NewRequest(method, route, nil))
+		return w
+	}
+
+	if w := call("POST", "/api/migration"); w.Code != http.StatusNotFound {
+		t.Errorf("migration with no drive: %d", w.Code)
+	}
+
+	old := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	files := map[string]string{
+		"Photos/a.jpg":       "jpeg",
+		"Documents/b.txt":    "some text",
+		"Documents/deep/c":   strings.Repeat("x", 100000),
+		".hidden":            "dot",
+		"Archive/on-a-drive": "not on the SD card",
+	}
+	for name, content := range files {
+		p := filepath.Join(c.DataDir, name)
+		os.MkdirAll(filepath.Dir(p), 0755)
+		os.WriteFile(p, []byte(content), 0644)
+		os.Chtimes(p, old, old)
+	}
+	os.Symlink("Photos/a.jpg", filepath.Join(c.DataDir, "latest"))
+	os.WriteFile(filepath.Join(c.DataDir, fsx.TempPrefix+"half"), []byte("partial upload"), 0600)
+
+	// The drive comes with a file copied by an attempt that was interrupted
+	target := filepath.Join(c.StateDir, "drive")
+	os.MkdirAll(filepath.Join(target, "Photos"), 0755)
+	os.WriteFile(filepath.Join(target, "Photos/a.jpg"), []byte("jpeg"), 0644)
+	os.Chtimes(filepath.Join(target, "Photos/a.jpg"), old, old)
+	// and files deleted from the SD card since
+	os.WriteFile(filepath.Join(target, "Photos/deleted.jpg"), []byte("gone"), 0644)
+	os.MkdirAll(filepath.Join(target, "Old/deep"), 0755)
+	os.WriteFile(filepath.Join(target, "Old/deep/x"), []byte("gone"), 0644)
+	os.MkdirAll(filepath.Join(target, "lost+found"), 0700)
+
+	d := &disk.MockDisk{IsFormatted: true}
+	if err := c.UseDrive(d, target); err != nil {
+		t.Fatal(err)
+	}
+	if c.Disk != nil || len(f.bound) != 1 {
+		t.Fatalf("switched to an empty drive over the SD card's files: bound %v", f.bound)
+	}
+	if w := call("GET", "/api/migration"); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"status":"offered"`) {
+		t.Fatalf("offer: %d %s", w.Code, w.Body)
+	}
+	if w := call("POST", "/api/migration/cleanup"); w.Code != http.StatusNotFound {
+		t.Errorf("cleanup before the move: %d", w.Code)
+	}
+
+	if w := call("POST", "/api/migration"); w.Code != http.StatusAccepted {
+		t.Fatalf("start: %d %s", w.Code, w.Body)
+	}
+	var job Migration
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if job, _ = c.Migration(); job.Status == MigrationDone || job.Status == MigrationFailed {
+			break
+		}
+	}
+	if job.Status != MigrationDone || job.Files != 4 || job.Copied != 4 || job.Progress != 1 {
+		t.Fatalf("migration %+v", job)
+	}
+
+	for name, content := range files {
+		got, err := os.ReadFile(filepath.Join(target, name))
+		if name == "Archive/on-a-drive" {
+			if err == nil {
+				t.Errorf("copied a pool drive's folder")
+			}
+			continue
+		}
+		info, _ := os.Stat(filepath.Join(target, name))
+		if string(got) != content || !info.ModTime().Equal(old) {
+			t.Errorf("%s: %q %v (%v)", name, got, info.ModTime(), err)
+		}
+	}
+	if link, _ := os.Readlink(filepath.Join(target, "latest")); link != "Photos/a.jpg" {
+		t.Errorf("symlink %q", link)
+	}
+	if _, err := os.Stat(filepath.Join(target, fsx.TempPrefix+"half")); err == nil {
+		t.Error("copied an unfinished upload")
+	}
+	for _, name := range []string{"Photos/deleted.jpg", "Old"} {
+		if _, err := os.Stat(filepath.Join(target, name)); err == nil {
+			t.Errorf("%s is on the drive but not on the SD card", name)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(target, "lost+found")); err != nil {
+		t.Errorf("lost+found: %v", err)
+	}
+
+	// Storage now lives on the drive, and the SD card's copy is set aside
+	if c.Disk != d || f.bound[c.DataDir] != target || c.Ejected() {
+		t.Errorf("after the switch: disk %v, bound %v", c.Disk, f.bound)
+	}
+	if f.bound[filepath.Join(c.DataDir, "Archive")] == "" {
+		t.Error("the pool did not come back")
+	}
+	if !strings.HasPrefix(job.Leftover, c.DataDir+".sd-copy-") || !holdsFiles(job.Leftover) {
+		t.Errorf("leftover %q", job.Leftover)
+	}
+	if uuid := c.dataDrive().UUID(); uuid != d.PartitionUUID() {
+		t.Errorf("remembered %q", uuid)
+	}
+	if w := call("POST", "/api/migration"); w.Code != http.StatusBadRequest {
+		t.Errorf("second migration: %d", w.Code)
+	}
+
+	// The copy can be cleaned up after a restart too
+	restarted := &Cloud{StateDir: c.StateDir, DataDir: c.DataDir}
+	if job, ok := restarted.Migration(); !ok || job.Leftover == "" {
+		t.Fatalf("after a restart: %+v", job)
+	}
+	if err := restarted.CleanupMigration(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(job.Leftover); !os.IsNotExist(err) {
+		t.Errorf("leftover still there: %v", err)
+	}
+	if err := restarted.CleanupMigration(); err == nil {
+		t.Error("cleaned up twice")
+	}
+	c.scans.Wait()
+}
+
+func TestMigrationStaysOnEmptySD(t *testing.T) {
+	c := newTestCloud(t)
+	f := &fakeDrives{attached: map[string]disk.Partition{}, bound: map[string]string{}}
+	c.Bind = f.bind
+	os.WriteFile(filepath.Join(c.DataDir, fsx.TempPrefix+"half"), []byte("partial upload"), 0600)
+
+	target := filepath.Join(c.StateDir, "drive")
+	d := &disk.MockDisk{}
+	if err := c.UseDrive(d, target); err != nil {
+		t.Fatal(err)
+	}
+	if c.Disk != d || f.bound[c.DataDir] != target {
+		t.Errorf("an empty SD card was not switched away from: bound %v", f.bound)
+	}
+	if _, ok := c.Migration(); ok {
+		t.Error("offered to move nothing")
+	}
+	c.scans.Wait()
+}
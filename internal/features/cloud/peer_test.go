@@ -0,0 +1,202 @@
+package cloud
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/strct-org/strct-agent/internal/features/peer"
+)
+
+type device struct {
+	cloud  *Cloud
+	peers  *peer.Manager
+	online atomic.Bool
+}
+
+// newDevice runs a cloud and its peer manager behind a test server that
+// answers 502, like the relay, while the device is offline.
+func newDevice(t *testing.T, id, name string) *device {
+	t.Helper()
+	d := &device{cloud: newTestCloud(t)}
+	d.cloud.Journal.Throttle = 0
+	d.online.Store(true)
+
+	mux := http.NewServeMux()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !d.online.Load() {
+			http.Error(w, "tunnel down", http.StatusBadGateway)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+
+	routes := d.cloud.GetRoutes()
+	m, err := peer.NewManager(peer.Config{DeviceID: id, Name: name, URL: srv.URL, DataDir: d.cloud.DataDir, StateDir: d.cloud.StateDir}, routes, d.cloud)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for route, h := range m.GetRoutes() {
+		routes[route] = h
+	}
+	for route, h := range routes {
+		mux.HandleFunc(route, h)
+	}
+	d.peers = m
+	return d
+}
+
+// api calls one of the device's peer endpoints and decodes its answer.
+func (d *device) api(t *testing.T, method, route, body string, want int, out any) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	d.peers.GetRoutes()[route](w, httptest.NewRequest(method, route, strings.NewReader(body)))
+	if w.Code != want {
+		t.Fatalf("%s %s: %d %s", method, route, w.Code, w.Body)
+	}
+	if out != nil {
+		if err := json.Unmarshal(w.Body.Bytes(), out); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func (d *device) link(t *testing.T, body string) string {
+	t.Helper()
+	var l peer.LinkResponse
+	d.api(t, http.MethodPost, "/api/peer/links", body, http.StatusCreated, &l)
+	return l.ID
+}
+
+func (d *device) write(t *testing.T, rel, data string) {
+	t.Helper()
+	full := filepath.Join(d.cloud.DataDir, filepath.FromSlash(rel))
+	if err := os.MkdirAll(filepath.Dir(full), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := d.cloud.writeFile(full, strings.NewReader(data), ""); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (d *device) read(rel string) string {
+	data, err := os.ReadFile(filepath.Join(d.cloud.DataDir, filepath.FromSlash(rel)))
+	if err != nil {
+		return "<" + err.Error() + ">"
+	}
+	return string(data)
+}
+
+func TestPeerReplication(t *testing.T) {
+	ctx := context.Background()
+	home, office := newDevice(t, "home-1234", "Home"), newDevice(t, "office-5678", "Office")
+
+	var inv peer.Invite
+	home.api(t, http.MethodPost, "/api/peer/invite", "", http.StatusCreated, &inv)
+	if _, err := office.peers.Join(ctx, inv.URL, inv.Code); err != nil {
+		t.Fatal(err)
+	}
+
+	// The office pushes its photos into the replica folder home made for it
+	push := office.link(t, `{"peer":"home-1234","folder":"Photos","mode":"push"}`)
+	office.write(t, "Photos/cat.jpg", "meow")
+	office.write(t, "Photos/2024/dog.jpg", "woof")
+	if _, err := office.peers.Run(ctx, push); err != nil {
+		t.Fatal(err)
+	}
+	if home.read("Replicas/Office/cat.jpg") != "meow" || home.read("Replicas/Office/2024/dog.jpg") != "woof" {
+		t.Fatal("push did not arrive")
+	}
+	if e, ok := home.cloud.Journal.Entry("Replicas/Office/cat.jpg"); !ok || e.SHA256 != sha256hex("meow") {
+		t.Errorf("home's journal missed the replicated file: %+v", e)
+	}
+
+	// Home keeps a folder in step both ways with the replica office made for it
+	both := home.link(t, `{"peer":"office-5678","folder":"Shared"}`)
+	home.write(t, "Shared/plan.txt", "v1")
+	if _, err := home.peers.Run(ctx, both); err != nil {
+		t.Fatal(err)
+	}
+	if office.read("Replicas/Home/plan.txt") != "v1" {
+		t.Fatal("two-way link did not copy to the office")
+	}
+	office.write(t, "Replicas/Home/plan.txt", "v2 from the office")
+	if _, err := home.peers.Run(ctx, both); err != nil {
+		t.Fatal(err)
+	}
+	if home.read("Shared/plan.txt") != "v2 from the office" {
+		t.Error("two-way link did not copy back")
+	}
+
+	// Neither side can reach outside what it was granted
+	bad := office.link(t, `{"peer":"home-1234","folder":"Stolen","remoteFolder":"Documents","mode":"pull"}`)
+	home.write(t, "Documents/taxes.pdf", "private")
+	if _, err := office.peers.Run(ctx, bad); err == nil {
+		t.Error("pulled a folder that was never shared")
+	}
+	if _, err := os.Stat(filepath.Join(office.cloud.DataDir, "Stolen", "taxes.pdf")); !os.IsNotExist(err) {
+		t.Error("ungranted file was copied")
+	}
+
+	// Home goes offline for a while; the office keeps working and catches up
+	home.online.Store(false)
+	office.write(t, "Photos/cat.jpg", "meow meow")
+	os.Remove(filepath.Join(office.cloud.DataDir, "Photos", "2024", "dog.jpg"))
+	if _, err := office.peers.Run(ctx, push); err == nil {
+		t.Fatal("synced with an offline peer")
+	}
+	var peers struct {
+		Peers []peer.PeerResponse `json:"peers"`
+	}
+	health := func() peer.Status {
+		t.Helper()
+		office.api(t, http.MethodGet, "/api/peer/peers", "", http.StatusOK, &peers)
+		for _, l := range peers.Peers[0].Links {
+			if l.ID == push {
+				return l.Status
+			}
+		}
+		t.Fatal("link missing from the health report")
+		return peer.Status{}
+	}
+	if st := health(); st.State != "offline" || st.Failures != 1 || st.LastSuccess == nil {
+		t.Errorf("while home is offline: %+v", st)
+	}
+
+	home.online.Store(true)
+	if _, err := office.peers.Run(ctx, push); err != nil {
+		t.Fatal(err)
+	}
+	if home.read("Replicas/Office/cat.jpg") != "meow meow" {
+		t.Error("edit made while offline did not arrive")
+	}
+	if _, err := os.Stat(filepath.Join(home.cloud.DataDir, "Replicas", "Office", "2024", "dog.jpg")); !os.IsNotExist(err) {
+		t.Error("deletion made while offline did not arrive")
+	}
+	if st := health(); st.State != "ok" || st.Sent == 0 || peers.Peers[0].LastSeen == nil {
+		t.Errorf("after catching up: %+v", st)
+	}
+
+	// The office's drive is ejected: the empty folder left behind must not
+	// reach home as every photo having been deleted
+	office.cloud.Disk = &mountedDisk{}
+	office.cloud.Unmount = func(dir string) error {
+		return os.Rename(filepath.Join(dir, "Photos"), filepath.Join(office.cloud.StateDir, "Photos"))
+	}
+	if err := office.cloud.Eject(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := office.peers.Run(ctx, push); err == nil {
+		t.Error("synced a folder on an ejected drive")
+	}
+	if home.read("Replicas/Office/cat.jpg") != "meow meow" {
+		t.Error("the eject deleted the replica")
+	}
+}
@@ -0,0 +1,440 @@
+package cloud
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/errs"
+	"github.com/strct-org/strct-agent/internal/fsx"
+	"github.com/strct-org/strct-agent/internal/platform/disk"
+)
+
+const (
+	OpPoolAdd     errs.Op = "cloud.Pool.Add"
+	OpPoolRemove  errs.Op = "cloud.Pool.Remove"
+	OpPoolDefault errs.Op = "cloud.Pool.SetDefault"
+	OpPoolSave    errs.Op = "cloud.Pool.save"
+	OpPoolAPI     errs.Op = "cloud.handleVolumes"
+)
+
+// Volume is a drive in the storage pool.
+type Volume struct {
+	UUID   string    `json:"uuid"`
+	Name   string    `json:"name"` // the top-level folder it appears as
+	FSType string    `json:"fsType"`
+	Added  time.Time `json:"added"`
+}
+
+// VolumeStatus is a volume as the API shows it.
+type VolumeStatus struct {
+	Volume
+	Online  bool   `json:"online"`
+	Device  string `json:"device,omitempty"`
+	Free    uint64 `json:"free"`
+	Total   uint64 `json:"total"`
+	Default bool   `json:"default"` // uploads to the top level land here
+}
+
+// Pool is the extra drives storage spans besides the main data location.
+// Each is mounted under MountDir by UUID and bound into DataDir as a
+// top-level folder named after the volume, so listing, search, WebDAV and
+// S3 see it as an ordinary folder. A drive that goes away is marked
+// offline and its folder refuses writes until it is back.
+type Pool struct {
+	DataDir  string            `json:"-"`
+	Path     string            `json:"-"` // state file
+	MountDir string            `json:"-"`
+	Tick     time.Duration     `json:"-"`
+	Events   <-chan disk.Event `json:"-"` // wakes the check when drives come and go
+	OnChange func()            `json:"-"` // volumes came online or went offline
+
+	Find   func(uuid string) (disk.Drive, disk.Partition, bool) `json:"-"`
+	Mount  func(p disk.Partition, dir string) error             `json:"-"`
+	Bind   func(src, dst string) error                          `json:"-"`
+	Detach func(dir string) error                               `json:"-"`
+
+	mu      sync.Mutex
+	Volumes map[string]*Volume `json:"volumes"`
+	Default string             `json:"default"` // UUID; "" is the main data location
+	online  map[string]string  // UUID -> device
+	// suspended while the data drive is ejected, as the volumes' folders
+	// are on it
+	suspended bool
+}
+
+// NewPool loads the volumes kept in statePath. Nothing is mounted until
+// Start.
+func NewPool(dataDir, statePath string) (*Pool, error) {
+	p := &Pool{
+		DataDir:  dataDir,
+		Path:     statePath,
+		MountDir: disk.PoolDir,
+		Tick:     time.Minute,
+		Find:     disk.System.FindUUID,
+		Mount:    disk.MountPool,
+		Bind:     disk.BindMount,
+		Detach:   disk.Detach,
+		Volumes:  make(map[string]*Volume),
+		online:   make(map[string]string),
+	}
+	data, err := os.ReadFile(statePath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, p); err != nil {
+			return nil, fmt.Errorf("parse %s: %w", statePath, err)
+		}
+	}
+	if p.Volumes == nil {
+		p.Volumes = make(map[string]*Volume)
+	}
+	return p, nil
+}
+
+func (p *Pool) Start() error {
+	go func() {
+		t := time.NewTicker(p.Tick)
+		defer t.Stop()
+		for {
+			p.Check()
+			select {
+			case <-t.C:
+			case <-p.Events:
+			}
+		}
+	}()
+	return nil
+}
+
+// Check brings attached volumes online and takes missing ones offline.
+func (p *Pool) Check() {
+	p.mu.Lock()
+	if p.suspended {
+		p.mu.Unlock()
+		return
+	}
+	changed := false
+	for uuid, v := range p.Volumes {
+		_, part, attached := p.Find(uuid)
+		_, online := p.online[uuid]
+		switch {
+		case online && !attached:
+			p.goOffline(v)
+			log.Printf("[POOL] Volume %s went offline", v.Name)
+			changed = true
+		case !online && attached:
+			if err := p.goOnline(v, part); err != nil {
+				log.Printf("[POOL] Volume %s is attached but could not be mounted: %v", v.Name, err)
+				continue
+			}
+			log.Printf("[POOL] Volume %s is online on %s", v.Name, part.Device)
+			changed = true
+		}
+	}
+	p.mu.Unlock()
+	if changed && p.OnChange != nil {
+		p.OnChange()
+	}
+}
+
+// Suspend takes every volume offline until Resume, so nothing is bound
+// into DataDir while it is unmounted.
+func (p *Pool) Suspend() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.suspended = true
+	for uuid := range p.online {
+		p.goOffline(p.Volumes[uuid])
+	}
+}
+
+// Resume brings the volumes that are attached back online.
+func (p *Pool) Resume() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	p.suspended = false
+	p.mu.Unlock()
+	p.Check()
+}
+
+func (p *Pool) mountPoint(uuid string) string { return filepath.Join(p.MountDir, uuid) }
+func (p *Pool) folder(v *Volume) string       { return filepath.Join(p.DataDir, v.Name) }
+
+// goOnline must be called with mu held.
+func (p *Pool) goOnline(v *Volume, part disk.Partition) error {
+	dir := p.mountPoint(v.UUID)
+	// Left mounted by an earlier run of the agent
+	if part.Mountpoint != dir {
+		if err := p.Mount(part, dir); err != nil {
+			return err
+		}
+	}
+	target := p.folder(v)
+	p.Detach(target)
+	if err := p.Bind(dir, target); err != nil {
+		p.Detach(dir)
+		return err
+	}
+	p.online[v.UUID] = part.Device
+	return nil
+}
+
+// goOffline must be called with mu held. The mounts are detached lazily
+// since the drive may already be gone with files still open on it.
+func (p *Pool) goOffline(v *Volume) {
+	p.Detach(p.folder(v))
+	p.Detach(p.mountPoint(v.UUID))
+	delete(p.online, v.UUID)
+}
+
+// Add puts the filesystem with uuid into the pool as a folder called name.
+func (p *Pool) Add(uuid, name string) (VolumeStatus, error) {
+	name = strings.TrimSpace(name)
+	if !validVolumeName(name) {
+		return VolumeStatus{}, errs.E(OpPoolAdd, errs.KindInvalid, "invalid volume name")
+	}
+	drive, part, ok := p.Find(uuid)
+	if !ok {
+		return VolumeStatus{}, errs.E(OpPoolAdd, errs.KindNotFound, "no attached drive has that filesystem")
+	}
+	switch {
+	case drive.System:
+		return VolumeStatus{}, errs.E(OpPoolAdd, errs.KindInvalid, "that drive holds the system")
+	case part.FSType == "" || part.FSType == "swap" || part.FSType == "crypto_LUKS":
+		return VolumeStatus{}, errs.E(OpPoolAdd, errs.KindInvalid, "the partition has no filesystem the pool can use")
+	case part.Mountpoint != "" && part.Mountpoint != p.mountPoint(part.UUID):
+		return VolumeStatus{}, errs.E(OpPoolAdd, errs.KindInvalid, "the partition is already mounted at "+part.Mountpoint)
+	}
+
+	p.mu.Lock()
+	if _, ok := p.Volumes[part.UUID]; ok {
+		p.mu.Unlock()
+		return VolumeStatus{}, errs.E(OpPoolAdd, errs.KindInvalid, "the drive is already in the pool")
+	}
+	for _, v := range p.Volumes {
+		if strings.EqualFold(v.Name, name) {
+			p.mu.Unlock()
+			return VolumeStatus{}, errs.E(OpPoolAdd, errs.KindInvalid, "another volume is called "+name)
+		}
+	}
+	// The drive is bound over the folder, which would hide what is in it
+	if entries, err := os.ReadDir(filepath.Join(p.DataDir, name)); err == nil && len(entries) > 0 {
+		p.mu.Unlock()
+		return VolumeStatus{}, errs.E(OpPoolAdd, errs.KindInvalid, "a folder called "+name+" already has files in it")
+	}
+
+	v := &Volume{UUID: part.UUID, Name: name, FSType: part.FSType, Added: time.Now().UTC()}
+	if err := p.goOnline(v, part); err != nil {
+		p.mu.Unlock()
+		return VolumeStatus{}, errs.E(OpPoolAdd, errs.KindIO, err, "could not mount the drive")
+	}
+	p.Volumes[v.UUID] = v
+	err := p.save()
+	st := p.status(v)
+	p.mu.Unlock()
+	if err != nil {
+		return VolumeStatus{}, err
+	}
+
+	log.Printf("[POOL] Added %s (%s) as %s", part.Device, part.FSType, name)
+	if p.OnChange != nil {
+		p.OnChange()
+	}
+	return st, nil
+}
+
+// Remove takes a volume out of the pool. What is on the drive stays there.
+func (p *Pool) Remove(uuid string) error {
+	p.mu.Lock()
+	v, ok := p.Volumes[uuid]
+	if !ok {
+		p.mu.Unlock()
+		return errs.E(OpPoolRemove, errs.KindNotFound, "no such volume")
+	}
+	if _, online := p.online[uuid]; online {
+		p.goOffline(v)
+	}
+	os.Remove(p.folder(v))
+	os.Remove(p.mountPoint(uuid))
+	delete(p.Volumes, uuid)
+	if p.Default == uuid {
+		p.Default = ""
+	}
+	err := p.save()
+	p.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	log.Printf("[POOL] Removed volume %s", v.Name)
+	if p.OnChange != nil {
+		p.OnChange()
+	}
+	return nil
+}
+
+// SetDefault makes uploads to the top level go to the volume with uuid,
+// or with "" to the main data location again.
+func (p *Pool) SetDefault(uuid string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.Volumes[uuid]; uuid != "" && !ok {
+		return errs.E(OpPoolDefault, errs.KindNotFound, "no such volume")
+	}
+	p.Default = uuid
+	return p.save()
+}
+
+// Status lists the volumes by name.
+func (p *Pool) Status() []VolumeStatus {
+	if p == nil {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	list := make([]VolumeStatus, 0, len(p.Volumes))
+	for _, v := range p.Volumes {
+		list = append(list, p.status(v))
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// status must be called with mu held.
+func (p *Pool) status(v *Volume) VolumeStatus {
+	st := VolumeStatus{Volume: *v, Default: p.Default == v.UUID}
+	st.Device, st.Online = p.online[v.UUID]
+	if st.Online {
+		st.Free, _ = disk.GetFreeDiskSpace(p.folder(v))
+		st.Total, _ = disk.GetDiskSize(p.folder(v))
+	}
+	return st
+}
+
+// UploadFolder is the folder uploads to the top level go to: the default
+// volume while it is online, otherwise "" for the main data location.
+func (p *Pool) UploadFolder() string {
+	if p == nil {
+		return ""
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	v, ok := p.Volumes[p.Default]
+	if _, online := p.online[p.Default]; !ok || !online {
+		return ""
+	}
+	return v.Name
+}
+
+// On returns the volume fullPath is on and whether it is online, or ""
+// for the main data location. An offline volume's folder is an empty
+// directory on the main storage.
+func (p *Pool) On(fullPath string) (name string, online bool) {
+	if p == nil {
+		return "", false
+	}
+	rel, err := filepath.Rel(p.DataDir, fullPath)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return "", false
+	}
+	top, _, _ := strings.Cut(filepath.ToSlash(rel), "/")
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for uuid, v := range p.Volumes {
+		if v.Name == top {
+			_, online := p.online[uuid]
+			return v.Name, online
+		}
+	}
+	return "", false
+}
+
+// save must be called with mu held.
+func (p *Pool) save() error {
+	data, err := json.Marshal(p)
+	if err != nil {
+		return errs.E(OpPoolSave, errs.KindIO, err)
+	}
+	if err := os.MkdirAll(filepath.Dir(p.Path), 0755); err != nil {
+		return errs.E(OpPoolSave, errs.KindIO, err)
+	}
+	if err := fsx.WriteFile(p.Path, data, 0600); err != nil {
+		return errs.E(OpPoolSave, errs.KindIO, err)
+	}
+	return nil
+}
+
+func validVolumeName(name string) bool {
+	return name != "" && len(name) <= 64 && !strings.HasPrefix(name, ".") && !fsx.IsTempName(name) &&
+		!strings.ContainsAny(name, "/\\\x00")
+}
+
+// handleVolumes lists the pool, adds a drive to it (POST {uuid, name}) or
+// takes one out (DELETE ?uuid=).
+func (s *Cloud) handleVolumes(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string][]VolumeStatus{"volumes": s.Pool.Status()})
+	case http.MethodPost:
+		var req struct {
+			UUID string `json:"uuid"`
+			Name string `json:"name"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4<<10)).Decode(&req); err != nil || req.UUID == "" {
+			errs.HTTPResponse(w, errs.E(OpPoolAPI, errs.KindInvalid, "Invalid JSON"))
+			return
+		}
+		v, err := s.Pool.Add(req.UUID, req.Name)
+		if err != nil {
+			errs.HTTPResponse(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(v)
+	case http.MethodDelete:
+		if err := s.Pool.Remove(r.URL.Query().Get("uuid")); err != nil {
+			errs.HTTPResponse(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleDefaultVolume chooses where uploads to the top level go.
+func (s *Cloud) handleDefaultVolume(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		UUID string `json:"uuid"` // "" for the main data location
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4<<10)).Decode(&req); err != nil {
+		errs.HTTPResponse(w, errs.E(OpPoolAPI, errs.KindInvalid, "Invalid JSON"))
+		return
+	}
+	if err := s.Pool.SetDefault(req.UUID); err != nil {
+		errs.HTTPResponse(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]VolumeStatus{"volumes": s.Pool.Status()})
+}
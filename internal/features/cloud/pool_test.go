@@ -0,0 +1,234 @@
+package cloud
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/strct-org/strct-agent/internal/platform/disk"
+)
+
+// fakeDrives stands in for the kernel and mount(8): attached filesystems
+// by UUID, and which folders are bound where.
+type fakeDrives struct {
+	mu       sync.Mutex
+	attached map[string]disk.Partition
+	system   map[string]bool
+	bound    map[string]string // target -> source
+	mounts   int
+}
+
+func (f *fakeDrives) find(uuid string) (disk.Drive, disk.Partition, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	p, ok := f.attached[uuid]
+	return disk.Drive{Device: strings.TrimRight(p.Device, "0123456789"), System: f.system[uuid]}, p, ok
+}
+
+func (f *fakeDrives) mount(p disk.Partition, dir string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.mounts++
+	return os.MkdirAll(dir, 0755)
+}
+
+func (f *fakeDrives) bind(src, dst string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.bound[dst] = src
+	return os.MkdirAll(dst, 0755)
+}
+
+func (f *fakeDrives) detach(dir string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.bound, dir)
+	return nil
+}
+
+func (f *fakeDrives) plug(uuid string, p disk.Partition) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if p.UUID == "" {
+		p.UUID = uuid
+	}
+	f.attached[uuid] = p
+}
+
+func (f *fakeDrives) unplug(uuid string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.attached, uuid)
+}
+
+func newTestPool(t *testing.T, c *Cloud, f *fakeDrives) *Pool {
+	t.Helper()
+	p, err := NewPool(c.DataDir, filepath.Join(c.StateDir, "pool.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.MountDir = filepath.Join(c.StateDir, "mnt")
+	p.Find, p.Mount, p.Bind, p.Detach = f.find, f.mount, f.bind, f.detach
+	return p
+}
+
+func TestPool(t *testing.T) {
+	c := newTestCloud(t)
+	f := &fakeDrives{attached: map[string]disk.Partition{}, system: map[string]bool{}, bound: map[string]string{}}
+	f.plug("a1", disk.Partition{Device: "/dev/sda1", FSType: "ext4"})
+	f.plug("b2", disk.Partition{Device: "/dev/sdb1", FSType: "exfat"})
+	f.plug("root", disk.Partition{Device: "/dev/mmcblk0p2", FSType: "ext4", Mountpoint: "/"})
+	f.system["root"] = true
+	f.plug("luks", disk.Partition{Device: "/dev/sdc1", FSType: "crypto_LUKS"})
+	f.plug("media", disk.Partition{Device: "/dev/sdd1", FSType: "vfat", Mountpoint: "/media/pi/STICK"})
+	os.MkdirAll(filepath.Join(c.DataDir, "Photos"), 0755)
+	os.WriteFile(filepath.Join(c.DataDir, "Photos", "a.jpg"), []byte("x"), 0644)
+
+	c.Pool = newTestPool(t, c, f)
+	changes := 0
+	c.Pool.OnChange = func() { changes++ }
+
+	call := func(method, route, body string, out any) int {
+		t.Helper()
+		w := httptest.NewRecorder()
+		c.GetRoutes()[strings.SplitN(route, "?", 2)[0]](w, httptest.NewRequest(method, route, strings.NewReader(body)))
+		if out != nil && w.Code < 300 {
+			if err := json.Unmarshal(w.Body.Bytes(), out); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return w.Code
+	}
+	upload := func(path string) (int, string) {
+		var buf bytes.Buffer
+		mw := multipart.NewWriter(&buf)
+		fw, _ := mw.CreateFormFile("file", "doc.txt")
+		fw.Write([]byte("hello"))
+		mw.Close()
+		r := httptest.NewRequest(http.MethodPost, "/strct_agent/fs/upload?path="+path, &buf)
+		r.Header.Set("Content-Type", mw.FormDataContentType())
+		w := httptest.NewRecorder()
+		c.handleUpload(w, r)
+		var landed string
+		filepath.WalkDir(c.DataDir, func(p string, d os.DirEntry, err error) error {
+			if err == nil && d.Name() == "doc.txt" {
+				landed, _ = filepath.Rel(c.DataDir, p)
+				os.Remove(p)
+			}
+			return nil
+		})
+		return w.Code, landed
+	}
+	volumes := func() []VolumeStatus {
+		var resp struct{ Volumes []VolumeStatus }
+		call("GET", "/api/volumes", "", &resp)
+		return resp.Volumes
+	}
+
+	invalid := []struct {
+		name string
+		body string
+		want int
+	}{
+		{"bad json", `{`, http.StatusBadRequest},
+		{"hidden name", `{"uuid":"a1","name":".secret"}`, http.StatusBadRequest},
+		{"nested name", `{"uuid":"a1","name":"a/b"}`, http.StatusBadRequest},
+		{"not attached", `{"uuid":"zz","name":"Gone"}`, http.StatusNotFound},
+		{"system drive", `{"uuid":"root","name":"Root"}`, http.StatusBadRequest},
+		{"encrypted", `{"uuid":"luks","name":"Vault"}`, http.StatusBadRequest},
+		{"mounted elsewhere", `{"uuid":"media","name":"Stick"}`, http.StatusBadRequest},
+		{"folder with files", `{"uuid":"a1","name":"Photos"}`, http.StatusBadRequest},
+	}
+	for _, tt := range invalid {
+		t.Run(tt.name, func(t *testing.T) {
+			if code := call("POST", "/api/volumes", tt.body, nil); code != tt.want {
+				t.Errorf("status %d, want %d", code, tt.want)
+			}
+		})
+	}
+
+	var v VolumeStatus
+	if code := call("POST", "/api/volumes", `{"uuid":"a1","name":"Archive"}`, &v); code != http.StatusCreated || !v.Online || v.Device != "/dev/sda1" {
+		t.Fatalf("add: %d %+v", code, v)
+	}
+	if src := f.bound[filepath.Join(c.DataDir, "Archive")]; src != filepath.Join(c.Pool.MountDir, "a1") {
+		t.Errorf("Archive bound to %q", src)
+	}
+	if code := call("POST", "/api/volumes", `{"uuid":"a1","name":"Again"}`, nil); code != http.StatusBadRequest {
+		t.Errorf("added twice: %d", code)
+	}
+	if code := call("POST", "/api/volumes", `{"uuid":"b2","name":"archive"}`, nil); code != http.StatusBadRequest {
+		t.Errorf("name taken: %d", code)
+	}
+	call("POST", "/api/volumes", `{"uuid":"b2","name":"Scratch"}`, nil)
+
+	if code, landed := upload("/"); code != http.StatusOK || landed != "doc.txt" {
+		t.Errorf("upload with no default volume: %d %s", code, landed)
+	}
+	if code := call("POST", "/api/volumes/default", `{"uuid":"nope"}`, nil); code != http.StatusNotFound {
+		t.Errorf("unknown default: %d", code)
+	}
+	call("POST", "/api/volumes/default", `{"uuid":"a1"}`, nil)
+	if code, landed := upload("/"); code != http.StatusOK || landed != filepath.Join("Archive", "doc.txt") {
+		t.Errorf("upload to the default volume: %d %s", code, landed)
+	}
+	if code, landed := upload("/Scratch"); code != http.StatusOK || landed != filepath.Join("Scratch", "doc.txt") {
+		t.Errorf("upload to a named volume: %d %s", code, landed)
+	}
+
+	// Pulled out: the folder stays but takes no writes, uploads fall back
+	changes = 0
+	f.unplug("a1")
+	c.Pool.Check()
+	if vs := volumes(); len(vs) != 2 || vs[0].Name != "Archive" || vs[0].Online || !vs[0].Default || !vs[1].Online {
+		t.Errorf("after unplugging: %+v", vs)
+	}
+	if _, ok := f.bound[filepath.Join(c.DataDir, "Archive")]; ok || changes != 1 {
+		t.Errorf("offline volume still bound, %d changes", changes)
+	}
+	if code, _ := upload("/Archive"); code != http.StatusNotFound {
+		t.Errorf("upload to an offline volume: %d", code)
+	}
+	if code := call("POST", "/api/mkdir", `{"path":"/Archive","name":"new"}`, nil); code != http.StatusNotFound {
+		t.Errorf("mkdir on an offline volume: %d", code)
+	}
+	if code, landed := upload("/"); code != http.StatusOK || landed != "doc.txt" {
+		t.Errorf("upload while the default volume is offline: %d %s", code, landed)
+	}
+
+	// Plugged back in, under another name
+	f.plug("a1", disk.Partition{Device: "/dev/sde1", FSType: "ext4"})
+	c.Pool.Check()
+	if vs := volumes(); !vs[0].Online || vs[0].Device != "/dev/sde1" || changes != 2 {
+		t.Errorf("after plugging back in: %+v, %d changes", vs, changes)
+	}
+
+	// A restarted agent finds its volumes still mounted
+	f.plug("b2", disk.Partition{Device: "/dev/sdb1", FSType: "exfat", Mountpoint: filepath.Join(c.Pool.MountDir, "b2")})
+	mounts := f.mounts
+	p := newTestPool(t, c, f)
+	p.Check()
+	if f.mounts != mounts+1 || p.Default != "a1" || len(p.Status()) != 2 {
+		t.Errorf("after restart: %d mounts, default %q, %+v", f.mounts-mounts, p.Default, p.Status())
+	}
+
+	if code := call("DELETE", "/api/volumes?uuid=a1", "", nil); code != http.StatusNoContent {
+		t.Fatalf("remove: %d", code)
+	}
+	if code := call("DELETE", "/api/volumes?uuid=a1", "", nil); code != http.StatusNotFound {
+		t.Errorf("remove twice: %d", code)
+	}
+	if vs := volumes(); len(vs) != 1 || c.Pool.Default != "" {
+		t.Errorf("after removing: %+v, default %q", vs, c.Pool.Default)
+	}
+	if _, err := os.Stat(filepath.Join(c.DataDir, "Archive")); !os.IsNotExist(err) {
+		t.Error("removed volume left its folder")
+	}
+}
@@ -0,0 +1,206 @@
+package cloud
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/strct-org/strct-agent/internal/errs"
+	"github.com/strct-org/strct-agent/internal/humanize"
+	"github.com/strct-org/strct-agent/internal/platform/disk"
+)
+
+const OpCheckQuota errs.Op = "cloud.CheckQuota"
+
+type FolderUsage struct {
+	Name  string `json:"name"`
+	Size  int64  `json:"size"`
+	Owner string `json:"owner,omitempty"`
+}
+
+type AccountUsage struct {
+	Name       string `json:"name"`
+	Used       int64  `json:"used"`
+	QuotaBytes int64  `json:"quotaBytes"`
+}
+
+type UsageResponse struct {
+	Used     int64          `json:"used"`
+	Free     uint64         `json:"free"`
+	Folders  []FolderUsage  `json:"folders"`
+	Accounts []AccountUsage `json:"accounts"`
+}
+
+// CheckQuota decides whether size bytes may be written to fullPath. It
+// accounts for the file being replaced, the owning account's quota and the
+// free space left on the drive. The error has KindQuota (HTTP 507), or
+// KindNotFound while the drive it would go to is offline.
+func (s *Cloud) CheckQuota(fullPath string, size int64) error {
+	l, err := s.limit(fullPath)
+	if err != nil {
+		return err
+	}
+	if growth := size - s.Usage.File(fullPath); l.room >= 0 && growth > l.room {
+		return l.err
+	}
+	return nil
+}
+
+// Room returns how many bytes fullPath may hold, counting the file it
+// replaces, or -1 when nothing limits it. The error is CheckQuota's.
+func (s *Cloud) Room(fullPath string) (int64, error) {
+	l, err := s.limit(fullPath)
+	if err != nil || l.room < 0 {
+		return l.room, err
+	}
+	return s.Usage.File(fullPath) + l.room, nil
+}
+
+// LimitUpload wraps the body of an upload to fullPath so that reading it
+// fails with CheckQuota's KindQuota error once it grows past what fits.
+// Uploads of unknown length are only stopped this way.
+func (s *Cloud) LimitUpload(fullPath string, r io.Reader) (io.Reader, error) {
+	l, err := s.limit(fullPath)
+	if err != nil {
+		return nil, err
+	}
+	if l.room < 0 {
+		return r, nil
+	}
+	return &quotaReader{r: r, left: s.Usage.File(fullPath) + l.room, err: l.err}, nil
+}
+
+// quotaLimit is how much a file may grow by, or -1 when nothing limits
+// it, and what going past that is refused with.
+type quotaLimit struct {
+	room int64
+	err  error
+}
+
+func (s *Cloud) limit(fullPath string) (quotaLimit, error) {
+	l := quotaLimit{room: -1}
+	if s.gate.isOffline() {
+		return l, errOffline()
+	}
+	volume, online := s.Pool.On(fullPath)
+	if volume != "" && !online {
+		return l, errs.E(OpCheckQuota, errs.KindNotFound, "Volume "+volume+" is offline")
+	}
+
+	// A pool drive has its own free space
+	spaceRoot := s.DataDir
+	if volume != "" {
+		spaceRoot = filepath.Join(s.DataDir, volume)
+	}
+	if free, err := disk.GetFreeDiskSpace(spaceRoot); err == nil {
+		l.room = int64(min(free, math.MaxInt64))
+		l.err = errs.E(OpCheckQuota, errs.KindQuota, "Not enough free space on the device")
+	}
+
+	if s.Accounts == nil {
+		return l, nil
+	}
+	owner, ok := s.Accounts.Owner(s.topFolder(fullPath))
+	if !ok || owner.QuotaBytes == 0 {
+		return l, nil
+	}
+	used := s.accountUsed(owner.Folders)
+	if left := max(owner.QuotaBytes-used, 0); l.room < 0 || left < l.room {
+		l.room = left
+		l.err = errs.E(OpCheckQuota, errs.KindQuota, fmt.Sprintf("Quota exceeded for %s: %s of %s used",
+			owner.Name, humanize.Bytes(used), humanize.Bytes(owner.QuotaBytes)))
+	}
+	return l, nil
+}
+
+// quotaReader fails with err once more than left bytes are read.
+type quotaReader struct {
+	r    io.Reader
+	left int64
+	err  error
+}
+
+func (q *quotaReader) Read(p []byte) (int, error) {
+	if q.left < 0 {
+		return 0, q.err
+	}
+	// One byte past the limit is enough to know it was crossed
+	if int64(len(p)) > q.left+1 {
+		p = p[:q.left+1]
+	}
+	n, err := q.r.Read(p)
+	if int64(n) > q.left {
+		n, q.left = int(q.left), -1
+		return n, q.err
+	}
+	q.left -= int64(n)
+	return n, err
+}
+
+// isQuota reports whether err is a quota or free space refusal.
+func isQuota(err error) bool {
+	var e *errs.Error
+	return errors.As(err, &e) && e.Kind == errs.KindQuota
+}
+
+// topFolder returns the top-level folder a path lives in, or "" for files
+// directly in DataDir.
+func (s *Cloud) topFolder(fullPath string) string {
+	rel, err := filepath.Rel(s.DataDir, fullPath)
+	if err != nil {
+		return ""
+	}
+	top, _, nested := strings.Cut(filepath.ToSlash(rel), "/")
+	if !nested {
+		return ""
+	}
+	return top
+}
+
+func (s *Cloud) accountUsed(folders []string) int64 {
+	var used int64
+	for _, f := range folders {
+		used += s.Usage.Folder(f)
+	}
+	return used
+}
+
+func (s *Cloud) handleUsage(w http.ResponseWriter, r *http.Request) {
+	free, _ := disk.GetFreeDiskSpace(s.DataDir)
+	resp := UsageResponse{
+		Used:     s.Usage.Total(),
+		Free:     free,
+		Folders:  []FolderUsage{},
+		Accounts: []AccountUsage{},
+	}
+
+	for name, size := range s.Usage.TopFolders() {
+		f := FolderUsage{Name: name, Size: size}
+		if s.Accounts != nil {
+			if owner, ok := s.Accounts.Owner(name); ok {
+				f.Owner = owner.Name
+			}
+		}
+		resp.Folders = append(resp.Folders, f)
+	}
+	sort.Slice(resp.Folders, func(i, j int) bool { return resp.Folders[i].Size > resp.Folders[j].Size })
+
+	if s.Accounts != nil {
+		for _, a := range s.Accounts.List() {
+			resp.Accounts = append(resp.Accounts, AccountUsage{
+				Name:       a.Name,
+				Used:       s.accountUsed(a.Folders),
+				QuotaBytes: a.QuotaBytes,
+			})
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,851 @@
+package cloud
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"io/fs"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/strct-org/strct-agent/internal/errs"
+	"github.com/strct-org/strct-agent/internal/fsx"
+	"github.com/strct-org/strct-agent/internal/humanize"
+	"github.com/strct-org/strct-agent/internal/templates"
+)
+
+const (
+	OpShareCreate errs.Op = "cloud.handleShares"
+	OpShareSave   errs.Op = "cloud.ShareStore.save"
+)
+
+type ShareMode string
+
+const (
+	ShareRead ShareMode = "read" // view and download
+	ShareDrop ShareMode = "drop" // upload only, nothing is listed
+)
+
+// maxShareLog caps the per-link access log so a popular link cannot grow the
+// state file without bound.
+const maxShareLog = 200
+
+// shareLogFlush is how long access log entries may wait before shares.json
+// is rewritten, so every view or refused request on a busy link does not
+// rewrite it. Downloads that a limit depends on are saved at once.
+const shareLogFlush = time.Minute
+
+// shareResume is how long a download can be resumed with Range requests
+// without counting as another one.
+const shareResume = 24 * time.Hour
+
+type Share struct {
+	Token        string        `json:"token"`
+	Path         string        `json:"path"`
+	Mode         ShareMode     `json:"mode"`
+	PasswordHash []byte        `json:"passwordHash,omitempty"`
+	ExpiresAt    *time.Time    `json:"expiresAt,omitempty"`
+	MaxDownloads int           `json:"maxDownloads,omitempty"`
+	Downloads    int           `json:"downloads"`
+	CreatedAt    time.Time     `json:"createdAt"`
+	RevokedAt    *time.Time    `json:"revokedAt,omitempty"`
+	Log          []ShareAccess `json:"log,omitempty"`
+}
+
+type ShareAccess struct {
+	Time   time.Time `json:"time"`
+	IP     string    `json:"ip"`
+	Action string    `json:"action"`
+	File   string    `json:"file,omitempty"`
+}
+
+// ShareInfo is what the owner sees; it never includes the password hash.
+type ShareInfo struct {
+	Token        string     `json:"token"`
+	URL          string     `json:"url"`
+	Path         string     `json:"path"`
+	Mode         ShareMode  `json:"mode"`
+	HasPassword  bool       `json:"hasPassword"`
+	ExpiresAt    *time.Time `json:"expiresAt,omitempty"`
+	MaxDownloads int        `json:"maxDownloads,omitempty"`
+	Downloads    int        `json:"downloads"`
+	CreatedAt    time.Time  `json:"createdAt"`
+	Active       bool       `json:"active"`
+	Revoked      bool       `json:"revoked"`
+}
+
+type ShareStore struct {
+	Path string `json:"-"`
+
+	mu     sync.Mutex
+	Secret []byte            `json:"secret"`
+	Shares map[string]*Share `json:"shares"`
+
+	flush *time.Timer // a pending save of the access log
+	tries map[string]*passwordTries
+}
+
+// passwordTries counts the wrong passwords given for one link. After
+// shareFreeTries of them every further attempt has to wait, twice as long
+// each time, so a password cannot be guessed at the speed of bcrypt.
+type passwordTries struct {
+	failed int
+	until  time.Time
+}
+
+const (
+	shareFreeTries = 5
+	shareTryDelay  = 30 * time.Second
+	shareMaxDelay  = time.Hour
+)
+
+func NewShareStore(path string) (*ShareStore, error) {
+	st := &ShareStore{Path: path, Shares: make(map[string]*Share), tries: make(map[string]*passwordTries)}
+
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, st); err != nil {
+			return nil, fmt.Errorf("parse %s: %w", path, err)
+		}
+	}
+
+	if len(st.Secret) == 0 {
+		st.Secret = make([]byte, 32)
+		if _, err := rand.Read(st.Secret); err != nil {
+			return nil, err
+		}
+		if err := st.save(); err != nil {
+			return nil, err
+		}
+	}
+	return st, nil
+}
+
+// save must be called with mu held.
+func (st *ShareStore) save() error {
+	if st.flush != nil {
+		st.flush.Stop()
+		st.flush = nil
+	}
+	data, err := json.Marshal(st)
+	if err != nil {
+		return errs.E(OpShareSave, errs.KindIO, err)
+	}
+	if err := writeFileAtomic(st.Path, data); err != nil {
+		return errs.E(OpShareSave, errs.KindIO, err)
+	}
+	return nil
+}
+
+// throttled reports whether password attempts on token have to wait.
+func (st *ShareStore) throttled(token string, now time.Time) bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	t := st.tries[token]
+	return t != nil && now.Before(t.until)
+}
+
+// passwordFailed counts a wrong password for token.
+func (st *ShareStore) passwordFailed(token string, now time.Time) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	t := st.tries[token]
+	if t == nil {
+		t = &passwordTries{}
+		st.tries[token] = t
+	}
+	t.failed++
+	if t.failed >= shareFreeTries {
+		t.until = now.Add(min(shareTryDelay<<min(t.failed-shareFreeTries, 10), shareMaxDelay))
+	}
+}
+
+// passwordAccepted forgets the wrong passwords given for token.
+func (st *ShareStore) passwordAccepted(token string) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	delete(st.tries, token)
+}
+
+// open reports whether the link is neither revoked nor expired.
+func (sh *Share) open(now time.Time) bool {
+	return sh.RevokedAt == nil && (sh.ExpiresAt == nil || !now.After(*sh.ExpiresAt))
+}
+
+// active reports whether the link is open and has downloads left.
+func (sh *Share) active(now time.Time) bool {
+	if !sh.open(now) {
+		return false
+	}
+	if sh.MaxDownloads > 0 && sh.Downloads >= sh.MaxDownloads {
+		return false
+	}
+	return true
+}
+
+func (sh *Share) info() ShareInfo {
+	return ShareInfo{
+		Token:        sh.Token,
+		URL:          "/s/" + sh.Token,
+		Path:         sh.Path,
+		Mode:         sh.Mode,
+		HasPassword:  len(sh.PasswordHash) > 0,
+		ExpiresAt:    sh.ExpiresAt,
+		MaxDownloads: sh.MaxDownloads,
+		Downloads:    sh.Downloads,
+		CreatedAt:    sh.CreatedAt,
+		Active:       sh.active(time.Now()),
+		Revoked:      sh.RevokedAt != nil,
+	}
+}
+
+func (sh *Share) logAccess(r *http.Request, action, file string) {
+	sh.Log = append(sh.Log, ShareAccess{Time: time.Now().UTC(), IP: clientIP(r), Action: action, File: file})
+	if len(sh.Log) > maxShareLog {
+		sh.Log = sh.Log[len(sh.Log)-maxShareLog:]
+	}
+}
+
+func (st *ShareStore) record(token string, r *http.Request, action, file string) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	sh, ok := st.Shares[token]
+	if !ok {
+		return
+	}
+	sh.logAccess(r, action, file)
+	st.saveLater()
+}
+
+// claim counts a download of file, if the link has one left. The check and
+// the count happen under one lock, so two requests cannot both take the
+// last download.
+func (st *ShareStore) claim(token string, r *http.Request, file string) bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	sh, ok := st.Shares[token]
+	if !ok || !sh.active(time.Now()) {
+		return false
+	}
+	sh.Downloads++
+	sh.logAccess(r, "download", file)
+	if sh.MaxDownloads == 0 {
+		st.saveLater()
+		return true
+	}
+	// A limit that a restart forgets is no limit
+	if err := st.save(); err != nil {
+		log.Printf("[SHARE] %v", err)
+	}
+	return true
+}
+
+// saveLater must be called with mu held.
+func (st *ShareStore) saveLater() {
+	if st.flush != nil {
+		return
+	}
+	st.flush = time.AfterFunc(shareLogFlush, func() {
+		st.mu.Lock()
+		defer st.mu.Unlock()
+		if err := st.save(); err != nil {
+			log.Printf("[SHARE] %v", err)
+		}
+	})
+}
+
+// lookup returns a copy so callers can read it without holding the lock.
+func (st *ShareStore) lookup(token string) (Share, bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	sh, ok := st.Shares[token]
+	if !ok {
+		return Share{}, false
+	}
+	return *sh, true
+}
+
+func (st *ShareStore) cookieValue(sh Share) string {
+	m := hmac.New(sha256.New, st.Secret)
+	m.Write([]byte(sh.Token))
+	m.Write(sh.PasswordHash)
+	return hex.EncodeToString(m.Sum(nil))
+}
+
+// resumeValue ties a resume cookie to one file of one link until expires.
+func (st *ShareStore) resumeValue(token, file string, expires int64) string {
+	m := hmac.New(sha256.New, st.Secret)
+	fmt.Fprintf(m, "%s\x00%s\x00%d", token, file, expires)
+	return hex.EncodeToString(m.Sum(nil))
+}
+
+// resuming reports whether r is a Range request continuing a download of
+// file that was already counted.
+func (st *ShareStore) resuming(r *http.Request, token, file string) bool {
+	if r.Header.Get("Range") == "" {
+		return false
+	}
+	c, err := r.Cookie("strct_dl")
+	if err != nil {
+		return false
+	}
+	exp, mac, ok := strings.Cut(c.Value, ".")
+	expires, err := strconv.ParseInt(exp, 10, 64)
+	if !ok || err != nil || time.Now().Unix() > expires {
+		return false
+	}
+	return hmac.Equal([]byte(mac), []byte(st.resumeValue(token, file, expires)))
+}
+
+func newShareToken() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// clientIP is where r came from. X-Forwarded-For is only believed from the
+// local frp client, and only its last entry, the one frps added: anything
+// before it is whatever the client chose to send.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+		return host
+	}
+	if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
+		hops := strings.Split(fwd, ",")
+		return strings.TrimSpace(hops[len(hops)-1])
+	}
+	return host
+}
+
+// handleShares is the owner-facing API: list (GET), create (POST) and revoke (DELETE).
+func (s *Cloud) handleShares(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		s.listShares(w, r)
+	case http.MethodPost:
+		s.createShare(w, r)
+	case http.MethodDelete:
+		s.revokeShare(w, r)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Cloud) listShares(w http.ResponseWriter, r *http.Request) {
+	st := s.Shares
+	st.mu.Lock()
+	list := make([]ShareInfo, 0, len(st.Shares))
+	for _, sh := range st.Shares {
+		list = append(list, sh.info())
+	}
+	st.mu.Unlock()
+
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.After(list[j].CreatedAt) })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]ShareInfo{"shares": list})
+}
+
+func (s *Cloud) createShare(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Path         string    `json:"path"`
+		Mode         ShareMode `json:"mode"`
+		Password     string    `json:"password"`
+		ExpiresIn    int64     `json:"expiresIn"` // seconds
+		MaxDownloads int       `json:"maxDownloads"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		errs.HTTPResponse(w, errs.E(OpShareCreate, errs.KindInvalid, "Invalid JSON"))
+		return
+	}
+
+	if req.Mode == "" {
+		req.Mode = ShareRead
+	}
+	if req.Mode != ShareRead && req.Mode != ShareDrop {
+		errs.HTTPResponse(w, errs.E(OpShareCreate, errs.KindInvalid, "mode must be 'read' or 'drop'"))
+		return
+	}
+	if req.ExpiresIn < 0 || req.MaxDownloads < 0 {
+		errs.HTTPResponse(w, errs.E(OpShareCreate, errs.KindInvalid, "expiresIn and maxDownloads must be positive"))
+		return
+	}
+
+	fullPath, err := secureJoin(s.DataDir, req.Path)
+	if err != nil {
+		http.Error(w, "Access Denied", http.StatusForbidden)
+		return
+	}
+	info, err := os.Stat(fullPath)
+	if err != nil {
+		errs.HTTPResponse(w, errs.E(OpShareCreate, errs.KindNotFound, "path does not exist"))
+		return
+	}
+	if req.Mode == ShareDrop && !info.IsDir() {
+		errs.HTTPResponse(w, errs.E(OpShareCreate, errs.KindInvalid, "file drop links must point to a folder"))
+		return
+	}
+
+	token, err := newShareToken()
+	if err != nil {
+		errs.HTTPResponse(w, errs.E(OpShareCreate, errs.KindSystem, err))
+		return
+	}
+
+	sh := &Share{
+		Token:        token,
+		Path:         filepath.ToSlash(strings.TrimPrefix(fullPath, s.DataDir)),
+		Mode:         req.Mode,
+		MaxDownloads: req.MaxDownloads,
+		CreatedAt:    time.Now().UTC(),
+	}
+	if req.ExpiresIn > 0 {
+		exp := sh.CreatedAt.Add(time.Duration(req.ExpiresIn) * time.Second)
+		sh.ExpiresAt = &exp
+	}
+	if req.Password != "" {
+		sh.PasswordHash, err = bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+		if err != nil {
+			errs.HTTPResponse(w, errs.E(OpShareCreate, errs.KindInvalid, "invalid password", err))
+			return
+		}
+	}
+
+	s.Shares.mu.Lock()
+	s.Shares.Shares[token] = sh
+	err = s.Shares.save()
+	resp := sh.info()
+	s.Shares.mu.Unlock()
+	if err != nil {
+		errs.HTTPResponse(w, err)
+		return
+	}
+
+	log.Printf("[SHARE] Created %s link for %s", sh.Mode, sh.Path)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *Cloud) revokeShare(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+
+	s.Shares.mu.Lock()
+	sh, ok := s.Shares.Shares[token]
+	if !ok {
+		s.Shares.mu.Unlock()
+		errs.HTTPResponse(w, errs.E(OpShareCreate, errs.KindNotFound, "share not found"))
+		return
+	}
+	now := time.Now().UTC()
+	sh.RevokedAt = &now
+	err := s.Shares.save()
+	s.Shares.mu.Unlock()
+	if err != nil {
+		errs.HTTPResponse(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "revoked"})
+}
+
+func (s *Cloud) handleShareLog(w http.ResponseWriter, r *http.Request) {
+	sh, ok := s.Shares.lookup(r.URL.Query().Get("token"))
+	if !ok {
+		errs.HTTPResponse(w, errs.E(OpShareCreate, errs.KindNotFound, "share not found"))
+		return
+	}
+
+	entries := sh.Log
+	if entries == nil {
+		entries = []ShareAccess{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]ShareAccess{"log": entries})
+}
+
+var sharePage = template.Must(template.New("share").Parse(templates.SharePage))
+
+type sharePageData struct {
+	Name         string
+	Base         string
+	IsDir        bool
+	Drop         bool
+	NeedPassword bool
+	Size         string
+	Expires      string
+	Error        string
+	Message      string
+	Files        []sharePageFile
+
+	status int // HTTP status, 200 if unset
+}
+
+type sharePageFile struct {
+	Name  string
+	Path  string
+	Size  string
+	IsDir bool
+}
+
+// handlePublicShare serves everything under /s/<token>: the landing page,
+// /dl for downloads and /upload for file drops.
+func (s *Cloud) handlePublicShare(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, "/s/")
+	token, action, _ := strings.Cut(rest, "/")
+
+	// A used-up link can still resume its last download; claim decides
+	sh, ok := s.Shares.lookup(token)
+	if !ok || !sh.open(time.Now()) || (action != "dl" && !sh.active(time.Now())) {
+		s.Shares.record(token, r, "denied", "")
+		http.Error(w, "This link does not exist or has expired", http.StatusNotFound)
+		return
+	}
+
+	base := "/s/" + token
+	root, err := shareJoin(s.DataDir, sh.Path)
+	if errors.Is(err, fs.ErrNotExist) {
+		http.Error(w, "The shared item no longer exists", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Access Denied", http.StatusForbidden)
+		return
+	}
+	info, err := os.Stat(root)
+	if err != nil {
+		http.Error(w, "The shared item no longer exists", http.StatusNotFound)
+		return
+	}
+
+	page := sharePageData{Name: info.Name(), Base: base, IsDir: info.IsDir(), Drop: sh.Mode == ShareDrop}
+	if sh.ExpiresAt != nil {
+		page.Expires = sh.ExpiresAt.Format("2 Jan 2006 15:04 MST")
+	}
+
+	if !s.shareUnlocked(w, r, sh, base) {
+		if r.Method == http.MethodPost && action == "" {
+			page.Error = "Wrong password"
+			if s.Shares.throttled(token, time.Now()) {
+				page.Error = "Too many wrong passwords. Please try again later."
+				page.status = http.StatusTooManyRequests
+			}
+			s.Shares.record(token, r, "denied", "")
+		}
+		page.NeedPassword = true
+		renderSharePage(w, page)
+		return
+	}
+	if r.Method == http.MethodPost && action == "" {
+		// Password accepted; switch back to GET so a refresh does not resubmit
+		http.Redirect(w, r, base, http.StatusSeeOther)
+		return
+	}
+
+	switch {
+	case action == "upload" && sh.Mode == ShareDrop:
+		s.shareUpload(w, r, sh, root, page)
+	case action == "dl" && sh.Mode == ShareRead:
+		s.shareDownload(w, r, sh, root, info)
+	case action == "" && sh.Mode == ShareDrop:
+		s.Shares.record(token, r, "view", "")
+		renderSharePage(w, page)
+	case action == "" && sh.Mode == ShareRead:
+		s.shareView(w, r, sh, root, info, page)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// shareUnlocked checks the password cookie, or the submitted password on POST.
+func (s *Cloud) shareUnlocked(w http.ResponseWriter, r *http.Request, sh Share, base string) bool {
+	if len(sh.PasswordHash) == 0 {
+		return true
+	}
+
+	want := s.Shares.cookieValue(sh)
+	if c, err := r.Cookie("strct_share"); err == nil {
+		if subtle.ConstantTimeCompare([]byte(c.Value), []byte(want)) == 1 {
+			return true
+		}
+	}
+
+	if r.Method != http.MethodPost || r.FormValue("password") == "" {
+		return false
+	}
+	if s.Shares.throttled(sh.Token, time.Now()) {
+		return false
+	}
+	if bcrypt.CompareHashAndPassword(sh.PasswordHash, []byte(r.FormValue("password"))) != nil {
+		s.Shares.passwordFailed(sh.Token, time.Now())
+		return false
+	}
+	s.Shares.passwordAccepted(sh.Token)
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     "strct_share",
+		Value:    want,
+		Path:     base,
+		HttpOnly: true,
+		Secure:   r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https",
+		SameSite: http.SameSiteLaxMode,
+	})
+	return true
+}
+
+func (s *Cloud) shareView(w http.ResponseWriter, r *http.Request, sh Share, root string, info os.FileInfo, page sharePageData) {
+	s.Shares.record(sh.Token, r, "view", "")
+
+	if !info.IsDir() {
+		page.Size = humanize.Bytes(info.Size())
+		renderSharePage(w, page)
+		return
+	}
+
+	sub := r.URL.Query().Get("path")
+	dir, err := shareJoin(root, sub)
+	if errors.Is(err, fs.ErrNotExist) {
+		http.Error(w, "Folder not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Access Denied", http.StatusForbidden)
+		return
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		http.Error(w, "Folder not found", http.StatusNotFound)
+		return
+	}
+	if sub != "" {
+		page.Name = filepath.Base(dir)
+	}
+
+	for _, e := range entries {
+		if fsx.IsTempName(e.Name()) {
+			continue
+		}
+		fi, err := e.Info()
+		if err != nil {
+			continue
+		}
+		item := sharePageFile{
+			Name:  e.Name(),
+			Path:  filepath.ToSlash(filepath.Join(sub, e.Name())),
+			IsDir: e.IsDir(),
+		}
+		if !e.IsDir() {
+			item.Size = humanize.Bytes(fi.Size())
+		}
+		page.Files = append(page.Files, item)
+	}
+	renderSharePage(w, page)
+}
+
+func (s *Cloud) shareDownload(w http.ResponseWriter, r *http.Request, sh Share, root string, info os.FileInfo) {
+	target := root
+	if info.IsDir() {
+		var err error
+		target, err = shareJoin(root, r.URL.Query().Get("path"))
+		if errors.Is(err, fs.ErrNotExist) || fsx.IsTempName(filepath.Base(target)) {
+			http.Error(w, "File not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Access Denied", http.StatusForbidden)
+			return
+		}
+	}
+
+	f, err := os.Open(target)
+	if err != nil {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil || fi.IsDir() {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+
+	// Every download is counted once, whether or not it asks for a range;
+	// the cookie lets the same download resume without counting again
+	file := strings.TrimPrefix(filepath.ToSlash(strings.TrimPrefix(target, root)), "/")
+	if !s.Shares.resuming(r, sh.Token, file) {
+		if !s.Shares.claim(sh.Token, r, file) {
+			http.Error(w, "This link does not exist or has expired", http.StatusNotFound)
+			return
+		}
+		expires := time.Now().Add(shareResume)
+		http.SetCookie(w, &http.Cookie{
+			Name:     "strct_dl",
+			Value:    fmt.Sprintf("%d.%s", expires.Unix(), s.Shares.resumeValue(sh.Token, file, expires.Unix())),
+			Path:     "/s/" + sh.Token + "/dl",
+			Expires:  expires,
+			HttpOnly: true,
+			Secure:   r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https",
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", fi.Name()))
+	http.ServeContent(w, r, fi.Name(), fi.ModTime(), f)
+}
+
+func (s *Cloud) shareUpload(w http.ResponseWriter, r *http.Request, sh Share, root string, page sharePageData) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	reader, err := r.MultipartReader()
+	if err != nil {
+		page.Error = "Invalid upload"
+		page.status = http.StatusBadRequest
+		renderSharePage(w, page)
+		return
+	}
+
+	count := 0
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			page.Error = "Upload interrupted"
+			break
+		}
+		if part.FormName() != "file" || part.FileName() == "" {
+			continue
+		}
+
+		dst, err := uniquePath(root, filepath.Base(part.FileName()))
+		if err != nil {
+			page.Error = "Invalid file name"
+			break
+		}
+		// The part's own size is unknown up front; the request can't be larger
+		if r.ContentLength > 0 && s.CheckQuota(dst, r.ContentLength) != nil {
+			os.Remove(dst)
+			page.Error = "There is not enough space left to accept this upload"
+			page.status = http.StatusInsufficientStorage
+			break
+		}
+		body, err := s.LimitUpload(dst, part)
+		if err == nil {
+			_, _, err = s.writeFile(dst, body, "")
+		}
+		if err != nil {
+			// Still the empty placeholder uniquePath reserved
+			os.Remove(dst)
+		}
+		if isQuota(err) {
+			page.Error = "There is not enough space left to accept this upload"
+			page.status = http.StatusInsufficientStorage
+			break
+		}
+		if err != nil {
+			page.Error = "Upload interrupted"
+			break
+		}
+
+		s.Shares.record(sh.Token, r, "upload", filepath.Base(dst))
+		count++
+	}
+
+	if count > 0 {
+		page.Message = fmt.Sprintf("%d file(s) uploaded. Thank you!", count)
+	}
+	renderSharePage(w, page)
+}
+
+// uniquePath reserves dir/name, or "name (n).ext" if that is already taken,
+// by creating it empty; the caller writes over it or removes it. Creating
+// the file is what claims the name, so two uploads cannot pick the same one.
+func uniquePath(dir, name string) (string, error) {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) || fsx.IsTempName(name) {
+		return "", fmt.Errorf("invalid file name %q", name)
+	}
+
+	candidate := filepath.Join(dir, name)
+	ext := filepath.Ext(name)
+	stem := strings.TrimSuffix(name, ext)
+	for i := 1; ; i++ {
+		f, err := os.OpenFile(candidate, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			return candidate, f.Close()
+		}
+		if !errors.Is(err, fs.ErrExist) {
+			return "", err
+		}
+		candidate = filepath.Join(dir, fmt.Sprintf("%s (%d)%s", stem, i, ext))
+	}
+}
+
+// shareJoin is secureJoin for share links, which also follows symlinks: the
+// resolved path has to stay inside within, so a link placed in a shared
+// folder cannot hand out files from anywhere else. It returns the unresolved
+// path, which callers keep using to name things.
+func shareJoin(within, userPath string) (string, error) {
+	full, err := secureJoin(within, userPath)
+	if err != nil {
+		return "", err
+	}
+	resolved, err := filepath.EvalSymlinks(full)
+	if err != nil {
+		return "", err
+	}
+	base, err := filepath.EvalSymlinks(within)
+	if err != nil {
+		return "", err
+	}
+	if resolved != base && !strings.HasPrefix(resolved, base+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s leaves the share", userPath)
+	}
+	return full, nil
+}
+
+func renderSharePage(w http.ResponseWriter, page sharePageData) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Robots-Tag", "noindex")
+	if page.status != 0 {
+		w.WriteHeader(page.status)
+	}
+	if err := sharePage.Execute(w, page); err != nil {
+		log.Printf("[SHARE] Template error: %v", err)
+	}
+}
@@ -0,0 +1,380 @@
+package cloud
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/fsx"
+)
+
+func newShareCloud(t *testing.T) *Cloud {
+	t.Helper()
+	c := newTestCloud(t)
+	shares, err := NewShareStore(filepath.Join(c.StateDir, "shares.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Shares = shares
+	os.MkdirAll(filepath.Join(c.DataDir, "docs"), 0755)
+	os.MkdirAll(filepath.Join(c.DataDir, "inbox"), 0755)
+	os.WriteFile(filepath.Join(c.DataDir, "docs", "a.txt"), []byte("hello world"), 0644)
+	return c
+}
+
+func createShare(t *testing.T, c *Cloud, body string) ShareInfo {
+	t.Helper()
+	w := httptest.NewRecorder()
+	c.handleShares(w, httptest.NewRequest(http.MethodPost, "/api/shares", strings.NewReader(body)))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create %s: %d %s", body, w.Code, w.Body)
+	}
+	var info ShareInfo
+	json.NewDecoder(w.Body).Decode(&info)
+	return info
+}
+
+func visitShare(c *Cloud, r *http.Request, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+	for _, ck := range cookies {
+		r.AddCookie(ck)
+	}
+	w := httptest.NewRecorder()
+	c.handlePublicShare(w, r)
+	return w
+}
+
+func cookie(w *httptest.ResponseRecorder, name string) *http.Cookie {
+	for _, ck := range w.Result().Cookies() {
+		if ck.Name == name {
+			return ck
+		}
+	}
+	return nil
+}
+
+func TestSharePassword(t *testing.T) {
+	c := newShareCloud(t)
+	sh := createShare(t, c, `{"path":"docs/a.txt","password":"open sesame"}`)
+
+	if w := visitShare(c, httptest.NewRequest(http.MethodGet, sh.URL, nil)); !strings.Contains(w.Body.String(), "password protected") {
+		t.Errorf("landing page without the password: %d %s", w.Code, w.Body)
+	}
+	if w := visitShare(c, httptest.NewRequest(http.MethodGet, sh.URL+"/dl", nil)); strings.Contains(w.Body.String(), "hello world") {
+		t.Error("downloaded without the password")
+	}
+
+	login := func(password string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, sh.URL, strings.NewReader(url.Values{"password": {password}}.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return visitShare(c, r)
+	}
+	if w := login("wrong"); !strings.Contains(w.Body.String(), "Wrong password") || cookie(w, "strct_share") != nil {
+		t.Errorf("wrong password: %d %s", w.Code, w.Body)
+	}
+	w := login("open sesame")
+	unlocked := cookie(w, "strct_share")
+	if w.Code != http.StatusSeeOther || unlocked == nil {
+		t.Fatalf("right password: %d", w.Code)
+	}
+	if w := visitShare(c, httptest.NewRequest(http.MethodGet, sh.URL+"/dl", nil), unlocked); w.Body.String() != "hello world" {
+		t.Errorf("download with the cookie: %d %q", w.Code, w.Body)
+	}
+
+	// A forged cookie opens nothing
+	forged := &http.Cookie{Name: "strct_share", Value: strings.Repeat("0", 64)}
+	if w := visitShare(c, httptest.NewRequest(http.MethodGet, sh.URL+"/dl", nil), forged); strings.Contains(w.Body.String(), "hello world") {
+		t.Error("downloaded with a forged cookie")
+	}
+}
+
+func TestSharePasswordThrottle(t *testing.T) {
+	c := newShareCloud(t)
+	sh := createShare(t, c, `{"path":"docs/a.txt","password":"open sesame"}`)
+	login := func(password string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, sh.URL, strings.NewReader(url.Values{"password": {password}}.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return visitShare(c, r)
+	}
+
+	for i := range shareFreeTries {
+		// The last free try already starts the wait
+		want := http.StatusOK
+		if i == shareFreeTries-1 {
+			want = http.StatusTooManyRequests
+		}
+		if w := login("wrong"); w.Code != want {
+			t.Fatalf("wrong password %d: %d, want %d", i+1, w.Code, want)
+		}
+	}
+	// Locked out now, even with the right password
+	if w := login("open sesame"); w.Code != http.StatusTooManyRequests || cookie(w, "strct_share") != nil {
+		t.Errorf("right password while throttled: %d", w.Code)
+	}
+	// Other links are not affected
+	other := createShare(t, c, `{"path":"docs/a.txt","password":"other"}`)
+	r := httptest.NewRequest(http.MethodPost, other.URL, strings.NewReader(url.Values{"password": {"other"}}.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if w := visitShare(c, r); w.Code != http.StatusSeeOther {
+		t.Errorf("another link: %d", w.Code)
+	}
+
+	c.Shares.mu.Lock()
+	c.Shares.tries[sh.Token].until = time.Now().Add(-time.Second)
+	c.Shares.mu.Unlock()
+	if w := login("open sesame"); w.Code != http.StatusSeeOther {
+		t.Errorf("right password after the wait: %d", w.Code)
+	}
+	if c.Shares.throttled(sh.Token, time.Now()) {
+		t.Error("still throttled after the right password")
+	}
+}
+
+func TestShareContents(t *testing.T) {
+	c := newShareCloud(t)
+	outside := filepath.Join(filepath.Dir(c.DataDir), "outside.txt")
+	os.WriteFile(outside, []byte("not shared"), 0644)
+	os.WriteFile(filepath.Join(c.DataDir, "private.txt"), []byte("not shared"), 0644)
+	os.WriteFile(filepath.Join(c.DataDir, "docs", fsx.TempPrefix+"half"), []byte("partial"), 0644)
+	if err := os.Symlink(outside, filepath.Join(c.DataDir, "docs", "escape")); err != nil {
+		t.Fatal(err)
+	}
+	os.Symlink(filepath.Join(c.DataDir, "private.txt"), filepath.Join(c.DataDir, "docs", "sibling"))
+	os.Symlink("a.txt", filepath.Join(c.DataDir, "docs", "inside"))
+	sh := createShare(t, c, `{"path":"docs"}`)
+
+	if w := visitShare(c, httptest.NewRequest(http.MethodGet, sh.URL, nil)); strings.Contains(w.Body.String(), fsx.TempPrefix) {
+		t.Errorf("listing shows a temp file: %s", w.Body)
+	}
+	tests := []struct {
+		path     string
+		wantCode int
+	}{
+		{"a.txt", http.StatusOK},
+		{"inside", http.StatusOK},
+		{"escape", http.StatusForbidden},
+		{"sibling", http.StatusForbidden},
+		{fsx.TempPrefix + "half", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		w := visitShare(c, httptest.NewRequest(http.MethodGet, sh.URL+"/dl?path="+url.QueryEscape(tt.path), nil))
+		if w.Code != tt.wantCode {
+			t.Errorf("download %q: %d, want %d", tt.path, w.Code, tt.wantCode)
+		}
+		if tt.wantCode != http.StatusOK && strings.Contains(w.Body.String(), "not shared") {
+			t.Errorf("download %q served the target", tt.path)
+		}
+	}
+	if w := visitShare(c, httptest.NewRequest(http.MethodGet, sh.URL+"?path=escape", nil)); w.Code != http.StatusForbidden {
+		t.Errorf("view through a link: %d", w.Code)
+	}
+}
+
+func TestUniquePath(t *testing.T) {
+	dir := t.TempDir()
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	picked := map[string]bool{}
+	for range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p, err := uniquePath(dir, "report.pdf")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if picked[p] {
+				t.Errorf("%s handed out twice", p)
+			}
+			picked[p] = true
+		}()
+	}
+	wg.Wait()
+	if len(picked) != 20 {
+		t.Errorf("%d names for 20 uploads", len(picked))
+	}
+	if _, err := uniquePath(dir, fsx.TempPrefix+"x"); err == nil {
+		t.Error("accepted a temp file name")
+	}
+}
+
+func TestShareExpiry(t *testing.T) {
+	c := newShareCloud(t)
+	sh := createShare(t, c, `{"path":"docs","expiresIn":3600}`)
+	if w := visitShare(c, httptest.NewRequest(http.MethodGet, sh.URL, nil)); w.Code != http.StatusOK {
+		t.Fatalf("open link: %d", w.Code)
+	}
+
+	c.Shares.mu.Lock()
+	past := time.Now().Add(-time.Minute)
+	c.Shares.Shares[sh.Token].ExpiresAt = &past
+	c.Shares.mu.Unlock()
+	for _, p := range []string{"", "/dl?path=a.txt"} {
+		if w := visitShare(c, httptest.NewRequest(http.MethodGet, sh.URL+p, nil)); w.Code != http.StatusNotFound {
+			t.Errorf("expired %q: %d", p, w.Code)
+		}
+	}
+
+	// Refused hits are logged without rewriting shares.json every time
+	saved, _ := os.ReadFile(c.Shares.Path)
+	for range 5 {
+		visitShare(c, httptest.NewRequest(http.MethodGet, sh.URL, nil))
+	}
+	if now, _ := os.ReadFile(c.Shares.Path); !bytes.Equal(saved, now) {
+		t.Error("every refused hit rewrote shares.json")
+	}
+	if s, _ := c.Shares.lookup(sh.Token); len(s.Log) != 8 || s.Log[0].Action != "view" || s.Log[7].Action != "denied" {
+		t.Errorf("log %+v", s.Log)
+	}
+}
+
+func TestShareDownloadLimit(t *testing.T) {
+	c := newShareCloud(t)
+
+	t.Run("counted", func(t *testing.T) {
+		sh := createShare(t, c, `{"path":"docs","maxDownloads":2}`)
+		for i, want := range []int{http.StatusOK, http.StatusOK, http.StatusNotFound} {
+			if w := visitShare(c, httptest.NewRequest(http.MethodGet, sh.URL+"/dl?path=a.txt", nil)); w.Code != want {
+				t.Errorf("download %d: %d, want %d", i+1, w.Code, want)
+			}
+		}
+		// The count is on disk at once, so a restart does not reset it
+		restarted, err := NewShareStore(c.Shares.Path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s, _ := restarted.lookup(sh.Token); s.Downloads != 2 {
+			t.Errorf("saved downloads %d", s.Downloads)
+		}
+	})
+
+	t.Run("range", func(t *testing.T) {
+		sh := createShare(t, c, `{"path":"docs/a.txt","maxDownloads":1}`)
+		get := func(rng string, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+			r := httptest.NewRequest(http.MethodGet, sh.URL+"/dl", nil)
+			r.Header.Set("Range", rng)
+			return visitShare(c, r, cookies...)
+		}
+		w := get("bytes=0-4")
+		resume := cookie(w, "strct_dl")
+		if w.Code != http.StatusPartialContent || w.Body.String() != "hello" || resume == nil {
+			t.Fatalf("first range: %d %q", w.Code, w.Body)
+		}
+		if w := get("bytes=5-", resume); w.Code != http.StatusPartialContent || w.Body.String() != " world" {
+			t.Errorf("resume: %d %q", w.Code, w.Body)
+		}
+		if w := get("bytes=0-"); w.Code != http.StatusNotFound {
+			t.Errorf("range without the resume cookie: %d", w.Code)
+		}
+		if w := visitShare(c, httptest.NewRequest(http.MethodGet, sh.URL+"/dl", nil), resume); w.Code != http.StatusNotFound {
+			t.Errorf("whole file again with the resume cookie: %d", w.Code)
+		}
+		// The cookie is for one file of one link
+		other := createShare(t, c, `{"path":"docs/a.txt","maxDownloads":1}`)
+		visitShare(c, httptest.NewRequest(http.MethodGet, other.URL+"/dl", nil))
+		r := httptest.NewRequest(http.MethodGet, other.URL+"/dl", nil)
+		r.Header.Set("Range", "bytes=0-")
+		if w := visitShare(c, r, resume); w.Code != http.StatusNotFound {
+			t.Errorf("cookie of another link: %d", w.Code)
+		}
+		if s, _ := c.Shares.lookup(sh.Token); s.Downloads != 1 {
+			t.Errorf("downloads %d", s.Downloads)
+		}
+	})
+
+	t.Run("concurrent", func(t *testing.T) {
+		sh := createShare(t, c, `{"path":"docs/a.txt","maxDownloads":1}`)
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		served := 0
+		for range 20 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				r := httptest.NewRequest(http.MethodGet, sh.URL+"/dl", nil)
+				r.Header.Set("Range", "bytes=0-")
+				if w := visitShare(c, r); w.Code < 300 {
+					mu.Lock()
+					served++
+					mu.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+		if served != 1 {
+			t.Errorf("%d downloads of a single-download link", served)
+		}
+	})
+}
+
+func TestShareDrop(t *testing.T) {
+	c := newShareCloud(t)
+	sh := createShare(t, c, `{"path":"inbox","mode":"drop"}`)
+	os.WriteFile(filepath.Join(c.DataDir, "inbox", "private.txt"), []byte("secret"), 0644)
+
+	upload := func(name, content string) *httptest.ResponseRecorder {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		fw, _ := mw.CreateFormFile("file", name)
+		fw.Write([]byte(content))
+		mw.Close()
+		r := httptest.NewRequest(http.MethodPost, sh.URL+"/upload", &body)
+		r.Header.Set("Content-Type", mw.FormDataContentType())
+		return visitShare(c, r)
+	}
+	for _, content := range []string{"first", "second"} {
+		if w := upload("report.pdf", content); !strings.Contains(w.Body.String(), "1 file(s) uploaded") {
+			t.Errorf("upload: %d %s", w.Code, w.Body)
+		}
+	}
+	if got, _ := os.ReadFile(filepath.Join(c.DataDir, "inbox", "report (1).pdf")); string(got) != "second" {
+		t.Errorf("second upload with the same name: %q", got)
+	}
+	if w := upload("../escape.txt", "x"); !strings.Contains(w.Body.String(), "1 file(s) uploaded") {
+		t.Errorf("upload with a path: %d", w.Code)
+	}
+	if _, err := os.Stat(filepath.Join(c.DataDir, "escape.txt")); err == nil {
+		t.Error("upload escaped the folder")
+	}
+
+	// Nothing in the folder can be listed or downloaded
+	if w := visitShare(c, httptest.NewRequest(http.MethodGet, sh.URL, nil)); strings.Contains(w.Body.String(), "private.txt") {
+		t.Error("drop link lists the folder")
+	}
+	if w := visitShare(c, httptest.NewRequest(http.MethodGet, sh.URL+"/dl?path=private.txt", nil)); w.Code != http.StatusNotFound {
+		t.Errorf("download from a drop link: %d", w.Code)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		remote, forwarded, want string
+	}{
+		{"203.0.113.5:4000", "", "203.0.113.5"},
+		{"203.0.113.5:4000", "10.0.0.1", "203.0.113.5"},
+		{"127.0.0.1:4000", "", "127.0.0.1"},
+		{"127.0.0.1:4000", "198.51.100.7", "198.51.100.7"},
+		{"127.0.0.1:4000", "10.0.0.1, 198.51.100.7", "198.51.100.7"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/s/x", nil)
+		r.RemoteAddr = tt.remote
+		if tt.forwarded != "" {
+			r.Header.Set("X-Forwarded-For", tt.forwarded)
+		}
+		if got := clientIP(r); got != tt.want {
+			t.Errorf("%s forwarded %q: %s, want %s", tt.remote, tt.forwarded, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,1103 @@
+package cloud
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/errs"
+	"github.com/strct-org/strct-agent/internal/fsx"
+	"github.com/strct-org/strct-agent/pkg/delta"
+)
+
+const (
+	OpSync        errs.Op = "cloud.handleSync"
+	OpJournalSave errs.Op = "cloud.Journal.save"
+)
+
+const (
+	defaultSyncLimit = 1000
+	maxSyncLimit     = 10000
+
+	// maxSignatureBody bounds the signature a client may post with a
+	// download; 128 MiB of file per 1 KiB block comes to about 4 MiB.
+	maxSignatureBody = 32 << 20
+
+	// An upload cut short after minResumeSize bytes is kept for a while,
+	// and a retry of the same content uses it as part of its delta base.
+	minResumeSize     = 1 << 20
+	syncPartialTTL    = 7 * 24 * time.Hour
+	syncPartialPrefix = fsx.TempPrefix + "sync-"
+
+	DeltaContentType  = "application/vnd.strct.delta"
+	SyncVersionHeader = "X-Sync-Version"
+)
+
+var errSyncConflict = errors.New("file changed on the server since the client last synced it")
+
+// SyncEntry is the journal's record of one file. Version is the journal
+// cursor at the file's latest change, so it only ever grows and a client
+// can use it as the base for conditional writes. Folders are not tracked;
+// they exist on either side because of the files in them.
+type SyncEntry struct {
+	Version int64     `json:"version"`
+	Path    string    `json:"path"` // relative to DataDir, forward slashes
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modifiedAt"` // when it was deleted, for tombstones
+	SHA256  string    `json:"sha256,omitempty"`
+	Deleted bool      `json:"deleted,omitempty"`
+}
+
+type SyncChangesResponse struct {
+	Changes []SyncEntry `json:"changes"`
+	Cursor  int64       `json:"cursor"` // pass back as ?cursor= next time
+	More    bool        `json:"more"`
+	// Reset means the client's cursor predates tombstones that have since
+	// been pruned: this is a full listing and anything the client knows
+	// that is not in it was deleted.
+	Reset   bool `json:"reset,omitempty"`
+	Pending int  `json:"pending"` // changed files not hashed yet
+}
+
+type SyncSignatureResponse struct {
+	Entry     SyncEntry        `json:"entry"`
+	Signature *delta.Signature `json:"signature"`
+}
+
+type SyncConflictResponse struct {
+	Error   string     `json:"error"`
+	Current *SyncEntry `json:"current,omitempty"`
+}
+
+// Journal is the change log that desktop clients sync against. Every file
+// below Root has an entry carrying its size, mtime and SHA-256, stamped with
+// a monotonic cursor each time it changes; deletions leave tombstones so a
+// client that was offline still hears about them.
+//
+// Changes are appended to a log as they happen and folded into a snapshot
+// from time to time, so a crash never loses a cursor a client has already
+// seen. Files written through the agent have a known digest and are
+// journaled immediately; anything else is hashed in the background.
+type Journal struct {
+	Root string
+	Dir  string
+
+	TombstoneTTL time.Duration
+	CompactEvery int           // log entries between snapshots
+	Throttle     time.Duration // pause after hashing each file
+
+	// Offline reports whether fullPath is on storage that is not mounted
+	// right now. Hashing waits for it, and a file missing there is not
+	// gone, so it never becomes a tombstone.
+	Offline func(fullPath string) bool
+
+	digests *digestStore
+
+	mu      sync.Mutex
+	seq     int64
+	horizon int64 // highest version of a pruned tombstone
+	files   map[string]SyncEntry
+	pending map[string]bool
+	queued  bool // pending changed since the last snapshot
+	logFile *os.File
+	logged  int
+	wake    chan struct{}
+
+	// writeMu is held from the version check to the commit of a sync
+	// write, so two clients cannot both win against the same base.
+	writeMu sync.Mutex
+}
+
+type journalSnapshot struct {
+	Seq     int64       `json:"seq"`
+	Horizon int64       `json:"horizon"`
+	Files   []SyncEntry `json:"files"`
+	Pending []string    `json:"pending,omitempty"` // still to be hashed
+}
+
+func NewJournal(root, dir string, digests *digestStore) *Journal {
+	return &Journal{
+		Root:         root,
+		Dir:          dir,
+		TombstoneTTL: 90 * 24 * time.Hour,
+		CompactEvery: 5000,
+		Throttle:     50 * time.Millisecond,
+		digests:      digests,
+		files:        make(map[string]SyncEntry),
+		pending:      make(map[string]bool),
+		wake:         make(chan struct{}, 1),
+	}
+}
+
+// Start loads the journal and hashes queued files as they come in. The
+// Walker keeps it in step with the drive.
+func (j *Journal) Start() error {
+	if err := j.load(); err != nil {
+		log.Printf("[SYNC] Could not load journal, rebuilding: %v", err)
+	}
+
+	go func() {
+		ctx := context.Background()
+		tick := time.NewTicker(time.Minute)
+		defer tick.Stop()
+		for {
+			j.Process(ctx)
+			select {
+			case <-j.wake:
+			case <-tick.C:
+				j.prune(time.Now())
+				if err := j.compact(); err != nil {
+					log.Printf("[SYNC] %v", err)
+				}
+			}
+		}
+	}()
+
+	return nil
+}
+
+// visit catches changes made behind the agent's back: files that are new
+// or differ in size or mtime are queued for hashing. Sync uploads abandoned
+// long ago are cleaned up.
+func (j *Journal) visit(rel, full string, info fs.FileInfo) {
+	if !info.Mode().IsRegular() {
+		return
+	}
+	if fsx.IsTempName(info.Name()) {
+		if strings.HasPrefix(info.Name(), syncPartialPrefix) && time.Since(info.ModTime()) > syncPartialTTL {
+			os.Remove(full)
+		}
+		return
+	}
+	j.observe(rel, full, info)
+}
+
+// reconcile turns entries whose file is gone into tombstones.
+func (j *Journal) reconcile(seen *walked) {
+	now := time.Now()
+	j.mu.Lock()
+	for rel, e := range j.files {
+		if !seen.has(rel) && !e.Deleted {
+			j.record(SyncEntry{Path: rel, ModTime: now, Deleted: true})
+		}
+	}
+	for rel := range j.pending {
+		if !seen.has(rel) {
+			delete(j.pending, rel)
+			j.queued = true
+		}
+	}
+	n := len(j.pending)
+	j.mu.Unlock()
+
+	if n > 0 {
+		log.Printf("[SYNC] %d files to hash", n)
+	}
+	j.signal()
+}
+
+// Update journals a written file, or every file below a written folder.
+func (j *Journal) Update(fullPath string) {
+	info, err := os.Stat(fullPath)
+	if err != nil {
+		j.Remove(fullPath)
+		return
+	}
+
+	if !info.IsDir() {
+		if info.Mode().IsRegular() && !fsx.IsTempName(info.Name()) {
+			j.observe(j.rel(fullPath), fullPath, info)
+			j.signal()
+		}
+		return
+	}
+
+	filepath.WalkDir(fullPath, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() || fsx.IsTempName(d.Name()) {
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			j.observe(j.rel(p), p, info)
+		}
+		return nil
+	})
+	j.signal()
+}
+
+// Remove leaves tombstones for a deleted file or everything below a
+// deleted folder.
+func (j *Journal) Remove(fullPath string) {
+	rel := j.rel(fullPath)
+	prefix := rel + "/"
+	now := time.Now()
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	for p, e := range j.files {
+		if (p == rel || strings.HasPrefix(p, prefix)) && !e.Deleted {
+			j.record(SyncEntry{Path: p, ModTime: now, Deleted: true})
+		}
+	}
+	for p := range j.pending {
+		if p == rel || strings.HasPrefix(p, prefix) {
+			delete(j.pending, p)
+			j.queued = true
+		}
+	}
+}
+
+// Version is the cursor of the latest change.
+func (j *Journal) Version() int64 {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.seq
+}
+
+// Live returns the entries of the files that exist, leaving out tombstones.
+func (j *Journal) Live() []SyncEntry {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	out := make([]SyncEntry, 0, len(j.files))
+	for _, e := range j.files {
+		if !e.Deleted {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+// Pending is the number of changed files waiting to be hashed.
+func (j *Journal) Pending() int {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return len(j.pending)
+}
+
+// Process hashes queued files until the queue is empty or ctx is done.
+func (j *Journal) Process(ctx context.Context) {
+	for ctx.Err() == nil && !j.offline(j.Root) {
+		rel, ok := j.next()
+		if !ok {
+			return
+		}
+		if err := j.hash(rel); err != nil && !os.IsNotExist(err) {
+			log.Printf("[SYNC] %s: %v", rel, err)
+		}
+		if j.Throttle > 0 {
+			select {
+			case <-ctx.Done():
+			case <-time.After(j.Throttle):
+			}
+		}
+	}
+}
+
+func (j *Journal) next() (string, bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for rel := range j.pending {
+		return rel, true
+	}
+	return "", false
+}
+
+func (j *Journal) signal() {
+	select {
+	case j.wake <- struct{}{}:
+	default:
+	}
+}
+
+// observe journals a file right away when its digest is already known and
+// queues it for hashing otherwise. Unchanged files are left alone.
+func (j *Journal) observe(rel, full string, info fs.FileInfo) {
+	if rel == "" {
+		return
+	}
+	j.mu.Lock()
+	e, ok := j.files[rel]
+	j.mu.Unlock()
+	if ok && !e.Deleted && sameFile(e, info) {
+		return
+	}
+	sum := j.digests.get(full, info)
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if sum == "" {
+		if !j.pending[rel] {
+			j.pending[rel] = true
+			j.queued = true
+		}
+		return
+	}
+	if e, ok := j.files[rel]; ok && !e.Deleted && sameFile(e, info) {
+		return
+	}
+	j.record(SyncEntry{Path: rel, Size: info.Size(), ModTime: info.ModTime(), SHA256: sum})
+}
+
+func sameFile(e SyncEntry, info fs.FileInfo) bool {
+	return e.Size == info.Size() && e.ModTime.Equal(info.ModTime())
+}
+
+// hash reads one file and journals it. A file that changes while it is
+// being read stays queued for another go.
+func (j *Journal) hash(rel string) error {
+	full := filepath.Join(j.Root, filepath.FromSlash(rel))
+	f, err := os.Open(full)
+	if err != nil {
+		j.mu.Lock()
+		delete(j.pending, rel)
+		j.queued = true
+		j.mu.Unlock()
+		// Queued again by the rescan once its drive is back
+		if os.IsNotExist(err) && !j.offline(full) {
+			j.Remove(full)
+		}
+		return err
+	}
+	defer f.Close()
+
+	before, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	after, err := os.Stat(full)
+	if err != nil || !sameInfo(before, after) {
+		return err
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+	j.digests.put(full, sum)
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	delete(j.pending, rel)
+	j.queued = true
+	if e, ok := j.files[rel]; ok && !e.Deleted && e.SHA256 == sum && sameFile(e, after) {
+		return nil
+	}
+	j.record(SyncEntry{Path: rel, Size: after.Size(), ModTime: after.ModTime(), SHA256: sum})
+	return nil
+}
+
+func sameInfo(a, b fs.FileInfo) bool {
+	return a.Size() == b.Size() && a.ModTime().Equal(b.ModTime())
+}
+
+// current returns the entry for rel after making sure it describes what is
+// on disk right now, hashing the file if the journal has not caught up.
+func (j *Journal) current(rel string) (SyncEntry, bool, error) {
+	full := filepath.Join(j.Root, filepath.FromSlash(rel))
+	info, err := os.Stat(full)
+	e, ok := j.Entry(rel)
+	switch {
+	case os.IsNotExist(err) && j.offline(full):
+		return SyncEntry{}, false, errs.E(OpSync, errs.KindNotFound, "Storage is offline")
+	case os.IsNotExist(err):
+		if ok && !e.Deleted {
+			j.Remove(full)
+			e, ok = j.Entry(rel)
+		}
+		return e, ok, nil
+	case err != nil:
+		return SyncEntry{}, false, err
+	case !info.Mode().IsRegular():
+		return SyncEntry{}, false, errs.E(OpSync, errs.KindInvalid, "Not a file")
+	case ok && !e.Deleted && sameFile(e, info):
+		return e, true, nil
+	}
+	if err := j.hash(rel); err != nil {
+		return SyncEntry{}, false, err
+	}
+	e, ok = j.Entry(rel)
+	return e, ok, nil
+}
+
+// Entry is the latest journal entry for a path, tombstones included.
+func (j *Journal) Entry(rel string) (SyncEntry, bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	e, ok := j.files[rel]
+	return e, ok
+}
+
+// Changes lists entries that changed after cursor, oldest change first. A
+// zero cursor lists every live file.
+func (j *Journal) Changes(cursor int64, limit int) SyncChangesResponse {
+	return j.ChangesIn("", cursor, limit)
+}
+
+// ChangesIn is Changes restricted to the files below folder.
+func (j *Journal) ChangesIn(folder string, cursor int64, limit int) SyncChangesResponse {
+	prefix := ""
+	if folder != "" {
+		prefix = folder + "/"
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	resp := SyncChangesResponse{Pending: len(j.pending)}
+	if cursor > j.seq {
+		// The journal was rebuilt from scratch; the client's cursor means nothing here
+		cursor = 0
+		resp.Reset = true
+	}
+	if cursor > 0 && cursor < j.horizon {
+		cursor = 0
+		resp.Reset = true
+	}
+
+	list := make([]SyncEntry, 0)
+	for _, e := range j.files {
+		if e.Version > cursor && !(cursor == 0 && e.Deleted) && strings.HasPrefix(e.Path, prefix) {
+			list = append(list, e)
+		}
+	}
+	sort.Slice(list, func(a, b int) bool { return list[a].Version < list[b].Version })
+
+	resp.Cursor = j.seq
+	if len(list) > limit {
+		list = list[:limit]
+		resp.More = true
+		resp.Cursor = list[len(list)-1].Version
+	}
+	resp.Changes = list
+	return resp
+}
+
+// record stamps e with the next cursor and appends it to the log. The
+// caller holds j.mu.
+func (j *Journal) record(e SyncEntry) {
+	j.seq++
+	e.Version = j.seq
+	j.files[e.Path] = e
+	delete(j.pending, e.Path)
+
+	if err := j.appendLog(e); err != nil {
+		log.Printf("[SYNC] Journal write: %v", err)
+	}
+	if j.CompactEvery > 0 && j.logged >= j.CompactEvery {
+		if err := j.compactLocked(); err != nil {
+			log.Printf("[SYNC] %v", err)
+		}
+	}
+}
+
+func (j *Journal) appendLog(e SyncEntry) error {
+	if j.logFile == nil {
+		if err := os.MkdirAll(j.Dir, 0755); err != nil {
+			return err
+		}
+		f, err := os.OpenFile(j.logPath(), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		j.logFile = f
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	j.logged++
+	_, err = j.logFile.Write(append(data, '\n'))
+	return err
+}
+
+// prune forgets tombstones older than TombstoneTTL. Clients whose cursor
+// is older than the newest of them get a full listing instead.
+func (j *Journal) prune(now time.Time) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	pruned := false
+	for rel, e := range j.files {
+		if e.Deleted && now.Sub(e.ModTime) > j.TombstoneTTL {
+			delete(j.files, rel)
+			j.horizon = max(j.horizon, e.Version)
+			pruned = true
+		}
+	}
+	if pruned {
+		if err := j.compactLocked(); err != nil {
+			log.Printf("[SYNC] %v", err)
+		}
+	}
+}
+
+func (j *Journal) snapshotPath() string { return filepath.Join(j.Dir, "journal.json") }
+func (j *Journal) logPath() string      { return filepath.Join(j.Dir, "journal.log") }
+
+func (j *Journal) compact() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.logged == 0 && !j.queued {
+		return nil
+	}
+	return j.compactLocked()
+}
+
+// compactLocked writes a snapshot and empties the log. The snapshot carries
+// the cursor, so log entries that survive a crash in between are skipped
+// on load, and the hash queue, so a restart does not have to wait for a
+// rescan to find it again.
+func (j *Journal) compactLocked() error {
+	snap := journalSnapshot{Seq: j.seq, Horizon: j.horizon, Files: make([]SyncEntry, 0, len(j.files))}
+	for _, e := range j.files {
+		snap.Files = append(snap.Files, e)
+	}
+	for rel := range j.pending {
+		snap.Pending = append(snap.Pending, rel)
+	}
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return errs.E(OpJournalSave, errs.KindIO, err)
+	}
+	if err := writeFileAtomic(j.snapshotPath(), data); err != nil {
+		return errs.E(OpJournalSave, errs.KindIO, err)
+	}
+	if err := os.Truncate(j.logPath(), 0); err != nil && !os.IsNotExist(err) {
+		return errs.E(OpJournalSave, errs.KindIO, err)
+	}
+	j.logged = 0
+	j.queued = false
+	return nil
+}
+
+func (j *Journal) load() error {
+	var snap journalSnapshot
+	if data, err := os.ReadFile(j.snapshotPath()); err == nil {
+		if err := json.Unmarshal(data, &snap); err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.seq, j.horizon = snap.Seq, snap.Horizon
+	j.files = make(map[string]SyncEntry, len(snap.Files))
+	for _, e := range snap.Files {
+		j.files[e.Path] = e
+	}
+	for _, rel := range snap.Pending {
+		j.pending[rel] = true
+	}
+
+	f, err := os.Open(j.logPath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 1<<20)
+	for sc.Scan() {
+		var e SyncEntry
+		if json.Unmarshal(sc.Bytes(), &e) != nil {
+			// A torn last line from a crash mid-write; what came before is good
+			break
+		}
+		if e.Version > j.seq {
+			j.files[e.Path] = e
+			j.seq = e.Version
+			j.logged++
+		}
+	}
+	return nil
+}
+
+func (j *Journal) offline(fullPath string) bool {
+	return j.Offline != nil && j.Offline(fullPath)
+}
+
+func (j *Journal) rel(fullPath string) string {
+	rel, err := filepath.Rel(j.Root, fullPath)
+	if err != nil || rel == "." {
+		return ""
+	}
+	return filepath.ToSlash(rel)
+}
+
+func (s *Cloud) handleSyncChanges(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+
+	var cursor int64
+	if v := q.Get("cursor"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			errs.HTTPResponse(w, errs.E(OpSync, errs.KindInvalid, "cursor must be a non-negative integer"))
+			return
+		}
+		cursor = n
+	}
+	limit := defaultSyncLimit
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			errs.HTTPResponse(w, errs.E(OpSync, errs.KindInvalid, "limit must be a positive integer"))
+			return
+		}
+		limit = min(n, maxSyncLimit)
+	}
+
+	scope, err := syncScopeOf(r)
+	if err != nil {
+		errs.HTTPResponse(w, err)
+		return
+	}
+	resp := s.Journal.ChangesIn(string(scope), cursor, limit)
+	for i := range resp.Changes {
+		resp.Changes[i] = scope.entry(resp.Changes[i])
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// syncScope confines a client to one folder of DataDir (?root=), as peer
+// replication does. Paths in its requests and in the replies it gets are
+// relative to that folder; the empty scope is DataDir itself.
+type syncScope string
+
+func syncScopeOf(r *http.Request) (syncScope, error) {
+	root := strings.Trim(path.Clean("/"+r.URL.Query().Get("root")), "/")
+	for _, seg := range strings.Split(root, "/") {
+		if fsx.IsTempName(seg) {
+			return "", errs.E(OpSync, errs.KindInvalid, "root must name a folder")
+		}
+	}
+	return syncScope(root), nil
+}
+
+func (sc syncScope) entry(e SyncEntry) SyncEntry {
+	if sc != "" {
+		e.Path = strings.TrimPrefix(e.Path, string(sc)+"/")
+	}
+	return e
+}
+
+// syncTarget resolves ?path= (within ?root=) to a file the journal can
+// track.
+func (s *Cloud) syncTarget(r *http.Request) (string, string, syncScope, error) {
+	scope, err := syncScopeOf(r)
+	if err != nil {
+		return "", "", "", err
+	}
+	p := path.Join(string(scope), path.Clean("/"+r.URL.Query().Get("path")))
+	full, err := secureJoin(s.DataDir, p)
+	if err != nil {
+		return "", "", "", errs.E(OpSync, errs.KindForbidden, err, "Access Denied")
+	}
+	if full == s.DataDir || p == string(scope) || fsx.IsTempName(filepath.Base(full)) {
+		return "", "", "", errs.E(OpSync, errs.KindInvalid, "path must name a file")
+	}
+	return s.Journal.rel(full), full, scope, nil
+}
+
+// syncPartialPath is where an interrupted upload of content sum to full
+// waits for its retry.
+func syncPartialPath(full, sum string) string {
+	return filepath.Join(filepath.Dir(full), syncPartialPrefix+sum+".part")
+}
+
+// syncBase opens the delta base for a write of content sum to full: the
+// kept partial of an earlier attempt at that content, if any, followed by
+// the live file. The caller closes the returned files.
+func syncBase(full, sum string, live bool) (*io.SectionReader, []*os.File, error) {
+	var names []string
+	if sum != "" {
+		if _, err := os.Stat(syncPartialPath(full, sum)); err == nil {
+			names = append(names, syncPartialPath(full, sum))
+		}
+	}
+	if live {
+		names = append(names, full)
+	}
+	var parts []*io.SectionReader
+	var files []*os.File
+	for _, name := range names {
+		f, err := os.Open(name)
+		if err != nil {
+			closeAll(files)
+			return nil, nil, err
+		}
+		files = append(files, f)
+		info, err := f.Stat()
+		if err != nil {
+			closeAll(files)
+			return nil, nil, err
+		}
+		parts = append(parts, io.NewSectionReader(f, 0, info.Size()))
+	}
+	return delta.Join(parts...), files, nil
+}
+
+// handleSyncSignature describes the server's copy of a file in blocks, so
+// a client can upload only what it changed. With ?sha256= it describes the
+// leftovers of an interrupted upload of that content followed by the file,
+// and answers even when only the leftovers exist.
+func (s *Cloud) handleSyncSignature(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	rel, full, scope, err := s.syncTarget(r)
+	if err != nil {
+		errs.HTTPResponse(w, err)
+		return
+	}
+	// With ?sha256= the signature also covers what an interrupted upload of
+	// that content left behind, so the retry can skip it
+	var sum string
+	if v := r.URL.Query().Get("sha256"); v != "" {
+		if sum, err = parseHexDigest(v); err != nil {
+			errs.HTTPResponse(w, err)
+			return
+		}
+	}
+	e, ok, err := s.Journal.current(rel)
+	if err != nil {
+		errs.HTTPResponse(w, errs.E(OpSync, errs.KindIO, err, "Could not read file"))
+		return
+	}
+	live := ok && !e.Deleted
+	if !live {
+		if _, err := os.Stat(syncPartialPath(full, sum)); sum == "" || err != nil {
+			errs.HTTPResponse(w, errs.E(OpSync, errs.KindNotFound, "File not found"))
+			return
+		}
+		e = SyncEntry{Path: rel}
+	}
+
+	base, files, err := syncBase(full, sum, live)
+	if err != nil {
+		errs.HTTPResponse(w, errs.E(OpSync, errs.KindIO, err, "Could not read file"))
+		return
+	}
+	defer closeAll(files)
+	sig, err := delta.Sign(bufio.NewReader(base), delta.BlockSizeFor(base.Size()))
+	if err != nil {
+		errs.HTTPResponse(w, errs.E(OpSync, errs.KindIO, err, "Could not read file"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(SyncSignatureResponse{Entry: scope.entry(e), Signature: sig})
+}
+
+func closeAll(files []*os.File) {
+	for _, f := range files {
+		f.Close()
+	}
+}
+
+// handleSyncDownload sends the server's copy of a file as a delta against
+// the signature of the client's copy in the request body. Without a body
+// the delta is the whole file.
+func (s *Cloud) handleSyncDownload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	rel, full, _, err := s.syncTarget(r)
+	if err != nil {
+		errs.HTTPResponse(w, err)
+		return
+	}
+
+	var sig *delta.Signature
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxSignatureBody+1))
+	if err != nil || len(body) > maxSignatureBody {
+		errs.HTTPResponse(w, errs.E(OpSync, errs.KindInvalid, "Signature too large"))
+		return
+	}
+	if len(bytes.TrimSpace(body)) > 0 {
+		sig = new(delta.Signature)
+		if err := json.Unmarshal(body, sig); err != nil {
+			errs.HTTPResponse(w, errs.E(OpSync, errs.KindInvalid, err, "Malformed signature"))
+			return
+		}
+		// The delta is streamed, so a bad signature has to be caught up front
+		if err := sig.Validate(); err != nil {
+			errs.HTTPResponse(w, errs.E(OpSync, errs.KindInvalid, err, "Malformed signature"))
+			return
+		}
+	}
+
+	e, ok, err := s.Journal.current(rel)
+	if err != nil {
+		errs.HTTPResponse(w, errs.E(OpSync, errs.KindIO, err, "Could not read file"))
+		return
+	}
+	if !ok || e.Deleted {
+		errs.HTTPResponse(w, errs.E(OpSync, errs.KindNotFound, "File not found"))
+		return
+	}
+	f, err := os.Open(full)
+	if err != nil {
+		errs.HTTPResponse(w, errs.E(OpSync, errs.KindIO, err, "Could not read file"))
+		return
+	}
+	defer f.Close()
+
+	w.Header().Set("Content-Type", DeltaContentType)
+	w.Header().Set(SyncVersionHeader, strconv.FormatInt(e.Version, 10))
+	setDigestHeader(w, e.SHA256)
+	if err := delta.Delta(sig, bufio.NewReader(f), w); err != nil {
+		log.Printf("[SYNC] Download of %s failed: %v", rel, err)
+	}
+}
+
+// handleSyncUpload applies a delta against the server's copy of a file.
+// ?base= is the version the client's edit started from (0 for a new
+// file), ?sha256= and ?size= the digest and size of the result. If the
+// file has moved on
+// since base the write is refused with 409; the client then sends its
+// version again with ?conflict=1 and it is stored as a conflict copy next
+// to the original. An upload cut off after the first MiB is kept, and a
+// retry signed with ?sha256= (sent with resume=1) only sends the rest.
+func (s *Cloud) handleSyncUpload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost && r.Method != http.MethodPut {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	rel, full, scope, err := s.syncTarget(r)
+	if err != nil {
+		errs.HTTPResponse(w, err)
+		return
+	}
+	expected, err := parseHexDigest(q.Get("sha256"))
+	if err != nil {
+		errs.HTTPResponse(w, err)
+		return
+	}
+	base, err := strconv.ParseInt(q.Get("base"), 10, 64)
+	if err != nil || base < 0 {
+		errs.HTTPResponse(w, errs.E(OpSync, errs.KindInvalid, "base must be the version the change started from"))
+		return
+	}
+	// The quota check and the cap on what the delta may rebuild both need it
+	size, err := strconv.ParseInt(q.Get("size"), 10, 64)
+	if err != nil || size < 0 {
+		errs.HTTPResponse(w, errs.E(OpSync, errs.KindInvalid, "size must be the size of the result"))
+		return
+	}
+	conflict := q.Get("conflict") == "1" || q.Get("conflict") == "true"
+
+	// writeMu is only held to check the version here and to commit below;
+	// the delta streams in between, so a slow upload does not hold up
+	// every other write
+	j := s.Journal
+	j.writeMu.Lock()
+	cur, ok, err := j.current(rel)
+	j.writeMu.Unlock()
+	if err != nil {
+		errs.HTTPResponse(w, errs.E(OpSync, errs.KindIO, err, "Could not read file"))
+		return
+	}
+	live := ok && !cur.Deleted
+
+	status := http.StatusOK
+	switch {
+	case conflict:
+		live = false
+		status = http.StatusCreated
+	case live && cur.SHA256 == expected:
+		// Someone already made the same change
+		os.Remove(syncPartialPath(full, expected))
+		writeSyncEntry(w, http.StatusOK, scope.entry(cur))
+		return
+	case live && cur.Version != base:
+		c := scope.entry(cur)
+		writeSyncConflict(w, &c)
+		return
+	case !live:
+		status = http.StatusCreated
+	}
+
+	if err := s.CheckQuota(full, size); err != nil {
+		errs.HTTPResponse(w, err)
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(full), 0755); err != nil {
+		errs.HTTPResponse(w, errs.E(OpSync, errs.KindIO, err, "Could not create folder"))
+		return
+	}
+
+	// A conflict copy is a new name, so nothing of an earlier attempt
+	// applies. Otherwise a client that signed with ?sha256= sends resume=1
+	// and its delta is against the kept partial followed by the file.
+	partial, resume := "", ""
+	if !conflict {
+		partial = syncPartialPath(full, expected)
+		if q.Get("resume") == "1" {
+			resume = expected
+		}
+	}
+	old, files, err := syncBase(full, resume, live)
+	if err != nil {
+		errs.HTTPResponse(w, errs.E(OpSync, errs.KindIO, err, "Could not read file"))
+		return
+	}
+	defer closeAll(files)
+
+	af, err := createAtomic(full)
+	if err != nil {
+		errs.HTTPResponse(w, errs.E(OpSync, errs.KindIO, err, "Could not write file"))
+		return
+	}
+	if err := delta.ApplyLimit(old, r.Body, af, size); err != nil {
+		// Keep what arrived for the retry, unless an earlier attempt got further
+		if info, serr := os.Stat(partial); partial != "" && err != delta.ErrTooLarge && af.n >= minResumeSize && (serr != nil || info.Size() < af.n) {
+			if kerr := af.Keep(partial); kerr != nil {
+				log.Printf("[SYNC] Keeping partial upload of %s: %v", rel, kerr)
+			}
+		} else {
+			af.Abort()
+		}
+		if err == delta.ErrTooLarge {
+			errs.HTTPResponse(w, errs.E(OpSync, errs.KindInvalid, err, "The delta rebuilds more than size bytes"))
+			return
+		}
+		errs.HTTPResponse(w, errs.E(OpSync, errs.KindInvalid, err, "Malformed or interrupted delta"))
+		return
+	}
+
+	j.writeMu.Lock()
+	defer j.writeMu.Unlock()
+	if conflict {
+		// Named now, so two conflict copies made at once do not collide
+		rel = s.conflictCopyPath(rel, q.Get("device"), time.Now())
+		full = filepath.Join(s.DataDir, filepath.FromSlash(rel))
+		af.dst = full
+	} else {
+		now, ok, err := j.current(rel)
+		if err != nil {
+			af.Abort()
+			errs.HTTPResponse(w, errs.E(OpSync, errs.KindIO, err, "Could not read file"))
+			return
+		}
+		// The file moved on while the delta was streaming
+		if nowLive := ok && !now.Deleted; nowLive != live || (live && now.Version != cur.Version) {
+			af.Abort()
+			if nowLive && now.SHA256 == expected {
+				writeSyncEntry(w, http.StatusOK, scope.entry(now))
+				return
+			}
+			c := scope.entry(now)
+			writeSyncConflict(w, &c)
+			return
+		}
+	}
+	if err := af.Commit(expected); err != nil {
+		errs.HTTPResponse(w, err)
+		return
+	}
+	if partial != "" {
+		os.Remove(partial)
+	}
+	s.digests.put(full, af.Sum())
+	s.NotifyChanged(full)
+
+	e, _ := j.Entry(rel)
+	writeSyncEntry(w, status, scope.entry(e))
+}
+
+// handleSyncDelete removes a file if it is still at version ?base=.
+func (s *Cloud) handleSyncDelete(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	rel, full, scope, err := s.syncTarget(r)
+	if err != nil {
+		errs.HTTPResponse(w, err)
+		return
+	}
+	base, err := strconv.ParseInt(r.URL.Query().Get("base"), 10, 64)
+	if err != nil || base < 1 {
+		errs.HTTPResponse(w, errs.E(OpSync, errs.KindInvalid, "base must be the version being deleted"))
+		return
+	}
+
+	j := s.Journal
+	j.writeMu.Lock()
+	defer j.writeMu.Unlock()
+
+	cur, ok, err := j.current(rel)
+	if err != nil {
+		errs.HTTPResponse(w, errs.E(OpSync, errs.KindIO, err, "Could not read file"))
+		return
+	}
+	if !ok || cur.Deleted {
+		writeSyncEntry(w, http.StatusOK, scope.entry(SyncEntry{Path: rel, Deleted: true, Version: cur.Version}))
+		return
+	}
+	if cur.Version != base {
+		c := scope.entry(cur)
+		writeSyncConflict(w, &c)
+		return
+	}
+	if err := os.Remove(full); err != nil && !os.IsNotExist(err) {
+		errs.HTTPResponse(w, errs.E(OpSync, errs.KindIO, err, "Could not delete file"))
+		return
+	}
+	s.NotifyRemoved(full)
+
+	e, _ := j.Entry(rel)
+	writeSyncEntry(w, http.StatusOK, scope.entry(e))
+}
+
+// conflictCopyPath names the copy that keeps a client's losing edit next
+// to the original, e.g. "report (conflict from laptop 2024-05-01 14.03.22).txt".
+func (s *Cloud) conflictCopyPath(rel, device string, now time.Time) string {
+	if !validDeviceID(device) {
+		device = "another device"
+	}
+	name := path.Base(rel)
+	ext := path.Ext(name)
+	name = fmt.Sprintf("%s (conflict from %s %s)%s", strings.TrimSuffix(name, ext), device, now.Format("2006-01-02 15.04.05"), ext)
+	return s.freeBackupPath(path.Dir(rel), name, nil)
+}
+
+func writeSyncEntry(w http.ResponseWriter, status int, e SyncEntry) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set(SyncVersionHeader, strconv.FormatInt(e.Version, 10))
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(e)
+}
+
+func writeSyncConflict(w http.ResponseWriter, cur *SyncEntry) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusConflict)
+	json.NewEncoder(w).Encode(SyncConflictResponse{Error: errSyncConflict.Error(), Current: cur})
+}
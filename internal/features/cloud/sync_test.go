@@ -0,0 +1,651 @@
+package cloud
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/strct-org/strct-agent/pkg/delta"
+	"github.com/strct-org/strct-agent/pkg/syncclient"
+)
+
+func newSyncServer(t *testing.T) (*Cloud, *httptest.Server) {
+	t.Helper()
+	c := newTestCloud(t)
+	c.Journal.Throttle = 0
+	mux := http.NewServeMux()
+	for route, h := range c.GetRoutes() {
+		mux.HandleFunc(route, h)
+	}
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return c, srv
+}
+
+func newSyncer(t *testing.T, srv *httptest.Server, device string) *syncclient.Syncer {
+	return &syncclient.Syncer{
+		Client: &syncclient.Client{BaseURL: srv.URL, HTTP: srv.Client(), Device: device},
+		Dir:    t.TempDir(),
+	}
+}
+
+func runSync(t *testing.T, s *syncclient.Syncer) *syncclient.Report {
+	t.Helper()
+	rep, err := s.Sync(context.Background())
+	if err != nil {
+		t.Fatalf("%s: %v", s.Client.Device, err)
+	}
+	return rep
+}
+
+// tree lists the files below dir with their content, leaving out the
+// client's own state.
+func tree(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	files := make(map[string]string)
+	filepath.WalkDir(dir, func(p string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() || d.Name() == syncclient.StateFile {
+			return nil
+		}
+		data, _ := os.ReadFile(p)
+		rel, _ := filepath.Rel(dir, p)
+		files[filepath.ToSlash(rel)] = string(data)
+		return nil
+	})
+	return files
+}
+
+func keys(m map[string]string) []string {
+	list := make([]string, 0, len(m))
+	for k := range m {
+		list = append(list, k)
+	}
+	sort.Strings(list)
+	return list
+}
+
+func writeLocal(t *testing.T, dir, rel string, data []byte) {
+	t.Helper()
+	p := filepath.Join(dir, filepath.FromSlash(rel))
+	os.MkdirAll(filepath.Dir(p), 0755)
+	if err := os.WriteFile(p, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTwoWaySync(t *testing.T) {
+	c, srv := newSyncServer(t)
+	laptop := newSyncer(t, srv, "laptop")
+	desktop := newSyncer(t, srv, "desktop")
+
+	// A file that was on the drive before anyone synced, written behind the agent's back
+	writeLocal(t, c.DataDir, "docs/readme.txt", []byte("welcome"))
+	if _, err := c.Walker.Scan(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	c.Journal.Process(context.Background())
+
+	big := make([]byte, 256<<10)
+	rand.New(rand.NewSource(7)).Read(big)
+
+	steps := []struct {
+		name  string
+		edit  func()
+		sync  *syncclient.Syncer
+		check func(t *testing.T, rep *syncclient.Report)
+	}{
+		{
+			name: "first sync downloads what the agent has",
+			sync: laptop,
+			check: func(t *testing.T, rep *syncclient.Report) {
+				if strings.Join(rep.Downloaded, ",") != "docs/readme.txt" {
+					t.Errorf("downloaded = %v", rep.Downloaded)
+				}
+			},
+		},
+		{
+			name: "new local files are uploaded",
+			edit: func() {
+				writeLocal(t, laptop.Dir, "big.bin", big)
+				writeLocal(t, laptop.Dir, "notes.txt", []byte("first notes"))
+			},
+			sync: laptop,
+			check: func(t *testing.T, rep *syncclient.Report) {
+				if strings.Join(rep.Uploaded, ",") != "big.bin,notes.txt" {
+					t.Errorf("uploaded = %v", rep.Uploaded)
+				}
+			},
+		},
+		{
+			name: "second client catches up",
+			sync: desktop,
+			check: func(t *testing.T, rep *syncclient.Report) {
+				if len(rep.Downloaded) != 3 {
+					t.Errorf("downloaded = %v", rep.Downloaded)
+				}
+			},
+		},
+		{
+			name: "a small edit uploads only a delta",
+			edit: func() {
+				edited := append(append(append([]byte{}, big[:100000]...), "inserted"...), big[100000:]...)
+				writeLocal(t, laptop.Dir, "big.bin", edited)
+			},
+			sync: laptop,
+			check: func(t *testing.T, rep *syncclient.Report) {
+				if len(rep.Uploaded) != 1 || rep.Sent > 8<<10 {
+					t.Errorf("uploaded %v with %d bytes", rep.Uploaded, rep.Sent)
+				}
+			},
+		},
+		{
+			name: "and downloads only a delta",
+			sync: desktop,
+			check: func(t *testing.T, rep *syncclient.Report) {
+				if len(rep.Downloaded) != 1 || rep.Received > 8<<10 {
+					t.Errorf("downloaded %v with %d bytes", rep.Downloaded, rep.Received)
+				}
+			},
+		},
+		{
+			name: "concurrent edits leave a conflict copy",
+			edit: func() {
+				writeLocal(t, laptop.Dir, "notes.txt", []byte("laptop's notes"))
+				writeLocal(t, desktop.Dir, "notes.txt", []byte("desktop's longer notes"))
+				runSync(t, laptop)
+			},
+			sync: desktop,
+			check: func(t *testing.T, rep *syncclient.Report) {
+				if len(rep.Conflicts) != 1 || !strings.HasPrefix(rep.Conflicts[0], "notes (conflict from desktop ") {
+					t.Fatalf("conflicts = %v", rep.Conflicts)
+				}
+				files := tree(t, desktop.Dir)
+				if files["notes.txt"] != "laptop's notes" || files[rep.Conflicts[0]] != "desktop's longer notes" {
+					t.Errorf("desktop files = %v", files)
+				}
+			},
+		},
+		{
+			name: "conflict copies reach the other client",
+			sync: laptop,
+			check: func(t *testing.T, rep *syncclient.Report) {
+				if len(rep.Downloaded) != 1 || !strings.Contains(rep.Downloaded[0], "(conflict from desktop ") {
+					t.Errorf("downloaded = %v", rep.Downloaded)
+				}
+			},
+		},
+		{
+			name: "deletions propagate",
+			edit: func() {
+				os.Remove(filepath.Join(desktop.Dir, "docs", "readme.txt"))
+				runSync(t, desktop)
+			},
+			sync: laptop,
+			check: func(t *testing.T, rep *syncclient.Report) {
+				if strings.Join(rep.DeletedLocal, ",") != "docs/readme.txt" {
+					t.Errorf("deleted = %v", rep.DeletedLocal)
+				}
+				if _, err := os.Stat(filepath.Join(laptop.Dir, "docs")); !os.IsNotExist(err) {
+					t.Errorf("empty folder left behind")
+				}
+			},
+		},
+		{
+			name: "an edit beats a concurrent delete",
+			edit: func() {
+				os.Remove(filepath.Join(laptop.Dir, "big.bin"))
+				runSync(t, laptop)
+				writeLocal(t, desktop.Dir, "big.bin", []byte("rewritten"))
+				runSync(t, desktop)
+			},
+			sync: laptop,
+			check: func(t *testing.T, rep *syncclient.Report) {
+				if strings.Join(rep.Downloaded, ",") != "big.bin" {
+					t.Errorf("downloaded = %v", rep.Downloaded)
+				}
+			},
+		},
+		{
+			name: "nothing left to do",
+			sync: desktop,
+			check: func(t *testing.T, rep *syncclient.Report) {
+				if n := len(rep.Downloaded) + len(rep.Uploaded) + len(rep.DeletedLocal) + len(rep.DeletedRemote); n != 0 {
+					t.Errorf("report = %+v", rep)
+				}
+			},
+		},
+	}
+
+	for _, tt := range steps {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.edit != nil {
+				tt.edit()
+			}
+			tt.check(t, runSync(t, tt.sync))
+		})
+	}
+
+	server, a, b := tree(t, c.DataDir), tree(t, laptop.Dir), tree(t, desktop.Dir)
+	if len(server) != 3 {
+		t.Errorf("server files = %v", keys(server))
+	}
+	for name, data := range server {
+		if a[name] != data || b[name] != data {
+			t.Errorf("%s differs: server %q, laptop %q, desktop %q", name, data, a[name], b[name])
+		}
+	}
+	if len(a) != len(server) || len(b) != len(server) {
+		t.Errorf("laptop %v, desktop %v, server %v", keys(a), keys(b), keys(server))
+	}
+}
+
+func syncPost(c *Cloud, h http.HandlerFunc, query string, body []byte) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest(http.MethodPost, "/api/sync?"+query, bytes.NewReader(body)))
+	return w
+}
+
+func TestSyncEndpoints(t *testing.T) {
+	c, _ := newSyncServer(t)
+	full := filepath.Join(c.DataDir, "a.txt")
+	if _, _, err := c.writeFile(full, strings.NewReader("hello"), ""); err != nil {
+		t.Fatal(err)
+	}
+	e, _ := c.Journal.Entry("a.txt")
+
+	var whole bytes.Buffer
+	delta.Delta(nil, strings.NewReader("replaced"), &whole)
+
+	tests := []struct {
+		name     string
+		handler  http.HandlerFunc
+		query    string
+		body     []byte
+		wantCode int
+	}{
+		{"upload against a stale base", c.handleSyncUpload, "path=a.txt&base=99&size=8&sha256=" + sha256hex("replaced"), whole.Bytes(), http.StatusConflict},
+		{"upload without a digest", c.handleSyncUpload, "path=a.txt&base=1&size=8", whole.Bytes(), http.StatusBadRequest},
+		{"upload without a size", c.handleSyncUpload, "path=b.txt&base=0&sha256=" + sha256hex("replaced"), whole.Bytes(), http.StatusBadRequest},
+		{"delta larger than its size", c.handleSyncUpload, "path=b.txt&base=0&size=3&sha256=" + sha256hex("replaced"), whole.Bytes(), http.StatusBadRequest},
+		{"garbage delta", c.handleSyncUpload, "path=b.txt&base=0&size=1&sha256=" + sha256hex("x"), []byte("nope"), http.StatusBadRequest},
+		{"result does not match the digest", c.handleSyncUpload, "path=b.txt&base=0&size=8&sha256=" + sha256hex("other"), whole.Bytes(), http.StatusBadRequest},
+		{"root is not a file", c.handleSyncUpload, "path=/&base=0&size=8&sha256=" + sha256hex("replaced"), whole.Bytes(), http.StatusBadRequest},
+		{"delete against a stale base", c.handleSyncDelete, "path=a.txt&base=99", nil, http.StatusConflict},
+		{"download of a missing file", c.handleSyncDownload, "path=missing.txt", nil, http.StatusNotFound},
+		{"malformed signature", c.handleSyncDownload, "path=a.txt", []byte(`{"blockSize":3}`), http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if w := syncPost(c, tt.handler, tt.query, tt.body); w.Code != tt.wantCode {
+				t.Errorf("status = %d, want %d: %s", w.Code, tt.wantCode, w.Body.String())
+			}
+		})
+	}
+
+	if data, _ := os.ReadFile(full); string(data) != "hello" {
+		t.Errorf("refused writes changed the file: %q", data)
+	}
+	if _, err := os.Stat(filepath.Join(c.DataDir, "b.txt")); !os.IsNotExist(err) {
+		t.Errorf("failed upload left b.txt behind")
+	}
+
+	t.Run("conflict response names the current version", func(t *testing.T) {
+		w := syncPost(c, c.handleSyncDelete, "path=a.txt&base=99", nil)
+		var resp SyncConflictResponse
+		json.NewDecoder(w.Body).Decode(&resp)
+		if resp.Current == nil || resp.Current.Version != e.Version || resp.Current.SHA256 != sha256hex("hello") {
+			t.Errorf("conflict = %+v", resp)
+		}
+	})
+}
+
+// A delta that is still streaming neither holds up other writes nor wins
+// over a change that was committed while it streamed.
+func TestSyncUploadStreamsUnlocked(t *testing.T) {
+	c, _ := newSyncServer(t)
+	full := filepath.Join(c.DataDir, "a.txt")
+	if _, _, err := c.writeFile(full, strings.NewReader("hello"), ""); err != nil {
+		t.Fatal(err)
+	}
+	e, _ := c.Journal.Entry("a.txt")
+	upload := func(path, content string, base int64) string {
+		return fmt.Sprintf("path=%s&base=%d&size=%d&sha256=%s", path, base, len(content), sha256hex(content))
+	}
+	whole := func(content string) []byte {
+		var d bytes.Buffer
+		delta.Delta(nil, strings.NewReader(content), &d)
+		return d.Bytes()
+	}
+
+	body, feed := io.Pipe()
+	slow := make(chan *httptest.ResponseRecorder)
+	go func() {
+		w := httptest.NewRecorder()
+		c.handleSyncUpload(w, httptest.NewRequest(http.MethodPost, "/api/sync/upload?"+upload("a.txt", "slow edit", e.Version), body))
+		slow <- w
+	}()
+	data := whole("slow edit")
+	feed.Write(data[:4])
+
+	done := make(chan int)
+	go func() {
+		done <- syncPost(c, c.handleSyncUpload, upload("a.txt", "quick edit", e.Version), whole("quick edit")).Code
+	}()
+	select {
+	case code := <-done:
+		if code != http.StatusOK {
+			t.Fatalf("quick edit: %d", code)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("an upload waited for another one to finish streaming")
+	}
+
+	feed.Write(data[4:])
+	feed.Close()
+	if w := <-slow; w.Code != http.StatusConflict {
+		t.Errorf("slow edit over a newer version: %d %s", w.Code, w.Body)
+	}
+	if got, _ := os.ReadFile(full); string(got) != "quick edit" {
+		t.Errorf("file is %q", got)
+	}
+}
+
+func TestJournal(t *testing.T) {
+	c := newTestCloud(t)
+	j := c.Journal
+	j.Throttle = 0
+
+	for _, name := range []string{"a", "b", "c"} {
+		if _, _, err := c.writeFile(filepath.Join(c.DataDir, name), strings.NewReader(name), ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	os.Remove(filepath.Join(c.DataDir, "b"))
+	c.NotifyRemoved(filepath.Join(c.DataDir, "b"))
+
+	paths := func(resp SyncChangesResponse) string {
+		var list []string
+		for _, e := range resp.Changes {
+			p := e.Path
+			if e.Deleted {
+				p = "-" + p
+			}
+			list = append(list, p)
+		}
+		return strings.Join(list, ",")
+	}
+
+	tests := []struct {
+		name      string
+		cursor    int64
+		limit     int
+		want      string
+		wantMore  bool
+		wantReset bool
+	}{
+		{"full listing skips tombstones", 0, 10, "a,c", false, false},
+		{"since the first write", 1, 10, "c,-b", false, false},
+		{"paged", 0, 1, "a", true, false},
+		{"up to date", 4, 10, "", false, false},
+		{"cursor from a rebuilt journal", 40, 10, "a,c", false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := j.Changes(tt.cursor, tt.limit)
+			if got := paths(resp); got != tt.want || resp.More != tt.wantMore || resp.Reset != tt.wantReset {
+				t.Errorf("changes = %q more=%v reset=%v, want %q more=%v reset=%v", got, resp.More, resp.Reset, tt.want, tt.wantMore, tt.wantReset)
+			}
+		})
+	}
+
+	t.Run("external edits are hashed before they show up", func(t *testing.T) {
+		p := filepath.Join(c.DataDir, "a")
+		os.WriteFile(p, []byte("edited"), 0644)
+		future := time.Now().Add(time.Minute)
+		os.Chtimes(p, future, future)
+		if _, err := c.Walker.Scan(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if n := j.Pending(); n != 1 {
+			t.Fatalf("pending = %d, want 1", n)
+		}
+		j.Process(context.Background())
+		if e, _ := j.Entry("a"); e.Version != 5 || e.SHA256 != sha256hex("edited") {
+			t.Errorf("entry = %+v", e)
+		}
+	})
+
+	t.Run("cursors survive a restart", func(t *testing.T) {
+		restarted := NewJournal(c.DataDir, j.Dir, c.digests)
+		if err := restarted.load(); err != nil {
+			t.Fatal(err)
+		}
+		if got := paths(restarted.Changes(3, 10)); got != "-b,a" {
+			t.Errorf("changes after restart = %q", got)
+		}
+		if err := restarted.compact(); err != nil {
+			t.Fatal(err)
+		}
+		again := NewJournal(c.DataDir, j.Dir, c.digests)
+		again.load()
+		if again.seq != 5 || len(again.files) != 3 {
+			t.Errorf("after compaction seq = %d, files = %d", again.seq, len(again.files))
+		}
+	})
+
+	t.Run("the hash queue survives a restart", func(t *testing.T) {
+		p := filepath.Join(c.DataDir, "c")
+		os.WriteFile(p, []byte("edited behind our back"), 0644)
+		if _, err := c.Walker.Scan(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if err := j.compact(); err != nil {
+			t.Fatal(err)
+		}
+		restarted := NewJournal(c.DataDir, j.Dir, c.digests)
+		if err := restarted.load(); err != nil {
+			t.Fatal(err)
+		}
+		if n := restarted.Pending(); n != 1 {
+			t.Fatalf("pending after restart = %d, want 1", n)
+		}
+		restarted.Throttle = 0
+		restarted.Process(context.Background())
+		if e, _ := restarted.Entry("c"); e.SHA256 != sha256hex("edited behind our back") {
+			t.Errorf("entry = %+v", e)
+		}
+		j.Process(context.Background())
+	})
+
+	t.Run("old tombstones are pruned", func(t *testing.T) {
+		j.prune(time.Now().Add(j.TombstoneTTL + time.Hour))
+		if _, ok := j.Entry("b"); ok {
+			t.Errorf("tombstone kept")
+		}
+		if resp := j.Changes(2, 10); !resp.Reset {
+			t.Errorf("cursor before the pruned tombstone was not reset")
+		}
+		if resp := j.Changes(4, 10); resp.Reset {
+			t.Errorf("cursor after the pruned tombstone was reset")
+		}
+	})
+}
+
+func TestOneWaySyncInFolder(t *testing.T) {
+	c, srv := newSyncServer(t)
+	writeLocal(t, c.DataDir, "Other/secret.txt", []byte("not for replicas"))
+	c.Walker.Scan(context.Background())
+	c.Journal.Process(context.Background())
+
+	newOneWay := func(dir syncclient.Direction) *syncclient.Syncer {
+		s := newSyncer(t, srv, "peer")
+		s.Client.Root = "Replicas/laptop"
+		s.Direction = dir
+		return s
+	}
+	push, pull := newOneWay(syncclient.Push), newOneWay(syncclient.Pull)
+	serverTree := func() map[string]string { return tree(t, filepath.Join(c.DataDir, "Replicas", "laptop")) }
+	write := func(rel, data string) {
+		t.Helper()
+		if _, _, err := c.writeFile(filepath.Join(c.DataDir, filepath.FromSlash(rel)), strings.NewReader(data), ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	writeLocal(t, push.Dir, "a.txt", []byte("a1"))
+	writeLocal(t, push.Dir, "sub/b.txt", []byte("b1"))
+	runSync(t, push)
+	runSync(t, pull)
+	want := map[string]string{"a.txt": "a1", "sub/b.txt": "b1"}
+	if got := serverTree(); len(got) != 2 || got["a.txt"] != "a1" || got["sub/b.txt"] != "b1" {
+		t.Fatalf("pushed %v", got)
+	}
+	if got := tree(t, pull.Dir); len(got) != len(want) || got["a.txt"] != "a1" || got["sub/b.txt"] != "b1" {
+		t.Fatalf("pulled %v, want only the folder's files", got)
+	}
+
+	// Edits on the receiving end are undone; files only it has are left alone
+	writeLocal(t, pull.Dir, "a.txt", []byte("edited by the replica"))
+	writeLocal(t, pull.Dir, "notes.txt", []byte("mine"))
+	write("Replicas/laptop/sub/b.txt", "edited on the agent")
+	write("Replicas/laptop/c.txt", "only on the agent")
+	writeLocal(t, push.Dir, "a.txt", []byte("a2"))
+
+	rep := runSync(t, push)
+	if len(rep.Downloaded) != 0 || len(rep.Conflicts) != 0 {
+		t.Errorf("push fetched or kept conflicts: %+v", rep)
+	}
+	got := serverTree()
+	if got["a.txt"] != "a2" || got["sub/b.txt"] != "b1" || got["c.txt"] != "only on the agent" {
+		t.Errorf("after push the agent has %v", got)
+	}
+	runSync(t, pull)
+	got = tree(t, pull.Dir)
+	if got["a.txt"] != "a2" || got["sub/b.txt"] != "b1" || got["notes.txt"] != "mine" || got["c.txt"] != "only on the agent" {
+		t.Errorf("after pull the replica has %v", got)
+	}
+	if _, err := os.Stat(filepath.Join(c.DataDir, "Replicas", "laptop", "notes.txt")); !os.IsNotExist(err) {
+		t.Error("pull uploaded a local file")
+	}
+
+	// Deletions follow the source
+	os.Remove(filepath.Join(push.Dir, "sub", "b.txt"))
+	runSync(t, push)
+	runSync(t, pull)
+	if _, err := os.Stat(filepath.Join(pull.Dir, "sub", "b.txt")); !os.IsNotExist(err) {
+		t.Error("deletion did not reach the replica")
+	}
+	if data, _ := os.ReadFile(filepath.Join(c.DataDir, "Other", "secret.txt")); string(data) != "not for replicas" {
+		t.Error("sync reached outside its folder")
+	}
+
+	t.Run("paths cannot leave the folder", func(t *testing.T) {
+		w := syncPost(c, c.handleSyncDownload, "root=Replicas/laptop&path=../../Other/secret.txt", nil)
+		if w.Code != http.StatusNotFound {
+			t.Errorf("status = %d", w.Code)
+		}
+	})
+}
+
+// cutTransport breaks off uploads and downloads after limit bytes, like a
+// link that drops mid-transfer.
+type cutTransport struct {
+	base  http.RoundTripper
+	limit int64
+}
+
+type cutReader struct {
+	r    io.ReadCloser
+	left int64
+}
+
+func (c *cutReader) Read(p []byte) (int, error) {
+	if c.left <= 0 {
+		return 0, errors.New("connection lost")
+	}
+	if int64(len(p)) > c.left {
+		p = p[:c.left]
+	}
+	n, err := c.r.Read(p)
+	c.left -= int64(n)
+	return n, err
+}
+
+func (c *cutReader) Close() error { return c.r.Close() }
+
+func (c *cutTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if strings.HasSuffix(req.URL.Path, "/upload") && req.Body != nil {
+		req.Body = &cutReader{r: req.Body, left: c.limit}
+	}
+	resp, err := c.base.RoundTrip(req)
+	if err == nil && strings.HasSuffix(req.URL.Path, "/download") {
+		resp.Body = &cutReader{r: resp.Body, left: c.limit}
+	}
+	return resp, err
+}
+
+func TestSyncResumesTransfers(t *testing.T) {
+	c, srv := newSyncServer(t)
+	s := newSyncer(t, srv, "laptop")
+	flaky := &http.Client{Transport: &cutTransport{base: srv.Client().Transport, limit: 2 << 20}}
+
+	video := make([]byte, 3<<20)
+	rand.New(rand.NewSource(1)).Read(video)
+	writeLocal(t, s.Dir, "video.mp4", video)
+
+	s.Client.HTTP = flaky
+	if _, err := s.Sync(context.Background()); err == nil {
+		t.Fatal("upload over a dropping link succeeded")
+	}
+	// The agent notices the cut after the client does
+	var kept []string
+	for deadline := time.Now().Add(5 * time.Second); len(kept) == 0 && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		kept, _ = filepath.Glob(filepath.Join(c.DataDir, syncPartialPrefix+"*.part"))
+	}
+	if len(kept) != 1 {
+		t.Fatalf("partial uploads kept: %v", kept)
+	}
+
+	s.Client.HTTP = srv.Client()
+	rep := runSync(t, s)
+	if rep.Sent > 3<<19 {
+		t.Errorf("retry sent %d bytes of a 3 MiB file", rep.Sent)
+	}
+	if data, _ := os.ReadFile(filepath.Join(c.DataDir, "video.mp4")); !bytes.Equal(data, video) {
+		t.Fatal("resumed upload differs")
+	}
+	if _, err := os.Stat(kept[0]); !os.IsNotExist(err) {
+		t.Error("partial upload left behind")
+	}
+
+	movie := make([]byte, 3<<20)
+	rand.New(rand.NewSource(2)).Read(movie)
+	if _, _, err := c.writeFile(filepath.Join(c.DataDir, "movie.mkv"), bytes.NewReader(movie), ""); err != nil {
+		t.Fatal(err)
+	}
+	s.Client.HTTP = flaky
+	if _, err := s.Sync(context.Background()); err == nil {
+		t.Fatal("download over a dropping link succeeded")
+	}
+	s.Client.HTTP = srv.Client()
+	rep = runSync(t, s)
+	if rep.Received > 3<<19 {
+		t.Errorf("retry received %d bytes of a 3 MiB file", rep.Received)
+	}
+	got := tree(t, s.Dir)
+	if got["movie.mkv"] != string(movie) || len(got) != 2 {
+		t.Errorf("after resumed download the folder has %v", keys(got))
+	}
+}
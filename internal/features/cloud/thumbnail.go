@@ -0,0 +1,348 @@
+package cloud
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+
+	"github.com/strct-org/strct-agent/internal/errs"
+	"github.com/strct-org/strct-agent/internal/exif"
+)
+
+const (
+	OpThumbnail errs.Op = "cloud.Thumbnailer.Get"
+)
+
+// ThumbnailSizes maps the API size names to the longest edge in pixels.
+var ThumbnailSizes = map[string]int{
+	"small":  160,
+	"medium": 480,
+	"large":  1280,
+}
+
+var thumbnailExt = map[string]bool{
+	".jpg": true, ".jpeg": true, ".png": true, ".gif": true, ".webp": true,
+}
+
+// maxSourcePixels stops a single huge panorama from eating all of the Pi's RAM.
+const maxSourcePixels = 80_000_000
+
+// Thumbnailer renders thumbnails on demand into CacheDir. A fixed pool of
+// workers does the decoding; concurrent requests for the same thumbnail share
+// one job. The job outlives any one caller giving up, and is only dropped
+// unrendered if every caller has gone before a worker picks it up.
+type Thumbnailer struct {
+	CacheDir string
+	Workers  int
+
+	jobs chan *thumbJob
+
+	mu       sync.Mutex
+	inflight map[string]*thumbJob
+}
+
+type thumbJob struct {
+	src  string
+	dst  string
+	size int
+	info os.FileInfo
+	done chan struct{}
+	err  error
+
+	waiters int // callers still waiting; guarded by Thumbnailer.mu
+}
+
+func NewThumbnailer(cacheDir string, workers int) *Thumbnailer {
+	return &Thumbnailer{
+		CacheDir: cacheDir,
+		Workers:  workers,
+		jobs:     make(chan *thumbJob, 64),
+		inflight: make(map[string]*thumbJob),
+	}
+}
+
+func (t *Thumbnailer) Start() error {
+	if err := os.MkdirAll(t.CacheDir, 0755); err != nil {
+		return errs.E(OpThumbnail, errs.KindIO, err, "could not create thumbnail cache")
+	}
+
+	// Thumbnails used to be filed under a hash of their source, which left
+	// nothing to find them by once the source was gone
+	if entries, err := os.ReadDir(t.CacheDir); err == nil {
+		for _, e := range entries {
+			if _, err := hex.DecodeString(e.Name()); err == nil && len(e.Name()) == 2 {
+				os.RemoveAll(filepath.Join(t.CacheDir, e.Name()))
+			}
+		}
+	}
+
+	log.Printf("[THUMBS] Starting %d thumbnail workers (cache: %s)", t.Workers, t.CacheDir)
+	for i := 0; i < t.Workers; i++ {
+		go func() {
+			for job := range t.jobs {
+				t.mu.Lock()
+				abandoned := job.waiters == 0
+				if abandoned {
+					delete(t.inflight, job.dst)
+				}
+				t.mu.Unlock()
+				if abandoned {
+					job.err = context.Canceled
+					close(job.done)
+					continue
+				}
+
+				job.err = t.render(job)
+				t.mu.Lock()
+				delete(t.inflight, job.dst)
+				t.mu.Unlock()
+				close(job.done)
+			}
+		}()
+	}
+	return nil
+}
+
+// Get returns the path of an up to date thumbnail for src, rendering it first
+// if the cached copy is missing or older than the source.
+func (t *Thumbnailer) Get(ctx context.Context, src, sizeName string) (string, error) {
+	size, ok := ThumbnailSizes[sizeName]
+	if !ok {
+		return "", errs.E(OpThumbnail, errs.KindInvalid, fmt.Sprintf("unknown size %q", sizeName))
+	}
+	if !thumbnailExt[strings.ToLower(filepath.Ext(src))] {
+		return "", errs.E(OpThumbnail, errs.KindInvalid, "file type has no thumbnail")
+	}
+
+	info, err := os.Stat(src)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", errs.E(OpThumbnail, errs.KindNotFound, "file not found")
+		}
+		return "", errs.E(OpThumbnail, errs.KindIO, err)
+	}
+	if info.IsDir() {
+		return "", errs.E(OpThumbnail, errs.KindInvalid, "cannot thumbnail a folder")
+	}
+
+	dst := t.cachePath(src, sizeName)
+	if fresh(dst, info) {
+		return dst, nil
+	}
+
+	t.mu.Lock()
+	job, ok := t.inflight[dst]
+	if !ok {
+		job = &thumbJob{src: src, dst: dst, size: size, info: info, done: make(chan struct{})}
+		select {
+		case t.jobs <- job:
+		default:
+			// Queueing behind a full queue would pile up a goroutine per
+			// request; the client can ask again once the workers catch up
+			t.mu.Unlock()
+			return "", errs.E(OpThumbnail, errs.KindBusy, "Too many thumbnails are being made, try again shortly")
+		}
+		t.inflight[dst] = job
+	}
+	job.waiters++
+	t.mu.Unlock()
+
+	select {
+	case <-job.done:
+		if job.err != nil {
+			return "", job.err
+		}
+		return dst, nil
+	case <-ctx.Done():
+		t.mu.Lock()
+		job.waiters--
+		t.mu.Unlock()
+		return "", ctx.Err()
+	}
+}
+
+// Invalidate drops the cached sizes of src, or of everything under it when
+// src is a folder. Stale thumbnails would also be caught by the mtime check;
+// this is what frees the space once a file is deleted or moved away.
+func (t *Thumbnailer) Invalidate(src string) {
+	os.RemoveAll(t.cacheDir(src))
+}
+
+// cachePath mirrors the source tree under CacheDir, with one folder per
+// source file holding its sizes, so a folder's thumbnails can be dropped in
+// one go. The thumbnail's own mtime is set to the source mtime so staleness
+// is a single stat.
+func (t *Thumbnailer) cachePath(src, sizeName string) string {
+	return filepath.Join(t.cacheDir(src), sizeName+".jpg")
+}
+
+func (t *Thumbnailer) cacheDir(src string) string {
+	src = filepath.Clean(src)
+	return filepath.Join(t.CacheDir, "files", src[len(filepath.VolumeName(src)):])
+}
+
+func fresh(dst string, src os.FileInfo) bool {
+	info, err := os.Stat(dst)
+	if err != nil {
+		return false
+	}
+	return info.ModTime().Equal(src.ModTime())
+}
+
+func (t *Thumbnailer) render(job *thumbJob) error {
+	f, err := os.Open(job.src)
+	if err != nil {
+		return errs.E(OpThumbnail, errs.KindIO, err)
+	}
+	defer f.Close()
+
+	cfg, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return errs.E(OpThumbnail, errs.KindInvalid, "unsupported or corrupt image", err)
+	}
+	if cfg.Width*cfg.Height > maxSourcePixels {
+		return errs.E(OpThumbnail, errs.KindInvalid, "image too large to thumbnail")
+	}
+
+	orientation := 1
+	if _, err := f.Seek(0, 0); err != nil {
+		return errs.E(OpThumbnail, errs.KindIO, err)
+	}
+	if d, err := exif.Decode(f); err == nil && d.Orientation > 0 {
+		orientation = d.Orientation
+	}
+
+	if _, err := f.Seek(0, 0); err != nil {
+		return errs.E(OpThumbnail, errs.KindIO, err)
+	}
+	src, _, err := image.Decode(f)
+	if err != nil {
+		return errs.E(OpThumbnail, errs.KindInvalid, "unsupported or corrupt image", err)
+	}
+
+	thumb := orient(scale(src, job.size), orientation)
+
+	if err := os.MkdirAll(filepath.Dir(job.dst), 0755); err != nil {
+		return errs.E(OpThumbnail, errs.KindIO, err)
+	}
+	tmp := job.dst + ".tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return errs.E(OpThumbnail, errs.KindIO, err)
+	}
+	if err := jpeg.Encode(out, thumb, &jpeg.Options{Quality: 80}); err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return errs.E(OpThumbnail, errs.KindIO, err)
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(tmp)
+		return errs.E(OpThumbnail, errs.KindIO, err)
+	}
+	if err := os.Chtimes(tmp, time.Now(), job.info.ModTime()); err != nil {
+		os.Remove(tmp)
+		return errs.E(OpThumbnail, errs.KindIO, err)
+	}
+	if err := os.Rename(tmp, job.dst); err != nil {
+		os.Remove(tmp)
+		return errs.E(OpThumbnail, errs.KindIO, err)
+	}
+	return nil
+}
+
+// scale fits src into a size x size box, never upscaling. Transparent areas
+// are flattened onto white since the output is JPEG.
+func scale(src image.Image, size int) *image.RGBA {
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w > size || h > size {
+		if w >= h {
+			h = max(1, h*size/w)
+			w = size
+		} else {
+			w = max(1, w*size/h)
+			h = size
+		}
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(dst, dst.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.BiLinear.Scale(dst, dst.Bounds(), src, b, draw.Over, nil)
+	return dst
+}
+
+// orient applies an EXIF orientation (1-8) so the thumbnail is upright.
+func orient(src *image.RGBA, o int) *image.RGBA {
+	if o < 2 || o > 8 {
+		return src
+	}
+
+	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+	dw, dh := w, h
+	if o >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var nx, ny int
+			switch o {
+			case 2: // mirror horizontal
+				nx, ny = w-1-x, y
+			case 3: // rotate 180
+				nx, ny = w-1-x, h-1-y
+			case 4: // mirror vertical
+				nx, ny = x, h-1-y
+			case 5: // transpose
+				nx, ny = y, x
+			case 6: // rotate 90 CW
+				nx, ny = h-1-y, x
+			case 7: // transverse
+				nx, ny = h-1-y, w-1-x
+			case 8: // rotate 90 CCW
+				nx, ny = y, w-1-x
+			}
+			dst.SetRGBA(nx, ny, src.RGBAAt(x, y))
+		}
+	}
+	return dst
+}
+
+func (s *Cloud) handleThumbnail(w http.ResponseWriter, r *http.Request) {
+	fullPath, err := secureJoin(s.DataDir, r.URL.Query().Get("path"))
+	if err != nil {
+		http.Error(w, "Access Denied", http.StatusForbidden)
+		return
+	}
+
+	size := r.URL.Query().Get("size")
+	if size == "" {
+		size = "small"
+	}
+
+	thumbPath, err := s.Thumbs.Get(r.Context(), fullPath, size)
+	if err != nil {
+		errs.HTTPResponse(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Cache-Control", "private, max-age=86400")
+	http.ServeFile(w, r, thumbPath)
+}
@@ -0,0 +1,324 @@
+package cloud
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/errs"
+)
+
+// writeImage saves a w x h picture, red on the left half and blue on the
+// right. A non-zero orientation is written into an EXIF block.
+func writeImage(t *testing.T, p string, w, h, orientation int) {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			c := color.RGBA{R: 255, A: 255}
+			if x >= w/2 {
+				c = color.RGBA{B: 255, A: 255}
+			}
+			img.SetRGBA(x, y, c)
+		}
+	}
+	var buf bytes.Buffer
+	if filepath.Ext(p) == ".png" {
+		png.Encode(&buf, img)
+	} else {
+		jpeg.Encode(&buf, img, &jpeg.Options{Quality: 95})
+	}
+	data := buf.Bytes()
+
+	if orientation != 0 {
+		tiff := []byte("MM\x00\x2a\x00\x00\x00\x08")
+		tiff = binary.BigEndian.AppendUint16(tiff, 1)
+		tiff = binary.BigEndian.AppendUint16(tiff, 0x0112)
+		tiff = binary.BigEndian.AppendUint16(tiff, 3)
+		tiff = binary.BigEndian.AppendUint32(tiff, 1)
+		tiff = binary.BigEndian.AppendUint16(tiff, uint16(orientation))
+		tiff = append(tiff, 0, 0, 0, 0, 0, 0)
+		app1 := append([]byte("Exif\x00\x00"), tiff...)
+		seg := []byte{0xff, 0xd8, 0xff, 0xe1}
+		seg = binary.BigEndian.AppendUint16(seg, uint16(len(app1)+2))
+		data = append(append(seg, app1...), data[2:]...)
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(p, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func decodeThumb(t *testing.T, p string) image.Image {
+	t.Helper()
+	f, err := os.Open(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	img, err := jpeg.Decode(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return img
+}
+
+func isRed(c color.Color) bool {
+	r, g, b, _ := c.RGBA()
+	return r > 0xc000 && g < 0x4000 && b < 0x4000
+}
+
+func TestThumbnailScale(t *testing.T) {
+	tests := []struct {
+		w, h, size   int
+		wantW, wantH int
+	}{
+		{400, 200, 160, 160, 80},
+		{200, 400, 160, 80, 160},
+		{100, 50, 160, 100, 50}, // never upscaled
+		{1000, 1, 160, 160, 1},  // never squashed to nothing
+	}
+	for _, tt := range tests {
+		got := scale(image.NewRGBA(image.Rect(0, 0, tt.w, tt.h)), tt.size).Bounds()
+		if got.Dx() != tt.wantW || got.Dy() != tt.wantH {
+			t.Errorf("%dx%d into %d = %dx%d, want %dx%d", tt.w, tt.h, tt.size, got.Dx(), got.Dy(), tt.wantW, tt.wantH)
+		}
+	}
+}
+
+func TestThumbnailer(t *testing.T) {
+	dir := t.TempDir()
+	th := NewThumbnailer(filepath.Join(dir, "cache"), 2)
+	if err := th.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("scaled to the size asked for", func(t *testing.T) {
+		src := filepath.Join(dir, "wide.png")
+		writeImage(t, src, 640, 320, 0)
+		p, err := th.Get(t.Context(), src, "small")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b := decodeThumb(t, p).Bounds(); b.Dx() != 160 || b.Dy() != 80 {
+			t.Errorf("thumbnail is %dx%d", b.Dx(), b.Dy())
+		}
+	})
+
+	t.Run("EXIF orientation is applied", func(t *testing.T) {
+		// Rotated 90 degrees clockwise, the red left half ends up on top
+		src := filepath.Join(dir, "rotated.jpg")
+		writeImage(t, src, 200, 100, 6)
+		p, err := th.Get(t.Context(), src, "small")
+		if err != nil {
+			t.Fatal(err)
+		}
+		img := decodeThumb(t, p)
+		if b := img.Bounds(); b.Dx() != 80 || b.Dy() != 160 {
+			t.Fatalf("thumbnail is %dx%d, want 80x160", b.Dx(), b.Dy())
+		}
+		if !isRed(img.At(40, 20)) || isRed(img.At(40, 140)) {
+			t.Errorf("thumbnail not turned upright")
+		}
+	})
+
+	t.Run("cached until the source changes", func(t *testing.T) {
+		src := filepath.Join(dir, "cached.jpg")
+		writeImage(t, src, 300, 300, 0)
+		p, err := th.Get(t.Context(), src, "medium")
+		if err != nil {
+			t.Fatal(err)
+		}
+		// A marker in the cached file shows whether it was rendered again
+		if err := os.WriteFile(p, []byte("cached"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		info, _ := os.Stat(src)
+		os.Chtimes(p, time.Now(), info.ModTime())
+		if p2, err := th.Get(t.Context(), src, "medium"); err != nil || p2 != p {
+			t.Fatalf("second get = %s, %v", p2, err)
+		}
+		if data, _ := os.ReadFile(p); string(data) != "cached" {
+			t.Error("fresh thumbnail was rendered again")
+		}
+
+		writeImage(t, src, 300, 300, 0)
+		later := info.ModTime().Add(time.Minute)
+		os.Chtimes(src, later, later)
+		if _, err := th.Get(t.Context(), src, "medium"); err != nil {
+			t.Fatal(err)
+		}
+		if data, _ := os.ReadFile(p); string(data) == "cached" {
+			t.Error("stale thumbnail served")
+		}
+		if got, _ := os.Stat(p); !got.ModTime().Equal(later) {
+			t.Errorf("thumbnail mtime %v, want the source's %v", got.ModTime(), later)
+		}
+		if tmps, _ := filepath.Glob(filepath.Join(th.cacheDir(src), "*.tmp")); len(tmps) != 0 {
+			t.Errorf("temp files left: %v", tmps)
+		}
+	})
+}
+
+func TestThumbnailInvalidate(t *testing.T) {
+	dir := t.TempDir()
+	th := NewThumbnailer(filepath.Join(dir, "cache"), 1)
+	legacy := filepath.Join(th.CacheDir, "ab", "ab12-small.jpg")
+	os.MkdirAll(filepath.Dir(legacy), 0755)
+	os.WriteFile(legacy, []byte("old"), 0644)
+	if err := th.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(legacy); !os.IsNotExist(err) {
+		t.Errorf("thumbnail from the old layout kept: %v", err)
+	}
+
+	album := filepath.Join(dir, "album")
+	var thumbs []string
+	for _, name := range []string{"a.jpg", "sub/b.jpg"} {
+		src := filepath.Join(album, name)
+		os.MkdirAll(filepath.Dir(src), 0755)
+		writeImage(t, src, 100, 100, 0)
+		for _, size := range []string{"small", "medium"} {
+			p, err := th.Get(t.Context(), src, size)
+			if err != nil {
+				t.Fatal(err)
+			}
+			thumbs = append(thumbs, p)
+		}
+	}
+	other := filepath.Join(dir, "album2.jpg")
+	writeImage(t, other, 100, 100, 0)
+	kept, err := th.Get(t.Context(), other, "small")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Removing or renaming the folder drops the thumbnails of all of it
+	th.Invalidate(album)
+	for _, p := range thumbs {
+		if _, err := os.Stat(p); !os.IsNotExist(err) {
+			t.Errorf("%s survived its folder: %v", p, err)
+		}
+	}
+	if _, err := os.Stat(kept); err != nil {
+		t.Errorf("thumbnail outside the folder removed: %v", err)
+	}
+}
+
+func TestThumbnailQueueFull(t *testing.T) {
+	dir := t.TempDir()
+	th := NewThumbnailer(filepath.Join(dir, "cache"), 1)
+	th.jobs = make(chan *thumbJob) // no room and no workers
+	src := filepath.Join(dir, "photo.jpg")
+	writeImage(t, src, 100, 100, 0)
+
+	_, err := th.Get(t.Context(), src, "small")
+	var e *errs.Error
+	if !errors.As(err, &e) || e.Kind != errs.KindBusy {
+		t.Fatalf("full queue: %v", err)
+	}
+	if len(th.inflight) != 0 {
+		t.Errorf("refused job left in flight")
+	}
+}
+
+// TestThumbnailWaiters checks that callers share an in-flight job and that
+// one giving up does not fail the rest.
+func TestThumbnailWaiters(t *testing.T) {
+	dir := t.TempDir()
+	th := NewThumbnailer(filepath.Join(dir, "cache"), 1)
+	src := filepath.Join(dir, "photo.jpg")
+	writeImage(t, src, 320, 240, 0)
+
+	waiters := func() int {
+		th.mu.Lock()
+		defer th.mu.Unlock()
+		if len(th.inflight) > 1 {
+			t.Fatalf("%d jobs for one thumbnail", len(th.inflight))
+		}
+		for _, job := range th.inflight {
+			return job.waiters
+		}
+		return 0
+	}
+	waitFor := func(n int) {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); waiters() != n; {
+			if time.Now().After(deadline) {
+				t.Fatalf("waiters = %d, want %d", waiters(), n)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	type result struct {
+		path string
+		err  error
+	}
+	get := func(ctx context.Context) chan result {
+		ch := make(chan result, 1)
+		go func() {
+			p, err := th.Get(ctx, src, "small")
+			ch <- result{p, err}
+		}()
+		return ch
+	}
+
+	// No workers are running yet, so the job stays queued
+	first, cancel := context.WithCancel(t.Context())
+	a := get(first)
+	waitFor(1)
+	b := get(t.Context())
+	waitFor(2)
+
+	cancel()
+	if r := <-a; r.err != context.Canceled {
+		t.Errorf("cancelled caller got %v", r.err)
+	}
+	waitFor(1)
+
+	if err := th.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if r := <-b; r.err != nil || r.path == "" {
+		t.Fatalf("remaining caller got %q, %v", r.path, r.err)
+	}
+
+	// A job everyone gave up on is dropped without rendering
+	os.RemoveAll(th.CacheDir)
+	th = NewThumbnailer(th.CacheDir, 1)
+	gone, cancel := context.WithCancel(t.Context())
+	c := get(gone)
+	waitFor(1)
+	cancel()
+	<-c
+	waitFor(0)
+	if err := th.Start(); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		th.mu.Lock()
+		n := len(th.inflight)
+		th.mu.Unlock()
+		if n == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("abandoned job never left the queue")
+		}
+	}
+	if _, err := os.Stat(th.cachePath(src, "small")); !os.IsNotExist(err) {
+		t.Errorf("abandoned job was rendered: %v", err)
+	}
+}
@@ -0,0 +1,341 @@
+package cloud
+
+import (
+	"encoding/json"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/errs"
+)
+
+const OpUsageSave errs.Op = "cloud.Usage.save"
+
+// Usage keeps byte counts for every folder below Root so that status and
+// quota checks never have to walk the drive. Handlers keep it current through
+// Update/Remove (via NotifyChanged/NotifyRemoved); the Walker's reconcile scan
+// corrects drift from changes made outside the agent.
+type Usage struct {
+	Root      string
+	StatePath string
+
+	mu     sync.RWMutex
+	files  map[string]int64 // file rel path -> size
+	dirs   map[string]int64 // folder rel path -> bytes below it, "" is Root
+	links  map[string]link  // file rel path -> identity, for files with several names
+	owners map[fileID]string
+	dirty  bool
+	gen    int64 // bumped on every change, so readers can tell when to redo derived work
+}
+
+// fileID tells the names of a hard-linked file apart from copies.
+type fileID struct{ dev, ino uint64 }
+
+type link struct {
+	id   fileID
+	size int64
+}
+
+func NewUsage(root, statePath string) *Usage {
+	return &Usage{
+		Root:      root,
+		StatePath: statePath,
+		files:     make(map[string]int64),
+		dirs:      make(map[string]int64),
+		links:     make(map[string]link),
+		owners:    make(map[fileID]string),
+	}
+}
+
+// Start loads the saved usage and flushes it to disk every minute. The
+// Walker keeps it in step with the drive.
+func (u *Usage) Start() error {
+	if err := u.load(); err != nil {
+		log.Printf("[USAGE] Could not load saved usage, rebuilding: %v", err)
+	}
+
+	go func() {
+		flush := time.NewTicker(time.Minute)
+		defer flush.Stop()
+		for range flush.C {
+			if err := u.save(); err != nil {
+				log.Printf("[USAGE] %v", err)
+			}
+		}
+	}()
+
+	return nil
+}
+
+func (u *Usage) visit(rel, full string, info fs.FileInfo) {
+	if !info.Mode().IsRegular() {
+		return
+	}
+	u.mu.Lock()
+	u.setInfo(rel, info)
+	u.mu.Unlock()
+}
+
+// reconcile drops files that are gone and rebuilds the folder totals from
+// what the walk found.
+func (u *Usage) reconcile(seen *walked) {
+	u.mu.Lock()
+	before := u.dirs[""]
+	for rel := range u.files {
+		if !seen.has(rel) {
+			delete(u.files, rel)
+			u.unlink(rel)
+		}
+	}
+	u.rebuild()
+	u.dirty = true
+	after := u.dirs[""]
+	u.mu.Unlock()
+
+	if err := u.save(); err != nil {
+		log.Printf("[USAGE] %v", err)
+	}
+	if after != before {
+		log.Printf("[USAGE] Reconciled: %d -> %d bytes", before, after)
+	}
+}
+
+// Update re-counts a path (and everything below it if it is a folder).
+func (u *Usage) Update(fullPath string) {
+	info, err := os.Lstat(fullPath)
+	if err != nil {
+		u.Remove(fullPath)
+		return
+	}
+	if info.Mode().IsRegular() {
+		u.mu.Lock()
+		u.setInfo(u.rel(fullPath), info)
+		u.mu.Unlock()
+		return
+	}
+	if !info.IsDir() {
+		return
+	}
+
+	filepath.WalkDir(fullPath, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			u.mu.Lock()
+			u.setInfo(u.rel(p), info)
+			u.mu.Unlock()
+		}
+		return nil
+	})
+}
+
+// Remove drops a path and everything below it.
+func (u *Usage) Remove(fullPath string) {
+	rel := u.rel(fullPath)
+	prefix := rel + "/"
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	for p, size := range u.files {
+		if p == rel || strings.HasPrefix(p, prefix) {
+			delete(u.files, p)
+			u.add(p, -size)
+			u.unlink(p)
+		}
+	}
+	for d := range u.dirs {
+		if d == rel || strings.HasPrefix(d, prefix) {
+			delete(u.dirs, d)
+		}
+	}
+}
+
+// Total is the number of bytes stored below Root.
+func (u *Usage) Total() int64 {
+	return u.Folder("")
+}
+
+// Folder is the number of bytes stored below a folder (relative, slash separated).
+func (u *Usage) Folder(rel string) int64 {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	return u.dirs[rel]
+}
+
+// File returns the accounted size of a single file.
+func (u *Usage) File(fullPath string) int64 {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	return u.files[u.rel(fullPath)]
+}
+
+// TopFolders returns the size of every top-level folder.
+func (u *Usage) TopFolders() map[string]int64 {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	out := make(map[string]int64)
+	for d, size := range u.dirs {
+		if d != "" && !strings.Contains(d, "/") {
+			out[d] = size
+		}
+	}
+	return out
+}
+
+// Files returns a copy of the size of every file, by relative path.
+func (u *Usage) Files() map[string]int64 {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	out := make(map[string]int64, len(u.files))
+	for rel, size := range u.files {
+		out[rel] = size
+	}
+	return out
+}
+
+// Version changes whenever any size does.
+func (u *Usage) Version() int64 {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	return u.gen
+}
+
+// set must be called with mu held.
+func (u *Usage) set(rel string, size int64) {
+	old := u.files[rel]
+	u.files[rel] = size
+	if size != old {
+		u.add(rel, size-old)
+	}
+}
+
+// setInfo records a file. Of the names a hard-linked file has, only one is
+// charged its size; the others count as nothing, so the bytes are counted
+// once. Must be called with mu held.
+func (u *Usage) setInfo(rel string, info fs.FileInfo) {
+	id, linked := hardLink(info)
+	if old, ok := u.links[rel]; ok && (!linked || old.id != id) {
+		u.unlink(rel)
+	}
+	if !linked {
+		u.set(rel, info.Size())
+		return
+	}
+	u.links[rel] = link{id: id, size: info.Size()}
+	if owner, ok := u.owners[id]; ok && owner != rel {
+		u.set(rel, 0)
+		return
+	}
+	u.owners[id] = rel
+	u.set(rel, info.Size())
+}
+
+// unlink forgets that rel is a name of a hard-linked file. If rel was the
+// name charged for it, another remaining name takes the charge over. Must be
+// called with mu held.
+func (u *Usage) unlink(rel string) {
+	l, ok := u.links[rel]
+	if !ok {
+		return
+	}
+	delete(u.links, rel)
+	if u.owners[l.id] != rel {
+		return
+	}
+	delete(u.owners, l.id)
+	for other, ol := range u.links {
+		if ol.id == l.id {
+			u.owners[l.id] = other
+			u.set(other, ol.size)
+			return
+		}
+	}
+}
+
+// inode reports the identity of a file with several names, so callers can
+// tell its names apart from copies.
+func (u *Usage) inode(rel string) (fileID, bool) {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	l, ok := u.links[rel]
+	return l.id, ok
+}
+
+// add applies delta to every folder above rel. Must be called with mu held.
+func (u *Usage) add(rel string, delta int64) {
+	dir := rel
+	for dir != "" {
+		dir = path.Dir(dir)
+		if dir == "." {
+			dir = ""
+		}
+		u.dirs[dir] += delta
+	}
+	u.dirty = true
+	u.gen++
+}
+
+// rebuild recomputes dirs from files. Must be called with mu held.
+func (u *Usage) rebuild() {
+	u.gen++
+	u.dirs = make(map[string]int64)
+	for rel, size := range u.files {
+		u.add(rel, size)
+	}
+}
+
+func (u *Usage) rel(fullPath string) string {
+	rel, err := filepath.Rel(u.Root, fullPath)
+	if err != nil || rel == "." {
+		return ""
+	}
+	return filepath.ToSlash(rel)
+}
+
+func (u *Usage) load() error {
+	data, err := os.ReadFile(u.StatePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	files := make(map[string]int64)
+	if err := json.Unmarshal(data, &files); err != nil {
+		return err
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.files = files
+	u.rebuild()
+	u.dirty = false
+	return nil
+}
+
+func (u *Usage) save() error {
+	u.mu.Lock()
+	if !u.dirty {
+		u.mu.Unlock()
+		return nil
+	}
+	data, err := json.Marshal(u.files)
+	u.dirty = false
+	u.mu.Unlock()
+
+	if err != nil {
+		return errs.E(OpUsageSave, errs.KindIO, err)
+	}
+	if err := writeFileAtomic(u.StatePath, data); err != nil {
+		return errs.E(OpUsageSave, errs.KindIO, err)
+	}
+	return nil
+}
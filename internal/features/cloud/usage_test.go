@@ -0,0 +1,209 @@
+package cloud
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/strct-org/strct-agent/internal/accounts"
+	"github.com/strct-org/strct-agent/internal/errs"
+	"github.com/strct-org/strct-agent/internal/fsx"
+)
+
+func TestUsageIncremental(t *testing.T) {
+	c := newTestCloud(t)
+	write := func(rel string, size int) func() {
+		return func() {
+			p := filepath.Join(c.DataDir, filepath.FromSlash(rel))
+			os.MkdirAll(filepath.Dir(p), 0755)
+			os.WriteFile(p, []byte(strings.Repeat("x", size)), 0644)
+			c.NotifyChanged(p)
+		}
+	}
+
+	type step struct {
+		name string
+		op   func()
+		want map[string]int64
+	}
+	tests := []step{
+		{"upload", write("alice/a.txt", 100), map[string]int64{"": 100, "alice": 100}},
+		{"nested upload", write("alice/photos/b.jpg", 50), map[string]int64{"": 150, "alice": 150, "alice/photos": 50}},
+		{"overwrite smaller", write("alice/a.txt", 10), map[string]int64{"": 60, "alice": 60}},
+		{"other folder", write("bob/c.bin", 1000), map[string]int64{"": 1060, "alice": 60, "bob": 1000}},
+		{"move folder", func() {
+			oldPath := filepath.Join(c.DataDir, "alice", "photos")
+			newPath := filepath.Join(c.DataDir, "bob", "photos")
+			os.Rename(oldPath, newPath)
+			c.NotifyRemoved(oldPath)
+			c.NotifyChanged(newPath)
+		}, map[string]int64{"": 1060, "alice": 10, "bob": 1050, "alice/photos": 0, "bob/photos": 50}},
+		{"delete", func() {
+			p := filepath.Join(c.DataDir, "bob")
+			os.RemoveAll(p)
+			c.NotifyRemoved(p)
+		}, map[string]int64{"": 10, "alice": 10, "bob": 0}},
+		{"reconcile external change", func() {
+			os.WriteFile(filepath.Join(c.DataDir, "alice", "sneaky.txt"), make([]byte, 7), 0644)
+			if _, err := c.Walker.Scan(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+		}, map[string]int64{"": 17, "alice": 17}},
+	}
+	if runtime.GOOS == "linux" {
+		tests = append(tests, []step{
+			{"hard link counts once", func() {
+				os.MkdirAll(filepath.Join(c.DataDir, "bob"), 0755)
+				os.Link(filepath.Join(c.DataDir, "alice", "a.txt"), filepath.Join(c.DataDir, "bob", "a.txt"))
+				if _, err := c.Walker.Scan(context.Background()); err != nil {
+					t.Fatal(err)
+				}
+			}, map[string]int64{"": 17, "alice": 17, "bob": 0}},
+			{"other name takes over the charge", func() {
+				p := filepath.Join(c.DataDir, "alice", "a.txt")
+				os.Remove(p)
+				c.NotifyRemoved(p)
+			}, map[string]int64{"": 17, "alice": 7, "bob": 10}},
+		}...)
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.op()
+			for dir, want := range tt.want {
+				if got := c.Usage.Folder(dir); got != want {
+					t.Errorf("Folder(%q) = %d, want %d", dir, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestCheckQuota(t *testing.T) {
+	c := newTestCloud(t)
+	store, err := accounts.Open(filepath.Join(c.StateDir, "accounts.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Accounts = store
+	if _, err := store.Create("alice", false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Update("alice", 100, []string{"alice"}); err != nil {
+		t.Fatal(err)
+	}
+
+	existing := filepath.Join(c.DataDir, "alice", "a.txt")
+	os.MkdirAll(filepath.Dir(existing), 0755)
+	os.WriteFile(existing, make([]byte, 60), 0644)
+	c.NotifyChanged(existing)
+
+	tests := []struct {
+		name    string
+		path    string
+		size    int64
+		wantErr bool
+	}{
+		{"fits", "alice/b.txt", 40, false},
+		{"over quota", "alice/b.txt", 41, true},
+		{"overwrite counts only growth", "alice/a.txt", 100, false},
+		{"unowned folder", "shared/big.iso", 1 << 20, false},
+		{"root file", "notes.txt", 1 << 20, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := c.CheckQuota(filepath.Join(c.DataDir, filepath.FromSlash(tt.path)), tt.size)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("CheckQuota() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			var e *errs.Error
+			if err != nil && (!errors.As(err, &e) || e.Kind != errs.KindQuota) {
+				t.Errorf("error kind = %v, want KindQuota", err)
+			}
+		})
+	}
+}
+
+func TestLimitUpload(t *testing.T) {
+	c := newTestCloud(t)
+	store, err := accounts.Open(filepath.Join(c.StateDir, "accounts.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Accounts = store
+	store.Create("alice", false)
+	store.Update("alice", 100, []string{"alice"})
+	existing := filepath.Join(c.DataDir, "alice", "a.txt")
+	os.MkdirAll(filepath.Dir(existing), 0755)
+	os.WriteFile(existing, make([]byte, 60), 0644)
+	c.NotifyChanged(existing)
+
+	isQuotaErr := func(err error) bool {
+		var e *errs.Error
+		return errors.As(err, &e) && e.Kind == errs.KindQuota
+	}
+	for _, tt := range []struct {
+		path string
+		size int
+		ok   bool
+	}{
+		{"alice/b.txt", 40, true},
+		{"alice/b.txt", 41, false},
+		{"alice/a.txt", 100, true},
+		{"alice/a.txt", 101, false},
+		{"shared/big.iso", 1 << 20, true},
+	} {
+		r, err := c.LimitUpload(filepath.Join(c.DataDir, filepath.FromSlash(tt.path)), strings.NewReader(strings.Repeat("x", tt.size)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, err := io.Copy(io.Discard, r)
+		if tt.ok && (err != nil || n != int64(tt.size)) {
+			t.Errorf("%s, %d bytes: %d read, %v", tt.path, tt.size, n, err)
+		}
+		if !tt.ok && !isQuotaErr(err) {
+			t.Errorf("%s, %d bytes: %d read, %v, want a quota error", tt.path, tt.size, n, err)
+		}
+	}
+
+	// Uploads that do not say their length are stopped at the quota too
+	tooLarge := strings.Repeat("x", 50)
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	fw, _ := mw.CreateFormFile("file", "b.txt")
+	fw.Write([]byte(tooLarge))
+	mw.Close()
+	r := httptest.NewRequest(http.MethodPost, "/strct_agent/fs/upload?path=/alice", &buf)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	r.ContentLength = -1
+	w := httptest.NewRecorder()
+	c.handleUpload(w, r)
+	if w.Code != http.StatusInsufficientStorage {
+		t.Errorf("chunked upload: %d %s", w.Code, w.Body)
+	}
+
+	r = httptest.NewRequest(http.MethodPut, davPrefix+"/alice/b.txt", strings.NewReader(tooLarge))
+	r.ContentLength = -1
+	w = httptest.NewRecorder()
+	c.handleDAV(w, r)
+	if w.Code != http.StatusInsufficientStorage {
+		t.Errorf("chunked WebDAV PUT: %d %s", w.Code, w.Body)
+	}
+
+	if _, err := os.Stat(filepath.Join(c.DataDir, "alice", "b.txt")); err == nil {
+		t.Error("stored an upload past the quota")
+	}
+	if leftovers, _ := filepath.Glob(filepath.Join(c.DataDir, "alice", fsx.TempPrefix+"*")); len(leftovers) != 0 {
+		t.Errorf("left %v behind", leftovers)
+	}
+}
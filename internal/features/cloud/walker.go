@@ -0,0 +1,185 @@
+package cloud
+
+import (
+	"context"
+	"io/fs"
+	"log"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/errs"
+)
+
+const OpWalk errs.Op = "cloud.Walker.Scan"
+
+// scanner is an index kept in step with Root by the Walker.
+type scanner interface {
+	// Start loads what the index saved and starts its own background work.
+	Start() error
+	// visit is called for every entry the walk finds below Root.
+	visit(rel, full string, info fs.FileInfo)
+	// reconcile is called after a complete walk with what it found, to
+	// forget whatever is gone.
+	reconcile(seen *walked)
+}
+
+// walked is what one walk of Root found. Everything below a folder the
+// walk could not read, or left alone because its drive is offline, counts
+// as found: neither is ever taken for the files having been deleted.
+type walked struct {
+	found map[string]bool
+	kept  []string // folders whose contents were not looked at
+}
+
+func (wk *walked) has(rel string) bool {
+	if wk.found[rel] {
+		return true
+	}
+	for _, dir := range wk.kept {
+		if strings.HasPrefix(rel, dir+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Walker walks Root for every index at once, so a reconcile scan reads the
+// drive's folders one time rather than once per index. Handlers keep the
+// indexes current through NotifyChanged/NotifyRemoved; the scan only
+// catches what changed behind the agent's back (SSH, Samba, etc).
+type Walker struct {
+	Root string
+
+	// The walk sleeps for Throttle after every BatchSize entries so a full
+	// walk of a large drive does not pin the Pi's CPU and I/O.
+	BatchSize      int
+	Throttle       time.Duration
+	RescanInterval time.Duration
+
+	// Offline reports whether fullPath is on storage that is not mounted
+	// right now. Nothing is scanned there, so an empty mount point never
+	// reads as every file on the drive having been deleted.
+	Offline func(fullPath string) bool
+
+	scanners []scanner
+	mu       sync.Mutex // one walk at a time
+}
+
+func NewWalker(root string, scanners ...scanner) *Walker {
+	return &Walker{
+		Root:           root,
+		BatchSize:      200,
+		Throttle:       50 * time.Millisecond,
+		RescanInterval: 6 * time.Hour,
+		scanners:       scanners,
+	}
+}
+
+// Start starts every index before the first walk so none of them loads its
+// saved state over what the walk found.
+func (w *Walker) Start() error {
+	for _, sc := range w.scanners {
+		if err := sc.Start(); err != nil {
+			return err
+		}
+	}
+
+	go func() {
+		ctx := context.Background()
+		w.runScan(ctx)
+
+		rescan := time.NewTicker(w.RescanInterval)
+		defer rescan.Stop()
+		for range rescan.C {
+			w.runScan(ctx)
+		}
+	}()
+	return nil
+}
+
+func (w *Walker) runScan(ctx context.Context) {
+	start := time.Now()
+	n, err := w.Scan(ctx)
+	if err != nil {
+		log.Printf("[SCAN] Scan failed: %v", err)
+		return
+	}
+	log.Printf("[SCAN] Scan complete: %d entries in %s", n, time.Since(start).Round(time.Second))
+}
+
+// Scan walks Root once and reconciles every index with what is on disk.
+// Entries are only stat'ed, never opened, so a rescan of an unchanged tree
+// is cheap. It returns how many entries it found.
+func (w *Walker) Scan(ctx context.Context) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.offline(w.Root) {
+		return 0, errs.E(OpWalk, errs.KindNotFound, "storage is offline")
+	}
+	seen := &walked{found: make(map[string]bool)}
+	n := 0
+	err := filepath.WalkDir(w.Root, func(p string, d fs.DirEntry, err error) error {
+		if p == w.Root {
+			return err
+		}
+		rel, relErr := filepath.Rel(w.Root, p)
+		if relErr != nil {
+			return nil
+		}
+		rel = filepath.ToSlash(rel)
+		if err != nil {
+			// Unreadable subtrees are skipped, not fatal
+			log.Printf("[SCAN] Skipping %s: %v", p, err)
+			seen.found[rel] = true
+			seen.kept = append(seen.kept, rel)
+			if d != nil && d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		n++
+		if w.BatchSize > 0 && n%w.BatchSize == 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(w.Throttle):
+			}
+		}
+
+		// Pool volumes are the top-level folders
+		if d.IsDir() && !strings.Contains(rel, "/") && w.offline(p) {
+			seen.found[rel] = true
+			seen.kept = append(seen.kept, rel)
+			return filepath.SkipDir
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		seen.found[rel] = true
+		for _, sc := range w.scanners {
+			sc.visit(rel, p, info)
+		}
+		return nil
+	})
+	if err != nil {
+		return n, errs.E(OpWalk, errs.KindIO, err)
+	}
+	// Ejected while the walk was running: what it saw is not the drive
+	if w.offline(w.Root) {
+		return n, errs.E(OpWalk, errs.KindNotFound, "storage went offline during the scan")
+	}
+
+	for _, sc := range w.scanners {
+		sc.reconcile(seen)
+	}
+	return n, nil
+}
+
+func (w *Walker) offline(fullPath string) bool {
+	return w.Offline != nil && w.Offline(fullPath)
+}
@@ -0,0 +1,189 @@
+package importer
+
+import (
+	"encoding/json"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/errs"
+)
+
+func (m *Manager) GetRoutes() map[string]http.HandlerFunc {
+	return map[string]http.HandlerFunc{
+		"/api/import/devices": m.handleDevices,
+		"/api/import/run":     m.handleRun,
+		"/api/import/rules":   m.handleRules,
+		"/api/import/history": m.handleHistory,
+	}
+}
+
+// handleDevices lists the media plugged in right now with their rules and
+// imports.
+func (m *Manager) handleDevices(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	m.mu.Lock()
+	list := make([]Device, 0, len(m.attached))
+	for id, v := range m.attached {
+		d := Device{Volume: v, ID: id}
+		if rule := m.Rules[id]; rule != nil {
+			cp := *rule
+			d.Rule = &cp
+		}
+		if j := m.jobs[id]; j != nil {
+			p := j.progress
+			d.Running, d.Progress = true, &p
+		}
+		for i := len(m.History) - 1; i >= 0; i-- {
+			if m.History[i].Volume == id {
+				res := m.History[i]
+				d.Last = &res
+				break
+			}
+		}
+		list = append(list, d)
+	}
+	m.mu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Device < list[j].Device })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]Device{"devices": list})
+}
+
+// handleRun starts importing a card (POST) or cancels the import (DELETE).
+func (m *Manager) handleRun(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+	switch r.Method {
+	case http.MethodPost:
+		m.mu.Lock()
+		_, ok := m.attached[id]
+		busy := m.jobs[id] != nil
+		m.mu.Unlock()
+		if !ok {
+			errs.HTTPResponse(w, errs.E(OpImportAPI, errs.KindNotFound, "this card is not plugged in"))
+			return
+		}
+		if busy {
+			errs.HTTPResponse(w, errs.E(OpImportAPI, errs.KindInvalid, "this card is already being imported"))
+			return
+		}
+		m.runAsync(id)
+		w.WriteHeader(http.StatusAccepted)
+	case http.MethodDelete:
+		m.mu.Lock()
+		j := m.jobs[id]
+		m.mu.Unlock()
+		if j == nil {
+			errs.HTTPResponse(w, errs.E(OpImportAPI, errs.KindNotFound, "nothing is being imported from this card"))
+			return
+		}
+		j.cancel()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (m *Manager) handleRules(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		m.mu.Lock()
+		list := make([]Rule, 0, len(m.Rules))
+		for _, rule := range m.Rules {
+			list = append(list, *rule)
+		}
+		m.mu.Unlock()
+		sort.Slice(list, func(i, j int) bool { return list[i].Created.Before(list[j].Created) })
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string][]Rule{"rules": list})
+	case http.MethodPost:
+		m.saveRule(w, r)
+	case http.MethodDelete:
+		id := r.URL.Query().Get("uuid")
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if m.Rules[id] == nil {
+			errs.HTTPResponse(w, errs.E(OpImportAPI, errs.KindNotFound, "no rule for this card"))
+			return
+		}
+		delete(m.Rules, id)
+		if err := m.save(); err != nil {
+			errs.HTTPResponse(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// saveRule creates or replaces the rule for a card.
+func (m *Manager) saveRule(w http.ResponseWriter, r *http.Request) {
+	var rule Rule
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&rule); err != nil {
+		errs.HTTPResponse(w, errs.E(OpImportAPI, errs.KindInvalid, "Invalid JSON"))
+		return
+	}
+	rule.UUID = strings.TrimSpace(rule.UUID)
+	if rule.UUID == "" {
+		errs.HTTPResponse(w, errs.E(OpImportAPI, errs.KindInvalid, "uuid is required"))
+		return
+	}
+	rule.Name = strings.TrimSpace(rule.Name)
+	if rule.Folder != "" {
+		rule.Folder = strings.Trim(path.Clean("/"+rule.Folder), "/")
+		if rule.Folder == "" {
+			errs.HTTPResponse(w, errs.E(OpImportAPI, errs.KindInvalid, "pick a folder, not the whole drive"))
+			return
+		}
+	}
+	exts := rule.Extensions[:0]
+	for _, e := range rule.Extensions {
+		e = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(e), "."))
+		if e == "" || strings.ContainsAny(e, "/\\") {
+			errs.HTTPResponse(w, errs.E(OpImportAPI, errs.KindInvalid, "bad extension"))
+			return
+		}
+		exts = append(exts, e)
+	}
+	rule.Extensions = exts
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	status := http.StatusCreated
+	rule.Created = time.Now().UTC()
+	if old := m.Rules[rule.UUID]; old != nil {
+		status = http.StatusOK
+		rule.Created = old.Created
+	}
+	m.Rules[rule.UUID] = &rule
+	if err := m.save(); err != nil {
+		errs.HTTPResponse(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(rule)
+}
+
+// handleHistory lists past imports, newest first.
+func (m *Manager) handleHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	m.mu.Lock()
+	list := make([]Result, 0, len(m.History))
+	for i := len(m.History) - 1; i >= 0; i-- {
+		list = append(list, m.History[i])
+	}
+	m.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]Result{"imports": list})
+}
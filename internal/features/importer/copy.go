@@ -0,0 +1,305 @@
+package importer
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/errs"
+	"github.com/strct-org/strct-agent/internal/platform/disk"
+)
+
+// tempPrefix keeps half-copied files out of the cloud's listings, index and
+// sync journal, like its own uploads.
+const tempPrefix = ".strct-upload-import-"
+
+// systemDirs are written by operating systems, not by the user or camera.
+var systemDirs = map[string]bool{
+	"System Volume Information": true,
+	"$RECYCLE.BIN":              true,
+	"RECYCLER":                  true,
+	"LOST.DIR":                  true,
+	"lost+found":                true,
+}
+
+type source struct {
+	rel  string
+	size int64
+	mod  time.Time
+}
+
+// key identifies a file on one card without reading it.
+func (s source) key() string {
+	return fmt.Sprintf("%s|%d|%d", s.rel, s.size, s.mod.Unix())
+}
+
+// copyNew copies the files on the volume mounted at dir that are not on the
+// device yet. Files this card already gave are skipped without being read,
+// so plugging the same card in again is quick, and a photo the user deleted
+// after the last import does not come back.
+func (m *Manager) copyNew(ctx context.Context, id string, v disk.Volume, rule Rule, dir string, res *Result) error {
+	m.update(id, func(p *Progress) { p.Phase = "scanning" })
+	files, total, err := scanSource(ctx, dir, rule.Extensions)
+	if err != nil {
+		return errs.E(OpImportRun, errs.KindIO, err, "could not read the card")
+	}
+	m.update(id, func(p *Progress) { p.Phase, p.Files, p.TotalBytes = "copying", len(files), total })
+
+	name := rule.Name
+	if name == "" {
+		name = v.Label
+	}
+	if name == "" {
+		name = "Card"
+	}
+	folder := rule.Folder
+	if folder == "" {
+		folder = defaultFolder
+	}
+	res.Folder = path.Join(folder, time.Now().Format("2006-01-02")+" "+safeName(name))
+	dest := filepath.Join(m.DataDir, filepath.FromSlash(res.Folder))
+
+	known := m.loadKnown(id)
+	defer m.saveKnown(id, known)
+	copied := make(map[string]bool) // digests copied in this run
+
+	for _, src := range files {
+		if err := ctx.Err(); err != nil {
+			return errs.E(OpImportRun, errs.KindInvalid, err, "import cancelled")
+		}
+		m.update(id, func(p *Progress) { p.Current = src.rel })
+
+		if _, ok := known[src.key()]; ok {
+			res.Duplicates++
+		} else {
+			sum, n, err := m.copyFile(ctx, filepath.Join(dir, filepath.FromSlash(src.rel)), src, dest, copied)
+			var rerr *readError
+			switch {
+			case errors.As(err, &rerr):
+				// A bad sector or a flaky reader loses one file, not the
+				// whole card
+				res.Failed++
+			case err != nil:
+				return err
+			case n < 0:
+				res.Duplicates++
+				known[src.key()] = sum
+			default:
+				res.Copied++
+				res.Bytes += n
+				known[src.key()] = sum
+			}
+		}
+		m.update(id, func(p *Progress) { p.Done++; p.Bytes += src.size })
+	}
+	return nil
+}
+
+// scanSource lists the user's files under dir, leaving out hidden files
+// and the folders operating systems keep on removable media.
+func scanSource(ctx context.Context, dir string, exts []string) ([]source, int64, error) {
+	want := make(map[string]bool)
+	for _, e := range exts {
+		want[e] = true
+	}
+	var files []source
+	var total int64
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if p == dir {
+				return err
+			}
+			return nil
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		name := d.Name()
+		if p != dir && (strings.HasPrefix(name, ".") || systemDirs[name]) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		if len(want) > 0 && !want[strings.ToLower(strings.TrimPrefix(filepath.Ext(name), "."))] {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		rel, _ := filepath.Rel(dir, p)
+		files = append(files, source{rel: filepath.ToSlash(rel), size: info.Size(), mod: info.ModTime()})
+		total += info.Size()
+		return nil
+	})
+	return files, total, err
+}
+
+// readError is a failure reading the card rather than writing the device.
+type readError struct{ err error }
+
+func (e *readError) Error() string { return e.err.Error() }
+func (e *readError) Unwrap() error { return e.err }
+
+// copyFile copies one file into dest under its path on the card, hashing
+// it on the way. Content already on the device is dropped again and
+// reported with n < 0.
+func (m *Manager) copyFile(ctx context.Context, full string, src source, dest string, copied map[string]bool) (sum string, n int64, err error) {
+	target := filepath.Join(dest, filepath.FromSlash(src.rel))
+	if m.Store != nil {
+		// Also stops the import if storage went offline under it
+		if err := m.Store.CheckQuota(target, src.size); err != nil {
+			return "", 0, err
+		}
+	} else if free, err := disk.GetFreeDiskSpace(m.DataDir); err == nil && uint64(src.size) > free {
+		return "", 0, errs.E(OpImportRun, errs.KindInvalid, "the device is full")
+	}
+	in, err := os.Open(full)
+	if err != nil {
+		return "", 0, &readError{err}
+	}
+	defer in.Close()
+
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return "", 0, errs.E(OpImportRun, errs.KindIO, err)
+	}
+	tmp := filepath.Join(filepath.Dir(target), tempPrefix+randomHex(6))
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return "", 0, errs.E(OpImportRun, errs.KindIO, err)
+	}
+	defer func() {
+		if out != nil {
+			out.Close()
+			os.Remove(tmp)
+		}
+	}()
+
+	h := sha256.New()
+	n, err = io.Copy(io.MultiWriter(out, h), &ctxReader{ctx, readErrors{in}})
+	var rerr *readError
+	switch {
+	case errors.As(err, &rerr):
+		return "", 0, err
+	case err != nil && ctx.Err() != nil:
+		return "", 0, errs.E(OpImportRun, errs.KindInvalid, err, "import cancelled")
+	case err != nil:
+		return "", 0, errs.E(OpImportRun, errs.KindIO, err, "could not write the copy")
+	}
+	sum = hex.EncodeToString(h.Sum(nil))
+	if copied[sum] || m.Store != nil && m.Store.HasContent(sum) {
+		return sum, -1, nil
+	}
+
+	if err := out.Sync(); err != nil {
+		return "", 0, errs.E(OpImportRun, errs.KindIO, err)
+	}
+	if err := out.Close(); err != nil {
+		return "", 0, errs.E(OpImportRun, errs.KindIO, err)
+	}
+	out = nil
+	// Keep the date the camera gave the file
+	os.Chtimes(tmp, src.mod, src.mod)
+	target = freePath(target)
+	if err := os.Rename(tmp, target); err != nil {
+		os.Remove(tmp)
+		return "", 0, errs.E(OpImportRun, errs.KindIO, err)
+	}
+	copied[sum] = true
+	if m.Store != nil {
+		m.Store.NotifyWritten(target, sum)
+	}
+	return sum, n, nil
+}
+
+// freePath adds " (n)" before the extension while the name is taken.
+func freePath(p string) string {
+	ext := filepath.Ext(p)
+	base := strings.TrimSuffix(p, ext)
+	for i := 2; ; i++ {
+		if _, err := os.Lstat(p); os.IsNotExist(err) {
+			return p
+		}
+		p = fmt.Sprintf("%s (%d)%s", base, i, ext)
+	}
+}
+
+type readErrors struct{ r io.Reader }
+
+func (r readErrors) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if err != nil && err != io.EOF {
+		err = &readError{err}
+	}
+	return n, err
+}
+
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r *ctxReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+// The known files of each card are kept apart from the main state since a
+// card can hold tens of thousands of photos.
+func (m *Manager) knownPath(id string) string {
+	return filepath.Join(m.Dir, "known", safeName(id)+".json")
+}
+
+func (m *Manager) loadKnown(id string) map[string]string {
+	known := make(map[string]string)
+	if data, err := os.ReadFile(m.knownPath(id)); err == nil {
+		json.Unmarshal(data, &known)
+	}
+	return known
+}
+
+func (m *Manager) saveKnown(id string, known map[string]string) {
+	data, _ := json.Marshal(known)
+	if err := writeState(m.knownPath(id), data); err != nil {
+		log.Printf("[IMPORT] %v", err)
+	}
+}
+
+// safeName makes a label usable as a single path element.
+func safeName(s string) string {
+	s = strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r < 0x20 {
+			return '-'
+		}
+		return r
+	}, strings.TrimSpace(s))
+	s = strings.Trim(s, ".")
+	if s == "" {
+		return "Card"
+	}
+	return s
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
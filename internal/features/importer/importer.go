@@ -0,0 +1,338 @@
+// Package importer copies photos and files off camera cards and USB sticks
+// when they are plugged into the device. Media is mounted read-only, only
+// content the device does not already hold is copied, into a dated folder,
+// and the card is unmounted again when the import is done so it can be
+// pulled out safely.
+package importer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/errs"
+	"github.com/strct-org/strct-agent/internal/fsx"
+	"github.com/strct-org/strct-agent/internal/platform/disk"
+)
+
+const (
+	OpImportRun  errs.Op = "importer.Manager.Import"
+	OpImportSave errs.Op = "importer.Manager.save"
+	OpImportAPI  errs.Op = "importer.handle"
+)
+
+const (
+	// defaultFolder is where imports land in DataDir unless a rule says
+	// otherwise.
+	defaultFolder = "Imports"
+	maxHistory    = 50
+)
+
+// Store is the part of the cloud an import writes through.
+type Store interface {
+	// HasContent reports whether DataDir already holds this SHA-256.
+	HasContent(sum string) bool
+	// NotifyWritten records a copied file and its digest.
+	NotifyWritten(fullPath, sum string)
+	// CheckQuota fails when size more bytes cannot go to fullPath: the
+	// drive or its owner's quota is full, or storage is offline.
+	CheckQuota(fullPath string, size int64) error
+}
+
+// Rule is what to do with one card, recognised by its volume UUID.
+type Rule struct {
+	UUID   string `json:"uuid"`
+	Name   string `json:"name,omitempty"`   // used instead of the volume label
+	Auto   bool   `json:"auto"`             // import as soon as it is plugged in
+	Folder string `json:"folder,omitempty"` // relative to DataDir
+	// Extensions limits the import to these file types, lower case and
+	// without the dot. Empty means every file.
+	Extensions []string  `json:"extensions,omitempty"`
+	Created    time.Time `json:"created"`
+}
+
+// Progress is how far a running import has got.
+type Progress struct {
+	Phase      string `json:"phase"` // mounting, scanning, copying or unmounting
+	Files      int    `json:"files"`
+	Done       int    `json:"done"`
+	Bytes      int64  `json:"bytes"`
+	TotalBytes int64  `json:"totalBytes"`
+	Current    string `json:"current,omitempty"`
+}
+
+// Result is what one import did.
+type Result struct {
+	Volume     string    `json:"volume"`
+	Label      string    `json:"label,omitempty"`
+	Folder     string    `json:"folder"` // relative to DataDir
+	Started    time.Time `json:"started"`
+	Finished   time.Time `json:"finished"`
+	Copied     int       `json:"copied"`
+	Duplicates int       `json:"duplicates"` // already on the device
+	Failed     int       `json:"failed"`     // unreadable on the card
+	Bytes      int64     `json:"bytes"`      // copied
+	Unmounted  bool      `json:"unmounted"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// Device is a plugged-in volume as the API shows it.
+type Device struct {
+	disk.Volume
+	ID       string    `json:"id"`
+	Rule     *Rule     `json:"rule,omitempty"`
+	Running  bool      `json:"running"`
+	Progress *Progress `json:"progress,omitempty"`
+	Last     *Result   `json:"last,omitempty"`
+}
+
+type job struct {
+	cancel   context.CancelFunc
+	progress Progress
+}
+
+// Manager watches for removable media, runs imports and serves the
+// /api/import endpoints. List, Mount and Unmount default to the real disk
+// helpers.
+type Manager struct {
+	DataDir  string        `json:"-"`
+	Dir      string        `json:"-"` // state
+	MountDir string        `json:"-"`
+	Store    Store         `json:"-"`
+	Tick     time.Duration `json:"-"`
+	// Events, if set, wakes the scan as soon as media is plugged in;
+	// Tick then only catches anything missed.
+	Events <-chan disk.Event `json:"-"`
+
+	List    func() ([]disk.Volume, error)         `json:"-"`
+	Mount   func(v disk.Volume, dir string) error `json:"-"`
+	Unmount func(dir string) error                `json:"-"`
+
+	mu       sync.Mutex
+	Rules    map[string]*Rule `json:"rules"`
+	History  []Result         `json:"history"`
+	attached map[string]disk.Volume
+	handled  map[string]bool // auto-imported since it was plugged in
+	jobs     map[string]*job
+	wg       sync.WaitGroup
+}
+
+// NewManager loads the rules and history kept in stateDir/import.
+func NewManager(dataDir, stateDir string, store Store) (*Manager, error) {
+	dir := filepath.Join(stateDir, "import")
+	m := &Manager{
+		DataDir:  dataDir,
+		Dir:      dir,
+		MountDir: filepath.Join(dir, "mnt"),
+		Store:    store,
+		Tick:     3 * time.Second,
+		List:     disk.ListRemovable,
+		Mount:    disk.MountReadOnly,
+		Unmount:  disk.Unmount,
+		Rules:    make(map[string]*Rule),
+		attached: make(map[string]disk.Volume),
+		handled:  make(map[string]bool),
+		jobs:     make(map[string]*job),
+	}
+	data, err := os.ReadFile(m.statePath())
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, m); err != nil {
+			return nil, fmt.Errorf("parse %s: %w", m.statePath(), err)
+		}
+	}
+	if m.Rules == nil {
+		m.Rules = make(map[string]*Rule)
+	}
+	return m, nil
+}
+
+// Start releases mounts left behind by a restart and then looks for newly
+// plugged-in media every Tick.
+func (m *Manager) Start() error {
+	if entries, err := os.ReadDir(m.MountDir); err == nil {
+		for _, e := range entries {
+			m.Unmount(filepath.Join(m.MountDir, e.Name()))
+		}
+	}
+	go func() {
+		t := time.NewTicker(m.Tick)
+		defer t.Stop()
+		for {
+			m.scan()
+			select {
+			case <-t.C:
+			case <-m.Events:
+			}
+		}
+	}()
+	return nil
+}
+
+// scan notices media coming and going and starts automatic imports.
+func (m *Manager) scan() {
+	vols, err := m.List()
+	if err != nil {
+		log.Printf("[IMPORT] %v", err)
+		return
+	}
+
+	m.mu.Lock()
+	seen := make(map[string]bool)
+	var auto []string
+	for _, v := range vols {
+		id := v.ID()
+		seen[id] = true
+		if _, ok := m.attached[id]; !ok {
+			log.Printf("[IMPORT] %s (%s, %s) plugged in", v.Device, v.FSType, id)
+		}
+		m.attached[id] = v
+		if r := m.Rules[id]; r != nil && r.Auto && !m.handled[id] && m.jobs[id] == nil {
+			m.handled[id] = true
+			auto = append(auto, id)
+		}
+	}
+	for id, v := range m.attached {
+		if seen[id] {
+			continue
+		}
+		log.Printf("[IMPORT] %s (%s) removed", v.Device, id)
+		if j := m.jobs[id]; j != nil {
+			j.cancel()
+		}
+		delete(m.attached, id)
+		delete(m.handled, id)
+	}
+	m.mu.Unlock()
+
+	for _, id := range auto {
+		m.runAsync(id)
+	}
+}
+
+func (m *Manager) runAsync(id string) {
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		if _, err := m.Import(context.Background(), id); err != nil {
+			log.Printf("[IMPORT] %v", err)
+		}
+	}()
+}
+
+// begin marks the volume busy and returns a context that DELETE /run
+// cancels.
+func (m *Manager) begin(ctx context.Context, id string) (disk.Volume, Rule, context.Context, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	v, ok := m.attached[id]
+	if !ok {
+		return disk.Volume{}, Rule{}, nil, errs.E(OpImportRun, errs.KindNotFound, "this card is not plugged in")
+	}
+	if m.jobs[id] != nil {
+		return disk.Volume{}, Rule{}, nil, errs.E(OpImportRun, errs.KindInvalid, "this card is already being imported")
+	}
+	rule := Rule{UUID: id}
+	if r := m.Rules[id]; r != nil {
+		rule = *r
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	m.jobs[id] = &job{cancel: cancel, progress: Progress{Phase: "mounting"}}
+	return v, rule, ctx, nil
+}
+
+func (m *Manager) end(id string, res Result) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if j := m.jobs[id]; j != nil {
+		j.cancel()
+	}
+	delete(m.jobs, id)
+	m.History = append(m.History, res)
+	if len(m.History) > maxHistory {
+		m.History = m.History[len(m.History)-maxHistory:]
+	}
+	if err := m.save(); err != nil {
+		log.Printf("[IMPORT] %v", err)
+	}
+}
+
+// update changes the running import's progress under mu.
+func (m *Manager) update(id string, f func(p *Progress)) {
+	m.mu.Lock()
+	if j := m.jobs[id]; j != nil {
+		f(&j.progress)
+	}
+	m.mu.Unlock()
+}
+
+// Import copies what is new on the volume into DataDir and unmounts it.
+func (m *Manager) Import(ctx context.Context, id string) (Result, error) {
+	v, rule, ctx, err := m.begin(ctx, id)
+	if err != nil {
+		return Result{}, err
+	}
+	res := Result{Volume: id, Label: v.Label, Started: time.Now().UTC()}
+	defer func() {
+		res.Finished = time.Now().UTC()
+		m.end(id, res)
+	}()
+
+	// Media something else already mounted is read where it is and left
+	// mounted
+	dir, ours := v.Mountpoint, false
+	if dir == "" {
+		dir, ours = filepath.Join(m.MountDir, safeName(id)), true
+		if err := m.Mount(v, dir); err != nil {
+			os.Remove(dir)
+			res.Error = err.Error()
+			return res, errs.E(OpImportRun, errs.KindIO, err, "could not mount the card")
+		}
+	}
+
+	err = m.copyNew(ctx, id, v, rule, dir, &res)
+
+	if ours {
+		m.update(id, func(p *Progress) { p.Phase, p.Current = "unmounting", "" })
+		if uerr := m.Unmount(dir); uerr != nil {
+			log.Printf("[IMPORT] %v", uerr)
+		} else {
+			res.Unmounted = true
+		}
+	}
+
+	if err != nil {
+		res.Error = err.Error()
+		return res, err
+	}
+	log.Printf("[IMPORT] %s: %d copied to %s, %d already here, %d unreadable", id, res.Copied, res.Folder, res.Duplicates, res.Failed)
+	return res, nil
+}
+
+// save must be called with mu held.
+func (m *Manager) save() error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return errs.E(OpImportSave, errs.KindIO, err)
+	}
+	return writeState(m.statePath(), data)
+}
+
+func (m *Manager) statePath() string { return filepath.Join(m.Dir, "state.json") }
+
+func writeState(p string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return errs.E(OpImportSave, errs.KindIO, err)
+	}
+	if err := fsx.WriteFile(p, data, 0600); err != nil {
+		return errs.E(OpImportSave, errs.KindIO, err)
+	}
+	return nil
+}
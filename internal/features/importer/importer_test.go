@@ -0,0 +1,284 @@
+package importer
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/platform/disk"
+)
+
+type fakeStore struct {
+	mu      sync.Mutex
+	sums    map[string]bool
+	written []string
+	full    error // from CheckQuota
+}
+
+func (s *fakeStore) HasContent(sum string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sums[sum]
+}
+
+func (s *fakeStore) NotifyWritten(full, sum string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sums[sum] = true
+	s.written = append(s.written, full)
+}
+
+func (s *fakeStore) CheckQuota(full string, size int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.full
+}
+
+func sum(s string) string {
+	h := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(h[:])
+}
+
+var taken = time.Date(2024, 7, 14, 9, 30, 0, 0, time.UTC)
+
+// card is what a camera leaves on its card, plus the clutter computers add.
+var card = fstest.MapFS{
+	"DCIM/100CANON/IMG_0001.JPG":                  {Data: []byte("sunrise"), ModTime: taken},
+	"DCIM/100CANON/IMG_0002.CR3":                  {Data: []byte("raw sunrise"), ModTime: taken},
+	"DCIM/101CANON/IMG_0001.JPG":                  {Data: []byte("sunset"), ModTime: taken},
+	"DCIM/101CANON/IMG_0003.JPG":                  {Data: []byte("sunset"), ModTime: taken}, // same shot twice
+	"PRIVATE/M4ROOT/CLIP/C0001.MP4":               {Data: []byte("video"), ModTime: taken},
+	"._IMG_0001.JPG":                              {Data: []byte("resource fork")},
+	".Trashes/501/old.jpg":                        {Data: []byte("trash")},
+	"System Volume Information/IndexerVolumeGuid": {Data: []byte("guid")},
+}
+
+type testManager struct {
+	*Manager
+	store     *fakeStore
+	unmounts  int
+	mountFail error
+}
+
+func newTestManager(t *testing.T, vols ...disk.Volume) *testManager {
+	t.Helper()
+	tm := &testManager{store: &fakeStore{sums: make(map[string]bool)}}
+	m, err := NewManager(t.TempDir(), t.TempDir(), tm.store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.List = func() ([]disk.Volume, error) { return vols, nil }
+	m.Mount = func(v disk.Volume, dir string) error {
+		if tm.mountFail != nil {
+			return tm.mountFail
+		}
+		if err := os.CopyFS(dir, card); err != nil {
+			return err
+		}
+		for name, f := range card {
+			os.Chtimes(filepath.Join(dir, name), f.ModTime, f.ModTime)
+		}
+		return nil
+	}
+	m.Unmount = func(dir string) error {
+		tm.unmounts++
+		return os.RemoveAll(dir)
+	}
+	tm.Manager = m
+	return tm
+}
+
+func (tm *testManager) call(t *testing.T, method, target, body string, out any) int {
+	t.Helper()
+	w := httptest.NewRecorder()
+	route := target
+	if i := strings.IndexByte(route, '?'); i >= 0 {
+		route = route[:i]
+	}
+	tm.GetRoutes()[route](w, httptest.NewRequest(method, target, strings.NewReader(body)))
+	if out != nil && w.Code < 300 {
+		if err := json.Unmarshal(w.Body.Bytes(), out); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return w.Code
+}
+
+func readTree(t *testing.T, root string) map[string]string {
+	t.Helper()
+	files := make(map[string]string)
+	filepath.WalkDir(root, func(p string, d os.DirEntry, err error) error {
+		if err == nil && d.Type().IsRegular() {
+			rel, _ := filepath.Rel(root, p)
+			data, _ := os.ReadFile(p)
+			files[filepath.ToSlash(rel)] = string(data)
+		}
+		return nil
+	})
+	return files
+}
+
+func TestImport(t *testing.T) {
+	vol := disk.Volume{Device: "/dev/sdb1", UUID: "3A21-7F0C", Label: "EOS_DIGITAL", FSType: "exfat"}
+	tm := newTestManager(t, vol)
+	tm.store.sums[sum("video")] = true // already uploaded from the phone
+	tm.scan()
+
+	res, err := tm.Import(context.Background(), vol.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	folder := "Imports/" + time.Now().Format("2006-01-02") + " EOS_DIGITAL"
+	if res.Folder != folder || res.Copied != 3 || res.Duplicates != 2 || res.Failed != 0 || !res.Unmounted || tm.unmounts != 1 {
+		t.Errorf("result = %+v", res)
+	}
+	want := map[string]string{
+		folder + "/DCIM/100CANON/IMG_0001.JPG": "sunrise",
+		folder + "/DCIM/100CANON/IMG_0002.CR3": "raw sunrise",
+		folder + "/DCIM/101CANON/IMG_0001.JPG": "sunset",
+	}
+	got := readTree(t, tm.DataDir)
+	if len(got) != len(want) {
+		t.Errorf("imported %v", got)
+	}
+	for p, data := range want {
+		if got[p] != data {
+			t.Errorf("%s = %q, want %q", p, got[p], data)
+		}
+	}
+	if info, err := os.Stat(filepath.Join(tm.DataDir, folder, "DCIM/100CANON/IMG_0001.JPG")); err != nil || !info.ModTime().Equal(taken) {
+		t.Errorf("camera date lost: %v %v", info, err)
+	}
+	if len(tm.store.written) != 3 {
+		t.Errorf("cloud told about %v", tm.store.written)
+	}
+
+	t.Run("same card again copies nothing", func(t *testing.T) {
+		os.RemoveAll(filepath.Join(tm.DataDir, folder, "DCIM/101CANON")) // deleted by the user
+		res, err := tm.Import(context.Background(), vol.ID())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Copied != 0 || res.Duplicates != 5 {
+			t.Errorf("result = %+v", res)
+		}
+		if _, err := os.Stat(filepath.Join(tm.DataDir, folder, "DCIM/101CANON")); !os.IsNotExist(err) {
+			t.Error("a deleted photo came back")
+		}
+	})
+
+	t.Run("mount failure", func(t *testing.T) {
+		tm.mountFail = os.ErrPermission
+		defer func() { tm.mountFail = nil }()
+		if res, err := tm.Import(context.Background(), vol.ID()); err == nil || res.Error == "" {
+			t.Errorf("import of an unmountable card: %+v %v", res, err)
+		}
+	})
+
+	var history struct{ Imports []Result }
+	tm.call(t, "GET", "/api/import/history", "", &history)
+	if len(history.Imports) != 3 || history.Imports[2].Copied != 3 {
+		t.Errorf("history = %+v", history.Imports)
+	}
+
+	t.Run("storage offline", func(t *testing.T) {
+		tm.store.full = errors.New("the data drive was ejected")
+		defer func() { tm.store.full = nil }()
+		os.RemoveAll(filepath.Join(tm.DataDir, folder))
+		os.Remove(tm.knownPath(vol.ID()))
+		res, err := tm.Import(context.Background(), vol.ID())
+		if err == nil || res.Copied != 0 || !res.Unmounted {
+			t.Errorf("import while offline: %+v %v", res, err)
+		}
+		if got := readTree(t, tm.DataDir); len(got) != 0 {
+			t.Errorf("wrote while offline: %v", got)
+		}
+	})
+}
+
+func TestImportRules(t *testing.T) {
+	vol := disk.Volume{Device: "/dev/sdb1", UUID: "3A21-7F0C", Label: "EOS_DIGITAL", FSType: "exfat"}
+	other := disk.Volume{Device: "/dev/sdc", UUID: "12AB-34CD", FSType: "vfat", Mountpoint: "/media/pi/STICK"}
+	tm := newTestManager(t, vol, other)
+
+	invalid := []struct {
+		name string
+		body string
+	}{
+		{"bad json", `{`},
+		{"no uuid", `{"auto":true}`},
+		{"whole drive", `{"uuid":"x","folder":"/"}`},
+		{"bad extension", `{"uuid":"x","extensions":["jpg","../x"]}`},
+	}
+	for _, tt := range invalid {
+		t.Run(tt.name, func(t *testing.T) {
+			if code := tm.call(t, "POST", "/api/import/rules", tt.body, nil); code != http.StatusBadRequest {
+				t.Errorf("status %d", code)
+			}
+		})
+	}
+
+	var rule Rule
+	if code := tm.call(t, "POST", "/api/import/rules", `{"uuid":"3A21-7F0C","name":"Canon R6","auto":true,"folder":"/Photos/Camera/","extensions":[".JPG"," mp4"]}`, &rule); code != http.StatusCreated {
+		t.Fatalf("create rule: %d", code)
+	}
+	if rule.Folder != "Photos/Camera" || strings.Join(rule.Extensions, ",") != "jpg,mp4" {
+		t.Errorf("rule = %+v", rule)
+	}
+
+	// Plugging in the known card starts its import; the stick just shows up
+	tm.scan()
+	tm.wg.Wait()
+	folder := "Photos/Camera/" + time.Now().Format("2006-01-02") + " Canon R6"
+	got := readTree(t, tm.DataDir)
+	if len(got) != 3 || got[folder+"/DCIM/101CANON/IMG_0001.JPG"] != "sunset" || got[folder+"/PRIVATE/M4ROOT/CLIP/C0001.MP4"] != "video" {
+		t.Errorf("auto import = %v", got)
+	}
+	tm.scan()
+	tm.wg.Wait()
+	if tm.unmounts != 1 {
+		t.Errorf("imported %d times while plugged in", tm.unmounts)
+	}
+
+	var devices struct{ Devices []Device }
+	tm.call(t, "GET", "/api/import/devices", "", &devices)
+	if len(devices.Devices) != 2 {
+		t.Fatalf("devices = %+v", devices)
+	}
+	if d := devices.Devices[0]; d.ID != "3A21-7F0C" || d.Rule == nil || d.Last == nil || d.Last.Copied != 3 || d.Running {
+		t.Errorf("card = %+v", d)
+	}
+	if d := devices.Devices[1]; d.ID != "12AB-34CD" || d.Rule != nil || d.Last != nil {
+		t.Errorf("stick = %+v", d)
+	}
+
+	if code := tm.call(t, "POST", "/api/import/run?id=nope", "", nil); code != http.StatusNotFound {
+		t.Errorf("import of a missing card: %d", code)
+	}
+	if code := tm.call(t, "DELETE", "/api/import/run?id=3A21-7F0C", "", nil); code != http.StatusNotFound {
+		t.Errorf("cancel with nothing running: %d", code)
+	}
+
+	// Rules survive a restart
+	again, err := NewManager(tm.DataDir, filepath.Dir(tm.Dir), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := again.Rules["3A21-7F0C"]; r == nil || !r.Auto || len(again.History) != 1 {
+		t.Errorf("after restart: %+v %+v", r, again.History)
+	}
+	if code := tm.call(t, "DELETE", "/api/import/rules?uuid=3A21-7F0C", "", nil); code != http.StatusNoContent {
+		t.Errorf("delete rule: %d", code)
+	}
+}
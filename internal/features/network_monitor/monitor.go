@@ -25,6 +25,12 @@ type NetworkMonitor struct {
 	stats  MonitorStats
 	mu     sync.RWMutex
 	Target string
+	Checks []Check // other parts of the agent that report through /api/health
+}
+
+// Check is a component that can tell what about it needs attention.
+type Check interface {
+	Warnings() []string
 }
 
 type MonitorStats struct {
@@ -69,9 +75,10 @@ func (m *NetworkMonitor) Start() error {
 
 func (m *NetworkMonitor) HandleHealth(w http.ResponseWriter, r *http.Request) {
 	type HealthResponse struct {
-		Status    string `json:"status"`
-		Internet  bool   `json:"internet_access"`
-		Timestamp string `json:"timestamp"`
+		Status    string   `json:"status"`
+		Internet  bool     `json:"internet_access"`
+		Timestamp string   `json:"timestamp"`
+		Warnings  []string `json:"warnings,omitempty"`
 	}
 
 	response := HealthResponse{
@@ -79,6 +86,12 @@ func (m *NetworkMonitor) HandleHealth(w http.ResponseWriter, r *http.Request) {
 		Internet:  wifi.HasInternet(),
 		Timestamp: time.Now().UTC().Format(time.RFC3339),
 	}
+	for _, c := range m.Checks {
+		response.Warnings = append(response.Warnings, c.Warnings()...)
+	}
+	if len(response.Warnings) > 0 {
+		response.Status = "warning"
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
@@ -146,13 +159,18 @@ func (m *NetworkMonitor) runBandwidth() {
 
 func (m *NetworkMonitor) reportToBackend(stats MonitorStats) {
 	stats.Timestamp = time.Now()
+	m.Report("network_metrics", stats)
+}
 
-	payload, err := json.Marshal(stats)
+// Report posts metrics of the given kind, such as drive_health, to the
+// backend the same way as the network's.
+func (m *NetworkMonitor) Report(kind string, metrics any) {
+	payload, err := json.Marshal(metrics)
 	if err != nil {
 		return
 	}
 
-	url := fmt.Sprintf("%s/api/v1/device/agent/%s/network_metrics", m.Config.BackendURL, m.Config.DeviceID)
+	url := fmt.Sprintf("%s/api/v1/device/agent/%s/%s", m.Config.BackendURL, m.Config.DeviceID, kind)
 
 	req, err := http.NewRequest("POST", url, bytes.NewBuffer(payload))
 	if err != nil {
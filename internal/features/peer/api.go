@@ -0,0 +1,403 @@
+package peer
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/errs"
+)
+
+// PeerResponse is a peer as the API shows it.
+type PeerResponse struct {
+	Peer
+	Fingerprint string         `json:"fingerprint"`
+	Links       []LinkResponse `json:"links"`
+}
+
+// LinkResponse is a link with its health.
+type LinkResponse struct {
+	Link
+	Status Status `json:"status"`
+}
+
+// Identity is how this device presents itself to peers.
+type Identity struct {
+	DeviceID    string `json:"deviceId"`
+	Name        string `json:"name"`
+	URL         string `json:"url"`
+	Fingerprint string `json:"fingerprint"`
+}
+
+func (m *Manager) GetRoutes() map[string]http.HandlerFunc {
+	return map[string]http.HandlerFunc{
+		"/api/peer/identity": m.handleIdentity,
+		"/api/peer/invite":   m.handleInvite,
+		"/api/peer/join":     m.handleJoin,
+		"/api/peer/peers":    m.handlePeers,
+		"/api/peer/links":    m.handleLinks,
+		"/api/peer/run":      m.handleRun,
+		handshakePath:        m.handleHandshake,
+		rpcPath:              m.handleRPC,
+	}
+}
+
+func (m *Manager) handleIdentity(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(Identity{
+		DeviceID:    m.Config.DeviceID,
+		Name:        m.Config.Name,
+		URL:         m.Config.URL,
+		Fingerprint: Fingerprint(m.key.PublicKey().Bytes()),
+	})
+}
+
+// handleInvite issues a pairing code for the user to enter on the other
+// device.
+func (m *Manager) handleInvite(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(m.newInvite(time.Now()))
+}
+
+// handleJoin pairs with the device that issued an invite code.
+func (m *Manager) handleJoin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		URL  string `json:"url"`
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil {
+		errs.HTTPResponse(w, errs.E(OpPeerAPI, errs.KindInvalid, "Invalid JSON"))
+		return
+	}
+	if !strings.HasPrefix(req.URL, "https://") && !strings.HasPrefix(req.URL, "http://") {
+		errs.HTTPResponse(w, errs.E(OpPeerAPI, errs.KindInvalid, "url must be the other device's address"))
+		return
+	}
+	p, err := m.Join(r.Context(), req.URL, req.Code)
+	if err != nil {
+		errs.HTTPResponse(w, err)
+		return
+	}
+
+	m.mu.Lock()
+	resp := m.peerResponse(p, time.Now())
+	m.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// peerResponse must be called with mu held.
+func (m *Manager) peerResponse(p *Peer, now time.Time) PeerResponse {
+	resp := PeerResponse{Peer: *p, Fingerprint: Fingerprint(p.PublicKey), Links: []LinkResponse{}}
+	resp.Grants = append([]Grant{}, p.Grants...)
+	for _, l := range m.Links {
+		if l.Peer == p.ID {
+			resp.Links = append(resp.Links, m.linkResponse(l, now))
+		}
+	}
+	sort.Slice(resp.Links, func(i, j int) bool { return resp.Links[i].Created.Before(resp.Links[j].Created) })
+	return resp
+}
+
+// linkResponse must be called with mu held.
+func (m *Manager) linkResponse(l *Link, now time.Time) LinkResponse {
+	resp := LinkResponse{Link: *l, Status: m.health(l, m.Status[l.ID], now)}
+	if l.Window != nil {
+		win := *l.Window
+		resp.Window = &win
+	}
+	return resp
+}
+
+// handlePeers lists peers with the health of their links (GET), renames
+// a peer or changes what it may sync with (POST) and unpairs one
+// (DELETE).
+func (m *Manager) handlePeers(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		now := time.Now()
+		m.mu.Lock()
+		list := make([]PeerResponse, 0, len(m.Peers))
+		for _, p := range m.Peers {
+			list = append(list, m.peerResponse(p, now))
+		}
+		m.mu.Unlock()
+		sort.Slice(list, func(i, j int) bool { return list[i].Paired.Before(list[j].Paired) })
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string][]PeerResponse{"peers": list})
+
+	case http.MethodPost:
+		m.updatePeer(w, r)
+
+	case http.MethodDelete:
+		id := r.URL.Query().Get("id")
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if m.Peers[id] == nil {
+			errs.HTTPResponse(w, errs.E(OpPeerAPI, errs.KindNotFound, "unknown peer"))
+			return
+		}
+		delete(m.Peers, id)
+		for lid, l := range m.Links {
+			if l.Peer == id {
+				m.removeLink(lid)
+			}
+		}
+		if err := m.save(); err != nil {
+			errs.HTTPResponse(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (m *Manager) updatePeer(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ID     string   `json:"id"`
+		Name   string   `json:"name"`
+		Grants *[]Grant `json:"grants"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil {
+		errs.HTTPResponse(w, errs.E(OpPeerAPI, errs.KindInvalid, "Invalid JSON"))
+		return
+	}
+	var grants []Grant
+	if req.Grants != nil {
+		for _, g := range *req.Grants {
+			g.Folder = cleanFolder(g.Folder)
+			if g.Folder == "" {
+				errs.HTTPResponse(w, errs.E(OpPeerAPI, errs.KindInvalid, "a grant must name a folder, not the whole drive"))
+				return
+			}
+			grants = append(grants, g)
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	p := m.Peers[req.ID]
+	if p == nil {
+		errs.HTTPResponse(w, errs.E(OpPeerAPI, errs.KindNotFound, "unknown peer"))
+		return
+	}
+	if name := strings.TrimSpace(req.Name); name != "" {
+		p.Name = safeName(name, p.ID)
+	}
+	if req.Grants != nil {
+		p.Grants = grants
+	}
+	if err := m.save(); err != nil {
+		errs.HTTPResponse(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(m.peerResponse(p, time.Now()))
+}
+
+// handleLinks lists (GET), creates or updates (POST) and removes (DELETE)
+// replication links.
+func (m *Manager) handleLinks(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		now := time.Now()
+		m.mu.Lock()
+		list := make([]LinkResponse, 0, len(m.Links))
+		for _, l := range m.Links {
+			list = append(list, m.linkResponse(l, now))
+		}
+		m.mu.Unlock()
+		sort.Slice(list, func(i, j int) bool { return list[i].Created.Before(list[j].Created) })
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string][]LinkResponse{"links": list})
+
+	case http.MethodPost:
+		m.saveLink(w, r)
+
+	case http.MethodDelete:
+		id := r.URL.Query().Get("id")
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if m.Links[id] == nil {
+			errs.HTTPResponse(w, errs.E(OpPeerAPI, errs.KindNotFound, "unknown link"))
+			return
+		}
+		m.removeLink(id)
+		if err := m.save(); err != nil {
+			errs.HTTPResponse(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// removeLink forgets a link and its sync state; the files stay. It must be
+// called with mu held.
+func (m *Manager) removeLink(id string) {
+	if cancel := m.cancels[id]; cancel != nil {
+		cancel()
+	}
+	delete(m.Links, id)
+	delete(m.Status, id)
+	os.Remove(m.linkState(id))
+}
+
+// saveLink creates a link, or updates one when the body carries a known id.
+func (m *Manager) saveLink(w http.ResponseWriter, r *http.Request) {
+	var l Link
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&l); err != nil {
+		errs.HTTPResponse(w, errs.E(OpPeerAPI, errs.KindInvalid, "Invalid JSON"))
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	old := m.Links[l.ID]
+	if l.ID != "" && old == nil {
+		errs.HTTPResponse(w, errs.E(OpPeerAPI, errs.KindNotFound, "unknown link"))
+		return
+	}
+	p := m.Peers[l.Peer]
+	if p == nil {
+		errs.HTTPResponse(w, errs.E(OpPeerAPI, errs.KindNotFound, "unknown peer"))
+		return
+	}
+	if old != nil {
+		if m.cancels[l.ID] != nil {
+			errs.HTTPResponse(w, errs.E(OpPeerAPI, errs.KindInvalid, "wait for the running sync to finish"))
+			return
+		}
+		if l.RemoteFolder == "" {
+			l.RemoteFolder = old.RemoteFolder
+		}
+		if l.Peer != old.Peer || cleanFolder(l.Folder) != old.Folder || cleanFolder(l.RemoteFolder) != old.RemoteFolder {
+			// The sync state describes one pair of folders
+			errs.HTTPResponse(w, errs.E(OpPeerAPI, errs.KindInvalid, "the folders of a link cannot be changed; make a new link"))
+			return
+		}
+		l.Created = old.Created
+	}
+
+	l.Folder = cleanFolder(l.Folder)
+	if l.Folder == "" {
+		errs.HTTPResponse(w, errs.E(OpPeerAPI, errs.KindInvalid, "folder must name a folder, not the whole drive"))
+		return
+	}
+	if l.RemoteFolder == "" {
+		l.RemoteFolder = p.Offered
+		if l.RemoteFolder == "" {
+			// What the peer grants a new device unless told otherwise
+			l.RemoteFolder = defaultGrant(m.Config.Name, m.Config.DeviceID)
+		}
+	}
+	l.RemoteFolder = cleanFolder(l.RemoteFolder)
+	if l.RemoteFolder == "" {
+		errs.HTTPResponse(w, errs.E(OpPeerAPI, errs.KindInvalid, "remoteFolder must name a folder"))
+		return
+	}
+	for id, other := range m.Links {
+		if id != l.ID && (other.Folder == l.Folder || strings.HasPrefix(other.Folder, l.Folder+"/") || strings.HasPrefix(l.Folder, other.Folder+"/")) {
+			errs.HTTPResponse(w, errs.E(OpPeerAPI, errs.KindInvalid, fmt.Sprintf("%s is already replicated by another link", other.Folder)))
+			return
+		}
+	}
+	switch l.Mode {
+	case "":
+		l.Mode = ModeBoth
+	case ModeBoth, ModePush, ModePull:
+	default:
+		errs.HTTPResponse(w, errs.E(OpPeerAPI, errs.KindInvalid, "mode must be both, push or pull"))
+		return
+	}
+	if l.Every != "" {
+		if d, err := time.ParseDuration(l.Every); err != nil || d < minInterval {
+			errs.HTTPResponse(w, errs.E(OpPeerAPI, errs.KindInvalid, fmt.Sprintf("every must be a duration of at least %s", minInterval)))
+			return
+		}
+	}
+	if l.Window != nil {
+		_, err1 := parseClock(l.Window.Start)
+		_, err2 := parseClock(l.Window.End)
+		if err1 != nil || err2 != nil || l.Window.Start == l.Window.End {
+			errs.HTTPResponse(w, errs.E(OpPeerAPI, errs.KindInvalid, "window needs a different start and end as HH:MM"))
+			return
+		}
+	}
+	if l.LimitKBps < 0 {
+		errs.HTTPResponse(w, errs.E(OpPeerAPI, errs.KindInvalid, "limitKBps must not be negative"))
+		return
+	}
+
+	status := http.StatusOK
+	if old == nil {
+		l.ID = randomHex(8)
+		l.Created = time.Now().UTC()
+		m.Status[l.ID] = &Status{}
+		status = http.StatusCreated
+	}
+	m.Links[l.ID] = &l
+	if err := m.save(); err != nil {
+		errs.HTTPResponse(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(m.linkResponse(&l, time.Now()))
+}
+
+// handleRun syncs a link now (POST), ignoring its window, or stops the
+// running sync (DELETE).
+func (m *Manager) handleRun(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+	m.mu.Lock()
+	_, ok := m.Links[id]
+	cancel := m.cancels[id]
+	m.mu.Unlock()
+	if !ok {
+		errs.HTTPResponse(w, errs.E(OpPeerAPI, errs.KindNotFound, "unknown link"))
+		return
+	}
+	switch r.Method {
+	case http.MethodPost:
+		if cancel != nil {
+			errs.HTTPResponse(w, errs.E(OpPeerAPI, errs.KindInvalid, "this link is already syncing"))
+			return
+		}
+		m.runAsync(id, false)
+		w.WriteHeader(http.StatusAccepted)
+	case http.MethodDelete:
+		if cancel == nil {
+			errs.HTTPResponse(w, errs.E(OpPeerAPI, errs.KindNotFound, "this link is not syncing"))
+			return
+		}
+		cancel()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,275 @@
+package peer
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/errs"
+)
+
+const (
+	handshakePath = "/api/peer/handshake"
+	inviteTTL     = 10 * time.Minute
+	maxInvites    = 5
+)
+
+// Pairing: the user asks one device for an invite code and types it into
+// the other, which sends its identity to the first. Both sides prove they
+// know the code with an HMAC over everything they send, so a relay in the
+// middle can neither swap the keys nor learn the code. The code works once.
+
+// Invite is what the inviting device shows the user.
+type Invite struct {
+	Code        string    `json:"code"`
+	Expires     time.Time `json:"expires"`
+	DeviceID    string    `json:"deviceId"`
+	URL         string    `json:"url"`
+	Fingerprint string    `json:"fingerprint"`
+}
+
+// hello is one side's half of the handshake.
+type hello struct {
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	URL       string `json:"url"`
+	PublicKey []byte `json:"publicKey"`
+	Folder    string `json:"folder"` // granted to the receiver
+	Nonce     []byte `json:"nonce"`
+	MAC       []byte `json:"mac"`
+}
+
+func (h *hello) sum(code, label string, bound []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(code))
+	for _, part := range [][]byte{[]byte(label), []byte(h.ID), []byte(h.Name), []byte(h.URL), h.PublicKey, []byte(h.Folder), h.Nonce, bound} {
+		var n [4]byte
+		binary.BigEndian.PutUint32(n[:], uint32(len(part)))
+		mac.Write(n[:])
+		mac.Write(part)
+	}
+	return mac.Sum(nil)
+}
+
+// normalizeCode accepts codes typed with any case, spaces or dashes.
+func normalizeCode(code string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' {
+			return -1
+		}
+		return r
+	}, strings.ToUpper(strings.TrimSpace(code)))
+}
+
+// newInvite makes a one-time 128-bit code.
+func (m *Manager) newInvite(now time.Time) Invite {
+	b := make([]byte, 16)
+	rand.Read(b)
+	raw := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b)
+	var groups []string
+	for i := 0; i < len(raw); i += 5 {
+		groups = append(groups, raw[i:min(i+5, len(raw))])
+	}
+
+	m.mu.Lock()
+	for c, exp := range m.invites {
+		if now.After(exp) {
+			delete(m.invites, c)
+		}
+	}
+	for len(m.invites) >= maxInvites {
+		// Drop the oldest
+		var oldest string
+		for c, exp := range m.invites {
+			if oldest == "" || exp.Before(m.invites[oldest]) {
+				oldest = c
+			}
+		}
+		delete(m.invites, oldest)
+	}
+	expires := now.Add(inviteTTL)
+	m.invites[raw] = expires
+	m.mu.Unlock()
+
+	return Invite{
+		Code:        strings.Join(groups, "-"),
+		Expires:     expires.UTC(),
+		DeviceID:    m.Config.DeviceID,
+		URL:         m.Config.URL,
+		Fingerprint: Fingerprint(m.key.PublicKey().Bytes()),
+	}
+}
+
+func (m *Manager) hello(folder string) *hello {
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	return &hello{
+		ID:        m.Config.DeviceID,
+		Name:      m.Config.Name,
+		URL:       m.Config.URL,
+		PublicKey: m.key.PublicKey().Bytes(),
+		Folder:    folder,
+		Nonce:     nonce,
+	}
+}
+
+func (h *hello) validate(self string) error {
+	if h.ID == "" || h.ID == self || strings.ContainsAny(h.ID, "/\\") {
+		return errs.E(OpPeerPair, errs.KindInvalid, "bad device id")
+	}
+	if _, err := ecdh.X25519().NewPublicKey(h.PublicKey); err != nil {
+		return errs.E(OpPeerPair, errs.KindInvalid, "bad public key")
+	}
+	if !strings.HasPrefix(h.URL, "https://") && !strings.HasPrefix(h.URL, "http://") {
+		return errs.E(OpPeerPair, errs.KindInvalid, "bad device url")
+	}
+	if len(h.Nonce) < 16 {
+		return errs.E(OpPeerPair, errs.KindInvalid, "bad nonce")
+	}
+	return nil
+}
+
+// defaultGrant is the folder a new peer gets to sync into.
+func defaultGrant(name, id string) string {
+	return path.Join(replicaRoot, safeName(name, id))
+}
+
+// addPeer records a peer that completed the handshake. Pairing again with
+// a known device updates its key and address and keeps its grants and
+// links. It must be called with mu held.
+func (m *Manager) addPeer(h *hello, grant string, now time.Time) *Peer {
+	p := m.Peers[h.ID]
+	if p == nil {
+		p = &Peer{ID: h.ID, Grants: []Grant{{Folder: grant}}}
+		m.Peers[h.ID] = p
+	}
+	p.Name = safeName(h.Name, h.ID)
+	p.URL = h.URL
+	p.PublicKey = h.PublicKey
+	p.Offered = cleanFolder(h.Folder)
+	p.Paired = now.UTC()
+	seen := now.UTC()
+	p.LastSeen = &seen
+	return p
+}
+
+// grantFor is the folder offered to a peer in the handshake: the one it
+// already has, or a new replica folder. It must be called with mu held.
+func (m *Manager) grantFor(id, name string) string {
+	if p := m.Peers[id]; p != nil && len(p.Grants) > 0 {
+		return p.Grants[0].Folder
+	}
+	return defaultGrant(name, id)
+}
+
+// Join pairs with the device that issued code, reachable at url.
+func (m *Manager) Join(ctx context.Context, url, code string) (*Peer, error) {
+	code = normalizeCode(code)
+	if code == "" {
+		return nil, errs.E(OpPeerPair, errs.KindInvalid, "code is required")
+	}
+	// The other side's name is not known yet; the grant is settled below
+	req := m.hello("")
+	req.MAC = req.sum(code, "strct-pair-request", nil)
+	body, _ := json.Marshal(req)
+
+	hreq, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(url, "/")+handshakePath, bytes.NewReader(body))
+	if err != nil {
+		return nil, errs.E(OpPeerPair, errs.KindInvalid, err, "bad device url")
+	}
+	hreq.Header.Set("Content-Type", "application/json")
+	base := m.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	resp, err := base.RoundTrip(hreq)
+	if err != nil {
+		return nil, errs.E(OpPeerPair, errs.KindNetwork, err, "could not reach the other device")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		if resp.StatusCode == http.StatusForbidden {
+			return nil, errs.E(OpPeerPair, errs.KindForbidden, "the code is wrong or has expired")
+		}
+		return nil, errs.E(OpPeerPair, errs.KindNetwork, fmt.Sprintf("the other device answered %s", resp.Status))
+	}
+	var h hello
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&h); err != nil {
+		return nil, errs.E(OpPeerPair, errs.KindNetwork, err, "bad handshake reply")
+	}
+	if !hmac.Equal(h.MAC, h.sum(code, "strct-pair-response", req.MAC)) {
+		return nil, errs.E(OpPeerPair, errs.KindForbidden, "the other device could not prove it knows the code")
+	}
+	if err := h.validate(m.Config.DeviceID); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	p := m.addPeer(&h, m.grantFor(h.ID, h.Name), time.Now())
+	if err := m.save(); err != nil {
+		return nil, err
+	}
+	log.Printf("[PEER] Paired with %s (%s), key %s", p.Name, p.ID, Fingerprint(p.PublicKey))
+	cp := *p
+	return &cp, nil
+}
+
+// handleHandshake is the inviting side of Join.
+func (m *Manager) handleHandshake(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var h hello
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&h); err != nil {
+		errs.HTTPResponse(w, errs.E(OpPeerPair, errs.KindInvalid, "Invalid JSON"))
+		return
+	}
+	if err := h.validate(m.Config.DeviceID); err != nil {
+		errs.HTTPResponse(w, err)
+		return
+	}
+
+	now := time.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var code string
+	for c, exp := range m.invites {
+		if now.Before(exp) && hmac.Equal(h.MAC, h.sum(c, "strct-pair-request", nil)) {
+			code = c
+			break
+		}
+	}
+	if code == "" {
+		log.Printf("[PEER] Pairing attempt from %q with no matching invite", h.ID)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	delete(m.invites, code)
+
+	grant := m.grantFor(h.ID, h.Name)
+	reply := m.hello(grant)
+	reply.MAC = reply.sum(code, "strct-pair-response", h.MAC)
+	p := m.addPeer(&h, grant, now)
+	if err := m.save(); err != nil {
+		errs.HTTPResponse(w, err)
+		return
+	}
+	log.Printf("[PEER] Paired with %s (%s), key %s", p.Name, p.ID, Fingerprint(p.PublicKey))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(reply)
+}
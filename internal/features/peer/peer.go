@@ -0,0 +1,586 @@
+// Package peer replicates folders between two strct devices. Devices pair
+// once by exchanging keys under a short-lived code; after that each can
+// sync chosen folders with the other over the tunnel, one way or both,
+// within a time window and a bandwidth cap. Traffic is encrypted end to
+// end, and the sync protocol underneath resumes where it stopped, so a
+// peer that is offline for days simply catches up when it is back.
+package peer
+
+import (
+	"context"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/errs"
+	"github.com/strct-org/strct-agent/internal/fsx"
+	"github.com/strct-org/strct-agent/pkg/syncclient"
+)
+
+const (
+	OpPeerRun   errs.Op = "peer.Manager.Run"
+	OpPeerPair  errs.Op = "peer.Manager.pair"
+	OpPeerRPC   errs.Op = "peer.Manager.handleRPC"
+	OpPeerSave  errs.Op = "peer.Manager.save"
+	OpPeerAPI   errs.Op = "peer.handle"
+	OpPeerSetup errs.Op = "peer.NewManager"
+)
+
+const (
+	// replicaRoot is where folders a peer pushes land by default.
+	replicaRoot = "Replicas"
+
+	defaultInterval = 15 * time.Minute
+	minInterval     = time.Minute
+	// A link that cannot reach its peer retries sooner than its interval,
+	// backing off from firstRetry up to the interval.
+	firstRetry = time.Minute
+	// staleAfter is how long a link may go without a successful sync
+	// before its health says so.
+	staleAfter = 24 * time.Hour
+)
+
+// Modes of a link, from this device's point of view.
+const (
+	ModeBoth = "both"
+	ModePush = "push"
+	ModePull = "pull"
+)
+
+// Hooks lets replication keep the cloud's index, usage and thumbnails
+// current for files it writes locally.
+type Hooks interface {
+	NotifyChanged(fullPath string)
+	NotifyRemoved(fullPath string)
+	// Offline reports whether fullPath is on storage that is not mounted.
+	// Its folder is empty then, which must not be sent to the peer as
+	// every file having been deleted.
+	Offline(fullPath string) bool
+}
+
+// Config describes this device to its peers.
+type Config struct {
+	DeviceID string
+	Name     string // shown to peers; defaults to DeviceID
+	URL      string // where peers reach this device's API
+	DataDir  string
+	StateDir string // keeps the identity key, peers, links and sync state
+}
+
+// Grant is a folder of this device's DataDir that a peer may sync with.
+type Grant struct {
+	Folder   string `json:"folder"`
+	ReadOnly bool   `json:"readOnly,omitempty"`
+}
+
+// Peer is a paired device.
+type Peer struct {
+	ID        string  `json:"id"`
+	Name      string  `json:"name"`
+	URL       string  `json:"url"`
+	PublicKey []byte  `json:"publicKey"`
+	Grants    []Grant `json:"grants"`
+	// Offered is the folder the peer granted this device when pairing, the
+	// default remote end of new links.
+	Offered  string     `json:"offered,omitempty"`
+	Paired   time.Time  `json:"paired"`
+	LastSeen *time.Time `json:"lastSeen,omitempty"`
+}
+
+// Window limits a link to part of the day, local time. End before Start
+// wraps past midnight, e.g. 22:00-06:00.
+type Window struct {
+	Start string `json:"start"`
+	End   string `json:"end"`
+}
+
+// Link keeps Folder here and RemoteFolder on the peer in step.
+type Link struct {
+	ID           string    `json:"id"`
+	Peer         string    `json:"peer"`
+	Folder       string    `json:"folder"`
+	RemoteFolder string    `json:"remoteFolder"`
+	Mode         string    `json:"mode"`
+	Every        string    `json:"every,omitempty"` // Go duration, default 15m
+	Window       *Window   `json:"window,omitempty"`
+	LimitKBps    int       `json:"limitKBps,omitempty"`
+	Paused       bool      `json:"paused,omitempty"`
+	Created      time.Time `json:"created"`
+}
+
+// Summary counts what one sync round did.
+type Summary struct {
+	Uploaded   int   `json:"uploaded"`
+	Downloaded int   `json:"downloaded"`
+	Deleted    int   `json:"deleted"`
+	Conflicts  int   `json:"conflicts"`
+	Sent       int64 `json:"sent"`
+	Received   int64 `json:"received"`
+}
+
+// Status is the health of a link.
+type Status struct {
+	Running     bool       `json:"running"`
+	LastRun     *time.Time `json:"lastRun,omitempty"`
+	LastSuccess *time.Time `json:"lastSuccess,omitempty"`
+	LastError   string     `json:"lastError,omitempty"`
+	Offline     bool       `json:"offline,omitempty"` // the last error was not reaching the peer
+	Failures    int        `json:"failures,omitempty"`
+	LastRound   *Summary   `json:"lastRound,omitempty"`
+	Sent        int64      `json:"sent"`
+	Received    int64      `json:"received"`
+	NextRun     *time.Time `json:"nextRun,omitempty"`
+	// State sums the above up: syncing, ok, stale, offline, error, paused
+	// or pending (never synced yet).
+	State string `json:"state"`
+}
+
+// Manager pairs with peers, serves their requests and runs this device's
+// links to them.
+type Manager struct {
+	Config Config                      `json:"-"`
+	Sync   map[string]http.HandlerFunc `json:"-"` // the cloud's /api/sync/* handlers
+	Hooks  Hooks                       `json:"-"`
+	Tick   time.Duration               `json:"-"`
+	// Transport carries requests to peers; nil means http.DefaultTransport.
+	Transport http.RoundTripper `json:"-"`
+
+	key *ecdh.PrivateKey
+
+	mu      sync.Mutex
+	Peers   map[string]*Peer   `json:"peers"`
+	Links   map[string]*Link   `json:"links"`
+	Status  map[string]*Status `json:"status"`
+	invites map[string]time.Time
+	cancels map[string]context.CancelFunc
+	wg      sync.WaitGroup
+
+	replayMu sync.Mutex
+	replay   map[string]time.Time
+}
+
+// NewManager loads or creates this device's identity and the saved peers
+// and links. routes are the cloud's; only /api/sync/* are used.
+func NewManager(cfg Config, routes map[string]http.HandlerFunc, hooks Hooks) (*Manager, error) {
+	if cfg.Name == "" {
+		cfg.Name = cfg.DeviceID
+	}
+	m := &Manager{
+		Config:  cfg,
+		Sync:    make(map[string]http.HandlerFunc),
+		Hooks:   hooks,
+		Tick:    30 * time.Second,
+		Peers:   make(map[string]*Peer),
+		Links:   make(map[string]*Link),
+		Status:  make(map[string]*Status),
+		invites: make(map[string]time.Time),
+		cancels: make(map[string]context.CancelFunc),
+		replay:  make(map[string]time.Time),
+	}
+	for p, h := range routes {
+		if strings.HasPrefix(p, "/api/sync/") {
+			m.Sync[p] = h
+		}
+	}
+	if err := os.MkdirAll(m.dir(), 0700); err != nil {
+		return nil, errs.E(OpPeerSetup, errs.KindIO, err)
+	}
+	key, err := loadKey(filepath.Join(m.dir(), "identity.key"))
+	if err != nil {
+		return nil, errs.E(OpPeerSetup, errs.KindIO, err, "could not load the peer identity")
+	}
+	m.key = key
+
+	data, err := os.ReadFile(m.statePath())
+	if err != nil && !os.IsNotExist(err) {
+		return nil, errs.E(OpPeerSetup, errs.KindIO, err)
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, m); err != nil {
+			return nil, errs.E(OpPeerSetup, errs.KindIO, fmt.Errorf("parse %s: %w", m.statePath(), err))
+		}
+	}
+	for id, st := range m.Status {
+		st.Running = false
+		if m.Links[id] == nil {
+			delete(m.Status, id)
+		}
+	}
+	for id := range m.Links {
+		if m.Status[id] == nil {
+			m.Status[id] = &Status{}
+		}
+	}
+	return m, nil
+}
+
+// loadKey reads the X25519 identity key, making one on first start.
+func loadKey(p string) (*ecdh.PrivateKey, error) {
+	raw, err := os.ReadFile(p)
+	if err == nil {
+		return ecdh.X25519().NewPrivateKey(raw)
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return key, fsx.WriteFile(p, key.Bytes(), 0600)
+}
+
+func (m *Manager) dir() string       { return filepath.Join(m.Config.StateDir, "peer") }
+func (m *Manager) statePath() string { return filepath.Join(m.dir(), "peers.json") }
+func (m *Manager) linkState(id string) string {
+	return filepath.Join(m.dir(), "links", id+".json")
+}
+
+// Fingerprint is a short digest of a public key for comparing by eye.
+func Fingerprint(pub []byte) string {
+	sum := sha256.Sum256(pub)
+	h := hex.EncodeToString(sum[:10])
+	var groups []string
+	for i := 0; i < len(h); i += 4 {
+		groups = append(groups, h[i:i+4])
+	}
+	return strings.Join(groups, " ")
+}
+
+// Start runs due links every Tick.
+func (m *Manager) Start() error {
+	go func() {
+		t := time.NewTicker(m.Tick)
+		defer t.Stop()
+		for {
+			m.runDue(time.Now())
+			<-t.C
+		}
+	}()
+	return nil
+}
+
+func (m *Manager) runDue(now time.Time) {
+	m.mu.Lock()
+	var due []string
+	for id, link := range m.Links {
+		if link.Paused || m.cancels[id] != nil || !link.Window.contains(now) || m.offline(link.Folder) {
+			continue
+		}
+		if !m.nextRun(link, m.Status[id]).After(now) {
+			due = append(due, id)
+		}
+	}
+	m.mu.Unlock()
+
+	for _, id := range due {
+		m.runAsync(id, true)
+	}
+}
+
+// nextRun is when the link is due: right away when new, an interval after
+// the last round, or sooner after a failure with a backoff that doubles up
+// to the interval. Windows are applied by the caller.
+func (m *Manager) nextRun(link *Link, st *Status) time.Time {
+	if st.LastRun == nil {
+		return link.Created
+	}
+	every := link.interval()
+	if st.LastError != "" {
+		retry := firstRetry << min(st.Failures-1, 16)
+		if retry > 0 && retry < every {
+			return st.LastRun.Add(retry)
+		}
+	}
+	return st.LastRun.Add(every)
+}
+
+func (l *Link) interval() time.Duration {
+	d, err := time.ParseDuration(l.Every)
+	if err != nil || d <= 0 {
+		return defaultInterval
+	}
+	return d
+}
+
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, err
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// contains reports whether t falls inside the window. No window is always
+// open.
+func (w *Window) contains(t time.Time) bool {
+	if w == nil {
+		return true
+	}
+	start, err1 := parseClock(w.Start)
+	end, err2 := parseClock(w.End)
+	if err1 != nil || err2 != nil || start == end {
+		return true
+	}
+	l := t.Local()
+	now := l.Hour()*60 + l.Minute()
+	if start < end {
+		return now >= start && now < end
+	}
+	return now >= start || now < end
+}
+
+// closes is when the window open at t closes, or zero for no window.
+func (w *Window) closes(t time.Time) time.Time {
+	if w == nil || !w.contains(t) {
+		return time.Time{}
+	}
+	end, err := parseClock(w.End)
+	if err != nil {
+		return time.Time{}
+	}
+	l := t.Local()
+	c := time.Date(l.Year(), l.Month(), l.Day(), end/60, end%60, 0, 0, time.Local)
+	if !c.After(t) {
+		c = c.AddDate(0, 0, 1)
+	}
+	return c
+}
+
+func (m *Manager) runAsync(id string, scheduled bool) {
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		if _, err := m.run(context.Background(), id, scheduled); err != nil {
+			log.Printf("[PEER] %v", err)
+		}
+	}()
+}
+
+// Run syncs a link now, whatever its schedule says.
+func (m *Manager) Run(ctx context.Context, id string) (*Summary, error) {
+	return m.run(ctx, id, false)
+}
+
+// run does one round. A scheduled round stops when its window closes; the
+// next one resumes from there.
+func (m *Manager) run(ctx context.Context, id string, scheduled bool) (*Summary, error) {
+	m.mu.Lock()
+	link, ok := m.Links[id]
+	if !ok {
+		m.mu.Unlock()
+		return nil, errs.E(OpPeerRun, errs.KindNotFound, "unknown link")
+	}
+	p := m.Peers[link.Peer]
+	if p == nil {
+		m.mu.Unlock()
+		return nil, errs.E(OpPeerRun, errs.KindNotFound, "the link's peer is no longer paired")
+	}
+	if m.cancels[id] != nil {
+		m.mu.Unlock()
+		return nil, errs.E(OpPeerRun, errs.KindInvalid, "this link is already syncing")
+	}
+	if m.offline(link.Folder) {
+		m.mu.Unlock()
+		return nil, errs.E(OpPeerRun, errs.KindNotFound, "the folder's storage is offline")
+	}
+	l, peer := *link, *p
+	if closes := l.Window.closes(time.Now()); scheduled && !closes.IsZero() {
+		var stop context.CancelFunc
+		ctx, stop = context.WithDeadline(ctx, closes)
+		defer stop()
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	m.cancels[id] = cancel
+	m.Status[id].Running = true
+	m.mu.Unlock()
+
+	started := time.Now().UTC()
+	sum, err := m.sync(ctx, &l, &peer)
+	cancel()
+
+	m.mu.Lock()
+	delete(m.cancels, id)
+	if st := m.Status[id]; st != nil {
+		st.Running = false
+		st.LastRun = &started
+		if sum != nil {
+			st.LastRound = sum
+			st.Sent += sum.Sent
+			st.Received += sum.Received
+		}
+		var offline *offlineError
+		st.Offline = errors.As(err, &offline)
+		if err != nil {
+			st.LastError = err.Error()
+			st.Failures++
+		} else {
+			done := time.Now().UTC()
+			st.LastSuccess = &done
+			st.LastError = ""
+			st.Failures = 0
+		}
+	}
+	if serr := m.save(); serr != nil {
+		log.Printf("[PEER] %v", serr)
+	}
+	m.mu.Unlock()
+
+	if err != nil {
+		return sum, errs.E(OpPeerRun, errs.KindNetwork, fmt.Errorf("%s with %s: %w", l.Folder, peer.Name, err))
+	}
+	if sum.Uploaded+sum.Downloaded+sum.Deleted+sum.Conflicts > 0 {
+		log.Printf("[PEER] %s with %s: %d up, %d down, %d deleted, %d conflicts", l.Folder, peer.Name, sum.Uploaded, sum.Downloaded, sum.Deleted, sum.Conflicts)
+	}
+	return sum, nil
+}
+
+func (m *Manager) offline(folder string) bool {
+	return m.Hooks != nil && m.Hooks.Offline(filepath.Join(m.Config.DataDir, filepath.FromSlash(folder)))
+}
+
+func (m *Manager) sync(ctx context.Context, l *Link, p *Peer) (*Summary, error) {
+	dir := filepath.Join(m.Config.DataDir, filepath.FromSlash(l.Folder))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(m.linkState(l.ID)), 0700); err != nil {
+		return nil, err
+	}
+	s := &syncclient.Syncer{
+		Client: &syncclient.Client{
+			BaseURL: p.URL,
+			HTTP:    &http.Client{Transport: m.transport(p, newLimiter(l.LimitKBps))},
+			Device:  m.Config.Name,
+			Root:    l.RemoteFolder,
+		},
+		Dir:       dir,
+		StatePath: m.linkState(l.ID),
+	}
+	switch l.Mode {
+	case ModePush:
+		s.Direction = syncclient.Push
+	case ModePull:
+		s.Direction = syncclient.Pull
+	}
+
+	rep, err := s.Sync(ctx)
+	if rep == nil {
+		return nil, err
+	}
+	if m.Hooks != nil {
+		for _, rel := range append(append([]string{}, rep.Downloaded...), rep.Conflicts...) {
+			m.Hooks.NotifyChanged(filepath.Join(dir, filepath.FromSlash(rel)))
+		}
+		for _, rel := range rep.DeletedLocal {
+			m.Hooks.NotifyRemoved(filepath.Join(dir, filepath.FromSlash(rel)))
+		}
+	}
+	return &Summary{
+		Uploaded:   len(rep.Uploaded),
+		Downloaded: len(rep.Downloaded),
+		Deleted:    len(rep.DeletedLocal) + len(rep.DeletedRemote),
+		Conflicts:  len(rep.Conflicts),
+		Sent:       rep.Sent,
+		Received:   rep.Received,
+	}, err
+}
+
+func (m *Manager) transport(p *Peer, limit *limiter) *transport {
+	base := m.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &transport{self: m.Config.DeviceID, key: m.key, peer: *p, base: base, limit: limit, seen: m.seen}
+}
+
+// seen notes that a peer was heard from.
+func (m *Manager) seen(id string, at time.Time) {
+	m.mu.Lock()
+	if p := m.Peers[id]; p != nil {
+		at = at.UTC()
+		p.LastSeen = &at
+	}
+	m.mu.Unlock()
+}
+
+// health fills in the summary fields of a link's status. It must be
+// called with mu held.
+func (m *Manager) health(link *Link, st *Status, now time.Time) Status {
+	out := *st
+	if !link.Paused {
+		next := m.nextRun(link, st)
+		if next.Before(now) {
+			next = now
+		}
+		out.NextRun = &next
+	}
+	switch {
+	case st.Running:
+		out.State = "syncing"
+	case link.Paused:
+		out.State = "paused"
+	case st.Offline:
+		out.State = "offline"
+	case st.LastError != "":
+		out.State = "error"
+	case st.LastSuccess == nil:
+		out.State = "pending"
+	case now.Sub(*st.LastSuccess) > max(staleAfter, 2*link.interval()):
+		out.State = "stale"
+	default:
+		out.State = "ok"
+	}
+	return out
+}
+
+// safeName turns a device name into a single folder name.
+func safeName(name, fallback string) string {
+	name = strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r < ' ' {
+			return '-'
+		}
+		return r
+	}, strings.TrimSpace(name))
+	name = strings.TrimLeft(name, ".")
+	if name == "" {
+		return fallback
+	}
+	return name
+}
+
+// cleanFolder normalises a folder relative to DataDir; "" means none.
+func cleanFolder(f string) string {
+	return strings.Trim(path.Clean("/"+f), "/")
+}
+
+// save must be called with mu held. The file names the devices this one
+// trusts, so it is private to the agent.
+func (m *Manager) save() error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return errs.E(OpPeerSave, errs.KindIO, err)
+	}
+	if err := fsx.WriteFile(m.statePath(), data, 0600); err != nil {
+		return errs.E(OpPeerSave, errs.KindIO, err)
+	}
+	return nil
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
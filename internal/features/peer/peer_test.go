@@ -0,0 +1,234 @@
+package peer
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func doJSON(t *testing.T, m *Manager, method, target, body string, out any) int {
+	t.Helper()
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	w := httptest.NewRecorder()
+	path := target
+	if i := strings.IndexByte(path, '?'); i >= 0 {
+		path = path[:i]
+	}
+	m.GetRoutes()[path](w, req)
+	if out != nil && w.Code < 300 {
+		if err := json.Unmarshal(w.Body.Bytes(), out); err != nil {
+			t.Fatalf("%s %s: %v: %s", method, target, err, w.Body)
+		}
+	}
+	return w.Code
+}
+
+func TestPairing(t *testing.T) {
+	a := newTestManager(t, "device-a", "Living room", nil)
+	b := newTestManager(t, "device-b", "Office/Desk", nil)
+	srvA := httptest.NewServer(routesMux(a.GetRoutes()))
+	defer srvA.Close()
+	a.Config.URL = srvA.URL
+
+	var inv Invite
+	if code := doJSON(t, a, "POST", "/api/peer/invite", "", &inv); code != http.StatusCreated {
+		t.Fatalf("invite: %d", code)
+	}
+	if len(normalizeCode(inv.Code)) != 26 || inv.Fingerprint != Fingerprint(a.key.PublicKey().Bytes()) {
+		t.Fatalf("invite = %+v", inv)
+	}
+
+	join := func(code string) (int, PeerResponse) {
+		var p PeerResponse
+		body, _ := json.Marshal(map[string]string{"url": srvA.URL, "code": code})
+		return doJSON(t, b, "POST", "/api/peer/join", string(body), &p), p
+	}
+	if code, _ := join("AAAAA-BBBBB-CCCCC-DDDDD-EEEEE-F"); code != http.StatusForbidden {
+		t.Errorf("wrong code: %d", code)
+	}
+	// Codes are forgiving about how they are typed
+	code, p := join(strings.ToLower(strings.ReplaceAll(inv.Code, "-", " ")))
+	if code != http.StatusCreated {
+		t.Fatalf("join: %d", code)
+	}
+	if p.ID != "device-a" || p.Name != "Living room" || p.Fingerprint != inv.Fingerprint || p.Offered != "Replicas/Office-Desk" {
+		t.Errorf("b sees a as %+v", p)
+	}
+	if got := b.Peers["device-a"].Grants; len(got) != 1 || got[0].Folder != "Replicas/Living room" {
+		t.Errorf("b grants a %v", got)
+	}
+	pa := a.Peers["device-b"]
+	if pa == nil || pa.URL != b.Config.URL || string(pa.PublicKey) != string(b.key.PublicKey().Bytes()) {
+		t.Fatalf("a sees b as %+v", pa)
+	}
+	if len(pa.Grants) != 1 || pa.Grants[0].Folder != "Replicas/Office-Desk" {
+		t.Errorf("a grants b %v", pa.Grants)
+	}
+
+	if code, _ := join(inv.Code); code != http.StatusForbidden {
+		t.Errorf("code worked twice: %d", code)
+	}
+	t.Run("expired code", func(t *testing.T) {
+		inv := a.newInvite(time.Now().Add(-inviteTTL - time.Second))
+		if code, _ := join(inv.Code); code != http.StatusForbidden {
+			t.Errorf("status %d", code)
+		}
+	})
+	t.Run("pairing again keeps grants", func(t *testing.T) {
+		pa.Grants = []Grant{{Folder: "Shared"}}
+		inv := a.newInvite(time.Now())
+		if code, p := join(inv.Code); code != http.StatusCreated || p.Offered != "Shared" {
+			t.Errorf("re-pair: %d %+v", code, p)
+		}
+	})
+
+	// Both sides survive a restart, and the files stay private
+	for _, m := range []*Manager{a, b} {
+		fi, err := os.Stat(m.statePath())
+		if err != nil || fi.Mode().Perm() != 0600 {
+			t.Fatalf("state file: %v %v", fi, err)
+		}
+		again, err := NewManager(m.Config, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(again.Peers) != 1 || string(again.key.Bytes()) != string(m.key.Bytes()) {
+			t.Errorf("%s lost its peers or identity on restart", m.Config.DeviceID)
+		}
+	}
+}
+
+func TestLinkAPI(t *testing.T) {
+	m := newTestManager(t, "device-a", "Living room", nil)
+	m.Peers["device-b"] = &Peer{ID: "device-b", Name: "Office", URL: "http://b", Offered: "Replicas/Living room"}
+
+	invalid := []struct {
+		name string
+		body string
+		want int
+	}{
+		{"bad json", `{`, http.StatusBadRequest},
+		{"unknown peer", `{"peer":"nope","folder":"Photos"}`, http.StatusNotFound},
+		{"whole drive", `{"peer":"device-b","folder":"/"}`, http.StatusBadRequest},
+		{"bad mode", `{"peer":"device-b","folder":"Photos","mode":"sideways"}`, http.StatusBadRequest},
+		{"too frequent", `{"peer":"device-b","folder":"Photos","every":"1s"}`, http.StatusBadRequest},
+		{"bad window", `{"peer":"device-b","folder":"Photos","window":{"start":"22:00","end":"22:00"}}`, http.StatusBadRequest},
+		{"negative cap", `{"peer":"device-b","folder":"Photos","limitKBps":-1}`, http.StatusBadRequest},
+	}
+	for _, tt := range invalid {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := doJSON(t, m, "POST", "/api/peer/links", tt.body, nil); got != tt.want {
+				t.Errorf("status %d, want %d", got, tt.want)
+			}
+		})
+	}
+
+	var l LinkResponse
+	if code := doJSON(t, m, "POST", "/api/peer/links", `{"peer":"device-b","folder":"/Photos/","mode":"push","window":{"start":"22:00","end":"06:00"},"limitKBps":512}`, &l); code != http.StatusCreated {
+		t.Fatalf("create: %d", code)
+	}
+	if l.Folder != "Photos" || l.RemoteFolder != "Replicas/Living room" || l.Status.State != "pending" {
+		t.Errorf("created %+v", l)
+	}
+	if code := doJSON(t, m, "POST", "/api/peer/links", `{"peer":"device-b","folder":"Photos/2024"}`, nil); code != http.StatusBadRequest {
+		t.Errorf("overlapping link: %d", code)
+	}
+	if code := doJSON(t, m, "POST", "/api/peer/links", `{"id":"`+l.ID+`","peer":"device-b","folder":"Photos","remoteFolder":"Elsewhere"}`, nil); code != http.StatusBadRequest {
+		t.Errorf("moving a link: %d", code)
+	}
+	if code := doJSON(t, m, "POST", "/api/peer/links", `{"id":"`+l.ID+`","peer":"device-b","folder":"Photos","mode":"both","paused":true}`, &l); code != http.StatusOK || !l.Paused || l.Status.State != "paused" {
+		t.Errorf("update: %d %+v", code, l)
+	}
+
+	var peers struct{ Peers []PeerResponse }
+	doJSON(t, m, "GET", "/api/peer/peers", "", &peers)
+	if len(peers.Peers) != 1 || len(peers.Peers[0].Links) != 1 {
+		t.Fatalf("peers = %+v", peers)
+	}
+	if code := doJSON(t, m, "POST", "/api/peer/peers", `{"id":"device-b","grants":[{"folder":"/"}]}`, nil); code != http.StatusBadRequest {
+		t.Errorf("granting the whole drive: %d", code)
+	}
+	if code := doJSON(t, m, "POST", "/api/peer/peers", `{"id":"device-b","grants":[{"folder":"Music/","readOnly":true}]}`, nil); code != http.StatusOK || m.Peers["device-b"].Grants[0].Folder != "Music" {
+		t.Errorf("grants: %d %+v", code, m.Peers["device-b"].Grants)
+	}
+
+	if code := doJSON(t, m, "DELETE", "/api/peer/peers?id=device-b", "", nil); code != http.StatusNoContent {
+		t.Errorf("unpair: %d", code)
+	}
+	if len(m.Links) != 0 {
+		t.Error("unpairing kept the peer's links")
+	}
+}
+
+func TestSchedule(t *testing.T) {
+	at := func(h, min int) time.Time { return time.Date(2026, 5, 1, h, min, 0, 0, time.Local) }
+	night := &Window{Start: "22:00", End: "06:00"}
+	day := &Window{Start: "09:00", End: "17:30"}
+
+	windows := []struct {
+		w      *Window
+		t      time.Time
+		open   bool
+		closes time.Time
+	}{
+		{nil, at(12, 0), true, time.Time{}},
+		{night, at(23, 0), true, at(6, 0).AddDate(0, 0, 1)},
+		{night, at(2, 0), true, at(6, 0)},
+		{night, at(6, 0), false, time.Time{}},
+		{night, at(12, 0), false, time.Time{}},
+		{day, at(9, 0), true, at(17, 30)},
+		{day, at(17, 30), false, time.Time{}},
+	}
+	for _, tt := range windows {
+		if got := tt.w.contains(tt.t); got != tt.open {
+			t.Errorf("%v contains %v = %v", tt.w, tt.t.Format("15:04"), got)
+		}
+		if got := tt.w.closes(tt.t); !got.Equal(tt.closes) {
+			t.Errorf("%v open at %v closes %v, want %v", tt.w, tt.t.Format("15:04"), got, tt.closes)
+		}
+	}
+
+	m := newTestManager(t, "device-a", "a", nil)
+	link := &Link{Created: at(8, 0), Every: "1h"}
+	last := at(10, 0)
+	long := at(10, 0).Add(-3 * 24 * time.Hour)
+	tests := []struct {
+		name      string
+		st        Status
+		paused    bool
+		wantNext  time.Time
+		wantState string
+	}{
+		{"never ran", Status{}, false, at(8, 0), "pending"},
+		{"ok", Status{LastRun: &last, LastSuccess: &last}, false, at(11, 0), "ok"},
+		{"first failure retries soon", Status{LastRun: &last, LastError: "x", Offline: true, Failures: 1}, false, at(10, 1), "offline"},
+		{"backoff doubles", Status{LastRun: &last, LastError: "x", Failures: 4}, false, at(10, 8), "error"},
+		{"backoff stops at the interval", Status{LastRun: &last, LastError: "x", Failures: 40}, false, at(11, 0), "error"},
+		{"stale", Status{LastRun: &last, LastSuccess: &long}, false, at(11, 0), "stale"},
+		{"paused", Status{LastRun: &last, LastSuccess: &last}, true, time.Time{}, "paused"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := *link
+			l.Paused = tt.paused
+			st := tt.st
+			h := m.health(&l, &st, at(10, 0))
+			if h.State != tt.wantState {
+				t.Errorf("state = %s, want %s", h.State, tt.wantState)
+			}
+			if tt.paused {
+				if h.NextRun != nil {
+					t.Errorf("paused link has next run %v", h.NextRun)
+				}
+				return
+			}
+			if next := m.nextRun(&l, &st); !next.Equal(tt.wantNext) {
+				t.Errorf("next = %v, want %v", next.Format("15:04"), tt.wantNext.Format("15:04"))
+			}
+		})
+	}
+}
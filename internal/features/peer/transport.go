@@ -0,0 +1,636 @@
+package peer
+
+import (
+	"bufio"
+	"context"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+
+	"github.com/strct-org/strct-agent/internal/errs"
+)
+
+// The tunnel ends TLS on the relay, so everything peers send each other is
+// sealed end to end on top of it. A request body is
+//
+//	magic | ephemeral X25519 key | frame...
+//
+// and each frame is a 4-byte length and a ChaCha20-Poly1305 box with a
+// counter nonce; the last frame says so in its associated data, which
+// makes a cut-off stream an error rather than a shorter one. The first
+// frame carries the inner request line and headers, the rest its body.
+// The response comes back the same way under a second key.
+//
+// Keys come from two Diffie-Hellmans: the sender's ephemeral key with the
+// receiver's static key, and the two static keys. Only the paired peer can
+// produce a request the receiver can open, and only the receiver can
+// answer it.
+const (
+	rpcPath      = "/api/peer/rpc"
+	peerHeader   = "X-Strct-Peer"
+	rpcMagic     = "STRCTP1\n"
+	maxFrame     = 64 << 10
+	maxClockSkew = 10 * time.Minute
+)
+
+var (
+	errTruncated = errors.New("peer: stream ended early")
+	errFrame     = errors.New("peer: bad frame")
+)
+
+// rpcHeader is the first frame of a request or response.
+type rpcHeader struct {
+	Method string      `json:"method,omitempty"`
+	Target string      `json:"target,omitempty"`
+	Time   int64       `json:"time,omitempty"`
+	Status int         `json:"status,omitempty"`
+	Header http.Header `json:"header,omitempty"`
+}
+
+// sessionKeys derives the request and response ciphers of one exchange.
+func sessionKeys(ephPub []byte, dhEph, dhStatic []byte, clientPub, serverPub []byte) (cipher.AEAD, cipher.AEAD, error) {
+	salt := append(append(append([]byte{}, ephPub...), clientPub...), serverPub...)
+	kdf := hkdf.New(sha256.New, append(append([]byte{}, dhEph...), dhStatic...), salt, []byte("strct-peer-v1"))
+	var keys [2 * chacha20poly1305.KeySize]byte
+	if _, err := io.ReadFull(kdf, keys[:]); err != nil {
+		return nil, nil, err
+	}
+	req, err := chacha20poly1305.New(keys[:chacha20poly1305.KeySize])
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, err := chacha20poly1305.New(keys[chacha20poly1305.KeySize:])
+	if err != nil {
+		return nil, nil, err
+	}
+	return req, resp, nil
+}
+
+func frameNonce(seq uint64) []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	binary.BigEndian.PutUint64(nonce[4:], seq)
+	return nonce
+}
+
+func frameAD(final bool) []byte {
+	if final {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+// sealWriter cuts what is written to it into sealed frames. Close sends
+// the final frame; without it the reader sees a truncated stream.
+type sealWriter struct {
+	w    io.Writer
+	aead cipher.AEAD
+	seq  uint64
+	buf  []byte
+}
+
+func newSealWriter(w io.Writer, aead cipher.AEAD) *sealWriter {
+	return &sealWriter{w: w, aead: aead, buf: make([]byte, 0, maxFrame)}
+}
+
+func (s *sealWriter) frame(p []byte, final bool) error {
+	out := make([]byte, 4, 4+len(p)+s.aead.Overhead())
+	out = s.aead.Seal(out, frameNonce(s.seq), p, frameAD(final))
+	binary.BigEndian.PutUint32(out, uint32(len(out)-4))
+	s.seq++
+	_, err := s.w.Write(out)
+	return err
+}
+
+func (s *sealWriter) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		k := min(len(p), maxFrame-len(s.buf))
+		s.buf = append(s.buf, p[:k]...)
+		p, n = p[k:], n+k
+		if len(s.buf) == maxFrame {
+			if err := s.Flush(); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// Flush sends what is buffered as a frame of its own.
+func (s *sealWriter) Flush() error {
+	if len(s.buf) == 0 {
+		return nil
+	}
+	err := s.frame(s.buf, false)
+	s.buf = s.buf[:0]
+	return err
+}
+
+func (s *sealWriter) Close() error {
+	err := s.frame(s.buf, true)
+	s.buf = s.buf[:0]
+	return err
+}
+
+// openReader is the other end of a sealWriter.
+type openReader struct {
+	r    *bufio.Reader
+	aead cipher.AEAD
+	seq  uint64
+	buf  []byte
+	done bool
+}
+
+func newOpenReader(r io.Reader, aead cipher.AEAD) *openReader {
+	return &openReader{r: bufio.NewReader(r), aead: aead}
+}
+
+func (o *openReader) frame() ([]byte, bool, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(o.r, size[:]); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, false, errTruncated
+		}
+		return nil, false, err
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n < uint32(o.aead.Overhead()) || n > uint32(maxFrame+o.aead.Overhead()) {
+		return nil, false, errFrame
+	}
+	box := make([]byte, n)
+	if _, err := io.ReadFull(o.r, box); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, false, errTruncated
+		}
+		return nil, false, err
+	}
+	for _, final := range []bool{false, true} {
+		if p, err := o.aead.Open(box[:0:0], frameNonce(o.seq), box, frameAD(final)); err == nil {
+			o.seq++
+			return p, final, nil
+		}
+	}
+	return nil, false, errFrame
+}
+
+func (o *openReader) Read(p []byte) (int, error) {
+	for len(o.buf) == 0 {
+		if o.done {
+			return 0, io.EOF
+		}
+		var err error
+		if o.buf, o.done, err = o.frame(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, o.buf)
+	o.buf = o.buf[n:]
+	return n, nil
+}
+
+// readHeader reads the first frame, which must hold an rpcHeader.
+func (o *openReader) readHeader() (*rpcHeader, error) {
+	p, final, err := o.frame()
+	if err != nil {
+		return nil, err
+	}
+	var h rpcHeader
+	if err := json.Unmarshal(p, &h); err != nil {
+		return nil, errFrame
+	}
+	o.done = final
+	return &h, nil
+}
+
+func writeHeader(s *sealWriter, h *rpcHeader) error {
+	data, err := json.Marshal(h)
+	if err != nil {
+		return err
+	}
+	return s.frame(data, false)
+}
+
+// handleRPC opens a request from a paired peer and runs it against the
+// cloud's sync endpoints, scoped to the folders the peer was granted.
+// Anything that fails before the request is opened gets a bare 403, so
+// strangers learn nothing.
+func (m *Manager) handleRPC(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	deny := func(reason string, args ...any) {
+		log.Printf("[PEER] Refused request from %q: "+reason, append([]any{r.Header.Get(peerHeader)}, args...)...)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+	}
+
+	m.mu.Lock()
+	p := m.Peers[r.Header.Get(peerHeader)]
+	var pub []byte
+	if p != nil {
+		pub = p.PublicKey
+	}
+	m.mu.Unlock()
+	if p == nil {
+		deny("not paired")
+		return
+	}
+	peerKey, err := ecdh.X25519().NewPublicKey(pub)
+	if err != nil {
+		deny("bad stored key")
+		return
+	}
+
+	body := bufio.NewReader(r.Body)
+	prefix := make([]byte, len(rpcMagic)+32)
+	if _, err := io.ReadFull(body, prefix); err != nil || string(prefix[:len(rpcMagic)]) != rpcMagic {
+		deny("bad preamble")
+		return
+	}
+	ephPub := prefix[len(rpcMagic):]
+	eph, err := ecdh.X25519().NewPublicKey(ephPub)
+	if err != nil {
+		deny("bad ephemeral key")
+		return
+	}
+	dhEph, err1 := m.key.ECDH(eph)
+	dhStatic, err2 := m.key.ECDH(peerKey)
+	if err1 != nil || err2 != nil {
+		deny("key agreement failed")
+		return
+	}
+	reqAEAD, respAEAD, err := sessionKeys(ephPub, dhEph, dhStatic, pub, m.key.PublicKey().Bytes())
+	if err != nil {
+		deny("%v", err)
+		return
+	}
+	in := newOpenReader(body, reqAEAD)
+	hdr, err := in.readHeader()
+	if err != nil {
+		deny("%v", err)
+		return
+	}
+	now := time.Now()
+	if d := now.Sub(time.Unix(hdr.Time, 0)); d > maxClockSkew || d < -maxClockSkew {
+		deny("clock off by %s", d.Round(time.Second))
+		return
+	}
+	if !m.fresh(string(ephPub), now) {
+		deny("replayed")
+		return
+	}
+	m.seen(p.ID, now)
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	out := &sealedResponse{s: newSealWriter(w, respAEAD), header: http.Header{}}
+	defer out.finish()
+
+	h, err := m.authorize(p.ID, hdr)
+	if err != nil {
+		errs.HTTPResponse(out, err)
+		return
+	}
+	inner, err := http.NewRequestWithContext(r.Context(), hdr.Method, hdr.Target, in)
+	if err != nil {
+		errs.HTTPResponse(out, errs.E(OpPeerRPC, errs.KindInvalid, err))
+		return
+	}
+	if ct := hdr.Header.Get("Content-Type"); ct != "" {
+		inner.Header.Set("Content-Type", ct)
+	}
+	inner.RemoteAddr = r.RemoteAddr
+	h(out, inner)
+}
+
+// authorize picks the sync handler for a request and checks that its
+// ?root= lies inside a folder granted to the peer, writable if it writes.
+func (m *Manager) authorize(peerID string, hdr *rpcHeader) (http.HandlerFunc, error) {
+	u, err := url.Parse(hdr.Target)
+	if err != nil {
+		return nil, errs.E(OpPeerRPC, errs.KindInvalid, "bad target")
+	}
+	h := m.Sync[u.Path]
+	if h == nil || !strings.HasPrefix(u.Path, "/api/sync/") {
+		return nil, errs.E(OpPeerRPC, errs.KindForbidden, "peers may only sync")
+	}
+	root := strings.Trim(path.Clean("/"+u.Query().Get("root")), "/")
+	writes := u.Path == "/api/sync/upload" || u.Path == "/api/sync/delete"
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	p := m.Peers[peerID]
+	if p == nil {
+		return nil, errs.E(OpPeerRPC, errs.KindForbidden, "not paired")
+	}
+	for _, g := range p.Grants {
+		if root != "" && (root == g.Folder || strings.HasPrefix(root, g.Folder+"/")) && !(writes && g.ReadOnly) {
+			return h, nil
+		}
+	}
+	return nil, errs.E(OpPeerRPC, errs.KindForbidden, fmt.Sprintf("%q is not shared with this device", root))
+}
+
+// fresh reports whether an ephemeral key is new, remembering it for as
+// long as a request carrying it would pass the clock check.
+func (m *Manager) fresh(eph string, now time.Time) bool {
+	m.replayMu.Lock()
+	defer m.replayMu.Unlock()
+	for k, t := range m.replay {
+		if now.Sub(t) > 2*maxClockSkew {
+			delete(m.replay, k)
+		}
+	}
+	if _, ok := m.replay[eph]; ok {
+		return false
+	}
+	m.replay[eph] = now
+	return true
+}
+
+// sealedResponse is the http.ResponseWriter a sync handler writes to when
+// called over the peer transport.
+type sealedResponse struct {
+	s      *sealWriter
+	header http.Header
+	status int
+	err    error
+}
+
+func (sr *sealedResponse) Header() http.Header { return sr.header }
+
+func (sr *sealedResponse) WriteHeader(code int) {
+	if sr.status != 0 {
+		return
+	}
+	sr.status = code
+	sr.err = writeHeader(sr.s, &rpcHeader{Status: code, Header: sr.header})
+}
+
+func (sr *sealedResponse) Write(p []byte) (int, error) {
+	sr.WriteHeader(http.StatusOK)
+	if sr.err != nil {
+		return 0, sr.err
+	}
+	n, err := sr.s.Write(p)
+	sr.err = err
+	return n, err
+}
+
+func (sr *sealedResponse) finish() {
+	sr.WriteHeader(http.StatusOK)
+	if sr.err == nil {
+		sr.s.Close()
+	}
+}
+
+// offlineError means the peer could not be reached at all, as opposed to
+// refusing or failing a request.
+type offlineError struct{ err error }
+
+func (e *offlineError) Error() string { return "peer unreachable: " + e.err.Error() }
+func (e *offlineError) Unwrap() error { return e.err }
+
+// transport carries requests to one peer over handleRPC on its side. The
+// request URL's host is ignored; only its path and query are sent.
+type transport struct {
+	self  string // our device ID
+	key   *ecdh.PrivateKey
+	peer  Peer
+	base  http.RoundTripper
+	limit *limiter
+	seen  func(peerID string, at time.Time)
+}
+
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	peerKey, err := ecdh.X25519().NewPublicKey(t.peer.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	eph, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	dhEph, err := eph.ECDH(peerKey)
+	if err != nil {
+		return nil, err
+	}
+	dhStatic, err := t.key.ECDH(peerKey)
+	if err != nil {
+		return nil, err
+	}
+	reqAEAD, respAEAD, err := sessionKeys(eph.PublicKey().Bytes(), dhEph, dhStatic, t.key.PublicKey().Bytes(), t.peer.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := req.Context()
+	pr, pw := io.Pipe()
+	go func() {
+		w := t.limit.writer(ctx, pw)
+		if _, err := io.WriteString(w, rpcMagic); err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		if _, err := w.Write(eph.PublicKey().Bytes()); err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		s := newSealWriter(w, reqAEAD)
+		hdr := &rpcHeader{Method: req.Method, Target: req.URL.RequestURI(), Time: time.Now().Unix(), Header: http.Header{}}
+		if ct := req.Header.Get("Content-Type"); ct != "" {
+			hdr.Header.Set("Content-Type", ct)
+		}
+		err := writeHeader(s, hdr)
+		if err == nil && req.Body != nil {
+			_, err = io.Copy(s, req.Body)
+		}
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		if err == nil {
+			err = s.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+
+	outer, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(t.peer.URL, "/")+rpcPath, pr)
+	if err != nil {
+		pr.Close()
+		return nil, err
+	}
+	outer.Header.Set(peerHeader, t.self)
+	outer.Header.Set("Content-Type", "application/octet-stream")
+	resp, err := t.base.RoundTrip(outer)
+	if err != nil {
+		pr.Close()
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		return nil, &offlineError{err}
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		pr.Close()
+		switch resp.StatusCode {
+		case http.StatusNotFound, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			// What the relay says when the peer's tunnel is down
+			return nil, &offlineError{fmt.Errorf("relay answered %s", resp.Status)}
+		}
+		return nil, fmt.Errorf("peer refused the request: %s", resp.Status)
+	}
+
+	in := newOpenReader(t.limit.reader(ctx, resp.Body), respAEAD)
+	hdr, err := in.readHeader()
+	if err != nil {
+		resp.Body.Close()
+		pr.Close()
+		return nil, fmt.Errorf("peer response: %w", err)
+	}
+	if t.seen != nil {
+		t.seen(t.peer.ID, time.Now())
+	}
+	if hdr.Header == nil {
+		hdr.Header = http.Header{}
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", hdr.Status, http.StatusText(hdr.Status)),
+		StatusCode:    hdr.Status,
+		Proto:         resp.Proto,
+		ProtoMajor:    resp.ProtoMajor,
+		ProtoMinor:    resp.ProtoMinor,
+		Header:        hdr.Header,
+		Body:          &sealedBody{Reader: in, closers: []io.Closer{resp.Body, pr}},
+		ContentLength: -1,
+		Request:       req,
+	}, nil
+}
+
+type sealedBody struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (b *sealedBody) Close() error {
+	for _, c := range b.closers {
+		c.Close()
+	}
+	return nil
+}
+
+// limiter is a token bucket shared by both directions of a link. A nil
+// limiter lets everything through.
+type limiter struct {
+	mu     sync.Mutex
+	rate   float64 // bytes per second
+	tokens float64
+	last   time.Time
+}
+
+func newLimiter(kbps int) *limiter {
+	if kbps <= 0 {
+		return nil
+	}
+	return &limiter{rate: float64(kbps) * 1024, last: time.Now()}
+}
+
+// wait blocks until n bytes may pass.
+func (l *limiter) wait(ctx context.Context, n int) error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens = min(l.tokens+now.Sub(l.last).Seconds()*l.rate, l.rate)
+	l.last = now
+	l.tokens -= float64(n)
+	delay := time.Duration(-l.tokens / l.rate * float64(time.Second))
+	l.mu.Unlock()
+	if delay <= 0 {
+		return nil
+	}
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// chunk keeps single waits short so a cap is smooth rather than bursty.
+func (l *limiter) chunk() int {
+	return max(int(l.rate/8), 1024)
+}
+
+func (l *limiter) writer(ctx context.Context, w io.Writer) io.Writer {
+	if l == nil {
+		return w
+	}
+	return &limitedWriter{ctx: ctx, w: w, l: l}
+}
+
+func (l *limiter) reader(ctx context.Context, r io.Reader) io.Reader {
+	if l == nil {
+		return r
+	}
+	return &limitedReader{ctx: ctx, r: r, l: l}
+}
+
+type limitedWriter struct {
+	ctx context.Context
+	w   io.Writer
+	l   *limiter
+}
+
+func (lw *limitedWriter) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		k := min(len(p), lw.l.chunk())
+		if err := lw.l.wait(lw.ctx, k); err != nil {
+			return n, err
+		}
+		m, err := lw.w.Write(p[:k])
+		n += m
+		if err != nil {
+			return n, err
+		}
+		p = p[k:]
+	}
+	return n, nil
+}
+
+type limitedReader struct {
+	ctx context.Context
+	r   io.Reader
+	l   *limiter
+}
+
+func (lr *limitedReader) Read(p []byte) (int, error) {
+	if len(p) > lr.l.chunk() {
+		p = p[:lr.l.chunk()]
+	}
+	n, err := lr.r.Read(p)
+	if n > 0 {
+		if werr := lr.l.wait(lr.ctx, n); werr != nil && err == nil {
+			err = werr
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,244 @@
+package peer
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+func TestFrames(t *testing.T) {
+	key := make([]byte, chacha20poly1305.KeySize)
+	rand.Read(key)
+	aead, _ := chacha20poly1305.New(key)
+
+	payload := make([]byte, 3*maxFrame+123)
+	rand.Read(payload)
+	seal := func(p []byte, close bool) []byte {
+		var buf bytes.Buffer
+		s := newSealWriter(&buf, aead)
+		s.Write(p)
+		if close {
+			s.Close()
+		} else {
+			s.Flush()
+		}
+		return buf.Bytes()
+	}
+	whole := seal(payload, true)
+
+	tests := []struct {
+		name    string
+		stream  []byte
+		wantErr error
+	}{
+		{"round trip", whole, nil},
+		{"empty", seal(nil, true), nil},
+		{"cut at a frame boundary", seal(payload, false), errTruncated},
+		{"cut mid-frame", whole[:len(whole)/2], errTruncated},
+		{"flipped bit", func() []byte { b := bytes.Clone(whole); b[100] ^= 1; return b }(), errFrame},
+		{"frames reordered", func() []byte {
+			f := 4 + maxFrame + aead.Overhead()
+			b := bytes.Clone(whole)
+			copy(b, whole[f:2*f])
+			copy(b[f:], whole[:f])
+			return b
+		}(), errFrame},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := io.ReadAll(newOpenReader(bytes.NewReader(tt.stream), aead))
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr == nil && tt.name == "round trip" && !bytes.Equal(got, payload) {
+				t.Error("payload differs")
+			}
+		})
+	}
+}
+
+// newPair makes two managers that trust each other, each serving its
+// routes on a test server. a's sync handlers are stand-ins that echo what
+// reached them.
+func newPair(t *testing.T) (a, b *Manager, srvA *httptest.Server) {
+	t.Helper()
+	echo := func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("X-Root", r.URL.Query().Get("root"))
+		w.Write(append([]byte(r.URL.Path+":"), body...))
+	}
+	routes := map[string]http.HandlerFunc{
+		"/api/sync/changes":  echo,
+		"/api/sync/upload":   echo,
+		"/api/sync/download": echo,
+		"/api/files":         echo,
+	}
+	a = newTestManager(t, "device-a", "Living room", routes)
+	b = newTestManager(t, "device-b", "Office", nil)
+	srvA = httptest.NewServer(routesMux(a.GetRoutes()))
+	t.Cleanup(srvA.Close)
+	a.Config.URL = srvA.URL
+
+	a.Peers[b.Config.DeviceID] = &Peer{ID: b.Config.DeviceID, Name: "Office", PublicKey: b.key.PublicKey().Bytes(),
+		Grants: []Grant{{Folder: "Replicas/Office"}, {Folder: "Photos", ReadOnly: true}}}
+	b.Peers[a.Config.DeviceID] = &Peer{ID: a.Config.DeviceID, Name: "Living room", URL: srvA.URL, PublicKey: a.key.PublicKey().Bytes()}
+	return a, b, srvA
+}
+
+func newTestManager(t *testing.T, id, name string, routes map[string]http.HandlerFunc) *Manager {
+	t.Helper()
+	m, err := NewManager(Config{DeviceID: id, Name: name, URL: "http://" + id, DataDir: t.TempDir(), StateDir: t.TempDir()}, routes, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func routesMux(routes map[string]http.HandlerFunc) *http.ServeMux {
+	mux := http.NewServeMux()
+	for p, h := range routes {
+		mux.HandleFunc(p, h)
+	}
+	return mux
+}
+
+func TestRPC(t *testing.T) {
+	a, b, srvA := newPair(t)
+	client := &http.Client{Transport: b.transport(b.Peers[a.Config.DeviceID], nil)}
+
+	tests := []struct {
+		name     string
+		method   string
+		target   string
+		body     string
+		wantCode int
+		wantBody string
+	}{
+		{"upload into the granted folder", "POST", "/api/sync/upload?root=Replicas/Office&path=a.txt", "hello", 200, "/api/sync/upload:hello"},
+		{"below the granted folder", "GET", "/api/sync/changes?root=Replicas/Office/sub", "", 200, "/api/sync/changes:"},
+		{"read a read-only folder", "POST", "/api/sync/download?root=Photos&path=x.jpg", "", 200, "/api/sync/download:"},
+		{"write a read-only folder", "POST", "/api/sync/upload?root=Photos&path=x.jpg", "x", 403, ""},
+		{"folder not granted", "GET", "/api/sync/changes?root=Documents", "", 403, ""},
+		{"whole drive", "GET", "/api/sync/changes", "", 403, ""},
+		{"dot-dot out of the grant", "GET", "/api/sync/changes?root=Replicas/Office/../../Documents", "", 403, ""},
+		{"similar prefix", "GET", "/api/sync/changes?root=Replicas/Office2", "", 403, ""},
+		{"not a sync endpoint", "GET", "/api/files?root=Replicas/Office", "", 403, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest(tt.method, "http://ignored"+tt.target, strings.NewReader(tt.body))
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != tt.wantCode {
+				t.Fatalf("status = %d, want %d: %s", resp.StatusCode, tt.wantCode, body)
+			}
+			if tt.wantBody != "" && string(body) != tt.wantBody {
+				t.Errorf("body = %q, want %q", body, tt.wantBody)
+			}
+		})
+	}
+	if a.Peers[b.Config.DeviceID].LastSeen == nil || b.Peers[a.Config.DeviceID].LastSeen == nil {
+		t.Error("neither side noted the other as seen")
+	}
+
+	// Capture one request as it crosses the relay
+	var captured []byte
+	var header http.Header
+	relay := roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		captured, _ = io.ReadAll(r.Body)
+		header = r.Header.Clone()
+		r.Body = io.NopCloser(bytes.NewReader(captured))
+		return http.DefaultTransport.RoundTrip(r)
+	})
+	tr := b.transport(b.Peers[a.Config.DeviceID], nil)
+	tr.base = relay
+	req, _ := http.NewRequest("POST", "http://ignored/api/sync/upload?root=Replicas/Office&path=secret.txt", strings.NewReader("TOP SECRET"))
+	resp, err := (&http.Client{Transport: tr}).Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if bytes.Contains(captured, []byte("TOP SECRET")) || bytes.Contains(captured, []byte("secret.txt")) {
+		t.Error("the relay can read the request")
+	}
+
+	replay := func(body []byte, h http.Header) int {
+		t.Helper()
+		req, _ := http.NewRequest("POST", srvA.URL+rpcPath, bytes.NewReader(body))
+		req.Header = h
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	t.Run("replayed request", func(t *testing.T) {
+		if code := replay(captured, header); code != http.StatusForbidden {
+			t.Errorf("status = %d", code)
+		}
+	})
+	t.Run("unknown sender", func(t *testing.T) {
+		h := header.Clone()
+		h.Set(peerHeader, "device-c")
+		if code := replay(captured, h); code != http.StatusForbidden {
+			t.Errorf("status = %d", code)
+		}
+	})
+	t.Run("another device's key", func(t *testing.T) {
+		c := newTestManager(t, "device-b", "Impostor", nil)
+		tr := c.transport(&Peer{ID: a.Config.DeviceID, URL: srvA.URL, PublicKey: a.key.PublicKey().Bytes()}, nil)
+		req, _ := http.NewRequest("GET", "http://ignored/api/sync/changes?root=Replicas/Office", nil)
+		if _, err := (&http.Client{Transport: tr}).Do(req); err == nil || !strings.Contains(err.Error(), "403") {
+			t.Errorf("impostor got through: %v", err)
+		}
+	})
+	t.Run("unreachable peer", func(t *testing.T) {
+		gone := *b.Peers[a.Config.DeviceID]
+		gone.URL = "http://127.0.0.1:1"
+		req, _ := http.NewRequest("GET", "http://ignored/api/sync/changes?root=Replicas/Office", nil)
+		_, err := (&http.Client{Transport: b.transport(&gone, nil)}).Do(req)
+		var offline *offlineError
+		if !errors.As(err, &offline) {
+			t.Errorf("err = %v, want offline", err)
+		}
+	})
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
+
+func TestLimiter(t *testing.T) {
+	l := newLimiter(64) // 64 KiB/s
+	var buf bytes.Buffer
+	start := time.Now()
+	if _, err := l.writer(t.Context(), &buf).Write(make([]byte, 32<<10)); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d < 400*time.Millisecond || d > 2*time.Second {
+		t.Errorf("32 KiB at 64 KiB/s took %v", d)
+	}
+	if newLimiter(0) != nil {
+		t.Error("no cap should mean no limiter")
+	}
+}
@@ -0,0 +1,337 @@
+package s3
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/accounts"
+)
+
+const (
+	sigAlgorithm = "AWS4-HMAC-SHA256"
+	amzDateFmt   = "20060102T150405Z"
+	maxClockSkew = 15 * time.Minute
+
+	unsignedPayload        = "UNSIGNED-PAYLOAD"
+	streamingPayload       = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+	streamingUnsignedTrail = "STREAMING-UNSIGNED-PAYLOAD-TRAILER"
+	emptySHA256            = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+// sigContext is what a verified request carries forward: who signed it and
+// what is needed to check streaming chunk signatures.
+type sigContext struct {
+	account     accounts.Account
+	payloadHash string
+	amzDate     string
+	scope       string
+	signingKey  []byte
+	seedSig     string
+}
+
+// authenticate verifies an AWS Signature Version 4 request, either from the
+// Authorization header or from presigned query parameters.
+func (s *Server) authenticate(r *http.Request) (*sigContext, *apiError) {
+	if r.URL.Query().Get("X-Amz-Algorithm") != "" {
+		return s.authPresigned(r)
+	}
+
+	auth := r.Header.Get("Authorization")
+	if auth == "" {
+		return nil, errAccessDenied
+	}
+	if !strings.HasPrefix(auth, sigAlgorithm+" ") {
+		return nil, errSignatureVersion
+	}
+
+	fields := map[string]string{}
+	for _, part := range strings.Split(strings.TrimPrefix(auth, sigAlgorithm+" "), ",") {
+		k, v, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if ok {
+			fields[k] = v
+		}
+	}
+	cred, signed, sig := fields["Credential"], fields["SignedHeaders"], fields["Signature"]
+	if cred == "" || signed == "" || sig == "" {
+		return nil, errMalformedAuth
+	}
+
+	amzDate := r.Header.Get("X-Amz-Date")
+	if amzDate == "" {
+		amzDate = r.Header.Get("Date")
+	}
+	t, err := time.Parse(amzDateFmt, amzDate)
+	if err != nil {
+		return nil, errMalformedAuth
+	}
+	if d := s.now().Sub(t); d > maxClockSkew || d < -maxClockSkew {
+		return nil, errTimeSkewed
+	}
+
+	payload := r.Header.Get("X-Amz-Content-Sha256")
+	if payload == "" {
+		payload = unsignedPayload
+	}
+
+	ctx, apiErr := s.verify(r, cred, signed, sig, amzDate, payload, nil)
+	if apiErr != nil {
+		return nil, apiErr
+	}
+	return ctx, nil
+}
+
+func (s *Server) authPresigned(r *http.Request) (*sigContext, *apiError) {
+	q := r.URL.Query()
+	if q.Get("X-Amz-Algorithm") != sigAlgorithm {
+		return nil, errSignatureVersion
+	}
+
+	amzDate := q.Get("X-Amz-Date")
+	t, err := time.Parse(amzDateFmt, amzDate)
+	if err != nil {
+		return nil, errMalformedAuth
+	}
+	expires, err := strconv.Atoi(q.Get("X-Amz-Expires"))
+	if err != nil || expires < 0 || expires > 7*24*3600 {
+		return nil, errMalformedAuth
+	}
+	if s.now().After(t.Add(time.Duration(expires) * time.Second)) {
+		return nil, &apiError{Code: "AccessDenied", Message: "Request has expired", Status: http.StatusForbidden}
+	}
+
+	return s.verify(r, q.Get("X-Amz-Credential"), q.Get("X-Amz-SignedHeaders"), q.Get("X-Amz-Signature"),
+		amzDate, unsignedPayload, map[string]bool{"X-Amz-Signature": true})
+}
+
+func (s *Server) verify(r *http.Request, cred, signedHeaders, sig, amzDate, payload string, skipQuery map[string]bool) (*sigContext, *apiError) {
+	// Credential=AKID/20240101/us-east-1/s3/aws4_request
+	parts := strings.Split(cred, "/")
+	if len(parts) != 5 || parts[4] != "aws4_request" {
+		return nil, errMalformedAuth
+	}
+	if !strings.HasPrefix(amzDate, parts[1]) {
+		return nil, errMalformedAuth
+	}
+
+	acct, ok := s.Accounts.ByAccessKey(parts[0])
+	if !ok {
+		return nil, errInvalidAccessKey
+	}
+
+	canonical := canonicalRequest(r, strings.Split(signedHeaders, ";"), payload, skipQuery)
+	scope := strings.Join(parts[1:], "/")
+	key := signingKey(acct.SecretKey, parts[1], parts[2], parts[3])
+	want := hex.EncodeToString(hmacSHA256(key, stringToSign(amzDate, scope, canonical)))
+
+	if !hmac.Equal([]byte(want), []byte(sig)) {
+		return nil, errSignatureMismatch
+	}
+
+	return &sigContext{
+		account:     acct,
+		payloadHash: payload,
+		amzDate:     amzDate,
+		scope:       scope,
+		signingKey:  key,
+		seedSig:     sig,
+	}, nil
+}
+
+// Sign adds a Signature Version 4 Authorization header to a request for
+// an S3 endpoint in region, covering its host, date and payload hash, the
+// way the AWS SDKs sign. payload is the hex SHA-256 of the body. The
+// canonical form is the one the gateway verifies against.
+func Sign(r *http.Request, accessKey, secretKey, region, payload string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format(amzDateFmt)
+	day := now.Format("20060102")
+	r.Header.Set("X-Amz-Date", amzDate)
+	r.Header.Set("X-Amz-Content-Sha256", payload)
+
+	signed := []string{"host", "x-amz-content-sha256", "x-amz-date"}
+	scope := day + "/" + region + "/s3/aws4_request"
+	canonical := canonicalRequest(r, signed, payload, nil)
+	key := signingKey(secretKey, day, region, "s3")
+	sig := hex.EncodeToString(hmacSHA256(key, stringToSign(amzDate, scope, canonical)))
+
+	r.Header.Set("Authorization", sigAlgorithm+" Credential="+accessKey+"/"+scope+
+		", SignedHeaders="+strings.Join(signed, ";")+", Signature="+sig)
+}
+
+func canonicalRequest(r *http.Request, signed []string, payload string, skipQuery map[string]bool) string {
+	var b strings.Builder
+	b.WriteString(r.Method)
+	b.WriteByte('\n')
+	b.WriteString(uriEncode(r.URL.Path, false))
+	b.WriteByte('\n')
+	b.WriteString(canonicalQuery(r.URL.Query(), skipQuery))
+	b.WriteByte('\n')
+
+	for _, h := range signed {
+		var v string
+		if h == "host" {
+			v = r.Host
+		} else {
+			v = strings.Join(r.Header.Values(h), ",")
+		}
+		b.WriteString(h)
+		b.WriteByte(':')
+		b.WriteString(strings.Join(strings.Fields(v), " "))
+		b.WriteByte('\n')
+	}
+	b.WriteByte('\n')
+	b.WriteString(strings.Join(signed, ";"))
+	b.WriteByte('\n')
+	b.WriteString(payload)
+	return b.String()
+}
+
+func canonicalQuery(q url.Values, skip map[string]bool) string {
+	var pairs []string
+	for k, vs := range q {
+		if skip[k] {
+			continue
+		}
+		for _, v := range vs {
+			pairs = append(pairs, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+func stringToSign(amzDate, scope, canonical string) string {
+	sum := sha256.Sum256([]byte(canonical))
+	return sigAlgorithm + "\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(sum[:])
+}
+
+func signingKey(secret, date, region, service string) []byte {
+	k := hmacSHA256([]byte("AWS4"+secret), date)
+	k = hmacSHA256(k, region)
+	k = hmacSHA256(k, service)
+	return hmacSHA256(k, "aws4_request")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(data))
+	return m.Sum(nil)
+}
+
+// uriEncode implements the AWS flavour of percent-encoding: everything but
+// the RFC 3986 unreserved characters is escaped, '/' optionally kept.
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// maxChunkSize bounds a single aws-chunked chunk we are willing to buffer.
+const maxChunkSize = 16 << 20
+
+var errChunkSignature = errors.New("chunk signature mismatch")
+
+// chunkedReader decodes an aws-chunked body. With a sigContext it verifies
+// every chunk signature (STREAMING-AWS4-HMAC-SHA256-PAYLOAD); without one it
+// just strips the framing and skips trailers (STREAMING-UNSIGNED-PAYLOAD-TRAILER).
+type chunkedReader struct {
+	r       *bufio.Reader
+	sig     *sigContext
+	prevSig string
+	buf     []byte
+	done    bool
+}
+
+func newChunkedReader(body io.Reader, sig *sigContext) *chunkedReader {
+	cr := &chunkedReader{r: bufio.NewReader(body), sig: sig}
+	if sig != nil {
+		cr.prevSig = sig.seedSig
+	}
+	return cr
+}
+
+func (c *chunkedReader) Read(p []byte) (int, error) {
+	for len(c.buf) == 0 {
+		if c.done {
+			return 0, io.EOF
+		}
+		if err := c.nextChunk(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, c.buf)
+	c.buf = c.buf[n:]
+	return n, nil
+}
+
+func (c *chunkedReader) nextChunk() error {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return io.ErrUnexpectedEOF
+	}
+	line = strings.TrimRight(line, "\r\n")
+
+	sizeHex, ext, _ := strings.Cut(line, ";")
+	size, err := strconv.ParseInt(sizeHex, 16, 64)
+	if err != nil || size < 0 || size > maxChunkSize {
+		return errors.New("malformed chunk header")
+	}
+
+	data := make([]byte, size)
+	if _, err := io.ReadFull(c.r, data); err != nil {
+		return io.ErrUnexpectedEOF
+	}
+
+	if c.sig != nil {
+		got := strings.TrimPrefix(ext, "chunk-signature=")
+		sum := sha256.Sum256(data)
+		sts := "AWS4-HMAC-SHA256-PAYLOAD\n" + c.sig.amzDate + "\n" + c.sig.scope + "\n" +
+			c.prevSig + "\n" + emptySHA256 + "\n" + hex.EncodeToString(sum[:])
+		want := hex.EncodeToString(hmacSHA256(c.sig.signingKey, sts))
+		if !hmac.Equal([]byte(got), []byte(want)) {
+			return errChunkSignature
+		}
+		c.prevSig = got
+	}
+
+	if size == 0 {
+		c.done = true
+		// Optional trailers (x-amz-checksum-*) end with an empty line
+		for {
+			l, err := c.r.ReadString('\n')
+			if err != nil || len(bytes.TrimSpace([]byte(l))) == 0 {
+				return nil
+			}
+		}
+	}
+
+	// Chunk data is followed by CRLF
+	if _, err := c.r.Discard(2); err != nil {
+		return io.ErrUnexpectedEOF
+	}
+	c.buf = data
+	return nil
+}
@@ -0,0 +1,419 @@
+package s3
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/fsx"
+)
+
+const s3NS = "http://s3.amazonaws.com/doc/2006-03-01/"
+
+const maxListKeys = 1000
+
+type owner struct {
+	ID          string `xml:"ID"`
+	DisplayName string `xml:"DisplayName"`
+}
+
+type listAllMyBucketsResult struct {
+	XMLName xml.Name     `xml:"ListAllMyBucketsResult"`
+	Xmlns   string       `xml:"xmlns,attr"`
+	Owner   owner        `xml:"Owner"`
+	Buckets []bucketInfo `xml:"Buckets>Bucket"`
+}
+
+type bucketInfo struct {
+	Name         string `xml:"Name"`
+	CreationDate string `xml:"CreationDate"`
+}
+
+type locationConstraint struct {
+	XMLName xml.Name `xml:"LocationConstraint"`
+	Xmlns   string   `xml:"xmlns,attr"`
+	Value   string   `xml:",chardata"`
+}
+
+type versioningConfiguration struct {
+	XMLName xml.Name `xml:"VersioningConfiguration"`
+}
+
+type objectInfo struct {
+	Key          string `xml:"Key"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	Size         int64  `xml:"Size"`
+	StorageClass string `xml:"StorageClass"`
+}
+
+type commonPrefix struct {
+	Prefix string `xml:"Prefix"`
+}
+
+type listBucketResult struct {
+	XMLName               xml.Name       `xml:"ListBucketResult"`
+	Xmlns                 string         `xml:"xmlns,attr"`
+	Name                  string         `xml:"Name"`
+	Prefix                string         `xml:"Prefix"`
+	Delimiter             string         `xml:"Delimiter,omitempty"`
+	MaxKeys               int            `xml:"MaxKeys"`
+	IsTruncated           bool           `xml:"IsTruncated"`
+	Marker                *string        `xml:"Marker,omitempty"`
+	NextMarker            string         `xml:"NextMarker,omitempty"`
+	KeyCount              *int           `xml:"KeyCount,omitempty"`
+	ContinuationToken     string         `xml:"ContinuationToken,omitempty"`
+	NextContinuationToken string         `xml:"NextContinuationToken,omitempty"`
+	StartAfter            string         `xml:"StartAfter,omitempty"`
+	Contents              []objectInfo   `xml:"Contents"`
+	CommonPrefixes        []commonPrefix `xml:"CommonPrefixes"`
+}
+
+func (s *Server) listBuckets(req *request) {
+	entries, err := os.ReadDir(s.Config.DataDir)
+	if err != nil {
+		req.failIO(err, errInternal)
+		return
+	}
+
+	res := listAllMyBucketsResult{
+		Xmlns: s3NS,
+		Owner: owner{ID: req.sig.account.Name, DisplayName: req.sig.account.Name},
+	}
+	for _, e := range entries {
+		if !e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		if s.authorize(req.sig.account, e.Name()) != nil {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		res.Buckets = append(res.Buckets, bucketInfo{
+			Name:         e.Name(),
+			CreationDate: info.ModTime().UTC().Format(time.RFC3339),
+		})
+	}
+	req.xml(http.StatusOK, res)
+}
+
+func (s *Server) statBucket(req *request) (string, bool) {
+	dir, apiErr := s.bucketPath(req.bucket)
+	if apiErr != nil {
+		req.fail(apiErr)
+		return "", false
+	}
+	info, err := os.Stat(dir)
+	if err != nil || !info.IsDir() {
+		req.fail(errNoSuchBucket)
+		return "", false
+	}
+	return dir, true
+}
+
+func (s *Server) headBucket(req *request) {
+	if _, ok := s.statBucket(req); ok {
+		req.w.WriteHeader(http.StatusOK)
+	}
+}
+
+func (s *Server) bucketLocation(req *request) {
+	if _, ok := s.statBucket(req); ok {
+		// Empty means us-east-1, which is what every client assumes by default
+		req.xml(http.StatusOK, locationConstraint{Xmlns: s3NS})
+	}
+}
+
+func (s *Server) createBucket(req *request) {
+	dir, apiErr := s.bucketPath(req.bucket)
+	if apiErr != nil {
+		req.fail(apiErr)
+		return
+	}
+	// The body may carry a CreateBucketConfiguration; the region is irrelevant here
+	io.Copy(io.Discard, req.r.Body)
+
+	// A name someone else owns stays theirs even while the folder is gone
+	if _, owned := s.Accounts.Owner(req.bucket); owned && s.authorize(req.sig.account, req.bucket) != nil {
+		req.fail(errBucketTaken)
+		return
+	}
+	if err := os.Mkdir(dir, 0755); err != nil {
+		switch {
+		case os.IsExist(err) && s.authorize(req.sig.account, req.bucket) == nil:
+			req.fail(errBucketExists)
+		case os.IsExist(err):
+			req.fail(errBucketTaken)
+		default:
+			req.failIO(err, errInternal)
+		}
+		return
+	}
+	// The creator owns the bucket; its size counts towards their quota. A
+	// bucket without an owner would be out of the creator's reach.
+	if err := s.Accounts.Claim(req.sig.account.Name, req.bucket); err != nil {
+		log.Printf("[S3] Could not record owner of %s: %v", req.bucket, err)
+		os.Remove(dir)
+		req.fail(errInternal)
+		return
+	}
+	s.Hooks.NotifyChanged(dir)
+	req.w.Header().Set("Location", "/"+req.bucket)
+	req.w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) deleteBucket(req *request) {
+	dir, ok := s.statBucket(req)
+	if !ok {
+		return
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		req.failIO(err, errNoSuchBucket)
+		return
+	}
+	if len(entries) > 0 {
+		req.fail(errBucketNotEmpty)
+		return
+	}
+	if err := os.Remove(dir); err != nil {
+		req.failIO(err, errNoSuchBucket)
+		return
+	}
+	s.Hooks.NotifyRemoved(dir)
+	req.w.WriteHeader(http.StatusNoContent)
+}
+
+// listObjects serves both ListObjects (V1, marker based) and ListObjectsV2
+// (continuation token based); the underlying walk is the same.
+func (s *Server) listObjects(req *request) {
+	dir, ok := s.statBucket(req)
+	if !ok {
+		return
+	}
+
+	q := req.r.URL.Query()
+	v2 := q.Get("list-type") == "2"
+	prefix, delim := q.Get("prefix"), q.Get("delimiter")
+	if delim != "" && delim != "/" {
+		// Only "/" maps onto directories; anything else would need a full scan per call
+		req.fail(&apiError{"InvalidArgument", "Only '/' is supported as delimiter", http.StatusBadRequest})
+		return
+	}
+
+	maxKeys := maxListKeys
+	if raw := q.Get("max-keys"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 0 {
+			req.fail(errInvalidArgument)
+			return
+		}
+		maxKeys = min(n, maxListKeys)
+	}
+
+	after := q.Get("marker")
+	if v2 {
+		after = q.Get("start-after")
+		if tok := q.Get("continuation-token"); tok != "" {
+			raw, err := base64.RawURLEncoding.DecodeString(tok)
+			if err != nil {
+				req.fail(&apiError{"InvalidArgument", "The continuation token provided is incorrect", http.StatusBadRequest})
+				return
+			}
+			after = string(raw)
+		}
+	}
+
+	items, err := s.collect(dir, prefix, delim != "")
+	if err != nil {
+		req.failIO(err, errNoSuchBucket)
+		return
+	}
+
+	res := listBucketResult{
+		Xmlns:     s3NS,
+		Name:      req.bucket,
+		Prefix:    prefix,
+		Delimiter: delim,
+		MaxKeys:   maxKeys,
+	}
+
+	start := sort.Search(len(items), func(i int) bool { return items[i].key > after })
+	count, last := 0, ""
+	for _, it := range items[start:] {
+		if count == maxKeys {
+			res.IsTruncated = true
+			break
+		}
+		if it.prefix {
+			res.CommonPrefixes = append(res.CommonPrefixes, commonPrefix{Prefix: it.key})
+		} else {
+			res.Contents = append(res.Contents, objectInfo{
+				Key:          it.key,
+				LastModified: it.info.ModTime().UTC().Format("2006-01-02T15:04:05.000Z"),
+				ETag:         s.meta.etag(filepath.Join(dir, filepath.FromSlash(it.key)), it.info),
+				Size:         it.info.Size(),
+				StorageClass: "STANDARD",
+			})
+		}
+		last = it.key
+		count++
+	}
+
+	if v2 {
+		res.KeyCount = &count
+		res.ContinuationToken = q.Get("continuation-token")
+		res.StartAfter = q.Get("start-after")
+		if res.IsTruncated {
+			res.NextContinuationToken = base64.RawURLEncoding.EncodeToString([]byte(last))
+		}
+	} else {
+		marker := q.Get("marker")
+		res.Marker = &marker
+		if res.IsTruncated {
+			res.NextMarker = last
+		}
+	}
+	req.xml(http.StatusOK, res)
+}
+
+type listItem struct {
+	key    string
+	prefix bool
+	info   fs.FileInfo
+}
+
+// collect gathers every key (or, with a delimiter, every key and common
+// prefix of one level) matching prefix, sorted the way S3 sorts: by raw
+// byte order of the full key, which is not the order a directory walk yields.
+func (s *Server) collect(bucketDir, prefix string, delimited bool) ([]listItem, error) {
+	// Start from the deepest directory the prefix pins down
+	base := ""
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		base = prefix[:i+1]
+	}
+	startDir := filepath.Join(bucketDir, filepath.FromSlash(base))
+
+	var items []listItem
+
+	if delimited {
+		entries, err := os.ReadDir(startDir)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil, nil
+			}
+			return nil, err
+		}
+		for _, e := range entries {
+			key := base + e.Name()
+			if fsx.IsTempName(e.Name()) || !strings.HasPrefix(key, prefix) {
+				continue
+			}
+			if e.IsDir() {
+				items = append(items, listItem{key: key + "/", prefix: true})
+				continue
+			}
+			info, err := e.Info()
+			if err != nil || !info.Mode().IsRegular() {
+				continue
+			}
+			items = append(items, listItem{key: key, info: info})
+		}
+	} else {
+		err := filepath.WalkDir(startDir, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				if os.IsNotExist(err) && p == startDir {
+					return filepath.SkipAll
+				}
+				return nil
+			}
+			if d.IsDir() || fsx.IsTempName(d.Name()) {
+				return nil
+			}
+			rel, err := filepath.Rel(bucketDir, p)
+			if err != nil {
+				return nil
+			}
+			key := filepath.ToSlash(rel)
+			if !strings.HasPrefix(key, prefix) {
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil || !info.Mode().IsRegular() {
+				return nil
+			}
+			items = append(items, listItem{key: key, info: info})
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sort.Slice(items, func(i, j int) bool { return items[i].key < items[j].key })
+	return items, nil
+}
+
+type deleteRequest struct {
+	Quiet   bool `xml:"Quiet"`
+	Objects []struct {
+		Key string `xml:"Key"`
+	} `xml:"Object"`
+}
+
+type deleteResult struct {
+	XMLName xml.Name        `xml:"DeleteResult"`
+	Xmlns   string          `xml:"xmlns,attr"`
+	Deleted []deletedObject `xml:"Deleted"`
+	Errors  []deleteError   `xml:"Error"`
+}
+
+type deletedObject struct {
+	Key string `xml:"Key"`
+}
+
+type deleteError struct {
+	Key     string `xml:"Key"`
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+func (s *Server) deleteObjects(req *request) {
+	if _, ok := s.statBucket(req); !ok {
+		return
+	}
+
+	body, err := readBody(req)
+	if err != nil {
+		req.fail(errIncompleteBody)
+		return
+	}
+	var in deleteRequest
+	if err := xml.Unmarshal(body, &in); err != nil || len(in.Objects) > 1000 {
+		req.fail(errMalformedXML)
+		return
+	}
+
+	res := deleteResult{Xmlns: s3NS}
+	for _, o := range in.Objects {
+		if apiErr := s.removeObject(req.bucket, o.Key); apiErr != nil {
+			res.Errors = append(res.Errors, deleteError{Key: o.Key, Code: apiErr.Code, Message: apiErr.Message})
+			continue
+		}
+		if !in.Quiet {
+			res.Deleted = append(res.Deleted, deletedObject{Key: o.Key})
+		}
+	}
+	req.xml(http.StatusOK, res)
+}
@@ -0,0 +1,457 @@
+package s3
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	maxPartNumber = 10000
+	// Uploads nobody completed or aborted are reclaimed after this long
+	uploadTTL = 7 * 24 * time.Hour
+)
+
+// upload is the on-disk record of a multipart upload in progress. Parts are
+// staged under StateDir, not next to the target, so they never show up in
+// listings or the file browser.
+type upload struct {
+	ID          string    `json:"id"`
+	Bucket      string    `json:"bucket"`
+	Key         string    `json:"key"`
+	ContentType string    `json:"contentType,omitempty"`
+	Initiated   time.Time `json:"initiated"`
+	Owner       string    `json:"owner"`
+}
+
+type initiateResult struct {
+	XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+	Xmlns    string   `xml:"xmlns,attr"`
+	Bucket   string   `xml:"Bucket"`
+	Key      string   `xml:"Key"`
+	UploadID string   `xml:"UploadId"`
+}
+
+type completeRequest struct {
+	Parts []struct {
+		PartNumber int    `xml:"PartNumber"`
+		ETag       string `xml:"ETag"`
+	} `xml:"Part"`
+}
+
+type completeResult struct {
+	XMLName  xml.Name `xml:"CompleteMultipartUploadResult"`
+	Xmlns    string   `xml:"xmlns,attr"`
+	Location string   `xml:"Location"`
+	Bucket   string   `xml:"Bucket"`
+	Key      string   `xml:"Key"`
+	ETag     string   `xml:"ETag"`
+}
+
+type partInfo struct {
+	PartNumber   int    `xml:"PartNumber"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	Size         int64  `xml:"Size"`
+}
+
+type listPartsResult struct {
+	XMLName  xml.Name   `xml:"ListPartsResult"`
+	Xmlns    string     `xml:"xmlns,attr"`
+	Bucket   string     `xml:"Bucket"`
+	Key      string     `xml:"Key"`
+	UploadID string     `xml:"UploadId"`
+	Parts    []partInfo `xml:"Part"`
+}
+
+type uploadSummary struct {
+	Key       string `xml:"Key"`
+	UploadID  string `xml:"UploadId"`
+	Initiated string `xml:"Initiated"`
+}
+
+type listUploadsResult struct {
+	XMLName xml.Name        `xml:"ListMultipartUploadsResult"`
+	Xmlns   string          `xml:"xmlns,attr"`
+	Bucket  string          `xml:"Bucket"`
+	Uploads []uploadSummary `xml:"Upload"`
+}
+
+func (s *Server) uploadsDir() string {
+	return filepath.Join(s.Config.StateDir, "s3", "uploads")
+}
+
+func (s *Server) uploadDir(id string) (string, bool) {
+	if len(id) != 32 || strings.Trim(id, "0123456789abcdef") != "" {
+		return "", false
+	}
+	return filepath.Join(s.uploadsDir(), id), true
+}
+
+// loadUpload fetches the upload record and checks it belongs to this bucket/key.
+func (s *Server) loadUpload(req *request) (*upload, string, bool) {
+	dir, ok := s.uploadDir(req.r.URL.Query().Get("uploadId"))
+	if !ok {
+		req.fail(errNoSuchUpload)
+		return nil, "", false
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "upload.json"))
+	if err != nil {
+		req.fail(errNoSuchUpload)
+		return nil, "", false
+	}
+	var up upload
+	if err := json.Unmarshal(data, &up); err != nil || up.Bucket != req.bucket || up.Key != req.key {
+		req.fail(errNoSuchUpload)
+		return nil, "", false
+	}
+	return &up, dir, true
+}
+
+func (s *Server) createMultipartUpload(req *request) {
+	if _, apiErr := s.objectPath(req.bucket, req.key); apiErr != nil {
+		req.fail(apiErr)
+		return
+	}
+	if _, ok := s.statBucket(req); !ok {
+		return
+	}
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		req.fail(errInternal)
+		return
+	}
+	up := upload{
+		ID:          hex.EncodeToString(b),
+		Bucket:      req.bucket,
+		Key:         req.key,
+		ContentType: req.r.Header.Get("Content-Type"),
+		Initiated:   time.Now().UTC(),
+		Owner:       req.sig.account.Name,
+	}
+
+	dir := filepath.Join(s.uploadsDir(), up.ID)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		req.failIO(err, errInternal)
+		return
+	}
+	data, _ := json.Marshal(up)
+	if err := os.WriteFile(filepath.Join(dir, "upload.json"), data, 0644); err != nil {
+		req.failIO(err, errInternal)
+		return
+	}
+
+	req.xml(http.StatusOK, initiateResult{Xmlns: s3NS, Bucket: up.Bucket, Key: up.Key, UploadID: up.ID})
+}
+
+func (s *Server) uploadPart(req *request) {
+	_, dir, ok := s.loadUpload(req)
+	if !ok {
+		return
+	}
+	full, apiErr := s.objectPath(req.bucket, req.key)
+	if apiErr != nil {
+		req.fail(apiErr)
+		return
+	}
+
+	n, err := strconv.Atoi(req.r.URL.Query().Get("partNumber"))
+	if err != nil || n < 1 || n > maxPartNumber {
+		req.fail(&apiError{"InvalidArgument", "Part number must be an integer between 1 and 10000", http.StatusBadRequest})
+		return
+	}
+
+	p, apiErr := newPayload(req)
+	if apiErr != nil {
+		req.fail(apiErr)
+		return
+	}
+	// Checked per part so a client learns early, not after uploading everything
+	if apiErr := s.limitPayload(full, p, s.stagedSize(dir)); apiErr != nil {
+		req.fail(apiErr)
+		return
+	}
+
+	tmp, err := os.CreateTemp(dir, "part-*.tmp")
+	if err != nil {
+		req.failIO(err, errInternal)
+		return
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, p); err != nil {
+		tmp.Close()
+		switch {
+		case errors.Is(err, errChunkSignature):
+			req.fail(errSignatureMismatch)
+		case errors.Is(err, errOverQuota):
+			req.fail(errQuotaExceeded)
+		default:
+			req.fail(errIncompleteBody)
+		}
+		return
+	}
+	if err := tmp.Close(); err != nil {
+		req.fail(errInternal)
+		return
+	}
+	if apiErr := p.verify(); apiErr != nil {
+		req.fail(apiErr)
+		return
+	}
+
+	// A re-uploaded part number simply replaces the previous one
+	etag := p.etag()
+	if err := os.WriteFile(partPath(dir, n)+".etag", []byte(etag), 0644); err != nil {
+		req.fail(errInternal)
+		return
+	}
+	if err := os.Rename(tmp.Name(), partPath(dir, n)); err != nil {
+		req.fail(errInternal)
+		return
+	}
+
+	req.w.Header().Set("ETag", etag)
+	req.w.WriteHeader(http.StatusOK)
+}
+
+// stagedSize is the number of bytes already uploaded as parts.
+func (s *Server) stagedSize(dir string) int64 {
+	matches, _ := filepath.Glob(filepath.Join(dir, "part.*[0-9]"))
+	var total int64
+	for _, m := range matches {
+		if info, err := os.Stat(m); err == nil {
+			total += info.Size()
+		}
+	}
+	return total
+}
+
+func partPath(dir string, n int) string {
+	return filepath.Join(dir, fmt.Sprintf("part.%05d", n))
+}
+
+func (s *Server) completeMultipartUpload(req *request) {
+	up, dir, ok := s.loadUpload(req)
+	if !ok {
+		return
+	}
+	full, apiErr := s.objectPath(req.bucket, req.key)
+	if apiErr != nil {
+		req.fail(apiErr)
+		return
+	}
+
+	body, err := readBody(req)
+	if err != nil {
+		req.fail(errIncompleteBody)
+		return
+	}
+	var in completeRequest
+	if err := xml.Unmarshal(body, &in); err != nil || len(in.Parts) == 0 {
+		req.fail(errMalformedXML)
+		return
+	}
+
+	// Validate every part before touching the destination
+	files := make([]string, 0, len(in.Parts))
+	digests := md5.New()
+	var total int64
+	prev := 0
+	for _, part := range in.Parts {
+		if part.PartNumber <= prev {
+			req.fail(errInvalidPartOrder)
+			return
+		}
+		prev = part.PartNumber
+
+		path := partPath(dir, part.PartNumber)
+		stored, err := os.ReadFile(path + ".etag")
+		if err != nil || strings.Trim(string(stored), `"`) != strings.Trim(part.ETag, `"`) {
+			req.fail(errInvalidPart)
+			return
+		}
+		sum, err := hex.DecodeString(strings.Trim(string(stored), `"`))
+		if err != nil {
+			req.fail(errInvalidPart)
+			return
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			req.fail(errInvalidPart)
+			return
+		}
+		total += info.Size()
+		digests.Write(sum)
+		files = append(files, path)
+	}
+	if apiErr := s.checkQuota(full, total); apiErr != nil {
+		req.fail(apiErr)
+		return
+	}
+
+	r := &partsReader{files: files}
+	defer r.Close()
+	if apiErr := s.writeObject(full, r, func() *apiError { return nil }); apiErr != nil {
+		req.fail(apiErr)
+		return
+	}
+
+	etag := fmt.Sprintf(`"%s-%d"`, hex.EncodeToString(digests.Sum(nil)), len(files))
+	s.meta.put(full, objectMeta{ETag: etag, ContentType: up.ContentType})
+	os.RemoveAll(dir)
+
+	req.xml(http.StatusOK, completeResult{
+		Xmlns:    s3NS,
+		Location: "/" + req.bucket + "/" + req.key,
+		Bucket:   req.bucket,
+		Key:      req.key,
+		ETag:     etag,
+	})
+}
+
+// partsReader concatenates the staged part files without loading them.
+type partsReader struct {
+	files []string
+	cur   *os.File
+}
+
+func (p *partsReader) Read(b []byte) (int, error) {
+	for {
+		if p.cur == nil {
+			if len(p.files) == 0 {
+				return 0, io.EOF
+			}
+			f, err := os.Open(p.files[0])
+			if err != nil {
+				return 0, err
+			}
+			p.cur, p.files = f, p.files[1:]
+		}
+		n, err := p.cur.Read(b)
+		if err == io.EOF {
+			p.cur.Close()
+			p.cur = nil
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+func (p *partsReader) Close() {
+	if p.cur != nil {
+		p.cur.Close()
+	}
+}
+
+func (s *Server) abortMultipartUpload(req *request) {
+	_, dir, ok := s.loadUpload(req)
+	if !ok {
+		return
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		req.failIO(err, errNoSuchUpload)
+		return
+	}
+	req.w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) listParts(req *request) {
+	up, dir, ok := s.loadUpload(req)
+	if !ok {
+		return
+	}
+
+	res := listPartsResult{Xmlns: s3NS, Bucket: up.Bucket, Key: up.Key, UploadID: up.ID}
+	matches, _ := filepath.Glob(filepath.Join(dir, "part.*[0-9]"))
+	sort.Strings(matches)
+	for _, m := range matches {
+		n, err := strconv.Atoi(strings.TrimPrefix(filepath.Ext(m), "."))
+		if err != nil {
+			continue
+		}
+		info, err := os.Stat(m)
+		if err != nil {
+			continue
+		}
+		etag, _ := os.ReadFile(m + ".etag")
+		res.Parts = append(res.Parts, partInfo{
+			PartNumber:   n,
+			LastModified: info.ModTime().UTC().Format("2006-01-02T15:04:05.000Z"),
+			ETag:         string(etag),
+			Size:         info.Size(),
+		})
+	}
+	req.xml(http.StatusOK, res)
+}
+
+func (s *Server) listMultipartUploads(req *request) {
+	if _, ok := s.statBucket(req); !ok {
+		return
+	}
+
+	res := listUploadsResult{Xmlns: s3NS, Bucket: req.bucket}
+	prefix := req.r.URL.Query().Get("prefix")
+	for _, up := range s.uploads() {
+		if up.Bucket != req.bucket || !strings.HasPrefix(up.Key, prefix) {
+			continue
+		}
+		res.Uploads = append(res.Uploads, uploadSummary{
+			Key:       up.Key,
+			UploadID:  up.ID,
+			Initiated: up.Initiated.Format("2006-01-02T15:04:05.000Z"),
+		})
+	}
+	req.xml(http.StatusOK, res)
+}
+
+func (s *Server) uploads() []upload {
+	entries, err := os.ReadDir(s.uploadsDir())
+	if err != nil {
+		return nil
+	}
+	var list []upload
+	for _, e := range entries {
+		data, err := os.ReadFile(filepath.Join(s.uploadsDir(), e.Name(), "upload.json"))
+		if err != nil {
+			continue
+		}
+		var up upload
+		if json.Unmarshal(data, &up) == nil {
+			list = append(list, up)
+		}
+	}
+	return list
+}
+
+func (s *Server) reapUploads() {
+	ticker := time.NewTicker(6 * time.Hour)
+	defer ticker.Stop()
+
+	for ; ; <-ticker.C {
+		for _, up := range s.uploads() {
+			if time.Since(up.Initiated) < uploadTTL {
+				continue
+			}
+			log.Printf("[S3] Removing abandoned multipart upload %s (%s/%s)", up.ID, up.Bucket, up.Key)
+			os.RemoveAll(filepath.Join(s.uploadsDir(), up.ID))
+		}
+	}
+}
@@ -0,0 +1,466 @@
+package s3
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/fsx"
+)
+
+// maxSmallBody caps bodies we read fully into memory (XML requests).
+const maxSmallBody = 4 << 20
+
+// errOverQuota ends a payload that grew past its limit.
+var errOverQuota = errors.New("body is larger than the quota allows")
+
+// payload wraps a request body: it removes aws-chunked framing and hashes
+// what flows through so the declared checksums can be checked before commit.
+type payload struct {
+	r       io.Reader
+	md5     hash.Hash
+	sha     hash.Hash
+	n       int64
+	wantLen int64
+	limit   int64 // the most that fits the owner's quota, or -1
+	wantSHA string
+	wantMD5 []byte
+}
+
+func newPayload(req *request) (*payload, *apiError) {
+	p := &payload{md5: md5.New(), sha: sha256.New(), wantLen: req.r.ContentLength, limit: -1}
+
+	switch h := req.sig.payloadHash; h {
+	case streamingPayload, streamingUnsignedTrail:
+		sig := req.sig
+		if h == streamingUnsignedTrail {
+			sig = nil
+		}
+		p.r = newChunkedReader(req.r.Body, sig)
+		p.wantLen = -1
+		if raw := req.r.Header.Get("X-Amz-Decoded-Content-Length"); raw != "" {
+			n, err := strconv.ParseInt(raw, 10, 64)
+			if err != nil {
+				return nil, errInvalidArgument
+			}
+			p.wantLen = n
+		}
+	case unsignedPayload:
+		p.r = req.r.Body
+	default:
+		if len(h) != 64 {
+			return nil, errInvalidArgument
+		}
+		p.r = req.r.Body
+		p.wantSHA = h
+	}
+
+	if raw := req.r.Header.Get("Content-MD5"); raw != "" {
+		sum, err := base64.StdEncoding.DecodeString(raw)
+		if err != nil || len(sum) != md5.Size {
+			return nil, &apiError{"InvalidDigest", "The Content-MD5 you specified was invalid", http.StatusBadRequest}
+		}
+		p.wantMD5 = sum
+	}
+	return p, nil
+}
+
+func (p *payload) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	if n > 0 {
+		p.md5.Write(b[:n])
+		p.sha.Write(b[:n])
+		p.n += int64(n)
+	}
+	if p.limit >= 0 && p.n > p.limit {
+		return n, errOverQuota
+	}
+	return n, err
+}
+
+func (p *payload) verify() *apiError {
+	if p.wantLen >= 0 && p.n != p.wantLen {
+		return errIncompleteBody
+	}
+	if p.wantSHA != "" && hex.EncodeToString(p.sha.Sum(nil)) != p.wantSHA {
+		return errSHA256Mismatch
+	}
+	if p.wantMD5 != nil && string(p.md5.Sum(nil)) != string(p.wantMD5) {
+		return errBadDigest
+	}
+	return nil
+}
+
+func (p *payload) etag() string {
+	return `"` + hex.EncodeToString(p.md5.Sum(nil)) + `"`
+}
+
+func readBody(req *request) ([]byte, error) {
+	p, apiErr := newPayload(req)
+	if apiErr != nil {
+		return nil, errors.New(apiErr.Message)
+	}
+	data, err := io.ReadAll(io.LimitReader(p, maxSmallBody))
+	if err != nil {
+		return nil, err
+	}
+	if apiErr := p.verify(); apiErr != nil {
+		return nil, errors.New(apiErr.Message)
+	}
+	return data, nil
+}
+
+func (s *Server) putObject(req *request) {
+	full, apiErr := s.objectPath(req.bucket, req.key)
+	if apiErr != nil {
+		req.fail(apiErr)
+		return
+	}
+	if _, ok := s.statBucket(req); !ok {
+		return
+	}
+
+	p, apiErr := newPayload(req)
+	if apiErr != nil {
+		req.fail(apiErr)
+		return
+	}
+
+	// "folder/" keys are how S3 tools create empty folders
+	if strings.HasSuffix(req.key, "/") {
+		io.Copy(io.Discard, p)
+		if err := os.MkdirAll(full, 0755); err != nil {
+			req.failIO(err, errInvalidKey)
+			return
+		}
+		s.Hooks.NotifyChanged(full)
+		req.w.Header().Set("ETag", p.etag())
+		req.w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if apiErr := s.limitPayload(full, p, 0); apiErr != nil {
+		req.fail(apiErr)
+		return
+	}
+	if apiErr := s.writeObject(full, p, p.verify); apiErr != nil {
+		req.fail(apiErr)
+		return
+	}
+
+	etag := p.etag()
+	s.meta.put(full, objectMeta{ETag: etag, ContentType: req.r.Header.Get("Content-Type")})
+	req.w.Header().Set("ETag", etag)
+	req.w.WriteHeader(http.StatusOK)
+}
+
+// writeObject streams r into a temp file next to full and renames it into
+// place only if check passes, so readers never see a partial object. The
+// SHA-256 of what was written goes to the hooks with it.
+func (s *Server) writeObject(full string, r io.Reader, check func() *apiError) *apiError {
+	dir := filepath.Dir(full)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return &apiError{"InvalidArgument", "A parent of this key is an existing object", http.StatusConflict}
+	}
+	if info, err := os.Stat(full); err == nil && info.IsDir() {
+		return &apiError{"InvalidArgument", "An object cannot replace a folder", http.StatusConflict}
+	}
+
+	tmp, err := os.CreateTemp(dir, fsx.TempPrefix+"*")
+	if err != nil {
+		log.Printf("[S3] Create temp file: %v", err)
+		return errInternal
+	}
+	defer os.Remove(tmp.Name())
+
+	sum := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tmp, sum), r); err != nil {
+		tmp.Close()
+		switch {
+		case errors.Is(err, errChunkSignature):
+			return errSignatureMismatch
+		case errors.Is(err, errOverQuota):
+			return errQuotaExceeded
+		}
+		return errIncompleteBody
+	}
+	if apiErr := check(); apiErr != nil {
+		tmp.Close()
+		return apiErr
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return errInternal
+	}
+	if err := tmp.Close(); err != nil {
+		return errInternal
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return errInternal
+	}
+	if err := os.Rename(tmp.Name(), full); err != nil {
+		log.Printf("[S3] Commit %s: %v", full, err)
+		return errInternal
+	}
+	if err := fsx.SyncDir(dir); err != nil {
+		log.Printf("[S3] fsync %s: %v", dir, err)
+	}
+
+	s.Hooks.NotifyWritten(full, hex.EncodeToString(sum.Sum(nil)))
+	return nil
+}
+
+func (s *Server) getObject(req *request) {
+	full, apiErr := s.objectPath(req.bucket, req.key)
+	if apiErr != nil {
+		req.fail(apiErr)
+		return
+	}
+	if _, ok := s.statBucket(req); !ok {
+		return
+	}
+
+	f, err := os.Open(full)
+	if err != nil {
+		req.failIO(err, errNoSuchKey)
+		return
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		req.failIO(err, errNoSuchKey)
+		return
+	}
+	if info.IsDir() {
+		if !strings.HasSuffix(req.key, "/") {
+			req.fail(errNoSuchKey)
+			return
+		}
+		req.w.Header().Set("ETag", `"d41d8cd98f00b204e9800998ecf8427e"`)
+		req.w.Header().Set("Content-Length", "0")
+		req.w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	m, _ := s.meta.get(full, info)
+	ctype := m.ContentType
+	if ctype == "" {
+		ctype = mime.TypeByExtension(filepath.Ext(full))
+	}
+	if ctype == "" {
+		ctype = "application/octet-stream"
+	}
+
+	h := req.w.Header()
+	h.Set("ETag", s.meta.etag(full, info))
+	h.Set("Content-Type", ctype)
+	h.Set("Accept-Ranges", "bytes")
+
+	// ServeContent handles Range, If-Match, If-None-Match and HEAD for us
+	http.ServeContent(req.w, req.r, "", info.ModTime(), f)
+}
+
+func (s *Server) deleteObject(req *request) {
+	if _, ok := s.statBucket(req); !ok {
+		return
+	}
+	if apiErr := s.removeObject(req.bucket, req.key); apiErr != nil {
+		req.fail(apiErr)
+		return
+	}
+	req.w.WriteHeader(http.StatusNoContent)
+}
+
+// removeObject deletes a single object. Like S3, deleting a missing key is
+// not an error.
+func (s *Server) removeObject(bucket, key string) *apiError {
+	full, apiErr := s.objectPath(bucket, key)
+	if apiErr != nil {
+		return apiErr
+	}
+
+	info, err := os.Stat(full)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errInternal
+	}
+	if info.IsDir() {
+		// Only an empty "folder/" marker may be removed through S3
+		if !strings.HasSuffix(key, "/") {
+			return nil
+		}
+		if err := os.Remove(full); err != nil {
+			return &apiError{"InvalidArgument", "Folder is not empty", http.StatusConflict}
+		}
+	} else if err := os.Remove(full); err != nil {
+		return errInternal
+	}
+
+	s.meta.remove(full)
+	s.Hooks.NotifyRemoved(full)
+	return nil
+}
+
+type copyObjectResult struct {
+	XMLName      xml.Name `xml:"CopyObjectResult"`
+	Xmlns        string   `xml:"xmlns,attr"`
+	ETag         string   `xml:"ETag"`
+	LastModified string   `xml:"LastModified"`
+}
+
+func (s *Server) copyObject(req *request) {
+	dst, apiErr := s.objectPath(req.bucket, req.key)
+	if apiErr != nil {
+		req.fail(apiErr)
+		return
+	}
+	if _, ok := s.statBucket(req); !ok {
+		return
+	}
+
+	raw := req.r.Header.Get("X-Amz-Copy-Source")
+	raw, _, _ = strings.Cut(raw, "?") // versionId is meaningless here
+	source, err := url.PathUnescape(raw)
+	if err != nil {
+		req.fail(errInvalidArgument)
+		return
+	}
+	srcBucket, srcKey, _ := strings.Cut(strings.TrimPrefix(source, "/"), "/")
+	if apiErr := s.authorize(req.sig.account, srcBucket); apiErr != nil {
+		req.fail(apiErr)
+		return
+	}
+	src, apiErr := s.objectPath(srcBucket, srcKey)
+	if apiErr != nil {
+		req.fail(apiErr)
+		return
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		req.failIO(err, errNoSuchKey)
+		return
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil || info.IsDir() {
+		req.fail(errNoSuchKey)
+		return
+	}
+
+	meta, _ := s.meta.get(src, info)
+	if req.r.Header.Get("X-Amz-Metadata-Directive") == "REPLACE" {
+		meta.ContentType = req.r.Header.Get("Content-Type")
+	}
+
+	if apiErr := s.checkQuota(dst, info.Size()); apiErr != nil {
+		req.fail(apiErr)
+		return
+	}
+
+	sum := md5.New()
+	if apiErr := s.writeObject(dst, io.TeeReader(in, sum), func() *apiError { return nil }); apiErr != nil {
+		req.fail(apiErr)
+		return
+	}
+
+	meta.ETag = `"` + hex.EncodeToString(sum.Sum(nil)) + `"`
+	s.meta.put(dst, meta)
+	req.xml(http.StatusOK, copyObjectResult{
+		Xmlns:        s3NS,
+		ETag:         meta.ETag,
+		LastModified: time.Now().UTC().Format("2006-01-02T15:04:05.000Z"),
+	})
+}
+
+// objectMeta is what S3 clients expect back that a plain file cannot carry.
+// It is only trusted while the file's size and mtime still match, so edits
+// made through the other APIs simply fall back to a synthetic ETag.
+type objectMeta struct {
+	ETag        string `json:"etag"`
+	ContentType string `json:"contentType,omitempty"`
+	Size        int64  `json:"size"`
+	ModTime     int64  `json:"mtime"`
+}
+
+// metaStore keeps one small sidecar file per object, keyed by a hash of the
+// path, so writing metadata costs the same for the first object as the millionth.
+type metaStore struct {
+	dir string
+}
+
+func (m *metaStore) path(full string) string {
+	sum := sha256.Sum256([]byte(full))
+	key := hex.EncodeToString(sum[:])
+	return filepath.Join(m.dir, key[:2], key+".json")
+}
+
+func (m *metaStore) put(full string, meta objectMeta) {
+	info, err := os.Stat(full)
+	if err != nil {
+		return
+	}
+	meta.Size = info.Size()
+	meta.ModTime = info.ModTime().UnixNano()
+
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return
+	}
+	p := m.path(full)
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		log.Printf("[S3] Metadata dir: %v", err)
+		return
+	}
+	if err := os.WriteFile(p, data, 0644); err != nil {
+		log.Printf("[S3] Metadata write: %v", err)
+	}
+}
+
+func (m *metaStore) get(full string, info os.FileInfo) (objectMeta, bool) {
+	data, err := os.ReadFile(m.path(full))
+	if err != nil {
+		return objectMeta{}, false
+	}
+	var meta objectMeta
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return objectMeta{}, false
+	}
+	if meta.Size != info.Size() || meta.ModTime != info.ModTime().UnixNano() {
+		return objectMeta{}, false
+	}
+	return meta, true
+}
+
+func (m *metaStore) remove(full string) {
+	os.Remove(m.path(full))
+}
+
+// etag returns the stored MD5 ETag, or a synthetic one for files that were
+// written outside the gateway. The synthetic form contains a '-' so clients
+// treat it like a multipart ETag and do not compare it against an MD5.
+func (m *metaStore) etag(full string, info os.FileInfo) string {
+	if meta, ok := m.get(full, info); ok && meta.ETag != "" {
+		return meta.ETag
+	}
+	return fmt.Sprintf(`"%x-%x"`, info.ModTime().UnixNano(), info.Size())
+}
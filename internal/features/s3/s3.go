@@ -0,0 +1,375 @@
+// Package s3 exposes DataDir through a subset of the Amazon S3 REST API so
+// that backup tools (restic, rclone, Kopia) and the AWS SDKs can use the
+// device as a storage endpoint. Buckets are the top-level folders of DataDir
+// and object keys map one-to-one onto file paths below them.
+package s3
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/accounts"
+	"github.com/strct-org/strct-agent/internal/errs"
+)
+
+const OpStart errs.Op = "s3.Start"
+
+// Hooks lets the gateway tell the rest of the agent about files it changed,
+// so the search index and caches stay current, and ask whether a write fits
+// the owner's quota. NotifyWritten is NotifyChanged for an object whose
+// SHA-256 the gateway computed as it was written. Room is how many bytes a
+// file may hold, or -1 when nothing limits it.
+//
+// The gateway has its own listener, so it also goes through the agent's
+// eject gate: Enter counts a request as using the data drive, or reports
+// false while it is ejected, and Leave ends what Enter began. Offline
+// reports whether fullPath is on storage that is not mounted.
+type Hooks interface {
+	Enter() bool
+	Leave()
+	Offline(fullPath string) bool
+	NotifyChanged(fullPath string)
+	NotifyWritten(fullPath, sum string)
+	NotifyRemoved(fullPath string)
+	CheckQuota(fullPath string, size int64) error
+	Room(fullPath string) (int64, error)
+}
+
+type Config struct {
+	DataDir  string
+	StateDir string
+	Port     int
+}
+
+type Server struct {
+	Config   Config
+	Accounts *accounts.Store
+	Hooks    Hooks
+
+	meta *metaStore
+	now  func() time.Time // the clock signatures are checked against
+}
+
+func New(cfg Config, accts *accounts.Store, hooks Hooks) *Server {
+	return &Server{
+		Config:   cfg,
+		Accounts: accts,
+		Hooks:    hooks,
+		meta:     &metaStore{dir: filepath.Join(cfg.StateDir, "s3", "meta")},
+		now:      time.Now,
+	}
+}
+
+func (s *Server) Start() error {
+	if err := os.MkdirAll(s.uploadsDir(), 0755); err != nil {
+		return errs.E(OpStart, errs.KindIO, err)
+	}
+	go s.reapUploads()
+
+	addr := fmt.Sprintf(":%d", s.Config.Port)
+	log.Printf("[S3] Gateway listening on %s (buckets = folders in %s)", addr, s.Config.DataDir)
+
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           s,
+		ReadHeaderTimeout: 30 * time.Second,
+	}
+	if err := srv.ListenAndServe(); err != nil {
+		return errs.E(OpStart, errs.KindNetwork, err, fmt.Sprintf("s3 gateway failed on port %d", s.Config.Port))
+	}
+	return nil
+}
+
+type request struct {
+	w      http.ResponseWriter
+	r      *http.Request
+	sig    *sigContext
+	bucket string
+	key    string
+	id     string
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	id := requestID()
+	w.Header().Set("x-amz-request-id", id)
+	w.Header().Set("Server", "strct-agent")
+
+	req := &request{w: w, r: r, id: id}
+	req.bucket, req.key, _ = strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+
+	sig, apiErr := s.authenticate(r)
+	if apiErr != nil {
+		req.fail(apiErr)
+		return
+	}
+	req.sig = sig
+
+	// An ejected drive leaves an empty folder behind, which must neither be
+	// written to nor taken for objects having been deleted
+	if !s.Hooks.Enter() {
+		req.fail(errVolumeOffline)
+		return
+	}
+	defer s.Hooks.Leave()
+	if s.Hooks.Offline(filepath.Join(s.Config.DataDir, req.bucket)) {
+		req.fail(errVolumeOffline)
+		return
+	}
+
+	// Creating a bucket checks who owns the name itself
+	creating := req.key == "" && r.Method == http.MethodPut
+	if req.bucket != "" && !creating {
+		if apiErr := s.authorize(sig.account, req.bucket); apiErr != nil {
+			req.fail(apiErr)
+			return
+		}
+	}
+
+	switch {
+	case req.bucket == "":
+		s.routeService(req)
+	case req.key == "":
+		s.routeBucket(req)
+	default:
+		s.routeObject(req)
+	}
+}
+
+func (s *Server) routeService(req *request) {
+	if req.r.Method != http.MethodGet {
+		req.fail(errMethodNotAllowed)
+		return
+	}
+	s.listBuckets(req)
+}
+
+func (s *Server) routeBucket(req *request) {
+	q := req.r.URL.Query()
+	switch req.r.Method {
+	case http.MethodGet:
+		switch {
+		case q.Has("location"):
+			s.bucketLocation(req)
+		case q.Has("uploads"):
+			s.listMultipartUploads(req)
+		case q.Has("versioning"):
+			req.xml(http.StatusOK, versioningConfiguration{})
+		default:
+			s.listObjects(req)
+		}
+	case http.MethodHead:
+		s.headBucket(req)
+	case http.MethodPut:
+		s.createBucket(req)
+	case http.MethodDelete:
+		s.deleteBucket(req)
+	case http.MethodPost:
+		if q.Has("delete") {
+			s.deleteObjects(req)
+			return
+		}
+		req.fail(errNotImplemented)
+	default:
+		req.fail(errMethodNotAllowed)
+	}
+}
+
+func (s *Server) routeObject(req *request) {
+	q := req.r.URL.Query()
+	switch req.r.Method {
+	case http.MethodGet:
+		if q.Has("uploadId") {
+			s.listParts(req)
+			return
+		}
+		s.getObject(req)
+	case http.MethodHead:
+		s.getObject(req)
+	case http.MethodPut:
+		switch {
+		case q.Has("uploadId"):
+			s.uploadPart(req)
+		case req.r.Header.Get("X-Amz-Copy-Source") != "":
+			s.copyObject(req)
+		default:
+			s.putObject(req)
+		}
+	case http.MethodPost:
+		switch {
+		case q.Has("uploads"):
+			s.createMultipartUpload(req)
+		case q.Has("uploadId"):
+			s.completeMultipartUpload(req)
+		default:
+			req.fail(errNotImplemented)
+		}
+	case http.MethodDelete:
+		if q.Has("uploadId") {
+			s.abortMultipartUpload(req)
+			return
+		}
+		s.deleteObject(req)
+	default:
+		req.fail(errMethodNotAllowed)
+	}
+}
+
+// authorize lets an account reach the buckets it owns. Admins reach every
+// bucket; a folder nobody owns is reachable by admins only.
+func (s *Server) authorize(acct accounts.Account, bucket string) *apiError {
+	if acct.Admin {
+		return nil
+	}
+	if owner, ok := s.Accounts.Owner(bucket); ok && owner.Name == acct.Name {
+		return nil
+	}
+	return errAccessDenied
+}
+
+type apiError struct {
+	Code    string
+	Message string
+	Status  int
+}
+
+var (
+	errAccessDenied      = &apiError{"AccessDenied", "Access Denied", http.StatusForbidden}
+	errSignatureVersion  = &apiError{"AccessDenied", "Only AWS Signature Version 4 is supported", http.StatusForbidden}
+	errMalformedAuth     = &apiError{"AuthorizationHeaderMalformed", "The authorization header is malformed", http.StatusBadRequest}
+	errInvalidAccessKey  = &apiError{"InvalidAccessKeyId", "The access key ID you provided does not exist", http.StatusForbidden}
+	errSignatureMismatch = &apiError{"SignatureDoesNotMatch", "The request signature we calculated does not match the signature you provided", http.StatusForbidden}
+	errTimeSkewed        = &apiError{"RequestTimeTooSkewed", "The difference between the request time and the server's time is too large", http.StatusForbidden}
+	errNoSuchBucket      = &apiError{"NoSuchBucket", "The specified bucket does not exist", http.StatusNotFound}
+	errNoSuchKey         = &apiError{"NoSuchKey", "The specified key does not exist", http.StatusNotFound}
+	errNoSuchUpload      = &apiError{"NoSuchUpload", "The specified multipart upload does not exist", http.StatusNotFound}
+	errBucketExists      = &apiError{"BucketAlreadyOwnedByYou", "The bucket already exists", http.StatusConflict}
+	errBucketTaken       = &apiError{"BucketAlreadyExists", "The requested bucket name is not available", http.StatusConflict}
+	errBucketNotEmpty    = &apiError{"BucketNotEmpty", "The bucket you tried to delete is not empty", http.StatusConflict}
+	errInvalidBucketName = &apiError{"InvalidBucketName", "The specified bucket is not valid", http.StatusBadRequest}
+	errInvalidKey        = &apiError{"KeyTooLongError", "The specified key is not a valid path on this device", http.StatusBadRequest}
+	errInvalidArgument   = &apiError{"InvalidArgument", "Invalid argument", http.StatusBadRequest}
+	errInvalidPart       = &apiError{"InvalidPart", "One or more of the specified parts could not be found", http.StatusBadRequest}
+	errInvalidPartOrder  = &apiError{"InvalidPartOrder", "The list of parts was not in ascending order", http.StatusBadRequest}
+	errMalformedXML      = &apiError{"MalformedXML", "The XML you provided was not well-formed", http.StatusBadRequest}
+	errBadDigest         = &apiError{"BadDigest", "The Content-MD5 you specified did not match what we received", http.StatusBadRequest}
+	errSHA256Mismatch    = &apiError{"XAmzContentSHA256Mismatch", "The provided 'x-amz-content-sha256' header does not match what was computed", http.StatusBadRequest}
+	errIncompleteBody    = &apiError{"IncompleteBody", "You did not provide the number of bytes specified by the Content-Length HTTP header", http.StatusBadRequest}
+	errMethodNotAllowed  = &apiError{"MethodNotAllowed", "The specified method is not allowed against this resource", http.StatusMethodNotAllowed}
+	errNotImplemented    = &apiError{"NotImplemented", "A header or query you provided implies functionality that is not implemented", http.StatusNotImplemented}
+	errQuotaExceeded     = &apiError{"QuotaExceeded", "The write would exceed the storage quota or the free space on the device", http.StatusInsufficientStorage}
+	errVolumeOffline     = &apiError{"ServiceUnavailable", "Volume is offline: the data drive was ejected", http.StatusServiceUnavailable}
+	errInternal          = &apiError{"InternalError", "We encountered an internal error. Please try again.", http.StatusInternalServerError}
+)
+
+type errorResponse struct {
+	XMLName   xml.Name `xml:"Error"`
+	Code      string   `xml:"Code"`
+	Message   string   `xml:"Message"`
+	Resource  string   `xml:"Resource"`
+	RequestID string   `xml:"RequestId"`
+}
+
+func (req *request) fail(e *apiError) {
+	if e.Status >= 500 {
+		log.Printf("[S3] %s %s: %s", req.r.Method, req.r.URL.Path, e.Message)
+	}
+	if req.r.Method == http.MethodHead {
+		req.w.WriteHeader(e.Status)
+		return
+	}
+	req.xml(e.Status, errorResponse{Code: e.Code, Message: e.Message, Resource: req.r.URL.Path, RequestID: req.id})
+}
+
+// failIO maps a filesystem error onto the closest S3 error.
+func (req *request) failIO(err error, notFound *apiError) {
+	switch {
+	case os.IsNotExist(err):
+		req.fail(notFound)
+	case os.IsPermission(err):
+		req.fail(errAccessDenied)
+	default:
+		log.Printf("[S3] %s %s: %v", req.r.Method, req.r.URL.Path, err)
+		req.fail(errInternal)
+	}
+}
+
+func (req *request) xml(status int, v any) {
+	req.w.Header().Set("Content-Type", "application/xml")
+	req.w.WriteHeader(status)
+	req.w.Write([]byte(xml.Header))
+	if err := xml.NewEncoder(req.w).Encode(v); err != nil {
+		log.Printf("[S3] Failed to encode response: %v", err)
+	}
+}
+
+func requestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return strings.ToUpper(hex.EncodeToString(b))
+}
+
+// bucketPath resolves a bucket to its folder. Bucket names are single path
+// segments; anything that could escape DataDir or hit a hidden folder is refused.
+func (s *Server) bucketPath(bucket string) (string, *apiError) {
+	if bucket == "" || bucket == "." || bucket == ".." || strings.HasPrefix(bucket, ".") ||
+		strings.ContainsAny(bucket, `/\`) || len(bucket) > 255 {
+		return "", errInvalidBucketName
+	}
+	return filepath.Join(s.Config.DataDir, bucket), nil
+}
+
+// objectPath resolves bucket/key to a file. Keys must already be in canonical
+// form ("a/b.txt", never "a//b.txt" or "a/../b.txt") so that every key maps
+// to exactly one file and back.
+func (s *Server) objectPath(bucket, key string) (string, *apiError) {
+	dir, apiErr := s.bucketPath(bucket)
+	if apiErr != nil {
+		return "", apiErr
+	}
+	if key == "" || len(key) > 1024 || strings.Contains(key, "\\") || strings.ContainsRune(key, 0) {
+		return "", errInvalidKey
+	}
+	for _, seg := range strings.Split(strings.TrimSuffix(key, "/"), "/") {
+		if seg == "" || seg == "." || seg == ".." {
+			return "", errInvalidKey
+		}
+	}
+	return filepath.Join(dir, filepath.FromSlash(key)), nil
+}
+
+// checkQuota refuses writes the owner has no room for.
+func (s *Server) checkQuota(full string, size int64) *apiError {
+	if err := s.Hooks.CheckQuota(full, size); err != nil {
+		log.Printf("[S3] %v", err)
+		return errQuotaExceeded
+	}
+	return nil
+}
+
+// limitPayload refuses a body to full that the owner has no room for and,
+// since a streamed body need not say its length, stops p once it grows
+// past the room left. staged is what earlier parts of it already take.
+func (s *Server) limitPayload(full string, p *payload, staged int64) *apiError {
+	if p.wantLen >= 0 {
+		if apiErr := s.checkQuota(full, p.wantLen+staged); apiErr != nil {
+			return apiErr
+		}
+	}
+	room, err := s.Hooks.Room(full)
+	if err != nil {
+		log.Printf("[S3] %v", err)
+		return errQuotaExceeded
+	}
+	if room >= 0 {
+		p.limit = max(room-staged, 0)
+	}
+	return nil
+}
@@ -0,0 +1,230 @@
+package storage
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/errs"
+	"github.com/strct-org/strct-agent/internal/platform/disk"
+)
+
+const (
+	OpStorageChecks errs.Op = "storage.Manager.Checks"
+	OpStorageScrub  errs.Op = "storage.Manager.Scrub"
+)
+
+// maxScheduleDays bounds how far apart checks and scrubs can be set.
+const maxScheduleDays = 365
+
+// ChecksStatus is the schedule and record of filesystem checks and
+// scrubs, with the progress of a scrub that is running.
+type ChecksStatus struct {
+	disk.CheckState
+	Scrubbing *float64 `json:"scrubbing,omitempty"`
+}
+
+// Warnings says what is wrong with the data drive's mirror and
+// filesystem, for the agent's health report.
+func (m *Manager) Warnings() []string {
+	w := m.mirrorWarnings()
+	if m.Checker != nil {
+		w = append(w, m.Checker.Warnings()...)
+	}
+	return w
+}
+
+// Start scrubs the mirror, if storage is on one, whenever one is due.
+func (m *Manager) Start() error {
+	if m.Checker == nil {
+		return nil
+	}
+	go func() {
+		t := time.NewTicker(m.Tick)
+		defer t.Stop()
+		for {
+			m.Maintain()
+			<-t.C
+		}
+	}()
+	return nil
+}
+
+// Maintain records the result of a scrub that has finished, and starts
+// the next once ScrubDays have passed since the last.
+func (m *Manager) Maintain() {
+	m.mu.Lock()
+	a := m.array()
+	m.mu.Unlock()
+	if a == nil {
+		return
+	}
+	s := m.Checker.State()
+	last, ok := s.LastScrub()
+	if ok && last.Finished == nil {
+		m.finishScrub(a, last)
+		return
+	}
+	if s.ScrubDays == 0 || ok && time.Since(last.Started) < time.Duration(s.ScrubDays)*24*time.Hour {
+		return
+	}
+	if _, err := m.startScrub(a); err != nil {
+		log.Printf("[STORAGE] Scrub not started: %v", err)
+	}
+}
+
+func (m *Manager) startScrub(a *disk.Array) (disk.ScrubResult, error) {
+	st, err := a.Detail()
+	if err != nil {
+		return disk.ScrubResult{}, errs.E(OpStorageScrub, errs.KindSystem, err, "could not read the mirror")
+	}
+	if st.State != disk.ArrayClean {
+		return disk.ScrubResult{}, errs.E(OpStorageScrub, errs.KindInvalid, "the mirror is "+st.State+"; it is scrubbed once both drives are in sync")
+	}
+	if err := a.Scrub(); err != nil {
+		return disk.ScrubResult{}, errs.E(OpStorageScrub, errs.KindSystem, err, "could not start the scrub")
+	}
+	r := disk.ScrubResult{Started: time.Now()}
+	if err := m.Checker.RecordScrub(r); err != nil {
+		return disk.ScrubResult{}, errs.E(OpStorageScrub, errs.KindIO, err)
+	}
+	log.Printf("[STORAGE] Scrubbing the mirror %s", a.Device)
+	return r, nil
+}
+
+// finishScrub records r once the kernel is done with it.
+func (m *Manager) finishScrub(a *disk.Array, r disk.ScrubResult) {
+	st, err := a.Detail()
+	if err == nil && st.State == disk.ArrayChecking {
+		return
+	}
+	now := time.Now()
+	r.Finished = &now
+	if err == nil {
+		r.Mismatches, err = a.Mismatches()
+	}
+	if err != nil {
+		r.Error = err.Error()
+	}
+	log.Printf("[STORAGE] Scrub of the mirror finished: %d mismatches", r.Mismatches)
+	if err := m.Checker.RecordScrub(r); err != nil {
+		log.Printf("[STORAGE] Could not record the scrub: %v", err)
+	}
+}
+
+// Scrub starts a scrub of the mirror now.
+func (m *Manager) Scrub() (disk.ScrubResult, error) {
+	if m.Checker == nil {
+		return disk.ScrubResult{}, errs.E(OpStorageScrub, errs.KindNotFound, "filesystem checks are not set up")
+	}
+	m.mu.Lock()
+	a := m.array()
+	m.mu.Unlock()
+	if a == nil {
+		return disk.ScrubResult{}, errs.E(OpStorageScrub, errs.KindInvalid, "only a mirror is scrubbed; a single drive is checked when it is mounted")
+	}
+	if last, ok := m.Checker.State().LastScrub(); ok && last.Finished == nil {
+		return disk.ScrubResult{}, errs.E(OpStorageScrub, errs.KindInvalid, "a scrub is already running")
+	}
+	return m.startScrub(a)
+}
+
+// Checks returns the schedule and record of checks and scrubs.
+func (m *Manager) Checks() (ChecksStatus, error) {
+	if m.Checker == nil {
+		return ChecksStatus{}, errs.E(OpStorageChecks, errs.KindNotFound, "filesystem checks are not set up")
+	}
+	st := ChecksStatus{CheckState: m.Checker.State()}
+	m.mu.Lock()
+	a := m.array()
+	m.mu.Unlock()
+	if last, ok := st.LastScrub(); ok && last.Finished == nil && a != nil {
+		if as, err := a.Detail(); err == nil && as.State == disk.ArrayChecking {
+			st.Scrubbing = as.Progress
+		}
+	}
+	return st, nil
+}
+
+// handleCheck reports on checks and scrubs (GET) and sets how often they
+// run (PUT).
+func (m *Manager) handleCheck(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var req struct {
+			CheckDays int `json:"checkDays"`
+			ScrubDays int `json:"scrubDays"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4<<10)).Decode(&req); err != nil {
+			errs.HTTPResponse(w, errs.E(OpStorageAPI, errs.KindInvalid, "Invalid JSON"))
+			return
+		}
+		if req.CheckDays < 0 || req.CheckDays > maxScheduleDays || req.ScrubDays < 0 || req.ScrubDays > maxScheduleDays {
+			errs.HTTPResponse(w, errs.E(OpStorageChecks, errs.KindInvalid, "days must be between 0 and 365"))
+			return
+		}
+		if m.Checker != nil {
+			if err := m.Checker.SetSchedule(req.CheckDays, req.ScrubDays); err != nil {
+				errs.HTTPResponse(w, errs.E(OpStorageChecks, errs.KindIO, err))
+				return
+			}
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	st, err := m.Checks()
+	if err != nil {
+		errs.HTTPResponse(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(st)
+}
+
+// handleRepair has the next start repair the filesystem (POST), or calls
+// that off (DELETE). It cannot be repaired while mounted.
+func (m *Manager) handleRepair(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if m.Checker == nil {
+		errs.HTTPResponse(w, errs.E(OpStorageChecks, errs.KindNotFound, "filesystem checks are not set up"))
+		return
+	}
+	if err := m.Checker.RequestRepair(r.Method == http.MethodPost); err != nil {
+		errs.HTTPResponse(w, errs.E(OpStorageChecks, errs.KindIO, err))
+		return
+	}
+	if r.Method == http.MethodDelete {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	log.Printf("[STORAGE] Filesystem repair scheduled for the next start")
+	st, err := m.Checks()
+	if err != nil {
+		errs.HTTPResponse(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(st)
+}
+
+func (m *Manager) handleScrub(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	res, err := m.Scrub()
+	if err != nil {
+		errs.HTTPResponse(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(res)
+}
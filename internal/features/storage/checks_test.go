@@ -0,0 +1,107 @@
+package storage
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/strct-org/strct-agent/internal/platform/disk"
+)
+
+func TestChecks(t *testing.T) {
+	root := t.TempDir()
+	os.MkdirAll(filepath.Join(root, "dev/md"), 0755)
+	os.MkdirAll(filepath.Join(root, "sys/block/md127/md"), 0755)
+	os.Symlink("../md127", filepath.Join(root, "dev/md/strct"))
+	os.WriteFile(filepath.Join(root, "sys/block/md127/md/mismatch_cnt"), []byte("0\n"), 0644)
+
+	rows := []string{
+		"       0       8        0        0      active sync   /dev/sda",
+		"       1       8       16        1      active sync   /dev/sdb",
+	}
+	detail := mdadmDetail("clean", rows...)
+	var scrubs int
+	a := &disk.Array{Device: disk.ArrayDevice, Sys: disk.Sysfs{Root: root}, Run: func(name string, args ...string) ([]byte, error) {
+		if args[0] == "--action=check" {
+			scrubs++
+			return nil, nil
+		}
+		return detail, nil
+	}}
+	m := New(a, nil)
+	m.Checker = disk.NewChecker(t.TempDir())
+
+	// Nothing was ever scrubbed, so one is due
+	m.Maintain()
+	if scrubs != 1 {
+		t.Fatalf("%d scrubs started", scrubs)
+	}
+	detail = []byte(strings.Replace(string(mdadmDetail("clean, checking", rows...)), "UUID", "Check Status : 35% complete\n              UUID", 1))
+	m.Maintain()
+	var st ChecksStatus
+	if code := call(t, m, "GET", "/api/disk/check", "", &st); code != http.StatusOK || st.Scrubbing == nil || *st.Scrubbing != 35 || scrubs != 1 {
+		t.Errorf("while scrubbing: %d %+v, %d scrubs", code, st, scrubs)
+	}
+	if code := call(t, m, "POST", "/api/disk/scrub", "", nil); code != http.StatusBadRequest {
+		t.Errorf("second scrub: %d", code)
+	}
+
+	// The kernel is done and found a sector that differs
+	detail = mdadmDetail("clean", rows...)
+	os.WriteFile(filepath.Join(root, "sys/block/md127/md/mismatch_cnt"), []byte("8\n"), 0644)
+	m.Maintain()
+	if r, _ := m.Checker.State().LastScrub(); r.Finished == nil || r.Mismatches != 8 || scrubs != 1 {
+		t.Errorf("finished scrub %+v, %d started", r, scrubs)
+	}
+	if w := m.Warnings(); len(w) != 1 || !strings.Contains(w[0], "8 sectors") {
+		t.Errorf("warnings %q", w)
+	}
+	// and the next is a month away
+	m.Maintain()
+	if scrubs != 1 {
+		t.Errorf("scrubbed again right away")
+	}
+	if code := call(t, m, "POST", "/api/disk/scrub", "", nil); code != http.StatusAccepted || scrubs != 2 {
+		t.Errorf("scrub on request: %d", code)
+	}
+
+	schedules := []struct {
+		body string
+		want int
+	}{
+		{`{`, http.StatusBadRequest},
+		{`{"checkDays":-1,"scrubDays":30}`, http.StatusBadRequest},
+		{`{"checkDays":7,"scrubDays":400}`, http.StatusBadRequest},
+		{`{"checkDays":7,"scrubDays":0}`, http.StatusOK},
+	}
+	for _, tt := range schedules {
+		if code := call(t, m, "PUT", "/api/disk/check", tt.body, nil); code != tt.want {
+			t.Errorf("PUT %s: %d, want %d", tt.body, code, tt.want)
+		}
+	}
+	if s := m.Checker.State(); s.CheckDays != 7 || s.ScrubDays != 0 {
+		t.Errorf("schedule %+v", s)
+	}
+
+	if code := call(t, m, "POST", "/api/disk/check/repair", "", &st); code != http.StatusAccepted || !st.Repair {
+		t.Errorf("repair: %d %+v", code, st)
+	}
+	if code := call(t, m, "DELETE", "/api/disk/check/repair", "", nil); code != http.StatusNoContent || m.Checker.State().Repair {
+		t.Errorf("repair called off: %d", code)
+	}
+
+	single := New(&disk.MockDisk{}, nil)
+	single.Checker = disk.NewChecker(t.TempDir())
+	single.Maintain()
+	if code := call(t, single, "POST", "/api/disk/scrub", "", nil); code != http.StatusBadRequest {
+		t.Errorf("scrub of a single drive: %d", code)
+	}
+	if r, ok := single.Checker.State().LastScrub(); ok {
+		t.Errorf("single drive scrubbed: %+v", r)
+	}
+	if code := call(t, New(nil, nil), "GET", "/api/disk/check", "", nil); code != http.StatusNotFound {
+		t.Errorf("no checker: %d", code)
+	}
+}
@@ -0,0 +1,128 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/errs"
+	"github.com/strct-org/strct-agent/internal/platform/disk"
+)
+
+const (
+	OpStorageEject   errs.Op = "storage.Manager.Eject"
+	OpStorageRemount errs.Op = "storage.Manager.Remount"
+)
+
+// EjectTimeout is how long an eject waits for transfers to finish.
+var EjectTimeout = 30 * time.Second
+
+// Ejector is what serves the files on the data drive. Eject stops it
+// using the drive and unmounts it; Remount mounts it and serves it again.
+type Ejector interface {
+	Eject(ctx context.Context) error
+	Remount() error
+	Ejected() bool
+}
+
+// MountStatus is what the eject and remount endpoints answer.
+type MountStatus struct {
+	Mounted bool `json:"mounted"`
+}
+
+// Eject unmounts the data drive once the transfers using it finish, and
+// stops the mirror or locks the encrypted container on it, so the drive
+// can be unplugged.
+func (m *Manager) Eject() error {
+	m.mu.Lock()
+	switch {
+	case m.Disk == nil || m.Ejector == nil:
+		m.mu.Unlock()
+		return errs.E(OpStorageEject, errs.KindNotFound, "there is no data drive")
+	case m.job.running():
+		m.mu.Unlock()
+		return errs.E(OpStorageEject, errs.KindInvalid, "a format is running")
+	}
+	m.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), EjectTimeout)
+	defer cancel()
+	if err := m.Ejector.Eject(ctx); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	// The filesystem is clean already; this only lets go of the drive
+	var err error
+	switch d := m.Disk.(type) {
+	case *disk.Array:
+		err = d.Stop()
+	default:
+		if d.IsEncrypted() && d.IsUnlocked() {
+			err = d.Lock()
+		}
+	}
+	if err != nil {
+		log.Printf("[STORAGE] Data drive unmounted but not released: %v", err)
+	}
+	log.Println("[STORAGE] Data drive ejected; it is safe to unplug")
+	return nil
+}
+
+// Remount puts storage back on the ejected data drive, unlocking it with
+// passphrase if it needs one.
+func (m *Manager) Remount(passphrase string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	switch {
+	case m.Disk == nil || m.Ejector == nil:
+		return errs.E(OpStorageRemount, errs.KindNotFound, "there is no data drive")
+	case !m.Ejector.Ejected():
+		return errs.E(OpStorageRemount, errs.KindInvalid, "the data drive is not ejected")
+	}
+	if m.Disk.IsEncrypted() && !m.Disk.IsUnlocked() {
+		if err := m.open(OpStorageRemount, passphrase); err != nil {
+			return err
+		}
+	}
+	return m.Ejector.Remount()
+}
+
+func (m *Manager) handleEject(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := m.Eject(); err != nil {
+		errs.HTTPResponse(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(MountStatus{Mounted: false})
+}
+
+// handleRemount takes an optional {passphrase} for an encrypted drive.
+func (m *Manager) handleRemount(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		Passphrase string `json:"passphrase"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4<<10)).Decode(&req); err != nil {
+			errs.HTTPResponse(w, errs.E(OpStorageAPI, errs.KindInvalid, "Invalid JSON"))
+			return
+		}
+	}
+	if err := m.Remount(req.Passphrase); err != nil {
+		errs.HTTPResponse(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(MountStatus{Mounted: true})
+}
@@ -0,0 +1,87 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/strct-org/strct-agent/internal/platform/disk"
+)
+
+type fakeEjector struct {
+	ejected bool
+	err     error
+}
+
+func (e *fakeEjector) Eject(ctx context.Context) error {
+	if e.err != nil {
+		return e.err
+	}
+	e.ejected = true
+	return nil
+}
+
+func (e *fakeEjector) Remount() error {
+	e.ejected = false
+	return nil
+}
+
+func (e *fakeEjector) Ejected() bool { return e.ejected }
+
+func TestEject(t *testing.T) {
+	wrongKeyDelay = 0
+	keys := &disk.KeyStore{Dir: t.TempDir(), MachineID: "machine-a"}
+	d := &disk.MockDisk{}
+	if err := keys.Format(d, "correct horse", ""); err != nil {
+		t.Fatal(err)
+	}
+	e := &fakeEjector{}
+	m := New(d, keys)
+
+	if code := call(t, m, "POST", "/api/disk/eject", "", nil); code != http.StatusNotFound {
+		t.Errorf("eject without anything serving the drive: %d", code)
+	}
+	m.Ejector = e
+
+	e.err = errors.New("busy")
+	if code := call(t, m, "POST", "/api/disk/eject", "", nil); code < 400 || !d.IsUnlocked() {
+		t.Errorf("failed eject: %d, unlocked %v", code, d.IsUnlocked())
+	}
+	e.err = nil
+
+	var st MountStatus
+	if code := call(t, m, "POST", "/api/disk/eject", "", &st); code != http.StatusOK || st.Mounted || !e.ejected {
+		t.Fatalf("eject: %d %+v", code, st)
+	}
+	if d.IsUnlocked() {
+		t.Error("the container was left open")
+	}
+
+	remounts := []struct {
+		name string
+		body string
+		want int
+	}{
+		{"bad json", `{`, http.StatusBadRequest},
+		{"no passphrase", ``, http.StatusUnauthorized},
+		{"wrong passphrase", `{"passphrase":"wrong horse"}`, http.StatusUnauthorized},
+		{"remount", `{"passphrase":"correct horse"}`, http.StatusOK},
+		{"not ejected", ``, http.StatusBadRequest},
+	}
+	for _, tt := range remounts {
+		t.Run(tt.name, func(t *testing.T) {
+			if code := call(t, m, "POST", "/api/disk/remount", tt.body, nil); code != tt.want {
+				t.Errorf("status %d, want %d", code, tt.want)
+			}
+		})
+	}
+	if e.ejected || !d.IsUnlocked() {
+		t.Errorf("after remount: ejected %v, unlocked %v", e.ejected, d.IsUnlocked())
+	}
+
+	m.job = &FormatJob{Device: "/dev/sdb"}
+	if code := call(t, m, "POST", "/api/disk/eject", "", nil); code != http.StatusBadRequest || e.ejected {
+		t.Errorf("eject during a format: %d", code)
+	}
+}
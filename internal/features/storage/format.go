@@ -0,0 +1,465 @@
+package storage
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/errs"
+	"github.com/strct-org/strct-agent/internal/platform/disk"
+)
+
+const (
+	OpStorageDrives errs.Op = "storage.Manager.Drives"
+	OpStorageFormat errs.Op = "storage.Manager.Format"
+)
+
+// confirmTTL is how long a format confirmation can be used.
+const confirmTTL = 2 * time.Minute
+
+// defaultFormatDelay is how long a confirmed format waits before it
+// touches the drive, unless Manager.FormatDelay says otherwise. Until then
+// it can be cancelled.
+const defaultFormatDelay = 10 * time.Second
+
+// Format stages, in order. A job ends in done, failed or cancelled.
+const (
+	StageWaiting   = "waiting"
+	StagePartition = "partition"
+	StageEncrypt   = "encrypt"
+	StageMirror    = "mirror"
+	StageMkfs      = "mkfs"
+	StageMount     = "mount"
+	StageDone      = "done"
+	StageFailed    = "failed"
+	StageCancelled = "cancelled"
+)
+
+// Switcher moves storage onto a drive once it is formatted and mounted, or
+// offers to move the files on the SD card there first.
+type Switcher interface {
+	UseDrive(d disk.Manager, mountPoint string) error
+}
+
+// DriveInfo is a detected drive and whether it can become the data drive.
+type DriveInfo struct {
+	disk.Drive
+	InUse     bool   `json:"inUse"`
+	CanFormat bool   `json:"canFormat"`
+	Reason    string `json:"reason,omitempty"` // why it cannot be formatted
+}
+
+// Confirmation is the first half of a format. Sending the token back
+// within its lifetime starts the job.
+type Confirmation struct {
+	Token   string      `json:"token"`
+	Drive   disk.Drive  `json:"drive"`
+	Mirror  *disk.Drive `json:"mirror,omitempty"` // the second drive of a mirror
+	Expires time.Time   `json:"expires"`
+}
+
+type FormatJob struct {
+	Device   string     `json:"device"`
+	Mirror   string     `json:"mirror,omitempty"`
+	Encrypt  bool       `json:"encrypt"`
+	Stage    string     `json:"stage"`
+	Error    string     `json:"error,omitempty"`
+	Started  time.Time  `json:"started"`
+	Finished *time.Time `json:"finished,omitempty"`
+	// RecoveryKey opens an encrypted drive without this device. It is
+	// only in the response that starts the format and is never kept.
+	RecoveryKey string `json:"recoveryKey,omitempty"`
+}
+
+func (j *FormatJob) running() bool {
+	return j != nil && j.Finished == nil
+}
+
+// confirmation binds a token to the drives the user saw, so a swapped
+// drive at the same device path is not formatted by mistake.
+type confirmation struct {
+	drives  []disk.Drive
+	expires time.Time
+}
+
+// Drives lists the detected drives.
+func (m *Manager) Drives() ([]DriveInfo, error) {
+	drives, err := m.List()
+	if err != nil {
+		return nil, errs.E(OpStorageDrives, errs.KindSystem, err, "could not list drives")
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	infos := make([]DriveInfo, 0, len(drives))
+	for _, d := range drives {
+		info := DriveInfo{Drive: d, InUse: d.Mounted()}
+		info.Reason = m.refuse(d)
+		info.CanFormat = info.Reason == ""
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// refuse says why d must not be formatted, or "" if it may be. It must be
+// called with mu held.
+func (m *Manager) refuse(d disk.Drive) string {
+	switch {
+	case d.System:
+		return "it holds the system"
+	case d.Removable:
+		return "removable media is imported from, not stored on"
+	case d.Mounted():
+		return "it is in use"
+	case m.Disk != nil:
+		return "storage already lives on a data drive"
+	}
+	return ""
+}
+
+// find returns the drive at device as it is now.
+func (m *Manager) find(device string) (disk.Drive, error) {
+	drives, err := m.List()
+	if err != nil {
+		return disk.Drive{}, errs.E(OpStorageFormat, errs.KindSystem, err, "could not list drives")
+	}
+	for _, d := range drives {
+		if d.Device == device {
+			return d, nil
+		}
+	}
+	return disk.Drive{}, errs.E(OpStorageFormat, errs.KindNotFound, "no such drive")
+}
+
+// Confirm checks that device, and mirror if it is to be paired with it,
+// can be formatted and issues the token that starts it.
+func (m *Manager) Confirm(device, mirror string) (Confirmation, error) {
+	drives, err := m.findAll(device, mirror)
+	if err != nil {
+		return Confirmation{}, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, d := range drives {
+		if reason := m.refuse(d); reason != "" {
+			return Confirmation{}, errs.E(OpStorageFormat, errs.KindInvalid, "cannot format "+d.Device+": "+reason)
+		}
+	}
+	c := Confirmation{Drive: drives[0], Expires: time.Now().Add(confirmTTL)}
+	if len(drives) > 1 {
+		c.Mirror = &drives[1]
+	}
+	c.Token = m.issue(drives, c.Expires)
+	return c, nil
+}
+
+// findAll returns the drives at the given devices; "" is skipped.
+func (m *Manager) findAll(devices ...string) ([]disk.Drive, error) {
+	if len(devices) > 1 && devices[0] == devices[1] {
+		return nil, errs.E(OpStorageFormat, errs.KindInvalid, "a mirror needs two different drives")
+	}
+	var drives []disk.Drive
+	for _, device := range devices {
+		if device == "" {
+			continue
+		}
+		d, err := m.find(device)
+		if err != nil {
+			return nil, err
+		}
+		drives = append(drives, d)
+	}
+	return drives, nil
+}
+
+// issue makes a token for drives. It must be called with mu held.
+func (m *Manager) issue(drives []disk.Drive, expires time.Time) string {
+	now := time.Now()
+	for t, c := range m.confirms {
+		if now.After(c.expires) {
+			delete(m.confirms, t)
+		}
+	}
+	token := randomHex(16)
+	m.confirms[token] = confirmation{drives: drives, expires: expires}
+	return token
+}
+
+// redeem uses up token, checking it was issued for drives as they are
+// now. It must be called with mu held.
+func (m *Manager) redeem(op errs.Op, token string, drives []disk.Drive) error {
+	c, ok := m.confirms[token]
+	delete(m.confirms, token)
+	if !ok || len(c.drives) != len(drives) || time.Now().After(c.expires) {
+		return errs.E(op, errs.KindForbidden, "confirmation is missing or expired")
+	}
+	for i, d := range drives {
+		if c.drives[i].Device != d.Device {
+			return errs.E(op, errs.KindForbidden, "confirmation is missing or expired")
+		}
+		if c.drives[i].Serial != d.Serial || c.drives[i].Size != d.Size {
+			return errs.E(op, errs.KindInvalid, "the drive changed since the format was confirmed")
+		}
+	}
+	return nil
+}
+
+// resolve finds the confirmed drives as they are now, by serial and size
+// wherever they are attached, and checks they may still be formatted. A
+// drive without a serial must still be at the same device path. It must
+// be called with mu held.
+func (m *Manager) resolve(confirmed []disk.Drive) ([]disk.Drive, error) {
+	list, err := m.List()
+	if err != nil {
+		return nil, errs.E(OpStorageFormat, errs.KindSystem, err, "could not list drives")
+	}
+	drives := make([]disk.Drive, 0, len(confirmed))
+	for _, c := range confirmed {
+		i := slices.IndexFunc(list, func(d disk.Drive) bool {
+			if d.Size != c.Size {
+				return false
+			}
+			if c.Serial != "" {
+				return d.Serial == c.Serial
+			}
+			return d.Serial == "" && d.Device == c.Device
+		})
+		if i < 0 {
+			return nil, errs.E(OpStorageFormat, errs.KindNotFound, c.Device+" was removed or replaced before the format started")
+		}
+		if reason := m.refuse(list[i]); reason != "" {
+			return nil, errs.E(OpStorageFormat, errs.KindInvalid, "cannot format "+list[i].Device+": "+reason)
+		}
+		drives = append(drives, list[i])
+	}
+	return drives, nil
+}
+
+// Format starts erasing device, or device and mirror to build a mirror
+// from them, in the background. The token is used up whether or not the
+// format starts.
+func (m *Manager) Format(device, mirror, token string, encrypt bool, passphrase string) (FormatJob, error) {
+	if !encrypt && passphrase != "" {
+		return FormatJob{}, errs.E(OpStorageFormat, errs.KindInvalid, "a passphrase needs encryption")
+	}
+	if passphrase != "" && len(passphrase) < minPassphrase {
+		return FormatJob{}, errs.E(OpStorageFormat, errs.KindInvalid, "passphrase must be at least 8 characters")
+	}
+	if encrypt && mirror != "" {
+		return FormatJob{}, errs.E(OpStorageFormat, errs.KindInvalid, "a mirror cannot be encrypted yet")
+	}
+	drives, err := m.findAll(device, mirror)
+	if err != nil {
+		return FormatJob{}, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.redeem(OpStorageFormat, token, drives); err != nil {
+		return FormatJob{}, err
+	}
+	if m.job.running() {
+		return FormatJob{}, errs.E(OpStorageFormat, errs.KindInvalid, "a format is already running")
+	}
+	for _, d := range drives {
+		if reason := m.refuse(d); reason != "" {
+			return FormatJob{}, errs.E(OpStorageFormat, errs.KindInvalid, "cannot format "+d.Device+": "+reason)
+		}
+	}
+
+	var recovery string
+	if encrypt {
+		if recovery, err = disk.NewRecoveryKey(); err != nil {
+			return FormatJob{}, errs.E(OpStorageFormat, errs.KindSystem, err, "could not create a recovery key")
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	m.job = &FormatJob{Device: device, Mirror: mirror, Encrypt: encrypt, Stage: StageWaiting, Started: time.Now()}
+	m.cancelFormat = cancel
+	if mirror != "" {
+		log.Printf("[STORAGE] Building a mirror of %s and %s in %s", device, mirror, m.FormatDelay)
+	} else {
+		log.Printf("[STORAGE] Formatting %s in %s (encrypted: %v)", device, m.FormatDelay, encrypt)
+	}
+	go m.runFormat(ctx, m.job, drives, m.FormatDelay, passphrase, recovery)
+	job := *m.job
+	job.RecoveryKey = recovery
+	return job, nil
+}
+
+// CancelFormat stops a format that has not touched the drive yet.
+func (m *Manager) CancelFormat() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.job.running() {
+		return errs.E(OpStorageFormat, errs.KindNotFound, "no format is running")
+	}
+	if m.job.Stage != StageWaiting {
+		return errs.E(OpStorageFormat, errs.KindInvalid, "the drive is already being erased")
+	}
+	m.cancelFormat()
+	m.finish(m.job, StageCancelled, nil)
+	log.Printf("[STORAGE] Format of %s cancelled", m.job.Device)
+	return nil
+}
+
+// FormatStatus returns the last format job, if there was one.
+func (m *Manager) FormatStatus() (FormatJob, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.job == nil {
+		return FormatJob{}, false
+	}
+	return *m.job, true
+}
+
+func (m *Manager) runFormat(ctx context.Context, job *FormatJob, confirmed []disk.Drive, delay time.Duration, passphrase, recovery string) {
+	select {
+	case <-time.After(delay):
+	case <-ctx.Done():
+		return
+	}
+	// Past this point there is no going back, so the drives are looked at
+	// once more: anything could have been plugged, mounted or swapped
+	// during the delay
+	m.mu.Lock()
+	if ctx.Err() != nil {
+		m.mu.Unlock()
+		return
+	}
+	drives, err := m.resolve(confirmed)
+	if err != nil {
+		log.Printf("[STORAGE] Format of %s stopped: %v", job.Device, err)
+		m.finish(job, StageFailed, err)
+		m.mu.Unlock()
+		return
+	}
+	job.Device = drives[0].Device
+	if len(drives) > 1 {
+		job.Mirror = drives[1].Device
+	}
+	job.Stage = StagePartition
+	m.mu.Unlock()
+
+	stage := func(name string) {
+		m.mu.Lock()
+		job.Stage = name
+		m.mu.Unlock()
+	}
+	var d disk.Manager
+	if job.Mirror != "" {
+		d = m.OpenMirror([]string{job.Device, job.Mirror}, stage)
+	} else {
+		d = m.Open(job.Device, stage)
+	}
+
+	if job.Encrypt {
+		err = m.Keys.Format(d, passphrase, recovery)
+	} else {
+		err = d.Format()
+	}
+	if err == nil {
+		stage(StageMount)
+		err = d.EnsureMounted(m.MountPoint)
+	}
+	if err == nil && m.Switcher != nil {
+		err = m.Switcher.UseDrive(d, m.MountPoint)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err != nil {
+		log.Printf("[STORAGE] Format of %s failed during %s: %v", job.Device, job.Stage, err)
+		m.finish(job, StageFailed, err)
+		return
+	}
+	m.Disk = d
+	m.finish(job, StageDone, nil)
+	log.Printf("[STORAGE] %s formatted; storage now lives on it", job.Device)
+}
+
+// finish must be called with mu held.
+func (m *Manager) finish(job *FormatJob, stage string, err error) {
+	now := time.Now()
+	job.Stage, job.Finished = stage, &now
+	if err != nil {
+		job.Error = err.Error()
+	}
+}
+
+func (m *Manager) handleDrives(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	drives, err := m.Drives()
+	if err != nil {
+		errs.HTTPResponse(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]DriveInfo{"drives": drives})
+}
+
+// handleFormat runs the two-step format. POST with only a device returns a
+// confirmation; POST again with its token starts the job.
+func (m *Manager) handleFormat(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		job, ok := m.FormatStatus()
+		if !ok {
+			errs.HTTPResponse(w, errs.E(OpStorageAPI, errs.KindNotFound, "no drive has been formatted"))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(job)
+	case http.MethodPost:
+		var req struct {
+			Device     string `json:"device"`
+			Mirror     string `json:"mirror"`
+			Token      string `json:"token"`
+			Encrypt    bool   `json:"encrypt"`
+			Passphrase string `json:"passphrase"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4<<10)).Decode(&req); err != nil || req.Device == "" {
+			errs.HTTPResponse(w, errs.E(OpStorageAPI, errs.KindInvalid, "Invalid JSON"))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if req.Token == "" {
+			c, err := m.Confirm(req.Device, req.Mirror)
+			if err != nil {
+				errs.HTTPResponse(w, err)
+				return
+			}
+			json.NewEncoder(w).Encode(c)
+			return
+		}
+		job, err := m.Format(req.Device, req.Mirror, req.Token, req.Encrypt, req.Passphrase)
+		if err != nil {
+			errs.HTTPResponse(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(job)
+	case http.MethodDelete:
+		if err := m.CancelFormat(); err != nil {
+			errs.HTTPResponse(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,264 @@
+package storage
+
+import (
+	"errors"
+	"net/http"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/platform/disk"
+)
+
+// fastDisk is a MockDisk without the simulated delays.
+type fastDisk struct {
+	*disk.MockDisk
+	mounted string
+}
+
+func (d *fastDisk) Format() error {
+	d.Progress("partition")
+	d.Progress("mkfs")
+	d.IsFormatted = true
+	return nil
+}
+
+func (d *fastDisk) EnsureMounted(mountPoint string) error {
+	if !d.IsUnlocked() {
+		return disk.ErrLocked
+	}
+	d.mounted = mountPoint
+	return nil
+}
+
+type fakeSwitcher struct {
+	err        error
+	d          disk.Manager
+	mountPoint string
+}
+
+func (s *fakeSwitcher) UseDrive(d disk.Manager, mountPoint string) error {
+	if s.err != nil {
+		return s.err
+	}
+	s.d, s.mountPoint = d, mountPoint
+	return nil
+}
+
+func TestFormat(t *testing.T) {
+	drives := []disk.Drive{
+		{Device: "/dev/mmcblk0", System: true, Partitions: []disk.Partition{{Device: "/dev/mmcblk0p2", Mountpoint: "/"}}},
+		{Device: "/dev/sdb", Removable: true, Transport: "usb"},
+		{Device: "/dev/sda", Serial: "USB1", Partitions: []disk.Partition{{Device: "/dev/sda1", FSType: "ext4", Mountpoint: "/media/old"}}},
+		{Device: "/dev/nvme0n1", Serial: "NVME1", Size: 500 << 30, Partitions: []disk.Partition{{Device: "/dev/nvme0n1p1", FSType: "ntfs"}}},
+	}
+	var listMu sync.Mutex
+	list := func() ([]disk.Drive, error) {
+		listMu.Lock()
+		defer listMu.Unlock()
+		return append([]disk.Drive(nil), drives...), nil
+	}
+
+	var stages []string
+	var opened *fastDisk
+	m := New(nil, &disk.KeyStore{Dir: t.TempDir(), MachineID: "machine-a"})
+	m.List = list
+	m.MountPoint = "/mnt/test"
+	m.Open = func(device string, progress func(string)) disk.Manager {
+		opened = &fastDisk{MockDisk: &disk.MockDisk{VirtualPath: device}}
+		opened.Progress = func(s string) {
+			stages = append(stages, s)
+			progress(s)
+		}
+		return opened
+	}
+	sw := &fakeSwitcher{}
+	m.Switcher = sw
+
+	var listed struct{ Drives []DriveInfo }
+	call(t, m, "GET", "/api/disk/drives", "", &listed)
+	can := map[string]bool{}
+	for _, d := range listed.Drives {
+		can[d.Device] = d.CanFormat
+		if !d.CanFormat && d.Reason == "" {
+			t.Errorf("%s refused without a reason", d.Device)
+		}
+	}
+	if want := map[string]bool{"/dev/mmcblk0": false, "/dev/sdb": false, "/dev/sda": false, "/dev/nvme0n1": true}; !reflect.DeepEqual(can, want) {
+		t.Errorf("can format %v, want %v", can, want)
+	}
+
+	confirm := func(device string) (string, int) {
+		var c Confirmation
+		code := call(t, m, "POST", "/api/disk/format", `{"device":"`+device+`"}`, &c)
+		return c.Token, code
+	}
+	job := func() FormatJob {
+		var j FormatJob
+		call(t, m, "GET", "/api/disk/format", "", &j)
+		return j
+	}
+	wait := func() FormatJob {
+		for range 200 {
+			if j := job(); j.Finished != nil {
+				return j
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatal("format never finished")
+		return FormatJob{}
+	}
+
+	for _, dev := range []string{"/dev/mmcblk0", "/dev/sdb", "/dev/sda", "/dev/nope"} {
+		if _, code := confirm(dev); code < 400 {
+			t.Errorf("confirmed %s: %d", dev, code)
+		}
+	}
+	if code := call(t, m, "GET", "/api/disk/format", "", nil); code != http.StatusNotFound {
+		t.Errorf("job before any format: %d", code)
+	}
+
+	t.Run("tokens", func(t *testing.T) {
+		token, code := confirm("/dev/nvme0n1")
+		if code != http.StatusOK || token == "" {
+			t.Fatalf("confirm: %d", code)
+		}
+		if code := call(t, m, "POST", "/api/disk/format", `{"device":"/dev/nvme0n1","token":"guess"}`, nil); code != http.StatusForbidden {
+			t.Errorf("made-up token: %d", code)
+		}
+		if code := call(t, m, "POST", "/api/disk/format", `{"device":"/dev/sda","token":"`+token+`"}`, nil); code != http.StatusForbidden {
+			t.Errorf("token for another drive: %d", code)
+		}
+		// That used the token up
+		if code := call(t, m, "POST", "/api/disk/format", `{"device":"/dev/nvme0n1","token":"`+token+`"}`, nil); code != http.StatusForbidden {
+			t.Errorf("token used twice: %d", code)
+		}
+
+		token, _ = confirm("/dev/nvme0n1")
+		listMu.Lock()
+		drives[3].Serial = "SWAPPED"
+		listMu.Unlock()
+		if code := call(t, m, "POST", "/api/disk/format", `{"device":"/dev/nvme0n1","token":"`+token+`"}`, nil); code != http.StatusBadRequest {
+			t.Errorf("drive swapped after confirming: %d", code)
+		}
+		token, _ = confirm("/dev/nvme0n1")
+		if code := call(t, m, "POST", "/api/disk/format", `{"device":"/dev/nvme0n1","token":"`+token+`","passphrase":"correct horse"}`, nil); code != http.StatusBadRequest {
+			t.Errorf("passphrase without encryption: %d", code)
+		}
+	})
+
+	t.Run("cancel", func(t *testing.T) {
+		m.FormatDelay = time.Hour
+		token, _ := confirm("/dev/nvme0n1")
+		var j FormatJob
+		if code := call(t, m, "POST", "/api/disk/format", `{"device":"/dev/nvme0n1","token":"`+token+`"}`, &j); code != http.StatusAccepted || j.Stage != StageWaiting {
+			t.Fatalf("start: %d %+v", code, j)
+		}
+		token, _ = confirm("/dev/nvme0n1")
+		if code := call(t, m, "POST", "/api/disk/format", `{"device":"/dev/nvme0n1","token":"`+token+`"}`, nil); code != http.StatusBadRequest {
+			t.Errorf("second format while one runs: %d", code)
+		}
+		if code := call(t, m, "DELETE", "/api/disk/format", "", nil); code != http.StatusNoContent {
+			t.Fatalf("cancel: %d", code)
+		}
+		if j := job(); j.Stage != StageCancelled || opened != nil {
+			t.Errorf("after cancel: %+v, drive opened: %v", j, opened != nil)
+		}
+		if code := call(t, m, "DELETE", "/api/disk/format", "", nil); code != http.StatusNotFound {
+			t.Errorf("cancel twice: %d", code)
+		}
+	})
+
+	t.Run("changed during the delay", func(t *testing.T) {
+		m.FormatDelay = 50 * time.Millisecond
+		changes := map[string]func(d *disk.Drive){
+			"mounted": func(d *disk.Drive) {
+				d.Partitions = []disk.Partition{{Device: "/dev/nvme0n1p1", Mountpoint: "/media/x"}}
+			},
+			"swapped": func(d *disk.Drive) { d.Serial = "OTHER" },
+			"removed": func(d *disk.Drive) { d.Device = "/dev/sdz"; d.Serial = "GONE" },
+		}
+		for name, change := range changes {
+			listMu.Lock()
+			saved := drives[3]
+			listMu.Unlock()
+			token, _ := confirm("/dev/nvme0n1")
+			if code := call(t, m, "POST", "/api/disk/format", `{"device":"/dev/nvme0n1","token":"`+token+`"}`, nil); code != http.StatusAccepted {
+				t.Fatalf("%s: start: %d", name, code)
+			}
+			listMu.Lock()
+			change(&drives[3])
+			listMu.Unlock()
+			if j := wait(); j.Stage != StageFailed || j.Error == "" || opened != nil {
+				t.Errorf("%s: job %+v, drive opened: %v", name, j, opened != nil)
+			}
+			listMu.Lock()
+			drives[3] = saved
+			listMu.Unlock()
+		}
+
+		// A drive that moved to another device path is followed there
+		token, _ := confirm("/dev/nvme0n1")
+		call(t, m, "POST", "/api/disk/format", `{"device":"/dev/nvme0n1","token":"`+token+`"}`, nil)
+		listMu.Lock()
+		drives[3].Device = "/dev/nvme1n1"
+		listMu.Unlock()
+		if j := wait(); j.Stage != StageDone || j.Device != "/dev/nvme1n1" || opened == nil || opened.VirtualPath != "/dev/nvme1n1" {
+			t.Errorf("moved drive: job %+v", j)
+		}
+		listMu.Lock()
+		drives[3].Device = "/dev/nvme0n1"
+		listMu.Unlock()
+		m.Disk, opened = nil, nil
+	})
+
+	m.FormatDelay = 0
+
+	t.Run("switch fails", func(t *testing.T) {
+		sw.err = errors.New("bind failed")
+		token, _ := confirm("/dev/nvme0n1")
+		call(t, m, "POST", "/api/disk/format", `{"device":"/dev/nvme0n1","token":"`+token+`"}`, nil)
+		if j := wait(); j.Stage != StageFailed || j.Error == "" {
+			t.Errorf("job: %+v", j)
+		}
+		if m.Status().Drive {
+			t.Error("storage moved to a drive it could not use")
+		}
+		sw.err = nil
+	})
+
+	t.Run("encrypted", func(t *testing.T) {
+		stages = nil
+		token, _ := confirm("/dev/nvme0n1")
+		body := `{"device":"/dev/nvme0n1","token":"` + token + `","encrypt":true,"passphrase":"correct horse"}`
+		var started FormatJob
+		if code := call(t, m, "POST", "/api/disk/format", body, &started); code != http.StatusAccepted {
+			t.Fatalf("start: %d", code)
+		}
+		if started.RecoveryKey == "" {
+			t.Error("no recovery key when the format started")
+		}
+		if j := wait(); j.Stage != StageDone || !j.Encrypt || j.RecoveryKey != "" {
+			t.Fatalf("job: %+v", j)
+		}
+		if want := []string{"partition", "encrypt", "mkfs"}; !reflect.DeepEqual(stages, want) {
+			t.Errorf("stages %v, want %v", stages, want)
+		}
+		if opened.mounted != "/mnt/test" || sw.d != opened || sw.mountPoint != "/mnt/test" {
+			t.Errorf("mounted at %q, switched to %v at %q", opened.mounted, sw.d, sw.mountPoint)
+		}
+		if st := m.Status(); !st.Drive || !st.Encrypted || !st.Passphrase {
+			t.Errorf("status: %+v", st)
+		}
+		// The recovery key opens the drive without the passphrase
+		opened.Lock()
+		if err := m.Recover(started.RecoveryKey); err != nil || !opened.Unlocked {
+			t.Errorf("recover: %v", err)
+		}
+		// Storage is on a drive now; another one is not formatted
+		if _, code := confirm("/dev/nvme0n1"); code != http.StatusBadRequest {
+			t.Errorf("confirm with a data drive in use: %d", code)
+		}
+	})
+}
@@ -0,0 +1,386 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/errs"
+	"github.com/strct-org/strct-agent/internal/fsx"
+	"github.com/strct-org/strct-agent/internal/platform/disk"
+)
+
+const (
+	OpHealthSelfTest errs.Op = "storage.HealthMonitor.SelfTest"
+	OpHealthSave     errs.Op = "storage.HealthMonitor.save"
+)
+
+const (
+	// historyAge is how long readings are kept per drive.
+	historyAge = 30 * 24 * time.Hour
+	// trendWindow is how far back a growing error count is noticed.
+	trendWindow = 7 * 24 * time.Hour
+)
+
+// Sample is one reading of the counters that show a drive wearing out.
+type Sample struct {
+	Time          time.Time `json:"time"`
+	Temperature   int       `json:"temperature,omitempty"`
+	WearUsed      *int      `json:"wearUsed,omitempty"`
+	Reallocated   uint64    `json:"reallocated,omitempty"`
+	Pending       uint64    `json:"pending,omitempty"`
+	Uncorrectable uint64    `json:"uncorrectable,omitempty"`
+	CRCErrors     uint64    `json:"crcErrors,omitempty"`
+	MediaErrors   uint64    `json:"mediaErrors,omitempty"`
+}
+
+// DriveHealth is the latest SMART reading of a drive and what it means.
+type DriveHealth struct {
+	disk.Health
+	Transport string    `json:"transport,omitempty"`
+	Checked   time.Time `json:"checked"`
+	Standby   bool      `json:"standby,omitempty"` // asleep at the last check, so the reading is older
+	Warnings  []string  `json:"warnings,omitempty"`
+	History   []Sample  `json:"history,omitempty"`
+}
+
+// HealthReport is sent to the backend after every round of checks.
+type HealthReport struct {
+	Timestamp time.Time     `json:"timestamp"`
+	Drives    []DriveHealth `json:"drives"`
+}
+
+// HealthMonitor reads the SMART data of every drive each Tick and keeps
+// its history, so a drive that is slowly failing is noticed in time.
+// Spun-down disks are not woken for it.
+type HealthMonitor struct {
+	Path   string
+	Tick   time.Duration
+	Events <-chan disk.Event // a drive plugged in is checked right away
+
+	List     func() ([]disk.Drive, error)
+	Read     func(device string) (disk.Health, error)
+	SelfTest func(device, kind string) error
+	Report   func(HealthReport) // sends a round to the backend; may be nil
+
+	mu       sync.Mutex
+	Drives   map[string]*DriveHealth // by serial number
+	attached map[string]string       // device -> serial, as of the last round
+}
+
+func NewHealthMonitor(path string) (*HealthMonitor, error) {
+	m := &HealthMonitor{
+		Path:     path,
+		Tick:     time.Hour,
+		List:     disk.ListDrives,
+		Read:     disk.ReadHealth,
+		SelfTest: disk.StartSelfTest,
+		Drives:   make(map[string]*DriveHealth),
+		attached: make(map[string]string),
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &m.Drives); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return m, nil
+}
+
+func (m *HealthMonitor) Start() error {
+	go func() {
+		t := time.NewTicker(m.Tick)
+		defer t.Stop()
+		for {
+			m.Check()
+			m.wait(t.C)
+		}
+	}()
+	return nil
+}
+
+func (m *HealthMonitor) wait(tick <-chan time.Time) {
+	for {
+		select {
+		case <-tick:
+			return
+		case e := <-m.Events:
+			if e.Action == "add" && e.Type == "disk" {
+				return
+			}
+		}
+	}
+}
+
+type reading struct {
+	drive disk.Drive
+	h     disk.Health
+	err   error
+}
+
+// Check reads every drive once and records what it says.
+func (m *HealthMonitor) Check() {
+	drives, err := m.List()
+	if err != nil {
+		log.Printf("[DISK] %v", err)
+		return
+	}
+	// smartctl can take a while per drive, so read before locking
+	var readings []reading
+	for _, d := range drives {
+		if d.Transport == "mmc" {
+			continue // SD cards and eMMC have no SMART
+		}
+		h, err := m.Read(d.Device)
+		readings = append(readings, reading{d, h, err})
+	}
+
+	now := time.Now()
+	m.mu.Lock()
+	m.attached = make(map[string]string)
+	for _, r := range readings {
+		m.record(r, now)
+	}
+	if err := m.save(); err != nil {
+		log.Printf("[DISK] %v", err)
+	}
+	report := HealthReport{Timestamp: now, Drives: m.status()}
+	m.mu.Unlock()
+
+	if m.Report != nil && len(report.Drives) > 0 {
+		go m.Report(report)
+	}
+}
+
+// record must be called with mu held.
+func (m *HealthMonitor) record(r reading, now time.Time) {
+	if errors.Is(r.err, disk.ErrStandby) {
+		// Asleep, so it is whichever drive was last read at this device
+		var last *DriveHealth
+		for serial, dh := range m.Drives {
+			if dh.Device == r.drive.Device && (last == nil || dh.Checked.After(last.Checked)) {
+				last = dh
+				m.attached[r.drive.Device] = serial
+			}
+		}
+		if last != nil {
+			last.Standby = true
+		}
+		return
+	}
+	if r.err != nil {
+		log.Printf("[DISK] No SMART data from %s: %v", r.drive.Device, r.err)
+		return
+	}
+	serial := r.h.Serial
+	if serial == "" {
+		serial = r.drive.Serial
+	}
+	if serial == "" {
+		serial = r.drive.Device
+	}
+	dh := m.Drives[serial]
+	if dh == nil {
+		dh = &DriveHealth{}
+		m.Drives[serial] = dh
+	}
+	before := dh.Warnings
+	dh.Health, dh.Transport, dh.Checked, dh.Standby = r.h, r.drive.Transport, now, false
+	m.attached[r.drive.Device] = serial
+
+	if r.h.Supported {
+		dh.History = append(dh.History, Sample{
+			Time:          now,
+			Temperature:   r.h.Temperature,
+			WearUsed:      r.h.WearUsed,
+			Reallocated:   r.h.Reallocated,
+			Pending:       r.h.Pending,
+			Uncorrectable: r.h.Uncorrectable,
+			CRCErrors:     r.h.CRCErrors,
+			MediaErrors:   r.h.MediaErrors,
+		})
+		for len(dh.History) > 0 && now.Sub(dh.History[0].Time) > historyAge {
+			dh.History = dh.History[1:]
+		}
+	}
+	dh.Warnings = append(r.h.Warnings(), trends(dh.History, now)...)
+	if len(dh.Warnings) > len(before) {
+		log.Printf("[DISK] %s (%s) needs attention: %v", dh.Device, dh.Model, dh.Warnings)
+	}
+}
+
+// trends warns about counters that grew over the last week. Reallocation
+// that keeps going means a drive is failing; link errors that keep coming
+// point at the cable or the enclosure instead.
+func trends(history []Sample, now time.Time) []string {
+	if len(history) < 2 {
+		return nil
+	}
+	first, last := history[len(history)-1], history[len(history)-1]
+	for _, s := range history {
+		if now.Sub(s.Time) <= trendWindow {
+			first = s
+			break
+		}
+	}
+	var w []string
+	if n := last.Reallocated - first.Reallocated; last.Reallocated > first.Reallocated {
+		w = append(w, fmt.Sprintf("%d more sectors reallocated in the last week", n))
+	}
+	if n := last.CRCErrors - first.CRCErrors; last.CRCErrors > first.CRCErrors {
+		w = append(w, fmt.Sprintf("%d link errors in the last week; check the cable or enclosure", n))
+	}
+	return w
+}
+
+// Status returns the health of the attached drives, without history.
+func (m *HealthMonitor) Status() []DriveHealth {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.status()
+}
+
+// status must be called with mu held.
+func (m *HealthMonitor) status() []DriveHealth {
+	list := make([]DriveHealth, 0, len(m.attached))
+	for _, serial := range m.attached {
+		dh := *m.Drives[serial]
+		dh.History = nil
+		list = append(list, dh)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Device < list[j].Device })
+	return list
+}
+
+// Drive returns the health of the attached drive at device, with history.
+func (m *HealthMonitor) Drive(device string) (DriveHealth, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	serial, ok := m.attached[device]
+	if !ok {
+		return DriveHealth{}, false
+	}
+	dh := *m.Drives[serial]
+	dh.History = append([]Sample(nil), dh.History...)
+	return dh, true
+}
+
+// Warnings lists what needs attention across the attached drives, for the
+// agent's health report.
+func (m *HealthMonitor) Warnings() []string {
+	var w []string
+	for _, dh := range m.Status() {
+		for _, text := range dh.Warnings {
+			w = append(w, fmt.Sprintf("%s (%s): %s", dh.Device, dh.Model, text))
+		}
+	}
+	return w
+}
+
+// StartSelfTest has the drive at device test itself. A short test takes
+// minutes and a long one hours; progress shows in its health.
+func (m *HealthMonitor) StartSelfTest(device, kind string) (DriveHealth, error) {
+	if kind != "short" && kind != "long" {
+		return DriveHealth{}, errs.E(OpHealthSelfTest, errs.KindInvalid, "type must be short or long")
+	}
+	dh, ok := m.Drive(device)
+	switch {
+	case !ok:
+		return DriveHealth{}, errs.E(OpHealthSelfTest, errs.KindNotFound, "no such drive")
+	case !dh.Supported:
+		return DriveHealth{}, errs.E(OpHealthSelfTest, errs.KindInvalid, device+" does not support SMART")
+	case dh.SelfTest.Running:
+		return DriveHealth{}, errs.E(OpHealthSelfTest, errs.KindInvalid, "a self-test is already running")
+	}
+	if err := m.SelfTest(device, kind); err != nil {
+		return DriveHealth{}, errs.E(OpHealthSelfTest, errs.KindSystem, err, "could not start the self-test")
+	}
+	log.Printf("[DISK] %s self-test started on %s", kind, device)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if d := m.Drives[m.attached[device]]; d != nil {
+		d.SelfTest = disk.SelfTest{Running: true, Remaining: 100, Type: kind}
+		dh = *d
+	}
+	dh.History = nil
+	return dh, nil
+}
+
+// save must be called with mu held.
+func (m *HealthMonitor) save() error {
+	data, err := json.Marshal(m.Drives)
+	if err != nil {
+		return errs.E(OpHealthSave, errs.KindIO, err)
+	}
+	if err := os.MkdirAll(filepath.Dir(m.Path), 0700); err != nil {
+		return errs.E(OpHealthSave, errs.KindIO, err)
+	}
+	if err := fsx.WriteFile(m.Path, data, 0600); err != nil {
+		return errs.E(OpHealthSave, errs.KindIO, err)
+	}
+	return nil
+}
+
+func (m *HealthMonitor) GetRoutes() map[string]http.HandlerFunc {
+	return map[string]http.HandlerFunc{
+		"/api/disk/health":          m.handleHealth,
+		"/api/disk/health/selftest": m.handleSelfTest,
+	}
+}
+
+// handleHealth lists the drives' health, or with ?device= one drive's
+// with its history.
+func (m *HealthMonitor) handleHealth(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	device := r.URL.Query().Get("device")
+	if device == "" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string][]DriveHealth{"drives": m.Status()})
+		return
+	}
+	dh, ok := m.Drive(device)
+	if !ok {
+		errs.HTTPResponse(w, errs.E(OpStorageAPI, errs.KindNotFound, "no such drive"))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(dh)
+}
+
+func (m *HealthMonitor) handleSelfTest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		Device string `json:"device"`
+		Type   string `json:"type"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4<<10)).Decode(&req); err != nil || req.Device == "" {
+		errs.HTTPResponse(w, errs.E(OpStorageAPI, errs.KindInvalid, "Invalid JSON"))
+		return
+	}
+	dh, err := m.StartSelfTest(req.Device, req.Type)
+	if err != nil {
+		errs.HTTPResponse(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(dh)
+}
@@ -0,0 +1,139 @@
+package storage
+
+import (
+	"errors"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/platform/disk"
+)
+
+func TestHealthMonitor(t *testing.T) {
+	var mu sync.Mutex
+	readings := map[string]disk.Health{
+		"/dev/sda": {Device: "/dev/sda", Model: "Samsung SSD 870 EVO 1TB", Serial: "S6PT", Protocol: "ATA", Supported: true, Passed: true, Temperature: 34},
+		"/dev/sdb": {Device: "/dev/sdb", Model: "WDC WD40EFRX", Serial: "WD1", Protocol: "ATA", Supported: true, Passed: true, Reallocated: 20, Temperature: 38},
+		"/dev/sdd": {Device: "/dev/sdd", Model: "JMicron Generic", Serial: "JM1"},
+	}
+	failures := map[string]error{"/dev/sdc": errors.New("open failed")}
+	var tested []string
+
+	path := filepath.Join(t.TempDir(), "health.json")
+	m, err := NewHealthMonitor(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.List = func() ([]disk.Drive, error) {
+		return []disk.Drive{
+			{Device: "/dev/mmcblk0", Transport: "mmc", System: true},
+			{Device: "/dev/sda", Transport: "usb"},
+			{Device: "/dev/sdb", Transport: "sata"},
+			{Device: "/dev/sdc", Transport: "usb"},
+			{Device: "/dev/sdd", Transport: "usb"},
+		}, nil
+	}
+	m.Read = func(device string) (disk.Health, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if device == "/dev/mmcblk0" {
+			t.Error("asked an SD card for SMART data")
+		}
+		if err := failures[device]; err != nil {
+			return disk.Health{}, err
+		}
+		return readings[device], nil
+	}
+	m.SelfTest = func(device, kind string) error {
+		tested = append(tested, device+" "+kind)
+		return nil
+	}
+	reports := make(chan HealthReport, 4)
+	m.Report = func(r HealthReport) { reports <- r }
+
+	// The HDD has been reallocating sectors for a while
+	now := time.Now()
+	m.Drives["WD1"] = &DriveHealth{Health: disk.Health{Device: "/dev/sdb"}, History: []Sample{
+		{Time: now.Add(-40 * 24 * time.Hour), Reallocated: 0},
+		{Time: now.Add(-8 * 24 * time.Hour), Reallocated: 2},
+		{Time: now.Add(-6 * 24 * time.Hour), Reallocated: 8, CRCErrors: 3},
+	}}
+
+	m.Check()
+	st := m.Status()
+	if len(st) != 3 || st[0].Device != "/dev/sda" || st[1].Device != "/dev/sdb" || st[2].Device != "/dev/sdd" {
+		t.Fatalf("status: %+v", st)
+	}
+	if st[0].Warnings != nil || st[0].History != nil || st[0].Transport != "usb" {
+		t.Errorf("healthy SSD: %+v", st[0])
+	}
+	if want := []string{"20 reallocated sectors", "12 more sectors reallocated in the last week"}; !reflect.DeepEqual(st[1].Warnings, want) {
+		t.Errorf("failing HDD warned %q, want %q", st[1].Warnings, want)
+	}
+	if st[2].Supported || st[2].Warnings != nil {
+		t.Errorf("drive without SMART: %+v", st[2])
+	}
+	if r := <-reports; len(r.Drives) != 3 || r.Drives[1].History != nil {
+		t.Errorf("report: %+v", r)
+	}
+	if w := m.Warnings(); len(w) != 2 || w[0] != "/dev/sdb (WDC WD40EFRX): 20 reallocated sectors" {
+		t.Errorf("agent warnings: %q", w)
+	}
+
+	var one DriveHealth
+	if code := call(t, m, "GET", "/api/disk/health?device=/dev/sdb", "", &one); code != http.StatusOK || len(one.History) != 3 {
+		t.Errorf("one drive: %d, %d samples (the one past a month is dropped)", code, len(one.History))
+	}
+	if code := call(t, m, "GET", "/api/disk/health?device=/dev/sdc", "", nil); code != http.StatusNotFound {
+		t.Errorf("unreadable drive: %d", code)
+	}
+	var listed struct{ Drives []DriveHealth }
+	if call(t, m, "GET", "/api/disk/health", "", &listed); len(listed.Drives) != 3 {
+		t.Errorf("listed %+v", listed.Drives)
+	}
+
+	selfTests := []struct {
+		name string
+		body string
+		want int
+	}{
+		{"bad json", `{`, http.StatusBadRequest},
+		{"unknown type", `{"device":"/dev/sda","type":"conveyance"}`, http.StatusBadRequest},
+		{"no such drive", `{"device":"/dev/sdz","type":"short"}`, http.StatusNotFound},
+		{"no SMART", `{"device":"/dev/sdd","type":"short"}`, http.StatusBadRequest},
+		{"short", `{"device":"/dev/sda","type":"short"}`, http.StatusAccepted},
+		{"already running", `{"device":"/dev/sda","type":"long"}`, http.StatusBadRequest},
+	}
+	for _, tt := range selfTests {
+		t.Run(tt.name, func(t *testing.T) {
+			if code := call(t, m, "POST", "/api/disk/health/selftest", tt.body, nil); code != tt.want {
+				t.Errorf("status %d, want %d", code, tt.want)
+			}
+		})
+	}
+	if dh, _ := m.Drive("/dev/sda"); !reflect.DeepEqual(tested, []string{"/dev/sda short"}) || !dh.SelfTest.Running {
+		t.Errorf("self-tests run: %q, %+v", tested, dh.SelfTest)
+	}
+
+	// The HDD spins down: its last reading stays, marked as such
+	mu.Lock()
+	failures["/dev/sdb"] = disk.ErrStandby
+	mu.Unlock()
+	m.Check()
+	<-reports
+	if dh, ok := m.Drive("/dev/sdb"); !ok || !dh.Standby || dh.Reallocated != 20 || len(dh.History) != 3 {
+		t.Errorf("asleep: %v %+v", ok, dh)
+	}
+
+	// History survives a restart
+	again, err := NewHealthMonitor(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dh := again.Drives["WD1"]; dh == nil || len(dh.History) != 3 || dh.Model != "WDC WD40EFRX" {
+		t.Errorf("reloaded %+v", dh)
+	}
+}
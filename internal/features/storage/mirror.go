@@ -0,0 +1,228 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/errs"
+	"github.com/strct-org/strct-agent/internal/humanize"
+	"github.com/strct-org/strct-agent/internal/platform/disk"
+)
+
+const (
+	OpStorageMirror  errs.Op = "storage.Manager.Mirror"
+	OpStorageReplace errs.Op = "storage.Manager.Replace"
+)
+
+// MirrorStatus is the state of the mirror and what, if anything, the user
+// should do about it.
+type MirrorStatus struct {
+	disk.ArrayStatus
+	Advice string `json:"advice,omitempty"`
+}
+
+// array returns the mirror storage lives on, or nil. It must be called
+// with mu held.
+func (m *Manager) array() *disk.Array {
+	a, _ := m.Disk.(*disk.Array)
+	return a
+}
+
+// Mirror reports on the mirror storage lives on.
+func (m *Manager) Mirror() (MirrorStatus, error) {
+	m.mu.Lock()
+	a := m.array()
+	m.mu.Unlock()
+	if a == nil {
+		return MirrorStatus{}, errs.E(OpStorageMirror, errs.KindNotFound, "storage is not on a mirror")
+	}
+	st, err := a.Detail()
+	if err != nil {
+		return MirrorStatus{}, errs.E(OpStorageMirror, errs.KindSystem, err, "could not read the mirror")
+	}
+	return MirrorStatus{ArrayStatus: st, Advice: advice(st)}, nil
+}
+
+func advice(st disk.ArrayStatus) string {
+	size := humanize.Bytes(int64(st.MemberSize))
+	switch st.State {
+	case disk.ArrayDegraded:
+		for _, mb := range st.Members {
+			if mb.State == disk.MemberFaulty {
+				return fmt.Sprintf("%s has failed. Attach a drive of at least %s and choose it to replace %s.", mb.Device, size, mb.Device)
+			}
+		}
+		return fmt.Sprintf("A drive is missing. Plug it back in, or attach a drive of at least %s and choose it as the replacement.", size)
+	case disk.ArrayRebuilding:
+		return "Copying the data onto the new drive. Keep both drives attached until it finishes."
+	case disk.ArrayResyncing:
+		return "Bringing the drives in sync. Keep both attached until it finishes."
+	case disk.ArrayStopped:
+		return "The mirror did not start. Check that its drives are attached."
+	}
+	return ""
+}
+
+// mirrorWarnings says what is wrong with the mirror, if storage is on one.
+func (m *Manager) mirrorWarnings() []string {
+	m.mu.Lock()
+	a := m.array()
+	m.mu.Unlock()
+	if a == nil {
+		return nil
+	}
+	st, err := m.Mirror()
+	switch {
+	case err != nil:
+		return []string{err.Error()}
+	case st.State == disk.ArrayDegraded || st.State == disk.ArrayStopped:
+		return []string{"the data mirror is " + st.State + ": " + st.Advice}
+	}
+	return nil
+}
+
+// refuseMember says why d cannot join the mirror, or "" if it can. It
+// must be called with mu held.
+func (m *Manager) refuseMember(d disk.Drive, st disk.ArrayStatus) string {
+	if _, ok := st.Member(d.Device); ok {
+		return "it is already part of the mirror"
+	}
+	switch {
+	case d.System:
+		return "it holds the system"
+	case d.Removable:
+		return "removable media is imported from, not stored on"
+	case d.Mounted():
+		return "it is in use"
+	case d.Size < st.MemberSize:
+		return "it is smaller than the mirror's drives"
+	}
+	return ""
+}
+
+// ConfirmReplacement checks that device can replace a drive of the mirror
+// and issues the token that lets Replace erase it.
+func (m *Manager) ConfirmReplacement(device string) (Confirmation, error) {
+	d, err := m.find(device)
+	if err != nil {
+		return Confirmation{}, err
+	}
+	st, err := m.Mirror()
+	if err != nil {
+		return Confirmation{}, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if reason := m.refuseMember(d, st.ArrayStatus); reason != "" {
+		return Confirmation{}, errs.E(OpStorageReplace, errs.KindInvalid, "cannot use "+device+": "+reason)
+	}
+	c := Confirmation{Drive: d, Expires: time.Now().Add(confirmTTL)}
+	c.Token = m.issue([]disk.Drive{d}, c.Expires)
+	return c, nil
+}
+
+// Replace swaps old out of the mirror for replacement. old may be left
+// out when a drive has failed or gone missing, and a healthy drive is
+// only taken out while the other holds a full copy.
+func (m *Manager) Replace(old, replacement, token string) (MirrorStatus, error) {
+	d, err := m.find(replacement)
+	if err != nil {
+		return MirrorStatus{}, err
+	}
+	st, err := m.Mirror()
+	if err != nil {
+		return MirrorStatus{}, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.redeem(OpStorageReplace, token, []disk.Drive{d}); err != nil {
+		return MirrorStatus{}, err
+	}
+	if st.State == disk.ArrayRebuilding || st.State == disk.ArrayResyncing {
+		return MirrorStatus{}, errs.E(OpStorageReplace, errs.KindInvalid, "wait for the mirror to finish syncing")
+	}
+	if reason := m.refuseMember(d, st.ArrayStatus); reason != "" {
+		return MirrorStatus{}, errs.E(OpStorageReplace, errs.KindInvalid, "cannot use "+replacement+": "+reason)
+	}
+	if old == "" {
+		for _, mb := range st.Members {
+			if mb.State == disk.MemberFaulty {
+				old = mb.Device
+			}
+		}
+		if old == "" && len(st.Members) >= st.Devices {
+			return MirrorStatus{}, errs.E(OpStorageReplace, errs.KindInvalid, "say which drive to replace")
+		}
+	}
+	if old != "" {
+		mb, ok := st.Member(old)
+		if !ok {
+			return MirrorStatus{}, errs.E(OpStorageReplace, errs.KindNotFound, old+" is not part of the mirror")
+		}
+		if mb.State == disk.MemberActive && st.Active() < 2 {
+			return MirrorStatus{}, errs.E(OpStorageReplace, errs.KindInvalid, old+" holds the only complete copy of the data")
+		}
+	}
+
+	a := m.array()
+	if err := a.Replace(old, replacement); err != nil {
+		return MirrorStatus{}, errs.E(OpStorageReplace, errs.KindSystem, err, "could not replace the drive")
+	}
+	log.Printf("[STORAGE] Mirror member %q replaced by %s; rebuilding", old, replacement)
+	st.ArrayStatus, err = a.Detail()
+	if err != nil {
+		return MirrorStatus{}, errs.E(OpStorageReplace, errs.KindSystem, err, "could not read the mirror")
+	}
+	st.Advice = advice(st.ArrayStatus)
+	return st, nil
+}
+
+// handleMirror reports on the mirror (GET) and replaces a drive of it in
+// two steps like a format: POST with only the new device returns a
+// confirmation, and POST again with its token starts the rebuild.
+func (m *Manager) handleMirror(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		st, err := m.Mirror()
+		if err != nil {
+			errs.HTTPResponse(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(st)
+	case http.MethodPost:
+		var req struct {
+			Device  string `json:"device"`
+			Replace string `json:"replace"`
+			Token   string `json:"token"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4<<10)).Decode(&req); err != nil || req.Device == "" {
+			errs.HTTPResponse(w, errs.E(OpStorageAPI, errs.KindInvalid, "Invalid JSON"))
+			return
+		}
+		if req.Token == "" {
+			c, err := m.ConfirmReplacement(req.Device)
+			if err != nil {
+				errs.HTTPResponse(w, err)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(c)
+			return
+		}
+		st, err := m.Replace(req.Replace, req.Device, req.Token)
+		if err != nil {
+			errs.HTTPResponse(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(st)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,207 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/platform/disk"
+)
+
+// mdadmDetail writes what mdadm --detail says of a 1 TB mirror in state
+// with the given member rows.
+func mdadmDetail(state string, rows ...string) []byte {
+	return []byte(fmt.Sprintf(`/dev/md/strct:
+        Raid Level : raid1
+        Array Size : 976630464 (931.39 GiB 1000.07 GB)
+     Used Dev Size : 976630464 (931.39 GiB 1000.07 GB)
+      Raid Devices : 2
+             State : %s
+              UUID : 3f1c2a8e:5b7d9e01:a2c4e6f8:1029384d
+
+    Number   Major   Minor   RaidDevice State
+%s
+`, state, strings.Join(rows, "\n")))
+}
+
+func TestMirror(t *testing.T) {
+	const tb = 1000 << 30
+	drives := []disk.Drive{
+		{Device: "/dev/sda", Serial: "A", Size: tb},
+		{Device: "/dev/sdb", Serial: "B", Size: tb},
+		{Device: "/dev/sdc", Serial: "C", Size: 2 * tb},
+		{Device: "/dev/sdd", Serial: "D", Size: 500 << 30},
+		{Device: "/dev/sde", Serial: "E", Size: tb, Removable: true},
+	}
+	detail := mdadmDetail("clean",
+		"       0       8        0        0      active sync   /dev/sda",
+		"       1       8       16        1      active sync   /dev/sdb")
+	var ran []string
+	a := &disk.Array{Device: disk.ArrayDevice, Run: func(name string, args ...string) ([]byte, error) {
+		cmd := name + " " + strings.Join(args, " ")
+		if args[0] == "--detail" {
+			return detail, nil
+		}
+		ran = append(ran, cmd)
+		return nil, nil
+	}}
+
+	m := New(a, &disk.KeyStore{Dir: t.TempDir(), MachineID: "machine-a"})
+	m.List = func() ([]disk.Drive, error) { return drives, nil }
+
+	var st MirrorStatus
+	if code := call(t, m, "GET", "/api/disk/mirror", "", &st); code != http.StatusOK || st.State != disk.ArrayClean || st.Advice != "" || len(st.Members) != 2 {
+		t.Errorf("healthy mirror: %d %+v", code, st)
+	}
+	if w := m.Warnings(); w != nil {
+		t.Errorf("healthy mirror warned %q", w)
+	}
+
+	confirm := func(device string) (string, int) {
+		var c Confirmation
+		code := call(t, m, "POST", "/api/disk/mirror", `{"device":"`+device+`"}`, &c)
+		return c.Token, code
+	}
+	refused := []struct {
+		device string
+		want   int
+	}{
+		{"/dev/sda", http.StatusBadRequest}, // a member already
+		{"/dev/sdd", http.StatusBadRequest}, // too small
+		{"/dev/sde", http.StatusBadRequest}, // removable
+		{"/dev/sdz", http.StatusNotFound},
+	}
+	for _, tt := range refused {
+		if _, code := confirm(tt.device); code != tt.want {
+			t.Errorf("confirm %s: %d, want %d", tt.device, code, tt.want)
+		}
+	}
+
+	// Both copies are good, so which one goes must be said
+	token, _ := confirm("/dev/sdc")
+	if code := call(t, m, "POST", "/api/disk/mirror", `{"device":"/dev/sdc","token":"`+token+`"}`, nil); code != http.StatusBadRequest {
+		t.Errorf("replace without saying which: %d", code)
+	}
+	if len(ran) != 0 {
+		t.Fatalf("ran %q", ran)
+	}
+
+	// sdb fails
+	detail = mdadmDetail("clean, degraded",
+		"       0       8        0        0      active sync   /dev/sda",
+		"       -       0        0        1      removed",
+		"",
+		"       1       8       16        -      faulty   /dev/sdb")
+	if w := m.Warnings(); len(w) != 1 || !strings.Contains(w[0], "/dev/sdb has failed") || !strings.Contains(w[0], "931.4 GB") {
+		t.Errorf("degraded mirror warned %q", w)
+	}
+	if code := call(t, m, "POST", "/api/disk/mirror", `{"device":"/dev/sdc","token":"guess"}`, nil); code != http.StatusForbidden {
+		t.Errorf("made-up token: %d", code)
+	}
+	token, _ = confirm("/dev/sdc")
+	if code := call(t, m, "POST", "/api/disk/mirror", `{"device":"/dev/sdc","replace":"/dev/sda","token":"`+token+`"}`, nil); code != http.StatusBadRequest {
+		t.Errorf("took out the only good copy: %d", code)
+	}
+	token, _ = confirm("/dev/sdc")
+	if code := call(t, m, "POST", "/api/disk/mirror", `{"device":"/dev/sdc","token":"`+token+`"}`, nil); code != http.StatusAccepted {
+		t.Fatalf("replace: %d", code)
+	}
+	want := []string{"mdadm /dev/md/strct --fail /dev/sdb", "mdadm /dev/md/strct --remove /dev/sdb", "wipefs -a /dev/sdc", "mdadm /dev/md/strct --add /dev/sdc"}
+	if !reflect.DeepEqual(ran, want) {
+		t.Errorf("ran %q\nwant %q", ran, want)
+	}
+
+	// No second replacement while it rebuilds
+	detail = mdadmDetail("clean, degraded, recovering",
+		"       0       8        0        0      active sync   /dev/sda",
+		"       2       8       32        1      spare rebuilding   /dev/sdc")
+	if call(t, m, "GET", "/api/disk/mirror", "", &st); st.State != disk.ArrayRebuilding || !strings.Contains(st.Advice, "Keep both") {
+		t.Errorf("rebuilding: %+v", st)
+	}
+	if w := m.Warnings(); w != nil {
+		t.Errorf("rebuilding mirror warned %q", w)
+	}
+	token, _ = confirm("/dev/sdb")
+	if code := call(t, m, "POST", "/api/disk/mirror", `{"device":"/dev/sdb","token":"`+token+`"}`, nil); code != http.StatusBadRequest {
+		t.Errorf("replace while rebuilding: %d", code)
+	}
+
+	a.Run = func(string, ...string) ([]byte, error) { return nil, errors.New("mdadm: cannot open /dev/md/strct") }
+	if w := m.Warnings(); len(w) != 1 {
+		t.Errorf("unreadable mirror warned %q", w)
+	}
+
+	single := New(&disk.MockDisk{}, nil)
+	if code := call(t, single, "GET", "/api/disk/mirror", "", nil); code != http.StatusNotFound {
+		t.Errorf("single drive: %d", code)
+	}
+	if w := single.Warnings(); w != nil {
+		t.Errorf("single drive warned %q", w)
+	}
+}
+
+func TestFormatMirror(t *testing.T) {
+	drives := []disk.Drive{
+		{Device: "/dev/sda", Serial: "A"},
+		{Device: "/dev/sdb", Serial: "B"},
+		{Device: "/dev/sdc", Serial: "C", Partitions: []disk.Partition{{Device: "/dev/sdc1", Mountpoint: "/media/c"}}},
+	}
+	m := New(nil, &disk.KeyStore{Dir: t.TempDir(), MachineID: "machine-a"})
+	m.List = func() ([]disk.Drive, error) { return drives, nil }
+	m.MountPoint = "/mnt/test"
+	var members []string
+	m.OpenMirror = func(devices []string, progress func(string)) disk.Manager {
+		members = devices
+		return &fastDisk{MockDisk: &disk.MockDisk{VirtualPath: devices[0], Progress: progress}}
+	}
+	sw := &fakeSwitcher{}
+	m.Switcher = sw
+	m.FormatDelay = 0
+
+	tests := []struct {
+		name string
+		body string
+		want int
+	}{
+		{"same drive twice", `{"device":"/dev/sda","mirror":"/dev/sda"}`, http.StatusBadRequest},
+		{"mirror in use", `{"device":"/dev/sda","mirror":"/dev/sdc"}`, http.StatusBadRequest},
+		{"no such mirror", `{"device":"/dev/sda","mirror":"/dev/sdz"}`, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if code := call(t, m, "POST", "/api/disk/format", tt.body, nil); code != tt.want {
+				t.Errorf("status %d, want %d", code, tt.want)
+			}
+		})
+	}
+
+	var c Confirmation
+	if code := call(t, m, "POST", "/api/disk/format", `{"device":"/dev/sda","mirror":"/dev/sdb"}`, &c); code != http.StatusOK || c.Mirror == nil || c.Mirror.Device != "/dev/sdb" {
+		t.Fatalf("confirm: %d %+v", code, c)
+	}
+	if code := call(t, m, "POST", "/api/disk/format", `{"device":"/dev/sda","mirror":"/dev/sdb","token":"`+c.Token+`","encrypt":true}`, nil); code != http.StatusBadRequest {
+		t.Errorf("encrypted mirror: %d", code)
+	}
+	call(t, m, "POST", "/api/disk/format", `{"device":"/dev/sda","mirror":"/dev/sdb"}`, &c)
+	if code := call(t, m, "POST", "/api/disk/format", `{"device":"/dev/sda","token":"`+c.Token+`"}`, nil); code != http.StatusForbidden {
+		t.Errorf("mirror token used for one drive: %d", code)
+	}
+	call(t, m, "POST", "/api/disk/format", `{"device":"/dev/sda","mirror":"/dev/sdb"}`, &c)
+	if code := call(t, m, "POST", "/api/disk/format", `{"device":"/dev/sda","mirror":"/dev/sdb","token":"`+c.Token+`"}`, nil); code != http.StatusAccepted {
+		t.Fatalf("start: %d", code)
+	}
+	var j FormatJob
+	for range 200 {
+		if call(t, m, "GET", "/api/disk/format", "", &j); j.Finished != nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if j.Stage != StageDone || j.Mirror != "/dev/sdb" || !reflect.DeepEqual(members, []string{"/dev/sda", "/dev/sdb"}) || sw.d == nil {
+		t.Errorf("job %+v, mirror of %q, switched to %v", j, members, sw.d)
+	}
+}
@@ -0,0 +1,296 @@
+// Package storage serves /api/disk: the detected drives, formatting one
+// or a mirrored pair into the data drive, its encryption at rest,
+// filesystem checks and scrubs, ejecting it safely, and the drives'
+// health.
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/errs"
+	"github.com/strct-org/strct-agent/internal/platform/disk"
+)
+
+const (
+	OpStorageAPI    errs.Op = "storage.handle"
+	OpStorageUnlock errs.Op = "storage.Manager.Unlock"
+	OpStorageRotate errs.Op = "storage.Manager.Rotate"
+)
+
+const minPassphrase = 8
+
+// wrongKeyDelay slows down guessing the passphrase over the network.
+var wrongKeyDelay = time.Second
+
+// EncryptionStatus is what GET /api/disk/encryption answers.
+type EncryptionStatus struct {
+	Drive      bool `json:"drive"` // false while the data lives on the SD card
+	Encrypted  bool `json:"encrypted"`
+	Unlocked   bool `json:"unlocked"`
+	Passphrase bool `json:"passphrase"` // unlocking needs the user's passphrase
+}
+
+// Manager owns the data drive. Key operations are serialised since each
+// one runs cryptsetup against the same container.
+type Manager struct {
+	Disk disk.Manager // nil when there is no data drive
+	Keys *disk.KeyStore
+
+	// Formatting. Open returns the drive at device, and OpenMirror the
+	// mirror of two drives, reporting format stages to progress;
+	// Switcher, if set, moves storage onto it.
+	List       func() ([]disk.Drive, error)
+	Open       func(device string, progress func(stage string)) disk.Manager
+	OpenMirror func(devices []string, progress func(stage string)) disk.Manager
+	MountPoint string
+	Switcher   Switcher
+	// Ejector takes storage off the drive so it can be unplugged.
+	Ejector Ejector
+
+	// Checker checks the filesystem of drives opened here before they
+	// are mounted, and keeps the record of checks and of scrubs, which
+	// run every Tick once due.
+	Checker *disk.Checker
+	Tick    time.Duration
+
+	// FormatDelay is how long a confirmed format waits before it touches
+	// the drive; it can be cancelled until then.
+	FormatDelay time.Duration
+
+	mu           sync.Mutex
+	unlocked     chan struct{}
+	confirms     map[string]confirmation
+	job          *FormatJob
+	cancelFormat context.CancelFunc
+}
+
+func New(d disk.Manager, keys *disk.KeyStore) *Manager {
+	m := &Manager{
+		Disk:        d,
+		Keys:        keys,
+		List:        disk.ListDrives,
+		Tick:        time.Hour,
+		FormatDelay: defaultFormatDelay,
+	}
+	m.Open = func(device string, progress func(string)) disk.Manager {
+		return &disk.RealDisk{DevicePath: device, Progress: progress, Checker: m.Checker}
+	}
+	m.OpenMirror = func(devices []string, progress func(string)) disk.Manager {
+		a := disk.NewArray(devices, progress)
+		a.Checker = m.Checker
+		return a
+	}
+	m.MountPoint = disk.DataMountPoint
+	m.unlocked = make(chan struct{})
+	m.confirms = make(map[string]confirmation)
+	return m
+}
+
+func (m *Manager) Status() EncryptionStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.status()
+}
+
+// status must be called with mu held.
+func (m *Manager) status() EncryptionStatus {
+	if m.Disk == nil {
+		return EncryptionStatus{}
+	}
+	st := EncryptionStatus{Drive: true, Encrypted: m.Disk.IsEncrypted()}
+	st.Unlocked = !st.Encrypted || m.Disk.IsUnlocked()
+	st.Passphrase = st.Encrypted && m.Keys.NeedsPassphrase()
+	return st
+}
+
+// Unlock opens the encrypted drive with the device secret and passphrase.
+func (m *Manager) Unlock(passphrase string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.Disk == nil || !m.Disk.IsEncrypted() {
+		return errs.E(OpStorageUnlock, errs.KindNotFound, "there is no encrypted drive")
+	}
+	if err := m.open(OpStorageUnlock, passphrase); err != nil {
+		return err
+	}
+	m.opened()
+	return nil
+}
+
+// Recover opens the encrypted drive with the recovery key shown when it
+// was formatted, and gives it a new device key without a passphrase.
+func (m *Manager) Recover(code string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.Disk == nil || !m.Disk.IsEncrypted() {
+		return errs.E(OpStorageUnlock, errs.KindNotFound, "there is no encrypted drive")
+	}
+	err := m.Keys.Recover(m.Disk, code)
+	switch {
+	case errors.Is(err, disk.ErrWrongKey):
+		time.Sleep(wrongKeyDelay)
+		return errs.E(OpStorageUnlock, errs.KindUnauthorized, "wrong recovery key")
+	case err != nil:
+		return errs.E(OpStorageUnlock, errs.KindSystem, err, "could not unlock the drive")
+	}
+	log.Println("[STORAGE] Drive opened with its recovery key; the passphrase was removed")
+	m.opened()
+	return nil
+}
+
+// opened lets WaitForUnlock return. It must be called with mu held.
+func (m *Manager) opened() {
+	select {
+	case <-m.unlocked:
+	default:
+		close(m.unlocked)
+	}
+}
+
+// open unlocks the drive. It must be called with mu held.
+func (m *Manager) open(op errs.Op, passphrase string) error {
+	err := m.Keys.Unlock(m.Disk, passphrase)
+	switch {
+	case errors.Is(err, disk.ErrPassphraseRequired):
+		return errs.E(op, errs.KindUnauthorized, err)
+	case errors.Is(err, disk.ErrWrongKey):
+		time.Sleep(wrongKeyDelay)
+		return errs.E(op, errs.KindUnauthorized, "wrong passphrase")
+	case err != nil:
+		return errs.E(op, errs.KindSystem, err, "could not unlock the drive")
+	}
+	return nil
+}
+
+// Rotate re-keys the drive from a fresh device secret and sets, changes or
+// removes its passphrase.
+func (m *Manager) Rotate(passphrase, newPassphrase string) error {
+	if newPassphrase != "" && len(newPassphrase) < minPassphrase {
+		return errs.E(OpStorageRotate, errs.KindInvalid, "passphrase must be at least 8 characters")
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.Disk == nil || !m.Disk.IsEncrypted() {
+		return errs.E(OpStorageRotate, errs.KindNotFound, "there is no encrypted drive")
+	}
+	err := m.Keys.Rotate(m.Disk, passphrase, newPassphrase)
+	switch {
+	case errors.Is(err, disk.ErrPassphraseRequired):
+		return errs.E(OpStorageRotate, errs.KindUnauthorized, err)
+	case errors.Is(err, disk.ErrWrongKey):
+		time.Sleep(wrongKeyDelay)
+		return errs.E(OpStorageRotate, errs.KindUnauthorized, "wrong passphrase")
+	case err != nil:
+		return errs.E(OpStorageRotate, errs.KindSystem, err, "could not change the drive key")
+	}
+	log.Printf("[STORAGE] Drive key rotated (passphrase: %v)", newPassphrase != "")
+	return nil
+}
+
+// WaitForUnlock serves only the unlock endpoints on addr and returns once
+// the drive is open. Boot waits here for a drive with a passphrase, before
+// anything tries to mount it.
+func (m *Manager) WaitForUnlock(addr string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/disk/encryption", m.handleEncryption)
+	mux.HandleFunc("/api/disk/unlock", m.handleUnlock)
+	srv := &http.Server{Addr: addr, Handler: mux}
+
+	failed := make(chan error, 1)
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			failed <- err
+		}
+	}()
+	log.Printf("[STORAGE] Drive is locked; waiting for its passphrase on %s", addr)
+
+	select {
+	case <-m.unlocked:
+	case err := <-failed:
+		return errs.E(OpStorageUnlock, errs.KindNetwork, err, "could not serve the unlock page")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	srv.Shutdown(ctx)
+	log.Println("[STORAGE] Drive unlocked")
+	return nil
+}
+
+func (m *Manager) GetRoutes() map[string]http.HandlerFunc {
+	return map[string]http.HandlerFunc{
+		"/api/disk/drives":            m.handleDrives,
+		"/api/disk/format":            m.handleFormat,
+		"/api/disk/mirror":            m.handleMirror,
+		"/api/disk/check":             m.handleCheck,
+		"/api/disk/check/repair":      m.handleRepair,
+		"/api/disk/scrub":             m.handleScrub,
+		"/api/disk/eject":             m.handleEject,
+		"/api/disk/remount":           m.handleRemount,
+		"/api/disk/encryption":        m.handleEncryption,
+		"/api/disk/encryption/rotate": m.handleRotate,
+		"/api/disk/unlock":            m.handleUnlock,
+	}
+}
+
+func (m *Manager) handleEncryption(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(m.Status())
+}
+
+func (m *Manager) handleUnlock(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		Passphrase  string `json:"passphrase"`
+		RecoveryKey string `json:"recoveryKey"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4<<10)).Decode(&req); err != nil {
+		errs.HTTPResponse(w, errs.E(OpStorageAPI, errs.KindInvalid, "Invalid JSON"))
+		return
+	}
+	var err error
+	if req.RecoveryKey != "" {
+		err = m.Recover(req.RecoveryKey)
+	} else {
+		err = m.Unlock(req.Passphrase)
+	}
+	if err != nil {
+		errs.HTTPResponse(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(m.Status())
+}
+
+func (m *Manager) handleRotate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		Passphrase    string `json:"passphrase"`
+		NewPassphrase string `json:"newPassphrase"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4<<10)).Decode(&req); err != nil {
+		errs.HTTPResponse(w, errs.E(OpStorageAPI, errs.KindInvalid, "Invalid JSON"))
+		return
+	}
+	if err := m.Rotate(req.Passphrase, req.NewPassphrase); err != nil {
+		errs.HTTPResponse(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(m.Status())
+}
@@ -0,0 +1,123 @@
+package storage
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/platform/disk"
+)
+
+func call(t *testing.T, m interface {
+	GetRoutes() map[string]http.HandlerFunc
+}, method, route, body string, out any) int {
+	t.Helper()
+	w := httptest.NewRecorder()
+	m.GetRoutes()[strings.SplitN(route, "?", 2)[0]](w, httptest.NewRequest(method, route, strings.NewReader(body)))
+	if out != nil && w.Code < 300 {
+		if err := json.Unmarshal(w.Body.Bytes(), out); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return w.Code
+}
+
+func TestEncryption(t *testing.T) {
+	wrongKeyDelay = 0
+	keys := &disk.KeyStore{Dir: t.TempDir(), MachineID: "machine-a"}
+
+	var st EncryptionStatus
+	if call(t, New(nil, keys), "GET", "/api/disk/encryption", "", &st); st.Drive {
+		t.Errorf("no drive: %+v", st)
+	}
+	plain := New(&disk.MockDisk{}, keys)
+	if call(t, plain, "GET", "/api/disk/encryption", "", &st); !st.Drive || st.Encrypted || !st.Unlocked {
+		t.Errorf("plain drive: %+v", st)
+	}
+	if code := call(t, plain, "POST", "/api/disk/encryption/rotate", `{}`, nil); code != http.StatusNotFound {
+		t.Errorf("rotate a plain drive: %d", code)
+	}
+
+	d := &disk.MockDisk{}
+	recovery, _ := disk.NewRecoveryKey()
+	if err := keys.Format(d, "correct horse", recovery); err != nil {
+		t.Fatal(err)
+	}
+	d.Lock()
+	m := New(d, keys)
+	if call(t, m, "GET", "/api/disk/encryption", "", &st); !st.Encrypted || st.Unlocked || !st.Passphrase {
+		t.Errorf("locked drive: %+v", st)
+	}
+
+	tests := []struct {
+		name  string
+		route string
+		body  string
+		want  int
+	}{
+		{"bad json", "/api/disk/unlock", `{`, http.StatusBadRequest},
+		{"no passphrase", "/api/disk/unlock", `{}`, http.StatusUnauthorized},
+		{"wrong passphrase", "/api/disk/unlock", `{"passphrase":"wrong horse"}`, http.StatusUnauthorized},
+		{"unlock", "/api/disk/unlock", `{"passphrase":"correct horse"}`, http.StatusOK},
+		{"rotate with the wrong passphrase", "/api/disk/encryption/rotate", `{"passphrase":"wrong horse","newPassphrase":"battery staple"}`, http.StatusUnauthorized},
+		{"short new passphrase", "/api/disk/encryption/rotate", `{"passphrase":"correct horse","newPassphrase":"short"}`, http.StatusBadRequest},
+		{"rotate", "/api/disk/encryption/rotate", `{"passphrase":"correct horse","newPassphrase":"battery staple"}`, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if code := call(t, m, "POST", tt.route, tt.body, nil); code != tt.want {
+				t.Errorf("status %d, want %d", code, tt.want)
+			}
+		})
+	}
+
+	// At boot the drive waits for its new passphrase
+	d.Lock()
+	m = New(d, keys)
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	addr := l.Addr().String()
+	l.Close()
+	done := make(chan error, 1)
+	go func() { done <- m.WaitForUnlock(addr) }()
+
+	post := func(body string) int {
+		for range 50 {
+			resp, err := http.Post("http://"+addr+"/api/disk/unlock", "application/json", strings.NewReader(body))
+			if err != nil {
+				time.Sleep(20 * time.Millisecond)
+				continue
+			}
+			resp.Body.Close()
+			return resp.StatusCode
+		}
+		t.Fatal("unlock page never came up")
+		return 0
+	}
+	if code := post(`{"passphrase":"correct horse"}`); code != http.StatusUnauthorized {
+		t.Errorf("old passphrase after rotation: %d", code)
+	}
+	if code := post(`{"passphrase":"battery staple"}`); code != http.StatusOK {
+		t.Errorf("new passphrase: %d", code)
+	}
+	select {
+	case err := <-done:
+		if err != nil || !d.Unlocked {
+			t.Errorf("wait: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("boot still waiting after unlock")
+	}
+
+	// The passphrase is forgotten
+	d.Lock()
+	if code := call(t, m, "POST", "/api/disk/unlock", `{"recoveryKey":"AAAA-BBBB"}`, nil); code != http.StatusUnauthorized {
+		t.Errorf("wrong recovery key: %d", code)
+	}
+	if code := call(t, m, "POST", "/api/disk/unlock", `{"recoveryKey":"`+recovery+`"}`, &st); code != http.StatusOK || !st.Unlocked || st.Passphrase {
+		t.Errorf("recovery: %d %+v", code, st)
+	}
+}
@@ -0,0 +1,35 @@
+// Package fsx holds the file conventions features share: writes that have
+// to survive a power cut, and the names of files still being written.
+package fsx
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// WriteFile replaces path with data so that a crash leaves either the old
+// file or the new one, never a torn or empty one: the data goes to a
+// temporary file next to path, is synced, renamed into place, and then the
+// folder is synced so the rename itself is on disk. The folder must exist.
+func WriteFile(path string, data []byte, perm os.FileMode) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return SyncDir(filepath.Dir(path))
+}
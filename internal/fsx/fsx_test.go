@@ -0,0 +1,41 @@
+package fsx
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "state.json")
+
+	for _, content := range []string{"first", "second"} {
+		if err := WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if got, _ := os.ReadFile(path); string(got) != content {
+			t.Errorf("read %q, want %q", got, content)
+		}
+	}
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("mode %v, %v", fi.Mode(), err)
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("temp file left behind: %v", err)
+	}
+
+	// A failed write leaves the old file and no temp file
+	if err := WriteFile(filepath.Join(dir, "missing", "state.json"), []byte("x"), 0600); err == nil {
+		t.Error("wrote into a missing folder")
+	}
+	if err := os.Mkdir(path+".tmp", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFile(path, []byte("third"), 0600); err == nil {
+		t.Error("wrote over a folder")
+	}
+	if got, _ := os.ReadFile(path); string(got) != "second" {
+		t.Errorf("after a failed write: %q", got)
+	}
+}
@@ -0,0 +1,16 @@
+//go:build !windows
+
+package fsx
+
+import "os"
+
+// SyncDir flushes dir's entries, so files just created or renamed in it
+// stay after a crash.
+func SyncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,17 @@
+package fsx
+
+import "strings"
+
+// TempPrefix marks files that are still being written. They are renamed
+// into place when complete and never listed, served or archived before
+// that. SyncTempPrefix is the same for the sync client, which peer
+// replication runs inside the data folder.
+const (
+	TempPrefix     = ".strct-upload-"
+	SyncTempPrefix = ".strct-sync-"
+)
+
+// IsTempName reports whether name is a file still being written.
+func IsTempName(name string) bool {
+	return strings.HasPrefix(name, TempPrefix) || strings.HasPrefix(name, SyncTempPrefix)
+}
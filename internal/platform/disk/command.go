@@ -0,0 +1,55 @@
+package disk
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+// CommandRunner runs a program and returns what it printed. Code that
+// drives mdadm and friends takes one, so tests can stand in for them.
+type CommandRunner func(name string, args ...string) ([]byte, error)
+
+// InputRunner is a CommandRunner that also feeds the program input: the
+// first on stdin, any others on /dev/fd/3 onwards. Keys go this way so
+// they never show up in the process list or on disk.
+type InputRunner func(input [][]byte, name string, args ...string) ([]byte, error)
+
+// Run is what the package-level helpers (mount, umount, smartctl) run
+// programs with. Tests replace it.
+var Run CommandRunner = Exec
+
+// Exec is the CommandRunner that runs the program for real. A failure
+// carries what the program said.
+func Exec(name string, args ...string) ([]byte, error) {
+	return ExecInput(nil, name, args...)
+}
+
+// ExecInput is the InputRunner that runs the program for real. The extra
+// input is written to pipes before the program starts, which is fine for
+// keys: they are far smaller than a pipe's buffer.
+func ExecInput(input [][]byte, name string, args ...string) ([]byte, error) {
+	cmd := exec.Command(name, args...)
+	if len(input) > 0 {
+		cmd.Stdin = bytes.NewReader(input[0])
+	}
+	for i := 1; i < len(input); i++ {
+		r, w, err := os.Pipe()
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		_, err = w.Write(input[i])
+		w.Close()
+		if err != nil {
+			return nil, err
+		}
+		cmd.ExtraFiles = append(cmd.ExtraFiles, r)
+	}
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return out, fmt.Errorf("%s: %w: %s", name, err, bytes.TrimSpace(out))
+	}
+	return out, nil
+}
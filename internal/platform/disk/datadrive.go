@@ -0,0 +1,108 @@
+package disk
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/strct-org/strct-agent/internal/fsx"
+)
+
+// DataDrive remembers which partition holds the data by its UUID, so the
+// drive is found wherever it is attached and another drive that comes up
+// under its old name is never mounted in its place.
+type DataDrive struct {
+	Dir string
+	Sys Sysfs
+	// Checker is given to the drives returned, to check their
+	// filesystem before it is mounted.
+	Checker *Checker
+}
+
+func NewDataDrive(dir string) *DataDrive {
+	return &DataDrive{Dir: dir, Sys: System, Checker: NewChecker(dir)}
+}
+
+func (r *DataDrive) path() string { return filepath.Join(r.Dir, "data-drive.json") }
+
+type dataDriveFile struct {
+	UUID  string `json:"uuid"`
+	Array string `json:"array,omitempty"` // set when the data is on a mirror
+}
+
+func (r *DataDrive) load() dataDriveFile {
+	var f dataDriveFile
+	if data, err := os.ReadFile(r.path()); err == nil {
+		json.Unmarshal(data, &f)
+	}
+	return f
+}
+
+// UUID returns the remembered partition UUID, or "" if storage never
+// lived on a drive.
+func (r *DataDrive) UUID() string {
+	return r.load().UUID
+}
+
+// Array returns the remembered mirror, or nil if the data is not on one.
+func (r *DataDrive) Array() *Array {
+	f := r.load()
+	if f.Array == "" {
+		return nil
+	}
+	return &Array{Device: ArrayDevice, UUID: f.UUID, ArrayUUID: f.Array, Run: Exec, Checker: r.Checker, Sys: r.Sys}
+}
+
+// Remember makes the partition with uuid the data drive.
+func (r *DataDrive) Remember(uuid string) error {
+	return r.write(dataDriveFile{UUID: uuid})
+}
+
+// RememberArray makes the mirror a the data drive.
+func (r *DataDrive) RememberArray(a *Array) error {
+	return r.write(dataDriveFile{UUID: a.PartitionUUID(), Array: a.ArrayUUID})
+}
+
+func (r *DataDrive) write(f dataDriveFile) error {
+	data, _ := json.Marshal(f)
+	if err := os.MkdirAll(r.Dir, 0700); err != nil {
+		return err
+	}
+	return fsx.WriteFile(r.path(), data, 0600)
+}
+
+// Candidates returns the drives storage may live on, in order of
+// preference: the remembered drive wherever it is attached now, or while
+// none is remembered, the DataCandidates that are present. There are none
+// while the data is on a mirror; Array returns it instead.
+func (r *DataDrive) Candidates() []*RealDisk {
+	f := r.load()
+	if f.Array != "" {
+		return nil
+	}
+	if uuid := f.UUID; uuid != "" {
+		drive, _, ok := r.Sys.FindUUID(uuid)
+		if !ok {
+			log.Printf("[DISK] Data drive %s is not attached", uuid)
+			return nil
+		}
+		return []*RealDisk{{DevicePath: drive.Device, UUID: uuid, Checker: r.Checker}}
+	}
+
+	var disks []*RealDisk
+	for _, path := range DataCandidates {
+		// A card reader or stick is something to import from, not
+		// somewhere to keep the data
+		drive, ok := r.Sys.Drive(path)
+		if !ok {
+			continue
+		}
+		if drive.Removable {
+			log.Printf("[DISK] Skipping %s: removable media", path)
+			continue
+		}
+		disks = append(disks, &RealDisk{DevicePath: path, Checker: r.Checker})
+	}
+	return disks
+}
@@ -1,20 +1,35 @@
 package disk
 
 import (
-	"encoding/json"
 	"errors"
 	"log"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"runtime"
-	"strings"
 )
 
+// DataCandidates are the drives the data can live on, in order of
+// preference.
+var DataCandidates = []string{"/dev/nvme0n1", "/dev/sda"}
+
 type Manager interface {
 	GetStatus() (string, error)
 	Format() error
 	EnsureMounted(mountPoint string) error
+	// PartitionUUID names the data partition however the drive is
+	// attached; "" until it is formatted.
+	PartitionUUID() string
+
+	// Encryption at rest. EnsureMounted fails with ErrLocked until an
+	// encrypted drive is unlocked.
+	FormatEncrypted(key []byte) error
+	IsEncrypted() bool
+	IsUnlocked() bool
+	Unlock(key []byte) error
+	Lock() error
+	ChangeKey(oldKey, newKey []byte) error
+	// AddKey adds newKey in a free key slot; key opens an existing one.
+	AddKey(key, newKey []byte) error
 }
 
 func New(devMode bool) Manager {
@@ -47,50 +62,26 @@ func New(devMode bool) Manager {
 }
 
 func detectDevicePath() (string, error) {
-	cmd := exec.Command("lsblk", "-J", "-o", "NAME,TYPE,MOUNTPOINT")
-	output, err := cmd.Output()
+	drives, err := System.Drives()
 	if err != nil {
 		return "", err
 	}
 
-	var data lsblkOutput
-	if err := json.Unmarshal(output, &data); err != nil {
-		return "", err
-	}
-
-	for _, dev := range data.Blockdevices {
-		if dev.Type == "loop" || dev.Type == "rom" || dev.Name == "sr0" {
+	for _, dev := range drives {
+		// The SD card, and whatever holds the running system, is never
+		// the data drive
+		if dev.Transport == "mmc" || dev.System {
 			continue
 		}
 
-		if strings.HasPrefix(dev.Name, "mmcblk") {
-			continue
-		}
-
-		isSystem := false
-		if dev.Mountpoint == "/" {
-			isSystem = true
-		}
-		for _, child := range dev.Children {
-			if child.Mountpoint == "/" {
-				isSystem = true
-				break
-			}
-		}
-
-		if isSystem {
-			continue
-		}
-
-		return "/dev/" + dev.Name, nil
+		return dev.Device, nil
 	}
 
 	var noExternalDriveError = errors.New("no suitable external drive found")
 
-	return "", noExternalDriveError 
+	return "", noExternalDriveError
 }
 
-
 func GetDirSize(path string) (uint64, error) {
 	var size int64
 	err := filepath.WalkDir(path, func(_ string, d os.DirEntry, err error) error {
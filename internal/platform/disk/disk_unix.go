@@ -11,4 +11,22 @@ func GetFreeDiskSpace(path string) (uint64, error) {
 	}
 	// Available blocks * Block size
 	return stat.Bavail * uint64(stat.Bsize), nil
-}
\ No newline at end of file
+}
+// GetDiskSize returns the size of the filesystem holding path.
+func GetDiskSize(path string) (uint64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, err
+	}
+	return stat.Blocks * uint64(stat.Bsize), nil
+}
+
+// IsMountPoint reports whether a filesystem is mounted at dir, telling a
+// mounted drive from the empty folder it leaves behind once it is gone.
+func IsMountPoint(dir string) bool {
+	var st, parent syscall.Stat_t
+	if syscall.Stat(dir, &st) != nil || syscall.Stat(dir+"/..", &parent) != nil {
+		return false
+	}
+	return st.Dev != parent.Dev || st.Ino == parent.Ino
+}
@@ -29,4 +29,28 @@ func GetFreeDiskSpace(path string) (uint64, error) {
 	}
 
 	return uint64(freeBytesAvailable), nil
-}
\ No newline at end of file
+}
+
+// GetDiskSize returns the size of the volume holding path.
+func GetDiskSize(path string) (uint64, error) {
+	h := syscall.MustLoadDLL("kernel32.dll")
+	c := h.MustFindProc("GetDiskFreeSpaceExW")
+
+	var freeBytesAvailable, totalNumberOfBytes, totalNumberOfFreeBytes int64
+	r, _, err := c.Call(
+		uintptr(unsafe.Pointer(syscall.StringToUTF16Ptr(path))),
+		uintptr(unsafe.Pointer(&freeBytesAvailable)),
+		uintptr(unsafe.Pointer(&totalNumberOfBytes)),
+		uintptr(unsafe.Pointer(&totalNumberOfFreeBytes)),
+	)
+	if r == 0 {
+		return 0, err
+	}
+	return uint64(totalNumberOfBytes), nil
+}
+
+// IsMountPoint always reports true: drives are not mounted into folders
+// here, so there is nothing to tell apart.
+func IsMountPoint(dir string) bool {
+	return true
+}
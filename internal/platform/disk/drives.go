@@ -0,0 +1,90 @@
+package disk
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+const (
+	// DataMountPoint is where the data drive is mounted.
+	DataMountPoint = "/mnt/strct_data"
+	// PoolDir holds a mount point per extra drive in the storage pool,
+	// named by the filesystem's UUID.
+	PoolDir = "/mnt/strct"
+)
+
+// Drive is a whole disk as the kernel sees it.
+type Drive struct {
+	Device     string      `json:"device"` // e.g. /dev/nvme0n1
+	Model      string      `json:"model,omitempty"`
+	Serial     string      `json:"serial,omitempty"`
+	Transport  string      `json:"transport,omitempty"` // nvme, sata, usb, mmc
+	Size       uint64      `json:"size"`
+	Removable  bool        `json:"removable"` // the kernel flags it as removable media
+	System     bool        `json:"system"`    // holds the running system
+	Partitions []Partition `json:"partitions"`
+}
+
+type Partition struct {
+	Device     string `json:"device"`
+	Size       uint64 `json:"size"`
+	FSType     string `json:"fsType,omitempty"`
+	Label      string `json:"label,omitempty"`
+	UUID       string `json:"uuid,omitempty"`
+	Mountpoint string `json:"mountpoint,omitempty"` // of the partition or the container open on it
+}
+
+// Mounted reports whether anything on the drive is in use.
+func (d Drive) Mounted() bool {
+	for _, p := range d.Partitions {
+		if p.Mountpoint != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// holdsSystem reports whether the drive holds the running system, such as
+// the boot SD card whose firmware partition is FAT.
+func (d Drive) holdsSystem() bool {
+	for _, p := range d.Partitions {
+		if p.Mountpoint == "/" || p.Mountpoint == "/boot" || strings.HasPrefix(p.Mountpoint, "/boot/") {
+			return true
+		}
+	}
+	return false
+}
+
+// ListDrives returns the disks attached to the device, partitions included.
+func ListDrives() ([]Drive, error) {
+	return System.Drives()
+}
+
+// BindMount makes the tree at src also appear at dst, hiding whatever dst
+// held until it is unmounted.
+func BindMount(src, dst string) error {
+	if err := os.MkdirAll(dst, 0755); err != nil {
+		return err
+	}
+	if _, err := Run("mount", "--bind", src, dst); err != nil {
+		return fmt.Errorf("bind %s to %s: %w", src, dst, err)
+	}
+	return nil
+}
+
+// MountPool mounts the filesystem on p read-write at dir. It is found by
+// UUID, and nothing on it can be run or act as a device.
+func MountPool(p Partition, dir string) error {
+	return mount("/dev/disk/by-uuid/"+p.UUID, p.FSType, dir, "nosuid,nodev,noexec")
+}
+
+// Detach lazily unmounts dir: it disappears at once and is cleaned up when
+// the last open file on it closes. It is how a drive that was pulled out
+// is let go of.
+func Detach(dir string) error {
+	if _, err := Run("umount", "-l", dir); err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,304 @@
+package disk
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/fsx"
+)
+
+// Why a filesystem was checked.
+const (
+	ReasonDirty     = "dirty"     // not unmounted cleanly, or known to have errors
+	ReasonScheduled = "scheduled" // unchecked for longer than the schedule allows
+	ReasonRepair    = "repair"    // the user asked for a full repair
+)
+
+// What a check found.
+const (
+	CheckClean    = "clean"
+	CheckRepaired = "repaired"
+	CheckErrors   = "errors" // some could not be repaired automatically
+	CheckFailed   = "failed" // e2fsck could not run
+)
+
+const (
+	// Defaults for a device that was never given a schedule.
+	defaultCheckDays = 30
+	defaultScrubDays = 30
+
+	keepChecks = 20
+	keepScrubs = 12
+	// keepOutput is how much of what e2fsck printed is kept per check.
+	keepOutput = 2 << 10
+)
+
+// CheckResult is one run of e2fsck before a mount.
+type CheckResult struct {
+	Device   string    `json:"device"`
+	Started  time.Time `json:"started"`
+	Seconds  float64   `json:"seconds"`
+	Reason   string    `json:"reason"`
+	Outcome  string    `json:"outcome"`
+	ReadOnly bool      `json:"readOnly,omitempty"` // mounted read-only since errors remain
+	Output   string    `json:"output,omitempty"`
+}
+
+// ScrubResult is one pass of the mirror comparing its drives.
+type ScrubResult struct {
+	Started    time.Time  `json:"started"`
+	Finished   *time.Time `json:"finished,omitempty"`
+	Mismatches uint64     `json:"mismatches"` // sectors that differ between the drives
+	Error      string     `json:"error,omitempty"`
+}
+
+// CheckState is the schedule and the record of past checks and scrubs.
+type CheckState struct {
+	// CheckDays is how long a clean filesystem goes unchecked; a dirty
+	// one is always checked. 0 turns scheduled checks off, and ScrubDays
+	// does the same for scrubs of a mirror.
+	CheckDays int           `json:"checkDays"`
+	ScrubDays int           `json:"scrubDays"`
+	Repair    bool          `json:"repair"` // repair at the next mount
+	Checks    []CheckResult `json:"checks"`
+	Scrubs    []ScrubResult `json:"scrubs"`
+}
+
+// LastCheck returns the latest check, if there was one.
+func (s CheckState) LastCheck() (CheckResult, bool) {
+	if len(s.Checks) == 0 {
+		return CheckResult{}, false
+	}
+	return s.Checks[len(s.Checks)-1], true
+}
+
+// LastScrub returns the latest scrub, finished or not.
+func (s CheckState) LastScrub() (ScrubResult, bool) {
+	if len(s.Scrubs) == 0 {
+		return ScrubResult{}, false
+	}
+	return s.Scrubs[len(s.Scrubs)-1], true
+}
+
+// Checker checks the data filesystem before it is mounted, as an unclean
+// shutdown is common on a board pulled from the wall, and keeps a record
+// of what it found next to the data drive's other state in Dir.
+type Checker struct {
+	Dir string
+	Run CommandRunner
+
+	mu sync.Mutex
+}
+
+func NewChecker(dir string) *Checker {
+	return &Checker{Dir: dir, Run: Exec}
+}
+
+func (c *Checker) path() string { return filepath.Join(c.Dir, "checks.json") }
+
+// State returns the schedule and the record.
+func (c *Checker) State() CheckState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.load()
+}
+
+func (c *Checker) load() CheckState {
+	s := CheckState{CheckDays: defaultCheckDays, ScrubDays: defaultScrubDays}
+	if data, err := os.ReadFile(c.path()); err == nil {
+		json.Unmarshal(data, &s)
+	}
+	return s
+}
+
+func (c *Checker) write(s CheckState) error {
+	data, _ := json.Marshal(s)
+	if err := os.MkdirAll(c.Dir, 0700); err != nil {
+		return err
+	}
+	return fsx.WriteFile(c.path(), data, 0600)
+}
+
+func (c *Checker) update(f func(*CheckState)) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := c.load()
+	f(&s)
+	return c.write(s)
+}
+
+// SetSchedule changes how often checks and scrubs run.
+func (c *Checker) SetSchedule(checkDays, scrubDays int) error {
+	return c.update(func(s *CheckState) { s.CheckDays, s.ScrubDays = checkDays, scrubDays })
+}
+
+// RequestRepair has the next mount repair whatever e2fsck finds, or
+// cancels that. Mounting is the only time the filesystem is not in use.
+func (c *Checker) RequestRepair(on bool) error {
+	return c.update(func(s *CheckState) { s.Repair = on })
+}
+
+// RecordScrub adds a scrub to the record, or updates it once it is done.
+func (c *Checker) RecordScrub(r ScrubResult) error {
+	return c.update(func(s *CheckState) {
+		if n := len(s.Scrubs); n > 0 && s.Scrubs[n-1].Started.Equal(r.Started) {
+			s.Scrubs[n-1] = r
+			return
+		}
+		s.Scrubs = append(s.Scrubs, r)
+		if len(s.Scrubs) > keepScrubs {
+			s.Scrubs = s.Scrubs[len(s.Scrubs)-keepScrubs:]
+		}
+	})
+}
+
+// BeforeMount checks the ext4 filesystem on device if it is dirty, due or
+// a repair was asked for, and reports whether it must be mounted
+// read-only because errors remain that only a repair may fix.
+func (c *Checker) BeforeMount(device string) (readOnly bool) {
+	s := c.State()
+
+	sb, err := c.superblock(device)
+	if err != nil {
+		// Not ext4, or nothing there yet; mount will say which
+		return false
+	}
+	reason := ""
+	switch {
+	case s.Repair:
+		reason = ReasonRepair
+	case sb.dirty:
+		reason = ReasonDirty
+	case s.CheckDays > 0 && time.Since(sb.checked) > time.Duration(s.CheckDays)*24*time.Hour:
+		reason = ReasonScheduled
+	default:
+		return false
+	}
+
+	r := CheckResult{Device: device, Started: time.Now(), Reason: reason}
+	log.Printf("[DISK] Checking the filesystem on %s (%s)", device, reason)
+	// -p repairs only what is safe without asking; -y whatever is found
+	mode := "-p"
+	if reason == ReasonRepair {
+		mode = "-y"
+	}
+	out, err := c.Run("e2fsck", "-f", mode, device)
+	r.Seconds = time.Since(r.Started).Seconds()
+	r.Outcome = fsckOutcome(err)
+	r.ReadOnly = r.Outcome == CheckErrors
+	if len(out) > keepOutput {
+		out = out[len(out)-keepOutput:]
+	}
+	r.Output = string(bytes.TrimSpace(out))
+	log.Printf("[DISK] Filesystem check of %s: %s", device, r.Outcome)
+
+	err = c.update(func(s *CheckState) {
+		s.Repair = false
+		s.Checks = append(s.Checks, r)
+		if len(s.Checks) > keepChecks {
+			s.Checks = s.Checks[len(s.Checks)-keepChecks:]
+		}
+	})
+	if err != nil {
+		log.Printf("[DISK] Could not record the filesystem check: %v", err)
+	}
+	return r.ReadOnly
+}
+
+// fsckOutcome reads e2fsck's exit status, a set of bits: 1 and 2 for
+// errors corrected, 4 for errors left, and 8 and up for failing to run.
+func fsckOutcome(err error) string {
+	if err == nil {
+		return CheckClean
+	}
+	var exit interface{ ExitCode() int }
+	if !errors.As(err, &exit) {
+		return CheckFailed
+	}
+	code := exit.ExitCode()
+	switch {
+	case code&4 != 0:
+		return CheckErrors
+	case code >= 8 || code < 0:
+		return CheckFailed
+	}
+	return CheckRepaired
+}
+
+// Warnings says what is wrong with the data filesystem, as far as the
+// latest check and scrub found.
+func (c *Checker) Warnings() []string {
+	s := c.State()
+	var w []string
+	if r, ok := s.LastCheck(); ok {
+		switch {
+		case r.ReadOnly:
+			w = append(w, fmt.Sprintf("the filesystem on %s has errors that could not be repaired automatically, so it is mounted read-only; schedule a repair", r.Device))
+		case r.Outcome == CheckFailed:
+			w = append(w, fmt.Sprintf("the filesystem on %s could not be checked", r.Device))
+		}
+	}
+	if r, ok := s.LastScrub(); ok {
+		switch {
+		case r.Error != "":
+			w = append(w, "the last scrub of the mirror failed: "+r.Error)
+		case r.Mismatches > 0:
+			w = append(w, fmt.Sprintf("the last scrub found %d sectors that differ between the mirror's drives", r.Mismatches))
+		}
+	}
+	return w
+}
+
+type superblock struct {
+	dirty   bool
+	checked time.Time
+}
+
+// superblock reads the state of an ext4 filesystem from dumpe2fs -h:
+//
+//	Filesystem state:         clean
+//	Filesystem features:      has_journal ext_attr ... needs_recovery
+//	Last checked:             Mon Oct  5 10:12:44 2026
+func (c *Checker) superblock(device string) (superblock, error) {
+	out, err := c.Run("dumpe2fs", "-h", device)
+	if err != nil {
+		return superblock{}, err
+	}
+	var sb superblock
+	found := false
+	sc := bufio.NewScanner(bytes.NewReader(out))
+	for sc.Scan() {
+		key, value, ok := strings.Cut(sc.Text(), ":")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		switch key {
+		case "Filesystem state":
+			found = true
+			if value != "clean" {
+				sb.dirty = true
+			}
+		case "Filesystem features":
+			// Set while mounted, so left over from an unclean shutdown
+			if strings.Contains(" "+value+" ", " needs_recovery ") {
+				sb.dirty = true
+			}
+		case "Last checked":
+			sb.checked, _ = time.ParseInLocation(time.ANSIC, value, time.Local)
+		}
+	}
+	if !found {
+		return superblock{}, fmt.Errorf("%s: no ext4 filesystem", device)
+	}
+	return sb, nil
+}
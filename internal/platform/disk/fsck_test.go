@@ -0,0 +1,176 @@
+package disk
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// exitStatus is how a program that ran but failed reports its exit code.
+type exitStatus int
+
+func (e exitStatus) Error() string { return fmt.Sprintf("exit status %d", int(e)) }
+func (e exitStatus) ExitCode() int { return int(e) }
+
+var lastChecked = regexp.MustCompile(`(?m)^Last checked:.*$`)
+
+func TestChecker(t *testing.T) {
+	tests := []struct {
+		name      string
+		superblk  string // testdata/dumpe2fs fixture; "" for no ext4 filesystem
+		checkDays int
+		repair    bool
+		exit      int
+
+		wantRun  string // e2fsck arguments; "" when it must not run
+		want     CheckResult
+		readOnly bool
+	}{
+		{name: "clean and recently checked", superblk: "clean.txt", checkDays: 30},
+		{name: "overdue, schedule off", superblk: "overdue.txt"},
+		{name: "not ext4", checkDays: 30},
+		{
+			name: "overdue", superblk: "overdue.txt", checkDays: 30,
+			wantRun: "-f -p /dev/sda1", want: CheckResult{Reason: ReasonScheduled, Outcome: CheckClean},
+		},
+		{
+			name: "journal left to replay", superblk: "unclean-shutdown.txt", checkDays: 30, exit: 1,
+			wantRun: "-f -p /dev/sda1", want: CheckResult{Reason: ReasonDirty, Outcome: CheckRepaired},
+		},
+		{
+			name: "errors it may not fix", superblk: "errors.txt", exit: 4,
+			wantRun: "-f -p /dev/sda1", want: CheckResult{Reason: ReasonDirty, Outcome: CheckErrors, ReadOnly: true}, readOnly: true,
+		},
+		{
+			name: "repair asked for", superblk: "clean.txt", repair: true, exit: 1,
+			wantRun: "-f -y /dev/sda1", want: CheckResult{Reason: ReasonRepair, Outcome: CheckRepaired},
+		},
+		{
+			name: "e2fsck cannot run", superblk: "unclean-shutdown.txt", exit: 8,
+			wantRun: "-f -p /dev/sda1", want: CheckResult{Reason: ReasonDirty, Outcome: CheckFailed},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var ran string
+			c := NewChecker(t.TempDir())
+			c.Run = func(name string, args ...string) ([]byte, error) {
+				switch name {
+				case "dumpe2fs":
+					if tt.superblk == "" {
+						return []byte("dumpe2fs: Bad magic number in super-block while trying to open /dev/sda1\n"), exitStatus(1)
+					}
+					out, err := os.ReadFile(filepath.Join("testdata", "dumpe2fs", tt.superblk))
+					if tt.superblk == "clean.txt" {
+						yesterday := time.Now().Add(-24 * time.Hour).Format(time.ANSIC)
+						out = lastChecked.ReplaceAll(out, []byte("Last checked:             "+yesterday))
+					}
+					return out, err
+				case "e2fsck":
+					ran = strings.Join(args, " ")
+					if tt.exit != 0 {
+						return []byte("/dev/sda1: 12/61054976 files"), exitStatus(tt.exit)
+					}
+					return nil, nil
+				}
+				return nil, fmt.Errorf("unexpected %s", name)
+			}
+			if err := c.SetSchedule(tt.checkDays, 0); err != nil {
+				t.Fatal(err)
+			}
+			if err := c.RequestRepair(tt.repair); err != nil {
+				t.Fatal(err)
+			}
+
+			if ro := c.BeforeMount("/dev/sda1"); ro != tt.readOnly {
+				t.Errorf("read-only %v, want %v", ro, tt.readOnly)
+			}
+			if ran != tt.wantRun {
+				t.Errorf("e2fsck %q, want %q", ran, tt.wantRun)
+			}
+			s := c.State()
+			got, ok := s.LastCheck()
+			if ok != (tt.wantRun != "") {
+				t.Fatalf("recorded %v", s.Checks)
+			}
+			if ok && (got.Device != "/dev/sda1" || got.Reason != tt.want.Reason || got.Outcome != tt.want.Outcome || got.ReadOnly != tt.want.ReadOnly) {
+				t.Errorf("recorded %+v, want %+v", got, tt.want)
+			}
+			if s.Repair {
+				t.Error("the repair is still pending")
+			}
+			if w := c.Warnings(); (len(w) > 0) != (tt.readOnly || tt.exit == 8) {
+				t.Errorf("warnings %q", w)
+			}
+		})
+	}
+}
+
+func TestCheckerScrubs(t *testing.T) {
+	c := NewChecker(t.TempDir())
+	if s := c.State(); s.CheckDays != defaultCheckDays || s.ScrubDays != defaultScrubDays {
+		t.Errorf("default schedule %+v", s)
+	}
+	start := time.Now().Add(-time.Hour)
+	for i := range keepScrubs + 2 {
+		c.RecordScrub(ScrubResult{Started: start.Add(time.Duration(i) * time.Minute)})
+	}
+	last := start.Add((keepScrubs + 1) * time.Minute)
+	done := time.Now()
+	c.RecordScrub(ScrubResult{Started: last, Finished: &done, Mismatches: 128})
+
+	s := c.State()
+	if r, _ := s.LastScrub(); len(s.Scrubs) != keepScrubs || r.Mismatches != 128 || r.Finished == nil {
+		t.Errorf("%d scrubs kept, last %+v", len(s.Scrubs), r)
+	}
+	if w := c.Warnings(); len(w) != 1 || !strings.Contains(w[0], "128 sectors") {
+		t.Errorf("warnings %q", w)
+	}
+}
+
+func TestArrayChecks(t *testing.T) {
+	root := t.TempDir()
+	for _, dir := range []string{"dev/md", "sys/block/md127/md"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	os.Symlink("../md127", filepath.Join(root, "dev/md/strct"))
+	os.WriteFile(filepath.Join(root, "sys/block/md127/md/mismatch_cnt"), []byte("256\n"), 0644)
+
+	f := newFakeMdadm()
+	f.running = true
+	f.members = []string{"/dev/sda", "/dev/sdb"}
+	f.states["/dev/sda"], f.states["/dev/sdb"] = MemberActive, MemberActive
+	c := NewChecker(t.TempDir())
+	c.Run = func(name string, args ...string) ([]byte, error) {
+		if name == "dumpe2fs" {
+			return os.ReadFile(filepath.Join("testdata", "dumpe2fs", "errors.txt"))
+		}
+		return nil, exitStatus(4)
+	}
+	a := &Array{Device: ArrayDevice, Run: f.run, Checker: c, Sys: Sysfs{Root: root}}
+
+	if err := a.EnsureMounted(filepath.Join(t.TempDir(), "data")); err != nil {
+		t.Fatal(err)
+	}
+	if mount := f.calls[len(f.calls)-1]; !strings.HasPrefix(mount, "mount -o ro /dev/md/strct ") {
+		t.Errorf("mounted with %q", mount)
+	}
+
+	if err := a.Scrub(); err != nil || f.calls[len(f.calls)-1] != "mdadm --action=check /dev/md/strct" {
+		t.Errorf("scrub: %v, ran %q", err, f.calls)
+	}
+	if n, err := a.Mismatches(); n != 256 || err != nil {
+		t.Errorf("mismatches %d, %v", n, err)
+	}
+	a.Sys = Sysfs{Root: t.TempDir()}
+	if _, err := a.Mismatches(); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("mismatches of a mirror that is not running: %v", err)
+	}
+}
@@ -0,0 +1,126 @@
+package disk
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"log"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Event is a block device coming, going or changing, such as a card
+// pushed into a reader that was already plugged in.
+type Event struct {
+	Action string `json:"action"` // add, remove or change
+	Device string `json:"device"` // e.g. /dev/sdb1
+	Type   string `json:"type"`   // disk or partition
+	FSType string `json:"fsType,omitempty"`
+	UUID   string `json:"uuid,omitempty"`
+}
+
+var errHotplugUnsupported = errors.New("hotplug events need Linux")
+
+// Hotplug publishes the kernel's block device events to subscribers.
+type Hotplug struct {
+	mu   sync.Mutex
+	subs []chan Event
+}
+
+func NewHotplug() *Hotplug {
+	return &Hotplug{}
+}
+
+// Subscribe returns a channel of events. A subscriber that falls behind
+// misses events rather than holding up the others.
+func (h *Hotplug) Subscribe() <-chan Event {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	ch := make(chan Event, 16)
+	h.subs = append(h.subs, ch)
+	return ch
+}
+
+func (h *Hotplug) publish(e Event) {
+	log.Printf("[DISK] %s %s (%s)", e.Action, e.Device, e.Type)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, ch := range h.subs {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+// Start listens for events until the agent exits, reconnecting if the
+// socket fails. Subscribers keep working without it, just later.
+func (h *Hotplug) Start() error {
+	go func() {
+		for {
+			err := listenUevents(h.publish)
+			log.Printf("[DISK] Hotplug events unavailable: %v", err)
+			if errors.Is(err, errHotplugUnsupported) {
+				return
+			}
+			time.Sleep(time.Minute)
+		}
+	}()
+	return nil
+}
+
+// udevMagic marks messages udev forwards once it has handled an event.
+const udevMagic = 0xfeedcafe
+
+// parseUevent reads a block device event as the kernel or udev sends it.
+// The kernel's is "action@devpath" followed by NUL-separated KEY=value
+// pairs; udev's has a binary header saying where its pairs are.
+func parseUevent(msg []byte) (Event, bool) {
+	var body []byte
+	if bytes.HasPrefix(msg, []byte("libudev\x00")) {
+		if len(msg) < 24 || binary.BigEndian.Uint32(msg[8:12]) != udevMagic {
+			return Event{}, false
+		}
+		off := binary.NativeEndian.Uint32(msg[16:20])
+		n := binary.NativeEndian.Uint32(msg[20:24])
+		if uint64(off)+uint64(n) > uint64(len(msg)) {
+			return Event{}, false
+		}
+		body = msg[off : off+n]
+	} else {
+		i := bytes.IndexByte(msg, 0)
+		if i < 0 || !bytes.Contains(msg[:i], []byte("@")) {
+			return Event{}, false
+		}
+		body = msg[i+1:]
+	}
+
+	props := make(map[string]string)
+	for _, kv := range bytes.Split(body, []byte{0}) {
+		if k, v, ok := strings.Cut(string(kv), "="); ok {
+			props[k] = v
+		}
+	}
+	if props["SUBSYSTEM"] != "block" || props["DEVNAME"] == "" {
+		return Event{}, false
+	}
+	switch props["ACTION"] {
+	case "add", "remove", "change":
+	default:
+		return Event{}, false
+	}
+	// The kernel names the device, udev gives its path
+	name := filepath.Base(props["DEVNAME"])
+	if isVirtual(name) {
+		return Event{}, false
+	}
+	return Event{
+		Action: props["ACTION"],
+		Device: "/dev/" + name,
+		Type:   props["DEVTYPE"],
+		FSType: props["ID_FS_TYPE"],
+		UUID:   props["ID_FS_UUID"],
+	}, true
+}
@@ -0,0 +1,57 @@
+//go:build linux
+
+package disk
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// udevGroup is the netlink group udev re-broadcasts events on after it has
+// handled them, so its database already knows a new filesystem by then.
+const udevGroup = 2
+
+// listenUevents hands block device events to handle until the socket
+// fails.
+func listenUevents(handle func(Event)) error {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_KOBJECT_UEVENT)
+	if err != nil {
+		return fmt.Errorf("netlink socket: %w", err)
+	}
+	defer syscall.Close(fd)
+	if err := syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK, Groups: udevGroup}); err != nil {
+		return fmt.Errorf("netlink bind: %w", err)
+	}
+	// Anyone can send to the group; only root's messages are udev's
+	if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_PASSCRED, 1); err != nil {
+		return fmt.Errorf("netlink credentials: %w", err)
+	}
+
+	buf := make([]byte, 64<<10)
+	oob := make([]byte, syscall.CmsgSpace(syscall.SizeofUcred))
+	for {
+		n, oobn, _, _, err := syscall.Recvmsg(fd, buf, oob, 0)
+		if err == syscall.EINTR || err == syscall.ENOBUFS {
+			// ENOBUFS: events were dropped while we were busy
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("netlink receive: %w", err)
+		}
+		if !fromRoot(oob[:oobn]) {
+			continue
+		}
+		if e, ok := parseUevent(buf[:n]); ok {
+			handle(e)
+		}
+	}
+}
+
+func fromRoot(oob []byte) bool {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil || len(msgs) == 0 {
+		return false
+	}
+	cred, err := syscall.ParseUnixCredentials(&msgs[0])
+	return err == nil && cred.Uid == 0
+}
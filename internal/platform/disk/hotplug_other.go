@@ -0,0 +1,7 @@
+//go:build !linux
+
+package disk
+
+func listenUevents(handle func(Event)) error {
+	return errHotplugUnsupported
+}
@@ -0,0 +1,80 @@
+package disk
+
+import (
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+func kernelMsg(header string, props ...string) []byte {
+	return []byte(header + "\x00" + strings.Join(props, "\x00") + "\x00")
+}
+
+func udevMsg(props ...string) []byte {
+	body := []byte(strings.Join(props, "\x00") + "\x00")
+	msg := make([]byte, 40, 40+len(body))
+	copy(msg, "libudev\x00")
+	binary.BigEndian.PutUint32(msg[8:], udevMagic)
+	binary.NativeEndian.PutUint32(msg[12:], 40)
+	binary.NativeEndian.PutUint32(msg[16:], 40)
+	binary.NativeEndian.PutUint32(msg[20:], uint32(len(body)))
+	return append(msg, body...)
+}
+
+func TestParseUevent(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  []byte
+		want Event
+		ok   bool
+	}{
+		{
+			"kernel adds a partition",
+			kernelMsg("add@/devices/platform/usb2/2-2/host0/block/sda/sda1",
+				"ACTION=add", "DEVPATH=/devices/platform/usb2/2-2/host0/block/sda/sda1", "SUBSYSTEM=block", "DEVNAME=sda1", "DEVTYPE=partition", "SEQNUM=2113"),
+			Event{Action: "add", Device: "/dev/sda1", Type: "partition"},
+			true,
+		},
+		{
+			"udev has identified the filesystem",
+			udevMsg("ACTION=add", "SUBSYSTEM=block", "DEVNAME=/dev/sdb1", "DEVTYPE=partition", "ID_FS_TYPE=exfat", "ID_FS_UUID=3A21-7F0C"),
+			Event{Action: "add", Device: "/dev/sdb1", Type: "partition", FSType: "exfat", UUID: "3A21-7F0C"},
+			true,
+		},
+		{
+			"card pushed into a reader",
+			udevMsg("ACTION=change", "SUBSYSTEM=block", "DEVNAME=/dev/sdb", "DEVTYPE=disk", "DISK_MEDIA_CHANGE=1"),
+			Event{Action: "change", Device: "/dev/sdb", Type: "disk"},
+			true,
+		},
+		{
+			"drive removed",
+			kernelMsg("remove@/devices/pci/nvme/nvme0/nvme0n1", "ACTION=remove", "SUBSYSTEM=block", "DEVNAME=nvme0n1", "DEVTYPE=disk"),
+			Event{Action: "remove", Device: "/dev/nvme0n1", Type: "disk"},
+			true,
+		},
+		{"not a block device", kernelMsg("add@/devices/usb2/2-2", "ACTION=add", "SUBSYSTEM=usb", "DEVNAME=bus/usb/002/003"), Event{}, false},
+		{"loop device", kernelMsg("add@/devices/virtual/block/loop3", "ACTION=add", "SUBSYSTEM=block", "DEVNAME=loop3", "DEVTYPE=disk"), Event{}, false},
+		{"bind action", kernelMsg("bind@/devices/x", "ACTION=bind", "SUBSYSTEM=block", "DEVNAME=sda"), Event{}, false},
+		{"bad magic", append([]byte("libudev\x00\x00\x00\x00\x00"), make([]byte, 30)...), Event{}, false},
+		{"properties past the end", func() []byte { m := udevMsg("ACTION=add"); binary.NativeEndian.PutUint32(m[20:], 1<<20); return m }(), Event{}, false},
+		{"garbage", []byte("hello"), Event{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := parseUevent(tt.msg)
+			if ok != tt.ok || got != tt.want {
+				t.Errorf("got %+v %v, want %+v %v", got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+
+	h := NewHotplug()
+	a, b := h.Subscribe(), h.Subscribe()
+	for range 20 {
+		h.publish(Event{Action: "add", Device: "/dev/sdb"})
+	}
+	if e := <-a; e.Device != "/dev/sdb" || len(b) != cap(b) {
+		t.Errorf("subscribers got %+v, %d queued", e, len(b))
+	}
+}
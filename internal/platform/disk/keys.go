@@ -0,0 +1,325 @@
+package disk
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/scrypt"
+
+	"github.com/strct-org/strct-agent/internal/fsx"
+)
+
+// ErrPassphraseRequired means the drive was encrypted with a passphrase on
+// top of the device secret.
+var ErrPassphraseRequired = errors.New("the drive needs its passphrase")
+
+const (
+	keySize   = 64
+	scryptN   = 1 << 15
+	keyInfo   = "strct-disk-v1"
+	machineID = "/etc/machine-id"
+)
+
+// keyFile is what the device keeps about the drive key. The key itself is
+// never stored: it is derived from a random secret that lives on the
+// device, the machine id and, if the user chose one, a passphrase. A drive
+// taken out of the device is unreadable on its own; with a passphrase, so
+// is the whole device.
+type keyFile struct {
+	Secret     []byte `json:"secret"`
+	Passphrase bool   `json:"passphrase"`
+	Salt       []byte `json:"salt,omitempty"`
+	N          int    `json:"n,omitempty"`
+}
+
+func (f *keyFile) derive(passphrase, machine string) ([]byte, error) {
+	ikm := f.Secret
+	if f.Passphrase {
+		if passphrase == "" {
+			return nil, ErrPassphraseRequired
+		}
+		pw, err := scrypt.Key([]byte(passphrase), f.Salt, f.N, 8, 1, 32)
+		if err != nil {
+			return nil, err
+		}
+		ikm = append(append([]byte{}, f.Secret...), pw...)
+	}
+	key := make([]byte, keySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, ikm, []byte(machine), []byte(keyInfo)), key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// KeyStore derives the data drive's key from what it keeps in Dir. A key
+// change is written next to the current file first and only replaces it
+// once the drive accepts the new key, so a power cut halfway leaves one
+// of the two working.
+type KeyStore struct {
+	Dir string
+	// MachineID is read from /etc/machine-id when empty.
+	MachineID string
+
+	mu sync.Mutex
+}
+
+func NewKeyStore(dir string) *KeyStore {
+	return &KeyStore{Dir: dir}
+}
+
+func (k *KeyStore) path() string    { return filepath.Join(k.Dir, "drive-key.json") }
+func (k *KeyStore) pending() string { return k.path() + ".new" }
+
+func (k *KeyStore) machine() string {
+	if k.MachineID != "" {
+		return k.MachineID
+	}
+	data, _ := os.ReadFile(machineID)
+	return strings.TrimSpace(string(data))
+}
+
+func (k *KeyStore) read(p string) (*keyFile, error) {
+	data, err := os.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+	var f keyFile
+	if err := json.Unmarshal(data, &f); err != nil || len(f.Secret) == 0 {
+		return nil, fmt.Errorf("unreadable key file %s", p)
+	}
+	return &f, nil
+}
+
+// write puts f at p durably: the file and the folder entry are both on
+// disk before it returns, since a key that only made it to the page cache
+// is a drive nobody can open after a power cut.
+func (k *KeyStore) write(p string, f *keyFile) error {
+	data, _ := json.Marshal(f)
+	if err := os.MkdirAll(k.Dir, 0700); err != nil {
+		return err
+	}
+	return fsx.WriteFile(p, data, 0600)
+}
+
+// commit makes the pending key file the current one.
+func (k *KeyStore) commit() error {
+	if err := os.Rename(k.pending(), k.path()); err != nil {
+		return err
+	}
+	return fsx.SyncDir(k.Dir)
+}
+
+func newKeyFile(passphrase string) (*keyFile, error) {
+	f := &keyFile{Secret: make([]byte, 32)}
+	if _, err := rand.Read(f.Secret); err != nil {
+		return nil, err
+	}
+	if passphrase != "" {
+		f.Passphrase, f.N, f.Salt = true, scryptN, make([]byte, 16)
+		if _, err := rand.Read(f.Salt); err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// current is the key file in use: the committed one, or a pending one
+// left by a format that was cut short before it could be committed.
+func (k *KeyStore) current() (*keyFile, error) {
+	f, err := k.read(k.path())
+	if os.IsNotExist(err) {
+		if next, perr := k.read(k.pending()); perr == nil {
+			return next, nil
+		}
+	}
+	return f, err
+}
+
+// Exists reports whether a drive key was ever set up on this device.
+func (k *KeyStore) Exists() bool {
+	for _, p := range []string{k.path(), k.pending()} {
+		if _, err := os.Stat(p); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// NeedsPassphrase reports whether unlocking takes the user's passphrase.
+func (k *KeyStore) NeedsPassphrase() bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	f, err := k.current()
+	return err == nil && f.Passphrase
+}
+
+// Format encrypts d with a new key and keeps what derives it. Everything
+// on the drive is lost. The key file is on disk before the drive depends
+// on it. recovery, if set, goes in a second key slot so the drive can
+// still be opened without this device; see NewRecoveryKey.
+func (k *KeyStore) Format(d Manager, passphrase, recovery string) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	f, err := newKeyFile(passphrase)
+	if err != nil {
+		return err
+	}
+	key, err := f.derive(passphrase, k.machine())
+	if err != nil {
+		return err
+	}
+	// The pending file stays if the format fails: the drive may have
+	// taken the key before the failure, and Unlock tries it
+	if err := k.write(k.pending(), f); err != nil {
+		return err
+	}
+	if err := d.FormatEncrypted(key); err != nil {
+		return err
+	}
+	if err := k.commit(); err != nil {
+		return err
+	}
+	if recovery != "" {
+		if err := d.AddKey(key, recoverySecret(recovery)); err != nil {
+			return fmt.Errorf("adding the recovery key: %w", err)
+		}
+	}
+	return nil
+}
+
+// Unlock opens d. A key change or format that was cut short is finished
+// or dropped, depending on which key the drive ended up with.
+func (k *KeyStore) Unlock(d Manager, passphrase string) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if !d.IsEncrypted() || d.IsUnlocked() {
+		return nil
+	}
+	cur, err := k.read(k.path())
+	if err == nil {
+		key, derr := cur.derive(passphrase, k.machine())
+		if derr != nil {
+			return derr
+		}
+		err = d.Unlock(key)
+		if !errors.Is(err, ErrWrongKey) {
+			if err == nil {
+				os.Remove(k.pending())
+			}
+			return err
+		}
+	}
+
+	// Only a missing current file or a wrong key gets this far
+	next, perr := k.read(k.pending())
+	if perr != nil {
+		return err
+	}
+	key, perr := next.derive(passphrase, k.machine())
+	if perr == nil {
+		perr = d.Unlock(key)
+	}
+	if perr != nil {
+		if os.IsNotExist(err) {
+			return perr
+		}
+		return err
+	}
+	return k.commit()
+}
+
+// Recover opens d with its recovery key and enrolls a new device key with
+// no passphrase, for when the passphrase or the device's key file is lost.
+// The recovery key keeps working afterwards.
+func (k *KeyStore) Recover(d Manager, code string) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	secret := recoverySecret(code)
+	if !d.IsUnlocked() {
+		if err := d.Unlock(secret); err != nil {
+			return err
+		}
+	}
+	next, err := newKeyFile("")
+	if err != nil {
+		return err
+	}
+	key, err := next.derive("", k.machine())
+	if err != nil {
+		return err
+	}
+	if err := k.write(k.pending(), next); err != nil {
+		return err
+	}
+	if err := d.AddKey(secret, key); err != nil {
+		os.Remove(k.pending())
+		return err
+	}
+	return k.commit()
+}
+
+// Rotate gives d a key from a fresh device secret, and sets or removes
+// the passphrase. passphrase is the current one, if any.
+func (k *KeyStore) Rotate(d Manager, passphrase, newPassphrase string) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	cur, err := k.read(k.path())
+	if err != nil {
+		return err
+	}
+	oldKey, err := cur.derive(passphrase, k.machine())
+	if err != nil {
+		return err
+	}
+	next, err := newKeyFile(newPassphrase)
+	if err != nil {
+		return err
+	}
+	newKey, err := next.derive(newPassphrase, k.machine())
+	if err != nil {
+		return err
+	}
+	if err := k.write(k.pending(), next); err != nil {
+		return err
+	}
+	if err := d.ChangeKey(oldKey, newKey); err != nil {
+		os.Remove(k.pending())
+		return err
+	}
+	return k.commit()
+}
+
+// recoveryBytes is the recovery key's strength: 160 bits, 32 characters.
+const recoveryBytes = 20
+
+// NewRecoveryKey returns a random recovery key in groups of four, for the
+// user to write down. It is shown once and never stored on the device.
+func NewRecoveryKey() (string, error) {
+	b := make([]byte, recoveryBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	code := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b)
+	groups := make([]string, 0, len(code)/4)
+	for len(code) > 4 {
+		groups = append(groups, code[:4])
+		code = code[4:]
+	}
+	return strings.Join(append(groups, code), "-"), nil
+}
+
+// recoverySecret is what the recovery slot holds: the key as the user
+// typed it, without separators and case.
+func recoverySecret(code string) []byte {
+	return []byte(strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(code)))
+}
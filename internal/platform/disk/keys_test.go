@@ -0,0 +1,169 @@
+package disk
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestKeyStore(t *testing.T) {
+	t.Run("device secret only", func(t *testing.T) {
+		k := &KeyStore{Dir: t.TempDir(), MachineID: "machine-a"}
+		d := &MockDisk{}
+		if err := k.Format(d, "", ""); err != nil {
+			t.Fatal(err)
+		}
+		if !d.Encrypted || !d.Unlocked || k.NeedsPassphrase() {
+			t.Fatalf("after format: %+v", d)
+		}
+		if fi, err := os.Stat(k.path()); err != nil || fi.Mode().Perm() != 0600 {
+			t.Errorf("key file: %v %v", fi, err)
+		}
+		d.Lock()
+		if err := d.EnsureMounted("/mnt/x"); !errors.Is(err, ErrLocked) {
+			t.Errorf("mounted a locked drive: %v", err)
+		}
+		if err := k.Unlock(d, ""); err != nil || !d.Unlocked {
+			t.Fatalf("unlock: %v", err)
+		}
+
+		// The same secret on another machine does not open the drive
+		d.Lock()
+		other := &KeyStore{Dir: k.Dir, MachineID: "machine-b"}
+		if err := other.Unlock(d, ""); !errors.Is(err, ErrWrongKey) {
+			t.Errorf("another machine: %v", err)
+		}
+	})
+
+	t.Run("passphrase", func(t *testing.T) {
+		k := &KeyStore{Dir: t.TempDir(), MachineID: "machine-a"}
+		d := &MockDisk{}
+		if err := k.Format(d, "correct horse", ""); err != nil {
+			t.Fatal(err)
+		}
+		d.Lock()
+		if !k.NeedsPassphrase() {
+			t.Error("passphrase not recorded")
+		}
+		if err := k.Unlock(d, ""); !errors.Is(err, ErrPassphraseRequired) {
+			t.Errorf("no passphrase: %v", err)
+		}
+		if err := k.Unlock(d, "wrong horse"); !errors.Is(err, ErrWrongKey) {
+			t.Errorf("wrong passphrase: %v", err)
+		}
+		if err := k.Unlock(d, "correct horse"); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := k.Rotate(d, "wrong horse", ""); !errors.Is(err, ErrWrongKey) {
+			t.Errorf("rotate with the wrong passphrase: %v", err)
+		}
+		if err := k.Rotate(d, "correct horse", ""); err != nil {
+			t.Fatal(err)
+		}
+		d.Lock()
+		if k.NeedsPassphrase() || k.Unlock(d, "") != nil {
+			t.Error("passphrase was not removed")
+		}
+	})
+
+	t.Run("interrupted rotation", func(t *testing.T) {
+		k := &KeyStore{Dir: t.TempDir(), MachineID: "machine-a"}
+		d := &MockDisk{}
+		if err := k.Format(d, "", ""); err != nil {
+			t.Fatal(err)
+		}
+		before, _ := os.ReadFile(k.path())
+		if err := k.Rotate(d, "", ""); err != nil {
+			t.Fatal(err)
+		}
+		after, _ := os.ReadFile(k.path())
+
+		// The drive took the new key but the file was not renamed yet
+		os.WriteFile(k.path(), before, 0600)
+		os.WriteFile(k.pending(), after, 0600)
+		d.Lock()
+		if err := k.Unlock(d, ""); err != nil {
+			t.Fatal(err)
+		}
+		if got, _ := os.ReadFile(k.path()); string(got) != string(after) {
+			t.Error("finished rotation was not kept")
+		}
+
+		// The drive never took the new key
+		os.WriteFile(k.pending(), before, 0600)
+		d.Lock()
+		if err := k.Unlock(d, ""); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(k.pending()); !os.IsNotExist(err) {
+			t.Error("abandoned key was kept")
+		}
+	})
+
+	t.Run("key is kept before the drive takes it", func(t *testing.T) {
+		k := &KeyStore{Dir: t.TempDir(), MachineID: "machine-a"}
+		var kept bool
+		d := &MockDisk{Progress: func(stage string) {
+			if stage == "encrypt" {
+				_, err := os.Stat(k.pending())
+				kept = err == nil
+			}
+		}}
+		if err := k.Format(d, "", ""); err != nil {
+			t.Fatal(err)
+		}
+		if !kept {
+			t.Error("the drive was encrypted before its key was on disk")
+		}
+
+		// Power was cut after luksFormat, before the key file was renamed
+		os.Rename(k.path(), k.pending())
+		d.Lock()
+		if !k.Exists() {
+			t.Error("an unfinished format does not count as a key")
+		}
+		if err := k.Unlock(d, ""); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(k.path()); err != nil {
+			t.Errorf("unfinished format was not committed: %v", err)
+		}
+	})
+
+	t.Run("recovery key", func(t *testing.T) {
+		k := &KeyStore{Dir: t.TempDir(), MachineID: "machine-a"}
+		d := &MockDisk{}
+		code, err := NewRecoveryKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(code) != 39 || strings.Count(code, "-") != 7 {
+			t.Errorf("recovery key %q", code)
+		}
+		if err := k.Format(d, "correct horse", code); err != nil {
+			t.Fatal(err)
+		}
+		d.Lock()
+		if err := k.Recover(d, "AAAA-"+code[5:]); !errors.Is(err, ErrWrongKey) {
+			t.Errorf("wrong recovery key: %v", err)
+		}
+
+		// The passphrase is forgotten; the key is typed in lower case
+		if err := k.Recover(d, strings.ToLower(strings.ReplaceAll(code, "-", " "))); err != nil {
+			t.Fatal(err)
+		}
+		if !d.Unlocked || k.NeedsPassphrase() {
+			t.Fatalf("after recovery: %+v", d)
+		}
+		d.Lock()
+		if err := k.Unlock(d, ""); err != nil {
+			t.Errorf("new device key: %v", err)
+		}
+		d.Lock()
+		if err := d.Unlock(recoverySecret(code)); err != nil {
+			t.Errorf("recovery key stopped working: %v", err)
+		}
+	})
+}
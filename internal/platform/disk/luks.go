@@ -0,0 +1,117 @@
+package disk
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+// MapperName is the device-mapper name an unlocked data drive appears
+// under, as /dev/mapper/strct_data.
+const MapperName = "strct_data"
+
+var (
+	ErrWrongKey = errors.New("the key does not unlock the drive")
+	ErrLocked   = errors.New("the drive is encrypted and locked")
+)
+
+// cryptsetup exits with 2 when no key slot accepts the key.
+const cryptsetupBadKey = 2
+
+// cryptsetup runs cryptsetup with the keys as its input: the first on
+// stdin, a second on /dev/fd/3.
+func (d *RealDisk) cryptsetup(keys [][]byte, args ...string) error {
+	_, err := d.runInput(keys, "cryptsetup", args...)
+	var exit *exec.ExitError
+	if errors.As(err, &exit) && exit.ExitCode() == cryptsetupBadKey {
+		return ErrWrongKey
+	}
+	if err != nil {
+		return fmt.Errorf("cryptsetup %s: %w", args[0], err)
+	}
+	return nil
+}
+
+func (d *RealDisk) mapperPath() string {
+	return "/dev/mapper/" + MapperName
+}
+
+// IsEncrypted reports whether the data partition is a LUKS container.
+func (d *RealDisk) IsEncrypted() bool {
+	_, err := d.run("cryptsetup", "isLuks", d.getPartitionPath())
+	return err == nil
+}
+
+// IsUnlocked reports whether the container is open.
+func (d *RealDisk) IsUnlocked() bool {
+	_, err := os.Stat(d.mapperPath())
+	return err == nil
+}
+
+func (d *RealDisk) Unlock(key []byte) error {
+	if d.IsUnlocked() {
+		return nil
+	}
+	return d.cryptsetup([][]byte{key}, "open", "--type", "luks2", "--key-file", "-", d.getPartitionPath(), MapperName)
+}
+
+// Lock closes the container. The filesystem must be unmounted first.
+func (d *RealDisk) Lock() error {
+	if !d.IsUnlocked() {
+		return nil
+	}
+	return d.cryptsetup(nil, "close", MapperName)
+}
+
+// FormatEncrypted is Format with a LUKS2 container between the partition
+// and the filesystem. The drive is left unlocked.
+func (d *RealDisk) FormatEncrypted(key []byte) error {
+	fmt.Printf("[DISK] REAL ENCRYPTED FORMATTING INITIATED ON %s\n", d.DevicePath)
+	d.Lock()
+
+	partPath, err := d.partition()
+	if err != nil {
+		return err
+	}
+
+	d.stage("encrypt")
+	if err := d.cryptsetup([][]byte{key}, "luksFormat", "--type", "luks2", "--batch-mode", "--key-file", "-", partPath); err != nil {
+		return err
+	}
+	if err := d.Unlock(key); err != nil {
+		return err
+	}
+	d.learnUUID(partPath)
+	d.stage("mkfs")
+	_, err = d.run("mkfs.ext4", "-F", d.mapperPath())
+	return err
+}
+
+// ChangeKey replaces the key slot oldKey opens with newKey.
+func (d *RealDisk) ChangeKey(oldKey, newKey []byte) error {
+	return d.withNewKey("luksChangeKey", oldKey, newKey)
+}
+
+// AddKey puts newKey in a free key slot, next to the one key opens.
+func (d *RealDisk) AddKey(key, newKey []byte) error {
+	return d.withNewKey("luksAddKey", key, newKey)
+}
+
+// withNewKey runs a cryptsetup action that takes the current key on stdin
+// and a new one. The new key is handed over on a pipe rather than a file.
+func (d *RealDisk) withNewKey(action string, key, newKey []byte) error {
+	return d.cryptsetup([][]byte{key, newKey}, action, "--key-file", "-", d.getPartitionPath(), "/dev/fd/3")
+}
+
+// mountSource is what EnsureMounted mounts: the partition, or the open
+// container on an encrypted drive.
+func (d *RealDisk) mountSource() (string, error) {
+	if !d.IsEncrypted() {
+		return d.getPartitionPath(), nil
+	}
+	if !d.IsUnlocked() {
+		return "", ErrLocked
+	}
+	return d.mapperPath(), nil
+}
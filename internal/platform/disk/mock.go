@@ -1,6 +1,7 @@
 package disk
 
 import (
+	"bytes"
 	"fmt"
 	"time"
 )
@@ -8,6 +9,21 @@ import (
 type MockDisk struct {
 	VirtualPath string
 	IsFormatted bool
+
+	// Encrypted drives keep their key so tests can check what unlocks them
+	Encrypted bool
+	Unlocked  bool
+	Key       []byte
+	Extra     [][]byte // keys added with AddKey
+
+	UUID     string
+	Progress func(stage string)
+}
+
+func (d *MockDisk) stage(name string) {
+	if d.Progress != nil {
+		d.Progress(name)
+	}
 }
 
 func (d *MockDisk) GetStatus() (string, error) {
@@ -19,10 +35,12 @@ func (d *MockDisk) GetStatus() (string, error) {
 
 func (d *MockDisk) Format() error {
 	fmt.Printf("[MOCK DISK] Simulating format of %s...\n", d.VirtualPath)
+	d.stage("partition")
 	fmt.Println("[MOCK DISK] Creating GPT Table...")
 	time.Sleep(1 * time.Second)
 	fmt.Println("[MOCK DISK] Creating Partition...")
 	time.Sleep(1 * time.Second)
+	d.stage("mkfs")
 	fmt.Println("[MOCK DISK] Running mkfs.ext4...")
 	time.Sleep(2 * time.Second)
 	
@@ -32,6 +50,9 @@ func (d *MockDisk) Format() error {
 }
 
 func (d *MockDisk) EnsureMounted(mountPoint string) error {
+	if d.Encrypted && !d.Unlocked {
+		return ErrLocked
+	}
 	fmt.Printf("[MOCK DISK] Ensuring %s is mounted to %s...\n", d.VirtualPath, mountPoint)
 	
 	time.Sleep(200 * time.Millisecond)
@@ -43,4 +64,75 @@ func (d *MockDisk) EnsureMounted(mountPoint string) error {
 	fmt.Printf("[MOCK DISK] Mounted partition to %s successfully.\n", mountPoint)
 	
 	return nil
-}
\ No newline at end of file
+}
+
+func (d *MockDisk) PartitionUUID() string {
+	if d.UUID == "" && d.IsFormatted {
+		d.UUID = "00000000-0000-4000-8000-000000000000"
+	}
+	return d.UUID
+}
+
+func (d *MockDisk) FormatEncrypted(key []byte) error {
+	fmt.Printf("[MOCK DISK] Simulating encrypted format of %s...\n", d.VirtualPath)
+	d.stage("partition")
+	d.stage("encrypt")
+	d.stage("mkfs")
+	d.IsFormatted, d.Encrypted, d.Unlocked = true, true, true
+	d.Key, d.Extra = bytes.Clone(key), nil
+	return nil
+}
+
+func (d *MockDisk) IsEncrypted() bool { return d.Encrypted }
+
+func (d *MockDisk) IsUnlocked() bool { return !d.Encrypted || d.Unlocked }
+
+func (d *MockDisk) Unlock(key []byte) error {
+	if !d.Encrypted || d.Unlocked {
+		return nil
+	}
+	if !d.opens(key) {
+		return ErrWrongKey
+	}
+	d.Unlocked = true
+	return nil
+}
+
+func (d *MockDisk) opens(key []byte) bool {
+	if bytes.Equal(key, d.Key) {
+		return true
+	}
+	for _, k := range d.Extra {
+		if bytes.Equal(key, k) {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *MockDisk) Lock() error {
+	d.Unlocked = false
+	return nil
+}
+
+func (d *MockDisk) ChangeKey(oldKey, newKey []byte) error {
+	if !d.Encrypted {
+		return ErrLocked
+	}
+	if !bytes.Equal(oldKey, d.Key) {
+		return ErrWrongKey
+	}
+	d.Key = bytes.Clone(newKey)
+	return nil
+}
+
+func (d *MockDisk) AddKey(key, newKey []byte) error {
+	if !d.Encrypted {
+		return ErrLocked
+	}
+	if !d.opens(key) {
+		return ErrWrongKey
+	}
+	d.Extra = append(d.Extra, bytes.Clone(newKey))
+	return nil
+}
@@ -0,0 +1,391 @@
+package disk
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// ArrayDevice is where the data mirror is assembled. It is created
+// without a home host, so any device it is moved to assembles it under
+// the same name.
+const ArrayDevice = "/dev/md/strct"
+
+// Array states. A mirror resyncs after it is created or shut down
+// uncleanly, and rebuilds onto a replacement for a failed member.
+const (
+	ArrayClean      = "clean"
+	ArrayResyncing  = "resyncing"
+	ArrayDegraded   = "degraded" // running on one member
+	ArrayRebuilding = "rebuilding"
+	ArrayChecking   = "checking"
+	ArrayStopped    = "stopped"
+)
+
+// Member states.
+const (
+	MemberActive     = "active"
+	MemberRebuilding = "rebuilding"
+	MemberSpare      = "spare"
+	MemberFaulty     = "faulty"
+)
+
+var errNotEncrypted = errors.New("the mirror is not encrypted")
+
+// ArrayStatus is what mdadm reports about the mirror.
+type ArrayStatus struct {
+	Device     string   `json:"device"`
+	UUID       string   `json:"uuid"` // the array's, which assembles it
+	Level      string   `json:"level"`
+	State      string   `json:"state"`
+	Progress   *float64 `json:"progress,omitempty"` // percent through a resync, rebuild or check
+	Size       uint64   `json:"size"`
+	MemberSize uint64   `json:"memberSize"` // a replacement must be at least this big
+	Devices    int      `json:"devices"`    // members the mirror is meant to have
+	Members    []Member `json:"members"`
+}
+
+type Member struct {
+	Device string `json:"device"`
+	State  string `json:"state"`
+}
+
+// Member returns the member at device, if it is one.
+func (s ArrayStatus) Member(device string) (Member, bool) {
+	for _, m := range s.Members {
+		if m.Device == device {
+			return m, true
+		}
+	}
+	return Member{}, false
+}
+
+// Active counts the members holding a full copy of the data.
+func (s ArrayStatus) Active() int {
+	n := 0
+	for _, m := range s.Members {
+		if m.State == MemberActive {
+			n++
+		}
+	}
+	return n
+}
+
+// Array is a RAID1 mirror of whole drives run by mdadm, with one ext4
+// filesystem on it. It is a Manager like a single drive, so it can be
+// formatted, mounted and switched to in the same way.
+type Array struct {
+	Device string
+	// UUID names the filesystem, ArrayUUID the array itself; both are
+	// known once it is created.
+	UUID      string
+	ArrayUUID string
+
+	// Members are the drives a Format builds the mirror from.
+	Members []string
+
+	Run      CommandRunner
+	Progress func(stage string)
+	// Checker, if set, checks the filesystem before it is mounted.
+	Checker *Checker
+	// Sys is where the kernel reports on the running array; System if
+	// unset.
+	Sys Sysfs
+}
+
+// NewArray returns the mirror to be built from members.
+func NewArray(members []string, progress func(stage string)) *Array {
+	return &Array{Device: ArrayDevice, Members: members, Run: Exec, Progress: progress}
+}
+
+func (a *Array) stage(name string) {
+	if a.Progress != nil {
+		a.Progress(name)
+	}
+}
+
+// Detail asks mdadm for the state of the running mirror.
+func (a *Array) Detail() (ArrayStatus, error) {
+	out, err := a.Run("mdadm", "--detail", a.Device)
+	if err != nil {
+		return ArrayStatus{}, err
+	}
+	st, err := parseDetail(out)
+	st.Device = a.Device
+	return st, err
+}
+
+func (a *Array) GetStatus() (string, error) {
+	st, err := a.Detail()
+	if err != nil {
+		return "Not Found", nil
+	}
+	status := fmt.Sprintf("RAID1 %s (%s)", st.State, formatSize(st.Size))
+	if st.Progress != nil {
+		status += fmt.Sprintf(", %.1f%%", *st.Progress)
+	}
+	return status, nil
+}
+
+// Format builds the mirror from its members, erasing both, and puts a
+// filesystem on it. The initial resync runs on in the background.
+func (a *Array) Format() error {
+	if len(a.Members) != 2 {
+		return fmt.Errorf("a mirror needs two drives, not %d", len(a.Members))
+	}
+	a.stage("partition")
+	a.UUID, a.ArrayUUID = "", ""
+	for _, m := range a.Members {
+		// Old signatures, including an earlier array's, would be found
+		// again at boot
+		if _, err := a.Run("wipefs", "-a", m); err != nil {
+			return err
+		}
+	}
+
+	a.stage("mirror")
+	args := []string{"--create", a.Device, "--run", "--level=1", "--raid-devices=2",
+		"--metadata=1.2", "--bitmap=internal", "--homehost=any", "--name=strct"}
+	if _, err := a.Run("mdadm", append(args, a.Members...)...); err != nil {
+		return err
+	}
+	st, err := a.Detail()
+	if err != nil {
+		return err
+	}
+	a.ArrayUUID = st.UUID
+
+	a.stage("mkfs")
+	if _, err := a.Run("mkfs.ext4", "-F", a.Device); err != nil {
+		return err
+	}
+	a.PartitionUUID()
+	return nil
+}
+
+// Assemble starts the mirror from whichever members are attached, even
+// if that is only one of them.
+func (a *Array) Assemble() error {
+	st, err := a.Detail()
+	switch {
+	case err == nil && st.State != ArrayStopped:
+		return nil
+	case err == nil:
+		// udev put it together as far as it could, but not with a member
+		// missing
+		_, err = a.Run("mdadm", "--run", a.Device)
+		return err
+	case a.ArrayUUID == "":
+		return fmt.Errorf("mirror %s is not running", a.Device)
+	}
+	_, err = a.Run("mdadm", "--assemble", a.Device, "--uuid="+a.ArrayUUID, "--run")
+	return err
+}
+
+func (a *Array) EnsureMounted(mountPoint string) error {
+	if err := a.Assemble(); err != nil {
+		return err
+	}
+	if _, err := a.Run("mountpoint", "-q", mountPoint); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(mountPoint, 0755); err != nil {
+		return err
+	}
+	args := []string{a.Device, mountPoint}
+	if a.Checker != nil && a.Checker.BeforeMount(a.Device) {
+		args = append([]string{"-o", "ro"}, args...)
+	}
+	_, err := a.Run("mount", args...)
+	return err
+}
+
+func (a *Array) PartitionUUID() string {
+	if a.UUID == "" {
+		if out, err := a.Run("blkid", "-s", "UUID", "-o", "value", a.Device); err == nil {
+			a.UUID = strings.TrimSpace(string(out))
+		}
+	}
+	return a.UUID
+}
+
+// Replace swaps old out of the mirror for replacement, which is erased.
+// old may be "" once the kernel has dropped a member that failed or was
+// unplugged. The data is then copied over in the background.
+func (a *Array) Replace(old, replacement string) error {
+	if old != "" {
+		// A member that has already failed cannot be failed again
+		a.Run("mdadm", a.Device, "--fail", old)
+		if _, err := a.Run("mdadm", a.Device, "--remove", old); err != nil {
+			return err
+		}
+	}
+	if _, err := a.Run("wipefs", "-a", replacement); err != nil {
+		return err
+	}
+	_, err := a.Run("mdadm", a.Device, "--add", replacement)
+	return err
+}
+
+// Stop shuts the mirror down once its filesystem is unmounted, marking
+// both members clean, so they can be unplugged. Assemble starts it again.
+func (a *Array) Stop() error {
+	_, err := a.Run("mdadm", "--stop", a.Device)
+	return err
+}
+
+// Scrub has the kernel read both members through and compare them, so a
+// sector gone bad on the copy that is rarely read is found while the
+// other still holds it. It runs in the background; Detail reports the
+// mirror as checking until it is done.
+func (a *Array) Scrub() error {
+	_, err := a.Run("mdadm", "--action=check", a.Device)
+	return err
+}
+
+// Mismatches counts the sectors the last scrub found to differ between
+// the members.
+func (a *Array) Mismatches() (uint64, error) {
+	sys := a.Sys
+	if sys.Root == "" {
+		sys = System
+	}
+	// The kernel knows the mirror by its md number, which the name links to
+	target, err := os.Readlink(sys.path(a.Device))
+	if err != nil {
+		return 0, err
+	}
+	value := sys.read("sys/block", filepath.Base(target), "md/mismatch_cnt")
+	return strconv.ParseUint(value, 10, 64)
+}
+
+func (a *Array) FormatEncrypted(key []byte) error {
+	return errors.New("an encrypted mirror is not supported")
+}
+
+func (a *Array) IsEncrypted() bool { return false }
+func (a *Array) IsUnlocked() bool  { return true }
+
+func (a *Array) Unlock(key []byte) error               { return errNotEncrypted }
+func (a *Array) Lock() error                           { return errNotEncrypted }
+func (a *Array) ChangeKey(oldKey, newKey []byte) error { return errNotEncrypted }
+func (a *Array) AddKey(key, newKey []byte) error       { return errNotEncrypted }
+
+// parseDetail reads the report of mdadm --detail:
+//
+//	         State : clean, degraded, recovering
+//	Rebuild Status : 42% complete
+//	          UUID : 3f1c2a8e:5b7d9e01:a2c4e6f8:1029384d
+//	   Number   Major   Minor   RaidDevice State
+//	      0       8        0        0      active sync   /dev/sda
+//	      2       8       16        1      spare rebuilding   /dev/sdb
+func parseDetail(out []byte) (ArrayStatus, error) {
+	var st ArrayStatus
+	var state string
+	table := false
+	sc := bufio.NewScanner(bytes.NewReader(out))
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if strings.HasPrefix(line, "Number") {
+			table = true
+			continue
+		}
+		if table {
+			if m, ok := parseMember(line); ok {
+				st.Members = append(st.Members, m)
+			}
+			continue
+		}
+		key, value, ok := strings.Cut(line, " : ")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		switch strings.TrimSpace(key) {
+		case "Raid Level":
+			st.Level = value
+		case "State":
+			state = value
+		case "UUID":
+			st.UUID = value
+		case "Raid Devices":
+			st.Devices, _ = strconv.Atoi(value)
+		case "Array Size":
+			st.Size = kibibytes(value)
+		case "Used Dev Size":
+			st.MemberSize = kibibytes(value)
+		case "Rebuild Status", "Resync Status", "Check Status":
+			if pct, err := strconv.ParseFloat(strings.TrimSuffix(firstField(value), "%"), 64); err == nil {
+				st.Progress = &pct
+			}
+		}
+	}
+	if state == "" {
+		return st, errors.New("mdadm --detail: no state")
+	}
+
+	has := func(flag string) bool {
+		for _, f := range strings.Split(state, ",") {
+			if strings.TrimSpace(f) == flag {
+				return true
+			}
+		}
+		return false
+	}
+	switch {
+	case has("inactive"):
+		st.State = ArrayStopped
+	case has("recovering"):
+		st.State = ArrayRebuilding
+	case has("degraded"):
+		st.State = ArrayDegraded
+	case has("resyncing"):
+		st.State = ArrayResyncing
+	case has("checking"):
+		st.State = ArrayChecking
+	default:
+		st.State = ArrayClean
+	}
+	return st, nil
+}
+
+// parseMember reads a row of the member table. A slot with no drive in it
+// ("removed") is not a member.
+func parseMember(line string) (Member, bool) {
+	fields := strings.Fields(line)
+	if len(fields) < 5 || !strings.HasPrefix(fields[len(fields)-1], "/dev/") {
+		return Member{}, false
+	}
+	m := Member{Device: fields[len(fields)-1]}
+	flags := " " + strings.Join(fields[4:len(fields)-1], " ") + " "
+	switch {
+	case strings.Contains(flags, " faulty "):
+		m.State = MemberFaulty
+	case strings.Contains(flags, " rebuilding "):
+		m.State = MemberRebuilding
+	case strings.Contains(flags, " active "):
+		m.State = MemberActive
+	default:
+		m.State = MemberSpare
+	}
+	return m, true
+}
+
+// kibibytes reads a size such as "976630464 (931.35 GiB 1000.07 GB)",
+// which mdadm gives in KiB.
+func kibibytes(value string) uint64 {
+	n, _ := strconv.ParseUint(firstField(value), 10, 64)
+	return n * 1024
+}
+
+func firstField(s string) string {
+	if f := strings.Fields(s); len(f) > 0 {
+		return f[0]
+	}
+	return ""
+}
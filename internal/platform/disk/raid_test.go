@@ -0,0 +1,285 @@
+package disk
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func pct(f float64) *float64 { return &f }
+
+func TestParseDetail(t *testing.T) {
+	const size = 976630464 * 1024
+	tests := []struct {
+		file string
+		want ArrayStatus
+	}{
+		{"resyncing.txt", ArrayStatus{
+			Level: "raid1", State: ArrayResyncing, Progress: pct(7), Size: size, MemberSize: size, Devices: 2,
+			Members: []Member{{"/dev/sda", MemberActive}, {"/dev/sdb", MemberActive}},
+		}},
+		{"degraded.txt", ArrayStatus{
+			Level: "raid1", State: ArrayDegraded, Size: size, MemberSize: size, Devices: 2,
+			Members: []Member{{"/dev/sda", MemberActive}, {"/dev/sdb", MemberFaulty}},
+		}},
+		{"recovering.txt", ArrayStatus{
+			Level: "raid1", State: ArrayRebuilding, Progress: pct(42), Size: size, MemberSize: size, Devices: 2,
+			Members: []Member{{"/dev/sda", MemberActive}, {"/dev/sdc", MemberRebuilding}},
+		}},
+		{"inactive.txt", ArrayStatus{
+			Level: "raid1", State: ArrayStopped,
+			Members: []Member{{"/dev/sda", MemberSpare}},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			out, err := os.ReadFile(filepath.Join("testdata", "mdadm", tt.file))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := parseDetail(out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.want.UUID = "3f1c2a8e:5b7d9e01:a2c4e6f8:1029384d"
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got  %+v\nwant %+v", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := parseDetail([]byte("mdadm: cannot open /dev/md/strct: No such file or directory\n")); err == nil {
+		t.Error("parsed an error message")
+	}
+}
+
+// fakeMdadm plays mdadm and the kernel's md driver for one mirror.
+type fakeMdadm struct {
+	running  bool
+	inactive bool // put together by udev but not started
+	members  []string
+	states   map[string]string
+	progress int // of a resync or rebuild; 100 when there is none
+	resync   bool
+	mounted  string
+	calls    []string
+}
+
+func newFakeMdadm() *fakeMdadm {
+	return &fakeMdadm{states: make(map[string]string), progress: 100}
+}
+
+func (f *fakeMdadm) run(name string, args ...string) ([]byte, error) {
+	f.calls = append(f.calls, strings.TrimSpace(name+" "+strings.Join(args, " ")))
+	last := args[len(args)-1]
+	switch name {
+	case "wipefs", "mkfs.ext4":
+		return nil, nil
+	case "blkid":
+		return []byte("0d6f3c52-9a1e-4b7c-8f20-6e4d2a1b9c33\n"), nil
+	case "mountpoint":
+		if f.mounted == last {
+			return nil, nil
+		}
+		return nil, errors.New("exit status 32")
+	case "mount":
+		f.mounted = last
+		return nil, nil
+	}
+
+	if !f.running && args[0] != "--create" && args[0] != "--assemble" {
+		return nil, errors.New("mdadm: cannot open /dev/md/strct: No such file or directory")
+	}
+	switch {
+	case args[0] == "--create":
+		f.running, f.resync, f.progress = true, true, 0
+		f.members = args[len(args)-2:]
+		for _, m := range f.members {
+			f.states[m] = MemberActive
+		}
+	case args[0] == "--assemble":
+		f.running = true
+	case args[0] == "--run":
+		f.inactive = false
+	case args[0] == "--action=check":
+	case args[0] == "--detail":
+		return f.detail(), nil
+	case args[1] == "--fail":
+		f.states[args[2]] = MemberFaulty
+	case args[1] == "--remove":
+		if f.states[args[2]] != MemberFaulty {
+			return nil, fmt.Errorf("mdadm: hot remove failed for %s: Device or resource busy", args[2])
+		}
+		delete(f.states, args[2])
+	case args[1] == "--add":
+		// It takes the slot of the member that was removed
+		for i, m := range f.members {
+			if _, ok := f.states[m]; !ok {
+				f.members[i] = args[2]
+				break
+			}
+		}
+		f.states[args[2]] = MemberRebuilding
+		f.progress = 0
+	default:
+		return nil, fmt.Errorf("unexpected mdadm %v", args)
+	}
+	return nil, nil
+}
+
+func (f *fakeMdadm) detail() []byte {
+	var b strings.Builder
+	b.WriteString("/dev/md/strct:\n        Raid Level : raid1\n")
+	if f.inactive {
+		b.WriteString("             State : inactive\n              UUID : 3f1c2a8e:5b7d9e01:a2c4e6f8:1029384d\n")
+		return []byte(b.String())
+	}
+	b.WriteString("        Array Size : 976630464 (931.39 GiB 1000.07 GB)\n     Used Dev Size : 976630464 (931.39 GiB 1000.07 GB)\n      Raid Devices : 2\n")
+
+	state, status := "clean", ""
+	active, rebuilding := 0, false
+	for _, s := range f.states {
+		switch s {
+		case MemberActive:
+			active++
+		case MemberRebuilding:
+			rebuilding = true
+		}
+	}
+	if active < 2 {
+		state += ", degraded"
+	}
+	switch {
+	case rebuilding && f.progress < 100:
+		state += ", recovering"
+		status = fmt.Sprintf("    Rebuild Status : %d%% complete\n", f.progress)
+	case f.resync && f.progress < 100:
+		state += ", resyncing"
+		status = fmt.Sprintf("     Resync Status : %d%% complete\n", f.progress)
+	}
+	fmt.Fprintf(&b, "             State : %s\n%s              UUID : 3f1c2a8e:5b7d9e01:a2c4e6f8:1029384d\n\n", state, status)
+	b.WriteString("    Number   Major   Minor   RaidDevice State\n")
+	for i, m := range f.members {
+		switch f.states[m] {
+		case MemberActive:
+			fmt.Fprintf(&b, "       %d       8       %d        %d      active sync   %s\n", i, i*16, i, m)
+		case MemberRebuilding:
+			fmt.Fprintf(&b, "       %d       8       %d        %d      spare rebuilding   %s\n", i, i*16, i, m)
+		case MemberFaulty:
+			fmt.Fprintf(&b, "       -       0        0        %d      removed\n\n       %d       8       %d        -      faulty   %s\n", i, i, i*16, m)
+		default:
+			fmt.Fprintf(&b, "       -       0        0        %d      removed\n", i)
+		}
+	}
+	return []byte(b.String())
+}
+
+// settle finishes whatever resync or rebuild is running.
+func (f *fakeMdadm) settle() {
+	f.progress, f.resync = 100, false
+	for m, s := range f.states {
+		if s == MemberRebuilding {
+			f.states[m] = MemberActive
+		}
+	}
+}
+
+func TestArray(t *testing.T) {
+	f := newFakeMdadm()
+	var stages []string
+	a := NewArray([]string{"/dev/sda", "/dev/sdb"}, func(s string) { stages = append(stages, s) })
+	a.Run = f.run
+
+	state := func(want string, active int) ArrayStatus {
+		t.Helper()
+		st, err := a.Detail()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if st.State != want || st.Active() != active {
+			t.Fatalf("state %s with %d active, want %s with %d: %+v", st.State, st.Active(), want, active, st)
+		}
+		return st
+	}
+
+	if _, err := a.Detail(); err == nil {
+		t.Fatal("detail of a mirror that does not exist yet")
+	}
+	f.calls = nil
+	if err := a.Format(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(stages, []string{"partition", "mirror", "mkfs"}) || a.ArrayUUID == "" || a.PartitionUUID() == "" {
+		t.Errorf("format: stages %v, array %q, filesystem %q", stages, a.ArrayUUID, a.UUID)
+	}
+	if f.calls[0] != "wipefs -a /dev/sda" || !strings.HasPrefix(f.calls[2], "mdadm --create /dev/md/strct --run --level=1") {
+		t.Errorf("format ran %q", f.calls)
+	}
+	if st := state(ArrayResyncing, 2); *st.Progress != 0 {
+		t.Errorf("resync progress %v", *st.Progress)
+	}
+
+	mnt := filepath.Join(t.TempDir(), "data")
+	for range 2 {
+		if err := a.EnsureMounted(mnt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if f.mounted != mnt || strings.Count(strings.Join(f.calls, "\n"), "mount /dev/md/strct") != 1 {
+		t.Errorf("mounted %q: %q", f.mounted, f.calls)
+	}
+	f.settle()
+	state(ArrayClean, 2)
+
+	// A member dies and the kernel kicks it out
+	f.states["/dev/sdb"] = MemberFaulty
+	if st := state(ArrayDegraded, 1); st.Members[1] != (Member{"/dev/sdb", MemberFaulty}) {
+		t.Errorf("failed member: %+v", st.Members)
+	}
+	if err := a.Replace("/dev/sdb", "/dev/sdc"); err != nil {
+		t.Fatal(err)
+	}
+	st := state(ArrayRebuilding, 1)
+	if m, _ := st.Member("/dev/sdc"); m.State != MemberRebuilding {
+		t.Errorf("replacement: %+v", st.Members)
+	}
+	f.progress = 42
+	if st := state(ArrayRebuilding, 1); *st.Progress != 42 {
+		t.Errorf("rebuild progress %v", *st.Progress)
+	}
+	f.settle()
+	state(ArrayClean, 2)
+
+	// Replacing a healthy member fails it first
+	if err := a.Replace("/dev/sda", "/dev/sdd"); err != nil {
+		t.Fatal(err)
+	}
+	if st := state(ArrayRebuilding, 1); st.Members[0] != (Member{"/dev/sdd", MemberRebuilding}) {
+		t.Errorf("after replacing a healthy member: %+v", st.Members)
+	}
+
+	// After a reboot the mirror is found by its UUID
+	f.running, f.mounted = false, ""
+	again := &Array{Device: ArrayDevice, ArrayUUID: a.ArrayUUID, Run: f.run}
+	if err := again.EnsureMounted(mnt); err != nil {
+		t.Fatal(err)
+	}
+	if want := "mdadm --assemble /dev/md/strct --uuid=" + a.ArrayUUID + " --run"; !strings.Contains(strings.Join(f.calls, "\n"), want) {
+		t.Errorf("ran %q, want %q", f.calls, want)
+	}
+
+	// udev assembled it but held back with a member missing
+	f.inactive = true
+	if err := again.Assemble(); err != nil || f.inactive {
+		t.Errorf("starting an inactive mirror: %v", err)
+	}
+
+	f.running = false
+	if err := (&Array{Device: ArrayDevice, Run: f.run}).Assemble(); err == nil {
+		t.Error("assembled a mirror without knowing its UUID")
+	}
+}
@@ -1,49 +1,63 @@
 package disk
 
 import (
-	"encoding/json"
 	"fmt"
-	"os/exec"
+	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 )
 
 type RealDisk struct {
 	DevicePath string
-}
 
-type lsblkOutput struct {
-	Blockdevices []blockDevice `json:"blockdevices"`
+	// UUID names the data partition, or the encrypted container on it,
+	// once known. It is then opened through /dev/disk/by-uuid, so another
+	// drive that comes up under DevicePath is never mounted in its place.
+	UUID string
+
+	// Progress, if set, is told each step of a format as it starts:
+	// partition, encrypt, mkfs.
+	Progress func(stage string)
+
+	// Checker, if set, checks the filesystem before it is mounted.
+	Checker *Checker
+
+	// Run and RunInput, if set, stand in for Exec and ExecInput.
+	Run      CommandRunner
+	RunInput InputRunner
 }
 
-type blockDevice struct {
-	Name       string        `json:"name"`
-	Size       string        `json:"size"`
-	Type       string        `json:"type"`
-	Mountpoint string        `json:"mountpoint"`
-	Children   []blockDevice `json:"children,omitempty"`
+func (d *RealDisk) stage(name string) {
+	if d.Progress != nil {
+		d.Progress(name)
+	}
 }
 
-func (d *RealDisk) GetStatus() (string, error) {
-	cmd := exec.Command("lsblk", "-J", "-o", "NAME,SIZE,TYPE,MOUNTPOINT", d.DevicePath)
-	output, err := cmd.Output()
-	if err != nil {
-		return "", fmt.Errorf("disk not found or error reading: %v", err)
+func (d *RealDisk) run(name string, args ...string) ([]byte, error) {
+	if d.Run != nil {
+		return d.Run(name, args...)
 	}
+	return Exec(name, args...)
+}
 
-	var data lsblkOutput
-	if err := json.Unmarshal(output, &data); err != nil {
-		return "", fmt.Errorf("failed to parse lsblk output: %v", err)
+func (d *RealDisk) runInput(input [][]byte, name string, args ...string) ([]byte, error) {
+	if d.RunInput != nil {
+		return d.RunInput(input, name, args...)
 	}
+	return ExecInput(input, name, args...)
+}
 
-	if len(data.Blockdevices) == 0 {
+func (d *RealDisk) GetStatus() (string, error) {
+	drive, ok := System.Drive(d.DevicePath)
+	if !ok {
 		return "Not Found", nil
 	}
 
-	dev := data.Blockdevices[0]
-	status := fmt.Sprintf("Raw/Unformatted (%s)", dev.Size)
+	status := fmt.Sprintf("Raw/Unformatted (%s)", formatSize(drive.Size))
 
-	if len(dev.Children) > 0 {
-		status = fmt.Sprintf("Formatted (%s)", dev.Size)
+	if len(drive.Partitions) > 0 {
+		status = fmt.Sprintf("Formatted (%s)", formatSize(drive.Size))
 	}
 
 	return status, nil
@@ -53,46 +67,143 @@ func (d *RealDisk) Format() error {
 	fmt.Printf("[DISK] REAL FORMATTING INITIATED ON %s\n", d.DevicePath)
 
 	// 1. Create Partition Table & Partition (Uses 100% of disk)
-	if err := exec.Command("parted", d.DevicePath, "--script", "mkpart", "primary", "ext4", "0%", "100%").Run(); err != nil {
+	partPath, err := d.partition()
+	if err != nil {
 		return err
 	}
 
-	// 2. Determine correct partition name (sda1 vs nvme0n1p1)
-	partPath := d.getPartitionPath()
-
-	// 3. Refresh kernel partition table
-	exec.Command("partprobe", d.DevicePath).Run()
-
-	// 4. Format
-	if err := exec.Command("mkfs.ext4", "-F", partPath).Run(); err != nil {
+	// 2. Format
+	d.stage("mkfs")
+	if _, err := d.run("mkfs.ext4", "-F", partPath); err != nil {
 		return err
 	}
 
+	d.learnUUID(partPath)
 	return nil
 }
 
 func (d *RealDisk) EnsureMounted(mountPoint string) error {
-	// check if mounted
-	cmd := exec.Command("grep", mountPoint, "/proc/mounts")
-	if err := cmd.Run(); err == nil {
-		return nil
+	if IsMountPoint(mountPoint) {
+		if d.mountedAt(mountPoint) {
+			return nil
+		}
+		// Whatever is there is not the data drive; mounting over it would
+		// hide it, and writing into it would fill the wrong filesystem
+		return fmt.Errorf("%s already holds another filesystem, not the data drive", mountPoint)
 	}
 
-	exec.Command("mkdir", "-p", mountPoint).Run()
+	os.MkdirAll(mountPoint, 0755)
+
+	// determine partition name, or the open container if encrypted
+	partPath, err := d.mountSource()
+	if err != nil {
+		return err
+	}
 
-	// determine partition name
-	partPath := d.getPartitionPath()
+	args := []string{partPath, mountPoint}
+	if d.Checker != nil && d.Checker.BeforeMount(partPath) {
+		args = append([]string{"-o", "ro"}, args...)
+	}
 
 	fmt.Printf("[DISK] Mounting %s to %s\n", partPath, mountPoint)
-	if err := exec.Command("mount", partPath, mountPoint).Run(); err != nil {
+	if _, err := d.run("mount", args...); err != nil {
 		return fmt.Errorf("failed to mount: %v", err)
 	}
 	return nil
 }
 
+// mountedAt reports whether the data partition, or the container open on
+// it, is what is mounted at dir.
+func (d *RealDisk) mountedAt(dir string) bool {
+	if d.UUID != "" {
+		_, p, ok := System.FindUUID(d.UUID)
+		return ok && p.Mountpoint == filepath.Clean(dir)
+	}
+	drive, ok := System.Drive(d.DevicePath)
+	if !ok {
+		return false
+	}
+	part := d.getPartitionPath()
+	for _, p := range drive.Partitions {
+		if p.Device == part {
+			return p.Mountpoint == filepath.Clean(dir)
+		}
+	}
+	return false
+}
+
+// partition replaces whatever is on the drive with one GPT partition
+// spanning all of it, and returns that partition's path.
+func (d *RealDisk) partition() (string, error) {
+	d.stage("partition")
+	d.UUID = ""
+	// Old signatures would let blkid recognise a stale filesystem
+	if _, err := d.run("wipefs", "-a", d.DevicePath); err != nil {
+		return "", err
+	}
+	if _, err := d.run("parted", d.DevicePath, "--script", "mklabel", "gpt", "mkpart", "primary", "ext4", "0%", "100%"); err != nil {
+		return "", err
+	}
+
+	// Refresh kernel partition table and wait for the device node
+	d.run("partprobe", d.DevicePath)
+	d.run("udevadm", "settle")
+	return d.getPartitionPath(), nil
+}
+
+// getPartitionPath returns the data partition.
 func (d *RealDisk) getPartitionPath() string {
-	if strings.Contains(d.DevicePath, "nvme") {
+	if d.UUID != "" {
+		return "/dev/disk/by-uuid/" + d.UUID
+	}
+	if drive, ok := System.Drive(d.DevicePath); ok {
+		for _, p := range drive.Partitions {
+			if p.Device != drive.Device {
+				return p.Device
+			}
+		}
+	}
+	// The kernel may not have caught up with a new partition table yet
+	if strings.Contains(d.DevicePath, "nvme") || strings.Contains(d.DevicePath, "mmcblk") {
 		return d.DevicePath + "p1"
 	}
 	return d.DevicePath + "1"
 }
+
+// PartitionUUID returns the UUID the data partition is known by, or "" if
+// it has none yet.
+func (d *RealDisk) PartitionUUID() string {
+	if d.UUID == "" {
+		d.learnUUID(d.getPartitionPath())
+	}
+	return d.UUID
+}
+
+// learnUUID picks up the UUID of a freshly written partition once udev has
+// recorded it.
+func (d *RealDisk) learnUUID(partPath string) {
+	d.run("udevadm", "settle")
+	drive, ok := System.Drive(d.DevicePath)
+	if !ok {
+		return
+	}
+	for _, p := range drive.Partitions {
+		if p.Device == partPath {
+			d.UUID = p.UUID
+		}
+	}
+}
+
+// formatSize prints a size the way lsblk does, e.g. 465.8G.
+func formatSize(n uint64) string {
+	const units = "BKMGTP"
+	v, i := float64(n), 0
+	for v >= 1024 && i < len(units)-1 {
+		v /= 1024
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%dB", n)
+	}
+	return strconv.FormatFloat(v, 'f', 1, 64) + string(units[i])
+}
@@ -0,0 +1,133 @@
+package disk
+
+import (
+	"errors"
+	"os/exec"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestRealDiskCommands(t *testing.T) {
+	var calls []string
+	var input [][]byte
+	var fail error
+	d := &RealDisk{DevicePath: "/dev/sdz"}
+	d.Run = func(name string, args ...string) ([]byte, error) {
+		calls = append(calls, strings.TrimSpace(name+" "+strings.Join(args, " ")))
+		return nil, nil
+	}
+	d.RunInput = func(in [][]byte, name string, args ...string) ([]byte, error) {
+		calls = append(calls, strings.TrimSpace(name+" "+strings.Join(args, " ")))
+		input = in
+		return nil, fail
+	}
+
+	if err := d.Format(); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"wipefs -a /dev/sdz",
+		"parted /dev/sdz --script mklabel gpt mkpart primary ext4 0% 100%",
+		"partprobe /dev/sdz",
+		"udevadm settle",
+		"mkfs.ext4 -F /dev/sdz1",
+		"udevadm settle",
+	}
+	if !reflect.DeepEqual(calls, want) {
+		t.Errorf("format ran %q", calls)
+	}
+
+	calls = nil
+	if err := d.FormatEncrypted([]byte("key")); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(calls, "\n"); !strings.Contains(got, "cryptsetup luksFormat --type luks2 --batch-mode --key-file - /dev/sdz1") ||
+		!strings.Contains(got, "cryptsetup open --type luks2 --key-file - /dev/sdz1 "+MapperName) ||
+		!strings.HasSuffix(got, "mkfs.ext4 -F /dev/mapper/"+MapperName) {
+		t.Errorf("encrypted format ran %q", calls)
+	}
+
+	calls = nil
+	if err := d.ChangeKey([]byte("old"), []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	if len(calls) != 1 || calls[0] != "cryptsetup luksChangeKey --key-file - /dev/sdz1 /dev/fd/3" ||
+		!reflect.DeepEqual(input, [][]byte{[]byte("old"), []byte("new")}) {
+		t.Errorf("change key ran %q with %q", calls, input)
+	}
+
+	// cryptsetup's exit status 2 means no key slot took the key
+	fail = exec.Command("sh", "-c", "exit 2").Run()
+	if err := d.AddKey([]byte("wrong"), []byte("new")); !errors.Is(err, ErrWrongKey) {
+		t.Errorf("wrong key: %v", err)
+	}
+	fail = errors.New("device busy")
+	if err := d.AddKey([]byte("key"), []byte("new")); err == nil || errors.Is(err, ErrWrongKey) {
+		t.Errorf("other failure: %v", err)
+	}
+}
+
+func TestPackageRunner(t *testing.T) {
+	old := Run
+	t.Cleanup(func() { Run = old })
+	var calls []string
+	Run = func(name string, args ...string) ([]byte, error) {
+		calls = append(calls, name+" "+strings.Join(args, " "))
+		return nil, errors.New("mount: permission denied")
+	}
+
+	err := BindMount(t.TempDir(), t.TempDir())
+	if err == nil || !strings.Contains(err.Error(), "permission denied") {
+		t.Errorf("bind: %v", err)
+	}
+	if err := Detach("/mnt/x"); err == nil {
+		t.Error("detach reported success")
+	}
+	if len(calls) != 2 || !strings.HasPrefix(calls[0], "mount --bind ") || calls[1] != "umount -l /mnt/x" {
+		t.Errorf("ran %q", calls)
+	}
+}
+
+func TestEnsureMounted(t *testing.T) {
+	old := System
+	t.Cleanup(func() { System = old })
+	System = newFixture(t)
+
+	var calls []string
+	run := func(name string, args ...string) ([]byte, error) {
+		calls = append(calls, strings.TrimSpace(name+" "+strings.Join(args, " ")))
+		if name == "cryptsetup" {
+			return nil, errors.New("not a LUKS device")
+		}
+		return nil, nil
+	}
+
+	tests := []struct {
+		name    string
+		uuid    string
+		dir     string
+		wantErr bool
+		mounts  bool
+	}{
+		// The fixture's root filesystem is what is mounted at /
+		{name: "ours", uuid: "ce208fd3-38a8-424a-87a2-cd44114eb820", dir: "/"},
+		{name: "another filesystem", uuid: "d4749f1e-0000-4000-8000-00000000000c", dir: "/", wantErr: true},
+		{name: "not mounted", uuid: "d4749f1e-0000-4000-8000-00000000000c", dir: t.TempDir(), mounts: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls = nil
+			d := &RealDisk{DevicePath: "/dev/sdc", UUID: tt.uuid, Run: run}
+			err := d.EnsureMounted(tt.dir)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("EnsureMounted(%s) = %v", tt.dir, err)
+			}
+			mounted := slices.Contains(calls, "mount /dev/disk/by-uuid/"+tt.uuid+" "+tt.dir)
+			if mounted != tt.mounts {
+				t.Errorf("ran %q", calls)
+			}
+		})
+	}
+}
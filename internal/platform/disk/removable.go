@@ -0,0 +1,116 @@
+package disk
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Volume is a filesystem on a removable drive: a camera card, a USB stick
+// or a card reader.
+type Volume struct {
+	Device     string `json:"device"` // e.g. /dev/sdb1
+	UUID       string `json:"uuid,omitempty"`
+	Label      string `json:"label,omitempty"`
+	FSType     string `json:"fsType"`
+	Size       uint64 `json:"size"`
+	Mountpoint string `json:"mountpoint,omitempty"` // set if something else mounted it
+}
+
+// ID names the volume across plug-ins. FAT and exFAT serials change when a
+// card is formatted, so a reformatted card counts as a new one.
+func (v Volume) ID() string {
+	if v.UUID != "" {
+		return v.UUID
+	}
+	return "dev-" + filepath.Base(v.Device)
+}
+
+// importable are the filesystems cameras, phones and other computers
+// write to removable media.
+var importable = map[string]bool{"vfat": true, "exfat": true, "ntfs": true}
+
+// ListRemovable returns the importable filesystems on removable drives.
+func ListRemovable() ([]Volume, error) {
+	drives, err := System.Drives()
+	if err != nil {
+		return nil, err
+	}
+	return removableVolumes(drives), nil
+}
+
+func removableVolumes(drives []Drive) []Volume {
+	var vols []Volume
+	for _, d := range drives {
+		// USB SSDs are not flagged removable by the kernel, but plugged
+		// in over USB they are still somewhere to import from
+		if !(d.Removable || d.Transport == "usb") || d.System {
+			continue
+		}
+		for _, p := range d.Partitions {
+			// Drives in the storage pool hold data, they are not cards
+			if !importable[p.FSType] || p.Mountpoint == DataMountPoint || strings.HasPrefix(p.Mountpoint, PoolDir+"/") {
+				continue
+			}
+			vols = append(vols, Volume{
+				Device:     p.Device,
+				UUID:       p.UUID,
+				Label:      p.Label,
+				FSType:     p.FSType,
+				Size:       p.Size,
+				Mountpoint: p.Mountpoint,
+			})
+		}
+	}
+	return vols
+}
+
+// IsRemovable reports whether the kernel flags the disk as removable media,
+// as it does for card readers and most USB sticks.
+func IsRemovable(devicePath string) bool {
+	return System.read("sys/block", filepath.Base(devicePath), "removable") == "1"
+}
+
+// MountReadOnly mounts v at dir so nothing on the card can change while it
+// is read. Files on it are never executable.
+func MountReadOnly(v Volume, dir string) error {
+	return mount(v.Device, v.FSType, dir, "ro,nosuid,nodev,noexec")
+}
+
+func mount(device, fsType, dir, options string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	// Newer kernels have their own NTFS driver; older systems use FUSE
+	types := []string{fsType}
+	if fsType == "ntfs" {
+		types = []string{"ntfs3", "ntfs-3g", "ntfs"}
+	}
+	var last error
+	for _, t := range types {
+		_, err := Run("mount", "-t", t, "-o", options, device, dir)
+		if err == nil {
+			return nil
+		}
+		last = fmt.Errorf("mount %s as %s: %w", device, t, err)
+	}
+	return last
+}
+
+// Unmount flushes and detaches the filesystem at dir, retrying for a few
+// seconds while something still has it open, and removes the empty mount
+// point.
+func Unmount(dir string) error {
+	Run("sync", "-f", dir)
+	var err error
+	for i := 0; i < 5; i++ {
+		if _, err = Run("umount", dir); err == nil {
+			os.Remove(dir)
+			return nil
+		}
+		time.Sleep(time.Second)
+	}
+	return err
+}
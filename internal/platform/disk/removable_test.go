@@ -0,0 +1,62 @@
+package disk
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRemovableVolumes(t *testing.T) {
+	tests := []struct {
+		name   string
+		drives []Drive
+		want   []Volume
+	}{
+		{
+			"camera card in a reader",
+			[]Drive{{Device: "/dev/sdb", Size: 63864569856, Removable: true, Transport: "usb", Partitions: []Partition{
+				{Device: "/dev/sdb1", FSType: "exfat", UUID: "3A21-7F0C", Label: "EOS_DIGITAL", Size: 63863521280}}}},
+			[]Volume{{Device: "/dev/sdb1", UUID: "3A21-7F0C", Label: "EOS_DIGITAL", FSType: "exfat", Size: 63863521280}},
+		},
+		{
+			"stick without partitions, mounted elsewhere",
+			[]Drive{{Device: "/dev/sdc", Size: 8004304896, Removable: true, Transport: "usb", Partitions: []Partition{
+				{Device: "/dev/sdc", FSType: "vfat", UUID: "12AB-34CD", Size: 8004304896, Mountpoint: "/media/pi/STICK"}}}},
+			[]Volume{{Device: "/dev/sdc", UUID: "12AB-34CD", FSType: "vfat", Size: 8004304896, Mountpoint: "/media/pi/STICK"}},
+		},
+		{
+			"boot SD card and data SSD are not importable",
+			[]Drive{
+				{Device: "/dev/mmcblk0", Transport: "mmc", System: true, Partitions: []Partition{
+					{Device: "/dev/mmcblk0p1", FSType: "vfat", Size: 536870912, Mountpoint: "/boot/firmware"},
+					{Device: "/dev/mmcblk0p2", FSType: "ext4", Size: 31373918208, Mountpoint: "/"}}},
+				{Device: "/dev/sda", Transport: "usb", Partitions: []Partition{
+					{Device: "/dev/sda1", FSType: "ext4", Size: 500106813440, Mountpoint: "/mnt/strct_data"}}},
+				{Device: "/dev/nvme0n1", Transport: "nvme", Partitions: []Partition{
+					{Device: "/dev/nvme0n1p1", FSType: "ntfs", Size: 500106813440}}},
+			},
+			nil,
+		},
+		{
+			"NTFS drive among other partitions",
+			[]Drive{{Device: "/dev/sdd", Transport: "usb", Partitions: []Partition{
+				{Device: "/dev/sdd1", FSType: "vfat", Label: "EFI", Size: 209715200},
+				{Device: "/dev/sdd2", FSType: "ntfs", UUID: "5E2C3A9F2C3A7411", Label: "Backup", Size: 999994318848},
+				{Device: "/dev/sdd3", FSType: "crypto_LUKS", Size: 1024}}}},
+			[]Volume{
+				{Device: "/dev/sdd1", FSType: "vfat", Label: "EFI", Size: 209715200},
+				{Device: "/dev/sdd2", UUID: "5E2C3A9F2C3A7411", Label: "Backup", FSType: "ntfs", Size: 999994318848},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := removableVolumes(tt.drives); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got  %+v\nwant %+v", got, tt.want)
+			}
+		})
+	}
+
+	if id := (Volume{Device: "/dev/sdc1"}).ID(); id != "dev-sdc1" {
+		t.Errorf("ID without a UUID = %q", id)
+	}
+}
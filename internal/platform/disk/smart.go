@@ -0,0 +1,350 @@
+package disk
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// HotTemp is the temperature, in °C, above which a drive that does not
+// state its own limit is running hot.
+const HotTemp = 60
+
+// WornOut is the share of its rated endurance, in percent, past which an
+// SSD should be replaced.
+const WornOut = 90
+
+var (
+	// ErrStandby means the disk has spun down and was left asleep.
+	ErrStandby = errors.New("drive is in standby")
+
+	errUnknownBridge = errors.New("unknown USB bridge")
+)
+
+// Health is what a drive says about itself through SMART.
+type Health struct {
+	Device    string `json:"device"`
+	Model     string `json:"model,omitempty"`
+	Serial    string `json:"serial,omitempty"`
+	Protocol  string `json:"protocol,omitempty"` // ATA, NVMe or SCSI
+	Supported bool   `json:"supported"`          // the drive reports SMART at all
+	Passed    bool   `json:"passed"`             // the drive's own overall verdict
+
+	Temperature  int    `json:"temperature,omitempty"` // °C
+	TempLimit    int    `json:"tempLimit,omitempty"`   // the drive's own warning threshold
+	PowerOnHours uint64 `json:"powerOnHours,omitempty"`
+	WearUsed     *int   `json:"wearUsed,omitempty"` // percent of rated endurance, SSDs only
+
+	Reallocated   uint64   `json:"reallocated"`
+	Pending       uint64   `json:"pending"`            // sectors waiting to be reallocated
+	Uncorrectable uint64   `json:"uncorrectable"`      // reads the drive could not recover
+	CRCErrors     uint64   `json:"crcErrors"`          // transfer errors on the cable or bridge
+	MediaErrors   uint64   `json:"mediaErrors"`        // NVMe
+	ErrorLog      uint64   `json:"errorLog"`           // entries in the drive's error log
+	Critical      int      `json:"critical,omitempty"` // NVMe critical warning bits
+	Failing       []string `json:"failing,omitempty"`  // attributes past their threshold
+
+	SelfTest SelfTest `json:"selfTest"`
+}
+
+// SelfTest is the running self-test, or else the last one.
+type SelfTest struct {
+	Running   bool   `json:"running"`
+	Remaining int    `json:"remaining,omitempty"` // percent
+	Type      string `json:"type,omitempty"`      // e.g. Short offline
+	Result    string `json:"result,omitempty"`
+	Failed    bool   `json:"failed"`
+	Hours     uint64 `json:"hours,omitempty"` // power-on hours when it ran
+}
+
+var nvmeCritical = []struct {
+	bit  int
+	text string
+}{
+	{0x01, "spare capacity is running out"},
+	{0x02, "temperature is out of range"},
+	{0x04, "reliability is degraded"},
+	{0x08, "media is read-only"},
+	{0x10, "volatile memory backup failed"},
+}
+
+// Warnings describes what about the drive's health needs attention.
+func (h Health) Warnings() []string {
+	if !h.Supported {
+		return nil
+	}
+	var w []string
+	if !h.Passed {
+		w = append(w, "the drive reports that it is failing")
+	}
+	for _, c := range nvmeCritical {
+		if h.Critical&c.bit != 0 {
+			w = append(w, c.text)
+		}
+	}
+	if len(h.Failing) > 0 {
+		w = append(w, "past threshold: "+strings.Join(h.Failing, ", "))
+	}
+	counts := []struct {
+		n    uint64
+		text string
+	}{
+		{h.Reallocated, "reallocated sectors"},
+		{h.Pending, "sectors pending reallocation"},
+		{h.Uncorrectable, "uncorrectable errors"},
+		{h.MediaErrors, "media errors"},
+	}
+	for _, c := range counts {
+		if c.n > 0 {
+			w = append(w, fmt.Sprintf("%d %s", c.n, c.text))
+		}
+	}
+	if h.WearUsed != nil && *h.WearUsed >= WornOut {
+		w = append(w, fmt.Sprintf("%d%% of rated endurance used", *h.WearUsed))
+	}
+	limit := h.TempLimit
+	if limit == 0 {
+		limit = HotTemp
+	}
+	if h.Temperature >= limit {
+		w = append(w, fmt.Sprintf("running hot at %d°C", h.Temperature))
+	}
+	if h.SelfTest.Failed {
+		w = append(w, "last self-test failed: "+h.SelfTest.Result)
+	}
+	return w
+}
+
+// ReadHealth asks the drive for its SMART data. A disk that has spun down
+// is not woken; that gives ErrStandby.
+func ReadHealth(device string) (Health, error) {
+	r, err := smartctl(device, "-a", "-n", "standby")
+	if err != nil {
+		return Health{}, err
+	}
+	return r.health(device), nil
+}
+
+// StartSelfTest starts a short or long self-test, which the drive runs on
+// its own while it stays in use. ReadHealth follows its progress.
+func StartSelfTest(device, kind string) error {
+	if kind != "short" && kind != "long" {
+		return fmt.Errorf("unknown self-test %q", kind)
+	}
+	_, err := smartctl(device, "-t", kind)
+	return err
+}
+
+// smartctl runs smartctl against device, retrying through SAT pass-through
+// for USB enclosures it does not recognise; most of them support it.
+func smartctl(device string, args ...string) (*smartReport, error) {
+	r, err := runSmartctl(device, args...)
+	if errors.Is(err, errUnknownBridge) {
+		r, err = runSmartctl(device, append([]string{"-d", "sat"}, args...)...)
+	}
+	return r, err
+}
+
+func runSmartctl(device string, args ...string) (*smartReport, error) {
+	args = append(append([]string{"--json"}, args...), device)
+	out, err := Run("smartctl", args...)
+	var exit *exec.ExitError
+	if err != nil && !errors.As(err, &exit) {
+		return nil, err
+	}
+	// The exit status is a bit mask that also flags a failing drive, so
+	// the report says whether the command itself worked
+	return decodeSmart(out)
+}
+
+type smartValue struct {
+	Value  int    `json:"value"`
+	String string `json:"string"`
+}
+
+type smartReport struct {
+	Smartctl struct {
+		ExitStatus int `json:"exit_status"`
+		Messages   []struct {
+			String   string `json:"string"`
+			Severity string `json:"severity"`
+		} `json:"messages"`
+	} `json:"smartctl"`
+	Device struct {
+		Protocol string `json:"protocol"`
+	} `json:"device"`
+	ModelName    string `json:"model_name"`
+	SerialNumber string `json:"serial_number"`
+	RotationRate *int   `json:"rotation_rate"`
+	SmartStatus  *struct {
+		Passed bool `json:"passed"`
+	} `json:"smart_status"`
+	Temperature struct {
+		Current    int `json:"current"`
+		OpLimitMax int `json:"op_limit_max"`
+	} `json:"temperature"`
+	PowerOnTime struct {
+		Hours uint64 `json:"hours"`
+	} `json:"power_on_time"`
+
+	ATASmartData struct {
+		SelfTest struct {
+			Status struct {
+				Value            int    `json:"value"`
+				String           string `json:"string"`
+				RemainingPercent int    `json:"remaining_percent"`
+			} `json:"status"`
+		} `json:"self_test"`
+	} `json:"ata_smart_data"`
+	ATASmartAttributes struct {
+		Table []struct {
+			ID         int    `json:"id"`
+			Name       string `json:"name"`
+			Value      int    `json:"value"`
+			WhenFailed string `json:"when_failed"`
+			Raw        struct {
+				Value uint64 `json:"value"`
+			} `json:"raw"`
+		} `json:"table"`
+	} `json:"ata_smart_attributes"`
+	ATASmartErrorLog struct {
+		Summary struct {
+			Count uint64 `json:"count"`
+		} `json:"summary"`
+	} `json:"ata_smart_error_log"`
+	ATASmartSelfTestLog struct {
+		Standard struct {
+			Table []struct {
+				Type   smartValue `json:"type"`
+				Status struct {
+					String string `json:"string"`
+					Passed *bool  `json:"passed"` // absent when it was aborted
+				} `json:"status"`
+				LifetimeHours uint64 `json:"lifetime_hours"`
+			} `json:"table"`
+		} `json:"standard"`
+	} `json:"ata_smart_self_test_log"`
+
+	NVMeLog *struct {
+		CriticalWarning int    `json:"critical_warning"`
+		PercentageUsed  int    `json:"percentage_used"`
+		MediaErrors     uint64 `json:"media_errors"`
+		NumErrLogs      uint64 `json:"num_err_log_entries"`
+	} `json:"nvme_smart_health_information_log"`
+	NVMeSelfTestLog struct {
+		Current           smartValue `json:"current_self_test_operation"`
+		CompletionPercent int        `json:"current_self_test_completion_percent"`
+		Table             []struct {
+			Code         smartValue `json:"self_test_code"`
+			Result       smartValue `json:"self_test_result"`
+			PowerOnHours uint64     `json:"power_on_hours"`
+		} `json:"table"`
+	} `json:"nvme_self_test_log"`
+}
+
+// decodeSmart reads smartctl's JSON output and tells a failed command
+// apart from a drive that merely has something to report.
+func decodeSmart(out []byte) (*smartReport, error) {
+	var r smartReport
+	if err := json.Unmarshal(out, &r); err != nil {
+		return nil, fmt.Errorf("smartctl output: %w", err)
+	}
+	// Bit 0: bad command line; bit 1: the device could not be opened
+	// or is asleep
+	if r.Smartctl.ExitStatus&0x3 == 0 {
+		return &r, nil
+	}
+	msg := "smartctl failed"
+	for _, m := range r.Smartctl.Messages {
+		switch {
+		case strings.Contains(m.String, "STANDBY"):
+			return nil, ErrStandby
+		case strings.Contains(m.String, "Unknown USB bridge"):
+			return nil, errUnknownBridge
+		case m.Severity == "error":
+			msg = m.String
+		}
+	}
+	return nil, errors.New(msg)
+}
+
+// ataWear holds the attributes whose normalised value counts down the
+// life left in an SSD, per vendor.
+var ataWear = map[int]bool{
+	169: true, // Remaining_Lifetime_Perc (WD)
+	177: true, // Wear_Leveling_Count (Samsung)
+	202: true, // Percent_Lifetime_Remain (Crucial, Micron)
+	231: true, // SSD_Life_Left (SandForce, Kingston)
+	233: true, // Media_Wearout_Indicator (Intel)
+}
+
+func (r *smartReport) health(device string) Health {
+	h := Health{
+		Device:       device,
+		Model:        r.ModelName,
+		Serial:       r.SerialNumber,
+		Protocol:     r.Device.Protocol,
+		Supported:    r.SmartStatus != nil,
+		Temperature:  r.Temperature.Current,
+		TempLimit:    r.Temperature.OpLimitMax,
+		PowerOnHours: r.PowerOnTime.Hours,
+	}
+	if r.SmartStatus != nil {
+		h.Passed = r.SmartStatus.Passed
+	}
+
+	if n := r.NVMeLog; n != nil {
+		h.Critical = n.CriticalWarning
+		h.MediaErrors = n.MediaErrors
+		h.ErrorLog = n.NumErrLogs
+		used := n.PercentageUsed
+		h.WearUsed = &used
+
+		st := r.NVMeSelfTestLog
+		if st.Current.Value != 0 {
+			h.SelfTest = SelfTest{Running: true, Type: st.Current.String, Remaining: 100 - st.CompletionPercent}
+		} else if len(st.Table) > 0 {
+			last := st.Table[0]
+			// 5-7 are failures; the rest other than 0 were interrupted
+			failed := last.Result.Value >= 5 && last.Result.Value <= 7
+			h.SelfTest = SelfTest{Type: last.Code.String, Result: last.Result.String, Failed: failed, Hours: last.PowerOnHours}
+		}
+		return h
+	}
+
+	ssd := r.RotationRate != nil && *r.RotationRate == 0
+	for _, a := range r.ATASmartAttributes.Table {
+		switch a.ID {
+		case 5:
+			h.Reallocated = a.Raw.Value
+		case 197:
+			h.Pending = a.Raw.Value
+		case 187, 198:
+			h.Uncorrectable = max(h.Uncorrectable, a.Raw.Value)
+		case 199:
+			h.CRCErrors = a.Raw.Value
+		}
+		if ataWear[a.ID] && ssd && h.WearUsed == nil {
+			used := max(0, 100-a.Value)
+			h.WearUsed = &used
+		}
+		if a.WhenFailed == "now" {
+			h.Failing = append(h.Failing, a.Name)
+		}
+	}
+	h.ErrorLog = r.ATASmartErrorLog.Summary.Count
+
+	// Status values 241-249 are a test in progress, the low nibble tenths
+	// left to run
+	if st := r.ATASmartData.SelfTest.Status; st.Value>>4 == 0xf {
+		h.SelfTest = SelfTest{Running: true, Remaining: st.RemainingPercent}
+	}
+	if log := r.ATASmartSelfTestLog.Standard.Table; len(log) > 0 && !h.SelfTest.Running {
+		last := log[0]
+		failed := last.Status.Passed != nil && !*last.Status.Passed
+		h.SelfTest = SelfTest{Type: last.Type.String, Result: last.Status.String, Failed: failed, Hours: last.LifetimeHours}
+	}
+	return h
+}
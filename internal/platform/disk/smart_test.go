@@ -0,0 +1,118 @@
+package disk
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func wear(n int) *int { return &n }
+
+// The fixtures are smartctl 7.3/7.4 JSON reports, trimmed to the fields
+// that matter here.
+func TestDecodeSmart(t *testing.T) {
+	tests := []struct {
+		file     string
+		want     Health
+		warnings []string
+		err      error
+	}{
+		{
+			"samsung-870-evo-usb.json",
+			Health{
+				Device: "/dev/sda", Model: "Samsung SSD 870 EVO 1TB", Serial: "S6PTNZ0T512345L", Protocol: "ATA",
+				Supported: true, Passed: true, Temperature: 34, PowerOnHours: 6417, WearUsed: wear(3), CRCErrors: 2,
+				SelfTest: SelfTest{Type: "Short offline", Result: "Completed without error", Hours: 6390},
+			},
+			nil,
+			nil,
+		},
+		{
+			"wd-red-failing.json",
+			Health{
+				Device: "/dev/sdb", Model: "WDC WD40EFRX-68N32N0", Serial: "WD-WCC7K4HPL1Z2", Protocol: "ATA",
+				Supported: true, Temperature: 37, PowerOnHours: 39512,
+				Reallocated: 1768, Pending: 24, Uncorrectable: 11, ErrorLog: 153, Failing: []string{"Reallocated_Sector_Ct"},
+				SelfTest: SelfTest{Type: "Short offline", Result: "Completed: read failure", Failed: true, Hours: 39508},
+			},
+			[]string{
+				"the drive reports that it is failing",
+				"past threshold: Reallocated_Sector_Ct",
+				"1768 reallocated sectors",
+				"24 sectors pending reallocation",
+				"11 uncorrectable errors",
+				"last self-test failed: Completed: read failure",
+			},
+			nil,
+		},
+		{
+			"wd-sn770-testing.json",
+			Health{
+				Device: "/dev/nvme0n1", Model: "WD_BLACK SN770 1TB", Serial: "22341J801234", Protocol: "NVMe",
+				Supported: true, Passed: true, Temperature: 48, TempLimit: 90, PowerOnHours: 3304, WearUsed: wear(3), ErrorLog: 3,
+				SelfTest: SelfTest{Running: true, Remaining: 60, Type: "Short self-test in progress"},
+			},
+			nil,
+			nil,
+		},
+		{
+			"no-smart.json",
+			Health{Device: "/dev/sdd", Model: "JMicron Generic", Serial: "0123456789ABCDEF", Protocol: "ATA"},
+			nil,
+			nil,
+		},
+		{"hdd-standby.json", Health{}, nil, ErrStandby},
+		{"unknown-bridge.json", Health{}, nil, errUnknownBridge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			data, err := os.ReadFile(filepath.Join("testdata", "smart", tt.file))
+			if err != nil {
+				t.Fatal(err)
+			}
+			r, err := decodeSmart(data)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("err = %v, want %v", err, tt.err)
+			}
+			if err != nil {
+				return
+			}
+			got := r.health(tt.want.Device)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got  %+v\nwant %+v", got, tt.want)
+			}
+			if w := got.Warnings(); !reflect.DeepEqual(w, tt.warnings) {
+				t.Errorf("warnings %q, want %q", w, tt.warnings)
+			}
+		})
+	}
+
+	if _, err := decodeSmart([]byte("smartctl: command not found")); err == nil {
+		t.Error("decoded something that is not JSON")
+	}
+}
+
+func TestHealthWarnings(t *testing.T) {
+	tests := []struct {
+		name string
+		h    Health
+		want []string
+	}{
+		{"hot without a stated limit", Health{Supported: true, Passed: true, Temperature: 61}, []string{"running hot at 61°C"}},
+		{"warm under its own limit", Health{Supported: true, Passed: true, Temperature: 65, TempLimit: 70}, nil},
+		{"worn SSD", Health{Supported: true, Passed: true, WearUsed: wear(93)}, []string{"93% of rated endurance used"}},
+		{"NVMe critical bits", Health{Supported: true, Passed: true, Critical: 0x05, MediaErrors: 2},
+			[]string{"spare capacity is running out", "reliability is degraded", "2 media errors"}},
+		{"link errors alone are not a fault", Health{Supported: true, Passed: true, CRCErrors: 40}, nil},
+		{"no SMART", Health{Temperature: 80}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.h.Warnings(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,270 @@
+package disk
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Sysfs reads block devices the way the kernel and udev describe them:
+// /sys/block for disks and partitions, udev's database for filesystem
+// types, UUIDs and labels, and mountinfo for what is mounted where. Root
+// is "/" on a device and a fixture tree in tests.
+type Sysfs struct {
+	Root string
+}
+
+// System is the running machine.
+var System = Sysfs{Root: "/"}
+
+func (s Sysfs) path(elem ...string) string {
+	return filepath.Join(append([]string{s.Root}, elem...)...)
+}
+
+func (s Sysfs) read(elem ...string) string {
+	data, _ := os.ReadFile(s.path(elem...))
+	return strings.TrimSpace(string(data))
+}
+
+// virtual are the kernel's block devices that are not drives.
+var virtual = []string{"loop", "ram", "zram", "sr", "fd", "dm-", "md", "nbd", "mtdblock"}
+
+func isVirtual(name string) bool {
+	for _, prefix := range virtual {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	// eMMC exposes its boot and replay-protected areas as extra disks
+	return strings.HasPrefix(name, "mmcblk") && (strings.Contains(name, "boot") || strings.Contains(name, "rpmb"))
+}
+
+// Drives returns the disks attached to the device, partitions included.
+func (s Sysfs) Drives() ([]Drive, error) {
+	entries, err := os.ReadDir(s.path("sys/block"))
+	if err != nil {
+		return nil, fmt.Errorf("list block devices: %w", err)
+	}
+	mounts := s.mounts()
+	drives := []Drive{}
+	for _, e := range entries {
+		if isVirtual(e.Name()) {
+			continue
+		}
+		if d, ok := s.drive(e.Name(), mounts); ok {
+			drives = append(drives, d)
+		}
+	}
+	return drives, nil
+}
+
+// Drive returns the disk at device, e.g. /dev/sda.
+func (s Sysfs) Drive(device string) (Drive, bool) {
+	return s.drive(filepath.Base(device), s.mounts())
+}
+
+// FindUUID returns the drive and partition holding the filesystem or
+// encrypted container with the given UUID, wherever it is attached now.
+func (s Sysfs) FindUUID(uuid string) (Drive, Partition, bool) {
+	drives, err := s.Drives()
+	if err != nil || uuid == "" {
+		return Drive{}, Partition{}, false
+	}
+	for _, d := range drives {
+		for _, p := range d.Partitions {
+			if strings.EqualFold(p.UUID, uuid) {
+				return d, p, true
+			}
+		}
+	}
+	return Drive{}, Partition{}, false
+}
+
+func (s Sysfs) drive(name string, mounts map[string]string) (Drive, bool) {
+	dir := filepath.Join("sys/block", name)
+	sectors, err := strconv.ParseUint(s.read(dir, "size"), 10, 64)
+	// An empty card reader slot is a disk of size zero
+	if err != nil || sectors == 0 {
+		return Drive{}, false
+	}
+	props := s.udev(s.read(dir, "dev"))
+	d := Drive{
+		Device:     "/dev/" + name,
+		Model:      firstOf(s.read(dir, "device/model"), props["ID_MODEL"]),
+		Serial:     firstOf(s.read(dir, "device/serial"), props["ID_SERIAL_SHORT"]),
+		Transport:  s.transport(name),
+		Size:       sectors * 512, // sysfs counts 512-byte sectors whatever the drive's block size
+		Removable:  s.read(dir, "removable") == "1",
+		Partitions: []Partition{},
+	}
+
+	// A drive formatted without a partition table carries the
+	// filesystem on the disk itself
+	if whole := s.partition(dir, name, mounts); whole.FSType != "" || whole.Mountpoint != "" {
+		d.Partitions = append(d.Partitions, whole)
+	}
+
+	entries, _ := os.ReadDir(s.path(dir))
+	type numbered struct {
+		n int
+		p Partition
+	}
+	var parts []numbered
+	for _, e := range entries {
+		n, err := strconv.Atoi(s.read(dir, e.Name(), "partition"))
+		if err != nil {
+			continue
+		}
+		parts = append(parts, numbered{n, s.partition(filepath.Join(dir, e.Name()), e.Name(), mounts)})
+	}
+	sort.Slice(parts, func(i, j int) bool { return parts[i].n < parts[j].n })
+	for _, p := range parts {
+		d.Partitions = append(d.Partitions, p.p)
+	}
+	d.System = d.holdsSystem()
+	return d, true
+}
+
+func (s Sysfs) partition(dir, name string, mounts map[string]string) Partition {
+	devno := s.read(dir, "dev")
+	props := s.udev(devno)
+	sectors, _ := strconv.ParseUint(s.read(dir, "size"), 10, 64)
+	p := Partition{
+		Device:     "/dev/" + name,
+		Size:       sectors * 512,
+		FSType:     props["ID_FS_TYPE"],
+		Label:      firstOf(udevDecode(props["ID_FS_LABEL_ENC"]), props["ID_FS_LABEL"]),
+		UUID:       props["ID_FS_UUID"],
+		Mountpoint: mounts[devno],
+	}
+	// An unlocked container is mounted through its device-mapper holder
+	holders, _ := os.ReadDir(s.path(dir, "holders"))
+	for _, h := range holders {
+		if p.Mountpoint == "" {
+			p.Mountpoint = mounts[s.read("sys/block", h.Name(), "dev")]
+		}
+	}
+	return p
+}
+
+func (s Sysfs) transport(name string) string {
+	switch {
+	case strings.HasPrefix(name, "nvme"):
+		return "nvme"
+	case strings.HasPrefix(name, "mmcblk"):
+		return "mmc"
+	}
+	// The link into /sys/devices runs through the bus the disk hangs off
+	link, err := os.Readlink(s.path("sys/block", name))
+	switch {
+	case err != nil:
+		return ""
+	case strings.Contains(link, "/usb"):
+		return "usb"
+	case strings.Contains(link, "/ata"):
+		return "sata"
+	}
+	return ""
+}
+
+// udev returns the properties udev recorded for the block device with the
+// given major:minor number.
+func (s Sysfs) udev(devno string) map[string]string {
+	props := make(map[string]string)
+	if devno == "" {
+		return props
+	}
+	f, err := os.Open(s.path("run/udev/data", "b"+devno))
+	if err != nil {
+		return props
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line, ok := strings.CutPrefix(sc.Text(), "E:")
+		if !ok {
+			continue
+		}
+		if k, v, ok := strings.Cut(line, "="); ok {
+			props[k] = v
+		}
+	}
+	return props
+}
+
+// mounts maps major:minor numbers to where they are mounted. mountinfo is
+// read rather than /proc/mounts because the root filesystem often shows
+// up there as /dev/root, which names no real device.
+func (s Sysfs) mounts() map[string]string {
+	mounts := make(map[string]string)
+	f, err := os.Open(s.path("proc/self/mountinfo"))
+	if err != nil {
+		return mounts
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) < 5 {
+			continue
+		}
+		// Bind mounts of the same filesystem come after the original
+		if _, ok := mounts[fields[2]]; !ok {
+			mounts[fields[2]] = unescapeMount(fields[4])
+		}
+	}
+	return mounts
+}
+
+// unescapeMount undoes the octal escapes mountinfo uses for spaces and
+// other separators in paths.
+func unescapeMount(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if n, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// udevDecode undoes the \xNN escapes in udev's *_ENC properties, which keep
+// the spaces and punctuation the plain properties replace with '_'.
+func udevDecode(s string) string {
+	if !strings.Contains(s, `\x`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if i+3 < len(s) && s[i] == '\\' && s[i+1] == 'x' {
+			if n, err := strconv.ParseUint(s[i+2:i+4], 16, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+func firstOf(values ...string) string {
+	for _, v := range values {
+		if v = strings.TrimSpace(v); v != "" {
+			return v
+		}
+	}
+	return ""
+}
@@ -0,0 +1,179 @@
+package disk
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// fixture lays out the parts of /sys, /run/udev and /proc the disk
+// package reads.
+type fixture struct {
+	t    *testing.T
+	root string
+}
+
+func (f fixture) file(path, content string) {
+	f.t.Helper()
+	p := filepath.Join(f.root, path)
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		f.t.Fatal(err)
+	}
+	if err := os.WriteFile(p, []byte(content+"\n"), 0644); err != nil {
+		f.t.Fatal(err)
+	}
+}
+
+// disk adds a disk whose sysfs entry links to devpath under /sys/devices.
+func (f fixture) disk(name, devpath, devno string, sectors int) {
+	f.t.Helper()
+	dir := filepath.Join("sys/devices", devpath, "block", name)
+	f.file(filepath.Join(dir, "dev"), devno)
+	f.file(filepath.Join(dir, "size"), strconv.Itoa(sectors))
+	f.file(filepath.Join(dir, "removable"), "0")
+	os.MkdirAll(filepath.Join(f.root, "sys/block"), 0755)
+	if err := os.Symlink(filepath.Join("..", "devices", devpath, "block", name), filepath.Join(f.root, "sys/block", name)); err != nil {
+		f.t.Fatal(err)
+	}
+}
+
+func (f fixture) part(disk, name, devno string, n, sectors int) {
+	dir := filepath.Join("sys/block", disk, name)
+	f.file(filepath.Join(dir, "dev"), devno)
+	f.file(filepath.Join(dir, "size"), strconv.Itoa(sectors))
+	f.file(filepath.Join(dir, "partition"), strconv.Itoa(n))
+}
+
+func (f fixture) udev(devno string, props ...string) {
+	f.file("run/udev/data/b"+devno, "E:"+strings.Join(props, "\nE:"))
+}
+
+func newFixture(t *testing.T) Sysfs {
+	f := fixture{t, t.TempDir()}
+
+	f.disk("loop0", "virtual", "7:0", 8)
+	f.disk("mmcblk0", "platform/emmc2bus/fe340000.mmc/mmc_host/mmc0/mmc0:aaaa", "179:0", 62333952)
+	f.disk("mmcblk0boot0", "platform/emmc2bus/fe340000.mmc/mmc_host/mmc0/mmc0:aaaa", "179:8", 8192)
+	f.part("mmcblk0", "mmcblk0p2", "179:2", 2, 61284352)
+	f.part("mmcblk0", "mmcblk0p1", "179:1", 1, 1048576)
+	f.udev("179:1", "ID_FS_TYPE=vfat", "ID_FS_UUID=4EF5-6F55", "ID_FS_LABEL=bootfs")
+	f.udev("179:2", "ID_FS_TYPE=ext4", "ID_FS_UUID=ce208fd3-38a8-424a-87a2-cd44114eb820", "ID_FS_LABEL=rootfs")
+
+	f.disk("nvme0n1", "platform/scb/fd500000.pcie/pci0000:00/0000:00:00.0/0000:01:00.0/nvme/nvme0", "259:0", 976773168)
+	f.file("sys/block/nvme0n1/device/model", "Samsung SSD 980 500GB                   ")
+	f.file("sys/block/nvme0n1/device/serial", "S64DNX0R123456      ")
+	f.part("nvme0n1", "nvme0n1p1", "259:1", 1, 976771072)
+	f.file("sys/block/nvme0n1/nvme0n1p1/holders/dm-0", "")
+	f.udev("259:1", "ID_FS_TYPE=crypto_LUKS", "ID_FS_UUID=c0ffee00-1111-4222-8333-444455556666")
+	f.disk("dm-0", "virtual", "254:0", 976738304)
+
+	f.disk("sda", "platform/scb/fd500000.pcie/pci0000:00/0000:00:00.0/0000:01:00.0/usb2/2-2/2-2:1.0/host0/target0:0:0/0:0:0:0", "8:0", 124735488)
+	f.file("sys/block/sda/removable", "1")
+	f.udev("8:0", "ID_MODEL=Card_Reader", "ID_SERIAL_SHORT=000000001206")
+	f.part("sda", "sda1", "8:1", 1, 124733440)
+	f.udev("8:1", "ID_FS_TYPE=exfat", "ID_FS_UUID=3A21-7F0C", "ID_FS_LABEL=My_Card", `ID_FS_LABEL_ENC=My\x20Card`)
+
+	// An empty slot of the same reader
+	f.disk("sdb", "platform/scb/usb2/2-2/2-2:1.0/host0/target0:0:0/0:0:0:1", "8:16", 0)
+	f.file("sys/block/sdb/removable", "1")
+
+	f.disk("sdc", "platform/ahci/ata1/host1/target1:0:0/1:0:0:0", "8:32", 1953525168)
+	f.udev("8:32", "ID_FS_TYPE=ext4", "ID_FS_UUID=d4749f1e-0000-4000-8000-00000000000c")
+
+	f.file("proc/self/mountinfo", strings.Join([]string{
+		`22 1 179:2 / / rw,noatime shared:1 - ext4 /dev/root rw`,
+		`25 22 179:1 / /boot/firmware rw,relatime shared:2 - vfat /dev/mmcblk0p1 rw`,
+		`40 22 254:0 / /mnt/strct_data rw,relatime shared:3 - ext4 /dev/mapper/strct_data rw`,
+		`41 22 254:0 / /home/pi/my\040data rw,relatime shared:3 - ext4 /dev/mapper/strct_data rw`,
+	}, "\n"))
+	return Sysfs{Root: f.root}
+}
+
+func TestSysfsDrives(t *testing.T) {
+	sys := newFixture(t)
+	got, err := sys.Drives()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Drive{
+		{Device: "/dev/mmcblk0", Transport: "mmc", Size: 62333952 * 512, System: true, Partitions: []Partition{
+			{Device: "/dev/mmcblk0p1", Size: 1048576 * 512, FSType: "vfat", Label: "bootfs", UUID: "4EF5-6F55", Mountpoint: "/boot/firmware"},
+			{Device: "/dev/mmcblk0p2", Size: 61284352 * 512, FSType: "ext4", Label: "rootfs", UUID: "ce208fd3-38a8-424a-87a2-cd44114eb820", Mountpoint: "/"},
+		}},
+		{Device: "/dev/nvme0n1", Model: "Samsung SSD 980 500GB", Serial: "S64DNX0R123456", Transport: "nvme", Size: 976773168 * 512, Partitions: []Partition{
+			{Device: "/dev/nvme0n1p1", Size: 976771072 * 512, FSType: "crypto_LUKS", UUID: "c0ffee00-1111-4222-8333-444455556666", Mountpoint: "/mnt/strct_data"},
+		}},
+		{Device: "/dev/sda", Model: "Card_Reader", Serial: "000000001206", Transport: "usb", Size: 124735488 * 512, Removable: true, Partitions: []Partition{
+			{Device: "/dev/sda1", Size: 124733440 * 512, FSType: "exfat", Label: "My Card", UUID: "3A21-7F0C"},
+		}},
+		{Device: "/dev/sdc", Transport: "sata", Size: 1953525168 * 512, Partitions: []Partition{
+			{Device: "/dev/sdc", Size: 1953525168 * 512, FSType: "ext4", UUID: "d4749f1e-0000-4000-8000-00000000000c"},
+		}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got  %+v\nwant %+v", got, want)
+	}
+	if !got[1].Mounted() || got[3].Mounted() {
+		t.Error("mounted state from partitions")
+	}
+
+	if d, p, ok := sys.FindUUID("C0FFEE00-1111-4222-8333-444455556666"); !ok || d.Device != "/dev/nvme0n1" || p.Device != "/dev/nvme0n1p1" {
+		t.Errorf("FindUUID: %v %v %v", d.Device, p.Device, ok)
+	}
+	if _, _, ok := sys.FindUUID("missing"); ok {
+		t.Error("found a missing UUID")
+	}
+	if _, ok := sys.Drive("/dev/sdb"); ok {
+		t.Error("empty card reader slot is a drive")
+	}
+	if s := formatSize(want[1].Size); s != "465.8G" {
+		t.Errorf("formatSize = %q", s)
+	}
+}
+
+func TestDataDrive(t *testing.T) {
+	r := &DataDrive{Dir: t.TempDir(), Sys: newFixture(t)}
+	paths := func() []string {
+		var p []string
+		for _, d := range r.Candidates() {
+			p = append(p, d.DevicePath+"="+d.UUID)
+		}
+		return p
+	}
+
+	// Before any drive was used, the usual places are probed; the card
+	// reader at /dev/sda is not one of them
+	if got := paths(); !reflect.DeepEqual(got, []string{"/dev/nvme0n1="}) {
+		t.Errorf("nothing remembered: %v", got)
+	}
+
+	// Once remembered, only that filesystem is used, wherever it is
+	r.Remember("d4749f1e-0000-4000-8000-00000000000c")
+	if got := paths(); !reflect.DeepEqual(got, []string{"/dev/sdc=d4749f1e-0000-4000-8000-00000000000c"}) {
+		t.Errorf("remembered: %v", got)
+	}
+	d := r.Candidates()[0]
+	if p := d.getPartitionPath(); p != "/dev/disk/by-uuid/d4749f1e-0000-4000-8000-00000000000c" {
+		t.Errorf("mounts %s", p)
+	}
+
+	r.Remember("0ld-dr1ve")
+	if got := paths(); got != nil {
+		t.Errorf("remembered drive is gone, still probed %v", got)
+	}
+	if r.Array() != nil {
+		t.Error("a single drive remembered as a mirror")
+	}
+
+	// A mirror's members are not data drives of their own
+	r.RememberArray(&Array{UUID: "0d6f3c52", ArrayUUID: "3f1c2a8e:5b7d9e01"})
+	if a := r.Array(); a == nil || a.Device != ArrayDevice || a.UUID != "0d6f3c52" || a.ArrayUUID != "3f1c2a8e:5b7d9e01" {
+		t.Errorf("remembered mirror: %+v", a)
+	}
+	if got := paths(); got != nil {
+		t.Errorf("mirror remembered, still probed %v", got)
+	}
+}
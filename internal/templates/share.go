@@ -0,0 +1,78 @@
+package templates
+
+// SharePage is the public landing page for a share link. It is rendered with
+// html/template, so every field is escaped.
+const SharePage = `
+<!DOCTYPE html>
+<html lang="en">
+<head>
+    <meta charset="UTF-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <meta name="robots" content="noindex">
+    <title>{{.Name}} - Strct</title>
+    <style>
+        :root {
+            --bg-color: #e3e1db;
+            --text-main: #1d1d1f;
+            --text-sub: #555;
+            --accent-yellow: #ffc233;
+            --card-bg: rgba(240, 239, 237, 0.8);
+        }
+        * { box-sizing: border-box; margin: 0; padding: 0; }
+        body {
+            font-family: -apple-system, BlinkMacSystemFont, "Segoe UI", Roboto, Helvetica, Arial, sans-serif;
+            background: var(--bg-color);
+            color: var(--text-main);
+            min-height: 100vh;
+            display: flex;
+            justify-content: center;
+            padding: 48px 16px;
+        }
+        .card { background: var(--card-bg); border-radius: 16px; padding: 32px; width: 100%; max-width: 640px; }
+        h1 { font-size: 22px; margin-bottom: 4px; word-break: break-all; }
+        .sub { color: var(--text-sub); font-size: 14px; margin-bottom: 24px; }
+        ul { list-style: none; }
+        li { display: flex; justify-content: space-between; padding: 10px 0; border-bottom: 1px solid rgba(0,0,0,0.06); }
+        a { color: var(--text-main); }
+        .btn, button { background: var(--accent-yellow); border: 0; border-radius: 8px; padding: 10px 18px; font-weight: 600; cursor: pointer; text-decoration: none; display: inline-block; }
+        input[type=password], input[type=file] { width: 100%; padding: 10px; margin-bottom: 12px; border-radius: 8px; border: 1px solid #ccc; }
+        .error { color: #b00020; margin-bottom: 12px; }
+        .ok { color: #1b7f3b; margin-bottom: 12px; }
+    </style>
+</head>
+<body>
+<div class="card">
+    <h1>{{.Name}}</h1>
+    {{if .NeedPassword}}
+        <p class="sub">This link is password protected.</p>
+        {{if .Error}}<p class="error">{{.Error}}</p>{{end}}
+        <form method="POST" action="{{.Base}}">
+            <input type="password" name="password" placeholder="Password" autofocus>
+            <button type="submit">Open</button>
+        </form>
+    {{else if .Drop}}
+        <p class="sub">Upload files for the owner of this link. You will not be able to see other uploads.</p>
+        {{if .Error}}<p class="error">{{.Error}}</p>{{end}}
+        {{if .Message}}<p class="ok">{{.Message}}</p>{{end}}
+        <form method="POST" action="{{.Base}}/upload" enctype="multipart/form-data">
+            <input type="file" name="file" multiple required>
+            <button type="submit">Upload</button>
+        </form>
+    {{else if .IsDir}}
+        <p class="sub">{{len .Files}} item(s){{if .Expires}} &middot; expires {{.Expires}}{{end}}</p>
+        <ul>
+        {{range .Files}}
+            <li>
+                {{if .IsDir}}<a href="{{$.Base}}?path={{.Path}}">{{.Name}}/</a><span></span>
+                {{else}}<a href="{{$.Base}}/dl?path={{.Path}}">{{.Name}}</a><span class="sub">{{.Size}}</span>{{end}}
+            </li>
+        {{end}}
+        </ul>
+    {{else}}
+        <p class="sub">{{.Size}}{{if .Expires}} &middot; expires {{.Expires}}{{end}}</p>
+        <a class="btn" href="{{.Base}}/dl">Download</a>
+    {{end}}
+</div>
+</body>
+</html>
+`
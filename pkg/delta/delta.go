@@ -0,0 +1,522 @@
+// Package delta implements rsync-style block deltas.
+//
+// The side that holds the old copy of a file describes it with a Signature:
+// one weak rolling checksum and one strong hash per fixed-size block. The
+// side that holds the new copy slides a window over it byte by byte and
+// emits a Delta made of "copy block i" instructions wherever a window
+// matches a block of the old file, and literal bytes everywhere else. The
+// old side then rebuilds the new file with Apply. Only the changed regions
+// and the signature cross the wire.
+package delta
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+const (
+	MinBlockSize = 1 << 10
+	MaxBlockSize = 1 << 17
+
+	// maxLiteral bounds how much unmatched data is buffered before it is
+	// written out as a literal.
+	maxLiteral = 1 << 16
+
+	strongSize = 16
+)
+
+var (
+	ErrFormat    = errors.New("delta: malformed stream")
+	ErrTooLarge  = errors.New("delta: result is larger than allowed")
+	ErrBlockSize = fmt.Errorf("delta: block size must be between %d and %d", MinBlockSize, MaxBlockSize)
+)
+
+// BlockSizeFor picks a block size for a file of the given size: roughly the
+// square root, like rsync, so the signature and the expected amount of
+// resent data grow together.
+func BlockSizeFor(size int64) int {
+	bs := int(math.Sqrt(float64(size))) &^ 7
+	return min(max(bs, MinBlockSize), MaxBlockSize)
+}
+
+// Block describes one block of the old file.
+type Block struct {
+	Weak   uint32 `json:"w"`
+	Strong []byte `json:"s"` // truncated SHA-256
+}
+
+// Signature describes a whole file in blocks of BlockSize bytes. The last
+// block may be shorter.
+type Signature struct {
+	BlockSize int     `json:"blockSize"`
+	Size      int64   `json:"size"`
+	Blocks    []Block `json:"blocks"`
+}
+
+// Sign reads r to the end and returns its signature.
+func Sign(r io.Reader, blockSize int) (*Signature, error) {
+	if blockSize < MinBlockSize || blockSize > MaxBlockSize {
+		return nil, ErrBlockSize
+	}
+	sig := &Signature{BlockSize: blockSize}
+	buf := make([]byte, blockSize)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			sig.Blocks = append(sig.Blocks, Block{Weak: weakSum(buf[:n]), Strong: strongSum(buf[:n])})
+			sig.Size += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return sig, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Validate rejects signatures Delta cannot work with, such as ones that
+// arrived malformed over the network.
+func (s *Signature) Validate() error {
+	if s.BlockSize < MinBlockSize || s.BlockSize > MaxBlockSize {
+		return ErrBlockSize
+	}
+	for _, b := range s.Blocks {
+		if len(b.Strong) != strongSize {
+			return fmt.Errorf("delta: strong hash must be %d bytes", strongSize)
+		}
+	}
+	return nil
+}
+
+// lastLen is the length of the final block, which may be short.
+func (s *Signature) lastLen() int {
+	if len(s.Blocks) == 0 {
+		return 0
+	}
+	return int(s.Size - int64(len(s.Blocks)-1)*int64(s.BlockSize))
+}
+
+func strongSum(p []byte) []byte {
+	sum := sha256.Sum256(p)
+	return sum[:strongSize]
+}
+
+// weakSum is the rsync rolling checksum: a is the byte sum, b weights every
+// byte by its distance from the end of the window.
+func weakSum(p []byte) uint32 {
+	var a, b uint32
+	l := uint32(len(p))
+	for i, c := range p {
+		a += uint32(c)
+		b += (l - uint32(i)) * uint32(c)
+	}
+	return a&0xffff | b<<16
+}
+
+// rolling maintains weakSum over a window that slides one byte at a time.
+type rolling struct {
+	a, b uint32
+	l    uint32
+}
+
+func newRolling(p []byte) rolling {
+	r := rolling{l: uint32(len(p))}
+	for i, c := range p {
+		r.a += uint32(c)
+		r.b += (r.l - uint32(i)) * uint32(c)
+	}
+	return r
+}
+
+func (r *rolling) roll(out, in byte) {
+	r.a += uint32(in) - uint32(out)
+	r.b += r.a - r.l*uint32(out)
+}
+
+func (r *rolling) sum() uint32 {
+	return r.a&0xffff | r.b<<16
+}
+
+// Wire format of a delta stream:
+//
+//	"SDLT1" uvarint(blockSize)
+//	'C' uvarint(first block) uvarint(count)   copy blocks from the old file
+//	'L' uvarint(n) n bytes                    literal data
+//	'E'                                       end
+const magic = "SDLT1"
+
+const (
+	opCopy    = 'C'
+	opLiteral = 'L'
+	opEnd     = 'E'
+)
+
+// Writer encodes delta instructions, merging runs of consecutive blocks.
+type Writer struct {
+	w         *bufio.Writer
+	blockSize int
+	started   bool
+	run       [2]uint64 // first block, count
+}
+
+func NewWriter(w io.Writer, blockSize int) *Writer {
+	return &Writer{w: bufio.NewWriter(w), blockSize: blockSize}
+}
+
+func (w *Writer) header() error {
+	if w.started {
+		return nil
+	}
+	w.started = true
+	if _, err := w.w.WriteString(magic); err != nil {
+		return err
+	}
+	return w.uvarint(uint64(w.blockSize))
+}
+
+func (w *Writer) uvarint(v uint64) error {
+	var buf [binary.MaxVarintLen64]byte
+	_, err := w.w.Write(buf[:binary.PutUvarint(buf[:], v)])
+	return err
+}
+
+// Copy emits an instruction to copy block i of the old file.
+func (w *Writer) Copy(i int) error {
+	if w.run[1] > 0 && w.run[0]+w.run[1] == uint64(i) {
+		w.run[1]++
+		return nil
+	}
+	if err := w.flushRun(); err != nil {
+		return err
+	}
+	w.run = [2]uint64{uint64(i), 1}
+	return nil
+}
+
+func (w *Writer) flushRun() error {
+	if err := w.header(); err != nil {
+		return err
+	}
+	if w.run[1] == 0 {
+		return nil
+	}
+	w.w.WriteByte(opCopy)
+	w.uvarint(w.run[0])
+	err := w.uvarint(w.run[1])
+	w.run = [2]uint64{}
+	return err
+}
+
+// Literal emits bytes that are not in the old file.
+func (w *Writer) Literal(p []byte) error {
+	if len(p) == 0 {
+		return nil
+	}
+	if err := w.flushRun(); err != nil {
+		return err
+	}
+	w.w.WriteByte(opLiteral)
+	w.uvarint(uint64(len(p)))
+	_, err := w.w.Write(p)
+	return err
+}
+
+// Close ends the stream. It does not close the underlying writer.
+func (w *Writer) Close() error {
+	if err := w.flushRun(); err != nil {
+		return err
+	}
+	w.w.WriteByte(opEnd)
+	return w.w.Flush()
+}
+
+// Delta reads the new file from r and writes the instructions that turn the
+// file described by sig into it. A nil or empty signature produces a delta
+// that is all literal, which is how whole files are sent.
+func Delta(sig *Signature, r io.Reader, out io.Writer) error {
+	if sig == nil {
+		sig = &Signature{BlockSize: MinBlockSize}
+	}
+	if err := sig.Validate(); err != nil {
+		return err
+	}
+	w := NewWriter(out, sig.BlockSize)
+
+	byWeak := make(map[uint32][]int, len(sig.Blocks))
+	for i, b := range sig.Blocks {
+		byWeak[b.Weak] = append(byWeak[b.Weak], i)
+	}
+	bs, lastLen := sig.BlockSize, sig.lastLen()
+	match := func(window []byte, weak uint32) int {
+		var strong []byte
+		for _, i := range byWeak[weak] {
+			want := bs
+			if i == len(sig.Blocks)-1 {
+				want = lastLen
+			}
+			if want != len(window) {
+				continue
+			}
+			if strong == nil {
+				strong = strongSum(window)
+			}
+			if bytes.Equal(strong, sig.Blocks[i].Strong) {
+				return i
+			}
+		}
+		return -1
+	}
+
+	var literal []byte
+	sl := newSlider(r, bs)
+	if err := sl.next(bs); err != nil {
+		return err
+	}
+	window := sl.window()
+	sum := newRolling(window)
+	for len(window) > 0 {
+		if len(byWeak) > 0 {
+			if i := match(window, sum.sum()); i >= 0 {
+				if err := w.Literal(literal); err != nil {
+					return err
+				}
+				literal = literal[:0]
+				if err := w.Copy(i); err != nil {
+					return err
+				}
+				if err := sl.next(bs); err != nil {
+					return err
+				}
+				window = sl.window()
+				sum = newRolling(window)
+				continue
+			}
+		}
+
+		out, in, ok, err := sl.slide()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			// No more input to roll in: the tail can still match the short
+			// last block, so drop bytes until it has that length. Anything
+			// longer or shorter can only go out as a literal.
+			if len(window) > lastLen && lastLen > 0 && lastLen < bs {
+				drop := len(window) - lastLen
+				literal = append(literal, window[:drop]...)
+				sl.drop(drop)
+				window = sl.window()
+				sum = newRolling(window)
+				if match(window, sum.sum()) >= 0 {
+					continue
+				}
+			}
+			literal = append(literal, window...)
+			break
+		}
+		literal = append(literal, out)
+		window = sl.window()
+		sum.roll(out, in)
+
+		if len(literal) >= maxLiteral {
+			if err := w.Literal(literal); err != nil {
+				return err
+			}
+			literal = literal[:0]
+		}
+	}
+	if err := w.Literal(literal); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+// slider is a window of up to a block that slides over r a byte at a
+// time. The window is a slice of a larger buffer, so a slide only moves
+// offsets; the buffer is compacted once every few blocks, not per byte.
+type slider struct {
+	r    io.Reader
+	buf  []byte
+	n    int // buf[:n] has been read
+	off  int // the window is buf[off : off+size]
+	size int
+	eof  bool
+}
+
+func newSlider(r io.Reader, bs int) *slider {
+	return &slider{r: r, buf: make([]byte, 4*bs)}
+}
+
+func (s *slider) window() []byte { return s.buf[s.off : s.off+s.size] }
+
+// fill reads until k bytes from off on are buffered, or r runs out.
+func (s *slider) fill(k int) error {
+	for s.n-s.off < k && !s.eof {
+		if s.n == len(s.buf) {
+			s.n = copy(s.buf, s.buf[s.off:s.n])
+			s.off = 0
+		}
+		m, err := s.r.Read(s.buf[s.n:])
+		s.n += m
+		if err == io.EOF {
+			s.eof = true
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// next starts a fresh window of up to bs bytes after the current one.
+func (s *slider) next(bs int) error {
+	s.off += s.size
+	s.size = 0
+	if err := s.fill(bs); err != nil {
+		return err
+	}
+	s.size = min(bs, s.n-s.off)
+	return nil
+}
+
+// slide moves the window on by one byte and returns the byte that left and
+// the one that came in. ok is false once there is nothing left to roll in.
+func (s *slider) slide() (out, in byte, ok bool, err error) {
+	if err := s.fill(s.size + 1); err != nil {
+		return 0, 0, false, err
+	}
+	if s.n-s.off <= s.size {
+		return 0, 0, false, nil
+	}
+	out, in = s.buf[s.off], s.buf[s.off+s.size]
+	s.off++
+	return out, in, true, nil
+}
+
+// drop shrinks the window by k bytes at the front.
+func (s *slider) drop(k int) {
+	s.off += k
+	s.size -= k
+}
+
+// Apply rebuilds the new file from the old one and a delta stream, writing
+// the result to out.
+func Apply(old io.ReaderAt, delta io.Reader, out io.Writer) error {
+	return ApplyLimit(old, delta, out, -1)
+}
+
+// ApplyLimit is Apply for a delta from someone untrusted: a few bytes of
+// copy instructions can rebuild an arbitrarily large file, so it stops
+// with ErrTooLarge before writing more than limit bytes. A negative limit
+// means no limit.
+func ApplyLimit(old io.ReaderAt, delta io.Reader, out io.Writer, limit int64) error {
+	if limit >= 0 {
+		out = &cappedWriter{w: out, left: limit}
+	}
+	br := bufio.NewReader(delta)
+	head := make([]byte, len(magic))
+	if _, err := io.ReadFull(br, head); err != nil || string(head) != magic {
+		return ErrFormat
+	}
+	bs, err := binary.ReadUvarint(br)
+	if err != nil || bs < MinBlockSize || bs > MaxBlockSize {
+		return ErrFormat
+	}
+	buf := make([]byte, bs)
+
+	for {
+		op, err := br.ReadByte()
+		if err != nil {
+			return ErrFormat
+		}
+		switch op {
+		case opEnd:
+			return nil
+		case opCopy:
+			first, err1 := binary.ReadUvarint(br)
+			count, err2 := binary.ReadUvarint(br)
+			if err1 != nil || err2 != nil || count == 0 || first > math.MaxInt64/bs {
+				return ErrFormat
+			}
+			for i := first; i < first+count; i++ {
+				n, err := old.ReadAt(buf, int64(i*bs))
+				if n == 0 || (err != nil && err != io.EOF) {
+					return fmt.Errorf("delta: block %d is not in the base file", i)
+				}
+				if _, err := out.Write(buf[:n]); err != nil {
+					return err
+				}
+			}
+		case opLiteral:
+			n, err := binary.ReadUvarint(br)
+			if err != nil {
+				return ErrFormat
+			}
+			if _, err := io.CopyN(out, br, int64(n)); err != nil {
+				if err == ErrTooLarge {
+					return err
+				}
+				return ErrFormat
+			}
+		default:
+			return ErrFormat
+		}
+	}
+}
+
+type cappedWriter struct {
+	w    io.Writer
+	left int64
+}
+
+func (c *cappedWriter) Write(p []byte) (int, error) {
+	if int64(len(p)) > c.left {
+		return 0, ErrTooLarge
+	}
+	c.left -= int64(len(p))
+	return c.w.Write(p)
+}
+
+// Join presents several files one after the other as a single base for
+// Sign and Apply. A transfer that was cut short can then resume: the part
+// that already arrived, followed by the previous version, covers most of
+// the new content, so only the rest goes over the wire again.
+func Join(parts ...*io.SectionReader) *io.SectionReader {
+	var size int64
+	for _, p := range parts {
+		size += p.Size()
+	}
+	return io.NewSectionReader(joined(parts), 0, size)
+}
+
+type joined []*io.SectionReader
+
+func (j joined) ReadAt(p []byte, off int64) (int, error) {
+	n := 0
+	for _, part := range j {
+		if len(p) == 0 {
+			break
+		}
+		if off >= part.Size() {
+			off -= part.Size()
+			continue
+		}
+		m, err := part.ReadAt(p[:min(int64(len(p)), part.Size()-off)], off)
+		n += m
+		if err != nil && err != io.EOF {
+			return n, err
+		}
+		p = p[m:]
+		off = 0
+	}
+	if len(p) > 0 {
+		return n, io.EOF
+	}
+	return n, nil
+}
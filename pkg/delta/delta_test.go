@@ -0,0 +1,201 @@
+package delta
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math/rand"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func randomBytes(seed int64, n int) []byte {
+	b := make([]byte, n)
+	rand.New(rand.NewSource(seed)).Read(b)
+	return b
+}
+
+func concat(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+func TestDeltaRoundTrip(t *testing.T) {
+	const bs = MinBlockSize
+	base := randomBytes(1, 20*bs+300)
+
+	tests := []struct {
+		name string
+		old  []byte
+		new  []byte
+		// maxLiteral bounds the literal bytes the delta may carry, which is
+		// the point of the exercise
+		maxLiteral int
+	}{
+		{"identical", base, base, 0},
+		{"empty old file", nil, base, len(base)},
+		{"empty new file", base, nil, 0},
+		{"byte inserted in the middle", base, concat(base[:5*bs+17], []byte{'x'}, base[5*bs+17:]), bs + 1},
+		{"block removed", base, concat(base[:3*bs], base[4*bs:]), 0},
+		{"appended", base, concat(base, []byte("tail data")), bs},
+		{"prepended", base, concat([]byte("header"), base), 6},
+		{"short last block moves", base, concat(base[:2*bs], base[20*bs:]), 0},
+		{"blocks reordered", base, concat(base[10*bs:12*bs], base[:10*bs], base[12*bs:]), 0},
+		{"everything changed", base, randomBytes(2, len(base)), len(base)},
+		{"smaller than a block", []byte("hello world"), []byte("hello, world"), 12},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sig, err := Sign(bytes.NewReader(tt.old), bs)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var d bytes.Buffer
+			if err := Delta(sig, bytes.NewReader(tt.new), &d); err != nil {
+				t.Fatal(err)
+			}
+			// Short reads make no difference to the delta
+			var slow bytes.Buffer
+			if err := Delta(sig, iotest.OneByteReader(bytes.NewReader(tt.new)), &slow); err != nil || !bytes.Equal(slow.Bytes(), d.Bytes()) {
+				t.Errorf("delta from one-byte reads differs: %v", err)
+			}
+			var out bytes.Buffer
+			if err := Apply(bytes.NewReader(tt.old), bytes.NewReader(d.Bytes()), &out); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(out.Bytes(), tt.new) {
+				t.Fatalf("rebuilt %d bytes, want %d", out.Len(), len(tt.new))
+			}
+			if lit := literalBytes(t, d.Bytes()); lit > tt.maxLiteral {
+				t.Errorf("delta carries %d literal bytes, want at most %d", lit, tt.maxLiteral)
+			}
+		})
+	}
+}
+
+// literalBytes decodes a delta stream and counts the bytes it carries as
+// literals rather than block copies.
+func literalBytes(t *testing.T, d []byte) int {
+	t.Helper()
+	r := bufio.NewReader(bytes.NewReader(d[len(magic):]))
+	binary.ReadUvarint(r)
+	n := 0
+	for {
+		op, err := r.ReadByte()
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch op {
+		case opEnd:
+			return n
+		case opCopy:
+			binary.ReadUvarint(r)
+			binary.ReadUvarint(r)
+		case opLiteral:
+			l, _ := binary.ReadUvarint(r)
+			r.Discard(int(l))
+			n += int(l)
+		}
+	}
+}
+
+func TestApplyRejectsBadStreams(t *testing.T) {
+	var valid bytes.Buffer
+	Delta(nil, strings.NewReader("abc"), &valid)
+
+	tests := []struct {
+		name   string
+		stream []byte
+	}{
+		{"empty", nil},
+		{"wrong magic", []byte("NOPE1")},
+		{"truncated", valid.Bytes()[:valid.Len()-2]},
+		{"unknown op", append([]byte(magic), 0x80, 0x08, 'X')},
+		{"copy past the end", append([]byte(magic), 0x80, 0x08, opCopy, 5, 1, opEnd)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := Apply(bytes.NewReader(nil), bytes.NewReader(tt.stream), &bytes.Buffer{}); err == nil {
+				t.Error("Apply succeeded")
+			}
+		})
+	}
+}
+
+func TestApplyLimit(t *testing.T) {
+	old := randomBytes(1, MinBlockSize)
+	sig, _ := Sign(bytes.NewReader(old), MinBlockSize)
+
+	// A handful of bytes of copy instructions rebuild a lot more
+	var d bytes.Buffer
+	w := NewWriter(&d, MinBlockSize)
+	for range 100 {
+		w.Copy(0)
+		w.Literal([]byte("x"))
+	}
+	w.Close()
+	want := 100 * (MinBlockSize + 1)
+
+	if err := ApplyLimit(bytes.NewReader(old), bytes.NewReader(d.Bytes()), io.Discard, int64(want-1)); err != ErrTooLarge {
+		t.Errorf("one byte over the limit: %v", err)
+	}
+	var out bytes.Buffer
+	if err := ApplyLimit(bytes.NewReader(old), bytes.NewReader(d.Bytes()), &out, int64(want)); err != nil || out.Len() != want {
+		t.Errorf("at the limit: %v, %d bytes", err, out.Len())
+	}
+
+	// A literal is cut off the same way
+	d.Reset()
+	Delta(sig, bytes.NewReader(randomBytes(2, 5000)), &d)
+	if err := ApplyLimit(bytes.NewReader(old), bytes.NewReader(d.Bytes()), io.Discard, 4999); err != ErrTooLarge {
+		t.Errorf("literal over the limit: %v", err)
+	}
+}
+
+func TestBlockSizeFor(t *testing.T) {
+	tests := []struct {
+		size int64
+		want int
+	}{
+		{0, MinBlockSize},
+		{1 << 20, MinBlockSize},
+		{1 << 30, 32768},
+		{1 << 40, MaxBlockSize},
+	}
+	for _, tt := range tests {
+		if got := BlockSizeFor(tt.size); got != tt.want {
+			t.Errorf("BlockSizeFor(%d) = %d, want %d", tt.size, got, tt.want)
+		}
+	}
+}
+
+func TestJoinResumes(t *testing.T) {
+	const bs = MinBlockSize
+	old := randomBytes(3, 30*bs)
+	newer := concat(randomBytes(4, 10*bs+123), old)
+	partial := newer[:7*bs+55]
+
+	base := Join(io.NewSectionReader(bytes.NewReader(partial), 0, int64(len(partial))),
+		io.NewSectionReader(bytes.NewReader(old), 0, int64(len(old))))
+	sig, err := Sign(base, bs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var d bytes.Buffer
+	if err := Delta(sig, bytes.NewReader(newer), &d); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err := Apply(base, bytes.NewReader(d.Bytes()), &out); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), newer) {
+		t.Fatal("rebuilt content differs")
+	}
+	// Only what neither the partial nor the old version holds is resent
+	if lit := literalBytes(t, d.Bytes()); lit > 3*bs+123+bs {
+		t.Errorf("resume sent %d literal bytes", lit)
+	}
+}
@@ -0,0 +1,272 @@
+// Package syncclient is a reference client for the agent's two-way sync
+// protocol (/api/sync/*). Client wraps the individual endpoints; Syncer
+// keeps a local folder and the agent's DataDir in step using them.
+//
+// The protocol in short: the agent keeps a change journal in which every
+// file has a version that grows with each change. A client remembers the
+// journal cursor and the version it last saw of each file, asks for the
+// changes since that cursor, and makes its own writes conditional on the
+// version they started from. File content moves as rsync-style deltas
+// (see package delta) in both directions, so editing a few bytes of a
+// large file sends about that much.
+package syncclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/strct-org/strct-agent/pkg/delta"
+)
+
+// Entry mirrors the agent's journal entry for one file.
+type Entry struct {
+	Version int64     `json:"version"`
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modifiedAt"`
+	SHA256  string    `json:"sha256,omitempty"`
+	Deleted bool      `json:"deleted,omitempty"`
+}
+
+// Changes is one page of the change journal.
+type Changes struct {
+	Changes []Entry `json:"changes"`
+	Cursor  int64   `json:"cursor"`
+	More    bool    `json:"more"`
+	Reset   bool    `json:"reset"`
+	Pending int     `json:"pending"`
+}
+
+// ConflictError is returned when a conditional write lost: the file on the
+// agent is no longer at the version the change started from.
+type ConflictError struct {
+	Path    string
+	Current *Entry
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("sync: %s changed on the server", e.Path)
+}
+
+// ErrNotFound is returned for files the agent does not have.
+var ErrNotFound = errors.New("sync: file not found on the server")
+
+// Client calls the sync endpoints of one agent. HTTP may carry whatever
+// authentication the agent sits behind; nil means http.DefaultClient.
+// With Root set the client works inside that folder of the agent's
+// DataDir, and all paths are relative to it.
+type Client struct {
+	BaseURL string
+	HTTP    *http.Client
+	Device  string // names conflict copies, e.g. "laptop"
+	Root    string
+}
+
+func (c *Client) http() *http.Client {
+	if c.HTTP != nil {
+		return c.HTTP
+	}
+	return http.DefaultClient
+}
+
+func (c *Client) url(endpoint string, q url.Values) string {
+	if c.Root != "" {
+		q.Set("root", c.Root)
+	}
+	return strings.TrimSuffix(c.BaseURL, "/") + "/api/sync/" + endpoint + "?" + q.Encode()
+}
+
+func (c *Client) do(ctx context.Context, method, u string, body io.Reader, contentType string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	return c.http().Do(req)
+}
+
+// Changes fetches one page of changes after cursor. Cursor 0 lists every
+// file.
+func (c *Client) Changes(ctx context.Context, cursor int64) (*Changes, error) {
+	resp, err := c.do(ctx, http.MethodGet, c.url("changes", url.Values{"cursor": {strconv.FormatInt(cursor, 10)}}), nil, "")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if err := checkStatus(resp, ""); err != nil {
+		return nil, err
+	}
+	var page Changes
+	if err := json.NewDecoder(resp.Body).Decode(&page); err != nil {
+		return nil, err
+	}
+	return &page, nil
+}
+
+// Signature describes the agent's copy of a file, for computing an upload
+// delta against it. Given the digest of the content about to be uploaded
+// it also covers whatever an interrupted upload of that content left on
+// the agent; the upload must then be sent with resume set. The entry has
+// version 0 when only such leftovers exist.
+func (c *Client) Signature(ctx context.Context, path, sum string) (*Entry, *delta.Signature, error) {
+	q := url.Values{"path": {path}}
+	if sum != "" {
+		q.Set("sha256", sum)
+	}
+	resp, err := c.do(ctx, http.MethodGet, c.url("signature", q), nil, "")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	if err := checkStatus(resp, path); err != nil {
+		return nil, nil, err
+	}
+	var out struct {
+		Entry     Entry            `json:"entry"`
+		Signature *delta.Signature `json:"signature"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return nil, nil, err
+	}
+	return &out.Entry, out.Signature, nil
+}
+
+// Download describes a file fetched with Client.Download.
+type Download struct {
+	Version int64
+	SHA256  string
+	Bytes   int64 // delta bytes on the wire
+}
+
+// Download fetches the agent's copy of path as a delta against old, which
+// sig describes (nil for a whole-file download), and writes the rebuilt
+// file to dst. Checking dst against the returned digest is up to the
+// caller.
+func (c *Client) Download(ctx context.Context, path string, sig *delta.Signature, old io.ReaderAt, dst io.Writer) (*Download, error) {
+	var body bytes.Buffer
+	if sig != nil {
+		if err := json.NewEncoder(&body).Encode(sig); err != nil {
+			return nil, err
+		}
+	}
+	if old == nil {
+		old = bytes.NewReader(nil)
+	}
+	resp, err := c.do(ctx, http.MethodPost, c.url("download", url.Values{"path": {path}}), &body, "application/json")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if err := checkStatus(resp, path); err != nil {
+		return nil, err
+	}
+	d := &Download{SHA256: parseReprDigest(resp.Header.Get("Repr-Digest"))}
+	d.Version, _ = strconv.ParseInt(resp.Header.Get("X-Sync-Version"), 10, 64)
+	if err := delta.Apply(old, &countingReader{r: resp.Body, n: &d.Bytes}, dst); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// Upload sends a delta (against the agent's copy at version base, or
+// against nothing when base is 0) that produces content with the given
+// size and SHA-256. With conflict set the content is stored as a conflict
+// copy next to path instead, and the returned entry names it. resume says
+// the delta is against a signature fetched with sum.
+func (c *Client) Upload(ctx context.Context, path string, base int64, sum string, size int64, d io.Reader, conflict, resume bool) (*Entry, error) {
+	q := url.Values{
+		"path":   {path},
+		"base":   {strconv.FormatInt(base, 10)},
+		"sha256": {sum},
+		"size":   {strconv.FormatInt(size, 10)},
+	}
+	if conflict {
+		q.Set("conflict", "1")
+		q.Set("device", c.Device)
+	}
+	if resume {
+		q.Set("resume", "1")
+	}
+	resp, err := c.do(ctx, http.MethodPost, c.url("upload", q), d, "application/vnd.strct.delta")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return decodeEntry(resp, path)
+}
+
+// Delete removes path if the agent's copy is still at version base.
+func (c *Client) Delete(ctx context.Context, path string, base int64) (*Entry, error) {
+	q := url.Values{"path": {path}, "base": {strconv.FormatInt(base, 10)}}
+	resp, err := c.do(ctx, http.MethodPost, c.url("delete", q), nil, "")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return decodeEntry(resp, path)
+}
+
+func decodeEntry(resp *http.Response, path string) (*Entry, error) {
+	if err := checkStatus(resp, path); err != nil {
+		return nil, err
+	}
+	var e Entry
+	if err := json.NewDecoder(resp.Body).Decode(&e); err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+func checkStatus(resp *http.Response, path string) error {
+	switch {
+	case resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode == http.StatusNotFound:
+		return ErrNotFound
+	case resp.StatusCode == http.StatusConflict:
+		var body struct {
+			Current *Entry `json:"current"`
+		}
+		json.NewDecoder(resp.Body).Decode(&body)
+		return &ConflictError{Path: path, Current: body.Current}
+	}
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("sync: %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+}
+
+// parseReprDigest turns "sha-256=:base64:" into hex.
+func parseReprDigest(v string) string {
+	alg, val, ok := strings.Cut(v, "=")
+	if !ok || !strings.EqualFold(alg, "sha-256") {
+		return ""
+	}
+	raw, err := base64.StdEncoding.DecodeString(strings.Trim(val, ":"))
+	if err != nil {
+		return ""
+	}
+	return hex.EncodeToString(raw)
+}
+
+type countingReader struct {
+	r io.Reader
+	n *int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	*c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,634 @@
+package syncclient
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/strct-org/strct-agent/pkg/delta"
+)
+
+const (
+	// StateFile is where a Syncer keeps its state unless told otherwise.
+	StateFile = ".strct-sync.json"
+
+	tempPrefix = ".strct-sync-"
+	// agentTempPrefix marks the agent's own staged uploads; they never
+	// appear in the journal and are not synced back either.
+	agentTempPrefix = ".strct-upload-"
+
+	// Transfers of at least minResumeSize bytes that break off are picked
+	// up where they stopped: the agent keeps what it received of an
+	// upload, and a download keeps what arrived in a partial file.
+	minResumeSize = 1 << 20
+)
+
+// Direction says which way a Syncer copies changes.
+type Direction int
+
+const (
+	// TwoWay copies changes both ways and keeps conflicting edits.
+	TwoWay Direction = iota
+	// Push makes the agent's copies follow Dir. Local files overwrite
+	// and local deletions remove the agent's copies, whatever happened
+	// to them there; files only the agent has are left alone.
+	Push
+	// Pull is Push the other way round: Dir follows the agent.
+	Pull
+)
+
+// Syncer keeps Dir and the agent's DataDir in step. Each call to Sync
+// pulls the journal since the last run, compares it with what changed
+// locally, and moves files in whichever direction is needed:
+//
+//   - changed on one side only: copied to the other
+//   - deleted on one side, untouched on the other: deleted there too
+//   - deleted on one side, edited on the other: the edit wins
+//   - edited on both sides: the local edit is kept as a conflict copy
+//     named by the agent, and the agent's version takes the original name
+//
+// Only files are synced; folders follow from the files in them. Direction
+// turns this into a one-way copy.
+type Syncer struct {
+	Client    *Client
+	Dir       string
+	StatePath string // defaults to Dir/StateFile
+	Direction Direction
+}
+
+// Report lists what one Sync did. Paths are relative to Dir with forward
+// slashes.
+type Report struct {
+	Downloaded    []string
+	Uploaded      []string
+	DeletedLocal  []string
+	DeletedRemote []string
+	Conflicts     []string // conflict copies created for local edits
+	Sent          int64    // delta bytes uploaded
+	Received      int64    // delta bytes downloaded
+}
+
+type fileState struct {
+	Version int64     `json:"version"`
+	SHA256  string    `json:"sha256"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+}
+
+type syncState struct {
+	Cursor int64                `json:"cursor"`
+	Files  map[string]fileState `json:"files"`
+}
+
+type localFile struct {
+	Size    int64
+	ModTime time.Time
+	SHA256  string
+	Changed bool // differs from what was last synced
+}
+
+// Sync runs one round. On error the work done so far is kept and the next
+// round picks up from there.
+func (s *Syncer) Sync(ctx context.Context) (*Report, error) {
+	st, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+
+	remote, cursor, reset, err := s.pull(ctx, st.Cursor)
+	if err != nil {
+		return nil, err
+	}
+	if reset {
+		// The journal forgot some deletions: whatever it no longer lists is gone
+		for p := range st.Files {
+			if _, ok := remote[p]; !ok {
+				remote[p] = Entry{Path: p, Deleted: true}
+			}
+		}
+	}
+
+	local, err := s.scan(st)
+	if err != nil {
+		return nil, err
+	}
+
+	paths := make(map[string]bool)
+	for p := range remote {
+		paths[p] = true
+	}
+	for p := range local {
+		paths[p] = true
+	}
+	for p := range st.Files {
+		paths[p] = true
+	}
+	sorted := make([]string, 0, len(paths))
+	for p := range paths {
+		sorted = append(sorted, p)
+	}
+	sort.Strings(sorted)
+
+	rep := &Report{}
+	for _, p := range sorted {
+		if err := ctx.Err(); err != nil {
+			s.save(st)
+			return rep, err
+		}
+		if err := s.reconcile(ctx, st, p, remote, local, rep); err != nil {
+			s.save(st)
+			return rep, fmt.Errorf("sync %s: %w", p, err)
+		}
+	}
+
+	st.Cursor = cursor
+	return rep, s.save(st)
+}
+
+func (s *Syncer) reconcile(ctx context.Context, st *syncState, p string, remote map[string]Entry, local map[string]localFile, rep *Report) error {
+	switch s.Direction {
+	case Push:
+		return s.reconcilePush(ctx, st, p, remote, local, rep)
+	case Pull:
+		return s.reconcilePull(ctx, st, p, remote, local, rep)
+	}
+	known, hasKnown := st.Files[p]
+	r, hasRemote := remote[p]
+	l, hasLocal := local[p]
+
+	rChanged := hasRemote && (!hasKnown || r.Version != known.Version)
+	lChanged := hasLocal && l.Changed
+	lDeleted := hasKnown && !hasLocal
+
+	switch {
+	case lChanged && rChanged && !r.Deleted && r.SHA256 == l.SHA256:
+		// Both sides made the same change
+		st.Files[p] = fileState{Version: r.Version, SHA256: r.SHA256, Size: l.Size, ModTime: l.ModTime}
+		return nil
+
+	case lChanged && rChanged && !r.Deleted:
+		return s.resolveConflict(ctx, st, p, l, rep)
+
+	case lChanged:
+		var base int64
+		if hasKnown && !(rChanged && r.Deleted) {
+			base = known.Version
+		}
+		err := s.upload(ctx, st, p, l, base, rep)
+		var conflict *ConflictError
+		if errors.As(err, &conflict) {
+			return s.resolveConflict(ctx, st, p, l, rep)
+		}
+		return err
+
+	case lDeleted && rChanged:
+		if r.Deleted {
+			delete(st.Files, p)
+			return nil
+		}
+		return s.download(ctx, st, p, "", rep)
+
+	case lDeleted:
+		_, err := s.Client.Delete(ctx, p, known.Version)
+		var conflict *ConflictError
+		if errors.As(err, &conflict) {
+			// Edited on the agent after we last saw it: keep the edit
+			return s.download(ctx, st, p, "", rep)
+		}
+		if err != nil {
+			return err
+		}
+		delete(st.Files, p)
+		rep.DeletedRemote = append(rep.DeletedRemote, p)
+		return nil
+
+	case rChanged && r.Deleted:
+		if hasLocal {
+			if err := os.Remove(s.local(p)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			s.removeEmptyParents(p)
+			rep.DeletedLocal = append(rep.DeletedLocal, p)
+		}
+		delete(st.Files, p)
+		return nil
+
+	case rChanged:
+		return s.download(ctx, st, p, "", rep)
+	}
+	return nil
+}
+
+// reconcilePush makes the agent's copy of p match the local one.
+func (s *Syncer) reconcilePush(ctx context.Context, st *syncState, p string, remote map[string]Entry, local map[string]localFile, rep *Report) error {
+	known, hasKnown := st.Files[p]
+	r, hasRemote := remote[p]
+	l, hasLocal := local[p]
+	rChanged := hasRemote && (!hasKnown || r.Version != known.Version)
+
+	base := known.Version
+	if rChanged {
+		base = r.Version
+		if r.Deleted {
+			base = 0
+		}
+	}
+	switch {
+	case hasLocal && rChanged && !r.Deleted && r.SHA256 == l.SHA256:
+		st.Files[p] = fileState{Version: r.Version, SHA256: r.SHA256, Size: l.Size, ModTime: l.ModTime}
+		return nil
+
+	case hasLocal && (l.Changed || rChanged):
+		err := s.upload(ctx, st, p, l, base, rep)
+		var conflict *ConflictError
+		if errors.As(err, &conflict) {
+			// Changed again since the journal was read: overwrite that too
+			err = s.upload(ctx, st, p, l, currentVersion(conflict), rep)
+		}
+		return err
+
+	case !hasLocal && hasKnown:
+		if !(rChanged && r.Deleted) {
+			_, err := s.Client.Delete(ctx, p, base)
+			var conflict *ConflictError
+			if errors.As(err, &conflict) {
+				_, err = s.Client.Delete(ctx, p, currentVersion(conflict))
+			}
+			if err != nil {
+				return err
+			}
+			rep.DeletedRemote = append(rep.DeletedRemote, p)
+		}
+		delete(st.Files, p)
+	}
+	return nil
+}
+
+// reconcilePull makes the local copy of p match the agent's.
+func (s *Syncer) reconcilePull(ctx context.Context, st *syncState, p string, remote map[string]Entry, local map[string]localFile, rep *Report) error {
+	known, hasKnown := st.Files[p]
+	r, hasRemote := remote[p]
+	l, hasLocal := local[p]
+	rChanged := hasRemote && (!hasKnown || r.Version != known.Version)
+
+	switch {
+	case rChanged && r.Deleted:
+		if hasLocal && hasKnown {
+			if err := os.Remove(s.local(p)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			s.removeEmptyParents(p)
+			rep.DeletedLocal = append(rep.DeletedLocal, p)
+		}
+		delete(st.Files, p)
+		return nil
+
+	case rChanged && hasLocal && l.SHA256 == r.SHA256:
+		st.Files[p] = fileState{Version: r.Version, SHA256: r.SHA256, Size: l.Size, ModTime: l.ModTime}
+		return nil
+
+	case rChanged, hasKnown && (!hasLocal || l.Changed):
+		// New on the agent, or edited or removed here: fetch the agent's copy
+		return s.download(ctx, st, p, "", rep)
+	}
+	return nil
+}
+
+func currentVersion(c *ConflictError) int64 {
+	if c.Current == nil || c.Current.Deleted {
+		return 0
+	}
+	return c.Current.Version
+}
+
+// resolveConflict stores the local edit on the agent as a conflict copy,
+// moves the local file to the same name, and then fetches the agent's
+// version into the original path, using the copy as the delta base.
+func (s *Syncer) resolveConflict(ctx context.Context, st *syncState, p string, l localFile, rep *Report) error {
+	var e *Entry
+	err := s.sendDelta(p, nil, rep, func(d io.Reader) (err error) {
+		e, err = s.Client.Upload(ctx, p, 0, l.SHA256, l.Size, d, true, false)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	copyPath := s.local(e.Path)
+	if err := os.MkdirAll(filepath.Dir(copyPath), 0755); err != nil {
+		return err
+	}
+	if err := os.Rename(s.local(p), copyPath); err != nil {
+		return err
+	}
+	st.Files[e.Path] = fileState{Version: e.Version, SHA256: e.SHA256, Size: l.Size, ModTime: l.ModTime}
+	delete(st.Files, p)
+	rep.Conflicts = append(rep.Conflicts, e.Path)
+
+	return s.download(ctx, st, p, e.Path, rep)
+}
+
+// upload sends the local file as a delta against the agent's copy at
+// version base, and against what an earlier attempt left behind.
+func (s *Syncer) upload(ctx context.Context, st *syncState, p string, l localFile, base int64, rep *Report) error {
+	var sig *delta.Signature
+	resume := false
+	if base > 0 || l.Size >= minResumeSize {
+		cur, remoteSig, err := s.Client.Signature(ctx, p, l.SHA256)
+		switch {
+		case errors.Is(err, ErrNotFound):
+			// Deleted on the agent since the journal was read: recreate it
+			base = 0
+		case err != nil:
+			return err
+		case cur.Version != base:
+			return &ConflictError{Path: p, Current: cur}
+		default:
+			sig, resume = remoteSig, true
+		}
+	}
+
+	var e *Entry
+	err := s.sendDelta(p, sig, rep, func(d io.Reader) (err error) {
+		e, err = s.Client.Upload(ctx, p, base, l.SHA256, l.Size, d, false, resume)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	st.Files[p] = fileState{Version: e.Version, SHA256: e.SHA256, Size: l.Size, ModTime: l.ModTime}
+	rep.Uploaded = append(rep.Uploaded, p)
+	return nil
+}
+
+// sendDelta streams the delta of local file p against sig to send.
+func (s *Syncer) sendDelta(p string, sig *delta.Signature, rep *Report, send func(io.Reader) error) error {
+	f, err := os.Open(s.local(p))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	pr, pw := io.Pipe()
+	sent := make(chan int64, 1)
+	go func() {
+		var n int64
+		pw.CloseWithError(delta.Delta(sig, bufio.NewReader(f), &countingWriter{w: pw, n: &n}))
+		sent <- n
+	}()
+	err = send(pr)
+	// Unblocks the writer if send gave up early
+	pr.Close()
+	rep.Sent += <-sent
+	return err
+}
+
+// download fetches the agent's copy of p, sending the signature of basePath
+// (p itself when empty) so only the differences come back. What an
+// interrupted download of p left behind is part of the base too. The
+// result is checked against the agent's digest before it replaces
+// anything.
+func (s *Syncer) download(ctx context.Context, st *syncState, p, basePath string, rep *Report) error {
+	full := s.local(p)
+	if basePath == "" {
+		basePath = p
+	}
+	partial := partialPath(full)
+
+	var parts []*io.SectionReader
+	for _, name := range []string{partial, s.local(basePath)} {
+		f, err := os.Open(name)
+		if err != nil {
+			continue
+		}
+		defer f.Close()
+		if info, err := f.Stat(); err == nil && info.Mode().IsRegular() {
+			parts = append(parts, io.NewSectionReader(f, 0, info.Size()))
+		}
+	}
+	var sig *delta.Signature
+	var old io.ReaderAt
+	if len(parts) > 0 {
+		base := delta.Join(parts...)
+		var err error
+		if sig, err = delta.Sign(bufio.NewReader(base), delta.BlockSizeFor(base.Size())); err != nil {
+			return err
+		}
+		old = base
+	}
+
+	if err := os.MkdirAll(filepath.Dir(full), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(full), tempPrefix+"*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	h := sha256.New()
+	var written int64
+	d, err := s.Client.Download(ctx, p, sig, old, &countingWriter{w: io.MultiWriter(tmp, h), n: &written})
+	if errors.Is(err, ErrNotFound) {
+		// Gone again already; the next round sees the tombstone
+		tmp.Close()
+		os.Remove(partial)
+		delete(st.Files, p)
+		return nil
+	}
+	if err != nil {
+		tmp.Close()
+		// Keep what arrived for the next attempt, unless an earlier one got further
+		if info, serr := os.Stat(partial); written >= minResumeSize && (serr != nil || info.Size() < written) {
+			os.Rename(tmp.Name(), partial)
+		}
+		return err
+	}
+	rep.Received += d.Bytes
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if sum := hex.EncodeToString(h.Sum(nil)); sum != d.SHA256 {
+		return fmt.Errorf("downloaded content does not match SHA-256 %s", d.SHA256)
+	}
+	if err := os.Rename(tmp.Name(), full); err != nil {
+		return err
+	}
+	os.Remove(partial)
+	info, err := os.Stat(full)
+	if err != nil {
+		return err
+	}
+
+	st.Files[p] = fileState{Version: d.Version, SHA256: d.SHA256, Size: info.Size(), ModTime: info.ModTime()}
+	rep.Downloaded = append(rep.Downloaded, p)
+	return nil
+}
+
+// pull reads the journal from cursor to the end and keeps the latest
+// entry per path.
+func (s *Syncer) pull(ctx context.Context, cursor int64) (map[string]Entry, int64, bool, error) {
+	remote := make(map[string]Entry)
+	reset := false
+	for {
+		page, err := s.Client.Changes(ctx, cursor)
+		if err != nil {
+			return nil, 0, false, err
+		}
+		if page.Reset {
+			reset = true
+			remote = make(map[string]Entry)
+		}
+		for _, e := range page.Changes {
+			remote[e.Path] = e
+		}
+		cursor = page.Cursor
+		if !page.More {
+			return remote, cursor, reset, nil
+		}
+	}
+}
+
+// scan hashes local files that differ in size or mtime from the last sync
+// and reports which ones really changed.
+func (s *Syncer) scan(st *syncState) (map[string]localFile, error) {
+	local := make(map[string]localFile)
+	statePath := s.statePath()
+
+	err := filepath.WalkDir(s.Dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		name := d.Name()
+		if !d.Type().IsRegular() || p == statePath || strings.HasPrefix(name, tempPrefix) || strings.HasPrefix(name, agentTempPrefix) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(s.Dir, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+
+		lf := localFile{Size: info.Size(), ModTime: info.ModTime()}
+		known, ok := st.Files[rel]
+		if ok && known.Size == lf.Size && known.ModTime.Equal(lf.ModTime) {
+			lf.SHA256 = known.SHA256
+			local[rel] = lf
+			return nil
+		}
+		if !ok && s.Direction == Pull {
+			// Never sent anywhere, so there is no need to know its content
+			lf.Changed = true
+			local[rel] = lf
+			return nil
+		}
+		if lf.SHA256, err = hashFile(p); err != nil {
+			return err
+		}
+		lf.Changed = !ok || known.SHA256 != lf.SHA256
+		if ok && !lf.Changed {
+			// Touched but not modified
+			known.Size, known.ModTime = lf.Size, lf.ModTime
+			st.Files[rel] = known
+		}
+		local[rel] = lf
+		return nil
+	})
+	return local, err
+}
+
+func hashFile(p string) (string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// partialPath is where an interrupted download to full is kept.
+func partialPath(full string) string {
+	return filepath.Join(filepath.Dir(full), tempPrefix+filepath.Base(full)+".part")
+}
+
+func (s *Syncer) local(p string) string {
+	return filepath.Join(s.Dir, filepath.FromSlash(p))
+}
+
+// removeEmptyParents cleans up folders left empty by a remote deletion.
+func (s *Syncer) removeEmptyParents(p string) {
+	for dir := filepath.Dir(s.local(p)); dir != s.Dir && strings.HasPrefix(dir, s.Dir); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			return
+		}
+	}
+}
+
+func (s *Syncer) statePath() string {
+	if s.StatePath != "" {
+		return s.StatePath
+	}
+	return filepath.Join(s.Dir, StateFile)
+}
+
+func (s *Syncer) load() (*syncState, error) {
+	st := &syncState{Files: make(map[string]fileState)}
+	data, err := os.ReadFile(s.statePath())
+	if os.IsNotExist(err) {
+		return st, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, st); err != nil {
+		return nil, err
+	}
+	if st.Files == nil {
+		st.Files = make(map[string]fileState)
+	}
+	return st, nil
+}
+
+func (s *Syncer) save(st *syncState) error {
+	data, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	p := s.statePath()
+	tmp := filepath.Join(filepath.Dir(p), tempPrefix+filepath.Base(p))
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, p)
+}
+
+type countingWriter struct {
+	w io.Writer
+	n *int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	*c.n += int64(n)
+	return n, err
+}